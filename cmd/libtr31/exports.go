@@ -0,0 +1,41 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"unsafe"
+
+	"github.com/moov-io/tr31"
+)
+
+// The C ABI: every function takes a NUL terminated JSON request and returns a
+// NUL terminated JSON response allocated with malloc, released with tr31_free.
+// Failed calls return {"error":{"code":"...","message":"..."}}.
+
+//export tr31_wrap
+func tr31_wrap(request *C.char) *C.char {
+	return C.CString(string(call(wrap, []byte(C.GoString(request)))))
+}
+
+//export tr31_unwrap
+func tr31_unwrap(request *C.char) *C.char {
+	return C.CString(string(call(unwrap, []byte(C.GoString(request)))))
+}
+
+//export tr31_inspect
+func tr31_inspect(request *C.char) *C.char {
+	return C.CString(string(call(inspect, []byte(C.GoString(request)))))
+}
+
+//export tr31_version
+func tr31_version() *C.char {
+	return C.CString(tr31.Version)
+}
+
+//export tr31_free
+func tr31_free(response *C.char) {
+	C.free(unsafe.Pointer(response))
+}
@@ -0,0 +1,237 @@
+// Command libtr31 builds a C shared library exposing key block wrapping,
+// unwrapping and inspection to C, C++ and Java callers over a stable C ABI.
+// Every function takes a JSON request and returns a JSON response, which the
+// caller releases with tr31_free.
+//
+//	cd cmd && go build -buildmode=c-shared -o ../bin/libtr31.so ./libtr31
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+// Error codes of failed calls
+const (
+	ERROR_CODE_INVALID_REQUEST   = "invalid_request"
+	ERROR_CODE_INVALID_HEADER    = "invalid_header"
+	ERROR_CODE_INVALID_KEY_BLOCK = "invalid_key_block"
+	ERROR_CODE_INTERNAL          = "internal"
+)
+
+func main() {}
+
+type wrapRequest struct {
+	// KBPK is the hex Key Block Protection Key
+	KBPK string `json:"kbpk"`
+	// Header is the header the key is wrapped under, such as "D0000P0AE00E0000"
+	Header string `json:"header"`
+	// Key is the hex key to wrap
+	Key string `json:"key"`
+	// MaskedKeyLength pads the key to this length, the version default when zero
+	MaskedKeyLength int `json:"maskedKeyLength,omitempty"`
+	// Revision checks the header against a revision of the standard, see tr31.SpecRevision
+	Revision tr31.SpecRevision `json:"revision,omitempty"`
+}
+
+type wrapResponse struct {
+	KeyBlock string `json:"keyBlock"`
+	KCV      string `json:"kcv,omitempty"`
+}
+
+type unwrapRequest struct {
+	KBPK     string            `json:"kbpk"`
+	KeyBlock string            `json:"keyBlock"`
+	Revision tr31.SpecRevision `json:"revision,omitempty"`
+}
+
+type unwrapResponse struct {
+	// Key is the hex unwrapped key
+	Key    string         `json:"key"`
+	Header headerResponse `json:"header"`
+}
+
+type inspectRequest struct {
+	KeyBlock string `json:"keyBlock"`
+}
+
+type headerResponse struct {
+	VersionID     string          `json:"versionId"`
+	KeyUsage      string          `json:"keyUsage"`
+	Algorithm     string          `json:"algorithm"`
+	ModeOfUse     string          `json:"modeOfUse"`
+	KeyVersion    string          `json:"keyVersion"`
+	Exportability string          `json:"exportability"`
+	Blocks        []blockResponse `json:"blocks"`
+	Deprecations  []string        `json:"deprecations,omitempty"`
+}
+
+type blockResponse struct {
+	ID          string `json:"id"`
+	Data        string `json:"data"`
+	Description string `json:"description,omitempty"`
+}
+
+type errorResponse struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// errInvalidRequest is returned for requests which aren't valid JSON or hex
+var errInvalidRequest = errors.New("invalid request")
+
+// wrap wraps the key of a wrapRequest
+func wrap(request []byte) (interface{}, error) {
+	var req wrapRequest
+	if err := decodeRequest(request, &req); err != nil {
+		return nil, err
+	}
+	kbpk, err := decodeHex("kbpk", req.KBPK)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(kbpk)
+	key, err := decodeHex("key", req.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+
+	header := tr31.DefaultHeader()
+	if _, err := header.Load(req.Header); err != nil {
+		return nil, err
+	}
+	kb, err := tr31.NewKeyBlock(kbpk, header, tr31.WithSpecRevision(req.Revision))
+	if err != nil {
+		return nil, err
+	}
+	var maskedKeyLength *int
+	if req.MaskedKeyLength > 0 {
+		maskedKeyLength = &req.MaskedKeyLength
+	}
+	result, err := kb.WrapWithResult(key, maskedKeyLength)
+	if err != nil {
+		return nil, err
+	}
+	return wrapResponse{KeyBlock: result.Block, KCV: result.KCV}, nil
+}
+
+// unwrap unwraps the key block of an unwrapRequest
+func unwrap(request []byte) (interface{}, error) {
+	var req unwrapRequest
+	if err := decodeRequest(request, &req); err != nil {
+		return nil, err
+	}
+	kbpk, err := decodeHex("kbpk", req.KBPK)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(kbpk)
+
+	kb, err := tr31.New(kbpk, tr31.WithSpecRevision(req.Revision))
+	if err != nil {
+		return nil, err
+	}
+	key, err := kb.Unwrap(req.KeyBlock)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	return unwrapResponse{
+		Key:    strings.ToUpper(hex.EncodeToString(key)),
+		Header: headerResponseOf(kb.GetHeader()),
+	}, nil
+}
+
+// inspect describes the header of a key block without its KBPK
+func inspect(request []byte) (interface{}, error) {
+	var req inspectRequest
+	if err := decodeRequest(request, &req); err != nil {
+		return nil, err
+	}
+	header := tr31.DefaultHeader()
+	if _, err := header.Load(req.KeyBlock); err != nil {
+		return nil, err
+	}
+	return headerResponseOf(header), nil
+}
+
+func headerResponseOf(h *tr31.Header) headerResponse {
+	resp := headerResponse{
+		VersionID:     h.VersionID,
+		KeyUsage:      h.KeyUsage,
+		Algorithm:     h.Algorithm,
+		ModeOfUse:     h.ModeOfUse,
+		KeyVersion:    h.VersionNum,
+		Exportability: h.Exportability,
+		Blocks:        []blockResponse{},
+		Deprecations:  h.Deprecations(),
+	}
+	for _, info := range h.Blocks.Inspect() {
+		resp.Blocks = append(resp.Blocks, blockResponse{ID: info.ID, Data: info.Data, Description: info.Description})
+	}
+	return resp
+}
+
+func decodeRequest(request []byte, v interface{}) error {
+	if err := json.Unmarshal(request, v); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidRequest, err)
+	}
+	return nil
+}
+
+func decodeHex(field, value string) ([]byte, error) {
+	decoded, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s must be hex", errInvalidRequest, field)
+	}
+	return decoded, nil
+}
+
+// call runs fn with the request and encodes its response, or its error, as JSON.
+// Panics are reported as internal errors, they must not unwind into C callers.
+func call(fn func([]byte) (interface{}, error), request []byte) (response []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			response = encodeError(fmt.Errorf("%v", r), ERROR_CODE_INTERNAL)
+		}
+	}()
+	resp, err := fn(request)
+	if err != nil {
+		return encodeError(err, codeOf(err))
+	}
+	out, err := json.Marshal(resp)
+	if err != nil {
+		return encodeError(err, ERROR_CODE_INTERNAL)
+	}
+	return out
+}
+
+func codeOf(err error) string {
+	var headerErr *tr31.HeaderError
+	var keyBlockErr *tr31.KeyBlockError
+	switch {
+	case errors.Is(err, errInvalidRequest):
+		return ERROR_CODE_INVALID_REQUEST
+	case errors.As(err, &headerErr):
+		return ERROR_CODE_INVALID_HEADER
+	case errors.As(err, &keyBlockErr):
+		return ERROR_CODE_INVALID_KEY_BLOCK
+	}
+	return ERROR_CODE_INVALID_REQUEST
+}
+
+func encodeError(err error, code string) []byte {
+	var resp errorResponse
+	resp.Error.Code = code
+	resp.Error.Message = err.Error()
+	out, _ := json.Marshal(resp)
+	return out
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCall(t *testing.T) {
+	out := call(wrap, []byte(`{"kbpk":"89E88CF7931444F334BD7547FC3F380C","header":"B0000P0TE00N0000","key":"EDB380DD340BC2620247D445F5B8D678"}`))
+	var wrapped wrapResponse
+	require.NoError(t, json.Unmarshal(out, &wrapped), string(out))
+	require.Equal(t, "F4B08D", wrapped.KCV)
+
+	request, _ := json.Marshal(unwrapRequest{KBPK: "89E88CF7931444F334BD7547FC3F380C", KeyBlock: wrapped.KeyBlock})
+	out = call(unwrap, request)
+	var unwrapped unwrapResponse
+	require.NoError(t, json.Unmarshal(out, &unwrapped), string(out))
+	require.Equal(t, "EDB380DD340BC2620247D445F5B8D678", unwrapped.Key)
+	require.Equal(t, "P0", unwrapped.Header.KeyUsage)
+
+	request, _ = json.Marshal(inspectRequest{KeyBlock: wrapped.KeyBlock})
+	out = call(inspect, request)
+	var header headerResponse
+	require.NoError(t, json.Unmarshal(out, &header), string(out))
+	require.Equal(t, "B", header.VersionID)
+	require.Equal(t, "T", header.Algorithm)
+}
+
+func TestCall_errors(t *testing.T) {
+	codeOf := func(out []byte) string {
+		var resp errorResponse
+		require.NoError(t, json.Unmarshal(out, &resp), string(out))
+		return resp.Error.Code
+	}
+	require.Equal(t, ERROR_CODE_INVALID_REQUEST, codeOf(call(wrap, []byte(`not json`))))
+	require.Equal(t, ERROR_CODE_INVALID_REQUEST, codeOf(call(unwrap, []byte(`{"kbpk":"zz"}`))))
+	require.Equal(t, ERROR_CODE_INVALID_HEADER, codeOf(call(wrap, []byte(`{"kbpk":"89E88CF7931444F334BD7547FC3F380C","header":"X0000P0TE00N0000","key":"00"}`))))
+	require.Equal(t, ERROR_CODE_INVALID_KEY_BLOCK, codeOf(call(unwrap, []byte(`{"kbpk":"89E88CF7931444F334BD7547FC3F380C","keyBlock":"B0096P0TE00N0000FFFF"}`))))
+	require.Equal(t, ERROR_CODE_INTERNAL, codeOf(call(func([]byte) (interface{}, error) { panic("boom") }, nil)))
+}
@@ -8,6 +8,8 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -16,6 +18,7 @@ import (
 	"github.com/moov-io/base/log"
 	"github.com/moov-io/tr31"
 	"github.com/moov-io/tr31/pkg/server"
+	pkgtr31 "github.com/moov-io/tr31/pkg/tr31"
 
 	kitlog "github.com/go-kit/log"
 )
@@ -24,8 +27,87 @@ var (
 	httpAddr  = flag.String("http.addr", bind.HTTP("tr31"), "HTTP listen address")
 	adminAddr = flag.String("admin.addr", bind.Admin("tr31"), "Admin HTTP listen address")
 
+	httpAuth       = flag.String("http.auth", "none", "Auth mode of the HTTP listener: none, or mtls when serving TLS with HTTPS_CERT_FILE")
+	httpsAddr      = flag.String("https.addr", "", "HTTPS listen address, in addition to the HTTP listener")
+	httpsCertFile  = flag.String("https.cert_file", "", "PEM certificate served by the HTTPS listener")
+	httpsKeyFile   = flag.String("https.key_file", "", "PEM private key of the HTTPS listener certificate")
+	httpsClientCA  = flag.String("https.client_ca_file", "", "PEM CAs the HTTPS listener verifies client certificates against")
+	httpsAuth      = flag.String("https.auth", "mtls", "Auth mode of the HTTPS listener: none or mtls")
+	unixSocket     = flag.String("unix.socket", "", "Unix domain socket path the API is also served on, for sidecars")
+	unixSocketMode = flag.String("unix.socket_mode", "0660", "Permissions of the Unix domain socket")
+
 	flagLogFormat = flag.String("log.format", "", "Format for log lines (Options: json, plain")
 
+	allowedOrigins     = flag.String("http.allowed_origins", "", "Comma separated origins allowed to call the API from browsers, every origin when empty")
+	maxRequestBodySize = flag.Int64("http.max_body_size", 0, "Largest request body accepted in bytes, 1 MiB when zero")
+	maxKeyBlockLength  = flag.Int("http.max_key_block_length", 0, "Longest key block accepted in characters, 9999 when zero")
+	maxBatchSize       = flag.Int("http.max_batch_size", 0, "Most job items or inspected key blocks accepted in a request, 10000 when zero")
+	gzipResponses      = flag.Bool("http.gzip", false, "Compress responses for clients accepting gzip")
+	idempotencyTTL     = flag.Duration("http.idempotency_ttl", 0, "How long POST responses are kept for Idempotency-Key retries, disabled when zero")
+
+	jobsRetention = flag.Duration("jobs.retention", server.DefaultJobRetention, "How long finished jobs and their results are kept")
+
+	consumerNATSAddr       = flag.String("consumer.nats_address", "", "host:port of the NATS server wrap and translate requests are consumed from, disabled when empty")
+	consumerNATSQueue      = flag.String("consumer.nats_queue", "", "NATS queue group the consumers of the requests share, none when empty")
+	consumerRequestSubject = flag.String("consumer.request_subject", "tr31.requests", "Subject wrap and translate requests are consumed from")
+	consumerResultSubject  = flag.String("consumer.result_subject", "tr31.results", "Subject the results of consumed requests are published to")
+	consumerPrincipal      = flag.String("consumer.principal", "", "Caller the usage rules approve consumed translate requests for, anonymous when empty")
+
+	machinesFile      = flag.String("machines.file", "", "Declarative machines.yaml file applied at startup")
+	machineIDStrategy = flag.String("machines.id_strategy", "credentials", "How the IDs of created machines are generated: credentials, uuidv7 or ulid")
+	machineIDPrefix   = flag.String("machines.id_prefix", "", "Institution prefix of the IDs of created machines, none when empty")
+
+	responseSigningKey = flag.String("response_signing.key", "", "PEM private key file /decrypt_data responses are signed with")
+
+	requestSigningKeys   = flag.String("request_signing.keys", "", "Comma separated PEM public key files of the clients every request must be signed by, disabled when empty")
+	requestSigningWindow = flag.Duration("request_signing.window", server.DefaultRequestSigningWindow, "How far the timestamp of a signed request may be from the server time, nonces are remembered that long")
+
+	transparencyFile     = flag.String("transparency.file", "", "Append-only file of the transparency log of wrapped key blocks, tree heads are signed with -response_signing.key")
+	transparencyInterval = flag.Duration("transparency.interval", time.Minute, "How often a transparency log tree head is signed")
+
+	auditFile          = flag.String("audit.file", "", "Append-only file of the signed audit log of key operations, disabled when empty")
+	auditSigningKey    = flag.String("audit.signing_key", "", "PEM PKCS #8 Ed25519 private key file audit batches are signed with")
+	auditTransitKey    = flag.String("audit.transit_key", "", "Vault Transit ed25519 key audit batches are signed with, at AUDIT_TRANSIT_ADDR with AUDIT_TRANSIT_TOKEN, instead of -audit.signing_key")
+	auditTransitMount  = flag.String("audit.transit_mount", "transit", "Mount of the Vault Transit engine holding -audit.transit_key")
+	auditBatchSize     = flag.Int("audit.batch_size", 100, "Number of audit records signed together")
+	auditBatchInterval = flag.Duration("audit.interval", time.Minute, "How often pending audit records are signed")
+
+	rotationSigningKey = flag.String("rotation.signing_key", "", "PEM private key file the key exchange envelopes of scheduled working keys are signed with, rotations are disabled when empty")
+	rotationFrom       = flag.String("rotation.from", "tr31", "Partner ID scheduled working keys are sent from")
+	rotationInterval   = flag.Duration("rotation.interval", time.Minute, "How often rotation schedules, deliveries and activations are checked")
+
+	deliveryFile = flag.String("delivery.file", "", "YAML SFTP and AS2 delivery targets of partners key exchange envelopes are pushed to")
+
+	tenantsFile = flag.String("tenants.file", "", "YAML tenants whose API tokens are required on every route, with their quotas and limits")
+
+	blockPolicyFile    = flag.String("block_policy.file", "", "YAML policy of the optional blocks added to wrapped key blocks and required from unwrapped ones")
+	allowSingleDESKBPK = flag.Bool("kbpk.allow_single_des", false, "Accept single DES (8 byte) KBPKs for key block versions A and C, counted by tr31_legacy_strength_operations_total")
+	requireFullMAC     = flag.Bool("key_blocks.require_full_mac", false, "Reject key blocks with truncated MACs, versions A and C, when unwrapping and translating")
+	requireAESVersionD = flag.Bool("key_blocks.require_aes_version_d", false, "Reject AES keys in key block versions other than D when wrapping, unwrapping and translating")
+
+	policyWatchInterval = flag.Duration("policy.watch_interval", 0, "How often the machines, block policy and usage rules files are checked for changes, never when zero")
+
+	usageRulesFile       = flag.String("usage_rules.file", "", "YAML rules of the key usages each caller may unwrap")
+	usagePrincipalHeader = flag.String("usage_rules.principal_header", "", "Header identifying callers, set by an API gateway, instead of the TLS client certificate")
+
+	simulatorLatency         = flag.Duration("simulator.latency", 0, "Latency added to key reads of machines on the SIMULATOR backend")
+	simulatorJitter          = flag.Duration("simulator.jitter", 0, "Random latency up to this duration added on the SIMULATOR backend")
+	simulatorKeyNotFoundRate = flag.Float64("simulator.key_not_found_rate", 0, "Share of SIMULATOR key reads failing with key not found, from 0 to 1")
+	simulatorMACFailureRate  = flag.Float64("simulator.mac_failure_rate", 0, "Share of SIMULATOR unwraps failing MAC verification, from 0 to 1")
+
+	kmipAddr         = flag.String("kmip.addr", "", "KMIP listen address of the key manager facade, disabled when empty")
+	kmipMachine      = flag.String("kmip.machine", "", "Initial key of the machine whose KBPK wraps keys registered over KMIP")
+	kmipCertFile     = flag.String("kmip.cert_file", "", "PEM certificate served by the KMIP listener")
+	kmipKeyFile      = flag.String("kmip.key_file", "", "PEM private key of the KMIP listener certificate")
+	kmipClientCAFile = flag.String("kmip.client_ca_file", "", "PEM CAs the KMIP listener verifies client certificates against")
+	kmipKeyUsage     = flag.String("kmip.key_usage", "", "Key usage of keys registered over KMIP, D0 when empty")
+
+	diagnosticsAddr        = flag.String("diagnostics.addr", "", "Listen address of the pprof, expvar and dump endpoints, disabled when empty")
+	diagnosticsTokenHashes = flag.String("diagnostics.token_hashes", "", "Comma separated hex SHA-256 hashes of the admin tokens the diagnostics endpoints require")
+	diagnosticsDumpDir     = flag.String("diagnostics.dump_dir", "", "Directory goroutine and heap dumps are written to, the temporary directory when empty")
+	diagnosticsCertFile    = flag.String("diagnostics.cert_file", "", "PEM certificate served by the diagnostics listener, plain HTTP when empty")
+	diagnosticsKeyFile     = flag.String("diagnostics.key_file", "", "PEM private key of the diagnostics listener certificate")
+
 	svc     server.Service
 	handler http.Handler
 )
@@ -53,6 +135,68 @@ func newServer(handler http.Handler, httpAddr string, logger log.Logger) *http.S
 	return serve
 }
 
+// listenerConfigs returns the listeners enabled by flags and environment
+// variables. The HTTP listener serves TLS when HTTPS_CERT_FILE and
+// HTTPS_KEY_FILE are set, an empty -http.addr disables it.
+func listenerConfigs() ([]server.ListenerConfig, error) {
+	env := map[string]*string{
+		"HTTP_AUTH":                     httpAuth,
+		"HTTPS_BIND_ADDRESS":            httpsAddr,
+		"HTTPS_LISTENER_CERT_FILE":      httpsCertFile,
+		"HTTPS_LISTENER_KEY_FILE":       httpsKeyFile,
+		"HTTPS_LISTENER_CLIENT_CA_FILE": httpsClientCA,
+		"HTTPS_AUTH":                    httpsAuth,
+		"UNIX_SOCKET_PATH":              unixSocket,
+		"UNIX_SOCKET_MODE":              unixSocketMode,
+	}
+	for name, value := range env {
+		if v := os.Getenv(name); v != "" {
+			*value = v
+		}
+	}
+
+	var listeners []server.ListenerConfig
+	if *httpAddr != "" {
+		listeners = append(listeners, server.ListenerConfig{
+			Network:      "tcp",
+			Address:      *httpAddr,
+			CertFile:     os.Getenv("HTTPS_CERT_FILE"),
+			KeyFile:      os.Getenv("HTTPS_KEY_FILE"),
+			ClientCAFile: os.Getenv("HTTPS_CLIENT_CA_FILE"),
+			Auth:         server.AuthMode(*httpAuth),
+		})
+	}
+	if *httpsAddr != "" {
+		listeners = append(listeners, server.ListenerConfig{
+			Network:      "tcp",
+			Address:      *httpsAddr,
+			CertFile:     *httpsCertFile,
+			KeyFile:      *httpsKeyFile,
+			ClientCAFile: *httpsClientCA,
+			Auth:         server.AuthMode(*httpsAuth),
+		})
+		if *httpsCertFile == "" || *httpsKeyFile == "" {
+			return nil, fmt.Errorf("-https.addr needs -https.cert_file and -https.key_file")
+		}
+	}
+	if *unixSocket != "" {
+		mode, err := strconv.ParseUint(*unixSocketMode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -unix.socket_mode %s: %v", *unixSocketMode, err)
+		}
+		listeners = append(listeners, server.ListenerConfig{
+			Network:    "unix",
+			Address:    *unixSocket,
+			Auth:       server.AUTH_NONE,
+			SocketMode: os.FileMode(mode),
+		})
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no listener is enabled")
+	}
+	return listeners, nil
+}
+
 func main() {
 	flag.Parse()
 
@@ -73,22 +217,346 @@ func main() {
 	// Setup underlying tr31 service
 	r := server.NewRepositoryInMemory(logger)
 	svc = server.NewService(r, server.MODE_VAULT)
+	if v := os.Getenv("MACHINES_ID_STRATEGY"); v != "" {
+		*machineIDStrategy = v
+	}
+	if v := os.Getenv("MACHINES_ID_PREFIX"); v != "" {
+		*machineIDPrefix = v
+	}
+	machineIDs, err := server.ParseMachineIDStrategy(*machineIDStrategy, *machineIDPrefix)
+	if err != nil {
+		logger.Fatal().LogErrorf("problem with the machine ID strategy: %v", err)
+		os.Exit(1)
+	}
+	svc.ConfigureMachineIDs(machineIDs)
+	if v, err := time.ParseDuration(os.Getenv("JOBS_RETENTION")); err == nil {
+		*jobsRetention = v
+	}
+	svc.ConfigureJobRetention(*jobsRetention)
+	svc.ConfigureSimulator(server.SimulatorConfig{
+		Latency:         *simulatorLatency,
+		Jitter:          *simulatorJitter,
+		KeyNotFoundRate: *simulatorKeyNotFoundRate,
+		MACFailureRate:  *simulatorMACFailureRate,
+	})
+
+	if v, err := strconv.ParseBool(os.Getenv("KBPK_ALLOW_SINGLE_DES")); err == nil {
+		*allowSingleDESKBPK = v
+	}
+	if *allowSingleDESKBPK {
+		pkgtr31.SetSingleDESKBPKPolicy(pkgtr31.SINGLE_DES_KBPK_ALLOW)
+		logger.Warn().Log("single DES KBPKs are allowed, see the tr31_legacy_strength_operations_total metric")
+	}
+	if v, err := strconv.ParseBool(os.Getenv("KEY_BLOCKS_REQUIRE_FULL_MAC")); err == nil {
+		*requireFullMAC = v
+	}
+	if *requireFullMAC {
+		pkgtr31.SetMACLengthPolicy(pkgtr31.MAC_LENGTH_FULL)
+	}
+	if v, err := strconv.ParseBool(os.Getenv("KEY_BLOCKS_REQUIRE_AES_VERSION_D")); err == nil {
+		*requireAESVersionD = v
+	}
+	if *requireAESVersionD {
+		pkgtr31.SetAESKeyPolicy(pkgtr31.AES_KEY_VERSION_D)
+	}
+
+	// KV version of the Vault mounts holding the keys, detected when unset
+	kvVersion, err := server.ParseKVVersion(os.Getenv("VAULT_KV_VERSION"))
+	if err != nil {
+		logger.Fatal().LogErrorf("problem with VAULT_KV_VERSION: %v", err)
+		os.Exit(1)
+	}
+	if vaultClient, ok := svc.GetSecretManager().(*server.VaultClient); ok {
+		vaultClient.SetKVVersion(kvVersion)
+	}
+
+	// Mutual TLS with Vault, certificates are reloaded when they're rotated on disk
+	if certFile, keyFile := os.Getenv("VAULT_CLIENT_CERT"), os.Getenv("VAULT_CLIENT_KEY"); certFile != "" && keyFile != "" {
+		interval, _ := time.ParseDuration(os.Getenv("VAULT_CERT_RELOAD_INTERVAL"))
+		watcher, err := server.NewCertWatcher(certFile, keyFile, os.Getenv("VAULT_CACERT"), interval, logger)
+		if err != nil {
+			logger.Fatal().LogErrorf("problem loading vault client certificates: %v", err)
+			os.Exit(1)
+		}
+		if vaultClient, ok := svc.GetSecretManager().(*server.VaultClient); ok {
+			if err := vaultClient.UseCertWatcher(watcher); err != nil {
+				logger.Fatal().LogErrorf("problem configuring vault mutual TLS: %v", err)
+				os.Exit(1)
+			}
+		}
+		go watcher.Watch(context.Background())
+	}
+
+	// Import keys into Vault Transit instead of returning them in clear, when requested
+	if addr, token := os.Getenv("VAULT_TRANSIT_IMPORT_ADDR"), os.Getenv("VAULT_TRANSIT_IMPORT_TOKEN"); addr != "" && token != "" {
+		importer, err := server.NewVaultTransitImporter(addr, token, os.Getenv("VAULT_TRANSIT_IMPORT_MOUNT"))
+		if err != nil {
+			logger.Fatal().LogErrorf("problem configuring vault transit import: %v", err)
+			os.Exit(1)
+		}
+		svc.ConfigureKeyImporter("vault-transit", importer)
+	}
+
+	// Sign responses carrying clear keys, if a signing key is configured
+	var handlerOptions []server.HandlerOption
+	if v := os.Getenv("RESPONSE_SIGNING_KEY_FILE"); v != "" {
+		*responseSigningKey = v
+	}
+	var signer *server.ResponseSigner
+	if *responseSigningKey != "" {
+		var err error
+		signer, err = server.LoadResponseSigner(*responseSigningKey)
+		if err != nil {
+			logger.Fatal().LogErrorf("problem loading response signing key: %v", err)
+			os.Exit(1)
+		}
+		logger.Logf("signing /decrypt_data responses with key %s", signer.PublicKey().KeyID)
+		handlerOptions = append(handlerOptions, server.WithResponseSigner(signer))
+	}
+
+	// Require signed requests with fresh nonces, so captured requests can't be replayed
+	if v := os.Getenv("REQUEST_SIGNING_KEYS"); v != "" {
+		*requestSigningKeys = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("REQUEST_SIGNING_WINDOW")); err == nil {
+		*requestSigningWindow = v
+	}
+	if *requestSigningKeys != "" {
+		verifier, err := server.LoadRequestVerifier(strings.Split(*requestSigningKeys, ","), *requestSigningWindow, server.NewMemoryNonceStore())
+		if err != nil {
+			logger.Fatal().LogErrorf("problem loading request signing keys: %v", err)
+			os.Exit(1)
+		}
+		logger.Logf("requiring signed requests within %v", *requestSigningWindow)
+		handlerOptions = append(handlerOptions, server.WithRequestSigning(verifier))
+	}
+
+	// Log the hashes of every wrapped key block in a transparency log
+	if v := os.Getenv("TRANSPARENCY_FILE"); v != "" {
+		*transparencyFile = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("TRANSPARENCY_INTERVAL")); err == nil {
+		*transparencyInterval = v
+	}
+	if *transparencyFile != "" {
+		transparencyLog, err := server.NewTransparencyLog(*transparencyFile, signer, *transparencyInterval, logger)
+		if err != nil {
+			logger.Fatal().LogErrorf("problem opening transparency log: %v", err)
+			os.Exit(1)
+		}
+		defer transparencyLog.Close()
+		logger.Logf("logging wrapped key blocks to %s, tree size %d", *transparencyFile, transparencyLog.TreeHead().TreeSize)
+		go transparencyLog.Run(context.Background())
+		svc.ConfigureTransparencyLog(transparencyLog)
+		handlerOptions = append(handlerOptions, server.WithTransparencyLog(transparencyLog))
+	}
+
+	// Record key operations in a signed audit log
+	auditEnv := map[string]*string{
+		"AUDIT_FILE":          auditFile,
+		"AUDIT_SIGNING_KEY":   auditSigningKey,
+		"AUDIT_TRANSIT_KEY":   auditTransitKey,
+		"AUDIT_TRANSIT_MOUNT": auditTransitMount,
+	}
+	for name, value := range auditEnv {
+		if v := os.Getenv(name); v != "" {
+			*value = v
+		}
+	}
+	if v, err := strconv.Atoi(os.Getenv("AUDIT_BATCH_SIZE")); err == nil {
+		*auditBatchSize = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("AUDIT_INTERVAL")); err == nil {
+		*auditBatchInterval = v
+	}
+	if *auditFile != "" {
+		var auditSigner server.AuditSigner
+		var err error
+		switch {
+		case *auditTransitKey != "":
+			auditSigner, err = server.NewVaultTransitAuditSigner(os.Getenv("AUDIT_TRANSIT_ADDR"), os.Getenv("AUDIT_TRANSIT_TOKEN"), *auditTransitMount, *auditTransitKey)
+		case *auditSigningKey != "":
+			auditSigner, err = server.LoadLocalAuditSigner(*auditSigningKey)
+		default:
+			err = fmt.Errorf("-audit.file needs -audit.signing_key or -audit.transit_key")
+		}
+		if err != nil {
+			logger.Fatal().LogErrorf("problem loading audit signing key: %v", err)
+			os.Exit(1)
+		}
+		auditLog, err := server.NewAuditLog(*auditFile, auditSigner, server.AuditConfig{BatchSize: *auditBatchSize, Interval: *auditBatchInterval}, logger)
+		if err != nil {
+			logger.Fatal().LogErrorf("problem opening audit log: %v", err)
+			os.Exit(1)
+		}
+		defer auditLog.Close()
+		logger.Logf("recording key operations to %s, signed with %s", *auditFile, auditSigner.KeyID())
+		go auditLog.Run(context.Background())
+		svc.ConfigureAuditLog(auditLog)
+	}
+
+	// Push key exchange envelopes to partners over SFTP or AS2
+	if v := os.Getenv("DELIVERY_FILE"); v != "" {
+		*deliveryFile = v
+	}
+	if *deliveryFile != "" {
+		config, err := server.LoadDeliveryConfig(*deliveryFile)
+		if err != nil {
+			logger.Fatal().LogErrorf("problem loading delivery targets: %v", err)
+			os.Exit(1)
+		}
+		deliveries, err := server.NewDeliveries(*config)
+		if err != nil {
+			logger.Fatal().LogErrorf("problem configuring delivery targets: %v", err)
+			os.Exit(1)
+		}
+		svc.ConfigureDeliveries(deliveries)
+		logger.Logf("delivering key exchange files to %d partners from %s", len(config.Partners), *deliveryFile)
+	}
+
+	// Rotate the working keys of partner zones on their schedules
+	rotationEnv := map[string]*string{
+		"ROTATION_SIGNING_KEY": rotationSigningKey,
+		"ROTATION_FROM":        rotationFrom,
+	}
+	for name, value := range rotationEnv {
+		if v := os.Getenv(name); v != "" {
+			*value = v
+		}
+	}
+	if *rotationSigningKey != "" {
+		signer, err := server.LoadSigningKey(*rotationSigningKey)
+		if err != nil {
+			logger.Fatal().LogErrorf("problem loading rotation signing key: %v", err)
+			os.Exit(1)
+		}
+		svc.ConfigureRotationSigner(*rotationFrom, signer)
+		logger.Logf("rotating scheduled working keys every %v, sent from %s", *rotationInterval, *rotationFrom)
+		go server.WatchRotations(context.Background(), svc, *rotationInterval, logger)
+	}
+
+	// Serve several tenants, each with its own machines, quotas and limits
+	if v := os.Getenv("TENANTS_FILE"); v != "" {
+		*tenantsFile = v
+	}
+	if *tenantsFile != "" {
+		tenants, err := server.LoadTenants(*tenantsFile)
+		if err != nil {
+			logger.Fatal().LogErrorf("problem loading tenants: %v", err)
+			os.Exit(1)
+		}
+		logger.Logf("serving %d tenants from %s", len(tenants.Tenants), *tenantsFile)
+		svc.ConfigureTenants(tenants)
+		handlerOptions = append(handlerOptions, server.WithTenants(tenants))
+	}
+
+	// Apply the policy files: machines declaration, block policy and usage rules.
+	// They are watched and applied again when they change if an interval is set.
+	env := map[string]*string{
+		"MACHINES_FILE":          machinesFile,
+		"BLOCK_POLICY_FILE":      blockPolicyFile,
+		"USAGE_RULES_FILE":       usageRulesFile,
+		"USAGE_PRINCIPAL_HEADER": usagePrincipalHeader,
+	}
+	for name, value := range env {
+		if v := os.Getenv(name); v != "" {
+			*value = v
+		}
+	}
+	if v, err := time.ParseDuration(os.Getenv("POLICY_WATCH_INTERVAL")); err == nil {
+		*policyWatchInterval = v
+	}
+	if *machinesFile != "" || *blockPolicyFile != "" || *usageRulesFile != "" {
+		watcher, err := server.NewPolicyWatcher(svc, server.PolicyFiles{
+			Machines:    *machinesFile,
+			UsageRules:  *usageRulesFile,
+			BlockPolicy: *blockPolicyFile,
+		}, *policyWatchInterval, logger)
+		if err != nil {
+			logger.Fatal().LogErrorf("problem applying policy: %v", err)
+			os.Exit(1)
+		}
+		logger.Logf("applied policy version %s", watcher.Status().Version)
+		if *policyWatchInterval > 0 {
+			logger.Logf("watching policy files every %v", *policyWatchInterval)
+			go watcher.Watch(context.Background())
+		}
+		handlerOptions = append(handlerOptions, server.WithPolicyWatcher(watcher))
+
+		// Approve the key usages each caller may unwrap with the latest rules
+		if *usageRulesFile != "" {
+			logger.Logf("approving unwrapped key usages with rules from %s", *usageRulesFile)
+			svc.ConfigureUsageApprover(watcher, logger)
+		}
+	}
+	// Callers are identified by their TLS client certificate unless a gateway names them
+	if *usagePrincipalHeader != "" {
+		handlerOptions = append(handlerOptions, server.WithPrincipal(server.PrincipalFromHeader(*usagePrincipalHeader)))
+	}
+
+	// Gateway and browser friendly HTTP features
+	if v := os.Getenv("HTTP_ALLOWED_ORIGINS"); v != "" {
+		*allowedOrigins = v
+	}
+	if *allowedOrigins != "" {
+		handlerOptions = append(handlerOptions, server.WithAllowedOrigins(strings.Split(*allowedOrigins, ",")...))
+	}
+	if v, err := strconv.ParseInt(os.Getenv("HTTP_MAX_BODY_SIZE"), 10, 64); err == nil {
+		*maxRequestBodySize = v
+	}
+	if *maxRequestBodySize > 0 {
+		handlerOptions = append(handlerOptions, server.WithMaxRequestBodySize(*maxRequestBodySize))
+	}
+	if v, err := strconv.Atoi(os.Getenv("HTTP_MAX_KEY_BLOCK_LENGTH")); err == nil {
+		*maxKeyBlockLength = v
+	}
+	if *maxKeyBlockLength > 0 {
+		handlerOptions = append(handlerOptions, server.WithMaxKeyBlockLength(*maxKeyBlockLength))
+	}
+	if v, err := strconv.Atoi(os.Getenv("HTTP_MAX_BATCH_SIZE")); err == nil {
+		*maxBatchSize = v
+	}
+	if *maxBatchSize > 0 {
+		handlerOptions = append(handlerOptions, server.WithMaxBatchSize(*maxBatchSize))
+	}
+	if v, err := strconv.ParseBool(os.Getenv("HTTP_GZIP")); err == nil {
+		*gzipResponses = v
+	}
+	if *gzipResponses {
+		handlerOptions = append(handlerOptions, server.WithGzip())
+	}
+	if v, err := time.ParseDuration(os.Getenv("HTTP_IDEMPOTENCY_TTL")); err == nil {
+		*idempotencyTTL = v
+	}
+	if *idempotencyTTL > 0 {
+		handlerOptions = append(handlerOptions, server.WithIdempotencyKeys(*idempotencyTTL))
+	}
 
 	// Create HTTP server
-	handler = server.MakeHTTPHandler(svc)
+	handler = server.MakeHTTPHandler(svc, handlerOptions...)
 
 	// Check to see if our -http.addr flag has been overridden
 	if v := os.Getenv("HTTP_BIND_ADDRESS"); v != "" {
 		*httpAddr = v
 	}
+	listeners, err := listenerConfigs()
+	if err != nil {
+		logger.Fatal().LogErrorf("problem configuring listeners: %v", err)
+		os.Exit(1)
+	}
 
-	// Create the main HTTP server using newServer
-	serve := newServer(handler, *httpAddr, logger)
+	// Create an HTTP server per listener, sharing the handler
+	servers := make([]*http.Server, len(listeners))
+	for i, cfg := range listeners {
+		servers[i] = newServer(server.RequireAuth(cfg.Auth, handler), cfg.Address, logger)
+	}
 
-	// Function to gracefully shut down the server
+	// Function to gracefully shut down the servers
 	shutdownServer := func() {
-		if err := serve.Shutdown(context.TODO()); err != nil {
-			logger.LogError(err)
+		for _, serve := range servers {
+			if err := serve.Shutdown(context.TODO()); err != nil {
+				logger.LogError(err)
+			}
 		}
 	}
 
@@ -118,24 +586,155 @@ func main() {
 	}()
 	defer adminServer.Shutdown()
 
-	// Start main HTTP server
-	go func() {
-		if certFile, keyFile := os.Getenv("HTTPS_CERT_FILE"), os.Getenv("HTTPS_KEY_FILE"); certFile != "" && keyFile != "" {
-			logger.Logf("startup binding to %s for secure HTTP server", *httpAddr)
-			if err := serve.ListenAndServeTLS(certFile, keyFile); err != nil {
+	// Start the HTTP servers
+	for i, cfg := range listeners {
+		ln, err := server.Listen(cfg)
+		if err != nil {
+			logger.Fatal().LogErrorf("problem listening on %s %s: %v", cfg.Network, cfg.Address, err)
+			os.Exit(1)
+		}
+		logger.Logf("startup binding to %s %s for HTTP server with %s auth", cfg.Network, cfg.Address, cfg.Auth)
+		go func(serve *http.Server) {
+			if err := serve.Serve(ln); err != nil {
 				errs <- err
 				logger.LogError(err)
 			}
-		} else {
-			logger.Logf("startup binding to %s for HTTP server", *httpAddr)
-			if err := serve.ListenAndServe(); err != nil {
+		}(servers[i])
+	}
 
+	// Start the KMIP facade
+	kmipConfig := map[string]*string{
+		"KMIP_BIND_ADDRESS":   kmipAddr,
+		"KMIP_MACHINE":        kmipMachine,
+		"KMIP_CERT_FILE":      kmipCertFile,
+		"KMIP_KEY_FILE":       kmipKeyFile,
+		"KMIP_CLIENT_CA_FILE": kmipClientCAFile,
+		"KMIP_KEY_USAGE":      kmipKeyUsage,
+	}
+	for name, value := range kmipConfig {
+		if v := os.Getenv(name); v != "" {
+			*value = v
+		}
+	}
+	if *kmipAddr != "" {
+		if *kmipMachine == "" || *kmipCertFile == "" || *kmipKeyFile == "" || *kmipClientCAFile == "" {
+			logger.Fatal().LogErrorf("-kmip.addr needs -kmip.machine, -kmip.cert_file, -kmip.key_file and -kmip.client_ca_file")
+			os.Exit(1)
+		}
+		ln, err := server.Listen(server.ListenerConfig{
+			Network:      "tcp",
+			Address:      *kmipAddr,
+			CertFile:     *kmipCertFile,
+			KeyFile:      *kmipKeyFile,
+			ClientCAFile: *kmipClientCAFile,
+			Auth:         server.AUTH_MTLS,
+		})
+		if err != nil {
+			logger.Fatal().LogErrorf("problem listening on tcp %s: %v", *kmipAddr, err)
+			os.Exit(1)
+		}
+		kmipServer := server.NewKMIPServer(svc, server.KMIPConfig{Machine: *kmipMachine, KeyUsage: *kmipKeyUsage}, logger)
+		defer kmipServer.Close()
+		logger.Logf("startup binding to tcp %s for KMIP server", *kmipAddr)
+		go func() {
+			if err := kmipServer.Serve(ln); err != nil {
 				errs <- err
 				logger.LogError(err)
 			}
+		}()
+	}
 
+	// Start the message-driven consumer
+	consumerConfig := map[string]*string{
+		"CONSUMER_NATS_ADDRESS":    consumerNATSAddr,
+		"CONSUMER_NATS_QUEUE":      consumerNATSQueue,
+		"CONSUMER_REQUEST_SUBJECT": consumerRequestSubject,
+		"CONSUMER_RESULT_SUBJECT":  consumerResultSubject,
+		"CONSUMER_PRINCIPAL":       consumerPrincipal,
+	}
+	for name, value := range consumerConfig {
+		if v := os.Getenv(name); v != "" {
+			*value = v
 		}
-	}()
+	}
+	if *consumerNATSAddr != "" {
+		broker, err := server.NewNATSBroker(context.Background(), server.NATSConfig{
+			Address:  *consumerNATSAddr,
+			User:     os.Getenv("CONSUMER_NATS_USER"),
+			Password: os.Getenv("CONSUMER_NATS_PASSWORD"),
+			Token:    os.Getenv("CONSUMER_NATS_TOKEN"),
+			Name:     "tr31",
+			Queue:    *consumerNATSQueue,
+		}, logger)
+		if err != nil {
+			logger.Fatal().LogErrorf("problem connecting to NATS %s: %v", *consumerNATSAddr, err)
+			os.Exit(1)
+		}
+		defer broker.Close()
+		consumer := server.NewConsumer(svc, broker, server.ConsumerConfig{
+			RequestSubject: *consumerRequestSubject,
+			ResultSubject:  *consumerResultSubject,
+			Principal:      *consumerPrincipal,
+		}, logger)
+		logger.Logf("consuming %s from NATS %s, results are published to %s", *consumerRequestSubject, *consumerNATSAddr, *consumerResultSubject)
+		go func() {
+			if err := consumer.Run(context.Background()); err != nil {
+				errs <- err
+				logger.LogError(err)
+			}
+		}()
+	}
+
+	// Start the diagnostics endpoints
+	diagnosticsConfig := map[string]*string{
+		"DIAGNOSTICS_BIND_ADDRESS": diagnosticsAddr,
+		"DIAGNOSTICS_TOKEN_HASHES": diagnosticsTokenHashes,
+		"DIAGNOSTICS_DUMP_DIR":     diagnosticsDumpDir,
+		"DIAGNOSTICS_CERT_FILE":    diagnosticsCertFile,
+		"DIAGNOSTICS_KEY_FILE":     diagnosticsKeyFile,
+	}
+	for name, value := range diagnosticsConfig {
+		if v := os.Getenv(name); v != "" {
+			*value = v
+		}
+	}
+	if *diagnosticsAddr != "" {
+		var tokenHashes []string
+		if *diagnosticsTokenHashes != "" {
+			tokenHashes = strings.Split(*diagnosticsTokenHashes, ",")
+		}
+		diagnostics, err := server.NewDiagnosticsHandler(server.DiagnosticsConfig{
+			TokenHashes: tokenHashes,
+			DumpDir:     *diagnosticsDumpDir,
+			Logger:      logger,
+		})
+		if err != nil {
+			logger.Fatal().LogErrorf("problem with -diagnostics.token_hashes or -diagnostics.dump_dir: %v", err)
+			os.Exit(1)
+		}
+		ln, err := server.Listen(server.ListenerConfig{
+			Network:  "tcp",
+			Address:  *diagnosticsAddr,
+			CertFile: *diagnosticsCertFile,
+			KeyFile:  *diagnosticsKeyFile,
+			Auth:     server.AUTH_NONE,
+		})
+		if err != nil {
+			logger.Fatal().LogErrorf("problem listening on tcp %s: %v", *diagnosticsAddr, err)
+			os.Exit(1)
+		}
+		diagnosticsServer := newServer(diagnostics, *diagnosticsAddr, logger)
+		// CPU profiles and traces last up to their seconds parameter
+		diagnosticsServer.WriteTimeout = 5 * time.Minute
+		defer diagnosticsServer.Shutdown(context.TODO())
+		logger.Logf("startup binding to tcp %s for diagnostics server", *diagnosticsAddr)
+		go func() {
+			if err := diagnosticsServer.Serve(ln); err != nil {
+				errs <- err
+				logger.LogError(err)
+			}
+		}()
+	}
 
 	if err := <-errs; err != nil {
 		shutdownServer()
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"flag"
 	"fmt"
 	"os"
@@ -8,6 +12,7 @@ import (
 
 	"github.com/moov-io/tr31"
 	"github.com/moov-io/tr31/pkg/server"
+	pkgtr31 "github.com/moov-io/tr31/pkg/tr31"
 )
 
 var (
@@ -21,6 +26,21 @@ var (
 	flagKeyName         = flag.String("key_name", "", "key stored vault key name")
 	flagWrapperKey      = flag.String("wrapper_key", "", "Symmetric key")
 	flagDecryptKeyBlock = flag.String("key_block", "", "wrapped key block for decryption")
+	flagAudit           = flag.Bool("audit", false, "audit key block header for weak configurations")
+	flagKBPKLen         = flag.Int("kbpk_len", 0, "KBPK length in bytes for auditing")
+	flagReencrypt       = flag.Bool("reencrypt", false, "translate the key blocks stored under the secret paths to the target KBPK")
+	flagTargetKeyPath   = flag.String("target_key_path", "", "target KBPK vault key path for re-encryption")
+	flagTargetKeyName   = flag.String("target_key_name", "", "target KBPK vault key name for re-encryption")
+	flagScanPaths       = flag.String("scan_paths", "", "comma separated vault paths to scan for re-encryption, key_path when empty")
+	flagDryRun          = flag.Bool("dry_run", false, "verify the re-encryption without writing key blocks")
+	flagReport          = flag.String("report", "", "file to write the re-encryption report to, stdout when empty")
+	flagVerifyAudit     = flag.String("verify_audit", "", "audit log file whose batch signatures and hash chain are verified")
+	flagAuditPublicKey  = flag.String("audit_public_key", "", "file of the Ed25519 public key audit batches are signed with, PEM or base64")
+	flagKEMSeal         = flag.String("kem_seal", "", "key exchange message JSON file to seal in a signed envelope")
+	flagKEMOpen         = flag.String("kem_open", "", "key exchange envelope file whose signature is verified")
+	flagKEMSigningKey   = flag.String("kem_signing_key", "", "PKCS#8 PEM private key file key exchange envelopes are signed with")
+	flagKEMPublicKey    = flag.String("kem_public_key", "", "PEM public key file of the sender of a key exchange envelope")
+	flagKEMOut          = flag.String("kem_out", "", "file to write the sealed envelope or opened message to, stdout when empty")
 )
 
 func main() {
@@ -93,6 +113,239 @@ func main() {
 		params.KeyBlock = *flagDecryptKeyBlock
 		makeFuncCall(server.Decrypt, params)
 	}
+
+	// audit
+	if *flagAudit {
+		if *flagDecryptKeyBlock == "" {
+			fmt.Printf("please select key block with key_block flag\n")
+			os.Exit(1)
+		}
+		if *flagKBPKLen == 0 {
+			fmt.Printf("please select KBPK length with kbpk_len flag\n")
+			os.Exit(1)
+		}
+		audit(*flagDecryptKeyBlock, *flagKBPKLen)
+	}
+
+	// verify audit log
+	if *flagVerifyAudit != "" {
+		if *flagAuditPublicKey == "" {
+			fmt.Printf("please select the audit signing public key with audit_public_key flag\n")
+			os.Exit(1)
+		}
+		verifyAudit(*flagVerifyAudit, *flagAuditPublicKey)
+	}
+
+	// seal key exchange message
+	if *flagKEMSeal != "" {
+		if *flagKEMSigningKey == "" {
+			fmt.Printf("please select the envelope signing key with kem_signing_key flag\n")
+			os.Exit(1)
+		}
+		kemSeal(*flagKEMSeal, *flagKEMSigningKey, *flagKEMOut)
+	}
+
+	// open key exchange envelope
+	if *flagKEMOpen != "" {
+		if *flagKEMPublicKey == "" {
+			fmt.Printf("please select the sender public key with kem_public_key flag\n")
+			os.Exit(1)
+		}
+		kemOpen(*flagKEMOpen, *flagKEMPublicKey, *flagKEMOut)
+	}
+
+	// re-encrypt
+	if *flagReencrypt {
+		if *flagVaultAddress == "" {
+			fmt.Printf("please select vault address key with vault_address flag\n")
+			os.Exit(1)
+		}
+		if *flagVaultToken == "" {
+			fmt.Printf("please select vault token with vault_token flag\n")
+			os.Exit(1)
+		}
+		if *flagKeyPath == "" || *flagKeyName == "" {
+			fmt.Printf("please select vault key path and name with key_path and key_name flags\n")
+			os.Exit(1)
+		}
+		if *flagTargetKeyPath == "" || *flagTargetKeyName == "" {
+			fmt.Printf("please select target key path and name with target_key_path and target_key_name flags\n")
+			os.Exit(1)
+		}
+		req := server.EstateRequest{
+			Key:       server.KeyReference{KeyPath: *flagKeyPath, KeyName: *flagKeyName},
+			TargetKey: server.KeyReference{KeyPath: *flagTargetKeyPath, KeyName: *flagTargetKeyName},
+			DryRun:    *flagDryRun,
+		}
+		if *flagScanPaths != "" {
+			req.Paths = strings.Split(*flagScanPaths, ",")
+		}
+		reencrypt(server.Vault{VaultAddress: *flagVaultAddress, VaultToken: *flagVaultToken}, req, *flagReport)
+	}
+}
+
+// reencrypt runs the estate re-encryption against Vault with a machine of the
+// vault credentials and writes the report as JSON
+func reencrypt(auth server.Vault, req server.EstateRequest, reportPath string) {
+	s := server.NewService(server.NewRepositoryInMemory(nil), server.MODE_VAULT)
+	m := server.NewMachine(auth)
+	if err := s.CreateMachine(m); err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(2)
+	}
+	report, err := s.ReencryptEstate(m.InitialKey, req)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(2)
+	}
+
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(2)
+	}
+	writeOutput(out, reportPath)
+	fmt.Printf("RESULT: %d translated, %d skipped, %d failed\n", report.Translated, report.Skipped, report.Failed)
+	if report.Failed > 0 {
+		os.Exit(3)
+	}
+}
+
+func audit(keyBlock string, kbpkLen int) {
+	header := pkgtr31.DefaultHeader()
+	if _, err := header.Load(keyBlock); err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(2)
+	}
+
+	findings := pkgtr31.AuditConfig(header, kbpkLen)
+	for _, finding := range findings {
+		fmt.Printf("%s: %s\n", strings.ToUpper(string(finding.Severity)), finding.Message)
+	}
+	if len(findings) == 0 {
+		fmt.Printf("RESULT: no findings\n")
+	}
+}
+
+func verifyAudit(path, publicKeyPath string) {
+	data, err := os.ReadFile(publicKeyPath)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+	key, err := server.ParseAuditPublicKey(data)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	verification, err := server.VerifyAuditLog(file, key)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(3)
+	}
+	fmt.Printf("RESULT: %d batches of %d records verified\n", verification.Batches, verification.Records)
+}
+
+// kemSeal signs a key exchange message file and writes its envelope
+func kemSeal(path, signingKeyPath, outPath string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+	var message pkgtr31.KeyExchangeMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+	signer, err := readSigningKey(signingKeyPath)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	envelope, err := pkgtr31.SealKeyExchange(&message, signer)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(2)
+	}
+	writeOutput(envelope, outPath)
+	fmt.Printf("RESULT: %d keys from %s to %s sealed\n", len(message.Keys), message.From, message.To)
+}
+
+// kemOpen verifies a key exchange envelope and writes its message
+func kemOpen(path, publicKeyPath, outPath string) {
+	envelope, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+	data, err := os.ReadFile(publicKeyPath)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		fmt.Printf("no PEM public key found in %s\n", publicKeyPath)
+		os.Exit(1)
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	message, err := pkgtr31.OpenKeyExchange(envelope, publicKey)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(3)
+	}
+	out, err := json.MarshalIndent(message, "", "  ")
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(2)
+	}
+	writeOutput(out, outPath)
+	fmt.Printf("RESULT: %d keys from %s to %s verified\n", len(message.Keys), message.From, message.To)
+}
+
+// readSigningKey reads a PKCS#8 PEM private key file
+func readSigningKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM private key found in %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key type %T can't sign", key)
+	}
+	return signer, nil
+}
+
+// writeOutput writes out to the file at path, or to stdout when path is empty
+func writeOutput(out []byte, path string) {
+	if path == "" {
+		fmt.Printf("%s\n", out)
+	} else if err := os.WriteFile(path, append(out, '\n'), 0600); err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(2)
+	}
 }
 
 func makeFuncCall(f server.WrapperCall, params server.UnifiedParams) {
@@ -110,12 +363,20 @@ func help() {
 tr31 is a CLI implementing the TR-31 (ANSI X9.143) key block standard for secure cryptographic key exchange.
 
 USAGE
-   tr31 [-v] [-e] [-d]
+   tr31 [-v] [-e] [-d] [-audit] [-reencrypt] [-verify_audit] [-kem_seal] [-kem_open]
 
 EXAMPLES
   tr31 -v           Print the version of tr31 (Example: %s)
   tr31 -e			Encrypt card data block using tr31 kbkp key
   tr31 -d           Decrypt card data block using tr31 kbkp key
+  tr31 -audit       Audit key block header for weak configurations
+  tr31 -reencrypt   Translate the key blocks stored in vault to a new KBPK
+  tr31 -verify_audit audit.log -audit_public_key audit.pub
+                    Verify the signatures and hash chain of a server audit log
+  tr31 -kem_seal message.json -kem_signing_key bank.pem -kem_out envelope.json
+                    Sign a key exchange message for a partner
+  tr31 -kem_open envelope.json -kem_public_key bank.pub
+                    Verify a key exchange envelope from a partner
 
 FLAGS
 `), tr31.Version)
@@ -0,0 +1,155 @@
+//go:build js && wasm
+
+// Command tr31wasm builds the key block parser for browsers, so operators can
+// inspect key blocks client side and ciphertext never leaves their browser.
+// It registers tr31Parse, tr31Inspect and tr31KCV on the global object, which
+// tr31.js wraps.
+//
+//	cd cmd && GOOS=js GOARCH=wasm go build -o ../bin/tr31.wasm ./tr31wasm
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall/js"
+
+	"github.com/moov-io/tr31"
+	pkg "github.com/moov-io/tr31/pkg/tr31"
+)
+
+type headerResponse struct {
+	VersionID     string            `json:"versionId"`
+	KeyUsage      string            `json:"keyUsage"`
+	Algorithm     string            `json:"algorithm"`
+	ModeOfUse     string            `json:"modeOfUse"`
+	KeyVersion    string            `json:"keyVersion"`
+	Exportability string            `json:"exportability"`
+	Length        int               `json:"length"`
+	Blocks        map[string]string `json:"blocks"`
+}
+
+type inspectResponse struct {
+	headerResponse
+	Descriptions map[string]string `json:"descriptions"`
+	Deprecations []string          `json:"deprecations,omitempty"`
+	// Revisions lists the problems of the header against every revision of the standard
+	Revisions map[pkg.SpecRevision][]string `json:"revisions"`
+}
+
+func main() {
+	js.Global().Set("tr31Version", tr31.Version)
+	js.Global().Set("tr31Parse", function(parse))
+	js.Global().Set("tr31Inspect", function(inspect))
+	js.Global().Set("tr31KCV", function(kcv))
+	select {}
+}
+
+// function exposes fn to JavaScript, it returns the JSON encoded response or
+// {"error":"..."}
+func function(fn func(args []js.Value) (interface{}, error)) js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		resp, err := fn(args)
+		if err != nil {
+			resp = map[string]string{"error": err.Error()}
+		}
+		out, err := json.Marshal(resp)
+		if err != nil {
+			out, _ = json.Marshal(map[string]string{"error": err.Error()})
+		}
+		return string(out)
+	})
+}
+
+func stringArg(args []js.Value, i int, name string) (string, error) {
+	if len(args) <= i || args[i].Type() != js.TypeString {
+		return "", fmt.Errorf("%s must be a string", name)
+	}
+	return strings.TrimSpace(args[i].String()), nil
+}
+
+func loadHeader(args []js.Value) (*pkg.Header, error) {
+	keyBlock, err := stringArg(args, 0, "keyBlock")
+	if err != nil {
+		return nil, err
+	}
+	header := pkg.DefaultHeader()
+	if _, err := header.Load(keyBlock); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// parse returns the header fields and optional blocks of a key block
+func parse(args []js.Value) (interface{}, error) {
+	header, err := loadHeader(args)
+	if err != nil {
+		return nil, err
+	}
+	return headerResponseOf(header, args[0].String()), nil
+}
+
+// inspect describes the header of a key block: its blocks, deprecations and
+// conformance to each revision of the standard
+func inspect(args []js.Value) (interface{}, error) {
+	header, err := loadHeader(args)
+	if err != nil {
+		return nil, err
+	}
+	resp := inspectResponse{
+		headerResponse: headerResponseOf(header, args[0].String()),
+		Descriptions:   map[string]string{},
+		Deprecations:   header.Deprecations(),
+		Revisions:      map[pkg.SpecRevision][]string{},
+	}
+	for _, info := range header.Blocks.Inspect() {
+		resp.Descriptions[info.ID] = info.Description
+	}
+	for _, revision := range pkg.SpecRevisions() {
+		problems := []string{}
+		if err := header.Conforms(revision); err != nil {
+			problems = strings.Split(err.Error(), "\n")
+		}
+		resp.Revisions[revision] = problems
+	}
+	return resp, nil
+}
+
+// kcv returns the key check value of a hex key, for comparing clear components
+// entered by the operator
+func kcv(args []js.Value) (interface{}, error) {
+	key, err := stringArg(args, 0, "key")
+	if err != nil {
+		return nil, err
+	}
+	algorithm := pkg.ENC_ALGORITHM_TRIPLE_DES
+	if len(args) > 1 && args[1].Type() == js.TypeString {
+		algorithm = args[1].String()
+	}
+	decoded, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, errors.New("key must be hex")
+	}
+	defer clear(decoded)
+	value, err := pkg.KeyCheckValue(decoded, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"kcv": value}, nil
+}
+
+func headerResponseOf(h *pkg.Header, keyBlock string) headerResponse {
+	resp := headerResponse{
+		VersionID:     h.VersionID,
+		KeyUsage:      h.KeyUsage,
+		Algorithm:     h.Algorithm,
+		ModeOfUse:     h.ModeOfUse,
+		KeyVersion:    h.VersionNum,
+		Exportability: h.Exportability,
+		Blocks:        h.GetBlocks(),
+	}
+	fmt.Sscanf(strings.TrimSpace(keyBlock)[1:5], "%d", &resp.Length)
+	return resp
+}
@@ -0,0 +1,42 @@
+// tr31.js loads tr31.wasm in the browser and exposes the key block parser.
+// Key blocks and keys are handled client side, nothing is sent to a server.
+//
+//   <script src="wasm_exec.js"></script>
+//   <script src="tr31.js"></script>
+//   const tr31 = await loadTR31("tr31.wasm");
+//   tr31.inspect("D0112P0AE00E0000...");
+//
+// wasm_exec.js ships with Go, copy it from "$(go env GOROOT)/lib/wasm/wasm_exec.js".
+(function (global) {
+  "use strict";
+
+  function call(fn, ...args) {
+    const resp = JSON.parse(global[fn](...args));
+    if (resp && resp.error) {
+      throw new Error(resp.error);
+    }
+    return resp;
+  }
+
+  async function loadTR31(url) {
+    const go = new global.Go();
+    const source = fetch(url);
+    const { instance } = await (WebAssembly.instantiateStreaming
+      ? WebAssembly.instantiateStreaming(source, go.importObject)
+      : source.then((r) => r.arrayBuffer()).then((b) => WebAssembly.instantiate(b, go.importObject)));
+    go.run(instance);
+
+    return {
+      version: global.tr31Version,
+      // parse returns the header fields and optional blocks of a key block
+      parse: (keyBlock) => call("tr31Parse", keyBlock),
+      // inspect adds block descriptions, deprecations and the problems of the
+      // header against each revision of the standard
+      inspect: (keyBlock) => call("tr31Inspect", keyBlock),
+      // kcv returns the key check value of a hex key, algorithm "T" (default), "D" or "A"
+      kcv: (key, algorithm) => call("tr31KCV", key, algorithm || "T").kcv,
+    };
+  }
+
+  global.loadTR31 = loadTR31;
+})(globalThis);
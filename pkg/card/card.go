@@ -0,0 +1,87 @@
+// Package card computes card verification values (CVV, CVC, CVV2, iCVV) and PIN
+// verification values with keys unwrapped from TR-31 key blocks: card verification
+// keys (key usage C0) and PIN verification keys (key usage V0 to V2).
+package card
+
+import (
+	"crypto/des"
+	"crypto/subtle"
+	"errors"
+	"strings"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+// TR-31 key usages of the keys accepted by this package
+const (
+	// KEY_USAGE_CVK is a card verification key
+	KEY_USAGE_CVK string = "C0"
+	// KEY_USAGE_PVK_OTHER is a PIN verification key for other algorithms
+	KEY_USAGE_PVK_OTHER string = "V0"
+	// KEY_USAGE_PVK_IBM is a PIN verification key for the IBM 3624 method
+	KEY_USAGE_PVK_IBM string = "V1"
+	// KEY_USAGE_PVK_VISA is a PIN verification key for the Visa PVV method
+	KEY_USAGE_PVK_VISA string = "V2"
+)
+
+var (
+	errInvalidKey        = errors.New("key must be a double length TDES key")
+	errInvalidPAN        = errors.New("PAN must be 12 to 19 digits")
+	errInvalidExpiry     = errors.New("expiry date must be 4 digits")
+	errInvalidCode       = errors.New("service code must be 3 digits")
+	errInvalidPIN        = errors.New("PIN must be 4 to 12 digits")
+	errInvalidPVKI       = errors.New("PVKI must be 1 digit")
+	errInvalidTable      = errors.New("decimalization table must be 16 digits")
+	errInvalidValidation = errors.New("validation data must be 16 hexchars")
+	errKeyUsage          = errors.New("key block usage doesn't match the computation")
+)
+
+// CheckKeyUsage makes sure a key unwrapped from a key block is meant for the
+// computation, for example KEY_USAGE_CVK before computing CVVs
+func CheckKeyUsage(header *tr31.Header, usages ...string) error {
+	for _, usage := range usages {
+		if header.KeyUsage == usage {
+			return nil
+		}
+	}
+	return errKeyUsage
+}
+
+// Compare checks a computed value against a received one in constant time
+func Compare(expected, received string) bool {
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(received)) == 1
+}
+
+// decimalize keeps the decimal digits of a hex string, followed by its hex
+// digits A to F converted to 0 to 5, and returns the first n
+func decimalize(hexStr string, n int) string {
+	hexStr = strings.ToUpper(hexStr)
+	var digits strings.Builder
+	for _, c := range hexStr {
+		if c <= '9' {
+			digits.WriteRune(c)
+		}
+	}
+	for _, c := range hexStr {
+		if c > '9' {
+			digits.WriteRune(c - 'A' + '0')
+		}
+	}
+	return digits.String()[:n]
+}
+
+// encrypt encrypts a block with a double length TDES key, leaving the key untouched
+func encrypt(key, block []byte) ([]byte, error) {
+	if len(key) != 16 {
+		return nil, errInvalidKey
+	}
+	return tr31.EncryptTDSECB(append([]byte{}, key...), block)
+}
+
+// encryptSingle encrypts a block with single DES
+func encryptSingle(key, block []byte) []byte {
+	cipher, _ := des.NewCipher(key)
+	encrypted := make([]byte, des.BlockSize)
+	cipher.Encrypt(encrypted, block)
+	return encrypted
+}
@@ -0,0 +1,112 @@
+package card
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/moov-io/tr31/pkg/charset"
+	"github.com/moov-io/tr31/pkg/tr31"
+	"github.com/stretchr/testify/require"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return data
+}
+
+func TestComputeCVV(t *testing.T) {
+	cvk := mustHex(t, "0123456789ABCDEFFEDCBA9876543210")
+
+	cvv, err := ComputeCVV(cvk, "4123456789012345", "8701", "101")
+	require.NoError(t, err)
+	require.Equal(t, "561", cvv)
+
+	cvv2, err := ComputeCVV2(cvk, "4123456789012345", "8701")
+	require.NoError(t, err)
+	require.Len(t, cvv2, 3)
+	expected, _ := ComputeCVV(cvk, "4123456789012345", "8701", "000")
+	require.Equal(t, expected, cvv2)
+
+	icvv, err := ComputeICVV(cvk, "4123456789012345", "8701")
+	require.NoError(t, err)
+	expected, _ = ComputeCVV(cvk, "4123456789012345", "8701", "999")
+	require.Equal(t, expected, icvv)
+
+	_, err = ComputeCVV(cvk[:8], "4123456789012345", "8701", "101")
+	require.ErrorIs(t, err, errInvalidKey)
+	_, err = ComputeCVV(cvk, "41234567890A2345", "8701", "101")
+	require.ErrorIs(t, err, errInvalidPAN)
+	_, err = ComputeCVV(cvk, "4123456789012345", "870", "101")
+	require.ErrorIs(t, err, errInvalidExpiry)
+	_, err = ComputeCVV(cvk, "4123456789012345", "8701", "1O1")
+	require.ErrorIs(t, err, errInvalidCode)
+}
+
+func TestComputePVV(t *testing.T) {
+	pvk := mustHex(t, "0123456789ABCDEFFEDCBA9876543210")
+
+	pvv, err := ComputePVV(pvk, "4123456789012345", "1", "1234")
+	require.NoError(t, err)
+	require.Len(t, pvv, 4)
+	require.True(t, charset.IsNumeric(pvv))
+
+	// the transformed security parameter is the whole encrypted block
+	encrypted, err := tr31.EncryptTDSECB(append([]byte{}, pvk...), mustHex(t, "4567890123411234"))
+	require.NoError(t, err)
+	require.Equal(t, decimalize(hex.EncodeToString(encrypted), 4), pvv)
+
+	other, err := ComputePVV(pvk, "4123456789012345", "1", "4321")
+	require.NoError(t, err)
+	require.NotEqual(t, pvv, other)
+
+	_, err = ComputePVV(pvk, "4123456789012345", "12", "1234")
+	require.ErrorIs(t, err, errInvalidPVKI)
+	_, err = ComputePVV(pvk, "4123456789012345", "1", "123")
+	require.ErrorIs(t, err, errInvalidPIN)
+	_, err = ComputePVV(pvk[:8], "4123456789012345", "1", "1234")
+	require.ErrorIs(t, err, errInvalidKey)
+}
+
+func TestPINOffset(t *testing.T) {
+	pvk := mustHex(t, "0123456789ABCDEFFEDCBA9876543210")
+	validation := "4123456789012345"
+
+	offset, err := ComputePINOffset(pvk, validation, DEFAULT_DECIMALIZATION_TABLE, "1234")
+	require.NoError(t, err)
+	require.Len(t, offset, 4)
+
+	pin, err := PINFromOffset(pvk, validation, DEFAULT_DECIMALIZATION_TABLE, offset)
+	require.NoError(t, err)
+	require.Equal(t, "1234", pin)
+
+	natural, err := naturalPIN(pvk, validation, DEFAULT_DECIMALIZATION_TABLE, 6)
+	require.NoError(t, err)
+	offset, err = ComputePINOffset(pvk, validation, DEFAULT_DECIMALIZATION_TABLE, natural)
+	require.NoError(t, err)
+	require.Equal(t, "000000", offset)
+
+	_, err = ComputePINOffset(pvk, validation, "012345678901234", "1234")
+	require.ErrorIs(t, err, errInvalidTable)
+	_, err = ComputePINOffset(pvk, "41234567", DEFAULT_DECIMALIZATION_TABLE, "1234")
+	require.ErrorIs(t, err, errInvalidValidation)
+	_, err = PINFromOffset(pvk, validation, DEFAULT_DECIMALIZATION_TABLE, "12")
+	require.ErrorIs(t, err, errInvalidPIN)
+}
+
+func TestDecimalize(t *testing.T) {
+	require.Equal(t, "1234", decimalize("A1B2C3D4", 4))
+	require.Equal(t, "3012", decimalize("ABCDEF3A", 4))
+}
+
+func TestCheckKeyUsageAndCompare(t *testing.T) {
+	header := tr31.DefaultHeader()
+	header.KeyUsage = KEY_USAGE_CVK
+	require.NoError(t, CheckKeyUsage(header, KEY_USAGE_CVK))
+	require.ErrorIs(t, CheckKeyUsage(header, KEY_USAGE_PVK_IBM, KEY_USAGE_PVK_VISA), errKeyUsage)
+
+	require.True(t, Compare("561", "561"))
+	require.False(t, Compare("561", "562"))
+	require.False(t, Compare("561", "56"))
+}
@@ -0,0 +1,60 @@
+package card
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/moov-io/tr31/pkg/charset"
+)
+
+// Service codes used by the CVV variants
+const (
+	// SERVICE_CODE_CVV2 computes the CVV2/CVC2 printed on the card
+	SERVICE_CODE_CVV2 string = "000"
+	// SERVICE_CODE_ICVV computes the iCVV of the chip magnetic stripe image
+	SERVICE_CODE_ICVV string = "999"
+)
+
+// ComputeCVV computes the 3 digit card verification value (Visa CVV, Mastercard
+// CVC1) of a PAN, YYMM expiry date and service code with a double length CVK
+func ComputeCVV(cvk []byte, pan, expiry, serviceCode string) (string, error) {
+	if len(cvk) != 16 {
+		return "", errInvalidKey
+	}
+	if len(pan) < 12 || len(pan) > 19 || !charset.IsNumeric(pan) {
+		return "", errInvalidPAN
+	}
+	if len(expiry) != 4 || !charset.IsNumeric(expiry) {
+		return "", errInvalidExpiry
+	}
+	if len(serviceCode) != 3 || !charset.IsNumeric(serviceCode) {
+		return "", errInvalidCode
+	}
+
+	data := pan + expiry + serviceCode
+	data += strings.Repeat("0", 32-len(data))
+	block1, _ := hex.DecodeString(data[:16])
+	block2, _ := hex.DecodeString(data[16:])
+
+	// Single DES with the left key half on the first block, then TDES on the
+	// result xored with the second block
+	result := encryptSingle(cvk[:8], block1)
+	for i := range result {
+		result[i] ^= block2[i]
+	}
+	result, err := encrypt(cvk, result)
+	if err != nil {
+		return "", err
+	}
+	return decimalize(hex.EncodeToString(result), 3), nil
+}
+
+// ComputeCVV2 computes the CVV2/CVC2 printed on the card
+func ComputeCVV2(cvk []byte, pan, expiry string) (string, error) {
+	return ComputeCVV(cvk, pan, expiry, SERVICE_CODE_CVV2)
+}
+
+// ComputeICVV computes the iCVV of the magnetic stripe image on the chip
+func ComputeICVV(cvk []byte, pan, expiry string) (string, error) {
+	return ComputeCVV(cvk, pan, expiry, SERVICE_CODE_ICVV)
+}
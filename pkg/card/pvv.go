@@ -0,0 +1,94 @@
+package card
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/moov-io/tr31/pkg/charset"
+)
+
+// ComputePVV computes the 4 digit Visa PIN verification value from the 11
+// rightmost PAN digits excluding the check digit, the PIN verification key
+// index and the first 4 PIN digits, with a double length PVK
+func ComputePVV(pvk []byte, pan, pvki, pin string) (string, error) {
+	if len(pan) < 12 || len(pan) > 19 || !charset.IsNumeric(pan) {
+		return "", errInvalidPAN
+	}
+	if len(pvki) != 1 || !charset.IsNumeric(pvki) {
+		return "", errInvalidPVKI
+	}
+	if len(pin) < 4 || len(pin) > 12 || !charset.IsNumeric(pin) {
+		return "", errInvalidPIN
+	}
+
+	tsp, _ := hex.DecodeString(pan[len(pan)-12:len(pan)-1] + pvki + pin[:4])
+	result, err := encrypt(pvk, tsp)
+	if err != nil {
+		return "", err
+	}
+	return decimalize(hex.EncodeToString(result), 4), nil
+}
+
+// DEFAULT_DECIMALIZATION_TABLE maps hex digits 0 to F to decimal digits for the IBM 3624 method
+const DEFAULT_DECIMALIZATION_TABLE string = "0123456789012345"
+
+// ComputePINOffset computes the IBM 3624 PIN offset: the digit wise difference
+// modulo 10 between the PIN and the natural PIN, the encrypted validation data
+// decimalized with the table
+func ComputePINOffset(pvk []byte, validationData, table, pin string) (string, error) {
+	natural, err := naturalPIN(pvk, validationData, table, len(pin))
+	if err != nil {
+		return "", err
+	}
+	if len(pin) < 4 || len(pin) > 12 || !charset.IsNumeric(pin) {
+		return "", errInvalidPIN
+	}
+
+	var offset strings.Builder
+	for i := range pin {
+		offset.WriteByte('0' + (pin[i]-natural[i]+10)%10)
+	}
+	return offset.String(), nil
+}
+
+// PINFromOffset recovers the PIN a PIN offset was computed for, to check an entered PIN
+func PINFromOffset(pvk []byte, validationData, table, offset string) (string, error) {
+	natural, err := naturalPIN(pvk, validationData, table, len(offset))
+	if err != nil {
+		return "", err
+	}
+	if len(offset) < 4 || len(offset) > 12 || !charset.IsNumeric(offset) {
+		return "", errInvalidPIN
+	}
+
+	var pin strings.Builder
+	for i := range offset {
+		pin.WriteByte('0' + (natural[i]-'0'+offset[i]-'0')%10)
+	}
+	return pin.String(), nil
+}
+
+func naturalPIN(pvk []byte, validationData, table string, length int) (string, error) {
+	if len(table) != 16 || !charset.IsNumeric(table) {
+		return "", errInvalidTable
+	}
+	data, err := hex.DecodeString(validationData)
+	if err != nil || len(data) != 8 {
+		return "", errInvalidValidation
+	}
+	result, err := encrypt(pvk, data)
+	if err != nil {
+		return "", err
+	}
+
+	encrypted := strings.ToUpper(hex.EncodeToString(result))
+	if length > len(encrypted) {
+		length = len(encrypted)
+	}
+	var natural strings.Builder
+	for _, c := range encrypted[:length] {
+		index := strings.IndexRune("0123456789ABCDEF", c)
+		natural.WriteByte(table[index])
+	}
+	return natural.String(), nil
+}
@@ -0,0 +1,61 @@
+// Package charset provides the strict ASCII character set checks TR-31 applies
+// to key block fields.
+//
+// The checks compare bytes against ASCII ranges, never Unicode tables, so they
+// don't depend on the locale and reject every non-ASCII character: Unicode
+// digits and letters such as "٣" or "Ａ", combining marks and invalid UTF-8 are
+// all rejected.
+package charset
+
+// IsAlphanumeric reports whether s holds only ASCII letters and digits.
+// The empty string holds no other characters, so it is alphanumeric.
+func IsAlphanumeric(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isDigit(s[i]) && !isLetter(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsNumeric reports whether s holds only ASCII digits 0-9.
+// The empty string holds no other characters, so it is numeric.
+func IsNumeric(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isDigit(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsPrintable reports whether s holds only printable ASCII characters, 0x20
+// (space) to 0x7E (~). The empty string is printable.
+func IsPrintable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7E {
+			return false
+		}
+	}
+	return true
+}
+
+// IsHex reports whether s holds only ASCII hex digits, in either case.
+// Unlike the other checks the empty string is not hex, a hex value has at least one digit.
+func IsHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !isDigit(c) && !(c >= 'a' && c <= 'f') && !(c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,167 @@
+package charset
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestIsAlphanumeric(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  bool
+	}{
+		{"Empty string", "", true},                                 // No invalid characters
+		{"Lowercase letters", "hello", true},                       // All lowercase letters
+		{"Uppercase letters", "HELLO", true},                       // All uppercase letters
+		{"Numbers only", "123456", true},                           // Only numbers
+		{"Mixed alphanumeric", "Test123", true},                    // Combination of letters and numbers
+		{"Contains space", "Hello World", false},                   // Space is not allowed
+		{"Contains special characters", "abc@123", false},          // Special characters not allowed
+		{"Contains underscore", "abc_def", false},                  // Underscore is not allowed
+		{"Contains hyphen", "abc-def", false},                      // Hyphen is not allowed
+		{"Long alphanumeric string", "A1b2C3D4E5F6G7H8I9J0", true}, // Valid long alphanumeric string
+		{"Unicode letter", "caf\u00e9", false},                     // Latin-1 letters are not ASCII
+		{"Fullwidth letter", "\uff21BC", false},                    // Fullwidth A is not ASCII
+		{"Turkish dotless i", "\u0131d", false},                    // Locale specific case mappings are not ASCII
+		{"Invalid UTF-8", "AB\xff", false},                         // Invalid UTF-8 bytes are rejected
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := IsAlphanumeric(tt.input)
+			if got != tt.want {
+				t.Errorf("IsAlphanumeric(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsNumeric(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  bool
+	}{
+		{"Empty string", "", true},                          // Empty string is valid (no non-numeric chars)
+		{"Only digits", "123456", true},                     // Only digits
+		{"Digits with space", "123 456", false},             // Space is not allowed
+		{"Digits with letters", "123abc", false},            // Letters mixed with digits
+		{"Single digit", "7", true},                         // Single digit
+		{"Digits with special character", "123@456", false}, // Special character is not allowed
+		{"Alphanumeric string", "abc123", false},            // Alphanumeric string is invalid
+		{"Digits with leading zero", "01234", true},         // Leading zero should be allowed
+		{"Digits with punctuation", "12,34", false},         // Punctuation is not allowed
+		{"Valid number with digits", "999999", true},        // Valid all digits string
+		{"Arabic-Indic digits", "\u0661\u0662", false},      // Unicode digits are not ASCII digits
+		{"Fullwidth digits", "\uff11\uff12", false},         // Fullwidth digits are not ASCII digits
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := IsNumeric(tt.input)
+			if got != tt.want {
+				t.Errorf("IsNumeric(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsPrintable(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  bool
+	}{
+		{"Empty string", "", true},                                       // Empty string is valid
+		{"Only printable characters", "Hello World!", true},              // All characters are printable
+		{"Contains newline", "Hello\nWorld", false},                      // Contains newline, invalid
+		{"Contains tab", "Hello\tWorld", false},                          // Contains tab, invalid
+		{"Contains non-printable char", "Hello\x01World", false},         // Contains non-printable char (ASCII 1), invalid
+		{"Only digits", "1234567890", true},                              // Only digits, valid
+		{"Only lowercase letters", "abcdefghijklmnopqrstuvwxyz", true},   // Only lowercase letters, valid
+		{"Only uppercase letters", "ABCDEFGHIJKLMNOPQRSTUVWXYZ", true},   // Only uppercase letters, valid
+		{"Only punctuation", "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", true}, // Only punctuation, valid
+		{"Valid string with spaces", "Hello World", true},                // Valid string with spaces
+		{"Contains special character", "Hello@World", true},              // Valid string with special char
+		{"Invalid string with control char", "Hello\x02World", false},    // Contains control char (ASCII 2), invalid
+		{"String with numbers and letters", "abc123", true},              // Numbers and letters, valid
+		{"String with escape sequence", "Hello\\World", true},            // Escape sequence (backslash) is valid
+		{"String with some special characters", "Hello$World", true},     // Valid string with special chars
+		{"DEL character", "Hello\x7fWorld", false},                       // DEL (0x7F) is not printable
+		{"Non-breaking space", "Hello\u00a0World", false},                // Unicode spaces are not ASCII
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := IsPrintable(tt.input)
+			if got != tt.want {
+				t.Errorf("IsPrintable(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsHex(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  bool
+	}{
+		{"Empty string", "", false},                      // Empty string is invalid (hex should have at least one character)
+		{"Only hex digits", "123ABC", true},              // Only valid hex digits
+		{"Only lowercase hex digits", "abcdef", true},    // Only lowercase hex digits
+		{"Only uppercase hex digits", "ABCDEF", true},    // Only uppercase hex digits
+		{"Mixed case hex digits", "aBcDeF", true},        // Mixed case, still valid
+		{"Contains non-hex character", "123GHI", false},  // Contains non-hex characters (G, H, I)
+		{"Contains spaces", "1 2 3 4", false},            // Contains spaces, invalid
+		{"Contains special characters", "123$#@", false}, // Contains special characters, invalid
+		{"Fullwidth hex digits", "\uff21\uff22", false},  // Fullwidth A and B are not hex
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := IsHex(tt.input)
+			if got != tt.want {
+				t.Errorf("IsHex(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+// The fuzz targets check the byte-wise checks against regular expressions
+// matching ASCII only, on arbitrary and invalid UTF-8 input
+
+func FuzzIsAlphanumeric(f *testing.F) {
+	fuzzCharset(f, IsAlphanumeric, regexp.MustCompile("^[A-Za-z0-9]*$"))
+}
+
+func FuzzIsNumeric(f *testing.F) {
+	fuzzCharset(f, IsNumeric, regexp.MustCompile("^[0-9]*$"))
+}
+
+func FuzzIsPrintable(f *testing.F) {
+	fuzzCharset(f, IsPrintable, regexp.MustCompile("^[\\x20-\\x7E]*$"))
+}
+
+func FuzzIsHex(f *testing.F) {
+	fuzzCharset(f, IsHex, regexp.MustCompile("^[0-9A-Fa-f]+$"))
+}
+
+func fuzzCharset(f *testing.F, check func(string) bool, expected *regexp.Regexp) {
+	for _, seed := range []string{"", "B0", "0123456789abcdefABCDEF", "Hello World!~", "\u0661", "\uff21", "caf\u00e9", "\xff", "\x7f"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		got := check(s)
+		if got != expected.MatchString(s) {
+			t.Errorf("check(%q) = %v, want %v", s, got, !got)
+		}
+		// Accepted strings never hold a non-ASCII byte
+		for i := 0; got && i < len(s); i++ {
+			if s[i] >= 0x80 {
+				t.Errorf("check(%q) accepted non-ASCII byte %#x", s, s[i])
+			}
+		}
+	})
+}
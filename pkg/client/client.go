@@ -0,0 +1,530 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/moov-io/tr31/pkg/server"
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+var (
+	errEmptyResponse = errors.New("empty response data")
+	errNoKeys        = errors.New("no KBPK references provided")
+)
+
+// Client calls the tr31 server REST API with the vault credentials it was created with
+type Client struct {
+	baseURL      string
+	auth         server.Vault
+	httpClient   *http.Client
+	maxRetries   int
+	retryBackoff time.Duration
+	token        string
+	// idempotencyKeys sends an Idempotency-Key with POST requests so they're retried
+	idempotencyKeys bool
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient replaces the default http.Client
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithRetries sets how many times a request is retried after a transport error
+// or a 502, 503 or 504 response, waiting backoff multiplied by the attempt number.
+// Only GET, PUT and DELETE requests are retried, and POST requests sent with
+// WithIdempotencyKeys.
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.retryBackoff = backoff
+	}
+}
+
+// WithIdempotencyKeys sends a random Idempotency-Key header with POST requests,
+// the same for every retry, so they're retried. The server must keep responses
+// for idempotency keys, see server.WithIdempotencyKeys, or a retry may repeat
+// a request which was processed.
+func WithIdempotencyKeys() Option {
+	return func(c *Client) {
+		c.idempotencyKeys = true
+	}
+}
+
+// WithTenantToken sends the API token of a tenant with every request, for
+// servers serving several tenants
+func WithTenantToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// New creates a Client for the server at baseURL
+func New(baseURL string, auth server.Vault, opts ...Option) *Client {
+	c := &Client{
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
+		auth:         auth,
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+		maxRetries:   2,
+		retryBackoff: 100 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Error is returned when the server answers with an unsuccessful status code
+type Error struct {
+	StatusCode int
+	// Code is the machine-readable code of the error, such as server.ERROR_CODE_NOT_FOUND
+	Code      string
+	Message   string
+	RequestID string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("tr31 server returned %d: %s", e.StatusCode, e.Message)
+}
+
+// CreateMachine registers a machine for the client credentials
+func (c *Client) CreateMachine(ctx context.Context, allowedVersions ...string) (*server.Machine, error) {
+	body := map[string]interface{}{
+		"VaultAddress":    c.auth.VaultAddress,
+		"VaultToken":      c.auth.VaultToken,
+		"AllowedVersions": allowedVersions,
+	}
+	var resp struct {
+		Machine *server.Machine `json:"machine"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/machine", body, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Machine, nil
+}
+
+// CreateMachineWithKBPK registers a machine for the client credentials, generating
+// and storing its KBPK as bootstrap describes. The KCV of the KBPK is returned.
+func (c *Client) CreateMachineWithKBPK(ctx context.Context, bootstrap server.KBPKBootstrap, allowedVersions ...string) (*server.Machine, string, error) {
+	body := map[string]interface{}{
+		"VaultAddress":    c.auth.VaultAddress,
+		"VaultToken":      c.auth.VaultToken,
+		"AllowedVersions": allowedVersions,
+		"KBPK":            bootstrap,
+	}
+	var resp struct {
+		Machine *server.Machine `json:"machine"`
+		KCV     string          `json:"kcv"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/machine", body, &resp); err != nil {
+		return nil, "", err
+	}
+	return resp.Machine, resp.KCV, nil
+}
+
+// GetMachine returns the machine registered under the initial key
+func (c *Client) GetMachine(ctx context.Context, ik string) (*server.Machine, error) {
+	var resp struct {
+		Machine *server.Machine `json:"machine"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/machine/"+url.PathEscape(ik), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Machine, nil
+}
+
+// UpdateMachineTags merges tags into the tags of a machine, a nil value removes the tag
+func (c *Client) UpdateMachineTags(ctx context.Context, ik string, tags map[string]*string) (*server.Machine, error) {
+	body := map[string]interface{}{
+		"Tags": tags,
+	}
+	var resp struct {
+		Machine *server.Machine `json:"machine"`
+	}
+	if err := c.do(ctx, http.MethodPatch, "/machine/"+url.PathEscape(ik), body, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Machine, nil
+}
+
+// UpdateMachineHeaderTemplate replaces the header template applied to encrypt
+// requests for a machine, nil removes it
+func (c *Client) UpdateMachineHeaderTemplate(ctx context.Context, ik string, template *server.HeaderParams) (*server.Machine, error) {
+	body := map[string]interface{}{
+		"HeaderTemplate": template,
+	}
+	var resp struct {
+		Machine *server.Machine `json:"machine"`
+	}
+	if err := c.do(ctx, http.MethodPatch, "/machine/"+url.PathEscape(ik), body, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Machine, nil
+}
+
+// GetMachines returns every registered machine
+func (c *Client) GetMachines(ctx context.Context) ([]*server.Machine, error) {
+	var resp struct {
+		Machines []*server.Machine `json:"machines"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/machines", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Machines, nil
+}
+
+// Encrypt wraps the hex encoded key under the KBPK stored at keyPath/keyName
+func (c *Client) Encrypt(ctx context.Context, keyPath, keyName, encryptKey string, header server.HeaderParams) (string, error) {
+	result, err := c.EncryptWithResult(ctx, keyPath, keyName, encryptKey, header)
+	if err != nil {
+		return "", err
+	}
+	return result.KeyBlock, nil
+}
+
+// EncryptWithResult wraps the key like Encrypt, and also returns the KCV of the
+// key and the header the server wrapped it under
+func (c *Client) EncryptWithResult(ctx context.Context, keyPath, keyName, encryptKey string, header server.HeaderParams) (*server.EncryptResult, error) {
+	body := map[string]interface{}{
+		"VaultAddr":  c.auth.VaultAddress,
+		"VaultToken": c.auth.VaultToken,
+		"KeyPath":    keyPath,
+		"KeyName":    keyName,
+		"EncryptKey": encryptKey,
+		"Header":     header,
+	}
+	var resp struct {
+		Data   string              `json:"data"`
+		KCV    string              `json:"kcv"`
+		Header server.HeaderParams `json:"header"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/encrypt_data", body, &resp); err != nil {
+		return nil, err
+	}
+	// The server reports wrapping failures with an empty key block
+	if resp.Data == "" {
+		return nil, errEmptyResponse
+	}
+	return &server.EncryptResult{KeyBlock: resp.Data, KCV: resp.KCV, Header: resp.Header}, nil
+}
+
+// Decrypt unwraps the key block with the KBPK stored at keyPath/keyName
+func (c *Client) Decrypt(ctx context.Context, keyPath, keyName, keyBlock string) (string, error) {
+	body := map[string]interface{}{
+		"VaultAddr":  c.auth.VaultAddress,
+		"VaultToken": c.auth.VaultToken,
+		"KeyPath":    keyPath,
+		"KeyName":    keyName,
+		"KeyBlock":   keyBlock,
+	}
+	var resp struct {
+		Data string `json:"data"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/decrypt_data", body, &resp); err != nil {
+		return "", err
+	}
+	return resp.Data, nil
+}
+
+// DecryptWithFallback unwraps the key block trying the KBPKs in order, such as the
+// old and new KBPK during a rotation, and returns the key that unwrapped it
+func (c *Client) DecryptWithFallback(ctx context.Context, keys []server.KeyReference, keyBlock string) (string, server.KeyReference, error) {
+	if len(keys) == 0 {
+		return "", server.KeyReference{}, errNoKeys
+	}
+	body := map[string]interface{}{
+		"VaultAddr":    c.auth.VaultAddress,
+		"VaultToken":   c.auth.VaultToken,
+		"KeyPath":      keys[0].KeyPath,
+		"KeyName":      keys[0].KeyName,
+		"FallbackKeys": keys[1:],
+		"KeyBlock":     keyBlock,
+	}
+	var resp struct {
+		Data string              `json:"data"`
+		Key  server.KeyReference `json:"key"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/decrypt_data", body, &resp); err != nil {
+		return "", server.KeyReference{}, err
+	}
+	// Without fallback keys the server doesn't report the key used
+	if len(keys) == 1 {
+		resp.Key = keys[0]
+	}
+	return resp.Data, resp.Key, nil
+}
+
+// Inspect parses the cleartext header of a key block. No KBPK is needed,
+// so the key block is parsed locally instead of being sent to the server.
+func (c *Client) Inspect(keyBlock string) (*tr31.Header, error) {
+	header := tr31.DefaultHeader()
+	if _, err := header.Load(keyBlock); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// Rotate starts a rotation job generating and wrapping a fresh key for every item
+func (c *Client) Rotate(ctx context.Context, keyPath, keyName string, items []server.JobItem) (*server.Job, error) {
+	return c.CreateJob(ctx, server.JobRequest{
+		Type:    server.JOB_ROTATION,
+		KeyPath: keyPath,
+		KeyName: keyName,
+		Items:   items,
+	})
+}
+
+// CreateJob starts an asynchronous job, the client credentials are filled in
+func (c *Client) CreateJob(ctx context.Context, req server.JobRequest) (*server.Job, error) {
+	req.VaultAddr = c.auth.VaultAddress
+	req.VaultToken = c.auth.VaultToken
+	var resp struct {
+		Job *server.Job `json:"job"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/jobs", req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Job, nil
+}
+
+// GetJob returns the status of a job
+func (c *Client) GetJob(ctx context.Context, id string) (*server.Job, error) {
+	var resp struct {
+		Job *server.Job `json:"job"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/jobs/"+url.PathEscape(id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Job, nil
+}
+
+// CancelJob stops a job
+func (c *Client) CancelJob(ctx context.Context, id string) (*server.Job, error) {
+	var resp struct {
+		Job *server.Job `json:"job"`
+	}
+	if err := c.do(ctx, http.MethodDelete, "/jobs/"+url.PathEscape(id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Job, nil
+}
+
+// GetJobResults returns the results of a finished job
+func (c *Client) GetJobResults(ctx context.Context, id string) ([]server.JobResult, error) {
+	var resp struct {
+		Results []server.JobResult `json:"results"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/jobs/"+url.PathEscape(id)+"/result", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Results, nil
+}
+
+// StreamJobResults passes the results of a finished job to fn as the server
+// streams them as newline delimited JSON, so large batches aren't held in
+// memory. It stops at the first error of fn. Streams aren't retried, fn may
+// already have seen part of the results.
+func (c *Client) StreamJobResults(ctx context.Context, id string, fn func(server.JobResult) error) error {
+	return c.stream(ctx, "/jobs/"+url.PathEscape(id)+"/result", func(line json.RawMessage) error {
+		var result server.JobResult
+		if err := json.Unmarshal(line, &result); err != nil {
+			return err
+		}
+		return fn(result)
+	})
+}
+
+// StreamInventory passes the inventory items of a machine to fn as the server
+// streams them, see StreamJobResults. Servers signing responses don't stream
+// inventories, it returns an error with them.
+func (c *Client) StreamInventory(ctx context.Context, ik string, fn func(server.InventoryItem) error) error {
+	return c.stream(ctx, "/machines/"+url.PathEscape(ik)+"/inventory", func(line json.RawMessage) error {
+		var item server.InventoryItem
+		if err := json.Unmarshal(line, &item); err != nil {
+			return err
+		}
+		return fn(item)
+	})
+}
+
+// stream performs a GET request accepting newline delimited JSON and passes
+// each line to fn. A line with a request ID is the error ending a stream the
+// server cut short.
+func (c *Client) stream(ctx context.Context, path string, fn func(line json.RawMessage) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/x-ndjson")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		_, respErr := responseError(resp.StatusCode, data)
+		return respErr
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "application/x-ndjson" {
+		return fmt.Errorf("unexpected %s response, the server doesn't stream %s", mediaType, path)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for decoder.More() {
+		var line json.RawMessage
+		if err := decoder.Decode(&line); err != nil {
+			return err
+		}
+		var end struct {
+			RequestID *string               `json:"requestId"`
+			Error     *server.ErrorResponse `json:"error"`
+		}
+		if json.Unmarshal(line, &end) == nil && end.RequestID != nil && end.Error != nil {
+			return &Error{
+				StatusCode: resp.StatusCode,
+				Code:       end.Error.Code,
+				Message:    end.Error.Message,
+				RequestID:  *end.RequestID,
+			}
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	// Requests which aren't idempotent may have been processed before failing
+	header := make(http.Header)
+	retries := c.maxRetries
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+	case http.MethodPost:
+		if !c.idempotencyKeys {
+			retries = 0
+			break
+		}
+		key := make([]byte, 16)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		header.Set(server.IdempotencyKeyHeader, hex.EncodeToString(key))
+	default:
+		retries = 0
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(c.retryBackoff * time.Duration(attempt)):
+			}
+		}
+
+		retry, err := c.send(ctx, method, path, header, payload, out)
+		if err == nil || !retry {
+			return err
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+// send performs a single request and reports whether a failure may be retried
+func (c *Client) send(ctx context.Context, method, path string, header http.Header, payload []byte, out interface{}) (bool, error) {
+	var reader io.Reader
+	if payload != nil {
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return false, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return true, err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return responseError(resp.StatusCode, data)
+	}
+
+	if out == nil {
+		return false, nil
+	}
+	return false, json.Unmarshal(data, out)
+}
+
+// responseError reads the error envelope of a failed response and reports
+// whether the request may be retried
+func responseError(status int, data []byte) (bool, error) {
+	var body struct {
+		RequestID string                `json:"requestId"`
+		Error     *server.ErrorResponse `json:"error"`
+	}
+	json.Unmarshal(data, &body)
+	if body.Error == nil {
+		body.Error = &server.ErrorResponse{Message: http.StatusText(status)}
+	}
+	retry := status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable ||
+		status == http.StatusGatewayTimeout
+	return retry, &Error{
+		StatusCode: status,
+		Code:       body.Error.Code,
+		Message:    body.Error.Message,
+		RequestID:  body.RequestID,
+	}
+}
@@ -0,0 +1,271 @@
+package client
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/moov-io/tr31/pkg/server"
+	"github.com/moov-io/tr31/pkg/tr31"
+	"github.com/stretchr/testify/require"
+)
+
+func mockClient(t *testing.T) *Client {
+	t.Helper()
+	svc := server.NewService(server.NewRepositoryInMemory(nil), server.MODE_MOCK)
+	svc.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+
+	ts := httptest.NewServer(server.MakeHTTPHandler(svc))
+	t.Cleanup(ts.Close)
+
+	return New(ts.URL, server.Vault{VaultAddress: "http://localhost:8200", VaultToken: "token"})
+}
+
+func TestClient_CreateMachineWithKBPK(t *testing.T) {
+	c := mockClient(t)
+	ctx := context.Background()
+
+	bootstrap := server.KBPKBootstrap{KeyPath: "secret/tr31", KeyName: "kbpk", Type: server.KBPK_TYPE_AES_128}
+	m, kcv, err := c.CreateMachineWithKBPK(ctx, bootstrap, "D")
+	require.NoError(t, err)
+	require.Len(t, kcv, 6)
+	require.Equal(t, []server.KeyReference{{KeyPath: "secret/tr31", KeyName: "kbpk"}}, m.Keys)
+}
+
+func TestClient_Machines(t *testing.T) {
+	c := mockClient(t)
+	ctx := context.Background()
+
+	m, err := c.CreateMachine(ctx, "D")
+	require.NoError(t, err)
+	require.NotEmpty(t, m.InitialKey)
+	require.Equal(t, []string{"D"}, m.AllowedVersions)
+
+	found, err := c.GetMachine(ctx, m.InitialKey)
+	require.NoError(t, err)
+	require.Equal(t, m.InitialKey, found.InitialKey)
+
+	machines, err := c.GetMachines(ctx)
+	require.NoError(t, err)
+	require.Len(t, machines, 1)
+
+	prod := "prod"
+	tagged, err := c.UpdateMachineTags(ctx, m.InitialKey, map[string]*string{"environment": &prod})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"environment": "prod"}, tagged.Tags)
+
+	_, err = c.UpdateMachineTags(ctx, m.InitialKey, map[string]*string{"bad key": &prod})
+	var tagErr *Error
+	require.ErrorAs(t, err, &tagErr)
+	require.Equal(t, http.StatusBadRequest, tagErr.StatusCode)
+	require.Equal(t, server.ERROR_CODE_INVALID_MACHINE, tagErr.Code)
+
+	templated, err := c.UpdateMachineHeaderTemplate(ctx, m.InitialKey, &server.HeaderParams{VersionId: "D", Algorithm: "A"})
+	require.NoError(t, err)
+	require.Equal(t, "D", templated.HeaderTemplate.VersionId)
+	require.Equal(t, tagged.Tags, templated.Tags)
+	untemplated, err := c.UpdateMachineHeaderTemplate(ctx, m.InitialKey, nil)
+	require.NoError(t, err)
+	require.Nil(t, untemplated.HeaderTemplate)
+
+	_, err = c.GetMachine(ctx, "missing")
+	var clientErr *Error
+	require.ErrorAs(t, err, &clientErr)
+	require.Equal(t, http.StatusNotFound, clientErr.StatusCode)
+	require.Equal(t, server.ERROR_CODE_NOT_FOUND, clientErr.Code)
+	require.Equal(t, "not found", clientErr.Message)
+	require.NotEmpty(t, clientErr.RequestID)
+}
+
+func TestClient_Encrypt_Decrypt_Inspect(t *testing.T) {
+	c := mockClient(t)
+	ctx := context.Background()
+
+	header := server.HeaderParams{
+		VersionId:     "D",
+		KeyUsage:      "D0",
+		Algorithm:     "A",
+		ModeOfUse:     "D",
+		KeyVersion:    "00",
+		Exportability: "E",
+	}
+	keyBlock, err := c.Encrypt(ctx, "secret/tr31", "kbkp", "ccccccccccccccccdddddddddddddddd", header)
+	require.NoError(t, err)
+
+	data, err := c.Decrypt(ctx, "secret/tr31", "kbkp", keyBlock)
+	require.NoError(t, err)
+	require.Equal(t, "ccccccccccccccccdddddddddddddddd", data)
+
+	inspected, err := c.Inspect(keyBlock)
+	require.NoError(t, err)
+	require.Equal(t, "D", inspected.VersionID)
+	require.Equal(t, "D0", inspected.KeyUsage)
+
+	_, err = c.Encrypt(ctx, "secret/tr31", "missing", "cccc", header)
+	require.Error(t, err)
+
+	result, err := c.EncryptWithResult(ctx, "secret/tr31", "kbkp", "ccccccccccccccccdddddddddddddddd", header)
+	require.NoError(t, err)
+	require.Equal(t, header, result.Header)
+	key, _ := hex.DecodeString("ccccccccccccccccdddddddddddddddd")
+	kcv, err := tr31.KeyCheckValue(key, tr31.ENC_ALGORITHM_AES)
+	require.NoError(t, err)
+	require.Equal(t, kcv, result.KCV)
+
+	_, err = c.Decrypt(ctx, "secret/tr31", "kbkp", "")
+	require.IsType(t, &Error{}, err)
+}
+
+func TestClient_DecryptWithFallback(t *testing.T) {
+	c := mockClient(t)
+	ctx := context.Background()
+
+	header := server.HeaderParams{
+		VersionId:     "D",
+		KeyUsage:      "D0",
+		Algorithm:     "A",
+		ModeOfUse:     "D",
+		KeyVersion:    "00",
+		Exportability: "E",
+	}
+	keyBlock, err := c.Encrypt(ctx, "secret/tr31", "kbkp", "ccccccccccccccccdddddddddddddddd", header)
+	require.NoError(t, err)
+
+	keys := []server.KeyReference{{KeyPath: "secret/tr31", KeyName: "missing"}, {KeyPath: "secret/tr31", KeyName: "kbkp"}}
+	data, key, err := c.DecryptWithFallback(ctx, keys, keyBlock)
+	require.NoError(t, err)
+	require.Equal(t, "ccccccccccccccccdddddddddddddddd", data)
+	require.Equal(t, keys[1], key)
+
+	_, _, err = c.DecryptWithFallback(ctx, keys[:1], keyBlock)
+	require.IsType(t, &Error{}, err)
+
+	_, _, err = c.DecryptWithFallback(ctx, nil, keyBlock)
+	require.Equal(t, errNoKeys, err)
+}
+
+func TestClient_Rotate(t *testing.T) {
+	c := mockClient(t)
+	ctx := context.Background()
+
+	job, err := c.Rotate(ctx, "secret/tr31", "kbkp", []server.JobItem{
+		{
+			KeyLength: 16,
+			Header: server.HeaderParams{
+				VersionId:     "B",
+				KeyUsage:      "D0",
+				Algorithm:     "T",
+				ModeOfUse:     "D",
+				KeyVersion:    "00",
+				Exportability: "E",
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		job, err = c.GetJob(ctx, job.ID)
+		return err == nil && job.FinishedAt != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	results, err := c.GetJobResults(ctx, job.ID)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.Empty(t, results[0].Error)
+
+	var streamed []server.JobResult
+	require.NoError(t, c.StreamJobResults(ctx, job.ID, func(result server.JobResult) error {
+		streamed = append(streamed, result)
+		return nil
+	}))
+	require.Equal(t, results, streamed)
+
+	err = c.StreamJobResults(ctx, "missing", func(server.JobResult) error { return nil })
+	var clientErr *Error
+	require.ErrorAs(t, err, &clientErr)
+	require.Equal(t, http.StatusNotFound, clientErr.StatusCode)
+}
+
+func TestClient_Retries(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"machines":[]}`))
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL, server.Vault{}, WithRetries(2, time.Millisecond))
+	_, err := c.GetMachines(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	atomic.StoreInt32(&calls, 0)
+	c = New(ts.URL, server.Vault{}, WithRetries(0, time.Millisecond))
+	_, err = c.GetMachines(context.Background())
+	require.Equal(t, &Error{StatusCode: http.StatusServiceUnavailable, Message: "Service Unavailable"}, err)
+}
+
+func TestClient_Retries_Idempotency(t *testing.T) {
+	var calls int32
+	var keys []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(server.IdempotencyKeyHeader))
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			// The connection drops after the request was received
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			conn.Close()
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte(`{"data":"B0096P0TE00N0000"}`))
+		}
+	}))
+	defer ts.Close()
+
+	// Requests which aren't idempotent aren't retried
+	c := New(ts.URL, server.Vault{}, WithRetries(2, time.Millisecond))
+	_, err := c.Encrypt(context.Background(), "secret/tr31", "kbkp", "ccccccccccccccccdddddddddddddddd", server.HeaderParams{})
+	require.Error(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	require.Equal(t, []string{""}, keys)
+
+	// Unless they carry an idempotency key, the same for every retry
+	atomic.StoreInt32(&calls, 0)
+	keys = nil
+	c = New(ts.URL, server.Vault{}, WithRetries(2, time.Millisecond), WithIdempotencyKeys())
+	_, err = c.Encrypt(context.Background(), "secret/tr31", "kbkp", "ccccccccccccccccdddddddddddddddd", server.HeaderParams{})
+	require.NoError(t, err)
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	require.Len(t, keys, 3)
+	require.NotEmpty(t, keys[0])
+	require.Equal(t, keys[0], keys[1])
+	require.Equal(t, keys[0], keys[2])
+}
+
+func TestClient_TenantToken(t *testing.T) {
+	tenants, err := server.ParseTenants([]byte(`tenants: [{id: acquiring, tokenHashes: ["` + server.TenantTokenHash("acquiring-token") + `"]}]`))
+	require.NoError(t, err)
+	svc := server.NewService(server.NewRepositoryInMemory(nil), server.MODE_MOCK)
+	ts := httptest.NewServer(server.MakeHTTPHandler(svc, server.WithTenants(tenants)))
+	defer ts.Close()
+
+	auth := server.Vault{VaultAddress: "http://localhost:8200", VaultToken: "token"}
+	_, err = New(ts.URL, auth).GetMachines(context.Background())
+	var clientErr *Error
+	require.ErrorAs(t, err, &clientErr)
+	require.Equal(t, http.StatusUnauthorized, clientErr.StatusCode)
+
+	c := New(ts.URL, auth, WithTenantToken("acquiring-token"))
+	m, err := c.CreateMachine(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "acquiring", m.Tenant)
+}
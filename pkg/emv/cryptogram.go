@@ -0,0 +1,54 @@
+package emv
+
+// GenerateARQC computes the authorization request cryptogram over the
+// transaction data with the session key, as the ISO/IEC 9797-1 retail MAC.
+// Cryptogram version 10 pads with zeros, version 18 and later with 0x80.
+func GenerateARQC(sessionKey, data []byte, padding Padding) ([]byte, error) {
+	return retailMAC(sessionKey, data, padding)
+}
+
+// VerifyARQC checks a received ARQC in constant time
+func VerifyARQC(sessionKey, data, arqc []byte, padding Padding) (bool, error) {
+	expected, err := GenerateARQC(sessionKey, data, padding)
+	if err != nil {
+		return false, err
+	}
+	return compare(expected, arqc), nil
+}
+
+// GenerateARPCMethod1 computes the authorization response cryptogram with EMV
+// ARPC method 1: the ARQC xored with the 2 byte authorization response code,
+// encrypted with the session key
+func GenerateARPCMethod1(sessionKey, arqc, arc []byte) ([]byte, error) {
+	if len(sessionKey) != 16 {
+		return nil, errInvalidKey
+	}
+	if len(arqc) != 8 {
+		return nil, errInvalidARQC
+	}
+	if len(arc) != 2 {
+		return nil, errInvalidARC
+	}
+	block := append([]byte{}, arqc...)
+	block[0] ^= arc[0]
+	block[1] ^= arc[1]
+	return encryptBlock(sessionKey, block)
+}
+
+// GenerateARPCMethod2 computes the 4 byte authorization response cryptogram with
+// EMV ARPC method 2: the retail MAC of the ARQC, the 4 byte card status update
+// and the optional proprietary authentication data, padded with 0x80
+func GenerateARPCMethod2(sessionKey, arqc, csu, proprietaryAuthData []byte) ([]byte, error) {
+	if len(arqc) != 8 {
+		return nil, errInvalidARQC
+	}
+	if len(csu) != 4 {
+		return nil, errInvalidCSU
+	}
+	data := append(append(append([]byte{}, arqc...), csu...), proprietaryAuthData...)
+	mac, err := retailMAC(sessionKey, data, PADDING_80)
+	if err != nil {
+		return nil, err
+	}
+	return mac[:4], nil
+}
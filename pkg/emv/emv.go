@@ -0,0 +1,95 @@
+// Package emv derives EMV card keys and computes application cryptograms with
+// issuer master keys unwrapped from TR-31 key blocks (key usage E0 to E6).
+package emv
+
+import (
+	"crypto/des"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+var (
+	errInvalidKey  = errors.New("key must be a double length TDES key")
+	errInvalidPAN  = errors.New("PAN and PAN sequence number must be digits")
+	errInvalidATC  = errors.New("ATC must be 2 bytes")
+	errInvalidARQC = errors.New("ARQC must be 8 bytes")
+	errInvalidData = errors.New("cryptogram data must not be empty")
+	errInvalidTree = errors.New("EMV2000 tree needs a branch factor and height of at least 2 covering the ATC")
+	errInvalidARC  = errors.New("ARC must be 2 bytes")
+	errInvalidCSU  = errors.New("CSU must be 4 bytes")
+)
+
+// Padding selects the ISO/IEC 9797-1 padding method applied to cryptogram data
+type Padding int
+
+const (
+	// PADDING_ZEROS is ISO/IEC 9797-1 padding method 1, zeros up to the block size
+	PADDING_ZEROS Padding = 1
+	// PADDING_80 is ISO/IEC 9797-1 padding method 2, 0x80 followed by zeros
+	PADDING_80 Padding = 2
+)
+
+// encryptBlock encrypts a single block with a double length TDES key, leaving the key untouched
+func encryptBlock(key, block []byte) ([]byte, error) {
+	return tr31.EncryptTDSECB(append([]byte{}, key...), block)
+}
+
+// adjustParity sets odd parity on every key byte
+func adjustParity(key []byte) []byte {
+	adjusted, _ := tr31.AdjustKeyParity(key)
+	return adjusted
+}
+
+func pad(data []byte, padding Padding) ([]byte, error) {
+	switch padding {
+	case PADDING_ZEROS:
+		if len(data)%des.BlockSize == 0 {
+			return append([]byte{}, data...), nil
+		}
+		return append(append([]byte{}, data...), make([]byte, des.BlockSize-len(data)%des.BlockSize)...), nil
+	case PADDING_80:
+		padded := append(append([]byte{}, data...), 0x80)
+		if len(padded)%des.BlockSize != 0 {
+			padded = append(padded, make([]byte, des.BlockSize-len(padded)%des.BlockSize)...)
+		}
+		return padded, nil
+	}
+	return nil, fmt.Errorf("padding method %d is not supported", padding)
+}
+
+// retailMAC computes the ISO/IEC 9797-1 MAC algorithm 3 (retail MAC) of data
+// with a double length key: single DES CBC with the left key half, and the last
+// block decrypted with the right half and encrypted again with the left half
+func retailMAC(key, data []byte, padding Padding) ([]byte, error) {
+	if len(key) != 16 {
+		return nil, errInvalidKey
+	}
+	if len(data) == 0 {
+		return nil, errInvalidData
+	}
+	padded, err := pad(data, padding)
+	if err != nil {
+		return nil, err
+	}
+	left, _ := des.NewCipher(key[:8])
+	right, _ := des.NewCipher(key[8:])
+
+	mac := make([]byte, des.BlockSize)
+	for i := 0; i < len(padded); i += des.BlockSize {
+		for j := range mac {
+			mac[j] ^= padded[i+j]
+		}
+		left.Encrypt(mac, mac)
+	}
+	right.Decrypt(mac, mac)
+	left.Encrypt(mac, mac)
+	return mac, nil
+}
+
+// compare checks two cryptograms in constant time
+func compare(expected, received []byte) bool {
+	return subtle.ConstantTimeCompare(expected, received) == 1
+}
@@ -0,0 +1,160 @@
+package emv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/moov-io/tr31/pkg/charset"
+	"github.com/moov-io/tr31/pkg/tr31"
+	"github.com/stretchr/testify/require"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return data
+}
+
+func tdes(t *testing.T, key, block []byte) []byte {
+	t.Helper()
+	encrypted, err := tr31.EncryptTDSECB(append([]byte{}, key...), block)
+	require.NoError(t, err)
+	return encrypted
+}
+
+func parity(t *testing.T, key []byte) []byte {
+	t.Helper()
+	adjusted, err := tr31.AdjustKeyParity(key)
+	require.NoError(t, err)
+	return adjusted
+}
+
+func TestDeriveICCMasterKey(t *testing.T) {
+	imk := mustHex(t, "0123456789ABCDEFFEDCBA9876543210")
+
+	// Option A: the rightmost 16 digits of PAN and PSN, and their complement, encrypted with the IMK
+	mk, err := DeriveICCMasterKey(imk, "4761739001010010", "01")
+	require.NoError(t, err)
+	y := mustHex(t, "6173900101001001")
+	expected := append(tdes(t, imk, y), tdes(t, imk, xorFF(y))...)
+	require.Equal(t, parity(t, expected), mk)
+
+	// Short PANs are left padded with zeros
+	mk, err = DeriveICCMasterKey(imk, "476173900101", "01")
+	require.NoError(t, err)
+	y = mustHex(t, "0047617390010101")
+	require.Equal(t, parity(t, tdes(t, imk, y)), mk[:8])
+
+	// Option B hashes longer PANs
+	mk, err = DeriveICCMasterKey(imk, "4761739001010010123", "01")
+	require.NoError(t, err)
+	require.Len(t, mk, 16)
+	y, _ = hex.DecodeString(decimalizeOptionB("476173900101001012301"))
+	require.Equal(t, parity(t, tdes(t, imk, y)), mk[:8])
+
+	_, err = DeriveICCMasterKey(imk[:8], "4761739001010010", "01")
+	require.Equal(t, errInvalidKey, err)
+	_, err = DeriveICCMasterKey(imk, "4761-7390", "01")
+	require.Equal(t, errInvalidPAN, err)
+}
+
+func TestDecimalizeOptionB(t *testing.T) {
+	digits := decimalizeOptionB("476173900101001012301")
+	require.Len(t, digits, 16)
+	require.True(t, charset.IsNumeric(digits))
+}
+
+func TestDeriveCommonSessionKey(t *testing.T) {
+	mk := mustHex(t, "0123456789ABCDEFFEDCBA9876543210")
+	sk, err := DeriveCommonSessionKey(mk, []byte{0x00, 0x1C})
+	require.NoError(t, err)
+	left := tdes(t, mk, mustHex(t, "001CF00000000000"))
+	right := tdes(t, mk, mustHex(t, "001C0F0000000000"))
+	require.Equal(t, parity(t, append(left, right...)), sk)
+
+	_, err = DeriveCommonSessionKey(mk, []byte{0x1C})
+	require.Equal(t, errInvalidATC, err)
+}
+
+func TestDeriveEMV2000SessionKey(t *testing.T) {
+	mk := mustHex(t, "0123456789ABCDEFFEDCBA9876543210")
+	iv := make([]byte, 16)
+
+	// With a height of 2 the ATC leaf key is IK(2,3) = f(IK(1,1), MK, 1) with
+	// IK(1,1) = f(MK, IV, 1), and the session key is IK(2,3) xor MK
+	sk, err := DeriveEMV2000SessionKey(mk, []byte{0x00, 0x03}, 2, 2, iv)
+	require.NoError(t, err)
+	ik1, _ := emv2000Derive(mk, iv, 1)
+	ik2, _ := emv2000Derive(ik1, mk, 1)
+	require.Equal(t, parity(t, xor(ik2, mk)), sk)
+
+	sk8, err := DeriveEMV2000SessionKey(mk, []byte{0x00, 0x03}, 2, 8, iv)
+	require.NoError(t, err)
+	require.NotEqual(t, sk, sk8)
+
+	_, err = DeriveEMV2000SessionKey(mk, []byte{0x00, 0x04}, 2, 2, iv)
+	require.Equal(t, errInvalidTree, err)
+	_, err = DeriveEMV2000SessionKey(mk, []byte{0x00, 0x03}, 1, 8, iv)
+	require.Equal(t, errInvalidTree, err)
+	_, err = DeriveEMV2000SessionKey(mk, []byte{0x00, 0x03}, 2, 8, iv[:8])
+	require.Equal(t, errInvalidKey, err)
+}
+
+func TestARQC(t *testing.T) {
+	sk := mustHex(t, "0123456789ABCDEFFEDCBA9876543210")
+
+	// A single block retail MAC is a TDES encryption
+	block := mustHex(t, "1122334455667788")
+	arqc, err := GenerateARQC(sk, block, PADDING_ZEROS)
+	require.NoError(t, err)
+	require.Equal(t, tdes(t, sk, block), arqc)
+
+	// Longer data is chained with single DES under the left key half
+	data := mustHex(t, "000000001000000000000000097800000000000978230301003839303100")
+	arqc, err = GenerateARQC(sk, data, PADDING_80)
+	require.NoError(t, err)
+	padded, _ := pad(data, PADDING_80)
+	chained := make([]byte, 8)
+	for i := 0; i < len(padded)-8; i += 8 {
+		chained = tdes(t, sk[:8], xor(chained, padded[i:i+8]))
+	}
+	require.Equal(t, tdes(t, sk, xor(chained, padded[len(padded)-8:])), arqc)
+
+	valid, err := VerifyARQC(sk, data, arqc, PADDING_80)
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = VerifyARQC(sk, data, arqc, PADDING_ZEROS)
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	_, err = GenerateARQC(sk, nil, PADDING_80)
+	require.Equal(t, errInvalidData, err)
+	_, err = GenerateARQC(sk, data, Padding(3))
+	require.Error(t, err)
+}
+
+func TestARPC(t *testing.T) {
+	sk := mustHex(t, "0123456789ABCDEFFEDCBA9876543210")
+	arqc := mustHex(t, "1122334455667788")
+
+	arpc, err := GenerateARPCMethod1(sk, arqc, []byte("00"))
+	require.NoError(t, err)
+	decrypted, err := tr31.DecryptTDSECB(append([]byte{}, sk...), arpc)
+	require.NoError(t, err)
+	require.Equal(t, mustHex(t, "2112334455667788"), decrypted)
+
+	arpc, err = GenerateARPCMethod2(sk, arqc, mustHex(t, "00820000"), nil)
+	require.NoError(t, err)
+	mac, _ := retailMAC(sk, mustHex(t, "112233445566778800820000"), PADDING_80)
+	require.Equal(t, mac[:4], arpc)
+
+	_, err = GenerateARPCMethod1(sk, arqc[:4], []byte("00"))
+	require.Equal(t, errInvalidARQC, err)
+	_, err = GenerateARPCMethod1(sk, arqc, []byte("0"))
+	require.Equal(t, errInvalidARC, err)
+	_, err = GenerateARPCMethod2(sk, arqc, []byte{0x00}, nil)
+	require.Equal(t, errInvalidCSU, err)
+	require.False(t, bytes.Equal(arqc, arpc))
+}
@@ -0,0 +1,169 @@
+package emv
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+
+	"github.com/moov-io/tr31/pkg/charset"
+)
+
+// DeriveICCMasterKey derives the ICC master key from an issuer master key with
+// EMV Book 2 Annex A1.4 option A, or option B for PANs longer than 16 digits
+func DeriveICCMasterKey(imk []byte, pan, psn string) ([]byte, error) {
+	if len(imk) != 16 {
+		return nil, errInvalidKey
+	}
+	digits := pan + psn
+	if digits == "" || !charset.IsNumeric(digits) {
+		return nil, errInvalidPAN
+	}
+
+	switch {
+	case len(pan) > 16:
+		digits = decimalizeOptionB(digits)
+	case len(digits) > 16:
+		digits = digits[len(digits)-16:]
+	default:
+		digits = strings.Repeat("0", 16-len(digits)) + digits
+	}
+
+	y, _ := hex.DecodeString(digits)
+	left, err := encryptBlock(imk, y)
+	if err != nil {
+		return nil, err
+	}
+	right, err := encryptBlock(imk, xorFF(y))
+	if err != nil {
+		return nil, err
+	}
+	return adjustParity(append(left, right...)), nil
+}
+
+// decimalizeOptionB hashes the PAN and PAN sequence number with SHA-1 and keeps
+// the first 16 decimal digits of the hash, taking the hex digits A to F converted
+// to 0 to 5 when there are fewer than 16 decimal digits
+func decimalizeOptionB(digits string) string {
+	if len(digits)%2 != 0 {
+		digits = "0" + digits
+	}
+	packed, _ := hex.DecodeString(digits)
+	sum := sha1.Sum(packed)
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	var result strings.Builder
+	for _, c := range hash {
+		if c <= '9' && result.Len() < 16 {
+			result.WriteRune(c)
+		}
+	}
+	for _, c := range hash {
+		if c > '9' && result.Len() < 16 {
+			result.WriteRune(c - 'A' + '0')
+		}
+	}
+	return result.String()
+}
+
+// DeriveCommonSessionKey derives the application cryptogram session key for an
+// ATC with the EMV common session key derivation (EMV Book 2 Annex A1.3)
+func DeriveCommonSessionKey(iccMK, atc []byte) ([]byte, error) {
+	if len(iccMK) != 16 {
+		return nil, errInvalidKey
+	}
+	if len(atc) != 2 {
+		return nil, errInvalidATC
+	}
+	r := make([]byte, 8)
+	copy(r, atc)
+
+	r[2] = 0xF0
+	left, err := encryptBlock(iccMK, r)
+	if err != nil {
+		return nil, err
+	}
+	r[2] = 0x0F
+	right, err := encryptBlock(iccMK, r)
+	if err != nil {
+		return nil, err
+	}
+	return adjustParity(append(left, right...)), nil
+}
+
+// DeriveEMV2000SessionKey derives the session key for an ATC with the EMV2000 tree
+// derivation: intermediate keys IK(i,j) = f(IK(i-1,j/b), IK(i-2,j/b²), j mod b)
+// starting from IK(0,0) = ICC master key and IK(-1,0) = iv, and the session key
+// SK = IK(H,ATC) xor IK(H-2,ATC/b²). Cards commonly use a branch factor of 2,
+// a height of 8 and a zero IV.
+func DeriveEMV2000SessionKey(iccMK, atc []byte, branchFactor, height int, iv []byte) ([]byte, error) {
+	if len(iccMK) != 16 || len(iv) != 16 {
+		return nil, errInvalidKey
+	}
+	if len(atc) != 2 {
+		return nil, errInvalidATC
+	}
+	atcNum := int(binary.BigEndian.Uint16(atc))
+	leaves := 1
+	for i := 0; i < height && leaves <= atcNum; i++ {
+		leaves *= branchFactor
+	}
+	if branchFactor < 2 || height < 2 || atcNum >= leaves {
+		return nil, errInvalidTree
+	}
+
+	// Walk from the root to the ATC leaf, path[i] is IK(i, ATC/b^(H-i))
+	path := [][]byte{iccMK}
+	for i := 1; i <= height; i++ {
+		j := atcNum
+		for k := i; k < height; k++ {
+			j /= branchFactor
+		}
+		grandparent := iv
+		if i >= 2 {
+			grandparent = path[i-2]
+		}
+		child, err := emv2000Derive(path[i-1], grandparent, j%branchFactor)
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, child)
+	}
+	return adjustParity(xor(path[height], path[height-2])), nil
+}
+
+// emv2000Derive is the EMV2000 tree function f(X, Y, j): Y split in halves and
+// varied by j, encrypted under the parent key X
+func emv2000Derive(parent, grandparent []byte, j int) ([]byte, error) {
+	left := append([]byte{}, grandparent[:8]...)
+	right := append([]byte{}, grandparent[8:]...)
+	left[7] ^= byte(j)
+	right[7] ^= byte(j)
+	right[7] ^= 0xF0
+
+	l, err := encryptBlock(parent, left)
+	if err != nil {
+		return nil, err
+	}
+	r, err := encryptBlock(parent, right)
+	if err != nil {
+		return nil, err
+	}
+	return adjustParity(append(l, r...)), nil
+}
+
+func xorFF(data []byte) []byte {
+	result := make([]byte, len(data))
+	for i, b := range data {
+		result[i] = b ^ 0xFF
+	}
+	return result
+}
+
+func xor(a, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+	return result
+}
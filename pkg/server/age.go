@@ -0,0 +1,358 @@
+package server
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Shares are encrypted to custodians as age-encryption.org/v1 files with a
+// single X25519 recipient stanza and an ASCII armor, so custodians decrypt
+// them with the age CLI or OpenEscrowShare.
+
+const (
+	ageIntro        = "age-encryption.org/v1\n"
+	ageX25519Label  = "age-encryption.org/v1/X25519"
+	ageRecipientHRP = "age"
+	ageIdentityHRP  = "age-secret-key-"
+	ageArmorType    = "AGE ENCRYPTED FILE"
+	ageFileKeySize  = 16
+	ageNonceSize    = 16
+	ageChunkSize    = 64 * 1024
+)
+
+var (
+	errInvalidAgeKey  = errors.New("invalid age X25519 key")
+	errInvalidAgeFile = errors.New("invalid age file")
+)
+
+// GenerateAgeIdentity returns a new age X25519 identity, "AGE-SECRET-KEY-1...",
+// and the recipient shares are encrypted to, "age1..."
+func GenerateAgeIdentity() (identity, recipient string, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	identity = strings.ToUpper(bech32Encode(ageIdentityHRP, key.Bytes()))
+	recipient = bech32Encode(ageRecipientHRP, key.PublicKey().Bytes())
+	return identity, recipient, nil
+}
+
+// parseAgeRecipient decodes an age X25519 recipient
+func parseAgeRecipient(recipient string) (*ecdh.PublicKey, error) {
+	hrp, data, err := bech32Decode(recipient)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidAgeKey, err)
+	}
+	if hrp != ageRecipientHRP {
+		return nil, fmt.Errorf("%w: %q is not a recipient", errInvalidAgeKey, hrp)
+	}
+	key, err := ecdh.X25519().NewPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidAgeKey, err)
+	}
+	return key, nil
+}
+
+// parseAgeIdentity decodes an age X25519 identity
+func parseAgeIdentity(identity string) (*ecdh.PrivateKey, error) {
+	hrp, data, err := bech32Decode(identity)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidAgeKey, err)
+	}
+	defer wipe(data)
+	if hrp != ageIdentityHRP {
+		return nil, fmt.Errorf("%w: %q is not an identity", errInvalidAgeKey, hrp)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidAgeKey, err)
+	}
+	return key, nil
+}
+
+// sealAge encrypts plaintext, up to a single 64 KiB chunk, to the recipient as
+// an armored age file
+func sealAge(recipient *ecdh.PublicKey, plaintext []byte) (string, error) {
+	if len(plaintext) > ageChunkSize {
+		return "", fmt.Errorf("%w: plaintext is larger than a chunk", errInvalidAgeFile)
+	}
+	fileKey := make([]byte, ageFileKeySize)
+	defer wipe(fileKey)
+	if _, err := rand.Read(fileKey); err != nil {
+		return "", err
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	wrapKey, err := ageX25519WrapKey(ephemeral, recipient, ephemeral.PublicKey().Bytes(), recipient.Bytes())
+	if err != nil {
+		return "", err
+	}
+	defer wipe(wrapKey)
+	aead, err := chacha20poly1305.New(wrapKey)
+	if err != nil {
+		return "", err
+	}
+	body := aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil)
+
+	var file bytes.Buffer
+	file.WriteString(ageIntro)
+	fmt.Fprintf(&file, "-> X25519 %s\n", base64.RawStdEncoding.EncodeToString(ephemeral.PublicKey().Bytes()))
+	fmt.Fprintf(&file, "%s\n---", base64.RawStdEncoding.EncodeToString(body))
+	mac, err := ageHeaderMAC(fileKey, file.Bytes())
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(&file, " %s\n", base64.RawStdEncoding.EncodeToString(mac))
+
+	nonce := make([]byte, ageNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	payload, err := agePayloadAEAD(fileKey, nonce)
+	if err != nil {
+		return "", err
+	}
+	file.Write(nonce)
+	file.Write(payload.Seal(nil, ageLastChunkNonce(), plaintext, nil))
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: ageArmorType, Bytes: file.Bytes()})), nil
+}
+
+// openAge decrypts an armored age file with a single chunk for the identity
+func openAge(identity *ecdh.PrivateKey, armored string) ([]byte, error) {
+	block, _ := pem.Decode([]byte(strings.TrimSpace(armored)))
+	if block == nil || block.Type != ageArmorType {
+		return nil, fmt.Errorf("%w: no age armor found", errInvalidAgeFile)
+	}
+	file := block.Bytes
+	if !bytes.HasPrefix(file, []byte(ageIntro)) {
+		return nil, fmt.Errorf("%w: unknown version", errInvalidAgeFile)
+	}
+	end := bytes.Index(file, []byte("\n--- "))
+	if end < 0 {
+		return nil, fmt.Errorf("%w: header has no MAC", errInvalidAgeFile)
+	}
+	header := file[:end+len("\n---")]
+	macLine, payload, found := bytes.Cut(file[end+len("\n--- "):], []byte("\n"))
+	if !found {
+		return nil, fmt.Errorf("%w: header has no MAC", errInvalidAgeFile)
+	}
+
+	// Unwrap the file key from the first X25519 stanza addressed to the identity
+	var fileKey []byte
+	lines := strings.Split(string(header[len(ageIntro):len(header)-len("\n---")]), "\n")
+	for i := 0; i < len(lines); i++ {
+		args := strings.Fields(strings.TrimPrefix(lines[i], "->"))
+		if !strings.HasPrefix(lines[i], "-> ") || len(args) != 2 || args[0] != "X25519" || i+1 >= len(lines) {
+			continue
+		}
+		share, err := base64.RawStdEncoding.DecodeString(args[1])
+		if err != nil {
+			continue
+		}
+		ephemeral, err := ecdh.X25519().NewPublicKey(share)
+		if err != nil {
+			continue
+		}
+		body, err := base64.RawStdEncoding.DecodeString(lines[i+1])
+		if err != nil {
+			continue
+		}
+		wrapKey, err := ageX25519WrapKey(identity, ephemeral, share, identity.PublicKey().Bytes())
+		if err != nil {
+			continue
+		}
+		aead, err := chacha20poly1305.New(wrapKey)
+		wipe(wrapKey)
+		if err != nil {
+			continue
+		}
+		if key, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), body, nil); err == nil && len(key) == ageFileKeySize {
+			fileKey = key
+			break
+		}
+	}
+	if fileKey == nil {
+		return nil, fmt.Errorf("%w: no stanza for the identity", errInvalidAgeFile)
+	}
+	defer wipe(fileKey)
+
+	mac, err := base64.RawStdEncoding.DecodeString(string(macLine))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidAgeFile, err)
+	}
+	expected, err := ageHeaderMAC(fileKey, header)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, expected) {
+		return nil, fmt.Errorf("%w: header MAC doesn't match", errInvalidAgeFile)
+	}
+
+	if len(payload) < ageNonceSize+chacha20poly1305.Overhead || len(payload) > ageNonceSize+ageChunkSize+chacha20poly1305.Overhead {
+		return nil, fmt.Errorf("%w: payload isn't a single chunk", errInvalidAgeFile)
+	}
+	aead, err := agePayloadAEAD(fileKey, payload[:ageNonceSize])
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, ageLastChunkNonce(), payload[ageNonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidAgeFile, err)
+	}
+	return plaintext, nil
+}
+
+// ageX25519WrapKey derives the key wrapping the file key from the X25519 shared
+// secret of key and peer, salted with the ephemeral share and the recipient
+func ageX25519WrapKey(key *ecdh.PrivateKey, peer *ecdh.PublicKey, ephemeralShare, recipient []byte) ([]byte, error) {
+	shared, err := key.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidAgeKey, err)
+	}
+	defer wipe(shared)
+	salt := append(append([]byte{}, ephemeralShare...), recipient...)
+	return hkdf.Key(sha256.New, shared, salt, ageX25519Label, chacha20poly1305.KeySize)
+}
+
+// ageHeaderMAC authenticates the header up to and including "---"
+func ageHeaderMAC(fileKey, header []byte) ([]byte, error) {
+	key, err := hkdf.Key(sha256.New, fileKey, nil, "header", sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(header)
+	return mac.Sum(nil), nil
+}
+
+// agePayloadAEAD returns the STREAM cipher of the payload
+func agePayloadAEAD(fileKey, nonce []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, fileKey, nonce, "payload", chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+	return chacha20poly1305.New(key)
+}
+
+// ageLastChunkNonce is the STREAM nonce of the first chunk, flagged as the last
+func ageLastChunkNonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	nonce[len(nonce)-1] = 1
+	return nonce
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// bech32Encode encodes data as BIP 173 bech32 under the lower case hrp
+func bech32Encode(hrp string, data []byte) string {
+	values := convertBits(data, 8, 5, true)
+	checksum := bech32Polymod(append(bech32ExpandHRP(hrp), append(values, 0, 0, 0, 0, 0, 0)...)) ^ 1
+	var b strings.Builder
+	b.WriteString(hrp)
+	b.WriteByte('1')
+	for _, v := range values {
+		b.WriteByte(bech32Charset[v])
+	}
+	for i := range 6 {
+		b.WriteByte(bech32Charset[(checksum>>(5*(5-i)))&31])
+	}
+	return b.String()
+}
+
+// bech32Decode decodes a BIP 173 bech32 string, returning its lower case hrp
+func bech32Decode(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, errors.New("mixed case")
+	}
+	s = strings.ToLower(s)
+	separator := strings.LastIndexByte(s, '1')
+	if separator < 1 || separator+7 > len(s) {
+		return "", nil, errors.New("separator misplaced")
+	}
+	hrp := s[:separator]
+	values := make([]byte, 0, len(s)-separator-1)
+	for _, c := range s[separator+1:] {
+		v := strings.IndexRune(bech32Charset, c)
+		if v < 0 {
+			return "", nil, fmt.Errorf("invalid character %q", c)
+		}
+		values = append(values, byte(v))
+	}
+	if bech32Polymod(append(bech32ExpandHRP(hrp), values...)) != 1 {
+		return "", nil, errors.New("invalid checksum")
+	}
+	data := convertBits(values[:len(values)-6], 5, 8, false)
+	if data == nil {
+		return "", nil, errors.New("invalid padding")
+	}
+	return hrp, data, nil
+}
+
+func bech32Polymod(values []byte) uint32 {
+	generator := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := range 5 {
+			if (top>>i)&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32ExpandHRP(hrp string) []byte {
+	expanded := make([]byte, 0, len(hrp)*2+1)
+	for i := range len(hrp) {
+		expanded = append(expanded, hrp[i]>>5)
+	}
+	expanded = append(expanded, 0)
+	for i := range len(hrp) {
+		expanded = append(expanded, hrp[i]&31)
+	}
+	return expanded
+}
+
+// convertBits regroups data from groups of from bits into groups of to bits,
+// nil when the padding is invalid
+func convertBits(data []byte, from, to uint, pad bool) []byte {
+	var acc uint32
+	var bits uint
+	converted := make([]byte, 0, len(data)*int(from)/int(to)+1)
+	for _, v := range data {
+		acc = acc<<from | uint32(v)
+		bits += from
+		for bits >= to {
+			bits -= to
+			converted = append(converted, byte(acc>>bits)&(1<<to-1))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			converted = append(converted, byte(acc<<(to-bits))&(1<<to-1))
+		}
+	} else if bits >= from || byte(acc<<(to-bits))&(1<<to-1) != 0 {
+		return nil
+	}
+	return converted
+}
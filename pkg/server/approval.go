@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/moov-io/base/log"
+	"github.com/moov-io/tr31/pkg/tr31"
+	"gopkg.in/yaml.v3"
+)
+
+// ANY_PRINCIPAL matches every caller in a usage rule
+const ANY_PRINCIPAL = "*"
+
+var (
+	// ErrUsageNotApproved is returned when the caller may not unwrap key blocks with the key usage
+	ErrUsageNotApproved  = errors.New("key usage is not approved for the caller")
+	errInvalidUsageRules = errors.New("invalid usage rules")
+)
+
+// principalKey stores the caller identity in the go-kit context, its type
+// differs from requestIDKey so the keys don't collide
+var principalKey struct{ principal string }
+
+// PrincipalFunc identifies the caller of a request, an empty string for an anonymous caller
+type PrincipalFunc func(r *http.Request) string
+
+// PrincipalFromClientCert identifies callers by the common name of their TLS client certificate
+func PrincipalFromClientCert(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+// PrincipalFromHeader identifies callers by a header set by an API gateway
+// authenticating them in front of the service
+func PrincipalFromHeader(name string) PrincipalFunc {
+	return func(r *http.Request) string {
+		return strings.TrimSpace(r.Header.Get(name))
+	}
+}
+
+// UsageApprover decides whether a caller may unwrap key blocks with the header,
+// along with the reason of the decision, which is logged
+type UsageApprover interface {
+	Approve(principal string, header *tr31.Header) (bool, string)
+}
+
+// UsageRule lists the key usages and modes of use a principal may unwrap. Deny
+// takes precedence over Allow, an empty Allow or ModesOfUse allows any value.
+type UsageRule struct {
+	// Principal is the caller the rule applies to, ANY_PRINCIPAL for every caller
+	Principal  string   `yaml:"principal"`
+	Allow      []string `yaml:"allow"`
+	Deny       []string `yaml:"deny"`
+	ModesOfUse []string `yaml:"modesOfUse"`
+}
+
+// UsageRules approves key blocks with the first rule of the principal, or the
+// first ANY_PRINCIPAL rule when the principal has none. Callers without a rule
+// are denied.
+type UsageRules struct {
+	Rules []UsageRule `yaml:"rules"`
+}
+
+// ParseUsageRules parses and validates usage rules in YAML, such as
+//
+//	rules:
+//	  - principal: pos-gateway
+//	    allow: [D0, E0]
+//	    deny: [P0]
+func ParseUsageRules(data []byte) (*UsageRules, error) {
+	rules := &UsageRules{}
+	if err := yaml.Unmarshal(data, rules); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidUsageRules, err)
+	}
+	for i, rule := range rules.Rules {
+		if rule.Principal == "" {
+			return nil, fmt.Errorf("%w: rule %d has no principal", errInvalidUsageRules, i)
+		}
+		for _, usage := range append(slices.Clone(rule.Allow), rule.Deny...) {
+			if len(usage) != 2 {
+				return nil, fmt.Errorf("%w: rule %d has invalid key usage %q", errInvalidUsageRules, i, usage)
+			}
+		}
+		for _, mode := range rule.ModesOfUse {
+			if len(mode) != 1 {
+				return nil, fmt.Errorf("%w: rule %d has invalid mode of use %q", errInvalidUsageRules, i, mode)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// LoadUsageRules reads a usage rules file
+func LoadUsageRules(path string) (*UsageRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseUsageRules(data)
+}
+
+// Approve implements UsageApprover
+func (r *UsageRules) Approve(principal string, header *tr31.Header) (bool, string) {
+	rule, index, found := r.ruleOf(principal)
+	if !found {
+		return false, "no rule for principal"
+	}
+	switch {
+	case slices.Contains(rule.Deny, header.KeyUsage):
+		return false, fmt.Sprintf("rule %d denies key usage %s", index, header.KeyUsage)
+	case len(rule.Allow) > 0 && !slices.Contains(rule.Allow, header.KeyUsage):
+		return false, fmt.Sprintf("rule %d doesn't allow key usage %s", index, header.KeyUsage)
+	case len(rule.ModesOfUse) > 0 && !slices.Contains(rule.ModesOfUse, header.ModeOfUse):
+		return false, fmt.Sprintf("rule %d doesn't allow mode of use %s", index, header.ModeOfUse)
+	}
+	return true, fmt.Sprintf("rule %d allows key usage %s", index, header.KeyUsage)
+}
+
+func (r *UsageRules) ruleOf(principal string) (UsageRule, int, bool) {
+	for i, rule := range r.Rules {
+		if principal != "" && rule.Principal == principal {
+			return rule, i, true
+		}
+	}
+	for i, rule := range r.Rules {
+		if rule.Principal == ANY_PRINCIPAL {
+			return rule, i, true
+		}
+	}
+	return UsageRule{}, 0, false
+}
+
+// savePrincipalIntoContext saves the caller identity into the go-kit context
+func savePrincipalIntoContext(principal PrincipalFunc) httptransport.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		return context.WithValue(ctx, principalKey, principal(r))
+	}
+}
+
+func principalFrom(ctx context.Context) string {
+	principal, _ := ctx.Value(principalKey).(string)
+	return principal
+}
+
+// UnwrapOption describes the caller of a service call unwrapping key blocks
+type UnwrapOption func(*unwrapCall)
+
+type unwrapCall struct {
+	principal string
+}
+
+// AsPrincipal names the caller the usage approver decides for, see
+// ConfigureUsageApprover. Calls without it are made by an anonymous caller.
+func AsPrincipal(principal string) UnwrapOption {
+	return func(c *unwrapCall) {
+		c.principal = principal
+	}
+}
+
+func unwrapCallOf(opts []UnwrapOption) unwrapCall {
+	var call unwrapCall
+	for _, opt := range opts {
+		opt(&call)
+	}
+	return call
+}
+
+// usageApproval is the approver asked before the service unwraps key blocks
+type usageApproval struct {
+	approver UsageApprover
+	logger   log.Logger
+}
+
+// ConfigureUsageApprover asks the approver whether the caller may unwrap each
+// key block before the service unwraps it, whichever route or listener the
+// call comes from. Decisions are logged to logger, nil lifts the approval.
+func (s *service) ConfigureUsageApprover(approver UsageApprover, logger log.Logger) {
+	if approver == nil {
+		s.usageApproval.Store(nil)
+		return
+	}
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	s.usageApproval.Store(&usageApproval{approver: approver, logger: logger})
+}
+
+// approveUsage asks the usage approver whether principal may unwrap the key
+// block. The header is parsed and the decision logged before any crypto occurs.
+func (s *service) approveUsage(principal, keyBlock string) error {
+	approval := s.usageApproval.Load()
+	if approval == nil || keyBlock == "" {
+		return nil
+	}
+	header := tr31.DefaultHeader()
+	if _, err := header.Load(keyBlock); err != nil {
+		return err
+	}
+	approved, reason := approval.approver.Approve(principal, header)
+	decision := "denied"
+	if approved {
+		decision = "approved"
+	}
+	approval.logger.Logf("usage approval: principal %q key usage %s mode of use %s %s: %s",
+		principal, header.KeyUsage, header.ModeOfUse, decision, reason)
+	if !approved {
+		return fmt.Errorf("%w: %s", ErrUsageNotApproved, reason)
+	}
+	return nil
+}
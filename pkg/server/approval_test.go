@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/moov-io/base/log"
+	"github.com/moov-io/tr31/pkg/tr31"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageRules_Approve(t *testing.T) {
+	rules, err := ParseUsageRules([]byte(`
+rules:
+  - principal: pos-gateway
+    allow: [D0, E0]
+    deny: [P0]
+  - principal: mac-service
+    allow: [M3]
+    modesOfUse: [C]
+  - principal: "*"
+    deny: [P0]
+`))
+	require.NoError(t, err)
+
+	header := func(usage, mode string) *tr31.Header {
+		h, err := tr31.NewHeader("D", usage, "A", mode, "00", "E")
+		require.NoError(t, err)
+		return h
+	}
+	tests := []struct {
+		principal string
+		header    *tr31.Header
+		approved  bool
+	}{
+		{"pos-gateway", header("D0", "D"), true},
+		{"pos-gateway", header("E0", "N"), true},
+		{"pos-gateway", header("P0", "E"), false},
+		{"pos-gateway", header("K0", "B"), false},
+		{"mac-service", header("M3", "C"), true},
+		{"mac-service", header("M3", "G"), false},
+		{"anyone", header("K0", "B"), true},
+		{"anyone", header("P0", "E"), false},
+		{"", header("D0", "D"), true},
+	}
+	for _, tt := range tests {
+		approved, reason := rules.Approve(tt.principal, tt.header)
+		require.Equal(t, tt.approved, approved, "%s %s: %s", tt.principal, tt.header.KeyUsage, reason)
+	}
+
+	// Without a catch-all rule unknown callers are denied
+	rules.Rules = rules.Rules[:2]
+	approved, _ := rules.Approve("anyone", header("D0", "D"))
+	require.False(t, approved)
+
+	_, err = ParseUsageRules([]byte(`rules: [{allow: [D0]}]`))
+	require.ErrorIs(t, err, errInvalidUsageRules)
+	_, err = ParseUsageRules([]byte(`rules: [{principal: x, deny: [P]}]`))
+	require.ErrorIs(t, err, errInvalidUsageRules)
+	_, err = ParseUsageRules([]byte(`rules: [{principal: x, modesOfUse: [EN]}]`))
+	require.ErrorIs(t, err, errInvalidUsageRules)
+}
+
+func TestRouting_decrypt_data_usage_approval(t *testing.T) {
+	rules, err := ParseUsageRules([]byte(`
+rules:
+  - principal: pos-gateway
+    allow: [D0, E0]
+  - principal: mac-service
+    allow: [M3]
+`))
+	require.NoError(t, err)
+
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	s.ConfigureUsageApprover(rules, log.NewNopLogger())
+	router := MakeHTTPHandler(s, WithPrincipal(PrincipalFromHeader("X-Principal")))
+
+	post := func(principal string) *httptest.ResponseRecorder {
+		body := `{"KeyPath":"secret/tr31","KeyName":"kbkp",` +
+			`"KeyBlock":"A0088M3TC00E000022BD7EC46BBE2A6A73389D1BA6DB63120B386F912839F4679C0523399E4D8D0F1D9A356E"}` // gitleaks:allow
+		req := httptest.NewRequest("POST", "/decrypt_data", strings.NewReader(body))
+		req.Header.Set("X-Principal", principal)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post("mac-service")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	for _, principal := range []string{"pos-gateway", ""} {
+		w = post(principal)
+		require.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+		var body struct {
+			Error *ErrorResponse `json:"error"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		require.Equal(t, ERROR_CODE_USAGE_NOT_APPROVED, body.Error.Code)
+	}
+}
+
+func TestService_usage_approval(t *testing.T) {
+	rules, err := ParseUsageRules([]byte(`
+rules:
+  - principal: mac-service
+    allow: [M3]
+`))
+	require.NoError(t, err)
+
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	s.GetSecretManager().WriteSecret("secret/tr31", "target", "DDDDDDDDDDDDDDDDEEEEEEEEEEEEEEEEFFFFFFFFFFFFFFFF")
+	keyBlock := "A0088M3TC00E000022BD7EC46BBE2A6A73389D1BA6DB63120B386F912839F4679C0523399E4D8D0F1D9A356E" // gitleaks:allow
+	s.ConfigureUsageApprover(rules, log.NewNopLogger())
+
+	// Translating unwraps the key block like decrypting it
+	_, err = s.TranslateData("mock", "mock", "secret/tr31", "kbkp", "secret/tr31", "target", keyBlock, 10, AsPrincipal("pos-gateway"))
+	require.ErrorIs(t, err, ErrUsageNotApproved)
+	_, err = s.TranslateData("mock", "mock", "secret/tr31", "kbkp", "secret/tr31", "target", keyBlock, 10)
+	require.ErrorIs(t, err, ErrUsageNotApproved)
+	_, err = s.TranslateData("mock", "mock", "secret/tr31", "kbkp", "secret/tr31", "target", keyBlock, 10, AsPrincipal("mac-service"))
+	require.NoError(t, err)
+
+	// Rewrap jobs ask for the principal of the request creating them
+	for principal, failed := range map[string]int{"pos-gateway": 1, "mac-service": 0} {
+		job, err := s.CreateJob(JobRequest{
+			Type:          JOB_REWRAP,
+			VaultAddr:     "mock",
+			VaultToken:    "mock",
+			KeyPath:       "secret/tr31",
+			KeyName:       "kbkp",
+			TargetKeyPath: "secret/tr31",
+			TargetKeyName: "target",
+			Items:         []JobItem{{KeyBlock: keyBlock}},
+			Principal:     principal,
+		})
+		require.NoError(t, err)
+		job = waitForJob(t, s, job.ID)
+		require.Equal(t, failed, job.Failed, principal)
+	}
+
+	// Lifting the approval unwraps for every caller
+	s.ConfigureUsageApprover(nil, nil)
+	_, err = s.DecryptData("mock", "mock", "secret/tr31", "kbkp", keyBlock, 10, AsPrincipal("pos-gateway"))
+	require.NoError(t, err)
+}
@@ -0,0 +1,514 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/moov-io/base/log"
+)
+
+// AuditOperation names the operations recorded in the audit log
+type AuditOperation string
+
+const (
+	AUDIT_OPERATION_CREATE_MACHINE          AuditOperation = "create_machine"
+	AUDIT_OPERATION_DELETE_MACHINE          AuditOperation = "delete_machine"
+	AUDIT_OPERATION_ENCRYPT                 AuditOperation = "encrypt"
+	AUDIT_OPERATION_DECRYPT                 AuditOperation = "decrypt"
+	AUDIT_OPERATION_TRANSLATE               AuditOperation = "translate"
+	AUDIT_OPERATION_REGISTER_MANAGED        AuditOperation = "register_managed_key"
+	AUDIT_OPERATION_GET_MANAGED             AuditOperation = "get_managed_key"
+	AUDIT_OPERATION_DESTROY_MANAGED         AuditOperation = "destroy_managed_key"
+	AUDIT_OPERATION_ESCROW_KBPK             AuditOperation = "escrow_kbpk"
+	AUDIT_OPERATION_RECOVER_KBPK            AuditOperation = "recover_kbpk"
+	AUDIT_OPERATION_REENCRYPT_ESTATE        AuditOperation = "reencrypt_estate"
+	AUDIT_OPERATION_REGISTER_TRANSPORT      AuditOperation = "register_transport_key"
+	AUDIT_OPERATION_PROVISION_TERMINAL      AuditOperation = "provision_terminal"
+	AUDIT_OPERATION_DECRYPT_TO_TRANSPORT    AuditOperation = "decrypt_to_transport_key"
+	AUDIT_OPERATION_CREATE_PARTNER          AuditOperation = "create_partner"
+	AUDIT_OPERATION_DELETE_PARTNER          AuditOperation = "delete_partner"
+	AUDIT_OPERATION_DELIVER_KEY_EXCHANGE    AuditOperation = "deliver_key_exchange"
+	AUDIT_OPERATION_ROTATE_WORKING_KEY      AuditOperation = "rotate_working_key"
+	AUDIT_OPERATION_ACKNOWLEDGE_WORKING_KEY AuditOperation = "acknowledge_working_key"
+	AUDIT_OPERATION_ACTIVATE_WORKING_KEY    AuditOperation = "activate_working_key"
+	AUDIT_OPERATION_CHANGE_KEY_STATE        AuditOperation = "change_key_state"
+	AUDIT_OPERATION_RESPOND_TO_COMPROMISE   AuditOperation = "respond_to_compromise"
+)
+
+var (
+	errInvalidAuditLog    = errors.New("invalid audit log")
+	errInvalidAuditSigner = errors.New("invalid audit signer")
+)
+
+// AuditRecord is an operation of the service on machines and keys. Records
+// never hold key material.
+type AuditRecord struct {
+	Time      time.Time      `json:"time"`
+	Operation AuditOperation `json:"operation"`
+	// Subject is what the operation acted on, such as a machine initial key or a KBPK path
+	Subject string `json:"subject,omitempty"`
+	// Error is the error of failed operations
+	Error string `json:"error,omitempty"`
+	// Receipt is the receipt of delivered key exchange files, see Deliverer
+	Receipt string `json:"receipt,omitempty"`
+	// State and Reason are the state a key was moved to and why, see KeyState
+	State  string `json:"state,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// AuditBatch is a batch of records signed together. Each batch holds the
+// SHA-256 hash of the line of the batch before it, so batches can't be
+// removed, reordered or altered without breaking the chain.
+type AuditBatch struct {
+	Sequence     int           `json:"sequence"`
+	PreviousHash string        `json:"previousHash"`
+	Records      []AuditRecord `json:"records"`
+	KeyID        string        `json:"keyId"`
+}
+
+// SignedAuditBatch is an audit batch with the base64 Ed25519 signature over
+// the JSON encoding of the AuditBatch, checked with VerifyAuditLog
+type SignedAuditBatch struct {
+	AuditBatch
+	Signature string `json:"signature"`
+}
+
+// AuditSigner signs audit batches with an Ed25519 key
+type AuditSigner interface {
+	// KeyID identifies the signing key in the batches
+	KeyID() string
+	// PublicKey returns the key the batches are verified with
+	PublicKey() ed25519.PublicKey
+	// Sign returns the Ed25519 signature of data
+	Sign(data []byte) ([]byte, error)
+}
+
+// LocalAuditSigner signs audit batches with an Ed25519 private key held by the service
+type LocalAuditSigner struct {
+	key ed25519.PrivateKey
+}
+
+// NewLocalAuditSigner returns an AuditSigner for an Ed25519 private key
+func NewLocalAuditSigner(key ed25519.PrivateKey) *LocalAuditSigner {
+	return &LocalAuditSigner{key: key}
+}
+
+// LoadLocalAuditSigner reads a PEM encoded PKCS #8 Ed25519 private key from path
+func LoadLocalAuditSigner(path string) (*LocalAuditSigner, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM data found in %s", errInvalidAuditSigner, path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidAuditSigner, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported key type %T, expecting Ed25519", errInvalidAuditSigner, key)
+	}
+	return NewLocalAuditSigner(edKey), nil
+}
+
+// KeyID is the hex SHA-256 of the public key
+func (l *LocalAuditSigner) KeyID() string {
+	sum := sha256.Sum256(l.PublicKey())
+	return "local:" + hex.EncodeToString(sum[:])
+}
+
+func (l *LocalAuditSigner) PublicKey() ed25519.PublicKey {
+	return l.key.Public().(ed25519.PublicKey)
+}
+
+func (l *LocalAuditSigner) Sign(data []byte) ([]byte, error) {
+	return ed25519.Sign(l.key, data), nil
+}
+
+// VaultTransitAuditSigner signs audit batches with an ed25519 key of a Vault
+// Transit secrets engine, so the signing key never leaves Vault. Batches are
+// signed with the latest version of the key when the signer was created.
+type VaultTransitAuditSigner struct {
+	client    *api.Client
+	path      string
+	version   int
+	publicKey ed25519.PublicKey
+}
+
+// NewVaultTransitAuditSigner returns a signer using the ed25519 Transit key
+// name of the engine mounted at mount ("transit" when empty) of the Vault at address
+func NewVaultTransitAuditSigner(address, token, mount, name string) (*VaultTransitAuditSigner, error) {
+	client, vErr := createVaultClient(address, token, 10)
+	if vErr != nil {
+		return nil, vErr
+	}
+	if mount == "" {
+		mount = "transit"
+	}
+	mount = strings.Trim(mount, "/")
+
+	secret, err := client.Logical().Read(mount + "/keys/" + name)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("%w: transit key %s not found", errInvalidAuditSigner, name)
+	}
+	if keyType, _ := secret.Data["type"].(string); keyType != "ed25519" {
+		return nil, fmt.Errorf("%w: transit key %s is a %s key, expecting ed25519", errInvalidAuditSigner, name, keyType)
+	}
+	version, err := strconv.Atoi(fmt.Sprint(secret.Data["latest_version"]))
+	if err != nil {
+		return nil, fmt.Errorf("%w: transit key %s has no latest version", errInvalidAuditSigner, name)
+	}
+	keys, _ := secret.Data["keys"].(map[string]interface{})
+	latest, _ := keys[strconv.Itoa(version)].(map[string]interface{})
+	encoded, _ := latest["public_key"].(string)
+	publicKey, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: transit key %s has no ed25519 public key", errInvalidAuditSigner, name)
+	}
+	return &VaultTransitAuditSigner{
+		client:    client,
+		path:      mount + "/sign/" + name,
+		version:   version,
+		publicKey: publicKey,
+	}, nil
+}
+
+// KeyID is the Transit signing path and key version
+func (v *VaultTransitAuditSigner) KeyID() string {
+	return fmt.Sprintf("vault:%s:v%d", v.path, v.version)
+}
+
+func (v *VaultTransitAuditSigner) PublicKey() ed25519.PublicKey {
+	return v.publicKey
+}
+
+func (v *VaultTransitAuditSigner) Sign(data []byte) ([]byte, error) {
+	secret, err := v.client.Logical().Write(v.path, map[string]interface{}{
+		"input":       base64.StdEncoding.EncodeToString(data),
+		"key_version": v.version,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, errors.New("transit returned no signature")
+	}
+	// Signatures are returned as vault:v<version>:<base64>
+	signature, _ := secret.Data["signature"].(string)
+	parts := strings.SplitN(signature, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" || parts[1] != "v"+strconv.Itoa(v.version) {
+		return nil, fmt.Errorf("transit returned an unexpected signature %q", signature)
+	}
+	return base64.StdEncoding.DecodeString(parts[2])
+}
+
+// AuditConfig configures an AuditLog
+type AuditConfig struct {
+	// BatchSize is the number of records signed together, 100 when zero
+	BatchSize int
+	// Interval is how often Run signs the pending records, 1 minute when zero
+	Interval time.Duration
+	// Clock stamps the records, SystemClock when nil
+	Clock Clock
+}
+
+// AuditLog is an append-only file of the operations of the service, signed in
+// batches, one JSON SignedAuditBatch per line. The signatures and the hash
+// chain between batches make the log tamper-evident, see VerifyAuditLog.
+type AuditLog struct {
+	signer AuditSigner
+	config AuditConfig
+	logger log.Logger
+
+	mu           sync.Mutex
+	file         *os.File
+	pending      []AuditRecord
+	sequence     int
+	previousHash string
+}
+
+// NewAuditLog opens the audit log kept at path, creating it if needed, and
+// continues the hash chain of its last batch
+func NewAuditLog(path string, signer AuditSigner, config AuditConfig, logger log.Logger) (*AuditLog, error) {
+	if signer == nil {
+		return nil, fmt.Errorf("%w: audit log needs a signer", errInvalidAuditSigner)
+	}
+	if path == "" {
+		return nil, fmt.Errorf("%w: audit log needs a file", errInvalidAuditLog)
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 100
+	}
+	if config.Interval <= 0 {
+		config.Interval = time.Minute
+	}
+	config.Clock = clockOrSystem(config.Clock)
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	l := &AuditLog{signer: signer, config: config, logger: logger}
+	if err := l.load(path); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l.file = file
+	return l, nil
+}
+
+// load reads the sequence and hash of the last batch of the log file
+func (l *AuditLog) load(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var last []byte
+	reader := bufio.NewReader(file)
+	for {
+		data, err := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(data))) > 0 {
+			last = data
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if last == nil {
+		return nil
+	}
+	var batch SignedAuditBatch
+	if err := json.Unmarshal(last, &batch); err != nil {
+		return fmt.Errorf("%w: %s last batch: %v", errInvalidAuditLog, path, err)
+	}
+	l.sequence = batch.Sequence + 1
+	l.previousHash = auditBatchHash(last)
+	return nil
+}
+
+// auditBatchHash is the hex SHA-256 of the line of a batch, without its newline
+func auditBatchHash(line []byte) string {
+	sum := sha256.Sum256([]byte(strings.TrimRight(string(line), "\r\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// Record adds a record to the pending batch, signed once the batch is full or
+// by Run. Failures to sign are logged and the records kept for the next batch,
+// so the operations themselves never fail because of the audit log.
+func (l *AuditLog) Record(r AuditRecord) {
+	if r.Time.IsZero() {
+		r.Time = l.config.Clock.Now().UTC()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending = append(l.pending, r)
+	if len(l.pending) >= l.config.BatchSize {
+		if err := l.flush(); err != nil {
+			l.logger.LogErrorf("signing audit batch: %v", err)
+		}
+	}
+}
+
+// Flush signs the pending records as a batch and appends it to the log file
+func (l *AuditLog) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.flush()
+}
+
+func (l *AuditLog) flush() error {
+	if len(l.pending) == 0 {
+		return nil
+	}
+	if l.file == nil {
+		return fmt.Errorf("%w: audit log is closed", errInvalidAuditLog)
+	}
+	batch := AuditBatch{
+		Sequence:     l.sequence,
+		PreviousHash: l.previousHash,
+		Records:      l.pending,
+		KeyID:        l.signer.KeyID(),
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	signature, err := l.signer.Sign(body)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(SignedAuditBatch{AuditBatch: batch, Signature: base64.StdEncoding.EncodeToString(signature)})
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("appending to audit log: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("appending to audit log: %w", err)
+	}
+	l.sequence++
+	l.previousHash = auditBatchHash(line)
+	l.pending = nil
+	return nil
+}
+
+// Run signs the pending records every interval, until ctx is cancelled
+func (l *AuditLog) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.Flush(); err != nil {
+				l.logger.LogErrorf("signing audit batch: %v", err)
+			}
+		}
+	}
+}
+
+// Close signs the pending records and closes the log file
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.flush()
+	if cErr := l.file.Close(); err == nil {
+		err = cErr
+	}
+	l.file = nil
+	return err
+}
+
+// AuditVerification summarizes a verified audit log
+type AuditVerification struct {
+	Batches int `json:"batches"`
+	Records int `json:"records"`
+}
+
+// VerifyAuditLog checks every batch of an audit log was signed by key, and
+// the batches form an unbroken chain from the first one
+func VerifyAuditLog(r io.Reader, key ed25519.PublicKey) (*AuditVerification, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: expecting an Ed25519 public key", errInvalidAuditSigner)
+	}
+	var result AuditVerification
+	previousHash := ""
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		data := scanner.Bytes()
+		if len(strings.TrimSpace(string(data))) == 0 {
+			continue
+		}
+		var batch SignedAuditBatch
+		if err := json.Unmarshal(data, &batch); err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", errInvalidAuditLog, line, err)
+		}
+		if batch.Sequence != result.Batches {
+			return nil, fmt.Errorf("%w: line %d: batch %d follows batch %d", errInvalidAuditLog, line, batch.Sequence, result.Batches-1)
+		}
+		if batch.PreviousHash != previousHash {
+			return nil, fmt.Errorf("%w: line %d: previous hash doesn't match batch %d", errInvalidAuditLog, line, result.Batches-1)
+		}
+		body, err := json.Marshal(batch.AuditBatch)
+		if err != nil {
+			return nil, err
+		}
+		signature, err := base64.StdEncoding.DecodeString(batch.Signature)
+		if err != nil || !ed25519.Verify(key, body, signature) {
+			return nil, fmt.Errorf("%w: line %d: signature of batch %d is invalid", errInvalidAuditLog, line, batch.Sequence)
+		}
+		previousHash = auditBatchHash(data)
+		result.Batches++
+		result.Records += len(batch.Records)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ParseAuditPublicKey reads an Ed25519 public key given as a PEM "PUBLIC KEY"
+// block, or as the base64 raw key Vault Transit returns
+func ParseAuditPublicKey(data []byte) (ed25519.PublicKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidAuditSigner, err)
+		}
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%w: unsupported key type %T, expecting Ed25519", errInvalidAuditSigner, key)
+		}
+		return edKey, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: expecting a PEM or base64 Ed25519 public key", errInvalidAuditSigner)
+	}
+	return key, nil
+}
+
+// ConfigureAuditLog records the operations of the service in the audit log,
+// nil stops recording them
+func (s *service) ConfigureAuditLog(l *AuditLog) {
+	s.auditLog.Store(l)
+}
+
+// auditKeysSubject lists the KBPKs an operation could use
+func auditKeysSubject(keys []KeyReference) string {
+	subjects := make([]string, len(keys))
+	for i, key := range keys {
+		subjects[i] = key.KeyPath + "/" + key.KeyName
+	}
+	return strings.Join(subjects, ",")
+}
+
+// audit records an operation in the audit log
+func (s *service) audit(operation AuditOperation, subject string, err error) {
+	l := s.auditLog.Load()
+	if l == nil {
+		return
+	}
+	r := AuditRecord{Time: s.now().UTC(), Operation: operation, Subject: subject}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	l.Record(r)
+}
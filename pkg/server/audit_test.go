@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLog(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer := NewLocalAuditSigner(key)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	clock := NewManualClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+
+	l, err := NewAuditLog(path, signer, AuditConfig{BatchSize: 2, Clock: clock}, nil)
+	require.NoError(t, err)
+	l.Record(AuditRecord{Operation: AUDIT_OPERATION_ENCRYPT, Subject: "secret/tr31/kbkp"})
+	l.Record(AuditRecord{Operation: AUDIT_OPERATION_DECRYPT, Subject: "secret/tr31/kbkp", Error: "mac mismatch"})
+	l.Record(AuditRecord{Operation: AUDIT_OPERATION_DELETE_MACHINE, Subject: "ik"})
+	require.NoError(t, l.Close())
+
+	// Batches appended after a restart continue the chain
+	l, err = NewAuditLog(path, signer, AuditConfig{}, nil)
+	require.NoError(t, err)
+	l.Record(AuditRecord{Operation: AUDIT_OPERATION_CREATE_MACHINE, Subject: "ik"})
+	require.NoError(t, l.Flush())
+	require.NoError(t, l.Flush())
+	require.NoError(t, l.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 3)
+	var batch SignedAuditBatch
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &batch))
+	require.Equal(t, signer.KeyID(), batch.KeyID)
+	require.Equal(t, clock.Now(), batch.Records[0].Time)
+
+	verification, err := VerifyAuditLog(bytes.NewReader(data), signer.PublicKey())
+	require.NoError(t, err)
+	require.Equal(t, &AuditVerification{Batches: 3, Records: 4}, verification)
+
+	verify := func(lines ...string) error {
+		_, err := VerifyAuditLog(strings.NewReader(strings.Join(lines, "\n")), signer.PublicKey())
+		return err
+	}
+	require.ErrorIs(t, verify(strings.Replace(lines[0], "mac mismatch", "ok", 1), lines[1], lines[2]), errInvalidAuditLog)
+	require.ErrorIs(t, verify(lines[0], lines[2]), errInvalidAuditLog)
+	require.ErrorIs(t, verify(lines[1], lines[2]), errInvalidAuditLog)
+	require.ErrorIs(t, verify(lines[1], lines[0], lines[2]), errInvalidAuditLog)
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, err = VerifyAuditLog(bytes.NewReader(data), other)
+	require.ErrorIs(t, err, errInvalidAuditLog)
+
+	// Public keys are PEM, or base64 as Vault Transit returns them
+	der, err := x509.MarshalPKIXPublicKey(signer.PublicKey())
+	require.NoError(t, err)
+	parsed, err := ParseAuditPublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	require.NoError(t, err)
+	require.Equal(t, signer.PublicKey(), parsed)
+	parsed, err = ParseAuditPublicKey([]byte(base64.StdEncoding.EncodeToString(signer.PublicKey())))
+	require.NoError(t, err)
+	require.Equal(t, signer.PublicKey(), parsed)
+	_, err = ParseAuditPublicKey([]byte("AAAA"))
+	require.ErrorIs(t, err, errInvalidAuditSigner)
+}
+
+func TestAuditLog_service(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer := NewLocalAuditSigner(key)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := NewAuditLog(path, signer, AuditConfig{}, nil)
+	require.NoError(t, err)
+
+	s := mockServiceInMock()
+	s.ConfigureAuditLog(l)
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	m := NewMachine(mockVaultAuthOne())
+	m.Keys = []KeyReference{{KeyPath: "secret/tr31", KeyName: "kbkp"}}
+	require.NoError(t, s.CreateMachine(m))
+	_, err = s.DecryptData("", "", "secret/tr31", "kbkp", "not a key block", 1)
+	require.Error(t, err)
+	require.NoError(t, l.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var batch SignedAuditBatch
+	require.NoError(t, json.Unmarshal(data, &batch))
+	require.Len(t, batch.Records, 2)
+	require.Equal(t, AUDIT_OPERATION_CREATE_MACHINE, batch.Records[0].Operation)
+	require.Equal(t, m.InitialKey, batch.Records[0].Subject)
+	require.Empty(t, batch.Records[0].Error)
+	require.Equal(t, AUDIT_OPERATION_DECRYPT, batch.Records[1].Operation)
+	require.Equal(t, "secret/tr31/kbkp", batch.Records[1].Subject)
+	require.NotEmpty(t, batch.Records[1].Error)
+}
+
+func TestVaultTransitAuditSigner(t *testing.T) {
+	publicKey, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/v1/transit/keys/audit":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{
+					"type":           "ed25519",
+					"latest_version": 2,
+					"keys": map[string]interface{}{
+						"2": map[string]interface{}{"public_key": base64.StdEncoding.EncodeToString(publicKey)},
+					},
+				},
+			})
+		case r.Method == "PUT" && r.URL.Path == "/v1/transit/sign/audit":
+			var req struct {
+				Input      string `json:"input"`
+				KeyVersion int    `json:"key_version"`
+			}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			require.Equal(t, 2, req.KeyVersion)
+			input, err := base64.StdEncoding.DecodeString(req.Input)
+			require.NoError(t, err)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]string{"signature": "vault:v2:" + base64.StdEncoding.EncodeToString(ed25519.Sign(key, input))},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer vault.Close()
+
+	signer, err := NewVaultTransitAuditSigner(vault.URL, "token", "", "audit")
+	require.NoError(t, err)
+	require.Equal(t, "vault:transit/sign/audit:v2", signer.KeyID())
+	require.Equal(t, publicKey, signer.PublicKey())
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := NewAuditLog(path, signer, AuditConfig{}, nil)
+	require.NoError(t, err)
+	l.Record(AuditRecord{Operation: AUDIT_OPERATION_ENCRYPT, Subject: "secret/tr31/kbkp"})
+	require.NoError(t, l.Close())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	verification, err := VerifyAuditLog(bytes.NewReader(data), publicKey)
+	require.NoError(t, err)
+	require.Equal(t, 1, verification.Records)
+
+	_, err = NewVaultTransitAuditSigner(vault.URL, "token", "", "missing")
+	require.Error(t, err)
+}
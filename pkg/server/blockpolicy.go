@@ -0,0 +1,179 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/moov-io/tr31/pkg/charset"
+	"github.com/moov-io/tr31/pkg/tr31"
+	"gopkg.in/yaml.v3"
+)
+
+// BLOCK_VALUE_NOW is replaced with the wrap time, in the TS block layout, in
+// the value of a policy block
+const BLOCK_VALUE_NOW = "${NOW}"
+
+var (
+	// ErrBlockPolicy is returned when a key block misses an optional block required by the block policy
+	ErrBlockPolicy        = errors.New("key block doesn't satisfy the block policy")
+	errInvalidBlockPolicy = errors.New("invalid block policy")
+)
+
+// PolicyBlock is an optional block every key block must carry. Blocks with a
+// Value are added to the key blocks the service wraps, when their header
+// doesn't already carry them.
+type PolicyBlock struct {
+	// ID is the optional block ID, such as TS, LB or KS
+	ID string `yaml:"id"`
+	// Value is the block data added at wrap time, BLOCK_VALUE_NOW is replaced with the wrap time
+	Value string `yaml:"value"`
+	// Pattern is a regular expression the block data must match. Without it a
+	// Value without BLOCK_VALUE_NOW must match exactly, otherwise the block only needs to be present.
+	Pattern string `yaml:"pattern"`
+
+	pattern *regexp.Regexp
+}
+
+// BlockPolicy lists the optional blocks institutions require in their key
+// blocks, such as a TS timestamp or an LB label with an institution code. The
+// service adds them before wrapping and verifies them on inbound key blocks
+// before unwrapping.
+type BlockPolicy struct {
+	Blocks []PolicyBlock `yaml:"blocks"`
+}
+
+// ParseBlockPolicy parses and validates a block policy in YAML, such as
+//
+//	blocks:
+//	  - id: TS
+//	    value: ${NOW}
+//	  - id: LB
+//	    value: INST0042
+//	  - id: KS
+//	    pattern: ^FFFF9876[0-9A-F]{12}$
+func ParseBlockPolicy(data []byte) (*BlockPolicy, error) {
+	policy := &BlockPolicy{}
+	if err := yaml.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidBlockPolicy, err)
+	}
+	seen := make(map[string]bool, len(policy.Blocks))
+	for i := range policy.Blocks {
+		block := &policy.Blocks[i]
+		if len(block.ID) != 2 || !charset.IsAlphanumeric(block.ID) {
+			return nil, fmt.Errorf("%w: block ID %q must be 2 alphanumeric characters", errInvalidBlockPolicy, block.ID)
+		}
+		if seen[block.ID] {
+			return nil, fmt.Errorf("%w: block %s is declared twice", errInvalidBlockPolicy, block.ID)
+		}
+		seen[block.ID] = true
+		if block.Value == "" && block.Pattern == "" {
+			return nil, fmt.Errorf("%w: block %s needs a value or a pattern", errInvalidBlockPolicy, block.ID)
+		}
+		// Setting the value on a header checks the data uses the block's charset
+		if block.Value != "" {
+			if err := tr31.DefaultHeader().Blocks.Set(block.ID, block.expand(time.Now())); err != nil {
+				return nil, fmt.Errorf("%w: block %s: %v", errInvalidBlockPolicy, block.ID, err)
+			}
+		}
+		if block.Pattern != "" {
+			pattern, err := regexp.Compile(block.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("%w: block %s pattern: %v", errInvalidBlockPolicy, block.ID, err)
+			}
+			block.pattern = pattern
+		}
+	}
+	return policy, nil
+}
+
+// LoadBlockPolicy reads a block policy file
+func LoadBlockPolicy(path string) (*BlockPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseBlockPolicy(data)
+}
+
+// expand returns the value of the block at wrap time
+func (b *PolicyBlock) expand(now time.Time) string {
+	return strings.ReplaceAll(b.Value, BLOCK_VALUE_NOW, now.UTC().Format(timestampLayout))
+}
+
+// check reports why the block data doesn't satisfy the policy block
+func (b *PolicyBlock) check(data string, found bool) error {
+	// Policies built in Go rather than parsed have their pattern compiled here
+	pattern := b.pattern
+	if pattern == nil && b.Pattern != "" {
+		var err error
+		if pattern, err = regexp.Compile(b.Pattern); err != nil {
+			return fmt.Errorf("%w: block %s pattern: %v", errInvalidBlockPolicy, b.ID, err)
+		}
+	}
+	switch {
+	case !found:
+		return fmt.Errorf("%w: block %s is missing", ErrBlockPolicy, b.ID)
+	case pattern != nil && !pattern.MatchString(data):
+		return fmt.Errorf("%w: block %s (%s) doesn't match %s", ErrBlockPolicy, b.ID, data, b.Pattern)
+	case pattern == nil && !strings.Contains(b.Value, BLOCK_VALUE_NOW) && data != b.Value:
+		return fmt.Errorf("%w: block %s (%s) is not %s", ErrBlockPolicy, b.ID, data, b.Value)
+	}
+	return nil
+}
+
+// Apply adds the policy blocks the header doesn't carry yet and checks the
+// header then satisfies the policy. A nil policy requires no blocks.
+func (p *BlockPolicy) Apply(header *tr31.Header, now time.Time) error {
+	if p == nil {
+		return nil
+	}
+	for i := range p.Blocks {
+		block := &p.Blocks[i]
+		if block.Value == "" || header.Blocks.Contains(block.ID) {
+			continue
+		}
+		if err := header.Blocks.Set(block.ID, block.expand(now)); err != nil {
+			return err
+		}
+	}
+	return p.Verify(header)
+}
+
+// Verify checks the header carries every policy block. A nil policy requires no blocks.
+func (p *BlockPolicy) Verify(header *tr31.Header) error {
+	if p == nil {
+		return nil
+	}
+	blocks := header.GetBlocks()
+	for i := range p.Blocks {
+		data, found := blocks[p.Blocks[i].ID]
+		if err := p.Blocks[i].check(data, found); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConfigureBlockPolicy sets the optional blocks added to the key blocks the
+// service wraps and required from the key blocks it unwraps, nil removes the policy
+func (s *service) ConfigureBlockPolicy(policy *BlockPolicy) {
+	s.blockPolicy.Store(policy)
+}
+
+// checkBlockPolicy verifies an inbound key block carries the policy blocks,
+// from its header only, so key blocks failing the policy aren't unwrapped
+func (s *service) checkBlockPolicy(keyBlock string) error {
+	policy := s.blockPolicy.Load()
+	if policy == nil || keyBlock == "" {
+		return nil
+	}
+	header := tr31.DefaultHeader()
+	if _, err := header.Load(keyBlock); err != nil {
+		return err
+	}
+	return policy.Verify(header)
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBlockPolicy(t *testing.T) {
+	policy, err := ParseBlockPolicy([]byte(`
+blocks:
+  - id: TS
+    value: ${NOW}
+  - id: LB
+    value: INST0042
+  - id: KS
+    pattern: ^FFFF9876[0-9A-F]{12}$
+`))
+	require.NoError(t, err)
+	require.Len(t, policy.Blocks, 3)
+
+	invalid := []string{
+		`blocks: [{id: T, value: x}]`,
+		`blocks: [{id: LB}]`,
+		`blocks: [{id: LB, value: a}, {id: LB, value: b}]`,
+		`blocks: [{id: KS, pattern: "[0-9"}]`,
+		`blocks: [{id: TS, value: "2024-01-01"}]`,
+	}
+	for _, data := range invalid {
+		_, err := ParseBlockPolicy([]byte(data))
+		require.ErrorIs(t, err, errInvalidBlockPolicy, data)
+	}
+}
+
+func TestBlockPolicy_Apply(t *testing.T) {
+	policy, err := ParseBlockPolicy([]byte(`
+blocks:
+  - id: TS
+    value: ${NOW}
+  - id: LB
+    value: INST0042
+  - id: KS
+    pattern: ^FFFF9876[0-9A-F]{12}$
+`))
+	require.NoError(t, err)
+
+	header, err := tr31.NewHeader("B", "P0", "T", "E", "00", "E")
+	require.NoError(t, err)
+	require.NoError(t, header.Blocks.Set("KS", "FFFF9876543210E00000"))
+	now := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	require.NoError(t, policy.Apply(header, now))
+	require.Equal(t, map[string]string{
+		"KS": "FFFF9876543210E00000",
+		"LB": "INST0042",
+		"TS": "20240501123000Z",
+	}, header.GetBlocks())
+
+	// Blocks already carried aren't replaced, but still checked
+	header.Blocks.Set("LB", "INST0001")
+	require.ErrorIs(t, policy.Apply(header, now), ErrBlockPolicy)
+
+	// Blocks without a value can't be added
+	header, _ = tr31.NewHeader("B", "P0", "T", "E", "00", "E")
+	require.ErrorIs(t, policy.Apply(header, now), ErrBlockPolicy)
+	header.Blocks.Set("KS", "FFFF1234543210E00000")
+	require.ErrorIs(t, policy.Verify(header), ErrBlockPolicy)
+
+	var none *BlockPolicy
+	require.NoError(t, none.Apply(header, now))
+}
+
+func TestService_BlockPolicy(t *testing.T) {
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	auth := mockVaultAuthOne()
+	header := HeaderParams{VersionId: "D", KeyUsage: "D0", Algorithm: "A", ModeOfUse: "D", KeyVersion: "00", Exportability: "E"}
+
+	// Key blocks wrapped before the policy don't carry the blocks
+	before, err := s.EncryptData(auth.VaultAddress, auth.VaultToken, "secret/tr31", "kbkp", "ccccccccccccccccdddddddddddddddd", header, 10)
+	require.NoError(t, err)
+
+	policy, err := ParseBlockPolicy([]byte(`
+blocks:
+  - id: TS
+    value: ${NOW}
+  - id: LB
+    value: INST0042
+`))
+	require.NoError(t, err)
+	s.ConfigureBlockPolicy(policy)
+
+	keyBlock, err := s.EncryptData(auth.VaultAddress, auth.VaultToken, "secret/tr31", "kbkp", "ccccccccccccccccdddddddddddddddd", header, 10)
+	require.NoError(t, err)
+	parsed := tr31.DefaultHeader()
+	_, err = parsed.Load(keyBlock)
+	require.NoError(t, err)
+	require.Equal(t, "INST0042", parsed.GetBlocks()["LB"])
+	_, err = time.Parse(timestampLayout, parsed.GetBlocks()["TS"])
+	require.NoError(t, err)
+
+	data, err := s.DecryptData(auth.VaultAddress, auth.VaultToken, "secret/tr31", "kbkp", keyBlock, 10)
+	require.NoError(t, err)
+	require.Equal(t, "ccccccccccccccccdddddddddddddddd", data)
+
+	// The header echoed back carries the policy blocks
+	result, err := s.EncryptDataWithResult(auth.VaultAddress, auth.VaultToken, "secret/tr31", "kbkp", "ccccccccccccccccdddddddddddddddd", header, 10)
+	require.NoError(t, err)
+	require.Equal(t, "INST0042", result.Header.Blocks["LB"])
+	require.Contains(t, result.Header.Blocks, "TS")
+
+	_, err = s.DecryptData(auth.VaultAddress, auth.VaultToken, "secret/tr31", "kbkp", before, 10)
+	require.ErrorIs(t, err, ErrBlockPolicy)
+	_, _, err = s.DecryptDataWithFallback(auth.VaultAddress, auth.VaultToken, []KeyReference{
+		{KeyPath: "secret/tr31", KeyName: "kbkp"},
+		{KeyPath: "secret/tr31", KeyName: "kbkp"},
+	}, before, 10)
+	require.ErrorIs(t, err, ErrBlockPolicy)
+
+	s.ConfigureBlockPolicy(nil)
+	_, err = s.DecryptData(auth.VaultAddress, auth.VaultToken, "secret/tr31", "kbkp", before, 10)
+	require.NoError(t, err)
+}
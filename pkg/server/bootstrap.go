@@ -0,0 +1,115 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+// KBPKType names the kind of KBPK generated when a machine is created
+type KBPKType string
+
+const (
+	KBPK_TYPE_TDES_2KEY KBPKType = "TDES-2KEY"
+	KBPK_TYPE_TDES_3KEY KBPKType = "TDES-3KEY"
+	KBPK_TYPE_AES_128   KBPKType = "AES-128"
+	KBPK_TYPE_AES_192   KBPKType = "AES-192"
+	KBPK_TYPE_AES_256   KBPKType = "AES-256"
+)
+
+// _kbpkTypes gives the length and KCV algorithm of each KBPK type
+var _kbpkTypes = map[KBPKType]struct {
+	length    int
+	algorithm string
+}{
+	KBPK_TYPE_TDES_2KEY: {16, tr31.ENC_ALGORITHM_TRIPLE_DES},
+	KBPK_TYPE_TDES_3KEY: {24, tr31.ENC_ALGORITHM_TRIPLE_DES},
+	KBPK_TYPE_AES_128:   {16, tr31.ENC_ALGORITHM_AES},
+	KBPK_TYPE_AES_192:   {24, tr31.ENC_ALGORITHM_AES},
+	KBPK_TYPE_AES_256:   {32, tr31.ENC_ALGORITHM_AES},
+}
+
+// KBPKBootstrap asks for a KBPK to be generated and stored when a machine is
+// created, so the machine is usable right away
+type KBPKBootstrap struct {
+	KeyPath string
+	KeyName string
+	// Type is the kind of KBPK generated, AES-256 when empty
+	Type KBPKType
+}
+
+// CreateMachineWithKBPK generates a KBPK of the bootstrap type, stores it at the
+// bootstrap key path and name with the machine's backend and creates the
+// machine with the KBPK as its first key reference. An existing secret is never
+// overwritten, and the KBPK is deleted again when the machine can't be created.
+// The KCV of the KBPK is returned.
+func (s *service) CreateMachineWithKBPK(m *Machine, bootstrap KBPKBootstrap) (string, error) {
+	if m == nil {
+		return "", ErrNotFound
+	}
+	if bootstrap.KeyPath == "" {
+		return "", errInvalidKeyPath
+	}
+	if bootstrap.KeyName == "" {
+		return "", errInvalidKeyName
+	}
+	bootstrap.Type = KBPKType(strings.ToUpper(string(bootstrap.Type)))
+	if bootstrap.Type == "" {
+		bootstrap.Type = KBPK_TYPE_AES_256
+	}
+	kbpkType, exists := _kbpkTypes[bootstrap.Type]
+	if !exists {
+		return "", fmt.Errorf("%w: unknown KBPK type %s", errInvalidMachine, bootstrap.Type)
+	}
+	if _, ok := s.clients.Load(m.Backend); m.Backend != "" && !ok {
+		return "", fmt.Errorf("%w: unknown backend %s", errInvalidMachine, m.Backend)
+	}
+
+	sm, err := s.scopedSecretManagerOf(m)
+	if err != nil {
+		return "", err
+	}
+	if secretExists(sm, bootstrap.KeyPath, bootstrap.KeyName) {
+		return "", ErrAlreadyExists
+	}
+
+	kbpk := make([]byte, kbpkType.length)
+	defer wipe(kbpk)
+	if _, err := rand.Read(kbpk); err != nil {
+		return "", err
+	}
+	kcv, err := tr31.KeyCheckValue(kbpk, kbpkType.algorithm)
+	if err != nil {
+		return "", err
+	}
+	if vErr := sm.WriteSecret(bootstrap.KeyPath, bootstrap.KeyName, strings.ToUpper(hex.EncodeToString(kbpk))); vErr != nil {
+		return "", vErr
+	}
+
+	m.Keys = append([]KeyReference{{KeyPath: bootstrap.KeyPath, KeyName: bootstrap.KeyName}}, m.Keys...)
+	if err := s.CreateMachine(m); err != nil {
+		m.Keys = m.Keys[1:]
+		sm.DeleteSecret(bootstrap.KeyPath, bootstrap.KeyName)
+		return "", err
+	}
+	return kcv, nil
+}
+
+// secretExists reports whether a secret is stored at the path and name. Secret
+// managers able to list a path are asked for the stored names, as the simulator
+// derives a KBPK for any name it doesn't store.
+func secretExists(sm SecretManager, path, name string) bool {
+	if scanner, ok := sm.(SecretScanner); ok {
+		secrets, vErr := scanner.ReadSecrets(path)
+		if vErr != nil {
+			return false
+		}
+		_, exists := secrets[name]
+		return exists
+	}
+	_, vErr := sm.ReadSecret(path, name)
+	return vErr == nil
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateMachineWithKBPK(t *testing.T) {
+	s := mockServiceInMock()
+	sm := s.GetSecretManager()
+
+	m := NewMachine(mockVaultAuthOne())
+	m.Keys = []KeyReference{{KeyPath: "secret/tr31", KeyName: "previous"}}
+	kcv, err := s.CreateMachineWithKBPK(m, KBPKBootstrap{KeyPath: "secret/tr31", KeyName: "kbpk", Type: "tdes-2key"})
+	require.NoError(t, err)
+	require.Equal(t, []KeyReference{{KeyPath: "secret/tr31", KeyName: "kbpk"}, {KeyPath: "secret/tr31", KeyName: "previous"}}, m.Keys)
+
+	stored, vErr := sm.ReadSecret("secret/tr31", "kbpk")
+	require.Nil(t, vErr)
+	kbpk, err := hex.DecodeString(stored)
+	require.NoError(t, err)
+	require.Len(t, kbpk, 16)
+	expected, err := tr31.KeyCheckValue(kbpk, tr31.ENC_ALGORITHM_TRIPLE_DES)
+	require.NoError(t, err)
+	require.Equal(t, expected, kcv)
+
+	found, err := s.GetMachine(m.InitialKey)
+	require.NoError(t, err)
+	require.Equal(t, m.Keys, found.Keys)
+
+	// An existing secret is never overwritten
+	other := NewMachine(mockVaultAuthTwo())
+	_, err = s.CreateMachineWithKBPK(other, KBPKBootstrap{KeyPath: "secret/tr31", KeyName: "kbpk"})
+	require.ErrorIs(t, err, ErrAlreadyExists)
+	again, _ := sm.ReadSecret("secret/tr31", "kbpk")
+	require.Equal(t, stored, again)
+
+	// The KBPK is removed when the machine can't be created
+	duplicate := NewMachine(mockVaultAuthOne())
+	_, err = s.CreateMachineWithKBPK(duplicate, KBPKBootstrap{KeyPath: "secret/tr31", KeyName: "orphan"})
+	require.ErrorIs(t, err, ErrAlreadyExists)
+	_, vErr = sm.ReadSecret("secret/tr31", "orphan")
+	require.NotNil(t, vErr)
+	require.Empty(t, duplicate.Keys)
+
+	_, err = s.CreateMachineWithKBPK(other, KBPKBootstrap{KeyPath: "secret/tr31", KeyName: "kbpk2", Type: "DES"})
+	require.ErrorIs(t, err, errInvalidMachine)
+	_, err = s.CreateMachineWithKBPK(other, KBPKBootstrap{KeyName: "kbpk2"})
+	require.ErrorIs(t, err, errInvalidKeyPath)
+}
+
+func TestCreateMachineWithKBPK_http(t *testing.T) {
+	s := mockServiceInMock()
+	router := MakeHTTPHandler(s)
+
+	auth := mockVaultAuthOne()
+	body, err := json.Marshal(map[string]interface{}{
+		"VaultAddress": auth.VaultAddress,
+		"VaultToken":   auth.VaultToken,
+		"KBPK":         map[string]string{"KeyPath": "secret/tr31", "KeyName": "kbpk"},
+	})
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/machine", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp createMachineResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.KCV, 6)
+	require.Equal(t, []KeyReference{{KeyPath: "secret/tr31", KeyName: "kbpk"}}, resp.Machine.Keys)
+
+	// The machine wraps keys under its new KBPK right away
+	header := HeaderParams{VersionId: "D", KeyUsage: "D0", Algorithm: "A", ModeOfUse: "D", KeyVersion: "00", Exportability: "E"}
+	_, err = s.EncryptData(auth.VaultAddress, auth.VaultToken, "secret/tr31", "kbpk", "ccccccccccccccccdddddddddddddddd", header, 10)
+	require.NoError(t, err)
+}
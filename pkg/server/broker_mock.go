@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"sync"
+)
+
+// MockBroker is an in-memory implementation of MessageBroker for testing.
+// Nacked messages are delivered again to the subscriber.
+type MockBroker struct {
+	mu          sync.Mutex
+	subscribers map[string]chan BrokerMessage
+	published   map[string][][]byte
+	publishErr  error
+}
+
+// NewMockBroker creates a new instance of MockBroker.
+func NewMockBroker() *MockBroker {
+	return &MockBroker{
+		subscribers: make(map[string]chan BrokerMessage),
+		published:   make(map[string][][]byte),
+	}
+}
+
+type mockBrokerMessage struct {
+	broker  *MockBroker
+	subject string
+	data    []byte
+}
+
+func (m *mockBrokerMessage) Data() []byte {
+	return m.data
+}
+
+func (m *mockBrokerMessage) Ack() error {
+	return nil
+}
+
+func (m *mockBrokerMessage) Nack() error {
+	go m.broker.Deliver(m.subject, m.data)
+	return nil
+}
+
+// Subscribe returns the channel of messages delivered to the subject
+func (m *MockBroker) Subscribe(_ context.Context, subject string) (<-chan BrokerMessage, error) {
+	return m.subscription(subject), nil
+}
+
+// Publish stores the message so tests can inspect it with Published
+func (m *MockBroker) Publish(_ context.Context, subject string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.publishErr != nil {
+		return m.publishErr
+	}
+	m.published[subject] = append(m.published[subject], data)
+	return nil
+}
+
+// Deliver sends a message to the subscriber of the subject
+func (m *MockBroker) Deliver(subject string, data []byte) {
+	m.subscription(subject) <- &mockBrokerMessage{broker: m, subject: subject, data: data}
+}
+
+// Published returns the messages published to the subject
+func (m *MockBroker) Published(subject string) [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([][]byte, len(m.published[subject]))
+	copy(out, m.published[subject])
+	return out
+}
+
+// SetPublishErr changes the error returned by Publish
+func (m *MockBroker) SetPublishErr(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.publishErr = err
+}
+
+func (m *MockBroker) subscription(subject string) chan BrokerMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ch, exists := m.subscribers[subject]
+	if !exists {
+		ch = make(chan BrokerMessage, 16)
+		m.subscribers[subject] = ch
+	}
+	return ch
+}
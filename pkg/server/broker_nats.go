@@ -0,0 +1,568 @@
+package server
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moov-io/base/log"
+)
+
+var (
+	errNATSProtocol     = errors.New("nats: protocol error")
+	errNATSClosed       = errors.New("nats: broker closed")
+	errNATSDisconnected = errors.New("nats: disconnected")
+	errNATSSubject      = errors.New("nats: invalid subject")
+	errNATSPayload      = errors.New("nats: payload larger than the server max_payload")
+)
+
+// natsJetStreamAckPrefix starts the reply subjects of JetStream deliveries
+const natsJetStreamAckPrefix = "$JS.ACK."
+
+const (
+	// natsDefaultMaxPayload bounds the messages of servers not announcing their max_payload
+	natsDefaultMaxPayload = 1024 * 1024
+	// natsMaxPendingMessages and natsMaxPendingBytes bound the messages queued
+	// for a subscriber, further messages are dropped until it catches up
+	natsMaxPendingMessages = 64 * 1024
+	natsMaxPendingBytes    = 64 * 1024 * 1024
+)
+
+// NATSConfig configures the connection of a NATSBroker
+type NATSConfig struct {
+	// Address is the host:port of the NATS server
+	Address string
+	// User and Password, or Token, authenticate the connection when set
+	User     string
+	Password string
+	Token    string
+	// Name identifies the connection in the monitoring of the server
+	Name string
+	// Queue, when set, subscribes in the queue group so consumers share the messages
+	Queue string
+	// TLS configures the connection when the server requires TLS, verifying
+	// the host of Address with the system roots when nil
+	TLS *tls.Config
+	// Timeout bounds connecting and each write, 10 seconds when zero
+	Timeout time.Duration
+	// ReconnectWait is the wait between reconnection attempts, 2 seconds when zero
+	ReconnectWait time.Duration
+}
+
+// natsInfo holds the fields of the INFO message of the server the broker uses
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	MaxPayload  int  `json:"max_payload"`
+}
+
+// natsConnect is the CONNECT message of the broker
+type natsConnect struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	Name     string `json:"name,omitempty"`
+	User     string `json:"user,omitempty"`
+	Pass     string `json:"pass,omitempty"`
+	Token    string `json:"auth_token,omitempty"`
+	Lang     string `json:"lang"`
+	Protocol int    `json:"protocol"`
+}
+
+// NATSBroker is a MessageBroker speaking the client protocol of NATS.
+//
+// Messages delivered by a JetStream push consumer, whose deliver subject is the
+// subscribed subject, are acknowledged with +ACK and redelivered after a -NAK,
+// giving the at-least-once delivery a Consumer expects. Messages published on
+// core NATS have no acknowledgement, they are delivered at most once.
+//
+// A lost connection is reconnected and its subscriptions renewed, publishing
+// fails while the broker is disconnected.
+type NATSBroker struct {
+	config NATSConfig
+	logger log.Logger
+
+	mu      sync.Mutex
+	conn    *natsConn
+	subs    map[string]*natsSubscription
+	nextSID int
+	closed  chan struct{}
+}
+
+// natsConn is a connection to the server
+type natsConn struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	maxPayload int
+	timeout    time.Duration
+
+	mu     sync.Mutex
+	writer *bufio.Writer
+}
+
+// natsSubscription queues the messages delivered to a subscriber, so a slow
+// subscriber never blocks the read loop answering the PINGs of the server
+type natsSubscription struct {
+	subject  string
+	messages chan BrokerMessage
+	done     chan struct{}
+
+	mu           sync.Mutex
+	pending      []*natsMessage
+	pendingBytes int
+	queued       chan struct{}
+}
+
+// queue adds the message to the pending messages, reporting false when the
+// pending limits are reached
+func (s *natsSubscription) queue(msg *natsMessage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) >= natsMaxPendingMessages || s.pendingBytes+len(msg.data) > natsMaxPendingBytes {
+		return false
+	}
+	s.pending = append(s.pending, msg)
+	s.pendingBytes += len(msg.data)
+	select {
+	case s.queued <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// next removes the oldest pending message, nil when none is pending
+func (s *natsSubscription) next() *natsMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		return nil
+	}
+	msg := s.pending[0]
+	s.pending[0] = nil
+	s.pending = s.pending[1:]
+	s.pendingBytes -= len(msg.data)
+	return msg
+}
+
+// forward passes the pending messages to the subscriber until it unsubscribes,
+// and closes its channel once the broker is closed
+func (s *natsSubscription) forward(closed <-chan struct{}) {
+	for {
+		select {
+		case <-s.queued:
+		case <-s.done:
+			return
+		case <-closed:
+			close(s.messages)
+			return
+		}
+		for msg := s.next(); msg != nil; msg = s.next() {
+			select {
+			case s.messages <- msg:
+			case <-s.done:
+				return
+			case <-closed:
+				close(s.messages)
+				return
+			}
+		}
+	}
+}
+
+type natsMessage struct {
+	broker *NATSBroker
+	data   []byte
+	reply  string
+}
+
+func (m *natsMessage) Data() []byte {
+	return m.data
+}
+
+// Ack acknowledges JetStream deliveries
+func (m *natsMessage) Ack() error {
+	return m.respond("+ACK")
+}
+
+// Nack asks JetStream to deliver the message again
+func (m *natsMessage) Nack() error {
+	return m.respond("-NAK")
+}
+
+func (m *natsMessage) respond(ack string) error {
+	if !strings.HasPrefix(m.reply, natsJetStreamAckPrefix) {
+		return nil
+	}
+	return m.broker.Publish(context.Background(), m.reply, []byte(ack))
+}
+
+// NewNATSBroker connects to the NATS server of the config
+func NewNATSBroker(ctx context.Context, config NATSConfig, logger log.Logger) (*NATSBroker, error) {
+	config.Timeout = cmp.Or(config.Timeout, 10*time.Second)
+	config.ReconnectWait = cmp.Or(config.ReconnectWait, 2*time.Second)
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	conn, err := dialNATS(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	b := &NATSBroker{
+		config: config,
+		logger: logger,
+		conn:   conn,
+		subs:   make(map[string]*natsSubscription),
+		closed: make(chan struct{}),
+	}
+	go b.run(conn)
+	return b, nil
+}
+
+// dialNATS connects to the server, reads its INFO, upgrades the connection to
+// TLS when required and waits for the PONG answering the CONNECT
+func dialNATS(ctx context.Context, config NATSConfig) (*natsConn, error) {
+	dialer := &net.Dialer{Timeout: config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+	c := &natsConn{conn: conn, timeout: config.Timeout}
+	if err := c.handshake(config); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *natsConn) handshake(config NATSConfig) error {
+	c.conn.SetDeadline(time.Now().Add(config.Timeout))
+	defer func() { c.conn.SetDeadline(time.Time{}) }()
+
+	c.reader = bufio.NewReader(c.conn)
+	op, args, err := c.readOp()
+	if err != nil {
+		return err
+	}
+	if op != "INFO" {
+		return fmt.Errorf("%w: expected INFO, got %s", errNATSProtocol, op)
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(args), &info); err != nil {
+		return fmt.Errorf("%w: %v", errNATSProtocol, err)
+	}
+	c.maxPayload = info.MaxPayload
+
+	if info.TLSRequired || config.TLS != nil {
+		tlsConfig := config.TLS
+		if tlsConfig == nil {
+			host, _, _ := net.SplitHostPort(config.Address)
+			tlsConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+		}
+		tlsConn := tls.Client(c.conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		c.conn = tlsConn
+		c.reader = bufio.NewReader(c.conn)
+	}
+	c.writer = bufio.NewWriter(c.conn)
+
+	connect, _ := json.Marshal(natsConnect{
+		Name:     config.Name,
+		User:     config.User,
+		Pass:     config.Password,
+		Token:    config.Token,
+		Lang:     "go",
+		Protocol: 1,
+	})
+	if err := c.write([]byte("CONNECT "), connect, []byte("\r\nPING\r\n")); err != nil {
+		return err
+	}
+	for {
+		op, args, err := c.readOp()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case "PONG":
+			return nil
+		case "-ERR":
+			return fmt.Errorf("nats: %s", strings.Trim(args, "'"))
+		}
+	}
+}
+
+// readOp reads the next protocol line and splits its operation from its arguments
+func (c *natsConn) readOp() (string, string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", "", err
+	}
+	op, args, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+	return strings.ToUpper(op), strings.TrimSpace(args), nil
+}
+
+func (c *natsConn) write(data ...[]byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	for _, d := range data {
+		if _, err := c.writer.Write(d); err != nil {
+			return err
+		}
+	}
+	return c.writer.Flush()
+}
+
+// run dispatches the messages of the connection and reconnects when it's lost,
+// until the broker is closed
+func (b *NATSBroker) run(conn *natsConn) {
+	for {
+		err := b.read(conn)
+		conn.conn.Close()
+		if conn = b.reconnect(err); conn == nil {
+			// The subscriptions close their channels once the broker is closed
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			for sid := range b.subs {
+				delete(b.subs, sid)
+			}
+			return
+		}
+	}
+}
+
+// reconnect connects again after the connection was lost with err and renews
+// the subscriptions, it returns nil once the broker is closed
+func (b *NATSBroker) reconnect(err error) *natsConn {
+	b.mu.Lock()
+	b.conn = nil
+	b.mu.Unlock()
+	for {
+		select {
+		case <-b.closed:
+			return nil
+		default:
+		}
+		b.logger.LogErrorf("nats: connection to %s lost, reconnecting: %v", b.config.Address, err)
+
+		select {
+		case <-b.closed:
+			return nil
+		case <-time.After(b.config.ReconnectWait):
+		}
+		var conn *natsConn
+		if conn, err = dialNATS(context.Background(), b.config); err != nil {
+			continue
+		}
+
+		b.mu.Lock()
+		for sid, sub := range b.subs {
+			if err = conn.write([]byte(b.subLine(sub.subject, sid))); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			b.conn = conn
+		}
+		b.mu.Unlock()
+		if err != nil {
+			conn.conn.Close()
+			continue
+		}
+		b.logger.Logf("nats: reconnected to %s", b.config.Address)
+		return conn
+	}
+}
+
+func (b *NATSBroker) read(c *natsConn) error {
+	for {
+		op, args, err := c.readOp()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case "MSG":
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			fields := strings.Fields(args)
+			if len(fields) != 3 && len(fields) != 4 {
+				return fmt.Errorf("%w: MSG %s", errNATSProtocol, args)
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || size < 0 {
+				return fmt.Errorf("%w: MSG %s", errNATSProtocol, args)
+			}
+			// The size is read from the wire, messages can't exceed the max_payload
+			if size > cmp.Or(c.maxPayload, natsDefaultMaxPayload) {
+				return fmt.Errorf("%w: MSG of %d bytes exceeds the max_payload", errNATSProtocol, size)
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(c.reader, payload); err != nil {
+				return err
+			}
+			msg := &natsMessage{broker: b, data: payload[:size]}
+			if len(fields) == 4 {
+				msg.reply = fields[2]
+			}
+			b.dispatch(fields[1], msg)
+		case "PING":
+			if err := c.write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case "-ERR":
+			return fmt.Errorf("nats: %s", strings.Trim(args, "'"))
+		}
+	}
+}
+
+// dispatch queues the message for its subscription, unless it was unsubscribed,
+// without waiting for the subscriber. Messages beyond the pending limits are
+// dropped, JetStream delivers them again once their ack wait expires.
+func (b *NATSBroker) dispatch(sid string, msg *natsMessage) {
+	b.mu.Lock()
+	sub, exists := b.subs[sid]
+	b.mu.Unlock()
+	if !exists {
+		return
+	}
+	if !sub.queue(msg) {
+		b.logger.LogErrorf("nats: dropped a message of slow subscriber to %s", sub.subject)
+	}
+}
+
+// subLine is the SUB protocol line of the subscription, in the queue group of the config
+func (b *NATSBroker) subLine(subject, sid string) string {
+	if b.config.Queue != "" {
+		return "SUB " + subject + " " + b.config.Queue + " " + sid + "\r\n"
+	}
+	return "SUB " + subject + " " + sid + "\r\n"
+}
+
+// Subscribe returns the channel of messages delivered to the subject, in the
+// queue group of the config when set. The subscription ends with the context,
+// and its channel is closed when the broker is closed.
+func (b *NATSBroker) Subscribe(ctx context.Context, subject string) (<-chan BrokerMessage, error) {
+	if !validNATSSubject(subject) {
+		return nil, errNATSSubject
+	}
+	if b.config.Queue != "" && !validNATSSubject(b.config.Queue) {
+		return nil, errNATSSubject
+	}
+
+	b.mu.Lock()
+	if b.isClosed() {
+		b.mu.Unlock()
+		return nil, errNATSClosed
+	}
+	b.nextSID++
+	sid := strconv.Itoa(b.nextSID)
+	sub := &natsSubscription{
+		subject:  subject,
+		messages: make(chan BrokerMessage, 64),
+		done:     make(chan struct{}),
+		queued:   make(chan struct{}, 1),
+	}
+	b.subs[sid] = sub
+	go sub.forward(b.closed)
+	// Subscriptions made while disconnected are renewed on reconnection
+	conn := b.conn
+	b.mu.Unlock()
+
+	if conn != nil {
+		if err := conn.write([]byte(b.subLine(subject, sid))); err != nil {
+			b.unsubscribe(sid, sub)
+			return nil, err
+		}
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			if b.unsubscribe(sid, sub) {
+				if conn, err := b.current(); err == nil {
+					conn.write([]byte("UNSUB " + sid + "\r\n"))
+				}
+			}
+		case <-b.closed:
+		}
+	}()
+	return sub.messages, nil
+}
+
+// unsubscribe forgets the subscription, reporting whether it was subscribed
+func (b *NATSBroker) unsubscribe(sid string, sub *natsSubscription) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, exists := b.subs[sid]; !exists {
+		return false
+	}
+	delete(b.subs, sid)
+	close(sub.done)
+	return true
+}
+
+// Publish sends the data to the subject
+func (b *NATSBroker) Publish(ctx context.Context, subject string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !validNATSSubject(subject) {
+		return errNATSSubject
+	}
+	conn, err := b.current()
+	if err != nil {
+		return err
+	}
+	if conn.maxPayload > 0 && len(data) > conn.maxPayload {
+		return errNATSPayload
+	}
+	return conn.write([]byte("PUB "+subject+" "+strconv.Itoa(len(data))+"\r\n"), data, []byte("\r\n"))
+}
+
+// current returns the connection to the server, failing while disconnected
+func (b *NATSBroker) current() (*natsConn, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.isClosed():
+		return nil, errNATSClosed
+	case b.conn == nil:
+		return nil, errNATSDisconnected
+	}
+	return b.conn, nil
+}
+
+// Close closes the connection to the server and the subscriptions
+func (b *NATSBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.isClosed() {
+		return nil
+	}
+	close(b.closed)
+	if b.conn != nil {
+		return b.conn.conn.Close()
+	}
+	return nil
+}
+
+func (b *NATSBroker) isClosed() bool {
+	select {
+	case <-b.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// validNATSSubject reports whether the subject can be written in a protocol line
+func validNATSSubject(subject string) bool {
+	return subject != "" && !strings.ContainsAny(subject, " \t\r\n")
+}
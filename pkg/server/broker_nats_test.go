@@ -0,0 +1,301 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNATS serves NATS clients one at a time with just enough of the protocol for
+// NATSBroker, recording their CONNECT and publishes
+type fakeNATS struct {
+	ln        net.Listener
+	authErr   string
+	connect   chan string
+	published chan string
+	pongs     chan struct{}
+
+	mu   sync.Mutex
+	conn net.Conn
+	subs map[string]string
+}
+
+func newFakeNATS(t *testing.T, authErr string) *fakeNATS {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f := &fakeNATS{
+		ln:        ln,
+		authErr:   authErr,
+		connect:   make(chan string, 1),
+		published: make(chan string, 16),
+		pongs:     make(chan struct{}, 1),
+		subs:      make(map[string]string),
+	}
+	t.Cleanup(func() { ln.Close() })
+	go f.serve()
+	return f
+}
+
+func (f *fakeNATS) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.conn = conn
+		f.subs = make(map[string]string)
+		f.mu.Unlock()
+		f.handle(conn)
+	}
+}
+
+func (f *fakeNATS) handle(conn net.Conn) {
+	defer conn.Close()
+
+	conn.Write([]byte(`INFO {"server_id":"fake","max_payload":1024}` + "\r\n"))
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		op, args, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		switch op {
+		case "CONNECT":
+			f.connect <- args
+		case "PING":
+			if f.authErr != "" {
+				conn.Write([]byte("-ERR '" + f.authErr + "'\r\n"))
+				return
+			}
+			conn.Write([]byte("PONG\r\n"))
+		case "PONG":
+			f.pongs <- struct{}{}
+		case "SUB":
+			fields := strings.Fields(args)
+			f.mu.Lock()
+			f.subs[fields[0]] = strings.Join(fields[1:], " ")
+			f.mu.Unlock()
+		case "PUB":
+			fields := strings.Fields(args)
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			f.published <- fields[0] + " " + string(payload[:size])
+		}
+	}
+}
+
+// subscription returns the queue group and sid the subject is subscribed with
+func (f *fakeNATS) subscription(t *testing.T, subject string) string {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		_, exists := f.subs[subject]
+		return exists
+	}, 5*time.Second, 10*time.Millisecond)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.subs[subject]
+}
+
+func (f *fakeNATS) write(data string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.conn.Write([]byte(data))
+}
+
+func (f *fakeNATS) deliver(t *testing.T, subject, reply string, data []byte) {
+	fields := strings.Fields(f.subscription(t, subject))
+	sid := fields[len(fields)-1]
+	if reply != "" {
+		sid += " " + reply
+	}
+	f.write("MSG " + subject + " " + sid + " " + strconv.Itoa(len(data)) + "\r\n" + string(data) + "\r\n")
+}
+
+func (f *fakeNATS) nextPublished(t *testing.T) string {
+	t.Helper()
+	select {
+	case p := <-f.published:
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing was published")
+		return ""
+	}
+}
+
+func TestNATSBroker(t *testing.T) {
+	fake := newFakeNATS(t, "")
+	broker, err := NewNATSBroker(context.Background(), NATSConfig{
+		Address:       fake.ln.Addr().String(),
+		User:          "tr31",
+		Password:      "secret",
+		Name:          "tr31-consumer",
+		Queue:         "tr31",
+		ReconnectWait: 10 * time.Millisecond,
+	}, nil)
+	require.NoError(t, err)
+	defer broker.Close()
+
+	var connect map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(<-fake.connect), &connect))
+	require.Equal(t, "tr31", connect["user"])
+	require.Equal(t, "secret", connect["pass"])
+	require.Equal(t, "tr31-consumer", connect["name"])
+	require.Equal(t, false, connect["verbose"])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages, err := broker.Subscribe(ctx, "tr31.requests")
+	require.NoError(t, err)
+	require.Equal(t, "tr31 1", fake.subscription(t, "tr31.requests"))
+
+	// JetStream deliveries are acknowledged on their reply subject
+	ack := "$JS.ACK.TR31.consumer.1.1.1.1700000000000000000.0"
+	fake.deliver(t, "tr31.requests", ack, []byte("first"))
+	msg := <-messages
+	require.Equal(t, "first", string(msg.Data()))
+	require.NoError(t, msg.Ack())
+	require.Equal(t, ack+" +ACK", fake.nextPublished(t))
+
+	fake.deliver(t, "tr31.requests", ack, []byte("second"))
+	msg = <-messages
+	require.NoError(t, msg.Nack())
+	require.Equal(t, ack+" -NAK", fake.nextPublished(t))
+
+	// Core NATS messages and requests aren't acknowledged
+	fake.deliver(t, "tr31.requests", "_INBOX.reply", []byte(""))
+	msg = <-messages
+	require.Empty(t, msg.Data())
+	require.NoError(t, msg.Ack())
+	require.NoError(t, broker.Publish(context.Background(), "tr31.results", []byte("result")))
+	require.Equal(t, "tr31.results result", fake.nextPublished(t))
+
+	require.ErrorIs(t, broker.Publish(context.Background(), "tr31 results", nil), errNATSSubject)
+	require.ErrorIs(t, broker.Publish(context.Background(), "tr31.results", make([]byte, 1025)), errNATSPayload)
+	_, err = broker.Subscribe(ctx, "")
+	require.ErrorIs(t, err, errNATSSubject)
+
+	// The server pings idle clients
+	fake.write("PING\r\n")
+	select {
+	case <-fake.pongs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("PING wasn't answered")
+	}
+
+	// A lost connection is reconnected and its subscriptions renewed
+	fake.mu.Lock()
+	fake.conn.Close()
+	fake.mu.Unlock()
+	<-fake.connect
+	fake.deliver(t, "tr31.requests", "", []byte("third"))
+	msg = <-messages
+	require.Equal(t, "third", string(msg.Data()))
+
+	// Closing the broker closes the subscriptions
+	require.NoError(t, broker.Close())
+	_, open := <-messages
+	require.False(t, open)
+	require.ErrorIs(t, broker.Publish(context.Background(), "tr31.results", nil), errNATSClosed)
+	_, err = broker.Subscribe(ctx, "tr31.requests")
+	require.ErrorIs(t, err, errNATSClosed)
+}
+
+func TestNATSBroker_Slow_Subscriber(t *testing.T) {
+	fake := newFakeNATS(t, "")
+	broker, err := NewNATSBroker(context.Background(), NATSConfig{Address: fake.ln.Addr().String(), ReconnectWait: 10 * time.Millisecond}, nil)
+	require.NoError(t, err)
+	defer broker.Close()
+	<-fake.connect
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages, err := broker.Subscribe(ctx, "tr31.requests")
+	require.NoError(t, err)
+
+	// Messages queue up for a subscriber not reading them, PINGs are still answered
+	for i := 0; i < 200; i++ {
+		fake.deliver(t, "tr31.requests", "", []byte(strconv.Itoa(i)))
+	}
+	fake.write("PING\r\n")
+	select {
+	case <-fake.pongs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("PING wasn't answered")
+	}
+	for i := 0; i < 200; i++ {
+		msg := <-messages
+		require.Equal(t, strconv.Itoa(i), string(msg.Data()))
+	}
+
+	// Messages larger than the max_payload aren't allocated, the connection is dropped
+	fake.write("MSG tr31.requests 1 2000000000\r\n")
+	select {
+	case <-fake.connect:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection wasn't dropped")
+	}
+	fake.deliver(t, "tr31.requests", "", []byte("after"))
+	msg := <-messages
+	require.Equal(t, "after", string(msg.Data()))
+}
+
+func TestNATSBroker_Auth_Error(t *testing.T) {
+	fake := newFakeNATS(t, "Authorization Violation")
+	_, err := NewNATSBroker(context.Background(), NATSConfig{Address: fake.ln.Addr().String(), Token: "wrong"}, nil)
+	require.EqualError(t, err, "nats: Authorization Violation")
+}
+
+func TestNATSBroker_Consumer(t *testing.T) {
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+
+	fake := newFakeNATS(t, "")
+	broker, err := NewNATSBroker(context.Background(), NATSConfig{Address: fake.ln.Addr().String()}, nil)
+	require.NoError(t, err)
+	defer broker.Close()
+
+	consumer := NewConsumer(s, broker, ConsumerConfig{
+		RequestSubject: "tr31.requests",
+		ResultSubject:  "tr31.results",
+	}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Run(ctx)
+
+	data, err := json.Marshal(ConsumerRequest{
+		IdempotencyKey: "wrap-1",
+		Action:         CONSUMER_WRAP,
+		KeyPath:        "secret/tr31",
+		KeyName:        "kbkp",
+		EncryptKey:     "ccccccccccccccccdddddddddddddddd",
+		Header:         HeaderParams{VersionId: "D", KeyUsage: "D0", Algorithm: "A", ModeOfUse: "D", KeyVersion: "00", Exportability: "E"},
+	})
+	require.NoError(t, err)
+	ack := "$JS.ACK.TR31.consumer.1.1.1.1700000000000000000.0"
+	fake.deliver(t, "tr31.requests", ack, data)
+
+	// The result is published before the request is acknowledged
+	subject, payload, _ := strings.Cut(fake.nextPublished(t), " ")
+	require.Equal(t, "tr31.results", subject)
+	var result ConsumerResult
+	require.NoError(t, json.Unmarshal([]byte(payload), &result))
+	require.Equal(t, "wrap-1", result.IdempotencyKey)
+	require.Empty(t, result.Error)
+	require.Equal(t, ack+" +ACK", fake.nextPublished(t))
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/moov-io/base/log"
+)
+
+var (
+	errNoClientCertificate = errors.New("no client certificate loaded")
+	errInvalidCACert       = errors.New("no certificates found in CA file")
+)
+
+// CertWatcher keeps a client certificate, its key and optionally a CA bundle
+// loaded from disk and reloads them when the files change. It is used for
+// mutual TLS with Vault when certificates are short lived, for example SPIFFE
+// SVIDs written to disk by a workload agent.
+type CertWatcher struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	interval time.Duration
+	logger   log.Logger
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	roots    *x509.CertPool
+	modTimes map[string]time.Time
+	onReload []func()
+}
+
+// NewCertWatcher loads the certificate files, caFile may be empty to use the system roots.
+// The files are checked for changes every interval once Watch is running.
+func NewCertWatcher(certFile, keyFile, caFile string, interval time.Duration, logger log.Logger) (*CertWatcher, error) {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	w := &CertWatcher{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		interval: interval,
+		logger:   logger,
+		modTimes: make(map[string]time.Time),
+	}
+	if err := w.Reload(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// OnReload registers a function called after certificates are reloaded
+func (w *CertWatcher) OnReload(fn func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.onReload = append(w.onReload, fn)
+}
+
+// Reload reads the certificate files. The previous certificates are kept when
+// the files can't be loaded, so a partially written rotation doesn't break TLS.
+func (w *CertWatcher) Reload() error {
+	cert, err := tls.LoadX509KeyPair(w.certFile, w.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var roots *x509.CertPool
+	if w.caFile != "" {
+		pem, err := os.ReadFile(w.caFile)
+		if err != nil {
+			return err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%w: %s", errInvalidCACert, w.caFile)
+		}
+	}
+
+	modTimes := make(map[string]time.Time)
+	for _, file := range w.files() {
+		if info, err := os.Stat(file); err == nil {
+			modTimes[file] = info.ModTime()
+		}
+	}
+
+	w.mu.Lock()
+	w.cert = &cert
+	w.roots = roots
+	w.modTimes = modTimes
+	callbacks := append([]func(){}, w.onReload...)
+	w.mu.Unlock()
+
+	for _, fn := range callbacks {
+		fn()
+	}
+	return nil
+}
+
+// Watch polls the certificate files and reloads them when they change, until ctx is cancelled
+func (w *CertWatcher) Watch(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !w.changed() {
+				continue
+			}
+			if err := w.Reload(); err != nil {
+				w.logger.LogErrorf("reloading vault client certificates: %v", err)
+				continue
+			}
+			w.logger.Logf("reloaded vault client certificates from %s", w.certFile)
+		}
+	}
+}
+
+// TLSConfig returns a client TLS configuration which always presents the
+// latest certificate and verifies the server against the latest CA bundle
+func (w *CertWatcher) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			w.mu.RLock()
+			defer w.mu.RUnlock()
+			if w.cert == nil {
+				return nil, errNoClientCertificate
+			}
+			return w.cert, nil
+		},
+		// Server verification is done in VerifyConnection so the CA bundle can be
+		// swapped without rebuilding the transport
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			w.mu.RLock()
+			roots := w.roots
+			w.mu.RUnlock()
+
+			opts := x509.VerifyOptions{
+				DNSName:       cs.ServerName,
+				Roots:         roots,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		},
+	}
+}
+
+func (w *CertWatcher) files() []string {
+	files := []string{w.certFile, w.keyFile}
+	if w.caFile != "" {
+		files = append(files, w.caFile)
+	}
+	return files
+}
+
+func (w *CertWatcher) changed() bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	for _, file := range w.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(w.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
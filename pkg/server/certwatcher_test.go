@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert, server bool) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600))
+	if keyFile != "" {
+		der, err := x509.MarshalECPrivateKey(c.key)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+	}
+}
+
+func TestCertWatcher_Reload(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, false)
+	serverCert := newTestCert(t, "server", ca, true)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.der}, PrivateKey: serverCert.key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+	newTestCert(t, "client-1", ca, false).write(t, certFile, keyFile)
+	ca.write(t, caFile, "")
+
+	watcher, err := NewCertWatcher(certFile, keyFile, caFile, 10*time.Millisecond, nil)
+	require.NoError(t, err)
+	transport := &http.Transport{TLSClientConfig: watcher.TLSConfig()}
+	watcher.OnReload(transport.CloseIdleConnections)
+	client := &http.Client{Transport: transport}
+
+	get := func() (string, error) {
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	name, err := get()
+	require.NoError(t, err)
+	require.Equal(t, "client-1", name)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watcher.Watch(ctx)
+
+	// Rotated certificates are picked up without rebuilding the client
+	time.Sleep(20 * time.Millisecond)
+	newTestCert(t, "client-2", ca, false).write(t, certFile, keyFile)
+	require.Eventually(t, func() bool {
+		name, err := get()
+		return err == nil && name == "client-2"
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// A broken rotation keeps the previous certificate
+	require.NoError(t, os.WriteFile(keyFile, []byte("partial"), 0600))
+	require.Error(t, watcher.Reload())
+	name, err = get()
+	require.NoError(t, err)
+	require.Equal(t, "client-2", name)
+
+	// Servers signed by another CA are rejected
+	newTestCert(t, "other-ca", nil, false).write(t, caFile, "")
+	newTestCert(t, "client-3", ca, false).write(t, certFile, keyFile)
+	require.NoError(t, watcher.Reload())
+	_, err = get()
+	require.Error(t, err)
+}
+
+func TestNewCertWatcher_Errors(t *testing.T) {
+	dir := t.TempDir()
+	_, err := NewCertWatcher(filepath.Join(dir, "missing.pem"), filepath.Join(dir, "missing-key.pem"), "", 0, nil)
+	require.Error(t, err)
+
+	ca := newTestCert(t, "ca", nil, false)
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	newTestCert(t, "client", ca, false).write(t, certFile, keyFile)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, []byte("not a certificate"), 0600))
+	_, err = NewCertWatcher(certFile, keyFile, caFile, 0, nil)
+	require.ErrorIs(t, err, errInvalidCACert)
+}
+
+func TestVaultClient_UseCertWatcher(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil, false)
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	newTestCert(t, "client", ca, false).write(t, certFile, keyFile)
+
+	watcher, err := NewCertWatcher(certFile, keyFile, "", 0, nil)
+	require.NoError(t, err)
+
+	vaultClient, err := NewVaultClient(Vault{VaultAddress: "https://127.0.0.1:8200", VaultToken: "token"})
+	require.NoError(t, err)
+	require.Nil(t, vaultClient.UseCertWatcher(watcher))
+
+	transport := vaultClient.client.CloneConfig().HttpClient.Transport.(*http.Transport)
+	require.NotNil(t, transport.TLSClientConfig.GetClientCertificate)
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time to the components stamping it: the TS blocks of
+// BLOCK_VALUE_NOW policies, machine, job and escrow creation times, estate
+// rotations, transparency log tree heads and consumer idempotency. Tests and
+// replay tooling set a ManualClock to control it.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock tells the time of the system clock, the default
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// ManualClock is a Clock which only moves when it is set or advanced
+type ManualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewManualClock returns a ManualClock stopped at now
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Set moves the clock to now
+func (c *ManualClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+// Advance moves the clock forward by d
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// clockOrSystem returns c, or SystemClock when c is nil
+func clockOrSystem(c Clock) Clock {
+	if c == nil {
+		return SystemClock
+	}
+	return c
+}
+
+// ConfigureClock changes the clock of the service, nil restores SystemClock
+func (s *service) ConfigureClock(c Clock) {
+	c = clockOrSystem(c)
+	s.clock.Store(&c)
+}
+
+// now returns the time of the service clock
+func (s *service) now() time.Time {
+	if c := s.clock.Load(); c != nil {
+		return (*c).Now()
+	}
+	return SystemClock.Now()
+}
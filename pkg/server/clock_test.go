@@ -0,0 +1,69 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManualClock(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	c := NewManualClock(start)
+	require.Equal(t, start, c.Now())
+	c.Advance(time.Hour)
+	require.Equal(t, start.Add(time.Hour), c.Now())
+	c.Set(start)
+	require.Equal(t, start, c.Now())
+	require.Equal(t, SystemClock, clockOrSystem(nil))
+}
+
+func TestService_clock(t *testing.T) {
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	clock := NewManualClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	s.ConfigureClock(clock)
+	defer s.ConfigureClock(nil)
+
+	m := NewMachine(mockVaultAuthOne())
+	require.NoError(t, s.CreateMachine(m))
+	require.Equal(t, clock.Now(), m.CreatedAt)
+
+	// TS blocks are stamped with the service clock
+	policy, err := ParseBlockPolicy([]byte("blocks:\n  - id: TS\n    value: ${NOW}\n"))
+	require.NoError(t, err)
+	s.ConfigureBlockPolicy(policy)
+	auth := mockVaultAuthOne()
+	header := HeaderParams{VersionId: "D", KeyUsage: "D0", Algorithm: "A", ModeOfUse: "D", KeyVersion: "00", Exportability: "E"}
+	keyBlock, err := s.EncryptData(auth.VaultAddress, auth.VaultToken, "secret/tr31", "kbkp", "ccccccccccccccccdddddddddddddddd", header, 10)
+	require.NoError(t, err)
+	parsed := tr31.DefaultHeader()
+	_, err = parsed.Load(keyBlock)
+	require.NoError(t, err)
+	require.Equal(t, clock.Now().Format(timestampLayout), parsed.GetBlocks()["TS"])
+
+	// Tree heads are timestamped with the log clock
+	signer, _ := newTransparencySigner(t)
+	l, err := NewTransparencyLog("", signer, 0, nil)
+	require.NoError(t, err)
+	l.SetClock(clock)
+	head, err := l.SignTreeHead()
+	require.NoError(t, err)
+	require.Equal(t, clock.Now(), head.Timestamp)
+}
+
+func TestConsumer_clock(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	c := NewConsumer(mockServiceInMock(), NewMockBroker(), ConsumerConfig{IdempotencyTTL: time.Hour, Clock: clock}, nil)
+	c.remember("wrap-1", []byte("result"))
+
+	clock.Advance(59 * time.Minute)
+	data, found := c.lookup("wrap-1")
+	require.True(t, found)
+	require.Equal(t, []byte("result"), data)
+
+	clock.Advance(2 * time.Minute)
+	_, found = c.lookup("wrap-1")
+	require.False(t, found)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+const (
+	minKeyComponents = 2
+	maxKeyComponents = 3
+)
+
+var errInvalidKeyComponents = errors.New("invalid KBPK components")
+
+// KeyComponent points at one XOR component of a KBPK split across secret paths,
+// so no single secret path, or backend, holds the full KBPK
+type KeyComponent struct {
+	KeyPath string `yaml:"keyPath"`
+	KeyName string `yaml:"keyName"`
+	// Backend is the secret manager backend holding the component, the machine's when empty
+	Backend RunningMode `yaml:"backend"`
+}
+
+// equal reports whether both references point at the same KBPK and components
+func (k KeyReference) equal(other KeyReference) bool {
+	return k.KeyPath == other.KeyPath && k.KeyName == other.KeyName && slices.Equal(k.Components, other.Components)
+}
+
+// validateKeyReferences checks the KBPKs split in components have 2 or 3
+// components, each with a path, a name and a known backend
+func (s *service) validateKeyReferences(keys []KeyReference) error {
+	for _, key := range keys {
+		if len(key.Components) == 0 {
+			continue
+		}
+		if len(key.Components) < minKeyComponents || len(key.Components) > maxKeyComponents {
+			return fmt.Errorf("%w: key %s/%s has %d components, expecting %d to %d",
+				errInvalidKeyComponents, key.KeyPath, key.KeyName, len(key.Components), minKeyComponents, maxKeyComponents)
+		}
+		for i, c := range key.Components {
+			if c.KeyPath == "" || c.KeyName == "" {
+				return fmt.Errorf("%w: key %s/%s component %d needs a key path and name",
+					errInvalidKeyComponents, key.KeyPath, key.KeyName, i+1)
+			}
+			if _, ok := s.clients.Load(c.Backend); c.Backend != "" && !ok {
+				return fmt.Errorf("%w: key %s/%s component %d has unknown backend %s",
+					errInvalidKeyComponents, key.KeyPath, key.KeyName, i+1, c.Backend)
+			}
+		}
+	}
+	return nil
+}
+
+// readKBPKFor reads the KBPK at params.KeyPath/KeyName with sm, combining its
+// components when the machine registered for the vault credentials stores it split.
+// KBPKs whose lifecycle state doesn't allow their use, such as compromised KBPKs,
+// are rejected with ErrKeyNotUsable. Callers wipe the KBPK once the operation is done.
+func (s *service) readKBPKFor(sm SecretManager, params UnifiedParams) ([]byte, error) {
+	if m, err := s.machineFor(params); err == nil {
+		if err := s.checkKeyUsable(m.InitialKey, params.KeyPath, params.KeyName); err != nil {
+			return nil, err
+		}
+	}
+	return s.readAnyKBPK(sm, params)
+}
+
+// readAnyKBPK reads the KBPK like readKBPKFor whatever its lifecycle state
+func (s *service) readAnyKBPK(sm SecretManager, params UnifiedParams) ([]byte, error) {
+	if m, err := s.machineFor(params); err == nil {
+		for _, key := range m.Keys {
+			if key.KeyPath == params.KeyPath && key.KeyName == params.KeyName && len(key.Components) > 0 {
+				return s.combineComponents(sm, params, key.Components)
+			}
+		}
+	}
+	return readKBPK(sm, params)
+}
+
+// combineComponents reads the components of a KBPK and XORs them together,
+// wiping each component as soon as it is combined
+func (s *service) combineComponents(sm SecretManager, params UnifiedParams, components []KeyComponent) ([]byte, error) {
+	var kbpk []byte
+	for i, c := range components {
+		csm := sm
+		if c.Backend != "" {
+			client, ok := s.clients.Load(c.Backend)
+			if !ok {
+				wipe(kbpk)
+				return nil, fmt.Errorf("%w: component %d has unknown backend %s", errInvalidKeyComponents, i+1, c.Backend)
+			}
+			scoped, err := scopedSecretManager(client.(SecretManager), Vault{VaultAddress: params.VaultAddr, VaultToken: params.VaultToken})
+			if err != nil {
+				wipe(kbpk)
+				return nil, err
+			}
+			csm = scoped
+		}
+
+		componentParams := params
+		componentParams.KeyPath = c.KeyPath
+		componentParams.KeyName = c.KeyName
+		component, err := readKBPK(csm, componentParams)
+		if err != nil {
+			wipe(kbpk)
+			return nil, fmt.Errorf("component %d: %w", i+1, err)
+		}
+		if kbpk == nil {
+			kbpk = component
+			continue
+		}
+		if len(component) != len(kbpk) {
+			wipe(kbpk)
+			wipe(component)
+			return nil, fmt.Errorf("%w: component %d length (%d) doesn't match component 1 length (%d)",
+				errInvalidKeyComponents, i+1, len(component), len(kbpk))
+		}
+		for j := range kbpk {
+			kbpk[j] ^= component[j]
+		}
+		wipe(component)
+	}
+	return kbpk, nil
+}
+
+// wipe zeroes key material once it is no longer needed
+func wipe(key []byte) {
+	clear(key)
+}
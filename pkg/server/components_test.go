@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_KBPKComponents(t *testing.T) {
+	s := mockServiceInMock()
+	sm := s.GetSecretManager()
+	c1 := strings.Repeat("11", 24)
+	c2 := strings.Repeat("22", 24)
+	require.Nil(t, sm.WriteSecret("secret/custodian1", "kbpk", c1))
+	require.Nil(t, sm.WriteSecret("secret/custodian2", "kbpk", c2))
+	c3, vErr := NewSimulator(SimulatorConfig{}).ReadSecret("secret/custodian3", "kbpk")
+	require.Nil(t, vErr)
+
+	auth := Vault{VaultAddress: "http://localhost:8200", VaultToken: "components"}
+	m := NewMachine(auth)
+	m.Keys = []KeyReference{{
+		KeyPath: "secret/tr31",
+		KeyName: "split",
+		Components: []KeyComponent{
+			{KeyPath: "secret/custodian1", KeyName: "kbpk"},
+			{KeyPath: "secret/custodian2", KeyName: "kbpk"},
+			{KeyPath: "secret/custodian3", KeyName: "kbpk", Backend: MODE_SIMULATOR},
+		},
+	}}
+	require.NoError(t, s.CreateMachine(m))
+
+	header := HeaderParams{VersionId: "B", KeyUsage: "D0", Algorithm: "T", ModeOfUse: "D", KeyVersion: "00", Exportability: "E"}
+	block, err := s.EncryptData(auth.VaultAddress, auth.VaultToken, "secret/tr31", "split", "ccccccccccccccccdddddddddddddddd", header, time.Second)
+	require.NoError(t, err)
+
+	// the key block is wrapped under the XOR of the components
+	raw1, _ := hex.DecodeString(c1)
+	raw2, _ := hex.DecodeString(c2)
+	raw3, _ := hex.DecodeString(c3)
+	kbpk := make([]byte, len(raw1))
+	for i := range kbpk {
+		kbpk[i] = raw1[i] ^ raw2[i] ^ raw3[i]
+	}
+	data, err := DecryptData(UnifiedParams{Kbkp: hex.EncodeToString(kbpk), KeyBlock: block})
+	require.NoError(t, err)
+	require.Equal(t, "ccccccccccccccccdddddddddddddddd", data)
+
+	data, err = s.DecryptData(auth.VaultAddress, auth.VaultToken, "secret/tr31", "split", block, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "ccccccccccccccccdddddddddddddddd", data)
+
+	// the full KBPK isn't stored anywhere
+	_, err = s.DecryptData(auth.VaultAddress, auth.VaultToken, "secret/tr31", "split-missing", block, time.Second)
+	require.Error(t, err)
+}
+
+func TestService_KBPKComponents_Validation(t *testing.T) {
+	s := mockServiceInMock()
+	component := KeyComponent{KeyPath: "secret/custodian1", KeyName: "kbpk"}
+
+	tests := []struct {
+		name       string
+		components []KeyComponent
+		message    string
+	}{
+		{"single component", []KeyComponent{component}, "has 1 components, expecting 2 to 3"},
+		{"too many components", []KeyComponent{component, component, component, component}, "has 4 components, expecting 2 to 3"},
+		{"missing key name", []KeyComponent{component, {KeyPath: "secret/custodian2"}}, "component 2 needs a key path and name"},
+		{"unknown backend", []KeyComponent{component, {KeyPath: "secret/custodian2", KeyName: "kbpk", Backend: "HSM"}}, "component 2 has unknown backend HSM"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMachine(Vault{VaultAddress: "http://localhost:8200", VaultToken: tt.name})
+			m.Keys = []KeyReference{{KeyPath: "secret/tr31", KeyName: "split", Components: tt.components}}
+			err := s.CreateMachine(m)
+			require.True(t, errors.Is(err, errInvalidMachine))
+			require.Contains(t, err.Error(), tt.message)
+		})
+	}
+}
+
+func TestService_KBPKComponents_LengthMismatch(t *testing.T) {
+	s := mockServiceInMock()
+	sm := s.GetSecretManager()
+	require.Nil(t, sm.WriteSecret("secret/custodian1", "kbpk", strings.Repeat("11", 24)))
+	require.Nil(t, sm.WriteSecret("secret/custodian2", "kbpk", strings.Repeat("22", 16)))
+
+	auth := Vault{VaultAddress: "http://localhost:8200", VaultToken: "mismatch"}
+	m := NewMachine(auth)
+	m.Keys = []KeyReference{{
+		KeyPath: "secret/tr31",
+		KeyName: "split",
+		Components: []KeyComponent{
+			{KeyPath: "secret/custodian1", KeyName: "kbpk"},
+			{KeyPath: "secret/custodian2", KeyName: "kbpk"},
+		},
+	}}
+	require.NoError(t, s.CreateMachine(m))
+
+	header := HeaderParams{VersionId: "B", KeyUsage: "D0", Algorithm: "T", ModeOfUse: "D", KeyVersion: "00", Exportability: "E"}
+	_, err := s.EncryptData(auth.VaultAddress, auth.VaultToken, "secret/tr31", "split", "ccccccccccccccccdddddddddddddddd", header, time.Second)
+	require.True(t, errors.Is(err, errInvalidKeyComponents))
+	require.Contains(t, err.Error(), "component 2 length (16) doesn't match component 1 length (24)")
+}
+
+func TestWipe(t *testing.T) {
+	key := []byte{0x01, 0x02, 0x03}
+	wipe(key)
+	require.Equal(t, []byte{0, 0, 0}, key)
+	wipe(nil)
+}
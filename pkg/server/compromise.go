@@ -0,0 +1,177 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+// compromiseKBPKLength is the length in bytes of the AES KBPKs generated for compromise responses
+const compromiseKBPKLength = 32
+
+var errInvalidCompromise = errors.New("Invalid Compromise.")
+
+// CompromiseRequest describes the response to the compromise of a machine KBPK
+type CompromiseRequest struct {
+	// Key is the compromised KBPK, one of the KBPKs of the machine
+	Key KeyReference
+	// TargetKey is the fresh KBPK the working keys are re-wrapped under, a 256
+	// bit AES KBPK is generated there when the secret doesn't exist
+	TargetKey KeyReference
+	// Reason is recorded with the compromised state, such as an incident number
+	Reason string
+	// Paths lists the secret paths to scan, the paths of the machine's KBPKs when empty
+	Paths []string
+	// Principal is the caller the usage approver decides for, set from the
+	// request and never from its body
+	Principal string `json:"-"`
+}
+
+// CompromiseReport is the outcome of a compromise response
+type CompromiseReport struct {
+	InitialKey string       `json:"initialKey"`
+	Key        KeyReference `json:"key"`
+	TargetKey  KeyReference `json:"targetKey"`
+	Reason     string       `json:"reason"`
+	// Generated is true when the fresh KBPK was generated by the response
+	Generated bool `json:"generated"`
+	// Estate lists the working keys re-wrapped under the fresh KBPK. Their values
+	// were exposed with the compromised KBPK, they're replaced with the parties
+	// sharing them, see RotateZone.
+	Estate     *EstateReport `json:"estate"`
+	StartedAt  time.Time     `json:"startedAt"`
+	FinishedAt time.Time     `json:"finishedAt"`
+}
+
+// Compromise responds to the compromise of a machine KBPK. The KBPK is moved to
+// the compromised state, which blocks its use, the working keys stored under the
+// machine's secret paths are re-wrapped under req.TargetKey as version D key
+// blocks, and req.TargetKey replaces the KBPK in the machine's keys once every
+// key block is re-wrapped. An interrupted response can be run again, re-wrapped
+// key blocks are skipped.
+func (s *service) Compromise(ik string, req CompromiseRequest) (_ *CompromiseReport, err error) {
+	defer func() {
+		s.audit(AUDIT_OPERATION_RESPOND_TO_COMPROMISE, ik+"/"+req.Key.KeyPath+"/"+req.Key.KeyName, err)
+	}()
+	for _, key := range []KeyReference{req.Key, req.TargetKey} {
+		if key.KeyPath == "" {
+			return nil, errInvalidKeyPath
+		}
+		if key.KeyName == "" {
+			return nil, errInvalidKeyName
+		}
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		return nil, fmt.Errorf("%w: a reason is required", errInvalidCompromise)
+	}
+	if req.Key.KeyPath == req.TargetKey.KeyPath && req.Key.KeyName == req.TargetKey.KeyName {
+		return nil, fmt.Errorf("%w: the target KBPK is the compromised KBPK", errInvalidCompromise)
+	}
+	m, err := s.GetMachine(ik)
+	if err != nil {
+		return nil, err
+	}
+	if !isMachineKBPK(m, req.Key.KeyPath, req.Key.KeyName) {
+		return nil, fmt.Errorf("%w: %s/%s is not a KBPK of the machine", errInvalidCompromise, req.Key.KeyPath, req.Key.KeyName)
+	}
+	if err := s.validateKeyReferences([]KeyReference{req.TargetKey}); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidCompromise, err)
+	}
+	if !m.AllowsVersion(tr31.TR31_VERSION_D) {
+		return nil, ErrVersionNotAllowed
+	}
+
+	sm, err := s.scopedSecretManagerOf(m)
+	if err != nil {
+		return nil, err
+	}
+	scanner, ok := sm.(SecretScanner)
+	if !ok {
+		return nil, errSecretScanNotSupported
+	}
+
+	report := &CompromiseReport{
+		InitialKey: ik,
+		Key:        req.Key,
+		TargetKey:  req.TargetKey,
+		Reason:     req.Reason,
+		StartedAt:  s.now(),
+	}
+	if state := s.keyStateOf(ik, req.Key.KeyPath, req.Key.KeyName); state != KEY_STATE_COMPROMISED {
+		if _, err := s.ChangeKeyState(ik, req.Key.KeyPath, req.Key.KeyName, KEY_STATE_COMPROMISED, req.Reason); err != nil {
+			return nil, err
+		}
+	}
+
+	params := UnifiedParams{
+		VaultAddr:  m.vaultAuth.VaultAddress,
+		VaultToken: m.vaultAuth.VaultToken,
+		KeyPath:    req.Key.KeyPath,
+		KeyName:    req.Key.KeyName,
+	}
+	kbpk, err := s.readAnyKBPK(sm, params)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(kbpk)
+	if !secretExists(sm, req.TargetKey.KeyPath, req.TargetKey.KeyName) {
+		fresh := make([]byte, compromiseKBPKLength)
+		if _, err := rand.Read(fresh); err != nil {
+			return nil, err
+		}
+		vErr := sm.WriteSecret(req.TargetKey.KeyPath, req.TargetKey.KeyName, strings.ToUpper(hex.EncodeToString(fresh)))
+		wipe(fresh)
+		if vErr != nil {
+			return nil, vErr
+		}
+		report.Generated = true
+	}
+	params.KeyPath = req.TargetKey.KeyPath
+	params.KeyName = req.TargetKey.KeyName
+	targetKbpk, err := s.readKBPKFor(sm, params)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(targetKbpk)
+
+	report.Estate = s.reencryptEstate(m, sm, scanner, kbpk, targetKbpk, EstateRequest{
+		Key:       req.Key,
+		TargetKey: req.TargetKey,
+		Paths:     req.Paths,
+		Principal: req.Principal,
+	})
+
+	// The machine keeps the compromised KBPK until every working key is re-wrapped,
+	// so the response can be run again for the key blocks which failed
+	if report.Estate.Failed == 0 {
+		if err := s.replaceMachineKBPK(m, req.Key, req.TargetKey); err != nil {
+			return nil, err
+		}
+	}
+	report.FinishedAt = s.now()
+	return report, nil
+}
+
+// replaceMachineKBPK replaces the reference to key in the machine's keys with target
+func (s *service) replaceMachineKBPK(m *Machine, key, target KeyReference) error {
+	// The keys of the stored machine are replaced under the repository lock, with a
+	// new slice so readers holding the machine don't see them change
+	_, err := s.store.UpdateMachine(m.InitialKey, func(stored *Machine) error {
+		keys := make([]KeyReference, 0, len(stored.Keys))
+		for _, k := range stored.Keys {
+			if k.KeyPath != key.KeyPath || k.KeyName != key.KeyName {
+				keys = append(keys, k)
+			} else if !isMachineKBPK(stored, target.KeyPath, target.KeyName) {
+				keys = append(keys, target)
+			}
+		}
+		stored.Keys = keys
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_Compromise(t *testing.T) {
+	s := mockServiceInMock()
+	m := mockTerminalMachine(t, s)
+	sm := s.GetSecretManager()
+
+	kbpk, _ := hex.DecodeString("AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	stored, err := wrapKey(kbpk, "ccccccccccccccccdddddddddddddddd", HeaderParams{
+		VersionId: "B", KeyUsage: "D0", Algorithm: "T", ModeOfUse: "D", KeyVersion: "00", Exportability: "E",
+	}, nil, time.Now())
+	require.NoError(t, err)
+	sm.WriteSecret("secret/tr31", "pek", stored.KeyBlock)
+
+	req := CompromiseRequest{
+		Key:       KeyReference{KeyPath: "secret/tr31", KeyName: "kbkp"},
+		TargetKey: KeyReference{KeyPath: "secret/tr31", KeyName: "kbpk-2"},
+	}
+	_, err = s.Compromise(m.InitialKey, req)
+	require.ErrorIs(t, err, errInvalidCompromise)
+	req.Reason = "INC-2041"
+	_, err = s.Compromise("missing", req)
+	require.Equal(t, ErrNotFound, err)
+
+	report, err := s.Compromise(m.InitialKey, req)
+	require.NoError(t, err)
+	require.True(t, report.Generated)
+	require.Equal(t, 1, report.Estate.Translated)
+	require.Zero(t, report.Estate.Failed)
+	require.Equal(t, "pek", report.Estate.Entries[2].Name)
+	require.Equal(t, stored.KCV, report.Estate.Entries[2].KCV)
+
+	// The compromised KBPK is blocked and replaced by the fresh KBPK
+	lifecycle, err := s.GetKeyState(m.InitialKey, "secret/tr31", "kbkp")
+	require.NoError(t, err)
+	require.Equal(t, KEY_STATE_COMPROMISED, lifecycle.State)
+	require.Equal(t, "INC-2041", lifecycle.History[0].Reason)
+	updated, err := s.GetMachine(m.InitialKey)
+	require.NoError(t, err)
+	require.Equal(t, []KeyReference{req.TargetKey}, updated.Keys)
+	vault := mockVaultAuthOne()
+	_, err = s.DecryptData(vault.VaultAddress, vault.VaultToken, "secret/tr31", "kbkp", stored.KeyBlock, 10)
+	require.ErrorIs(t, err, ErrKeyNotUsable)
+
+	rewrapped, _ := sm.ReadSecret("secret/tr31", "pek")
+	key, err := s.DecryptData(vault.VaultAddress, vault.VaultToken, "secret/tr31", "kbpk-2", rewrapped, 10)
+	require.NoError(t, err)
+	require.Equal(t, "ccccccccccccccccdddddddddddddddd", key)
+
+	// The compromised KBPK is no longer a KBPK of the machine
+	_, err = s.Compromise(m.InitialKey, req)
+	require.ErrorIs(t, err, errInvalidCompromise)
+}
+
+func TestService_Compromise_failed(t *testing.T) {
+	s := mockServiceInMock()
+	m := mockTerminalMachine(t, s)
+	sm := s.GetSecretManager()
+	other, _ := hex.DecodeString("11111111111111112222222222222222")
+	foreign, err := wrapKey(other, "ccccccccccccccccdddddddddddddddd", HeaderParams{
+		VersionId: "D", KeyUsage: "D0", Algorithm: "A", ModeOfUse: "D", KeyVersion: "00", Exportability: "E",
+	}, nil, time.Now())
+	require.NoError(t, err)
+	sm.WriteSecret("secret/tr31", "foreign", foreign.KeyBlock)
+
+	req := CompromiseRequest{
+		Key:       KeyReference{KeyPath: "secret/tr31", KeyName: "kbkp"},
+		TargetKey: KeyReference{KeyPath: "secret/tr31", KeyName: "kbpk-2"},
+		Reason:    "INC-2041",
+	}
+	report, err := s.Compromise(m.InitialKey, req)
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Estate.Failed)
+
+	// The machine keeps the compromised KBPK so the response can be run again
+	updated, err := s.GetMachine(m.InitialKey)
+	require.NoError(t, err)
+	require.Equal(t, []KeyReference{req.Key}, updated.Keys)
+	sm.DeleteSecret("secret/tr31", "foreign")
+	report, err = s.Compromise(m.InitialKey, req)
+	require.NoError(t, err)
+	require.False(t, report.Generated)
+	require.Zero(t, report.Estate.Failed)
+	updated, err = s.GetMachine(m.InitialKey)
+	require.NoError(t, err)
+	require.Equal(t, []KeyReference{req.TargetKey}, updated.Keys)
+}
+
+func TestRouting_compromise(t *testing.T) {
+	s := mockServiceInMock()
+	m := mockTerminalMachine(t, s)
+	router := MakeHTTPHandler(s)
+
+	body := `{"Key":{"KeyPath":"secret/tr31","KeyName":"kbkp"},"TargetKey":{"KeyPath":"secret/tr31","KeyName":"kbpk-2"},"Reason":"INC-2041"}`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/machines/"+m.InitialKey+"/compromise", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp compromiseResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.True(t, resp.Report.Generated)
+	require.Equal(t, "INC-2041", resp.Report.Reason)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/machines/"+m.InitialKey+"/compromise", strings.NewReader(body)))
+	require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+}
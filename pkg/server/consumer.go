@@ -0,0 +1,237 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/moov-io/base/log"
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+type ConsumerAction string
+
+var (
+	// CONSUMER_WRAP wraps the supplied key under the KBPK
+	CONSUMER_WRAP ConsumerAction = "wrap"
+	// CONSUMER_TRANSLATE unwraps the supplied key block and wraps it again under the target KBPK
+	CONSUMER_TRANSLATE ConsumerAction = "translate"
+)
+
+var (
+	errInvalidConsumerAction = errors.New("Invalid Consumer Action.")
+	errInvalidIdempotencyKey = errors.New("Invalid Idempotency Key.")
+)
+
+// BrokerMessage is a single delivery received from a message broker.
+// Ack confirms the message was handled, Nack asks the broker to deliver it again.
+type BrokerMessage interface {
+	Data() []byte
+	Ack() error
+	Nack() error
+}
+
+// MessageBroker is implemented by adapters for Kafka, NATS or any other broker
+// offering at-least-once delivery on named subjects (topics), see NATSBroker.
+type MessageBroker interface {
+	Subscribe(ctx context.Context, subject string) (<-chan BrokerMessage, error)
+	Publish(ctx context.Context, subject string, data []byte) error
+}
+
+// ConsumerRequest is the message consumed from the request subject
+type ConsumerRequest struct {
+	// IdempotencyKey identifies the request, redeliveries with the same key
+	// publish the result of the first delivery again
+	IdempotencyKey string
+	Action         ConsumerAction
+	VaultAddr      string
+	VaultToken     string
+	KeyPath        string
+	KeyName        string
+	TargetKeyPath  string
+	TargetKeyName  string
+	EncryptKey     string
+	KeyBlock       string
+	Header         HeaderParams
+}
+
+// masked describes the key material of the request for logs without disclosing it
+func (req ConsumerRequest) masked() string {
+	if req.Action == CONSUMER_WRAP {
+		return "key " + tr31.MaskHex(req.EncryptKey)
+	}
+	return "key block " + tr31.MaskKeyBlock(req.KeyBlock)
+}
+
+// ConsumerResult is the message published to the result subject
+type ConsumerResult struct {
+	IdempotencyKey string `json:"idempotencyKey"`
+	Data           string `json:"data,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// ConsumerConfig configures the subjects and timeouts of a Consumer
+type ConsumerConfig struct {
+	RequestSubject string
+	ResultSubject  string
+	Timeout        time.Duration
+	// IdempotencyTTL is how long results are kept to answer redeliveries
+	IdempotencyTTL time.Duration
+	// Clock expires the results kept, SystemClock when nil
+	Clock Clock
+	// Principal is the caller the usage approver decides for on translate
+	// requests, see Service.ConfigureUsageApprover
+	Principal string
+}
+
+type processedResult struct {
+	data      []byte
+	createdAt time.Time
+}
+
+// Consumer reads wrap and translate requests from a broker and publishes their results.
+// Messages are acknowledged only after their result is published, so a failed publish
+// leads to a redelivery which is answered from the idempotency cache.
+type Consumer struct {
+	svc    Service
+	broker MessageBroker
+	config ConsumerConfig
+	logger log.Logger
+
+	mu        sync.Mutex
+	processed map[string]processedResult
+	lastPrune time.Time
+}
+
+// NewConsumer creates a consumer of the service for the given broker
+func NewConsumer(s Service, broker MessageBroker, config ConsumerConfig, logger log.Logger) *Consumer {
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.IdempotencyTTL == 0 {
+		config.IdempotencyTTL = 24 * time.Hour
+	}
+	config.Clock = clockOrSystem(config.Clock)
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &Consumer{
+		svc:       s,
+		broker:    broker,
+		config:    config,
+		logger:    logger,
+		processed: make(map[string]processedResult),
+		lastPrune: config.Clock.Now(),
+	}
+}
+
+// Run consumes messages until the context is cancelled or the subscription is closed
+func (c *Consumer) Run(ctx context.Context) error {
+	messages, err := c.broker.Subscribe(ctx, c.config.RequestSubject)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			c.handle(ctx, msg)
+		}
+	}
+}
+
+func (c *Consumer) handle(ctx context.Context, msg BrokerMessage) {
+	var req ConsumerRequest
+	if err := json.Unmarshal(msg.Data(), &req); err != nil {
+		// A malformed message is never going to succeed, drop it
+		c.logger.LogErrorf("consumer: dropping malformed message: %v", err)
+		msg.Ack()
+		return
+	}
+
+	data, cached := c.lookup(req.IdempotencyKey)
+	if !cached {
+		data = c.process(req)
+	}
+
+	if err := c.broker.Publish(ctx, c.config.ResultSubject, data); err != nil {
+		c.logger.LogErrorf("consumer: publishing result of %s: %v", req.IdempotencyKey, err)
+		msg.Nack()
+		return
+	}
+	msg.Ack()
+}
+
+func (c *Consumer) process(req ConsumerRequest) []byte {
+	result := ConsumerResult{IdempotencyKey: req.IdempotencyKey}
+	data, err := c.execute(req)
+	if err != nil {
+		c.logger.LogErrorf("consumer: %s of %s failed (%s): %v", req.Action, req.IdempotencyKey, req.masked(), err)
+		result.Error = err.Error()
+	} else {
+		result.Data = data
+	}
+
+	out, _ := json.Marshal(result)
+	// Failures which may not last, such as Vault being unavailable, are
+	// processed again when the request is redelivered
+	if req.IdempotencyKey != "" && !retryable(err) {
+		c.remember(req.IdempotencyKey, out)
+	}
+	return out
+}
+
+// retryable reports whether the request failed with a server error, which
+// retrying the request may not hit again. Client errors are never retryable.
+func retryable(err error) bool {
+	return err != nil && codeFrom(err) >= http.StatusInternalServerError
+}
+
+func (c *Consumer) execute(req ConsumerRequest) (string, error) {
+	if req.IdempotencyKey == "" {
+		return "", errInvalidIdempotencyKey
+	}
+	switch req.Action {
+	case CONSUMER_WRAP:
+		return c.svc.EncryptData(req.VaultAddr, req.VaultToken, req.KeyPath, req.KeyName, req.EncryptKey, req.Header, c.config.Timeout)
+	case CONSUMER_TRANSLATE:
+		return c.svc.TranslateData(req.VaultAddr, req.VaultToken, req.KeyPath, req.KeyName, req.TargetKeyPath, req.TargetKeyName, req.KeyBlock, c.config.Timeout, AsPrincipal(c.config.Principal))
+	}
+	return "", errInvalidConsumerAction
+}
+
+func (c *Consumer) lookup(key string) ([]byte, bool) {
+	if key == "" {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result, exists := c.processed[key]
+	if !exists || c.config.Clock.Now().Sub(result.createdAt) > c.config.IdempotencyTTL {
+		return nil, false
+	}
+	return result.data, true
+}
+
+func (c *Consumer) remember(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.config.Clock.Now()
+	if now.Sub(c.lastPrune) > c.config.IdempotencyTTL {
+		for k, v := range c.processed {
+			if now.Sub(v.createdAt) > c.config.IdempotencyTTL {
+				delete(c.processed, k)
+			}
+		}
+		c.lastPrune = now
+	}
+	c.processed[key] = processedResult{data: data, createdAt: now}
+}
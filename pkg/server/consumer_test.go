@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func waitForResults(t *testing.T, broker *MockBroker, subject string, count int) []ConsumerResult {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if published := broker.Published(subject); len(published) >= count {
+			results := make([]ConsumerResult, len(published))
+			for i := range published {
+				require.NoError(t, json.Unmarshal(published[i], &results[i]))
+			}
+			return results
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d results on %s", count, subject)
+	return nil
+}
+
+func deliverRequest(t *testing.T, broker *MockBroker, req ConsumerRequest) {
+	t.Helper()
+	data, err := json.Marshal(req)
+	require.NoError(t, err)
+	broker.Deliver("tr31.requests", data)
+}
+
+func TestConsumer_Wrap_Translate(t *testing.T) {
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	s.GetSecretManager().WriteSecret("secret/tr31", "target", "DDDDDDDDDDDDDDDDEEEEEEEEEEEEEEEEFFFFFFFFFFFFFFFF")
+
+	broker := NewMockBroker()
+	consumer := NewConsumer(s, broker, ConsumerConfig{
+		RequestSubject: "tr31.requests",
+		ResultSubject:  "tr31.results",
+	}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Run(ctx)
+
+	wrap := ConsumerRequest{
+		IdempotencyKey: "wrap-1",
+		Action:         CONSUMER_WRAP,
+		KeyPath:        "secret/tr31",
+		KeyName:        "kbkp",
+		EncryptKey:     "ccccccccccccccccdddddddddddddddd",
+		Header: HeaderParams{
+			VersionId:     "D",
+			KeyUsage:      "D0",
+			Algorithm:     "A",
+			ModeOfUse:     "D",
+			KeyVersion:    "00",
+			Exportability: "E",
+		},
+	}
+	deliverRequest(t, broker, wrap)
+	results := waitForResults(t, broker, "tr31.results", 1)
+	require.Equal(t, "wrap-1", results[0].IdempotencyKey)
+	require.Empty(t, results[0].Error)
+
+	// A redelivery publishes the same key block instead of wrapping again
+	deliverRequest(t, broker, wrap)
+	results = waitForResults(t, broker, "tr31.results", 2)
+	require.Equal(t, results[0], results[1])
+
+	deliverRequest(t, broker, ConsumerRequest{
+		IdempotencyKey: "translate-1",
+		Action:         CONSUMER_TRANSLATE,
+		KeyPath:        "secret/tr31",
+		KeyName:        "kbkp",
+		TargetKeyPath:  "secret/tr31",
+		TargetKeyName:  "target",
+		KeyBlock:       results[0].Data,
+	})
+	results = waitForResults(t, broker, "tr31.results", 3)
+	require.Empty(t, results[2].Error)
+
+	data, err := s.DecryptData("", "", "secret/tr31", "target", results[2].Data, 10)
+	require.NoError(t, err)
+	require.Equal(t, "ccccccccccccccccdddddddddddddddd", data)
+}
+
+func TestConsumer_Errors(t *testing.T) {
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+
+	broker := NewMockBroker()
+	consumer := NewConsumer(s, broker, ConsumerConfig{
+		RequestSubject: "tr31.requests",
+		ResultSubject:  "tr31.results",
+	}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Run(ctx)
+
+	// Malformed messages are dropped without a result
+	broker.Deliver("tr31.requests", []byte("not json"))
+
+	deliverRequest(t, broker, ConsumerRequest{Action: CONSUMER_WRAP})
+	results := waitForResults(t, broker, "tr31.results", 1)
+	require.Equal(t, errInvalidIdempotencyKey.Error(), results[0].Error)
+
+	deliverRequest(t, broker, ConsumerRequest{IdempotencyKey: "unknown-1", Action: "unknown"})
+	results = waitForResults(t, broker, "tr31.results", 2)
+	require.Equal(t, errInvalidConsumerAction.Error(), results[1].Error)
+
+	// Failed publishes are retried through redelivery
+	broker.SetPublishErr(errors.New("broker unavailable"))
+	deliverRequest(t, broker, ConsumerRequest{IdempotencyKey: "retry-1", Action: "unknown"})
+	time.Sleep(50 * time.Millisecond)
+	broker.SetPublishErr(nil)
+	results = waitForResults(t, broker, "tr31.results", 3)
+	require.Equal(t, "retry-1", results[2].IdempotencyKey)
+}
+
+func TestConsumer_Retryable_Errors(t *testing.T) {
+	s := mockServiceInMock()
+
+	broker := NewMockBroker()
+	consumer := NewConsumer(s, broker, ConsumerConfig{
+		RequestSubject: "tr31.requests",
+		ResultSubject:  "tr31.results",
+	}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Run(ctx)
+
+	wrap := ConsumerRequest{
+		IdempotencyKey: "wrap-1",
+		Action:         CONSUMER_WRAP,
+		KeyPath:        "secret/tr31",
+		KeyName:        "kbkp",
+		EncryptKey:     "ccccccccccccccccdddddddddddddddd",
+		Header:         HeaderParams{VersionId: "D", KeyUsage: "D0", Algorithm: "A", ModeOfUse: "D", KeyVersion: "00", Exportability: "E"},
+	}
+	// The KBPK can't be read yet
+	deliverRequest(t, broker, wrap)
+	results := waitForResults(t, broker, "tr31.results", 1)
+	require.NotEmpty(t, results[0].Error)
+
+	// The failure isn't kept, the redelivery wraps the key
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	deliverRequest(t, broker, wrap)
+	results = waitForResults(t, broker, "tr31.results", 2)
+	require.Empty(t, results[1].Error)
+	require.NotEmpty(t, results[1].Data)
+
+	require.True(t, retryable(&VaultError{Message: "connection refused"}))
+	require.False(t, retryable(errInvalidConsumerAction))
+	require.False(t, retryable(nil))
+}
+
+func TestConsumerRequest_Masked(t *testing.T) {
+	wrap := ConsumerRequest{Action: CONSUMER_WRAP, EncryptKey: "ccccccccccccccccdddddddddddddddd"}
+	require.Equal(t, "key cccc************************dddd", wrap.masked())
+
+	translate := ConsumerRequest{Action: CONSUMER_TRANSLATE, KeyBlock: "B0096P0TE00N0000471D4FBE35E5865BDE20DBF4C15503161F55A681170BF8DD14D01B6822EF8550CB67C569DE8AC048"}
+	require.Equal(t, "key block B0096P0TE00N0000471D"+strings.Repeat("*", 72)+"C048", translate.masked())
+}
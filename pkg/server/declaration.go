@@ -0,0 +1,226 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	errInvalidDeclaration = errors.New("invalid machine declaration")
+)
+
+// KeyReference points at a KBPK stored in the secret manager
+type KeyReference struct {
+	KeyPath string `yaml:"keyPath"`
+	KeyName string `yaml:"keyName"`
+	// Components, when set, hold the KBPK as XOR components combined at operation time
+	Components []KeyComponent `yaml:"components,omitempty"`
+}
+
+// MachineDeclaration describes the desired state of a machine
+type MachineDeclaration struct {
+	VaultAddress    string            `yaml:"vaultAddress"`
+	VaultToken      string            `yaml:"vaultToken"`
+	AllowedVersions []string          `yaml:"allowedVersions"`
+	Keys            []KeyReference    `yaml:"keys"`
+	Tags            map[string]string `yaml:"tags"`
+	NeverClear      bool              `yaml:"neverClear"`
+}
+
+// Declaration is the content of a machines.yaml file.
+// When Prune is set, machines missing from the declaration are deleted.
+type Declaration struct {
+	Prune    bool                 `yaml:"prune"`
+	Machines []MachineDeclaration `yaml:"machines"`
+}
+
+// ApplyResult lists the initial keys of the machines changed by Apply
+type ApplyResult struct {
+	Created   []string `json:"created"`
+	Updated   []string `json:"updated"`
+	Deleted   []string `json:"deleted"`
+	Unchanged []string `json:"unchanged"`
+}
+
+// ParseDeclaration reads a declaration from YAML (or JSON) data.
+// Environment variables such as ${VAULT_TOKEN} are expanded so secrets
+// don't need to be committed with the file.
+func ParseDeclaration(data []byte) (*Declaration, error) {
+	decl := &Declaration{}
+	if err := yaml.Unmarshal([]byte(os.ExpandEnv(string(data))), decl); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidDeclaration, err)
+	}
+	return decl, nil
+}
+
+// LoadDeclaration reads a declaration file
+func LoadDeclaration(path string) (*Declaration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDeclaration(data)
+}
+
+// Apply reconciles the stored machines to the declaration. Every declared
+// machine is validated, including its key references, before anything changes.
+func (s *service) Apply(decl *Declaration) (*ApplyResult, error) {
+	if decl == nil {
+		return nil, errInvalidDeclaration
+	}
+
+	desired := make(map[string]*Machine, len(decl.Machines))
+	for i, md := range decl.Machines {
+		m, err := s.declaredMachine(md)
+		if err != nil {
+			return nil, fmt.Errorf("%w: machine %d: %v", errInvalidDeclaration, i, err)
+		}
+		if _, exists := desired[m.TransactionKey]; exists {
+			return nil, fmt.Errorf("%w: machine %d: duplicate vault credentials", errInvalidDeclaration, i)
+		}
+		desired[m.TransactionKey] = m
+	}
+
+	// Declared machines are matched with stored ones by their vault credentials,
+	// the transaction key, since generated IDs aren't known to the declaration
+	result := &ApplyResult{}
+	for tk, m := range desired {
+		current, err := s.store.FindMachineByTransactionKey(tk)
+		if err != nil {
+			if err := s.CreateMachine(m); err != nil {
+				return result, err
+			}
+			result.Created = append(result.Created, m.InitialKey)
+			continue
+		}
+		ik := current.InitialKey
+		m.InitialKey = ik
+		if declaredEqual(current, m) {
+			result.Unchanged = append(result.Unchanged, ik)
+			continue
+		}
+		// Only the declared fields are updated, the backend, creation time,
+		// tenant and header template of the stored machine are kept
+		_, err = s.store.UpdateMachine(ik, func(stored *Machine) error {
+			stored.vaultAuth = m.vaultAuth
+			stored.AllowedVersions = m.AllowedVersions
+			stored.Keys = m.Keys
+			stored.Tags = m.Tags
+			stored.NeverClear = m.NeverClear
+			return nil
+		})
+		if err != nil {
+			return result, err
+		}
+		result.Updated = append(result.Updated, ik)
+	}
+
+	if decl.Prune {
+		machines, err := s.store.FindAllMachines()
+		if err != nil {
+			return result, err
+		}
+		for _, m := range machines {
+			// Tenants manage their own machines, pruning only deletes the
+			// machines outside of any tenant
+			if m.Tenant != "" {
+				continue
+			}
+			if _, exists := desired[m.TransactionKey]; !exists {
+				if err := s.DeleteMachine(m.InitialKey); err != nil {
+					return result, err
+				}
+				result.Deleted = append(result.Deleted, m.InitialKey)
+			}
+		}
+	}
+
+	sort.Strings(result.Created)
+	sort.Strings(result.Updated)
+	sort.Strings(result.Deleted)
+	sort.Strings(result.Unchanged)
+	return result, nil
+}
+
+// declaredEqual reports whether the declared fields of the machines are the same
+func declaredEqual(a, b *Machine) bool {
+	return a.vaultAuth == b.vaultAuth &&
+		slices.Equal(a.AllowedVersions, b.AllowedVersions) &&
+		slices.EqualFunc(a.Keys, b.Keys, KeyReference.equal) &&
+		maps.Equal(a.Tags, b.Tags) &&
+		a.NeverClear == b.NeverClear
+}
+
+// declaredMachine builds the machine described by md and checks its key references are readable
+func (s *service) declaredMachine(md MachineDeclaration) (*Machine, error) {
+	if md.VaultAddress == "" {
+		return nil, errInvalidVaultAddress
+	}
+	if md.VaultToken == "" {
+		return nil, errInvalidVaultToken
+	}
+	for _, v := range md.AllowedVersions {
+		if err := tr31.DefaultHeader().SetVersionID(v); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateTags(md.Tags); err != nil {
+		return nil, err
+	}
+
+	params := UnifiedParams{
+		VaultAddr:  md.VaultAddress,
+		VaultToken: md.VaultToken,
+	}
+	tk, err := TransactionKey(params)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.validateKeyReferences(md.Keys); err != nil {
+		return nil, err
+	}
+
+	// Declarations are applied concurrently with other requests, the keys are
+	// read with a client of their own credentials
+	sm, err := scopedSecretManager(s.GetSecretManager(), Vault{VaultAddress: md.VaultAddress, VaultToken: md.VaultToken})
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range md.Keys {
+		params.KeyPath = key.KeyPath
+		params.KeyName = key.KeyName
+		if key.KeyPath == "" {
+			return nil, errInvalidKeyPath
+		}
+		if key.KeyName == "" {
+			return nil, errInvalidKeyName
+		}
+		read := readKBPK
+		if len(key.Components) > 0 {
+			read = func(sm SecretManager, params UnifiedParams) ([]byte, error) {
+				return s.combineComponents(sm, params, key.Components)
+			}
+		}
+		kbpk, err := read(sm, params)
+		if err != nil {
+			return nil, fmt.Errorf("key %s/%s: %v", key.KeyPath, key.KeyName, err)
+		}
+		wipe(kbpk)
+	}
+
+	m := NewMachine(Vault{VaultAddress: md.VaultAddress, VaultToken: md.VaultToken})
+	m.TransactionKey = tk
+	m.AllowedVersions = md.AllowedVersions
+	m.Keys = md.Keys
+	m.Tags = md.Tags
+	m.NeverClear = md.NeverClear
+	return m, nil
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDeclaration(t *testing.T) {
+	t.Setenv("TR31_TEST_TOKEN", "token-from-env")
+
+	decl, err := ParseDeclaration([]byte(`
+prune: true
+machines:
+  - vaultAddress: http://localhost:8200
+    vaultToken: ${TR31_TEST_TOKEN}
+    allowedVersions: [D]
+    keys:
+      - keyPath: secret/tr31
+        keyName: kbkp
+`))
+	require.NoError(t, err)
+	require.Equal(t, &Declaration{
+		Prune: true,
+		Machines: []MachineDeclaration{
+			{
+				VaultAddress:    "http://localhost:8200",
+				VaultToken:      "token-from-env",
+				AllowedVersions: []string{"D"},
+				Keys:            []KeyReference{{KeyPath: "secret/tr31", KeyName: "kbkp"}},
+			},
+		},
+	}, decl)
+
+	_, err = ParseDeclaration([]byte("machines: {"))
+	require.ErrorIs(t, err, errInvalidDeclaration)
+
+	path := filepath.Join(t.TempDir(), "machines.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("machines: []"), 0600))
+	decl, err = LoadDeclaration(path)
+	require.NoError(t, err)
+	require.Empty(t, decl.Machines)
+}
+
+func TestService_Apply(t *testing.T) {
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+
+	manual := NewMachine(Vault{VaultAddress: "http://manual:8200", VaultToken: "manual"})
+	require.NoError(t, s.CreateMachine(manual))
+
+	decl := &Declaration{
+		Machines: []MachineDeclaration{
+			{
+				VaultAddress: "http://localhost:8200",
+				VaultToken:   "token",
+				Keys:         []KeyReference{{KeyPath: "secret/tr31", KeyName: "kbkp"}},
+			},
+		},
+	}
+	result, err := s.Apply(decl)
+	require.NoError(t, err)
+	require.Len(t, result.Created, 1)
+	ik := result.Created[0]
+
+	m, err := s.GetMachine(ik)
+	require.NoError(t, err)
+	require.Equal(t, decl.Machines[0].Keys, m.Keys)
+
+	// Applying again is a no-op
+	result, err = s.Apply(decl)
+	require.NoError(t, err)
+	require.Equal(t, []string{ik}, result.Unchanged)
+
+	// Policy changes update the machine in place
+	decl.Machines[0].AllowedVersions = []string{"D"}
+	result, err = s.Apply(decl)
+	require.NoError(t, err)
+	require.Equal(t, []string{ik}, result.Updated)
+	m, err = s.GetMachine(ik)
+	require.NoError(t, err)
+	require.Equal(t, []string{"D"}, m.AllowedVersions)
+
+	// So do tag changes, which keep the fields that aren't declared
+	_, err = s.(*service).store.UpdateMachine(ik, func(m *Machine) error {
+		m.Tenant = "acme"
+		return nil
+	})
+	require.NoError(t, err)
+	decl.Machines[0].Tags = map[string]string{"environment": "prod"}
+	result, err = s.Apply(decl)
+	require.NoError(t, err)
+	require.Equal(t, []string{ik}, result.Updated)
+	m, err = s.GetMachine(ik)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"environment": "prod"}, m.Tags)
+	require.Equal(t, "acme", m.Tenant)
+
+	// Machines outside the declaration are only deleted when pruning, and
+	// machines of tenants are left to them
+	owned := NewMachine(Vault{VaultAddress: "http://tenant:8200", VaultToken: "tenant"})
+	owned.Tenant = "acme"
+	require.NoError(t, s.CreateMachine(owned))
+	machines, err := s.GetMachines()
+	require.NoError(t, err)
+	require.Len(t, machines, 3)
+	decl.Prune = true
+	result, err = s.Apply(decl)
+	require.NoError(t, err)
+	require.Equal(t, []string{manual.InitialKey}, result.Deleted)
+	machines, err = s.GetMachines()
+	require.NoError(t, err)
+	require.Len(t, machines, 2)
+	_, err = s.GetMachine(owned.InitialKey)
+	require.NoError(t, err)
+}
+
+func TestService_Apply_Invalid(t *testing.T) {
+	s := mockServiceInMock()
+
+	tests := []struct {
+		name    string
+		machine MachineDeclaration
+	}{
+		{"Missing vault address", MachineDeclaration{VaultToken: "token"}},
+		{"Invalid version", MachineDeclaration{VaultAddress: "addr", VaultToken: "token", AllowedVersions: []string{"E"}}},
+		{"Missing key name", MachineDeclaration{VaultAddress: "addr", VaultToken: "token", Keys: []KeyReference{{KeyPath: "secret/tr31"}}}},
+		{"Invalid tag", MachineDeclaration{VaultAddress: "addr", VaultToken: "token", Tags: map[string]string{"bad key": "value"}}},
+		{"Unknown key", MachineDeclaration{VaultAddress: "addr", VaultToken: "token", Keys: []KeyReference{{KeyPath: "secret/tr31", KeyName: "missing"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.Apply(&Declaration{Machines: []MachineDeclaration{tt.machine}})
+			require.ErrorIs(t, err, errInvalidDeclaration)
+			machines, err := s.GetMachines()
+			require.NoError(t, err)
+			require.Empty(t, machines)
+		})
+	}
+
+	duplicate := MachineDeclaration{VaultAddress: "addr", VaultToken: "token"}
+	_, err := s.Apply(&Declaration{Machines: []MachineDeclaration{duplicate, duplicate}})
+	require.ErrorIs(t, err, errInvalidDeclaration)
+}
+
+func TestRouting_apply_declaration(t *testing.T) {
+	router := mockHttpHandler()
+
+	req := httptest.NewRequest("POST", "/admin/apply", bytes.NewReader([]byte(`
+machines:
+  - vaultAddress: http://localhost:8200
+    vaultToken: token
+`)))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp applyDeclarationResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Result.Created, 1)
+
+	req = httptest.NewRequest("POST", "/admin/apply", bytes.NewReader([]byte(`{"machines": [{"vaultAddress": ""}]}`)))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestService_Apply_KBPKComponents(t *testing.T) {
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/custodian1", "kbpk", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBB")
+
+	decl, err := ParseDeclaration([]byte(`
+machines:
+  - vaultAddress: http://localhost:8200
+    vaultToken: token
+    keys:
+      - keyPath: secret/tr31
+        keyName: split
+        components:
+          - keyPath: secret/custodian1
+            keyName: kbpk
+          - keyPath: secret/custodian2
+            keyName: kbpk
+`))
+	require.NoError(t, err)
+	require.Len(t, decl.Machines[0].Keys[0].Components, 2)
+
+	// every component must be readable
+	_, err = s.Apply(decl)
+	require.ErrorIs(t, err, errInvalidDeclaration)
+	require.Contains(t, err.Error(), "component 2")
+
+	s.GetSecretManager().WriteSecret("secret/custodian2", "kbpk", "CCCCCCCCCCCCCCCCDDDDDDDDDDDDDDDD")
+	result, err := s.Apply(decl)
+	require.NoError(t, err)
+	require.Len(t, result.Created, 1)
+
+	result, err = s.Apply(decl)
+	require.NoError(t, err)
+	require.Len(t, result.Unchanged, 1)
+
+	decl.Machines[0].Keys[0].Components = decl.Machines[0].Keys[0].Components[:1]
+	_, err = s.Apply(decl)
+	require.ErrorIs(t, err, errInvalidDeclaration)
+	require.Contains(t, err.Error(), "has 1 components, expecting 2 to 3")
+}
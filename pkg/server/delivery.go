@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/moov-io/base"
+	"github.com/moov-io/tr31/pkg/tr31"
+	"gopkg.in/yaml.v3"
+)
+
+type DeliveryProtocol string
+
+var (
+	// DELIVERY_PROTOCOL_SFTP uploads key exchange files to an SFTP server
+	DELIVERY_PROTOCOL_SFTP DeliveryProtocol = "sftp"
+	// DELIVERY_PROTOCOL_AS2 posts key exchange files to an AS2 endpoint
+	DELIVERY_PROTOCOL_AS2 DeliveryProtocol = "as2"
+)
+
+type DeliveryStatus string
+
+var (
+	DELIVERY_PENDING   DeliveryStatus = "pending"
+	DELIVERY_DELIVERED DeliveryStatus = "delivered"
+	DELIVERY_FAILED    DeliveryStatus = "failed"
+)
+
+var errInvalidDelivery = errors.New("Invalid Delivery.")
+
+// Deliverer pushes a key exchange file to a partner and returns the receipt of
+// the delivery, such as the uploaded path or the AS2 MDN
+type Deliverer interface {
+	Deliver(ctx context.Context, name string, data []byte) (string, error)
+}
+
+// DeliveryTarget is where the key exchange files of a partner are delivered
+type DeliveryTarget struct {
+	Protocol DeliveryProtocol `yaml:"protocol"`
+	// Address is the host:port of the SFTP server
+	Address string `yaml:"address"`
+	User    string `yaml:"user"`
+	// Password or PrivateKeyFile, a PEM SSH private key, authenticate the SFTP user
+	Password       string `yaml:"password"`
+	PrivateKeyFile string `yaml:"privateKeyFile"`
+	// HostKey is the SSH host key of the SFTP server in authorized_keys format,
+	// the only host key accepted
+	HostKey string `yaml:"hostKey"`
+	// Directory is the SFTP directory files are uploaded to
+	Directory string `yaml:"directory"`
+	// URL is the AS2 endpoint, AS2From and AS2To the AS2 names of both sides
+	URL     string `yaml:"url"`
+	AS2From string `yaml:"as2From"`
+	AS2To   string `yaml:"as2To"`
+}
+
+// DeliveryConfig lists the delivery targets of partners by partner ID, and how
+// failed deliveries are retried
+type DeliveryConfig struct {
+	// Attempts is the number of times a file is pushed before the delivery fails, 5 when zero
+	Attempts int `yaml:"attempts"`
+	// Backoff is the wait before the second attempt, doubled after each attempt, 30s when zero
+	Backoff time.Duration `yaml:"backoff"`
+	// Timeout bounds each attempt, 1m when zero
+	Timeout  time.Duration             `yaml:"timeout"`
+	Partners map[string]DeliveryTarget `yaml:"partners"`
+}
+
+// ParseDeliveryConfig reads a delivery configuration from YAML, such as
+//
+//	attempts: 5
+//	backoff: 30s
+//	partners:
+//	  acme:
+//	    protocol: sftp
+//	    address: sftp.acme.example:22
+//	    user: bank
+//	    privateKeyFile: /etc/tr31/acme_ed25519
+//	    hostKey: ssh-ed25519 AAAAC3Nza...
+//	    directory: /inbound/keys
+//
+// Environment variables such as ${ACME_SFTP_PASSWORD} are expanded.
+func ParseDeliveryConfig(data []byte) (*DeliveryConfig, error) {
+	config := &DeliveryConfig{}
+	if err := yaml.Unmarshal([]byte(os.ExpandEnv(string(data))), config); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidDelivery, err)
+	}
+	return config, nil
+}
+
+// LoadDeliveryConfig reads a delivery configuration file
+func LoadDeliveryConfig(path string) (*DeliveryConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDeliveryConfig(data)
+}
+
+// Deliveries pushes key exchange files to the delivery targets of partners
+type Deliveries struct {
+	config     DeliveryConfig
+	mu         sync.RWMutex
+	deliverers map[string]Deliverer
+}
+
+// NewDeliveries validates the delivery targets of the configuration and fills in
+// its defaults
+func NewDeliveries(config DeliveryConfig) (*Deliveries, error) {
+	if config.Attempts <= 0 {
+		config.Attempts = 5
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = 30 * time.Second
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = time.Minute
+	}
+	d := &Deliveries{config: config, deliverers: make(map[string]Deliverer, len(config.Partners))}
+	for partnerID, target := range config.Partners {
+		var (
+			deliverer Deliverer
+			err       error
+		)
+		switch target.Protocol {
+		case DELIVERY_PROTOCOL_SFTP:
+			deliverer, err = newSFTPDeliverer(target)
+		case DELIVERY_PROTOCOL_AS2:
+			deliverer, err = newAS2Deliverer(target)
+		default:
+			err = fmt.Errorf("unknown protocol %q", target.Protocol)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: partner %s: %v", errInvalidDelivery, partnerID, err)
+		}
+		d.deliverers[partnerID] = deliverer
+	}
+	return d, nil
+}
+
+// SetDeliverer delivers the files of a partner with a custom Deliverer
+func (d *Deliveries) SetDeliverer(partnerID string, deliverer Deliverer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deliverers[partnerID] = deliverer
+}
+
+func (d *Deliveries) delivererOf(partnerID string) (Deliverer, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	deliverer, ok := d.deliverers[partnerID]
+	return deliverer, ok
+}
+
+// Delivery is a snapshot of the delivery of a key exchange file to a partner
+type Delivery struct {
+	ID          string           `json:"id"`
+	InitialKey  string           `json:"initialKey"`
+	PartnerID   string           `json:"partnerId"`
+	Protocol    DeliveryProtocol `json:"protocol,omitempty"`
+	FileName    string           `json:"fileName"`
+	Status      DeliveryStatus   `json:"status"`
+	Attempts    int              `json:"attempts"`
+	Receipt     string           `json:"receipt,omitempty"`
+	Error       string           `json:"error,omitempty"`
+	CreatedAt   time.Time        `json:"createdAt"`
+	DeliveredAt *time.Time       `json:"deliveredAt,omitempty"`
+}
+
+// delivery is the mutable state of a delivery
+type delivery struct {
+	mu   sync.RWMutex
+	info Delivery
+}
+
+func (d *delivery) snapshot() *Delivery {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	info := d.info
+	return &info
+}
+
+func (d *delivery) attempted(receipt string, err error, final bool, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.info.Attempts++
+	if err != nil {
+		d.info.Error = err.Error()
+		if final {
+			d.info.Status = DELIVERY_FAILED
+		}
+		return
+	}
+	d.info.Status = DELIVERY_DELIVERED
+	d.info.Receipt = receipt
+	d.info.Error = ""
+	d.info.DeliveredAt = &now
+}
+
+// ConfigureDeliveries sets the delivery targets key exchange files are pushed to
+func (s *service) ConfigureDeliveries(d *Deliveries) {
+	s.deliveryTargets.Store(d)
+}
+
+// DeliverKeyExchange checks a key exchange envelope is addressed to a partner
+// of the machine and starts pushing it to the partner's delivery target in the
+// background, retrying failed attempts
+func (s *service) DeliverKeyExchange(ik, partnerID string, envelope []byte) (*Delivery, error) {
+	d := s.deliveryTargets.Load()
+	if d == nil {
+		return nil, fmt.Errorf("%w: delivery is not configured", errInvalidDelivery)
+	}
+	if _, _, err := s.partnerOf(ik, partnerID); err != nil {
+		return nil, err
+	}
+	deliverer, ok := d.delivererOf(partnerID)
+	if !ok {
+		return nil, fmt.Errorf("%w: partner %s has no delivery target", errInvalidDelivery, partnerID)
+	}
+
+	var env tr31.KeyExchangeEnvelope
+	if err := json.Unmarshal(envelope, &env); err != nil || env.Format != tr31.KeyExchangeFormat {
+		return nil, fmt.Errorf("%w: not a %s envelope", errInvalidDelivery, tr31.KeyExchangeFormat)
+	}
+	var message tr31.KeyExchangeMessage
+	if err := json.Unmarshal(env.Message, &message); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidDelivery, err)
+	}
+	if err := message.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidDelivery, err)
+	}
+	if message.To != partnerID {
+		return nil, fmt.Errorf("%w: envelope is addressed to %s", errInvalidDelivery, message.To)
+	}
+
+	id := base.ID()
+	dv := &delivery{info: Delivery{
+		ID:         id,
+		InitialKey: ik,
+		PartnerID:  partnerID,
+		Protocol:   d.config.Partners[partnerID].Protocol,
+		FileName:   fmt.Sprintf("%s-%s.kem.json", partnerID, id),
+		Status:     DELIVERY_PENDING,
+		CreatedAt:  s.now(),
+	}}
+	s.deliveries.Store(id, dv)
+
+	go s.runDelivery(d.config, dv, deliverer, envelope)
+	return dv.snapshot(), nil
+}
+
+// GetDelivery returns the status of a delivery to a partner of the machine
+func (s *service) GetDelivery(ik, partnerID, id string) (*Delivery, error) {
+	if v, ok := s.deliveries.Load(id); ok {
+		info := v.(*delivery).snapshot()
+		if info.InitialKey == ik && info.PartnerID == partnerID {
+			return info, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// runDelivery pushes the file until an attempt succeeds or the attempts run out,
+// and records the outcome and its receipt in the audit log
+func (s *service) runDelivery(config DeliveryConfig, dv *delivery, deliverer Deliverer, data []byte) {
+	info := dv.snapshot()
+	backoff := config.Backoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+		receipt, err := deliverer.Deliver(ctx, info.FileName, data)
+		cancel()
+
+		final := err == nil || attempt >= config.Attempts
+		dv.attempted(receipt, err, final, s.now())
+		if final {
+			s.auditDelivery(info, receipt, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (s *service) auditDelivery(info *Delivery, receipt string, err error) {
+	l := s.auditLog.Load()
+	if l == nil {
+		return
+	}
+	r := AuditRecord{
+		Time:      s.now().UTC(),
+		Operation: AUDIT_OPERATION_DELIVER_KEY_EXCHANGE,
+		Subject:   info.InitialKey + "/" + info.PartnerID + "/" + info.ID,
+		Receipt:   receipt,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	l.Record(r)
+}
+
+// validateHTTPURL checks a URL is an absolute http(s) URL
+func validateHTTPURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q must be an http(s) URL", rawURL)
+	}
+	return nil
+}
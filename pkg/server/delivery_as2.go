@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/moov-io/base"
+)
+
+// as2Deliverer posts key exchange files to an AS2 (RFC 4130) endpoint and reads
+// the synchronous MDN. Payloads are sent unsigned and unencrypted: the envelope
+// carries its own signature and the keys are wrapped in key blocks.
+type as2Deliverer struct {
+	target DeliveryTarget
+	client *http.Client
+}
+
+func newAS2Deliverer(target DeliveryTarget) (*as2Deliverer, error) {
+	if err := validateHTTPURL(target.URL); err != nil {
+		return nil, fmt.Errorf("as2 url %v", err)
+	}
+	if target.AS2From == "" || target.AS2To == "" {
+		return nil, errors.New("as2 needs as2From and as2To")
+	}
+	return &as2Deliverer{target: target, client: &http.Client{}}, nil
+}
+
+// Deliver posts the file and returns its message ID and the MDN disposition as
+// the receipt. Endpoints answering without an MDN are receipted with the HTTP status.
+func (d *as2Deliverer) Deliver(ctx context.Context, name string, data []byte) (string, error) {
+	messageID := fmt.Sprintf("<%s@%s>", base.ID(), d.target.AS2From)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.target.URL, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("AS2-Version", "1.2")
+	req.Header.Set("AS2-From", d.target.AS2From)
+	req.Header.Set("AS2-To", d.target.AS2To)
+	req.Header.Set("Message-ID", messageID)
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("Subject", "Key exchange "+name)
+	req.Header.Set("MIME-Version", "1.0")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	req.Header.Set("Disposition-Notification-To", d.target.AS2From)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("as2: %s answered %s", d.target.URL, resp.Status)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" {
+		return fmt.Sprintf("as2 %s HTTP %d", messageID, resp.StatusCode), nil
+	}
+	disposition, err := readMDNDisposition(resp.Body, params["boundary"])
+	if err != nil {
+		return "", err
+	}
+	lower := strings.ToLower(disposition)
+	if !strings.Contains(lower, "processed") || strings.Contains(lower, "error") || strings.Contains(lower, "failed") {
+		return "", fmt.Errorf("as2: MDN disposition %s", disposition)
+	}
+	return fmt.Sprintf("as2 %s MDN %s", messageID, disposition), nil
+}
+
+// readMDNDisposition returns the Disposition field of the message/disposition-notification
+// part of a multipart/report MDN
+func readMDNDisposition(body io.Reader, boundary string) (string, error) {
+	mr := multipart.NewReader(body, boundary)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return "", errors.New("as2: MDN has no disposition notification")
+		}
+		if err != nil {
+			return "", fmt.Errorf("as2: MDN: %v", err)
+		}
+		mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if mediaType != "message/disposition-notification" {
+			continue
+		}
+		fields, err := textproto.NewReader(bufio.NewReader(part)).ReadMIMEHeader()
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("as2: MDN: %v", err)
+		}
+		if disposition := fields.Get("Disposition"); disposition != "" {
+			return disposition, nil
+		}
+		return "", errors.New("as2: MDN has no disposition")
+	}
+}
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP version 3 packet types, flags and status codes (draft-ietf-secsh-filexfer-02)
+const (
+	sshFxpInit    = 1
+	sshFxpVersion = 2
+	sshFxpOpen    = 3
+	sshFxpClose   = 4
+	sshFxpWrite   = 6
+	sshFxpStat    = 17
+	sshFxpRename  = 18
+	sshFxpStatus  = 101
+	sshFxpHandle  = 102
+	sshFxpAttrs   = 105
+
+	sshFxfWrite = 0x02
+	sshFxfCreat = 0x08
+	sshFxfTrunc = 0x10
+
+	sshFileXferAttrSize = 0x01
+	sshFxOK             = 0
+
+	sftpVersion      = 3
+	sftpChunkSize    = 32 * 1024
+	sftpMaxPacketLen = 256 * 1024
+)
+
+var errSFTPPacket = errors.New("malformed SFTP packet")
+
+// sftpDeliverer uploads key exchange files to an SFTP server. Files are written
+// under a .part name and renamed once complete, so partners never pick up a
+// partial file, and their size is checked after the upload.
+type sftpDeliverer struct {
+	target DeliveryTarget
+	config *ssh.ClientConfig
+}
+
+func newSFTPDeliverer(target DeliveryTarget) (*sftpDeliverer, error) {
+	if target.Address == "" || target.User == "" {
+		return nil, errors.New("sftp needs an address and a user")
+	}
+	if target.HostKey == "" {
+		return nil, errors.New("sftp needs the host key of the server")
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(target.HostKey))
+	if err != nil {
+		return nil, fmt.Errorf("host key: %v", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if target.PrivateKeyFile != "" {
+		data, err := os.ReadFile(target.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("private key: %v", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if target.Password != "" {
+		auth = append(auth, ssh.Password(target.Password))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("sftp needs a password or a private key file")
+	}
+	return &sftpDeliverer{
+		target: target,
+		config: &ssh.ClientConfig{
+			User:            target.User,
+			Auth:            auth,
+			HostKeyCallback: ssh.FixedHostKey(hostKey),
+		},
+	}, nil
+}
+
+// Deliver uploads the file to the target directory and returns its path, size
+// and SHA-256 as the receipt
+func (d *sftpDeliverer) Deliver(ctx context.Context, name string, data []byte) (string, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", d.target.Address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, d.target.Address, d.config)
+	if err != nil {
+		return "", err
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	w, err := session.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return "", err
+	}
+
+	sc := &sftpConn{w: w, r: r}
+	if err := sc.init(); err != nil {
+		return "", err
+	}
+	target := path.Join(d.target.Directory, name)
+	partial := target + ".part"
+	handle, err := sc.open(partial)
+	if err != nil {
+		return "", err
+	}
+	for offset := 0; offset < len(data); offset += sftpChunkSize {
+		if err := sc.write(handle, uint64(offset), data[offset:min(offset+sftpChunkSize, len(data))]); err != nil {
+			return "", err
+		}
+	}
+	if err := sc.status(sshFxpClose, sftpString(handle)); err != nil {
+		return "", err
+	}
+	if err := sc.status(sshFxpRename, sftpString(partial), sftpString(target)); err != nil {
+		return "", err
+	}
+	size, err := sc.stat(target)
+	if err != nil {
+		return "", err
+	}
+	if size != uint64(len(data)) {
+		return "", fmt.Errorf("sftp: %s has %d bytes after upload, expected %d", target, size, len(data))
+	}
+	return fmt.Sprintf("sftp://%s@%s%s %d bytes sha256:%x", d.target.User, d.target.Address, target, size, sha256.Sum256(data)), nil
+}
+
+// sftpConn is the client side of an SFTP session, sending one request at a time
+type sftpConn struct {
+	w  io.Writer
+	r  io.Reader
+	id uint32
+}
+
+func (c *sftpConn) init() error {
+	if err := writeSFTPPacket(c.w, sshFxpInit, sftpUint32(sftpVersion)); err != nil {
+		return err
+	}
+	typ, _, err := readSFTPPacket(c.r)
+	if err != nil {
+		return err
+	}
+	if typ != sshFxpVersion {
+		return fmt.Errorf("%w: expecting version, got type %d", errSFTPPacket, typ)
+	}
+	return nil
+}
+
+// request sends a request with the next request ID and returns the type and
+// payload of its response, after the request ID
+func (c *sftpConn) request(typ byte, fields ...[]byte) (byte, []byte, error) {
+	c.id++
+	payload := sftpUint32(c.id)
+	for _, f := range fields {
+		payload = append(payload, f...)
+	}
+	if err := writeSFTPPacket(c.w, typ, payload); err != nil {
+		return 0, nil, err
+	}
+	respType, resp, err := readSFTPPacket(c.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	id, resp, ok := readSFTPUint32(resp)
+	if !ok || id != c.id {
+		return 0, nil, fmt.Errorf("%w: unexpected request ID", errSFTPPacket)
+	}
+	return respType, resp, nil
+}
+
+// status sends a request answered with a status, and returns the error of
+// failed statuses
+func (c *sftpConn) status(typ byte, fields ...[]byte) error {
+	respType, resp, err := c.request(typ, fields...)
+	if err != nil {
+		return err
+	}
+	return sftpStatusError(respType, resp)
+}
+
+func (c *sftpConn) open(name string) (string, error) {
+	respType, resp, err := c.request(sshFxpOpen, sftpString(name), sftpUint32(sshFxfWrite|sshFxfCreat|sshFxfTrunc), sftpUint32(0))
+	if err != nil {
+		return "", err
+	}
+	if respType != sshFxpHandle {
+		return "", sftpStatusError(respType, resp)
+	}
+	handle, _, ok := readSFTPString(resp)
+	if !ok {
+		return "", errSFTPPacket
+	}
+	return handle, nil
+}
+
+func (c *sftpConn) write(handle string, offset uint64, data []byte) error {
+	return c.status(sshFxpWrite, sftpString(handle), binary.BigEndian.AppendUint64(nil, offset), sftpString(string(data)))
+}
+
+func (c *sftpConn) stat(name string) (uint64, error) {
+	respType, resp, err := c.request(sshFxpStat, sftpString(name))
+	if err != nil {
+		return 0, err
+	}
+	if respType != sshFxpAttrs {
+		return 0, sftpStatusError(respType, resp)
+	}
+	flags, resp, ok := readSFTPUint32(resp)
+	if !ok || flags&sshFileXferAttrSize == 0 || len(resp) < 8 {
+		return 0, fmt.Errorf("%w: attributes without a size", errSFTPPacket)
+	}
+	return binary.BigEndian.Uint64(resp), nil
+}
+
+// sftpStatusError returns the error of a status response, nil for SSH_FX_OK
+func sftpStatusError(typ byte, resp []byte) error {
+	if typ != sshFxpStatus {
+		return fmt.Errorf("%w: expecting a status, got type %d", errSFTPPacket, typ)
+	}
+	code, resp, ok := readSFTPUint32(resp)
+	if !ok {
+		return errSFTPPacket
+	}
+	if code == sshFxOK {
+		return nil
+	}
+	message, _, _ := readSFTPString(resp)
+	return fmt.Errorf("sftp: status %d: %s", code, message)
+}
+
+func writeSFTPPacket(w io.Writer, typ byte, payload []byte) error {
+	packet := append(sftpUint32(uint32(len(payload)+1)), typ)
+	_, err := w.Write(append(packet, payload...))
+	return err
+}
+
+func readSFTPPacket(r io.Reader) (byte, []byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n == 0 || n > sftpMaxPacketLen {
+		return 0, nil, fmt.Errorf("%w: length %d", errSFTPPacket, n)
+	}
+	packet := make([]byte, n)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return 0, nil, err
+	}
+	return packet[0], packet[1:], nil
+}
+
+func sftpUint32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func sftpString(s string) []byte {
+	return append(sftpUint32(uint32(len(s))), s...)
+}
+
+func readSFTPUint32(b []byte) (uint32, []byte, bool) {
+	if len(b) < 4 {
+		return 0, nil, false
+	}
+	return binary.BigEndian.Uint32(b), b[4:], true
+}
+
+func readSFTPString(b []byte) (string, []byte, bool) {
+	n, b, ok := readSFTPUint32(b)
+	if !ok || uint32(len(b)) < n {
+		return "", nil, false
+	}
+	return string(b[:n]), b[n:], true
+}
@@ -0,0 +1,364 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func mockKeyExchangeEnvelope(t *testing.T, to string) []byte {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	envelope, err := tr31.SealKeyExchange(&tr31.KeyExchangeMessage{
+		From: "bank",
+		To:   to,
+		Keys: []tr31.ExchangeKey{{KeyBlock: transportTestKeyBlock, EffectiveFrom: time.Now()}},
+	}, key)
+	require.NoError(t, err)
+	return envelope
+}
+
+// flakyDeliverer fails the first failures deliveries
+type flakyDeliverer struct {
+	mu       sync.Mutex
+	failures int
+	files    map[string][]byte
+}
+
+func (d *flakyDeliverer) Deliver(_ context.Context, name string, data []byte) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.failures > 0 {
+		d.failures--
+		return "", errors.New("connection refused")
+	}
+	d.files[name] = data
+	return "stored " + name, nil
+}
+
+func waitForDelivery(t *testing.T, s Service, d *Delivery) *Delivery {
+	t.Helper()
+	var current *Delivery
+	require.Eventually(t, func() bool {
+		var err error
+		current, err = s.GetDelivery(d.InitialKey, d.PartnerID, d.ID)
+		require.NoError(t, err)
+		return current.Status != DELIVERY_PENDING
+	}, 5*time.Second, 5*time.Millisecond)
+	return current
+}
+
+func TestService_DeliverKeyExchange(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := NewAuditLog(path, NewLocalAuditSigner(key), AuditConfig{}, nil)
+	require.NoError(t, err)
+
+	s := mockServiceInMock()
+	s.ConfigureAuditLog(l)
+	m := mockTerminalMachine(t, s)
+	mockPartner(t, s, m)
+	envelope := mockKeyExchangeEnvelope(t, "acme")
+
+	_, err = s.DeliverKeyExchange(m.InitialKey, "acme", envelope)
+	require.ErrorIs(t, err, errInvalidDelivery)
+
+	deliveries, err := NewDeliveries(DeliveryConfig{Attempts: 3, Backoff: time.Millisecond})
+	require.NoError(t, err)
+	deliverer := &flakyDeliverer{failures: 2, files: make(map[string][]byte)}
+	deliveries.SetDeliverer("acme", deliverer)
+	s.ConfigureDeliveries(deliveries)
+
+	d, err := s.DeliverKeyExchange(m.InitialKey, "acme", envelope)
+	require.NoError(t, err)
+	require.Equal(t, DELIVERY_PENDING, d.Status)
+	d = waitForDelivery(t, s, d)
+	require.Equal(t, DELIVERY_DELIVERED, d.Status)
+	require.Equal(t, 3, d.Attempts)
+	require.Equal(t, "stored "+d.FileName, d.Receipt)
+	require.NotNil(t, d.DeliveredAt)
+	require.Equal(t, envelope, deliverer.files[d.FileName])
+
+	// The attempts run out
+	deliverer.failures = 3
+	failed, err := s.DeliverKeyExchange(m.InitialKey, "acme", envelope)
+	require.NoError(t, err)
+	failed = waitForDelivery(t, s, failed)
+	require.Equal(t, DELIVERY_FAILED, failed.Status)
+	require.Equal(t, "connection refused", failed.Error)
+
+	_, err = s.GetDelivery(m.InitialKey, "other", d.ID)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = s.DeliverKeyExchange(m.InitialKey, "acme", mockKeyExchangeEnvelope(t, "other"))
+	require.ErrorIs(t, err, errInvalidDelivery)
+	_, err = s.DeliverKeyExchange(m.InitialKey, "acme", []byte(`{"format":"other"}`))
+	require.ErrorIs(t, err, errInvalidDelivery)
+	_, err = s.DeliverKeyExchange(m.InitialKey, "unknown", envelope)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, l.Close())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var batch SignedAuditBatch
+	require.NoError(t, json.Unmarshal(data, &batch))
+	var receipts []AuditRecord
+	for _, r := range batch.Records {
+		if r.Operation == AUDIT_OPERATION_DELIVER_KEY_EXCHANGE {
+			receipts = append(receipts, r)
+		}
+	}
+	require.Len(t, receipts, 2)
+	require.Equal(t, m.InitialKey+"/acme/"+d.ID, receipts[0].Subject)
+	require.Equal(t, d.Receipt, receipts[0].Receipt)
+	require.Equal(t, "connection refused", receipts[1].Error)
+}
+
+func TestNewDeliveries_invalid(t *testing.T) {
+	tests := map[string]DeliveryTarget{
+		"protocol":      {Protocol: "ftp"},
+		"sftp address":  {Protocol: DELIVERY_PROTOCOL_SFTP, User: "bank", Password: "secret", HostKey: "ssh-ed25519 AAAA"},
+		"sftp host key": {Protocol: DELIVERY_PROTOCOL_SFTP, Address: "localhost:22", User: "bank", Password: "secret", HostKey: "not a key"},
+		"sftp auth":     {Protocol: DELIVERY_PROTOCOL_SFTP, Address: "localhost:22", User: "bank"},
+		"as2 url":       {Protocol: DELIVERY_PROTOCOL_AS2, URL: "ftp://as2.acme.example", AS2From: "BANK", AS2To: "ACME"},
+		"as2 names":     {Protocol: DELIVERY_PROTOCOL_AS2, URL: "https://as2.acme.example"},
+	}
+	for name, target := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewDeliveries(DeliveryConfig{Partners: map[string]DeliveryTarget{"acme": target}})
+			require.ErrorIs(t, err, errInvalidDelivery)
+		})
+	}
+
+	config, err := ParseDeliveryConfig([]byte("attempts: 2\nbackoff: 1m\npartners:\n  acme:\n    protocol: as2\n    url: https://as2.acme.example\n    as2From: BANK\n    as2To: ACME\n"))
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, config.Backoff)
+	d, err := NewDeliveries(*config)
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, d.config.Timeout)
+}
+
+// sftpTestServer is an SFTP server keeping uploaded files in memory, answering
+// the requests sftpDeliverer sends
+type sftpTestServer struct {
+	listener net.Listener
+	hostKey  ssh.PublicKey
+	mu       sync.Mutex
+	files    map[string][]byte
+}
+
+func newSFTPTestServer(t *testing.T, password string) *sftpTestServer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(_ ssh.ConnMetadata, p []byte) (*ssh.Permissions, error) {
+			if string(p) != password {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	srv := &sftpTestServer{listener: listener, hostKey: signer.PublicKey(), files: make(map[string][]byte)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn, config)
+		}
+	}()
+	return srv
+}
+
+func (srv *sftpTestServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go srv.serveSFTP(channel)
+				}
+			}
+		}()
+	}
+}
+
+func (srv *sftpTestServer) serveSFTP(rw io.ReadWriteCloser) {
+	defer rw.Close()
+	status := func(id uint32, code uint32) []byte {
+		return append(append(sftpUint32(id), sftpUint32(code)...), sftpString("")...)
+	}
+	for {
+		typ, packet, err := readSFTPPacket(rw)
+		if err != nil {
+			return
+		}
+		if typ == sshFxpInit {
+			writeSFTPPacket(rw, sshFxpVersion, sftpUint32(sftpVersion))
+			continue
+		}
+		id, packet, _ := readSFTPUint32(packet)
+		name, packet, _ := readSFTPString(packet)
+
+		srv.mu.Lock()
+		switch typ {
+		case sshFxpOpen:
+			srv.files[name] = nil
+			writeSFTPPacket(rw, sshFxpHandle, append(sftpUint32(id), sftpString(name)...))
+		case sshFxpWrite:
+			offset := binary.BigEndian.Uint64(packet)
+			data, _, _ := readSFTPString(packet[8:])
+			srv.files[name] = append(srv.files[name][:offset], data...)
+			writeSFTPPacket(rw, sshFxpStatus, status(id, sshFxOK))
+		case sshFxpClose:
+			writeSFTPPacket(rw, sshFxpStatus, status(id, sshFxOK))
+		case sshFxpRename:
+			target, _, _ := readSFTPString(packet)
+			srv.files[target] = srv.files[name]
+			delete(srv.files, name)
+			writeSFTPPacket(rw, sshFxpStatus, status(id, sshFxOK))
+		case sshFxpStat:
+			data, exists := srv.files[name]
+			if !exists {
+				writeSFTPPacket(rw, sshFxpStatus, status(id, 2))
+				break
+			}
+			attrs := append(sftpUint32(sshFileXferAttrSize), binary.BigEndian.AppendUint64(nil, uint64(len(data)))...)
+			writeSFTPPacket(rw, sshFxpAttrs, append(sftpUint32(id), attrs...))
+		default:
+			writeSFTPPacket(rw, sshFxpStatus, status(id, 8))
+		}
+		srv.mu.Unlock()
+	}
+}
+
+func TestSFTPDeliverer(t *testing.T) {
+	srv := newSFTPTestServer(t, "secret")
+	target := DeliveryTarget{
+		Protocol:  DELIVERY_PROTOCOL_SFTP,
+		Address:   srv.listener.Addr().String(),
+		User:      "bank",
+		Password:  "secret",
+		HostKey:   string(ssh.MarshalAuthorizedKey(srv.hostKey)),
+		Directory: "/inbound",
+	}
+	deliverer, err := newSFTPDeliverer(target)
+	require.NoError(t, err)
+
+	// Files larger than a chunk are written in several requests
+	data := bytes.Repeat([]byte("key exchange "), 5000)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	receipt, err := deliverer.Deliver(ctx, "acme.kem.json", data)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(receipt, fmt.Sprintf("sftp://bank@%s/inbound/acme.kem.json %d bytes sha256:", target.Address, len(data))), receipt)
+	srv.mu.Lock()
+	require.Equal(t, data, srv.files["/inbound/acme.kem.json"])
+	require.NotContains(t, srv.files, "/inbound/acme.kem.json.part")
+	srv.mu.Unlock()
+
+	// Only the pinned host key is accepted
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := ssh.NewPublicKey(other.Public())
+	target.HostKey = string(ssh.MarshalAuthorizedKey(otherKey))
+	deliverer, err = newSFTPDeliverer(target)
+	require.NoError(t, err)
+	_, err = deliverer.Deliver(ctx, "acme.kem.json", data)
+	require.ErrorContains(t, err, "host key mismatch")
+}
+
+func TestAS2Deliverer(t *testing.T) {
+	disposition := "automatic-action/MDN-sent-automatically; processed"
+	var received []byte
+	as2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "BANK", r.Header.Get("AS2-From"))
+		require.Equal(t, "ACME", r.Header.Get("AS2-To"))
+		received, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", `multipart/report; report-type=disposition-notification; boundary="mdn"`)
+		fmt.Fprintf(w, "--mdn\r\nContent-Type: text/plain\r\n\r\nReceived\r\n--mdn\r\nContent-Type: message/disposition-notification\r\n\r\nOriginal-Message-ID: %s\r\nDisposition: %s\r\n\r\n--mdn--\r\n", r.Header.Get("Message-ID"), disposition)
+	}))
+	defer as2.Close()
+
+	deliverer, err := newAS2Deliverer(DeliveryTarget{Protocol: DELIVERY_PROTOCOL_AS2, URL: as2.URL, AS2From: "BANK", AS2To: "ACME"})
+	require.NoError(t, err)
+	receipt, err := deliverer.Deliver(context.Background(), "acme.kem.json", []byte(`{"format":"tr31-kem/1"}`))
+	require.NoError(t, err)
+	require.Contains(t, receipt, "MDN "+disposition)
+	require.Equal(t, `{"format":"tr31-kem/1"}`, string(received))
+
+	disposition = "automatic-action/MDN-sent-automatically; processed/error: unexpected-processing-error"
+	_, err = deliverer.Deliver(context.Background(), "acme.kem.json", []byte(`{}`))
+	require.ErrorContains(t, err, "MDN disposition")
+}
+
+func TestRouting_deliveries(t *testing.T) {
+	s := mockServiceInMock()
+	m := mockTerminalMachine(t, s)
+	mockPartner(t, s, m)
+	deliveries, err := NewDeliveries(DeliveryConfig{})
+	require.NoError(t, err)
+	deliveries.SetDeliverer("acme", &flakyDeliverer{files: make(map[string][]byte)})
+	s.ConfigureDeliveries(deliveries)
+	router := MakeHTTPHandler(s)
+
+	req := httptest.NewRequest("POST", "/machine/"+m.InitialKey+"/partners/acme/deliveries", bytes.NewReader(mockKeyExchangeEnvelope(t, "acme")))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var created deliveryResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	waitForDelivery(t, s, created.Delivery)
+
+	req = httptest.NewRequest("GET", "/machine/"+m.InitialKey+"/partners/acme/deliveries/"+created.Delivery.ID, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var status deliveryResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	require.Equal(t, DELIVERY_DELIVERED, status.Delivery.Status)
+
+	req = httptest.NewRequest("POST", "/machine/"+m.InitialKey+"/partners/acme/deliveries", strings.NewReader("not an envelope"))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	rpprof "runtime/pprof"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/moov-io/base/log"
+)
+
+var (
+	// ErrAdminUnauthorized is returned for diagnostics requests without an admin token
+	ErrAdminUnauthorized = errors.New("missing or unknown admin token")
+
+	errInvalidDiagnostics = errors.New("invalid diagnostics")
+	errInvalidDump        = errors.New("invalid dump")
+)
+
+// _dumpProfiles are the profiles POST /debug/dump writes, with the debug level
+// of their format: full goroutine stacks as text, the heap as a pprof profile
+var _dumpProfiles = map[string]int{
+	"goroutine": 2,
+	"heap":      0,
+}
+
+// DiagnosticsConfig configures the diagnostics handler
+type DiagnosticsConfig struct {
+	// TokenHashes are the hex SHA-256 hashes of the admin tokens, see
+	// TenantTokenHash, sent as "Authorization: Bearer <token>"
+	TokenHashes []string
+	// DumpDir is the directory goroutine and heap dumps are written to,
+	// os.TempDir() when empty
+	DumpDir string
+	Logger  log.Logger
+}
+
+// DumpResult is the response of POST /debug/dump
+type DumpResult struct {
+	Profile string    `json:"profile"`
+	File    string    `json:"file"`
+	Size    int64     `json:"size"`
+	Time    time.Time `json:"time"`
+}
+
+// NewDiagnosticsHandler serves the runtime diagnostics of the server to admins:
+// the net/http/pprof profiles under /debug/pprof/, the expvar variables at
+// /debug/vars and POST /debug/dump?profile=goroutine|heap, which writes a dump
+// to DumpDir. Profiles and dumps hold raw memory, including keys being
+// wrapped, so the handler is served on a listener of its own and every request
+// needs an admin token.
+func NewDiagnosticsHandler(cfg DiagnosticsConfig) (http.Handler, error) {
+	if len(cfg.TokenHashes) == 0 {
+		return nil, fmt.Errorf("%w: an admin token hash is required", errInvalidDiagnostics)
+	}
+	hashes := make([][]byte, 0, len(cfg.TokenHashes))
+	for i, hash := range cfg.TokenHashes {
+		hash = strings.ToLower(strings.TrimSpace(hash))
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("%w: token hash %d must be 64 hexchars", errInvalidDiagnostics, i)
+		}
+		hashes = append(hashes, []byte(hash))
+	}
+	if cfg.DumpDir == "" {
+		cfg.DumpDir = os.TempDir()
+	}
+	if info, err := os.Stat(cfg.DumpDir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%w: dump directory %s doesn't exist", errInvalidDiagnostics, cfg.DumpDir)
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.NewNopLogger()
+	}
+
+	r := mux.NewRouter()
+	r.Use(requireAdminToken(hashes))
+	r.Path("/debug/pprof/cmdline").HandlerFunc(pprof.Cmdline)
+	r.Path("/debug/pprof/profile").HandlerFunc(pprof.Profile)
+	r.Path("/debug/pprof/symbol").HandlerFunc(pprof.Symbol)
+	r.Path("/debug/pprof/trace").HandlerFunc(pprof.Trace)
+	r.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+	r.Path("/debug/vars").Handler(expvar.Handler())
+	r.Methods("POST").Path("/debug/dump").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := saveRequestIDIntoContext()(req.Context(), req)
+		result, err := writeDump(cfg.DumpDir, req.URL.Query().Get("profile"), time.Now())
+		if err != nil {
+			encodeError(ctx, err, w)
+			return
+		}
+		cfg.Logger.Logf("diagnostics: wrote %s dump to %s", result.Profile, result.File)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(result)
+	})
+	return r, nil
+}
+
+// requireAdminToken rejects requests without the admin token of one of hashes
+func requireAdminToken(hashes [][]byte) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if token = strings.TrimSpace(token); token != "" {
+				hash := []byte(TenantTokenHash(token))
+				for _, candidate := range hashes {
+					if subtle.ConstantTimeCompare(hash, candidate) == 1 {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+			encodeError(saveRequestIDIntoContext()(r.Context(), r), ErrAdminUnauthorized, w)
+		})
+	}
+}
+
+// writeDump writes the goroutine or heap profile to a new file of dir
+func writeDump(dir, profile string, now time.Time) (*DumpResult, error) {
+	debug, known := _dumpProfiles[profile]
+	if !known {
+		return nil, fmt.Errorf("%w: profile must be goroutine or heap", errInvalidDump)
+	}
+	ext := ".pprof"
+	if debug > 0 {
+		ext = ".txt"
+	}
+	if profile == "heap" {
+		// Collect garbage so the profile reflects live objects
+		runtime.GC()
+	}
+	path := filepath.Join(dir, fmt.Sprintf("tr31-%s-%s%s", profile, now.UTC().Format("20060102T150405.000000000Z"), ext))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := rpprof.Lookup(profile).WriteTo(file, debug); err != nil {
+		file.Close()
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	return &DumpResult{Profile: profile, File: path, Size: info.Size(), Time: now}, nil
+}
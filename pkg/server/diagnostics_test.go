@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiagnosticsHandler(t *testing.T) {
+	dir := t.TempDir()
+	handler, err := NewDiagnosticsHandler(DiagnosticsConfig{
+		TokenHashes: []string{TenantTokenHash("admin-token")},
+		DumpDir:     dir,
+	})
+	require.NoError(t, err)
+
+	send := func(method, target, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Every route needs an admin token
+	for _, target := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/vars"} {
+		require.Equal(t, http.StatusUnauthorized, send("GET", target, "").Code, target)
+		require.Equal(t, http.StatusUnauthorized, send("GET", target, "tenant-token").Code, target)
+	}
+	w := send("POST", "/debug/dump?profile=heap", "")
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Contains(t, w.Body.String(), ERROR_CODE_UNAUTHORIZED)
+
+	w = send("GET", "/debug/pprof/", "admin-token")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), "goroutine")
+	w = send("GET", "/debug/pprof/goroutine?debug=1", "admin-token")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), "goroutine profile")
+	w = send("GET", "/debug/vars", "admin-token")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), "memstats")
+
+	for _, profile := range []string{"goroutine", "heap"} {
+		w = send("POST", "/debug/dump?profile="+profile, "admin-token")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var result DumpResult
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+		require.Equal(t, profile, result.Profile)
+		require.Equal(t, dir, filepath.Dir(result.File))
+		info, err := os.Stat(result.File)
+		require.NoError(t, err)
+		require.Equal(t, result.Size, info.Size())
+		require.Positive(t, info.Size())
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "tr31-goroutine-*.txt"))
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	data, err := os.ReadFile(matches[0])
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(data), "goroutine "))
+
+	w = send("POST", "/debug/dump?profile=allocs", "admin-token")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Equal(t, http.StatusMethodNotAllowed, send("GET", "/debug/dump?profile=heap", "admin-token").Code)
+}
+
+func TestNewDiagnosticsHandler_Invalid(t *testing.T) {
+	_, err := NewDiagnosticsHandler(DiagnosticsConfig{})
+	require.ErrorIs(t, err, errInvalidDiagnostics)
+	_, err = NewDiagnosticsHandler(DiagnosticsConfig{TokenHashes: []string{"admin-token"}})
+	require.ErrorIs(t, err, errInvalidDiagnostics)
+	_, err = NewDiagnosticsHandler(DiagnosticsConfig{
+		TokenHashes: []string{TenantTokenHash("admin-token")},
+		DumpDir:     filepath.Join(t.TempDir(), "missing"),
+	})
+	require.ErrorIs(t, err, errInvalidDiagnostics)
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+// Machine-readable codes of the error object in response envelopes
+const (
+	ERROR_CODE_INTERNAL              string = "internal_error"
+	ERROR_CODE_INVALID_REQUEST       string = "invalid_request"
+	ERROR_CODE_INVALID_JSON          string = "invalid_json"
+	ERROR_CODE_MALFORMED_FIELD       string = "malformed_field"
+	ERROR_CODE_REQUEST_TOO_LARGE     string = "request_too_large"
+	ERROR_CODE_NOT_FOUND             string = "not_found"
+	ERROR_CODE_UNAUTHORIZED          string = "unauthorized"
+	ERROR_CODE_FORBIDDEN             string = "forbidden"
+	ERROR_CODE_QUOTA_EXCEEDED        string = "quota_exceeded"
+	ERROR_CODE_ALREADY_EXISTS        string = "already_exists"
+	ERROR_CODE_VERSION_NOT_ALLOWED   string = "version_not_allowed"
+	ERROR_CODE_CLEAR_KEY_NOT_ALLOWED string = "clear_key_not_allowed"
+	ERROR_CODE_USAGE_NOT_APPROVED    string = "usage_not_approved"
+	ERROR_CODE_BLOCK_POLICY          string = "block_policy_violation"
+	ERROR_CODE_JOB_NOT_FINISHED      string = "job_not_finished"
+	ERROR_CODE_KEY_STATE_TRANSITION  string = "key_state_transition_not_allowed"
+	ERROR_CODE_KEY_NOT_USABLE        string = "key_not_usable"
+	ERROR_CODE_IDEMPOTENCY_KEY_USED  string = "idempotency_key_used"
+	ERROR_CODE_REQUEST_REPLAYED      string = "request_replayed"
+	ERROR_CODE_INVALID_MACHINE       string = "invalid_machine"
+	ERROR_CODE_INVALID_DECLARATION   string = "invalid_declaration"
+	ERROR_CODE_INVALID_HEADER        string = "invalid_header"
+	ERROR_CODE_INVALID_KEY_BLOCK     string = "invalid_key_block"
+	ERROR_CODE_VAULT                 string = "vault_error"
+)
+
+// ErrorResponse is the error object of a response envelope
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Fields lists the invalid fields of the request, when known
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+type errorCode struct {
+	target error
+	code   string
+	status int
+}
+
+var (
+	_errorCodesMu sync.RWMutex
+	_errorCodes   []errorCode
+)
+
+// RegisterErrorCode maps errors matching target (see errors.Is) to a code and an
+// HTTP status in responses, for example errors of a custom secret manager.
+// Registered errors take precedence over the built-in mapping.
+func RegisterErrorCode(target error, code string, status int) {
+	_errorCodesMu.Lock()
+	defer _errorCodesMu.Unlock()
+	_errorCodes = append(_errorCodes, errorCode{target: target, code: code, status: status})
+}
+
+func registeredErrorCode(err error) (errorCode, bool) {
+	_errorCodesMu.RLock()
+	defer _errorCodesMu.RUnlock()
+	for _, ec := range _errorCodes {
+		if errors.Is(err, ec.target) {
+			return ec, true
+		}
+	}
+	return errorCode{}, false
+}
+
+// codeOf returns the machine-readable code of an error
+func codeOf(err error) string {
+	if ec, ok := registeredErrorCode(err); ok {
+		return ec.code
+	}
+
+	var headerErr *tr31.HeaderError
+	var paramsErr *HeaderParamsError
+	var keyBlockErr *tr31.KeyBlockError
+	var vaultErr *VaultError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return ERROR_CODE_NOT_FOUND
+	case errors.Is(err, ErrAlreadyExists):
+		return ERROR_CODE_ALREADY_EXISTS
+	case errors.Is(err, ErrClientCertRequired), errors.Is(err, ErrTenantUnauthorized), errors.Is(err, ErrRequestSignature),
+		errors.Is(err, ErrAdminUnauthorized):
+		return ERROR_CODE_UNAUTHORIZED
+	case errors.Is(err, ErrRequestReplayed):
+		return ERROR_CODE_REQUEST_REPLAYED
+	case errors.Is(err, ErrTenantForbidden):
+		return ERROR_CODE_FORBIDDEN
+	case errors.Is(err, ErrQuotaExceeded):
+		return ERROR_CODE_QUOTA_EXCEEDED
+	case errors.Is(err, ErrVersionNotAllowed):
+		return ERROR_CODE_VERSION_NOT_ALLOWED
+	case errors.Is(err, ErrClearKeyNotAllowed):
+		return ERROR_CODE_CLEAR_KEY_NOT_ALLOWED
+	case errors.Is(err, ErrUsageNotApproved):
+		return ERROR_CODE_USAGE_NOT_APPROVED
+	case errors.Is(err, ErrBlockPolicy):
+		return ERROR_CODE_BLOCK_POLICY
+	case errors.Is(err, errJobNotFinished):
+		return ERROR_CODE_JOB_NOT_FINISHED
+	case errors.Is(err, ErrKeyStateTransition):
+		return ERROR_CODE_KEY_STATE_TRANSITION
+	case errors.Is(err, ErrKeyNotUsable):
+		return ERROR_CODE_KEY_NOT_USABLE
+	case errors.Is(err, errIdempotencyKeyInUse), errors.Is(err, errIdempotencyKeyReused):
+		return ERROR_CODE_IDEMPOTENCY_KEY_USED
+	case errors.Is(err, errRequestTooLarge):
+		return ERROR_CODE_REQUEST_TOO_LARGE
+	case errors.Is(err, errInvalidJSON):
+		return ERROR_CODE_INVALID_JSON
+	case errors.Is(err, errMalformedField):
+		return ERROR_CODE_MALFORMED_FIELD
+	case errors.Is(err, errInvalidMachine):
+		return ERROR_CODE_INVALID_MACHINE
+	case errors.Is(err, errInvalidDeclaration):
+		return ERROR_CODE_INVALID_DECLARATION
+	case
+		errors.Is(err, errInvalidVaultAddress),
+		errors.Is(err, errInvalidVaultToken),
+		errors.Is(err, errInvalidRequestId),
+		errors.Is(err, errInvalidKeyPath),
+		errors.Is(err, errInvalidKeyName),
+		errors.Is(err, errInvalidKeyBlock),
+		errors.Is(err, errInvalidTransportKey),
+		errors.Is(err, errInvalidPartner),
+		errors.Is(err, errInvalidDelivery),
+		errors.Is(err, errInvalidRotation),
+		errors.Is(err, errInvalidKeyState),
+		errors.Is(err, errInvalidCompromise),
+		errors.Is(err, errInvalidInspection),
+		errors.Is(err, errInvalidDump),
+		errors.Is(err, errInvalidEscrow),
+		errors.Is(err, errInvalidEscrowShare),
+		errors.Is(err, errInvalidKeyImporter),
+		errors.Is(err, errInvalidImportName),
+		errors.Is(err, errSecretScanNotSupported),
+		errors.Is(err, errInvalidIdempotencyKey),
+		errors.Is(err, errInvalidConsumerAction),
+		errors.Is(err, errInvalidJobType),
+		errors.Is(err, errInvalidJobItems):
+		return ERROR_CODE_INVALID_REQUEST
+	case errors.As(err, &headerErr), errors.As(err, &paramsErr):
+		return ERROR_CODE_INVALID_HEADER
+	case errors.As(err, &keyBlockErr):
+		return ERROR_CODE_INVALID_KEY_BLOCK
+	case errors.As(err, &vaultErr):
+		return ERROR_CODE_VAULT
+	}
+	return ERROR_CODE_INTERNAL
+}
+
+func newErrorResponse(err error) *ErrorResponse {
+	resp := &ErrorResponse{Code: codeOf(err), Message: err.Error()}
+	var paramsErr *HeaderParamsError
+	if errors.As(err, &paramsErr) {
+		resp.Fields = paramsErr.Fields
+	}
+	return resp
+}
+
+// statusOf returns the HTTP status of a registered error
+func statusOf(err error) (int, bool) {
+	if ec, ok := registeredErrorCode(err); ok && ec.status != 0 {
+		return ec.status, true
+	}
+	return http.StatusInternalServerError, false
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodeOf(t *testing.T) {
+	require.Equal(t, ERROR_CODE_NOT_FOUND, codeOf(ErrNotFound))
+	require.Equal(t, ERROR_CODE_VERSION_NOT_ALLOWED, codeOf(ErrVersionNotAllowed))
+	require.Equal(t, ERROR_CODE_MALFORMED_FIELD, codeOf(fmt.Errorf("%w EncryptKey must be hexchars.", errMalformedField)))
+	require.Equal(t, ERROR_CODE_INVALID_REQUEST, codeOf(errInvalidKeyPath))
+	require.Equal(t, ERROR_CODE_INVALID_HEADER, codeOf(tr31.NewHeaderError("bad header")))
+	require.Equal(t, ERROR_CODE_INVALID_KEY_BLOCK, codeOf(&tr31.KeyBlockError{Message: "bad MAC"}))
+	require.Equal(t, ERROR_CODE_VAULT, codeOf(&VaultError{Message: "sealed"}))
+	require.Equal(t, ERROR_CODE_INTERNAL, codeOf(errors.New("boom")))
+}
+
+func TestRegisterErrorCode(t *testing.T) {
+	errQuota := errors.New("quota exceeded")
+	RegisterErrorCode(errQuota, "quota_exceeded", http.StatusTooManyRequests)
+
+	err := fmt.Errorf("wrapping: %w", errQuota)
+	require.Equal(t, "quota_exceeded", codeOf(err))
+	require.Equal(t, http.StatusTooManyRequests, codeFrom(err))
+}
+
+func TestRouting_response_envelope(t *testing.T) {
+	router := MakeHTTPHandler(mockServiceInMock())
+
+	req := httptest.NewRequest("GET", "/machine/missing", nil)
+	req.Header.Set("X-Request-ID", "req-1234")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Equal(t, "req-1234", w.Header().Get("X-Request-ID"))
+	var body struct {
+		RequestID string         `json:"requestId"`
+		Error     *ErrorResponse `json:"error"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	require.Equal(t, "req-1234", body.RequestID)
+	require.Equal(t, &ErrorResponse{Code: ERROR_CODE_NOT_FOUND, Message: ErrNotFound.Error()}, body.Error)
+
+	// encrypt errors used to answer 200 with an error marshalled to {}
+	req = httptest.NewRequest("POST", "/encrypt_data", strings.NewReader(`{"KeyPath":"secret/tr31","KeyName":"missing","EncryptKey":"cccccccccccccccc"}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	body.Error = nil
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	require.NotEmpty(t, body.RequestID)
+	require.Equal(t, w.Header().Get("X-Request-ID"), body.RequestID)
+	require.Equal(t, ERROR_CODE_VAULT, body.Error.Code, body.Error.Message)
+	require.NotEmpty(t, body.Error.Message)
+
+	req = httptest.NewRequest("GET", "/machines", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	var machines map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &machines))
+	require.Contains(t, machines, "machines")
+	require.Contains(t, machines, "requestId")
+	require.NotContains(t, machines, "error")
+}
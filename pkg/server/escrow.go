@@ -0,0 +1,371 @@
+package server
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moov-io/base"
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+const (
+	minEscrowThreshold  = 2
+	maxEscrowCustodians = 255
+	// escrowManifestName is the secret name of the escrow manifest under the escrow path
+	escrowManifestName = "manifest"
+	// escrowShareName is the secret name of each custodian share
+	escrowShareName = "share"
+)
+
+var (
+	errInvalidEscrow      = errors.New("invalid escrow")
+	errInvalidEscrowShare = errors.New("invalid escrow share")
+)
+
+// EscrowCustodian holds one share of an escrowed KBPK
+type EscrowCustodian struct {
+	ID string
+	// Recipient is the age X25519 recipient, "age1...", the share is encrypted to
+	Recipient string
+	// ShareHash is the hex SHA-256 of the share, checked when the custodian submits it
+	ShareHash string `json:",omitempty"`
+}
+
+// EscrowRequest describes the escrow of a machine KBPK to custodians
+type EscrowRequest struct {
+	// Key is the KBPK escrowed, the machine's first KBPK when empty
+	Key KeyReference
+	// Algorithm is the algorithm of the KBPK, which its KCV is computed with, AES when empty
+	Algorithm string
+	// Threshold is the number of custodians needed to recover the KBPK
+	Threshold  int
+	Custodians []EscrowCustodian
+	// EscrowPath is where the shares are stored, the KBPK path followed by /escrow when empty
+	EscrowPath string
+}
+
+// Escrow is a KBPK split into Shamir shares, each encrypted to a custodian and
+// stored under EscrowPath/ID with the machine's backend
+type Escrow struct {
+	ID         string
+	InitialKey string
+	Key        KeyReference
+	EscrowPath string
+	Threshold  int
+	Custodians []EscrowCustodian
+	// KCV is the key check value of the escrowed KBPK
+	KCV       string
+	Algorithm string
+	CreatedAt time.Time
+	// Shares are the armored age files by custodian ID, only returned when the KBPK is escrowed
+	Shares map[string]string `json:",omitempty"`
+}
+
+// EscrowShare is the share a custodian decrypted, submitted to recover a KBPK
+type EscrowShare struct {
+	Custodian string
+	// Share is the hex share decrypted from the custodian's age file
+	Share string
+	// EscrowPath finds escrows stored outside the paths of the machine's KBPKs
+	EscrowPath string
+}
+
+// EscrowRecovery is the progress of the recovery of an escrowed KBPK
+type EscrowRecovery struct {
+	EscrowID  string
+	Threshold int
+	// Submitted lists the custodians whose shares were accepted
+	Submitted []string
+	// Recovered is set once the KBPK is reassembled and stored again
+	Recovered bool
+	KCV       string `json:",omitempty"`
+}
+
+// escrowSession holds the shares submitted for a recovery until the threshold is met
+type escrowSession struct {
+	mu     sync.Mutex
+	shares map[string][]byte
+}
+
+// OpenEscrowShare decrypts the armored age file of a custodian share with the
+// custodian's age X25519 identity, "AGE-SECRET-KEY-1...". The hex of the share
+// is submitted to recover the KBPK.
+func OpenEscrowShare(identity, sealed string) ([]byte, error) {
+	key, err := parseAgeIdentity(identity)
+	if err != nil {
+		return nil, err
+	}
+	return openAge(key, sealed)
+}
+
+// EscrowKBPK splits a KBPK of the machine into Shamir shares, encrypts each to
+// a custodian age X25519 recipient and stores the shares and the escrow manifest
+// with the machine's backend. Any threshold of custodians recovers the KBPK with
+// RecoverKBPK, fewer learn nothing about it.
+func (s *service) EscrowKBPK(ik string, req EscrowRequest) (_ *Escrow, err error) {
+	defer func() { s.audit(AUDIT_OPERATION_ESCROW_KBPK, ik, err) }()
+	m, err := s.GetMachine(ik)
+	if err != nil {
+		return nil, err
+	}
+	key, err := escrowedKey(m, req.Key)
+	if err != nil {
+		return nil, err
+	}
+	algorithm := cmp.Or(strings.ToUpper(req.Algorithm), tr31.ENC_ALGORITHM_AES)
+	if algorithm != tr31.ENC_ALGORITHM_AES && algorithm != tr31.ENC_ALGORITHM_TRIPLE_DES {
+		return nil, fmt.Errorf("%w: unsupported KBPK algorithm %s", errInvalidEscrow, req.Algorithm)
+	}
+	if req.Threshold < minEscrowThreshold || req.Threshold > len(req.Custodians) || len(req.Custodians) > maxEscrowCustodians {
+		return nil, fmt.Errorf("%w: threshold must be %d to the number of custodians, at most %d",
+			errInvalidEscrow, minEscrowThreshold, maxEscrowCustodians)
+	}
+	custodians := make([]EscrowCustodian, len(req.Custodians))
+	for i, c := range req.Custodians {
+		if !validEscrowCustodianID(c.ID) || slices.ContainsFunc(custodians[:i], func(o EscrowCustodian) bool { return o.ID == c.ID }) {
+			return nil, fmt.Errorf("%w: custodian %d needs a unique ID of letters, digits, '-' and '_'", errInvalidEscrow, i+1)
+		}
+		if _, err := parseAgeRecipient(c.Recipient); err != nil {
+			return nil, fmt.Errorf("%w: custodian %s: %v", errInvalidEscrow, c.ID, err)
+		}
+		custodians[i] = EscrowCustodian{ID: c.ID, Recipient: c.Recipient}
+	}
+
+	sm, err := s.scopedSecretManagerOf(m)
+	if err != nil {
+		return nil, err
+	}
+	kbpk, err := s.readKBPKFor(sm, UnifiedParams{
+		VaultAddr:  m.vaultAuth.VaultAddress,
+		VaultToken: m.vaultAuth.VaultToken,
+		KeyPath:    key.KeyPath,
+		KeyName:    key.KeyName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(kbpk)
+	kcv, err := tr31.KeyCheckValue(kbpk, algorithm)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidEscrow, err)
+	}
+	shares, err := splitSecret(kbpk, len(custodians), req.Threshold)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidEscrow, err)
+	}
+	defer func() {
+		for _, share := range shares {
+			wipe(share)
+		}
+	}()
+
+	e := &Escrow{
+		ID:         base.ID(),
+		InitialKey: ik,
+		Key:        KeyReference{KeyPath: key.KeyPath, KeyName: key.KeyName},
+		EscrowPath: cmp.Or(strings.TrimSuffix(req.EscrowPath, "/"), key.KeyPath+"/escrow"),
+		Threshold:  req.Threshold,
+		Custodians: custodians,
+		KCV:        kcv,
+		Algorithm:  algorithm,
+		CreatedAt:  s.now(),
+		Shares:     make(map[string]string, len(custodians)),
+	}
+	dir := e.EscrowPath + "/" + e.ID
+	for i := range e.Custodians {
+		c := &e.Custodians[i]
+		recipient, _ := parseAgeRecipient(c.Recipient)
+		sealed, err := sealAge(recipient, shares[i])
+		if err != nil {
+			return nil, err
+		}
+		hash := sha256.Sum256(shares[i])
+		c.ShareHash = hex.EncodeToString(hash[:])
+		e.Shares[c.ID] = sealed
+	}
+
+	stored := *e
+	stored.Shares = nil
+	manifest, err := json.Marshal(stored)
+	if err != nil {
+		return nil, err
+	}
+	var written []EscrowCustodian
+	for _, c := range e.Custodians {
+		if vErr := sm.WriteSecret(dir+"/"+c.ID, escrowShareName, e.Shares[c.ID]); vErr != nil {
+			for _, w := range written {
+				sm.DeleteSecret(dir+"/"+w.ID, escrowShareName)
+			}
+			return nil, vErr
+		}
+		written = append(written, c)
+	}
+	// The manifest is written last, an escrow is only found once every share is stored
+	if vErr := sm.WriteSecret(dir, escrowManifestName, string(manifest)); vErr != nil {
+		for _, w := range written {
+			sm.DeleteSecret(dir+"/"+w.ID, escrowShareName)
+		}
+		return nil, vErr
+	}
+	return e, nil
+}
+
+// RecoverKBPK accepts the share a custodian decrypted. Once the escrow threshold
+// of custodians submitted their shares the KBPK is reassembled, checked against
+// the escrowed KCV and stored again at its key path and name. A KBPK still
+// stored is left untouched when its KCV matches, and never overwritten.
+func (s *service) RecoverKBPK(ik, escrowID string, submission EscrowShare) (_ *EscrowRecovery, err error) {
+	defer func() { s.audit(AUDIT_OPERATION_RECOVER_KBPK, ik+"/"+escrowID, err) }()
+	m, err := s.GetMachine(ik)
+	if err != nil {
+		return nil, err
+	}
+	sm, err := s.scopedSecretManagerOf(m)
+	if err != nil {
+		return nil, err
+	}
+	e, err := findEscrow(sm, m, escrowID, submission.EscrowPath)
+	if err != nil {
+		return nil, err
+	}
+
+	i := slices.IndexFunc(e.Custodians, func(c EscrowCustodian) bool { return c.ID == submission.Custodian })
+	if i < 0 {
+		return nil, fmt.Errorf("%w: unknown custodian %q", errInvalidEscrowShare, submission.Custodian)
+	}
+	share, err := hex.DecodeString(strings.TrimSpace(submission.Share))
+	if err != nil {
+		return nil, fmt.Errorf("%w: share must be hex", errInvalidEscrowShare)
+	}
+	hash := sha256.Sum256(share)
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(hash[:])), []byte(e.Custodians[i].ShareHash)) != 1 {
+		wipe(share)
+		return nil, fmt.Errorf("%w: share doesn't match custodian %s", errInvalidEscrowShare, submission.Custodian)
+	}
+
+	sessionKey := ik + "/" + e.ID
+	value, _ := s.escrows.LoadOrStore(sessionKey, &escrowSession{shares: make(map[string][]byte)})
+	session := value.(*escrowSession)
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if previous, exists := session.shares[submission.Custodian]; exists {
+		wipe(previous)
+	}
+	session.shares[submission.Custodian] = share
+
+	recovery := &EscrowRecovery{EscrowID: e.ID, Threshold: e.Threshold}
+	for id := range session.shares {
+		recovery.Submitted = append(recovery.Submitted, id)
+	}
+	slices.Sort(recovery.Submitted)
+	if len(session.shares) < e.Threshold {
+		return recovery, nil
+	}
+
+	shares := make([][]byte, 0, len(session.shares))
+	for _, share := range session.shares {
+		shares = append(shares, share)
+	}
+	kbpk, err := combineShares(shares)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidEscrowShare, err)
+	}
+	defer wipe(kbpk)
+	kcv, err := tr31.KeyCheckValue(kbpk, e.Algorithm)
+	if err != nil || kcv != e.KCV {
+		return nil, fmt.Errorf("%w: recovered KBPK doesn't match the escrowed KCV", errInvalidEscrowShare)
+	}
+
+	params := UnifiedParams{
+		VaultAddr:  m.vaultAuth.VaultAddress,
+		VaultToken: m.vaultAuth.VaultToken,
+		KeyPath:    e.Key.KeyPath,
+		KeyName:    e.Key.KeyName,
+	}
+	if secretExists(sm, e.Key.KeyPath, e.Key.KeyName) {
+		stored, err := readKBPK(sm, params)
+		if err != nil {
+			return nil, err
+		}
+		defer wipe(stored)
+		if storedKCV, _ := tr31.KeyCheckValue(stored, e.Algorithm); storedKCV != e.KCV {
+			return nil, fmt.Errorf("%w: another KBPK is stored at %s/%s", ErrAlreadyExists, e.Key.KeyPath, e.Key.KeyName)
+		}
+	} else if vErr := sm.WriteSecret(e.Key.KeyPath, e.Key.KeyName, strings.ToUpper(hex.EncodeToString(kbpk))); vErr != nil {
+		return nil, vErr
+	}
+
+	for id, share := range session.shares {
+		wipe(share)
+		delete(session.shares, id)
+	}
+	s.escrows.Delete(sessionKey)
+	recovery.Recovered = true
+	recovery.KCV = e.KCV
+	return recovery, nil
+}
+
+// escrowedKey returns the machine KBPK reference to escrow, its first when key is empty
+func escrowedKey(m *Machine, key KeyReference) (KeyReference, error) {
+	if len(m.Keys) == 0 {
+		return KeyReference{}, errMachineHasNoKBPK
+	}
+	if key.KeyPath == "" && key.KeyName == "" {
+		key = m.Keys[0]
+	}
+	i := slices.IndexFunc(m.Keys, func(k KeyReference) bool { return k.KeyPath == key.KeyPath && k.KeyName == key.KeyName })
+	if i < 0 {
+		return KeyReference{}, fmt.Errorf("%w: key %s/%s isn't referenced by the machine", errInvalidEscrow, key.KeyPath, key.KeyName)
+	}
+	if len(m.Keys[i].Components) > 0 {
+		return KeyReference{}, fmt.Errorf("%w: key %s/%s is split in components", errInvalidEscrow, key.KeyPath, key.KeyName)
+	}
+	return m.Keys[i], nil
+}
+
+// findEscrow reads the manifest of the escrow under path, or under the escrow
+// paths of the machine's KBPKs
+func findEscrow(sm SecretManager, m *Machine, id, path string) (*Escrow, error) {
+	paths := []string{strings.TrimSuffix(path, "/")}
+	if path == "" {
+		paths = paths[:0]
+		for _, key := range m.Keys {
+			paths = append(paths, key.KeyPath+"/escrow")
+		}
+	}
+	for _, path := range paths {
+		manifest, vErr := sm.ReadSecret(path+"/"+id, escrowManifestName)
+		if vErr != nil {
+			continue
+		}
+		// Backends deriving secrets for any name, such as the simulator, return no manifest
+		var e Escrow
+		if err := json.Unmarshal([]byte(manifest), &e); err != nil || e.ID != id || e.InitialKey != m.InitialKey {
+			continue
+		}
+		return &e, nil
+	}
+	return nil, fmt.Errorf("escrow %s: %w", id, ErrNotFound)
+}
+
+// validEscrowCustodianID checks custodian IDs are usable in secret paths
+func validEscrowCustodianID(id string) bool {
+	if id == "" || len(id) > maxTagKeyLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShamir(t *testing.T) {
+	secret, _ := hex.DecodeString("AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	shares, err := splitSecret(secret, 5, 3)
+	require.NoError(t, err)
+	require.Len(t, shares, 5)
+
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		var picked [][]byte
+		for _, i := range subset {
+			picked = append(picked, shares[i])
+		}
+		combined, err := combineShares(picked)
+		require.NoError(t, err)
+		require.Equal(t, secret, combined, subset)
+	}
+
+	// Fewer shares than the threshold give another value
+	combined, err := combineShares(shares[:2])
+	require.NoError(t, err)
+	require.NotEqual(t, secret, combined)
+
+	_, err = combineShares([][]byte{shares[0], shares[0]})
+	require.ErrorIs(t, err, errInvalidShares)
+	_, err = splitSecret(secret, 2, 3)
+	require.ErrorIs(t, err, errInvalidShares)
+	_, err = splitSecret(secret, 3, 1)
+	require.ErrorIs(t, err, errInvalidShares)
+}
+
+func TestAge(t *testing.T) {
+	// Key pair of the age test vectors
+	key, err := parseAgeIdentity("AGE-SECRET-KEY-1GFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPQ4EGAEX")
+	require.NoError(t, err)
+	require.Equal(t, "age1zvkyg2lqzraa2lnjvqej32nkuu0ues2s82hzrye869xeexvn73equnujwj", bech32Encode(ageRecipientHRP, key.PublicKey().Bytes()))
+
+	identity, recipient, err := GenerateAgeIdentity()
+	require.NoError(t, err)
+	publicKey, err := parseAgeRecipient(recipient)
+	require.NoError(t, err)
+	sealed, err := sealAge(publicKey, []byte("share"))
+	require.NoError(t, err)
+	require.Contains(t, sealed, "-----BEGIN AGE ENCRYPTED FILE-----")
+
+	opened, err := OpenEscrowShare(identity, sealed)
+	require.NoError(t, err)
+	require.Equal(t, []byte("share"), opened)
+
+	other, _, err := GenerateAgeIdentity()
+	require.NoError(t, err)
+	_, err = OpenEscrowShare(other, sealed)
+	require.ErrorIs(t, err, errInvalidAgeFile)
+
+	_, err = parseAgeRecipient(identity)
+	require.ErrorIs(t, err, errInvalidAgeKey)
+	_, err = parseAgeRecipient(recipient[:len(recipient)-1] + "q")
+	require.ErrorIs(t, err, errInvalidAgeKey)
+}
+
+func TestEscrowKBPK(t *testing.T) {
+	s := mockServiceInMock()
+	sm := s.GetSecretManager()
+	sm.WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	m := NewMachine(mockVaultAuthOne())
+	m.Keys = []KeyReference{{KeyPath: "secret/tr31", KeyName: "kbkp"}}
+	require.NoError(t, s.CreateMachine(m))
+
+	identities := map[string]string{}
+	var custodians []EscrowCustodian
+	for _, id := range []string{"alice", "bob", "carol"} {
+		identity, recipient, err := GenerateAgeIdentity()
+		require.NoError(t, err)
+		identities[id] = identity
+		custodians = append(custodians, EscrowCustodian{ID: id, Recipient: recipient})
+	}
+
+	e, err := s.EscrowKBPK(m.InitialKey, EscrowRequest{Threshold: 2, Custodians: custodians, Algorithm: "T"})
+	require.NoError(t, err)
+	require.Equal(t, "secret/tr31/escrow", e.EscrowPath)
+	require.Len(t, e.Shares, 3)
+	stored, vErr := sm.ReadSecret("secret/tr31/escrow/"+e.ID+"/bob", escrowShareName)
+	require.Nil(t, vErr)
+	require.Equal(t, e.Shares["bob"], stored)
+
+	shareOf := func(id string) string {
+		share, err := OpenEscrowShare(identities[id], e.Shares[id])
+		require.NoError(t, err)
+		return hex.EncodeToString(share)
+	}
+
+	// The KBPK is lost, then recovered once 2 custodians submit their shares
+	require.Nil(t, sm.DeleteSecret("secret/tr31", "kbkp"))
+	_, err = s.RecoverKBPK(m.InitialKey, e.ID, EscrowShare{Custodian: "alice", Share: shareOf("bob")})
+	require.ErrorIs(t, err, errInvalidEscrowShare)
+	_, err = s.RecoverKBPK(m.InitialKey, e.ID, EscrowShare{Custodian: "mallory", Share: shareOf("bob")})
+	require.ErrorIs(t, err, errInvalidEscrowShare)
+
+	recovery, err := s.RecoverKBPK(m.InitialKey, e.ID, EscrowShare{Custodian: "alice", Share: shareOf("alice")})
+	require.NoError(t, err)
+	require.False(t, recovery.Recovered)
+	require.Equal(t, []string{"alice"}, recovery.Submitted)
+	_, vErr = sm.ReadSecret("secret/tr31", "kbkp")
+	require.NotNil(t, vErr)
+
+	recovery, err = s.RecoverKBPK(m.InitialKey, e.ID, EscrowShare{Custodian: "carol", Share: shareOf("carol")})
+	require.NoError(t, err)
+	require.True(t, recovery.Recovered)
+	require.Equal(t, e.KCV, recovery.KCV)
+	kbpk, vErr := sm.ReadSecret("secret/tr31", "kbkp")
+	require.Nil(t, vErr)
+	require.Equal(t, "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC", kbpk)
+
+	// Another KBPK stored since is never overwritten
+	sm.WriteSecret("secret/tr31", "kbkp", "DDDDDDDDDDDDDDDDEEEEEEEEEEEEEEEEFFFFFFFFFFFFFFFF")
+	s.RecoverKBPK(m.InitialKey, e.ID, EscrowShare{Custodian: "alice", Share: shareOf("alice")})
+	_, err = s.RecoverKBPK(m.InitialKey, e.ID, EscrowShare{Custodian: "bob", Share: shareOf("bob")})
+	require.ErrorIs(t, err, ErrAlreadyExists)
+
+	_, err = s.RecoverKBPK(m.InitialKey, "unknown", EscrowShare{Custodian: "alice", Share: shareOf("alice")})
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = s.EscrowKBPK(m.InitialKey, EscrowRequest{Threshold: 4, Custodians: custodians})
+	require.ErrorIs(t, err, errInvalidEscrow)
+	_, err = s.EscrowKBPK(m.InitialKey, EscrowRequest{Threshold: 2, Custodians: append(custodians, custodians[0])})
+	require.ErrorIs(t, err, errInvalidEscrow)
+	_, err = s.EscrowKBPK(m.InitialKey, EscrowRequest{Key: KeyReference{KeyPath: "secret/other", KeyName: "kbkp"}, Threshold: 2, Custodians: custodians})
+	require.ErrorIs(t, err, errInvalidEscrow)
+}
+
+func TestEscrowKBPK_http(t *testing.T) {
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	m := NewMachine(mockVaultAuthOne())
+	m.Keys = []KeyReference{{KeyPath: "secret/tr31", KeyName: "kbkp"}}
+	require.NoError(t, s.CreateMachine(m))
+	router := MakeHTTPHandler(s)
+
+	call := func(path string, body interface{}) *httptest.ResponseRecorder {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", path, bytes.NewReader(data)))
+		return w
+	}
+
+	identity, recipient, err := GenerateAgeIdentity()
+	require.NoError(t, err)
+	_, other, err := GenerateAgeIdentity()
+	require.NoError(t, err)
+	w := call("/machine/"+m.InitialKey+"/escrows", EscrowRequest{
+		Threshold:  2,
+		Custodians: []EscrowCustodian{{ID: "alice", Recipient: recipient}, {ID: "bob", Recipient: other}},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp escrowResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+	share, err := OpenEscrowShare(identity, resp.Escrow.Shares["alice"])
+	require.NoError(t, err)
+	w = call("/machine/"+m.InitialKey+"/escrows/"+resp.Escrow.ID+"/recover", EscrowShare{Custodian: "alice", Share: hex.EncodeToString(share)})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var recovery escrowRecoveryResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &recovery))
+	require.Equal(t, []string{"alice"}, recovery.Recovery.Submitted)
+	require.False(t, recovery.Recovery.Recovered)
+
+	w = call("/machine/"+m.InitialKey+"/escrows/"+resp.Escrow.ID+"/recover", EscrowShare{Custodian: "bob", Share: hex.EncodeToString(share)})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Body.String(), ERROR_CODE_INVALID_REQUEST)
+
+	w = call("/machine/"+m.InitialKey+"/escrows", EscrowRequest{Threshold: 2, Custodians: []EscrowCustodian{{ID: "alice", Recipient: "age1"}}})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+type EstateEntryStatus string
+
+var (
+	// ESTATE_TRANSLATED key blocks were translated to the target KBPK
+	ESTATE_TRANSLATED EstateEntryStatus = "translated"
+	// ESTATE_SKIPPED secrets are not key blocks, or are already under the target KBPK
+	ESTATE_SKIPPED EstateEntryStatus = "skipped"
+	// ESTATE_FAILED key blocks could not be translated and were left untouched
+	ESTATE_FAILED EstateEntryStatus = "failed"
+)
+
+var (
+	errSecretScanNotSupported = errors.New("secret manager can't scan secret paths")
+	errKCVMismatch            = errors.New("key check values don't match after translation")
+	errNotAKeyBlock           = errors.New("secret is not a key block")
+	errAlreadyTranslated      = errors.New("key block is already under the target KBPK")
+)
+
+// SecretScanner is implemented by secret managers able to read every secret
+// stored under a path, which re-encrypting an estate requires
+type SecretScanner interface {
+	// ReadSecrets returns the secrets stored under the path by name
+	ReadSecrets(path string) (map[string]string, *VaultError)
+}
+
+// EstateRequest describes the re-encryption of the key blocks stored under a
+// machine's secret paths from one KBPK to another
+type EstateRequest struct {
+	// Key is the KBPK the stored key blocks are wrapped under
+	Key KeyReference
+	// TargetKey is the KBPK the key blocks are translated to, as version D key blocks
+	TargetKey KeyReference
+	// Paths lists the secret paths to scan, the paths of the machine's KBPKs when empty
+	Paths []string
+	// DryRun translates and verifies every key block without writing it back
+	DryRun bool
+	// Principal is the caller the usage approver decides for, set from the
+	// request and never from its body
+	Principal string `json:"-"`
+}
+
+// EstateEntry is the reconciliation of a single secret
+type EstateEntry struct {
+	Path   string            `json:"path"`
+	Name   string            `json:"name,omitempty"`
+	Status EstateEntryStatus `json:"status"`
+	// KCV is the key check value of the wrapped key, identical before and after translation
+	KCV   string `json:"kcv,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// EstateReport reconciles the secrets scanned by an estate re-encryption
+type EstateReport struct {
+	InitialKey string        `json:"initialKey"`
+	DryRun     bool          `json:"dryRun"`
+	Translated int           `json:"translated"`
+	Skipped    int           `json:"skipped"`
+	Failed     int           `json:"failed"`
+	Entries    []EstateEntry `json:"entries"`
+	StartedAt  time.Time     `json:"startedAt"`
+	FinishedAt time.Time     `json:"finishedAt"`
+}
+
+func (r *EstateReport) record(entry EstateEntry) {
+	switch entry.Status {
+	case ESTATE_TRANSLATED:
+		r.Translated++
+	case ESTATE_SKIPPED:
+		r.Skipped++
+	case ESTATE_FAILED:
+		r.Failed++
+	}
+	r.Entries = append(r.Entries, entry)
+}
+
+// ReencryptEstate scans the secrets stored under the machine's secret paths and
+// translates every key block wrapped under req.Key to a version D key block under
+// req.TargetKey, writing it back in place. The KCV of each key is compared before
+// and after translation, mismatching key blocks are not written. Secrets holding
+// KBPKs or not holding key blocks are skipped, as are key blocks already under the
+// target KBPK, so an interrupted re-encryption can be run again.
+func (s *service) ReencryptEstate(ik string, req EstateRequest) (_ *EstateReport, err error) {
+	defer func() { s.audit(AUDIT_OPERATION_REENCRYPT_ESTATE, ik, err) }()
+	for _, key := range []KeyReference{req.Key, req.TargetKey} {
+		if key.KeyPath == "" {
+			return nil, errInvalidKeyPath
+		}
+		if key.KeyName == "" {
+			return nil, errInvalidKeyName
+		}
+	}
+	m, err := s.GetMachine(ik)
+	if err != nil {
+		return nil, err
+	}
+	if !m.AllowsVersion(tr31.TR31_VERSION_D) {
+		return nil, ErrVersionNotAllowed
+	}
+
+	sm, err := s.scopedSecretManagerOf(m)
+	if err != nil {
+		return nil, err
+	}
+	scanner, ok := sm.(SecretScanner)
+	if !ok {
+		return nil, errSecretScanNotSupported
+	}
+
+	params := UnifiedParams{
+		VaultAddr:  m.vaultAuth.VaultAddress,
+		VaultToken: m.vaultAuth.VaultToken,
+		KeyPath:    req.Key.KeyPath,
+		KeyName:    req.Key.KeyName,
+	}
+	kbpk, err := s.readKBPKFor(sm, params)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(kbpk)
+	params.KeyPath = req.TargetKey.KeyPath
+	params.KeyName = req.TargetKey.KeyName
+	targetKbpk, err := s.readKBPKFor(sm, params)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(targetKbpk)
+
+	return s.reencryptEstate(m, sm, scanner, kbpk, targetKbpk, req), nil
+}
+
+// reencryptEstate translates the key blocks stored under the secret paths of
+// req from kbpk to targetKbpk, see ReencryptEstate
+func (s *service) reencryptEstate(m *Machine, sm SecretManager, scanner SecretScanner, kbpk, targetKbpk []byte, req EstateRequest) *EstateReport {
+	kbpks := append([]KeyReference{req.Key, req.TargetKey}, m.Keys...)
+	isKBPK := func(path, name string) bool {
+		for _, key := range kbpks {
+			if key.KeyPath == path && key.KeyName == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	report := &EstateReport{
+		InitialKey: m.InitialKey,
+		DryRun:     req.DryRun,
+		Entries:    []EstateEntry{},
+		StartedAt:  s.now(),
+	}
+	for _, path := range estatePaths(m, req) {
+		secrets, vErr := scanner.ReadSecrets(path)
+		if vErr != nil {
+			report.record(EstateEntry{Path: path, Status: ESTATE_FAILED, Error: vErr.Error()})
+			continue
+		}
+		names := make([]string, 0, len(secrets))
+		for name := range secrets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			entry := EstateEntry{Path: path, Name: name}
+			if isKBPK(path, name) {
+				entry.Status, entry.Error = ESTATE_SKIPPED, "secret is a KBPK"
+				report.record(entry)
+				continue
+			}
+			// Secrets which aren't key blocks are skipped below
+			if err := s.approveUsage(req.Principal, secrets[name]); errors.Is(err, ErrUsageNotApproved) {
+				entry.Status, entry.Error = ESTATE_FAILED, err.Error()
+				report.record(entry)
+				continue
+			}
+			keyBlock, kcv, err := translateToVersionD(kbpk, targetKbpk, secrets[name])
+			entry.KCV = kcv
+			switch {
+			case errors.Is(err, errNotAKeyBlock), errors.Is(err, errAlreadyTranslated):
+				entry.Status, entry.Error = ESTATE_SKIPPED, err.Error()
+			case err != nil:
+				entry.Status, entry.Error = ESTATE_FAILED, err.Error()
+			case req.DryRun:
+				entry.Status = ESTATE_TRANSLATED
+			default:
+				if lErr := s.logWrapped(keyBlock); lErr != nil {
+					entry.Status, entry.Error = ESTATE_FAILED, lErr.Error()
+				} else if vErr := sm.WriteSecret(path, name, keyBlock); vErr != nil {
+					entry.Status, entry.Error = ESTATE_FAILED, vErr.Error()
+				} else {
+					entry.Status = ESTATE_TRANSLATED
+					s.recordRotation(m.InitialKey, path, name, s.now())
+				}
+			}
+			report.record(entry)
+		}
+	}
+	report.FinishedAt = s.now()
+	return report
+}
+
+// estatePaths returns the sorted, distinct secret paths to scan
+func estatePaths(m *Machine, req EstateRequest) []string {
+	paths := req.Paths
+	if len(paths) == 0 {
+		for _, key := range m.Keys {
+			paths = append(paths, key.KeyPath)
+		}
+	}
+	if len(paths) == 0 {
+		paths = []string{req.Key.KeyPath}
+	}
+	seen := make(map[string]bool, len(paths))
+	distinct := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if path != "" && !seen[path] {
+			seen[path] = true
+			distinct = append(distinct, path)
+		}
+	}
+	sort.Strings(distinct)
+	return distinct
+}
+
+// translateToVersionD unwraps the key block with kbpk and wraps the key under
+// targetKbpk as a version D key block with the same header fields, then unwraps
+// the result to check the KCV of the key didn't change. It returns the new key
+// block along with the KCV.
+func translateToVersionD(kbpk, targetKbpk []byte, keyBlock string) (string, string, error) {
+	header := tr31.DefaultHeader()
+	if _, err := header.Load(keyBlock); err != nil {
+		return "", "", errNotAKeyBlock
+	}
+
+	source, err := tr31.New(kbpk)
+	if err != nil {
+		return "", "", err
+	}
+	key, err := source.Unwrap(keyBlock)
+	if err != nil {
+		// A key block the target KBPK unwraps was translated by an earlier run
+		if header.VersionID == tr31.TR31_VERSION_D {
+			if kcv, verr := unwrapKCV(targetKbpk, keyBlock); verr == nil {
+				return "", kcv, errAlreadyTranslated
+			}
+		}
+		return "", "", err
+	}
+	defer wipe(key)
+	kcv, err := tr31.KeyCheckValue(key, header.Algorithm)
+	if err != nil {
+		return "", "", err
+	}
+
+	targetHeader := source.GetHeader()
+	if err := targetHeader.SetVersionID(tr31.TR31_VERSION_D); err != nil {
+		return "", kcv, err
+	}
+	target, err := tr31.New(targetKbpk, tr31.WithHeader(targetHeader))
+	if err != nil {
+		return "", kcv, err
+	}
+	translated, err := target.Wrap(key, nil)
+	if err != nil {
+		return "", kcv, err
+	}
+
+	targetKCV, err := unwrapKCV(targetKbpk, translated)
+	if err != nil {
+		return "", kcv, err
+	}
+	if targetKCV != kcv {
+		return "", kcv, fmt.Errorf("%w: %s before, %s after", errKCVMismatch, kcv, targetKCV)
+	}
+	return translated, kcv, nil
+}
+
+// unwrapKCV unwraps the key block with kbpk and returns the KCV of the key
+func unwrapKCV(kbpk []byte, keyBlock string) (string, error) {
+	kblock, err := tr31.New(kbpk)
+	if err != nil {
+		return "", err
+	}
+	key, err := kblock.Unwrap(keyBlock)
+	if err != nil {
+		return "", err
+	}
+	defer wipe(key)
+	return tr31.KeyCheckValue(key, kblock.GetHeader().Algorithm)
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_ReencryptEstate(t *testing.T) {
+	s := mockServiceInMock()
+	sm := s.GetSecretManager()
+	sm.WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	sm.WriteSecret("secret/tr31", "target", "DDDDDDDDDDDDDDDDEEEEEEEEEEEEEEEEFFFFFFFFFFFFFFFF")
+	m := NewMachine(mockVaultAuthOne())
+	m.Keys = []KeyReference{{KeyPath: "secret/tr31", KeyName: "kbkp"}}
+	require.NoError(t, s.CreateMachine(m))
+
+	kbpk, _ := hex.DecodeString("AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	other, _ := hex.DecodeString("11111111111111112222222222222222")
+	stored, err := wrapKey(kbpk, "ccccccccccccccccdddddddddddddddd", HeaderParams{
+		VersionId: "B", KeyUsage: "D0", Algorithm: "T", ModeOfUse: "D", KeyVersion: "00", Exportability: "E",
+	}, nil, time.Now())
+	require.NoError(t, err)
+	foreign, err := wrapKey(other, "ccccccccccccccccdddddddddddddddd", HeaderParams{
+		VersionId: "D", KeyUsage: "D0", Algorithm: "A", ModeOfUse: "D", KeyVersion: "00", Exportability: "E",
+	}, nil, time.Now())
+	require.NoError(t, err)
+	sm.WriteSecret("secret/tr31", "pek", stored.KeyBlock)
+	sm.WriteSecret("secret/tr31", "foreign", foreign.KeyBlock)
+	sm.WriteSecret("secret/tr31", "note", "not a key block")
+
+	req := EstateRequest{
+		Key:       KeyReference{KeyPath: "secret/tr31", KeyName: "kbkp"},
+		TargetKey: KeyReference{KeyPath: "secret/tr31", KeyName: "target"},
+		DryRun:    true,
+	}
+	report, err := s.ReencryptEstate(m.InitialKey, req)
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Translated)
+	require.Equal(t, 3, report.Skipped)
+	require.Equal(t, 1, report.Failed)
+	unchanged, _ := sm.ReadSecret("secret/tr31", "pek")
+	require.Equal(t, stored.KeyBlock, unchanged)
+
+	req.DryRun = false
+	report, err = s.ReencryptEstate(m.InitialKey, req)
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Translated)
+	var kcv string
+	for _, entry := range report.Entries {
+		if entry.Name == "pek" {
+			require.Equal(t, ESTATE_TRANSLATED, entry.Status)
+			kcv = entry.KCV
+		}
+		if entry.Name == "foreign" {
+			require.Equal(t, ESTATE_FAILED, entry.Status)
+		}
+	}
+	require.Len(t, kcv, 6)
+
+	translated, _ := sm.ReadSecret("secret/tr31", "pek")
+	require.Equal(t, "D", translated[:1])
+	data, err := s.DecryptData(mockVaultAuthOne().VaultAddress, mockVaultAuthOne().VaultToken, "secret/tr31", "target", translated, 10)
+	require.NoError(t, err)
+	require.Equal(t, "ccccccccccccccccdddddddddddddddd", data)
+
+	// Running again skips the key blocks already translated
+	report, err = s.ReencryptEstate(m.InitialKey, req)
+	require.NoError(t, err)
+	require.Equal(t, 0, report.Translated)
+	require.Equal(t, 4, report.Skipped)
+	for _, entry := range report.Entries {
+		if entry.Name == "pek" {
+			require.Equal(t, kcv, entry.KCV)
+		}
+	}
+}
+
+func TestService_ReencryptEstate_Errors(t *testing.T) {
+	s := mockServiceInMock()
+	_, err := s.ReencryptEstate("missing", EstateRequest{Key: KeyReference{KeyPath: "secret/tr31", KeyName: "kbkp"}})
+	require.Equal(t, errInvalidKeyPath, err)
+
+	req := EstateRequest{
+		Key:       KeyReference{KeyPath: "secret/tr31", KeyName: "kbkp"},
+		TargetKey: KeyReference{KeyPath: "secret/tr31", KeyName: "target"},
+	}
+	_, err = s.ReencryptEstate("missing", req)
+	require.Equal(t, ErrNotFound, err)
+
+	m := NewMachine(mockVaultAuthOne())
+	m.AllowedVersions = []string{"B"}
+	require.NoError(t, s.CreateMachine(m))
+	_, err = s.ReencryptEstate(m.InitialKey, req)
+	require.Equal(t, ErrVersionNotAllowed, err)
+}
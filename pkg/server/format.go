@@ -0,0 +1,51 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// DataFormat is the encoding of the clear keys returned by /decrypt_data
+type DataFormat string
+
+var (
+	// DATA_FORMAT_HEX returns keys as hexchars, the default
+	DATA_FORMAT_HEX DataFormat = "hex"
+	// DATA_FORMAT_BASE64 returns keys as standard base64
+	DATA_FORMAT_BASE64 DataFormat = "base64"
+	// DATA_FORMAT_BINARY returns the raw key bytes as an application/octet-stream download
+	DATA_FORMAT_BINARY DataFormat = "binary"
+)
+
+// binaryContentType is the media type of DATA_FORMAT_BINARY responses
+const binaryContentType = "application/octet-stream"
+
+// ParseDataFormat returns the data format named s, DATA_FORMAT_HEX when s is empty
+func ParseDataFormat(s string) (DataFormat, error) {
+	switch format := DataFormat(strings.ToLower(strings.TrimSpace(s))); format {
+	case "":
+		return DATA_FORMAT_HEX, nil
+	case DATA_FORMAT_HEX, DATA_FORMAT_BASE64, DATA_FORMAT_BINARY:
+		return format, nil
+	}
+	return "", fmt.Errorf("%w Format must be hex, base64 or binary.", errMalformedField)
+}
+
+// encodeHex re-encodes hexchars data in the format, binary data is returned
+// as bytes for the caller to write
+func (f DataFormat) encodeHex(data string) (string, []byte, error) {
+	if f == DATA_FORMAT_HEX || f == "" {
+		return data, nil, nil
+	}
+	raw, err := hex.DecodeString(data)
+	if err != nil {
+		return "", nil, err
+	}
+	if f == DATA_FORMAT_BINARY {
+		return "", raw, nil
+	}
+	defer wipe(raw)
+	return base64.StdEncoding.EncodeToString(raw), nil, nil
+}
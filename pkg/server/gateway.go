@@ -0,0 +1,437 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	moovhttp "github.com/moov-io/base/http"
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+// IdempotencyKeyHeader identifies a POST request, retries with the same key
+// are answered with the response of the first request
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayedHeader is set on responses replayed for an idempotency key
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// maxIdempotencyKeyLength keeps keys to the size of a UUID or a hash, with room to spare
+const maxIdempotencyKeyLength = 255
+
+var (
+	errIdempotencyKeyInUse  = errors.New("a request with the idempotency key is in progress")
+	errIdempotencyKeyReused = errors.New("the idempotency key was used for a different request")
+)
+
+// WithAllowedOrigins only answers cross-origin requests from the origins, such
+// as https://admin.example.com, "*" allows any origin. Without it the origin of
+// every request is allowed.
+func WithAllowedOrigins(origins ...string) HandlerOption {
+	return func(cfg *handlerConfig) {
+		cfg.allowedOrigins = origins
+	}
+}
+
+// WithMaxRequestBodySize rejects request bodies larger than size bytes with a
+// 413, instead of the 1 MiB default
+func WithMaxRequestBodySize(size int64) HandlerOption {
+	return func(cfg *handlerConfig) {
+		cfg.maxRequestBodySize = size
+	}
+}
+
+// WithMaxKeyBlockLength rejects key blocks longer than length characters with
+// a 413, instead of tr31.DefaultMaxKeyBlockLen
+func WithMaxKeyBlockLength(length int) HandlerOption {
+	return func(cfg *handlerConfig) {
+		cfg.maxKeyBlockLength = length
+	}
+}
+
+// WithMaxBatchSize rejects jobs with more items, and inspected files with more
+// key blocks, than size with a 413, instead of 10000
+func WithMaxBatchSize(size int) HandlerOption {
+	return func(cfg *handlerConfig) {
+		cfg.maxBatchSize = size
+	}
+}
+
+// WithGzip compresses responses for clients sending Accept-Encoding: gzip
+func WithGzip() HandlerOption {
+	return func(cfg *handlerConfig) {
+		cfg.gzip = true
+	}
+}
+
+// WithIdempotencyKeys keeps the responses of POST requests sent with an
+// Idempotency-Key header for ttl, so retries by clients and gateways get the
+// response of the first request instead of repeating it. Only routes with side
+// effects whose responses carry no clear keys keep their responses, /decrypt_data
+// and read-only routes such as /tr31/inspect don't.
+func WithIdempotencyKeys(ttl time.Duration) HandlerOption {
+	return func(cfg *handlerConfig) {
+		cfg.idempotencyTTL = ttl
+	}
+}
+
+// allowsOrigin reports whether cross-origin requests from origin are answered
+func (cfg *handlerConfig) allowsOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if len(cfg.allowedOrigins) == 0 {
+		return true
+	}
+	return slices.Contains(cfg.allowedOrigins, "*") || slices.Contains(cfg.allowedOrigins, origin)
+}
+
+// setCORSHeaders sets the Access-Control-Allow-* headers when the origin is allowed
+func (cfg *handlerConfig) setCORSHeaders(w http.ResponseWriter, origin string) {
+	if cfg.allowsOrigin(origin) {
+		moovhttp.SetAccessControlAllowHeaders(w, origin)
+	}
+}
+
+// requestLimits bound the payloads of a request, so hostile requests can't
+// exhaust the memory of the server
+type requestLimits struct {
+	body           int64
+	keyBlockLength int
+	batchSize      int
+}
+
+// withDefaults replaces the unset limits with the defaults
+func (l requestLimits) withDefaults() requestLimits {
+	if l.body <= 0 {
+		l.body = maxRequestBodySize
+	}
+	if l.keyBlockLength <= 0 || l.keyBlockLength > tr31.DefaultMaxKeyBlockLen {
+		l.keyBlockLength = tr31.DefaultMaxKeyBlockLen
+	}
+	if l.batchSize <= 0 {
+		l.batchSize = maxBatchSize
+	}
+	return l
+}
+
+// requestLimitsKey stores the payload limits in the request context
+var requestLimitsKey struct{ name string }
+
+// limitRequests rejects requests announcing a body over the limit and makes
+// the limits available to the decoders reading the body
+func limitRequests(limits requestLimits, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limits.body {
+			encodeError(saveRequestIDIntoContext()(r.Context(), r), errRequestTooLarge, w)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestLimitsKey, limits)))
+	})
+}
+
+// limitsOf returns the payload limits of the request
+func limitsOf(r *http.Request) requestLimits {
+	limits, _ := r.Context().Value(requestLimitsKey).(requestLimits)
+	return limits.withDefaults()
+}
+
+// bodyLimitOf returns the body size limit of the request
+func bodyLimitOf(r *http.Request) int64 {
+	return limitsOf(r).body
+}
+
+// checkKeyBlockLength rejects key blocks over the limit of the request before
+// they are parsed
+func checkKeyBlockLength(r *http.Request, keyBlock string) error {
+	if limit := limitsOf(r).keyBlockLength; len(keyBlock) > limit {
+		return fmt.Errorf("%w Key block length %d exceeds the limit of %d.", errRequestTooLarge, len(keyBlock), limit)
+	}
+	return nil
+}
+
+// checkBatchSize rejects batches of more items than the limit of the request
+func checkBatchSize(r *http.Request, size int) error {
+	if limit := limitsOf(r).batchSize; size > limit {
+		return fmt.Errorf("%w Batch of %d items exceeds the limit of %d.", errRequestTooLarge, size, limit)
+	}
+	return nil
+}
+
+// readBody reads the request body up to the limit of the request
+func readBody(r *http.Request) ([]byte, error) {
+	limit := bodyLimitOf(r)
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, errRequestTooLarge
+	}
+	return body, nil
+}
+
+// gzipResponseWriter compresses the body once the status is known, so responses
+// without a body, like 204, aren't given a gzip stream
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if status != http.StatusNoContent && status != http.StatusNotModified {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Del("Content-Length")
+			w.gz = gzip.NewWriter(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+// Flush writes the compressed bytes so far to the client, for streamed responses
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController set the deadlines of the underlying writer
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *gzipResponseWriter) close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
+
+// gzipResponses compresses the responses of clients accepting gzip
+func gzipResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+		if strings.EqualFold(strings.TrimSpace(name), "gzip") && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsNDJSON reports whether the client asked for a newline delimited JSON
+// stream, with "Accept: application/x-ndjson"
+func acceptsNDJSON(r *http.Request) bool {
+	return accepts(r, ndjsonContentType)
+}
+
+// accepts reports whether the Accept header of the request names mediaType
+func accepts(r *http.Request, mediaType string) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(accepted), ";")
+		if strings.EqualFold(strings.TrimSpace(name), mediaType) && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// idempotentResponse is the response of a request made with an idempotency key,
+// done is false while the first request is in progress
+type idempotentResponse struct {
+	fingerprint [sha256.Size]byte
+	done        bool
+	status      int
+	header      http.Header
+	body        []byte
+	createdAt   time.Time
+}
+
+// idempotencyStore keeps the responses of POST requests by idempotency key
+type idempotencyStore struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	responses map[string]*idempotentResponse
+	lastPrune time.Time
+}
+
+func newIdempotencyStore(ttl time.Duration) *idempotencyStore {
+	return &idempotencyStore{
+		ttl:       ttl,
+		responses: make(map[string]*idempotentResponse),
+		lastPrune: time.Now(),
+	}
+}
+
+// begin returns the response kept for the key, or reserves the key for a new
+// request when there is none
+func (s *idempotencyStore) begin(key string, fingerprint [sha256.Size]byte) (*idempotentResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastPrune) > s.ttl {
+		for k, v := range s.responses {
+			if v.done && now.Sub(v.createdAt) > s.ttl {
+				delete(s.responses, k)
+			}
+		}
+		s.lastPrune = now
+	}
+
+	if found, exists := s.responses[key]; exists && (!found.done || now.Sub(found.createdAt) <= s.ttl) {
+		switch {
+		case found.fingerprint != fingerprint:
+			return nil, errIdempotencyKeyReused
+		case !found.done:
+			return nil, errIdempotencyKeyInUse
+		}
+		return found, nil
+	}
+	s.responses[key] = &idempotentResponse{fingerprint: fingerprint, createdAt: now}
+	return nil, nil
+}
+
+// finish keeps the response of the request, server errors and requests which
+// didn't respond release the key so the request can be retried
+func (s *idempotencyStore) finish(key string, rec *responseRecorder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec.status == 0 || rec.status >= http.StatusInternalServerError {
+		delete(s.responses, key)
+		return
+	}
+	if found, exists := s.responses[key]; exists {
+		found.done = true
+		found.status = rec.status
+		found.header = rec.Header().Clone()
+		// The encoding depends on the client of each request
+		found.header.Del("Content-Encoding")
+		found.header.Del("Vary")
+		found.body = rec.body.Bytes()
+		found.createdAt = time.Now()
+	}
+}
+
+// responseRecorder writes a response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the writer being recorded
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotent keeps the responses of a route for retries with the same
+// Idempotency-Key, see WithIdempotencyKeys. Routes opt in when their responses
+// carry no clear keys, so responses of other routes are never kept.
+func (cfg *handlerConfig) idempotent(next http.Handler) http.Handler {
+	if cfg.idempotency == nil {
+		return next
+	}
+	return idempotentRequests(cfg.idempotency, cfg.principal, next)
+}
+
+// idempotentRequests answers POST requests carrying an idempotency key that was
+// already used with the kept response. A key is scoped to the tenant and the
+// principal of the caller and to its route, so callers never get each other's
+// responses. Reusing a key with a different body is rejected, as is a retry
+// while the first request is still in progress.
+func idempotentRequests(store *idempotencyStore, principal PrincipalFunc, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimSpace(r.Header.Get(IdempotencyKeyHeader))
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := saveRequestIDIntoContext()(r.Context(), r)
+		if len(key) > maxIdempotencyKeyLength {
+			encodeError(ctx, errInvalidIdempotencyKey, w)
+			return
+		}
+		body, err := readBody(r)
+		if err != nil {
+			encodeError(ctx, err, w)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var tenantID string
+		if tenant := tenantFrom(r.Context()); tenant != nil {
+			tenantID = tenant.ID
+		}
+		key = fmt.Sprintf("%q %q %s %s", tenantID, principal(r), r.URL.Path, key)
+		found, err := store.begin(key, sha256.Sum256(body))
+		if err != nil {
+			encodeError(ctx, err, w)
+			return
+		}
+		if found != nil {
+			for name, values := range found.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set(IdempotentReplayedHeader, "true")
+			w.WriteHeader(found.status)
+			w.Write(found.body)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		defer store.finish(key, rec)
+		next.ServeHTTP(rec, r)
+	})
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouting_allowed_origins(t *testing.T) {
+	router := MakeHTTPHandler(mockServiceInMock(), WithAllowedOrigins("https://admin.moov.io"))
+
+	get := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/machines", nil)
+		req.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("https://admin.moov.io")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "https://admin.moov.io", w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = get("https://evil.example.com")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestRouting_max_request_body_size(t *testing.T) {
+	router := MakeHTTPHandler(mockServiceInMock(), WithMaxRequestBodySize(64))
+
+	req := httptest.NewRequest("POST", "/machine", strings.NewReader(`{"VaultAddress":"`+strings.Repeat("a", 64)+`"}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	require.Contains(t, w.Body.String(), ERROR_CODE_REQUEST_TOO_LARGE)
+}
+
+func TestRouting_max_key_block_length_and_batch_size(t *testing.T) {
+	router := MakeHTTPHandler(mockServiceInMock(), WithMaxKeyBlockLength(32), WithMaxBatchSize(2))
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	keyBlock := "D0144D0AE00E0000" + strings.Repeat("0", 128)
+
+	w := send("POST", "/decrypt_data", `{"vaultAddr":"http://localhost:8200","vaultToken":"token","keyPath":"secret/tr31","keyName":"kbpk","keyBlock":"`+keyBlock+`"}`)
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	require.Contains(t, w.Body.String(), ERROR_CODE_REQUEST_TOO_LARGE)
+
+	w = send("POST", "/jobs", `{"Type":"rewrap","KeyPath":"secret/tr31","KeyName":"kbpk","Items":[{"KeyBlock":"`+keyBlock+`"}]}`)
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	w = send("POST", "/jobs", `{"Type":"batch_wrap","KeyPath":"secret/tr31","KeyName":"kbpk","Items":[{},{},{}]}`)
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	require.Contains(t, w.Body.String(), "Batch of 3 items exceeds the limit of 2.")
+
+	w = send("POST", "/tr31/inspect", "A\nB\nC\n")
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	w = send("POST", "/tr31/inspect", keyBlock)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), "Header data length (144) exceeds limit of 32.")
+}
+
+func TestRouting_gzip(t *testing.T) {
+	router := MakeHTTPHandler(mockServiceInMock(), WithGzip())
+
+	req := httptest.NewRequest("GET", "/machines", nil)
+	req.Header.Set("Accept-Encoding", "br, gzip")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	gz, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `"machines"`)
+
+	req = httptest.NewRequest("GET", "/machines", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Empty(t, w.Header().Get("Content-Encoding"))
+	require.Contains(t, w.Body.String(), `"machines"`)
+}
+
+func TestRouting_idempotency_keys(t *testing.T) {
+	router := MakeHTTPHandler(mockServiceInMock(), WithIdempotencyKeys(time.Hour), WithPrincipal(PrincipalFromHeader("X-Principal")))
+
+	send := func(path, principal, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("X-Principal", principal)
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	post := func(key, body string) *httptest.ResponseRecorder {
+		return send("/machine", "pos-gateway", key, body)
+	}
+	body := `{"VaultAddress":"http://localhost:8200","VaultToken":"token"}`
+
+	first := post("create-1", body)
+	require.Equal(t, http.StatusOK, first.Code, first.Body.String())
+	require.Empty(t, first.Header().Get(IdempotentReplayedHeader))
+
+	// The retry is answered with the first response instead of creating the machine again
+	retry := post("create-1", body)
+	require.Equal(t, http.StatusOK, retry.Code)
+	require.Equal(t, "true", retry.Header().Get(IdempotentReplayedHeader))
+	require.Equal(t, first.Body.String(), retry.Body.String())
+
+	w := post("", body)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = post("create-1", `{"VaultAddress":"http://localhost:8201","VaultToken":"token"}`)
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	require.Contains(t, w.Body.String(), ERROR_CODE_IDEMPOTENCY_KEY_USED)
+
+	w = post(strings.Repeat("k", maxIdempotencyKeyLength+1), body)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Keys are scoped to the caller, the machine is created again and conflicts
+	w = send("/machine", "mac-service", "create-1", body)
+	require.Contains(t, w.Body.String(), `"already_exists"`)
+	require.Empty(t, w.Header().Get(IdempotentReplayedHeader))
+
+	// Routes which don't opt in, such as read-only ones, never keep their responses
+	keyBlock := `{"KeyBlock":"A0088M3TC00E000022BD7EC46BBE2A6A73389D1BA6DB63120B386F912839F4679C0523399E4D8D0F1D9A356E"}` // gitleaks:allow
+	for i := 0; i < 2; i++ {
+		w = send("/tr31/inspect", "pos-gateway", "inspect-1", keyBlock)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Empty(t, w.Header().Get(IdempotentReplayedHeader))
+	}
+}
+
+func TestIdempotencyStore(t *testing.T) {
+	store := newIdempotencyStore(time.Hour)
+	fingerprint := [32]byte{1}
+
+	found, err := store.begin("key", fingerprint)
+	require.NoError(t, err)
+	require.Nil(t, found)
+
+	_, err = store.begin("key", fingerprint)
+	require.Equal(t, errIdempotencyKeyInUse, err)
+
+	// Server errors release the key
+	store.finish("key", &responseRecorder{ResponseWriter: httptest.NewRecorder(), status: http.StatusInternalServerError})
+	found, err = store.begin("key", fingerprint)
+	require.NoError(t, err)
+	require.Nil(t, found)
+
+	store.finish("key", &responseRecorder{ResponseWriter: httptest.NewRecorder(), status: http.StatusOK})
+	found, err = store.begin("key", fingerprint)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, found.status)
+}
@@ -3,48 +3,171 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-kit/kit/endpoint"
 	"github.com/gorilla/mux"
 	moovhttp "github.com/moov-io/base/http"
+	"github.com/moov-io/tr31/pkg/charset"
+	"github.com/moov-io/tr31/pkg/tr31"
 )
 
+// maxRequestBodySize limits the bodies accepted by the handlers by default, key
+// blocks and declarations are far smaller
+const maxRequestBodySize int64 = 1 << 20
+
+// maxBatchSize limits the items of a job and the key blocks of an inspected
+// file by default
+const maxBatchSize = 10000
+
 func bindJSON(request *http.Request, params interface{}) (err error) {
-	body, err := io.ReadAll(request.Body)
+	body, err := readBody(request)
+	if errors.Is(err, errRequestTooLarge) {
+		return err
+	}
 	if err != nil {
-		return fmt.Errorf("could not parse json request: %s", err)
+		return fmt.Errorf("%w: %s", errInvalidJSON, err)
 	}
 	err = json.Unmarshal(body, params)
 	if err != nil {
-		return fmt.Errorf("could not parse json request: %s", err)
+		return fmt.Errorf("%w: %s", errInvalidJSON, err)
 	}
 	return
 }
 
+// cleanHex trims the whitespace and newlines around a hex field and makes sure
+// what's left is hexchars, in any case
+func cleanHex(field, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || len(value)%2 != 0 {
+		return "", fmt.Errorf("%w %s must be an even number of hexchars.", errMalformedField, field)
+	}
+	if !charset.IsHex(value) {
+		return "", fmt.Errorf("%w %s must be hexchars.", errMalformedField, field)
+	}
+	return value, nil
+}
+
+// cleanKeyBlock trims the whitespace and newlines around a key block and makes
+// sure what's left is printable ASCII, as TR-31 requires
+func cleanKeyBlock(field, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if !charset.IsPrintable(value) || strings.Contains(value, " ") {
+		return "", fmt.Errorf("%w %s must be printable ASCII.", errMalformedField, field)
+	}
+	return value, nil
+}
+
+// cleanHeader trims the header fields and upper-cases them, header values are
+// upper case ASCII
+func cleanHeader(header HeaderParams) HeaderParams {
+	clean := func(s string) string {
+		return strings.ToUpper(strings.TrimSpace(s))
+	}
+	cleaned := HeaderParams{
+		VersionId:     clean(header.VersionId),
+		KeyUsage:      clean(header.KeyUsage),
+		Algorithm:     clean(header.Algorithm),
+		ModeOfUse:     clean(header.ModeOfUse),
+		KeyVersion:    clean(header.KeyVersion),
+		Exportability: clean(header.Exportability),
+	}
+	// Block IDs are upper case too, block values are case sensitive
+	if len(header.Blocks) > 0 {
+		cleaned.Blocks = make(map[string]string, len(header.Blocks))
+		for id, value := range header.Blocks {
+			cleaned.Blocks[clean(id)] = strings.TrimSpace(value)
+		}
+	}
+	return cleaned
+}
+
 type getMachinesRequest struct {
 	requestID string
+	query     MachineQuery
 }
 
 type getMachinesResponse struct {
-	Machines []*Machine `json:"machines"`
-	Err      string     `json:"error"`
+	Machines []*MachineView `json:"machines"`
+	total    int
 }
 
-func decodeGetMachinesRequest(_ context.Context, request *http.Request) (interface{}, error) {
-	return getMachinesRequest{
+func (r getMachinesResponse) count() int {
+	return r.total
+}
+
+func decodeGetMachinesRequest(ctx context.Context, request *http.Request) (interface{}, error) {
+	req := getMachinesRequest{
 		requestID: moovhttp.GetRequestID(request),
-	}, nil
+	}
+
+	params := request.URL.Query()
+	var err error
+	if v := params.Get("limit"); v != "" {
+		if req.query.Limit, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("%w limit must be a number.", errMalformedField)
+		}
+	}
+	if v := params.Get("offset"); v != "" {
+		if req.query.Offset, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("%w offset must be a number.", errMalformedField)
+		}
+	}
+	if v := params.Get("createdAfter"); v != "" {
+		if req.query.CreatedAfter, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, fmt.Errorf("%w createdAfter must be an RFC 3339 time.", errMalformedField)
+		}
+	}
+	if v := params.Get("createdBefore"); v != "" {
+		if req.query.CreatedBefore, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, fmt.Errorf("%w createdBefore must be an RFC 3339 time.", errMalformedField)
+		}
+	}
+	for _, tag := range params["tag"] {
+		k, v, found := strings.Cut(tag, ":")
+		if !found || k == "" {
+			return nil, fmt.Errorf("%w tag must be key:value.", errMalformedField)
+		}
+		if req.query.Tags == nil {
+			req.query.Tags = make(map[string]string)
+		}
+		req.query.Tags[k] = v
+	}
+	req.query.Backend = RunningMode(strings.ToUpper(params.Get("backend")))
+	req.query.Sort = params.Get("sort")
+	// Tenants only list their own machines
+	req.query.Tenant = scopedTenant(ctx)
+	if err := req.query.Validate(); err != nil {
+		return nil, err
+	}
+	return req, nil
 }
 
 func getMachinesEndpoint(s Service) endpoint.Endpoint {
-	return func(_ context.Context, _ interface{}) (interface{}, error) {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(getMachinesRequest)
+		if !ok {
+			return getMachinesResponse{}, ErrFoundABug
+		}
+
+		machines, total, err := s.FindMachines(req.query)
+		if err != nil {
+			return getMachinesResponse{}, err
+		}
+		views := make([]*MachineView, 0, len(machines))
+		for _, m := range machines {
+			views = append(views, m.View())
+		}
 		return getMachinesResponse{
-			Machines: s.GetMachines(),
-			Err:      "",
+			Machines: views,
+			total:    total,
 		}, nil
 	}
 }
@@ -55,8 +178,7 @@ type findMachineRequest struct {
 }
 
 type findMachineResponse struct {
-	Machine *Machine `json:"machine"`
-	Err     string   `json:"error"`
+	Machine *MachineView `json:"machine"`
 }
 
 func decodeFindMachineRequest(_ context.Context, request *http.Request) (interface{}, error) {
@@ -71,43 +193,157 @@ func findMachineEndpoint(s Service) endpoint.Endpoint {
 	return func(_ context.Context, request interface{}) (interface{}, error) {
 		req, ok := request.(findMachineRequest)
 		if req.ik == "" {
-			return findMachineResponse{Err: errInvalidRequestId.Error()}, errInvalidRequestId
+			return findMachineResponse{}, errInvalidRequestId
 		}
 		if !ok {
-			return findMachineResponse{Err: ErrFoundABug.Error()}, ErrFoundABug
+			return findMachineResponse{}, ErrFoundABug
 		}
 
 		resp := findMachineResponse{}
 		m, err := s.GetMachine(req.ik)
 		if err != nil {
-			resp.Err = err.Error()
 			return resp, err
 		}
 
-		resp.Machine = m
+		resp.Machine = m.View()
 		return resp, nil
 	}
 }
 
-type createMachineRequest struct {
-	vaultAuth Vault
+type updateMachineRequest struct {
 	requestID string
+	ik        string
+	tags      map[string]*string
+	// setHeaderTemplate is set when the body has a HeaderTemplate, null removes it
+	setHeaderTemplate bool
+	headerTemplate    *HeaderParams
+}
+
+func decodeUpdateMachineRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	req := updateMachineRequest{
+		requestID: moovhttp.GetRequestID(request),
+		ik:        mux.Vars(request)["ik"],
+	}
+
+	type requestParam struct {
+		Tags           map[string]*string
+		HeaderTemplate json.RawMessage
+	}
+
+	reqParams := requestParam{}
+	if err := bindJSON(request, &reqParams); err != nil {
+		return nil, err
+	}
+	req.tags = reqParams.Tags
+	if len(reqParams.HeaderTemplate) > 0 {
+		req.setHeaderTemplate = true
+		if err := json.Unmarshal(reqParams.HeaderTemplate, &req.headerTemplate); err != nil {
+			return nil, fmt.Errorf("%w HeaderTemplate must be header params.", errMalformedField)
+		}
+		if req.headerTemplate != nil {
+			template := cleanHeader(*req.headerTemplate)
+			req.headerTemplate = &template
+		}
+	}
+	return req, nil
+}
+
+func updateMachineEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(updateMachineRequest)
+		if !ok {
+			return findMachineResponse{}, ErrFoundABug
+		}
+
+		resp := findMachineResponse{}
+		// Validate the template first, so an invalid one leaves the tags unchanged
+		if err := validateHeaderTemplate(req.headerTemplate); err != nil {
+			return resp, err
+		}
+		m, err := s.GetMachine(req.ik)
+		if err != nil {
+			return resp, err
+		}
+		if req.tags != nil {
+			if m, err = s.UpdateMachineTags(req.ik, req.tags); err != nil {
+				return resp, err
+			}
+		}
+		if req.setHeaderTemplate {
+			if m, err = s.UpdateMachineHeaderTemplate(req.ik, req.headerTemplate); err != nil {
+				return resp, err
+			}
+		}
+
+		resp.Machine = m.View()
+		return resp, nil
+	}
+}
+
+type createMachineRequest struct {
+	vaultAuth       Vault
+	allowedVersions []string
+	keys            []KeyReference
+	tags            map[string]string
+	backend         RunningMode
+	neverClear      bool
+	headerTemplate  *HeaderParams
+	kbpk            *KBPKBootstrap
+	tenant          string
+	requestID       string
 }
 
 type createMachineResponse struct {
-	IK      string   `json:"ik"`
-	Machine *Machine `json:"machine"`
-	Err     string   `json:"error"`
+	IK      string       `json:"ik"`
+	Machine *MachineView `json:"machine"`
+	// KCV is the key check value of the KBPK generated with the machine
+	KCV string `json:"kcv,omitempty"`
 }
 
-func decodeCreateMachineRequest(_ context.Context, request *http.Request) (interface{}, error) {
+func decodeCreateMachineRequest(ctx context.Context, request *http.Request) (interface{}, error) {
 	req := createMachineRequest{
 		requestID: moovhttp.GetRequestID(request),
 	}
 
-	if err := bindJSON(request, &req.vaultAuth); err != nil {
+	type requestParam struct {
+		VaultAddress    string
+		VaultToken      string
+		AllowedVersions []string
+		Keys            []KeyReference
+		Tags            map[string]string
+		Backend         RunningMode
+		NeverClear      bool
+		HeaderTemplate  *HeaderParams
+		KBPK            *KBPKBootstrap
+	}
+
+	reqParams := requestParam{}
+	if err := bindJSON(request, &reqParams); err != nil {
 		return nil, err
 	}
+	req.vaultAuth = Vault{
+		VaultAddress: reqParams.VaultAddress,
+		VaultToken:   reqParams.VaultToken,
+	}
+	req.allowedVersions = reqParams.AllowedVersions
+	req.keys = reqParams.Keys
+	req.tags = reqParams.Tags
+	req.backend = RunningMode(strings.ToUpper(strings.TrimSpace(string(reqParams.Backend))))
+	req.neverClear = reqParams.NeverClear
+	if reqParams.HeaderTemplate != nil {
+		template := cleanHeader(*reqParams.HeaderTemplate)
+		req.headerTemplate = &template
+	}
+	if tenant := tenantFrom(ctx); tenant != nil {
+		req.tenant = tenant.ID
+	}
+	if reqParams.KBPK != nil {
+		req.kbpk = &KBPKBootstrap{
+			KeyPath: strings.TrimSpace(reqParams.KBPK.KeyPath),
+			KeyName: strings.TrimSpace(reqParams.KBPK.KeyName),
+			Type:    KBPKType(strings.TrimSpace(string(reqParams.KBPK.Type))),
+		}
+	}
 
 	return req, nil
 }
@@ -116,25 +352,36 @@ func createMachineEndpoint(s Service) endpoint.Endpoint {
 	return func(_ context.Context, request interface{}) (interface{}, error) {
 		req, ok := request.(createMachineRequest)
 		if req.vaultAuth.VaultAddress == "" {
-			return createMachineResponse{Err: errInvalidVaultAddress.Error()}, errInvalidVaultAddress
+			return createMachineResponse{}, errInvalidVaultAddress
 		}
 		if req.vaultAuth.VaultToken == "" {
-			return createMachineResponse{Err: errInvalidVaultToken.Error()}, errInvalidVaultToken
+			return createMachineResponse{}, errInvalidVaultToken
 		}
 		if !ok {
-			return createMachineResponse{Err: ErrFoundABug.Error()}, ErrFoundABug
+			return createMachineResponse{}, ErrFoundABug
 		}
 
 		resp := createMachineResponse{}
 
 		m := NewMachine(req.vaultAuth)
-		err := s.CreateMachine(m)
-		if err != nil {
-			resp.Err = err.Error()
+		m.AllowedVersions = req.allowedVersions
+		m.Keys = req.keys
+		m.Tags = req.tags
+		m.Backend = req.backend
+		m.NeverClear = req.neverClear
+		m.HeaderTemplate = req.headerTemplate
+		m.Tenant = req.tenant
+		if req.kbpk != nil {
+			kcv, err := s.CreateMachineWithKBPK(m, *req.kbpk)
+			if err != nil {
+				return resp, err
+			}
+			resp.KCV = kcv
+		} else if err := s.CreateMachine(m); err != nil {
 			return resp, err
 		}
 
-		resp.Machine = m
+		resp.Machine = m.View()
 		resp.IK = m.InitialKey
 
 		return resp, nil
@@ -142,19 +389,26 @@ func createMachineEndpoint(s Service) endpoint.Endpoint {
 }
 
 type decryptDataRequest struct {
-	requestID  string
-	ik         string
-	vaultAddr  string
-	vaultToken string
-	keyPath    string
-	keyName    string
-	keyBlock   string
-	timeout    time.Duration
+	requestID      string
+	ik             string
+	vaultAddr      string
+	vaultToken     string
+	keyPath        string
+	keyName        string
+	fallbackKeys   []KeyReference
+	keyBlock       string
+	transportKeyID string
+	importTo       string
+	importName     string
+	format         DataFormat
+	timeout        time.Duration
 }
 
 type decryptDataResponse struct {
-	Data string `json:"data"`
-	Err  string `json:"error"`
+	Data          string        `json:"data,omitempty"`
+	EncryptedData string        `json:"encryptedData,omitempty"`
+	Handle        string        `json:"handle,omitempty"`
+	Key           *KeyReference `json:"key,omitempty"`
 }
 
 func decodeDecryptDataRequest(_ context.Context, request *http.Request) (interface{}, error) {
@@ -164,52 +418,139 @@ func decodeDecryptDataRequest(_ context.Context, request *http.Request) (interfa
 	}
 
 	type requestParam struct {
-		VaultAddr  string
-		VaultToken string
-		KeyPath    string
-		KeyName    string
-		KeyBlock   string
+		VaultAddr      string
+		VaultToken     string
+		KeyPath        string
+		KeyName        string
+		FallbackKeys   []KeyReference
+		KeyBlock       string
+		TransportKeyID string
+		ImportTo       string
+		ImportName     string
+		Format         string
 	}
 
 	reqParams := requestParam{}
 	if err := bindJSON(request, &reqParams); err != nil {
 		return req, err
 	}
+	format, err := ParseDataFormat(reqParams.Format)
+	if err != nil {
+		return req, err
+	}
+	// Download tooling asks for the raw key with the Accept header instead
+	if reqParams.Format == "" && accepts(request, binaryContentType) {
+		format = DATA_FORMAT_BINARY
+	}
+	keyBlock, err := cleanKeyBlock("KeyBlock", reqParams.KeyBlock)
+	if err != nil {
+		return req, err
+	}
+	if err := checkKeyBlockLength(request, keyBlock); err != nil {
+		return req, err
+	}
 	req.vaultAddr = reqParams.VaultAddr
 	req.vaultToken = reqParams.VaultToken
-	req.keyPath = reqParams.KeyPath
-	req.keyName = reqParams.KeyName
-	req.keyBlock = reqParams.KeyBlock
+	req.keyPath = strings.TrimSpace(reqParams.KeyPath)
+	req.keyName = strings.TrimSpace(reqParams.KeyName)
+	req.fallbackKeys = reqParams.FallbackKeys
+	req.keyBlock = keyBlock
+	req.transportKeyID = strings.TrimSpace(reqParams.TransportKeyID)
+	req.importTo = strings.TrimSpace(reqParams.ImportTo)
+	req.importName = strings.TrimSpace(reqParams.ImportName)
+	if req.transportKeyID != "" && req.importTo != "" {
+		return req, fmt.Errorf("%w TransportKeyID and ImportTo can't both be set.", errMalformedField)
+	}
+	req.format = format
+	if (req.transportKeyID != "" || req.importTo != "") && format != DATA_FORMAT_HEX {
+		return req, fmt.Errorf("%w Format only applies to clear keys, it can't be set with TransportKeyID or ImportTo.", errMalformedField)
+	}
 	return req, nil
 }
 
 func decryptDataEndpoint(s Service) endpoint.Endpoint {
-	return func(_ context.Context, request interface{}) (interface{}, error) {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req, ok := request.(decryptDataRequest)
 		if !ok {
-			return decryptDataResponse{Err: ErrFoundABug.Error()}, ErrFoundABug
+			return decryptDataResponse{}, ErrFoundABug
 		}
 
 		if req.keyPath == "" {
-			return decryptDataResponse{Err: errInvalidKeyPath.Error()}, errInvalidKeyPath
+			return decryptDataResponse{}, errInvalidKeyPath
 		}
 		if req.keyName == "" {
-			return decryptDataResponse{Err: errInvalidKeyName.Error()}, errInvalidKeyName
+			return decryptDataResponse{}, errInvalidKeyName
 		}
 		if req.keyBlock == "" {
-			return decryptDataResponse{Err: errInvalidKeyBlock.Error()}, errInvalidKeyBlock
+			return decryptDataResponse{}, errInvalidKeyBlock
 		}
 
 		resp := decryptDataResponse{}
-		decrypted, err := s.DecryptData(req.vaultAddr, req.vaultToken, req.keyPath, req.keyName, req.keyBlock, req.timeout)
+		principal := AsPrincipal(principalFrom(ctx))
+		if req.importTo != "" {
+			keys := append([]KeyReference{{KeyPath: req.keyPath, KeyName: req.keyName}}, req.fallbackKeys...)
+			handle, key, err := s.DecryptDataAndImport(req.vaultAddr, req.vaultToken, keys, req.keyBlock, req.importTo, req.importName, req.timeout, principal)
+			if err != nil {
+				return resp, err
+			}
+			resp.Handle = handle
+			if len(req.fallbackKeys) > 0 {
+				resp.Key = &key
+			}
+			return resp, nil
+		}
+		if req.transportKeyID != "" {
+			keys := append([]KeyReference{{KeyPath: req.keyPath, KeyName: req.keyName}}, req.fallbackKeys...)
+			encrypted, key, err := s.DecryptDataUnderTransportKey(req.vaultAddr, req.vaultToken, keys, req.keyBlock, req.transportKeyID, req.timeout, principal)
+			if err != nil {
+				return resp, err
+			}
+			resp.EncryptedData = encrypted
+			if len(req.fallbackKeys) > 0 {
+				resp.Key = &key
+			}
+			return resp, nil
+		}
+		if len(req.fallbackKeys) > 0 {
+			keys := append([]KeyReference{{KeyPath: req.keyPath, KeyName: req.keyName}}, req.fallbackKeys...)
+			decrypted, key, err := s.DecryptDataWithFallback(req.vaultAddr, req.vaultToken, keys, req.keyBlock, req.timeout, principal)
+			if err != nil {
+				return resp, err
+			}
+			resp.Data = decrypted
+			resp.Key = &key
+			return req.formatted(resp)
+		}
+
+		decrypted, err := s.DecryptData(req.vaultAddr, req.vaultToken, req.keyPath, req.keyName, req.keyBlock, req.timeout, principal)
 		if err != nil {
-			resp.Err = err.Error()
 			return resp, err
 		}
 
 		resp.Data = decrypted
+		return req.formatted(resp)
+	}
+}
+
+// formatted encodes the clear key of a response in the format of the request.
+// Binary responses carry the key reporting which KBPK unwrapped the key block
+// in the X-Key-Path and X-Key-Name headers.
+func (req decryptDataRequest) formatted(resp decryptDataResponse) (interface{}, error) {
+	encoded, raw, err := req.format.encodeHex(resp.Data)
+	if err != nil {
+		return decryptDataResponse{}, err
+	}
+	if req.format != DATA_FORMAT_BINARY {
+		resp.Data = encoded
 		return resp, nil
 	}
+	binary := binaryResponse{data: raw, filename: req.keyName + ".bin", header: http.Header{}}
+	if resp.Key != nil {
+		binary.header.Set("X-Key-Path", resp.Key.KeyPath)
+		binary.header.Set("X-Key-Name", resp.Key.KeyName)
+		binary.filename = resp.Key.KeyName + ".bin"
+	}
+	return binary, nil
 }
 
 type encryptDataRequest struct {
@@ -225,7 +566,10 @@ type encryptDataRequest struct {
 }
 type encryptDataResponse struct {
 	Data string `json:"data"`
-	Err  error  `json:"error"`
+	// KCV and Header describe the wrapped key and the header it was wrapped
+	// under, blocks added by the block policy included
+	KCV    string        `json:"kcv,omitempty"`
+	Header *HeaderParams `json:"header,omitempty"`
 }
 
 func decodeEncryptDataRequest(_ context.Context, request *http.Request) (interface{}, error) {
@@ -246,13 +590,17 @@ func decodeEncryptDataRequest(_ context.Context, request *http.Request) (interfa
 	if err := bindJSON(request, &reqParams); err != nil {
 		return nil, err
 	}
+	encryptKey, err := cleanHex("EncryptKey", reqParams.EncryptKey)
+	if err != nil {
+		return nil, err
+	}
 
 	req.vaultAddr = reqParams.VaultAddr
 	req.vaultToken = reqParams.VaultToken
-	req.keyPath = reqParams.KeyPath
-	req.keyName = reqParams.KeyName
-	req.encryptKey = reqParams.EncryptKey
-	req.header = reqParams.Header
+	req.keyPath = strings.TrimSpace(reqParams.KeyPath)
+	req.keyName = strings.TrimSpace(reqParams.KeyName)
+	req.encryptKey = encryptKey
+	req.header = cleanHeader(reqParams.Header)
 	req.timeout = reqParams.Timeout
 	return req, nil
 }
@@ -261,17 +609,1500 @@ func encryptDataEndpoint(s Service) endpoint.Endpoint {
 	return func(_ context.Context, request interface{}) (interface{}, error) {
 		req, ok := request.(encryptDataRequest)
 		if !ok {
-			return encryptDataResponse{Err: ErrFoundABug}, ErrFoundABug
+			return encryptDataResponse{}, ErrFoundABug
 		}
 
 		resp := encryptDataResponse{}
-		encrypted, err := s.EncryptData(req.vaultAddr, req.vaultToken, req.keyPath, req.keyName, req.encryptKey, req.header, req.timeout)
+		result, err := s.EncryptDataWithResult(req.vaultAddr, req.vaultToken, req.keyPath, req.keyName, req.encryptKey, req.header, req.timeout)
 		if err != nil {
-			resp.Err = err
-			return resp, nil
+			return resp, err
+		}
+
+		resp.Data = result.KeyBlock
+		resp.KCV = result.KCV
+		resp.Header = &result.Header
+		return resp, nil
+	}
+}
+
+type createJobRequest struct {
+	requestID string
+	job       JobRequest
+}
+
+type jobResponse struct {
+	Job *Job `json:"job"`
+}
+
+func decodeCreateJobRequest(ctx context.Context, request *http.Request) (interface{}, error) {
+	req := createJobRequest{
+		requestID: moovhttp.GetRequestID(request),
+	}
+	if err := bindJSON(request, &req.job); err != nil {
+		return nil, err
+	}
+	if tenant := tenantFrom(ctx); tenant != nil {
+		req.job.Tenant = tenant.ID
+	}
+	req.job.Principal = principalFrom(ctx)
+	if err := checkBatchSize(request, len(req.job.Items)); err != nil {
+		return nil, err
+	}
+	for _, item := range req.job.Items {
+		if err := checkKeyBlockLength(request, item.KeyBlock); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+func createJobEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(createJobRequest)
+		if !ok {
+			return jobResponse{}, ErrFoundABug
+		}
+
+		resp := jobResponse{}
+		job, err := s.CreateJob(req.job)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.Job = job
+		return resp, nil
+	}
+}
+
+type jobRequest struct {
+	requestID string
+	id        string
+	// stream is set when the client accepts newline delimited JSON
+	stream bool
+}
+
+func decodeJobRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	return jobRequest{
+		requestID: moovhttp.GetRequestID(request),
+		id:        mux.Vars(request)["id"],
+		stream:    acceptsNDJSON(request),
+	}, nil
+}
+
+func getJobEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(jobRequest)
+		if !ok {
+			return jobResponse{}, ErrFoundABug
+		}
+
+		resp := jobResponse{}
+		job, err := s.GetJob(req.id)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.Job = job
+		return resp, nil
+	}
+}
+
+func cancelJobEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(jobRequest)
+		if !ok {
+			return jobResponse{}, ErrFoundABug
+		}
+
+		resp := jobResponse{}
+		if err := s.CancelJob(req.id); err != nil {
+			return resp, err
+		}
+		job, err := s.GetJob(req.id)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.Job = job
+		return resp, nil
+	}
+}
+
+type jobResultsResponse struct {
+	Results []JobResult `json:"results"`
+}
+
+func getJobResultsEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(jobRequest)
+		if !ok {
+			return jobResultsResponse{}, ErrFoundABug
+		}
+
+		if req.stream {
+			return ndjsonResponse{stream: func(emit func(interface{}) error) error {
+				return s.StreamJobResults(req.id, func(result JobResult) error {
+					return emit(result)
+				})
+			}}, nil
+		}
+
+		resp := jobResultsResponse{}
+		results, err := s.GetJobResults(req.id)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.Results = results
+		return resp, nil
+	}
+}
+
+type applyDeclarationRequest struct {
+	requestID   string
+	declaration *Declaration
+}
+
+type applyDeclarationResponse struct {
+	Result *ApplyResult `json:"result"`
+}
+
+func decodeApplyDeclarationRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	req := applyDeclarationRequest{
+		requestID: moovhttp.GetRequestID(request),
+	}
+	body, err := readBody(request)
+	if errors.Is(err, errRequestTooLarge) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read declaration: %s", err)
+	}
+	req.declaration, err = ParseDeclaration(body)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func applyDeclarationEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(applyDeclarationRequest)
+		if !ok {
+			return applyDeclarationResponse{}, ErrFoundABug
+		}
+
+		resp := applyDeclarationResponse{}
+		result, err := s.Apply(req.declaration)
+		if err != nil {
+			return resp, err
 		}
 
-		resp.Data = encrypted
+		resp.Result = result
 		return resp, nil
 	}
 }
+
+type provisionTerminalRequest struct {
+	requestID  string
+	ik         string
+	keyUsage   string
+	terminalID string
+}
+
+type terminalResponse struct {
+	Terminal *Terminal `json:"terminal"`
+}
+
+func decodeProvisionTerminalRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	req := provisionTerminalRequest{
+		requestID: moovhttp.GetRequestID(request),
+		ik:        mux.Vars(request)["ik"],
+	}
+
+	type requestParam struct {
+		KeyUsage   string
+		TerminalID string
+	}
+
+	reqParams := requestParam{}
+	if err := bindJSON(request, &reqParams); err != nil {
+		return nil, err
+	}
+	req.keyUsage = reqParams.KeyUsage
+	req.terminalID = reqParams.TerminalID
+	return req, nil
+}
+
+func provisionTerminalEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(provisionTerminalRequest)
+		if !ok {
+			return terminalResponse{}, ErrFoundABug
+		}
+
+		resp := terminalResponse{}
+		t, err := s.ProvisionTerminal(req.ik, req.keyUsage, req.terminalID)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.Terminal = t
+		return resp, nil
+	}
+}
+
+type getTerminalRequest struct {
+	requestID  string
+	ik         string
+	terminalID string
+}
+
+func decodeGetTerminalRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	return getTerminalRequest{
+		requestID:  moovhttp.GetRequestID(request),
+		ik:         mux.Vars(request)["ik"],
+		terminalID: mux.Vars(request)["terminalID"],
+	}, nil
+}
+
+func getTerminalEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(getTerminalRequest)
+		if !ok {
+			return terminalResponse{}, ErrFoundABug
+		}
+
+		resp := terminalResponse{}
+		t, err := s.GetTerminal(req.ik, req.terminalID)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.Terminal = t
+		return resp, nil
+	}
+}
+
+type registerTransportKeyRequest struct {
+	requestID string
+	ik        string
+	publicKey string
+}
+
+type transportKeyResponse struct {
+	TransportKey *TransportKey `json:"transportKey"`
+}
+
+func decodeRegisterTransportKeyRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	req := registerTransportKeyRequest{
+		requestID: moovhttp.GetRequestID(request),
+		ik:        mux.Vars(request)["ik"],
+	}
+
+	type requestParam struct {
+		PublicKey string
+	}
+
+	reqParams := requestParam{}
+	if err := bindJSON(request, &reqParams); err != nil {
+		return nil, err
+	}
+	req.publicKey = reqParams.PublicKey
+	return req, nil
+}
+
+func registerTransportKeyEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(registerTransportKeyRequest)
+		if !ok {
+			return transportKeyResponse{}, ErrFoundABug
+		}
+
+		resp := transportKeyResponse{}
+		tk, err := s.RegisterTransportKey(req.ik, req.publicKey)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.TransportKey = tk
+		return resp, nil
+	}
+}
+
+type getTransportKeyRequest struct {
+	requestID string
+	ik        string
+	keyID     string
+}
+
+func decodeGetTransportKeyRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	return getTransportKeyRequest{
+		requestID: moovhttp.GetRequestID(request),
+		ik:        mux.Vars(request)["ik"],
+		keyID:     mux.Vars(request)["keyID"],
+	}, nil
+}
+
+func getTransportKeyEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(getTransportKeyRequest)
+		if !ok {
+			return transportKeyResponse{}, ErrFoundABug
+		}
+
+		resp := transportKeyResponse{}
+		tk, err := s.GetTransportKey(req.ik, req.keyID)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.TransportKey = tk
+		return resp, nil
+	}
+}
+
+type createPartnerRequest struct {
+	requestID string
+	ik        string
+	partner   *Partner
+}
+
+type partnerResponse struct {
+	Partner *Partner `json:"partner"`
+}
+
+type partnersResponse struct {
+	Partners []*Partner `json:"partners"`
+}
+
+func decodeCreatePartnerRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	req := createPartnerRequest{
+		requestID: moovhttp.GetRequestID(request),
+		ik:        mux.Vars(request)["ik"],
+	}
+
+	type requestParam struct {
+		ID              string
+		Name            string
+		Key             KeyReference
+		AllowedVersions []string
+		AllowedUsages   []string
+		Contact         PartnerContact
+		Webhooks        []string
+	}
+
+	reqParams := requestParam{}
+	if err := bindJSON(request, &reqParams); err != nil {
+		return nil, err
+	}
+	req.partner = &Partner{
+		ID:              strings.TrimSpace(reqParams.ID),
+		Name:            reqParams.Name,
+		Key:             reqParams.Key,
+		AllowedVersions: reqParams.AllowedVersions,
+		AllowedUsages:   reqParams.AllowedUsages,
+		Contact:         reqParams.Contact,
+		Webhooks:        reqParams.Webhooks,
+	}
+	return req, nil
+}
+
+func createPartnerEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(createPartnerRequest)
+		if !ok {
+			return partnerResponse{}, ErrFoundABug
+		}
+
+		resp := partnerResponse{}
+		if err := s.CreatePartner(req.ik, req.partner); err != nil {
+			return resp, err
+		}
+
+		resp.Partner = req.partner
+		return resp, nil
+	}
+}
+
+type partnerRequest struct {
+	requestID string
+	ik        string
+	partnerID string
+}
+
+func decodePartnerRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	return partnerRequest{
+		requestID: moovhttp.GetRequestID(request),
+		ik:        mux.Vars(request)["ik"],
+		partnerID: mux.Vars(request)["partnerID"],
+	}, nil
+}
+
+func getPartnerEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(partnerRequest)
+		if !ok {
+			return partnerResponse{}, ErrFoundABug
+		}
+
+		resp := partnerResponse{}
+		p, err := s.GetPartner(req.ik, req.partnerID)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.Partner = p
+		return resp, nil
+	}
+}
+
+func getPartnersEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(partnerRequest)
+		if !ok {
+			return partnersResponse{}, ErrFoundABug
+		}
+
+		resp := partnersResponse{}
+		partners, err := s.GetPartners(req.ik)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.Partners = partners
+		return resp, nil
+	}
+}
+
+func deletePartnerEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(partnerRequest)
+		if !ok {
+			return partnerResponse{}, ErrFoundABug
+		}
+
+		resp := partnerResponse{}
+		p, err := s.GetPartner(req.ik, req.partnerID)
+		if err != nil {
+			return resp, err
+		}
+		if err := s.DeletePartner(req.ik, req.partnerID); err != nil {
+			return resp, err
+		}
+
+		resp.Partner = p
+		return resp, nil
+	}
+}
+
+type wrapForPartnerRequest struct {
+	requestID  string
+	ik         string
+	partnerID  string
+	encryptKey string
+	header     HeaderParams
+	timeout    time.Duration
+}
+
+func decodeWrapForPartnerRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	req := wrapForPartnerRequest{
+		requestID: moovhttp.GetRequestID(request),
+		ik:        mux.Vars(request)["ik"],
+		partnerID: mux.Vars(request)["partnerID"],
+	}
+
+	type requestParam struct {
+		EncryptKey string
+		Header     HeaderParams
+		Timeout    time.Duration
+	}
+
+	reqParams := requestParam{}
+	if err := bindJSON(request, &reqParams); err != nil {
+		return nil, err
+	}
+	encryptKey, err := cleanHex("EncryptKey", reqParams.EncryptKey)
+	if err != nil {
+		return nil, err
+	}
+	req.encryptKey = encryptKey
+	req.header = cleanHeader(reqParams.Header)
+	req.timeout = reqParams.Timeout
+	return req, nil
+}
+
+func wrapForPartnerEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(wrapForPartnerRequest)
+		if !ok {
+			return encryptDataResponse{}, ErrFoundABug
+		}
+
+		resp := encryptDataResponse{}
+		result, err := s.WrapForPartner(req.ik, req.partnerID, req.encryptKey, req.header, req.timeout)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.Data = result.KeyBlock
+		resp.KCV = result.KCV
+		resp.Header = &result.Header
+		return resp, nil
+	}
+}
+
+type translateForPartnerRequest struct {
+	requestID string
+	ik        string
+	partnerID string
+	source    KeyReference
+	keyBlock  string
+	timeout   time.Duration
+}
+
+type translateForPartnerResponse struct {
+	Data string `json:"data"`
+}
+
+func decodeTranslateForPartnerRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	req := translateForPartnerRequest{
+		requestID: moovhttp.GetRequestID(request),
+		ik:        mux.Vars(request)["ik"],
+		partnerID: mux.Vars(request)["partnerID"],
+	}
+
+	type requestParam struct {
+		KeyPath  string
+		KeyName  string
+		KeyBlock string
+		Timeout  time.Duration
+	}
+
+	reqParams := requestParam{}
+	if err := bindJSON(request, &reqParams); err != nil {
+		return nil, err
+	}
+	req.source = KeyReference{
+		KeyPath: strings.TrimSpace(reqParams.KeyPath),
+		KeyName: strings.TrimSpace(reqParams.KeyName),
+	}
+	req.keyBlock = strings.TrimSpace(reqParams.KeyBlock)
+	if req.keyBlock == "" {
+		return nil, errInvalidKeyBlock
+	}
+	if err := checkKeyBlockLength(request, req.keyBlock); err != nil {
+		return nil, err
+	}
+	req.timeout = reqParams.Timeout
+	return req, nil
+}
+
+func translateForPartnerEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(translateForPartnerRequest)
+		if !ok {
+			return translateForPartnerResponse{}, ErrFoundABug
+		}
+
+		resp := translateForPartnerResponse{}
+		translated, err := s.TranslateForPartner(req.ik, req.partnerID, req.source, req.keyBlock, req.timeout, AsPrincipal(principalFrom(ctx)))
+		if err != nil {
+			return resp, err
+		}
+
+		resp.Data = translated
+		return resp, nil
+	}
+}
+
+type deliverKeyExchangeRequest struct {
+	requestID string
+	ik        string
+	partnerID string
+	envelope  []byte
+}
+
+type deliveryResponse struct {
+	Delivery *Delivery `json:"delivery"`
+}
+
+func decodeDeliverKeyExchangeRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	req := deliverKeyExchangeRequest{
+		requestID: moovhttp.GetRequestID(request),
+		ik:        mux.Vars(request)["ik"],
+		partnerID: mux.Vars(request)["partnerID"],
+	}
+	body, err := readBody(request)
+	if errors.Is(err, errRequestTooLarge) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidJSON, err)
+	}
+	req.envelope = body
+	return req, nil
+}
+
+func deliverKeyExchangeEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(deliverKeyExchangeRequest)
+		if !ok {
+			return deliveryResponse{}, ErrFoundABug
+		}
+
+		resp := deliveryResponse{}
+		d, err := s.DeliverKeyExchange(req.ik, req.partnerID, req.envelope)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.Delivery = d
+		return resp, nil
+	}
+}
+
+type getDeliveryRequest struct {
+	requestID  string
+	ik         string
+	partnerID  string
+	deliveryID string
+}
+
+func decodeGetDeliveryRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	return getDeliveryRequest{
+		requestID:  moovhttp.GetRequestID(request),
+		ik:         mux.Vars(request)["ik"],
+		partnerID:  mux.Vars(request)["partnerID"],
+		deliveryID: mux.Vars(request)["deliveryID"],
+	}, nil
+}
+
+func getDeliveryEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(getDeliveryRequest)
+		if !ok {
+			return deliveryResponse{}, ErrFoundABug
+		}
+
+		resp := deliveryResponse{}
+		d, err := s.GetDelivery(req.ik, req.partnerID, req.deliveryID)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.Delivery = d
+		return resp, nil
+	}
+}
+
+type createRotationScheduleRequest struct {
+	requestID string
+	ik        string
+	partnerID string
+	schedule  *RotationSchedule
+}
+
+type rotationScheduleResponse struct {
+	Schedule *RotationSchedule `json:"schedule"`
+}
+
+type rotationSchedulesResponse struct {
+	Schedules []*RotationSchedule `json:"schedules"`
+}
+
+func decodeCreateRotationScheduleRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	req := createRotationScheduleRequest{
+		requestID: moovhttp.GetRequestID(request),
+		ik:        mux.Vars(request)["ik"],
+		partnerID: mux.Vars(request)["partnerID"],
+	}
+
+	type requestParam struct {
+		Zone            string
+		Schedule        string
+		Header          HeaderParams
+		KeyLength       int
+		ActivationDelay time.Duration
+	}
+
+	reqParams := requestParam{}
+	if err := bindJSON(request, &reqParams); err != nil {
+		return nil, err
+	}
+	req.schedule = &RotationSchedule{
+		Zone:            strings.TrimSpace(reqParams.Zone),
+		Schedule:        reqParams.Schedule,
+		Header:          reqParams.Header,
+		KeyLength:       reqParams.KeyLength,
+		ActivationDelay: reqParams.ActivationDelay,
+	}
+	return req, nil
+}
+
+func createRotationScheduleEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(createRotationScheduleRequest)
+		if !ok {
+			return rotationScheduleResponse{}, ErrFoundABug
+		}
+
+		resp := rotationScheduleResponse{}
+		if err := s.CreateRotationSchedule(req.ik, req.partnerID, req.schedule); err != nil {
+			return resp, err
+		}
+
+		resp.Schedule = req.schedule
+		return resp, nil
+	}
+}
+
+type rotationRequest struct {
+	requestID  string
+	ik         string
+	partnerID  string
+	zone       string
+	rotationID string
+}
+
+func decodeRotationRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	return rotationRequest{
+		requestID:  moovhttp.GetRequestID(request),
+		ik:         mux.Vars(request)["ik"],
+		partnerID:  mux.Vars(request)["partnerID"],
+		zone:       mux.Vars(request)["zone"],
+		rotationID: mux.Vars(request)["rotationID"],
+	}, nil
+}
+
+func getRotationSchedulesEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(rotationRequest)
+		if !ok {
+			return rotationSchedulesResponse{}, ErrFoundABug
+		}
+
+		resp := rotationSchedulesResponse{}
+		schedules, err := s.GetRotationSchedules(req.ik, req.partnerID)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.Schedules = schedules
+		return resp, nil
+	}
+}
+
+func deleteRotationScheduleEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(rotationRequest)
+		if !ok {
+			return rotationScheduleResponse{}, ErrFoundABug
+		}
+
+		resp := rotationScheduleResponse{}
+		if err := s.DeleteRotationSchedule(req.ik, req.partnerID, req.zone); err != nil {
+			return resp, err
+		}
+		return resp, nil
+	}
+}
+
+type rotationResponse struct {
+	Rotation *Rotation `json:"rotation"`
+}
+
+type rotationsResponse struct {
+	Rotations []*Rotation `json:"rotations"`
+}
+
+func rotateZoneEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(rotationRequest)
+		if !ok {
+			return rotationResponse{}, ErrFoundABug
+		}
+
+		resp := rotationResponse{}
+		r, err := s.RotateZone(req.ik, req.partnerID, req.zone)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.Rotation = r
+		return resp, nil
+	}
+}
+
+func getRotationsEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(rotationRequest)
+		if !ok {
+			return rotationsResponse{}, ErrFoundABug
+		}
+
+		resp := rotationsResponse{}
+		rotations, err := s.GetRotations(req.ik, req.partnerID)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.Rotations = rotations
+		return resp, nil
+	}
+}
+
+func getRotationEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(rotationRequest)
+		if !ok {
+			return rotationResponse{}, ErrFoundABug
+		}
+
+		resp := rotationResponse{}
+		r, err := s.GetRotation(req.ik, req.partnerID, req.rotationID)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.Rotation = r
+		return resp, nil
+	}
+}
+
+type acknowledgeRotationRequest struct {
+	rotationRequest
+	kcv string
+}
+
+func decodeAcknowledgeRotationRequest(ctx context.Context, request *http.Request) (interface{}, error) {
+	r, _ := decodeRotationRequest(ctx, request)
+	req := acknowledgeRotationRequest{rotationRequest: r.(rotationRequest)}
+
+	type requestParam struct {
+		KCV string
+	}
+
+	reqParams := requestParam{}
+	if err := bindJSON(request, &reqParams); err != nil {
+		return nil, err
+	}
+	req.kcv = strings.TrimSpace(reqParams.KCV)
+	return req, nil
+}
+
+func acknowledgeRotationEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(acknowledgeRotationRequest)
+		if !ok {
+			return rotationResponse{}, ErrFoundABug
+		}
+
+		resp := rotationResponse{}
+		r, err := s.AcknowledgeRotation(req.ik, req.partnerID, req.rotationID, req.kcv)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.Rotation = r
+		return resp, nil
+	}
+}
+
+type reencryptEstateRequest struct {
+	requestID string
+	ik        string
+	estate    EstateRequest
+}
+
+type estateReportResponse struct {
+	Report *EstateReport `json:"report"`
+}
+
+func decodeReencryptEstateRequest(ctx context.Context, request *http.Request) (interface{}, error) {
+	req := reencryptEstateRequest{
+		requestID: moovhttp.GetRequestID(request),
+		ik:        mux.Vars(request)["ik"],
+	}
+	if err := bindJSON(request, &req.estate); err != nil {
+		return nil, err
+	}
+	req.estate.Principal = principalFrom(ctx)
+	return req, nil
+}
+
+func reencryptEstateEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(reencryptEstateRequest)
+		if !ok {
+			return estateReportResponse{}, ErrFoundABug
+		}
+
+		resp := estateReportResponse{}
+		report, err := s.ReencryptEstate(req.ik, req.estate)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.Report = report
+		return resp, nil
+	}
+}
+
+type escrowKBPKRequest struct {
+	requestID string
+	ik        string
+	escrow    EscrowRequest
+}
+
+type escrowResponse struct {
+	Escrow *Escrow `json:"escrow"`
+}
+
+func decodeEscrowKBPKRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	req := escrowKBPKRequest{
+		requestID: moovhttp.GetRequestID(request),
+		ik:        mux.Vars(request)["ik"],
+	}
+	if err := bindJSON(request, &req.escrow); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func escrowKBPKEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(escrowKBPKRequest)
+		if !ok {
+			return escrowResponse{}, ErrFoundABug
+		}
+
+		resp := escrowResponse{}
+		e, err := s.EscrowKBPK(req.ik, req.escrow)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.Escrow = e
+		return resp, nil
+	}
+}
+
+type recoverKBPKRequest struct {
+	requestID string
+	ik        string
+	escrowID  string
+	share     EscrowShare
+}
+
+type escrowRecoveryResponse struct {
+	Recovery *EscrowRecovery `json:"recovery"`
+}
+
+func decodeRecoverKBPKRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	req := recoverKBPKRequest{
+		requestID: moovhttp.GetRequestID(request),
+		ik:        mux.Vars(request)["ik"],
+		escrowID:  mux.Vars(request)["escrowID"],
+	}
+	if err := bindJSON(request, &req.share); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func recoverKBPKEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(recoverKBPKRequest)
+		if !ok {
+			return escrowRecoveryResponse{}, ErrFoundABug
+		}
+
+		resp := escrowRecoveryResponse{}
+		recovery, err := s.RecoverKBPK(req.ik, req.escrowID, req.share)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.Recovery = recovery
+		return resp, nil
+	}
+}
+
+type getInventoryRequest struct {
+	requestID string
+	ik        string
+	states    []KeyState
+	// stream is set when the client accepts newline delimited JSON
+	stream bool
+}
+
+type inventoryResponse struct {
+	Inventory *Inventory `json:"inventory"`
+}
+
+func decodeGetInventoryRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	req := getInventoryRequest{
+		requestID: moovhttp.GetRequestID(request),
+		ik:        mux.Vars(request)["ik"],
+		stream:    acceptsNDJSON(request),
+	}
+	// state filters the items, such as ?state=suspended,compromised
+	for _, v := range request.URL.Query()["state"] {
+		for _, name := range strings.Split(v, ",") {
+			state, err := ParseKeyState(name)
+			if err != nil {
+				return nil, fmt.Errorf("%w state must be a key state.", errMalformedField)
+			}
+			req.states = append(req.states, state)
+		}
+	}
+	return req, nil
+}
+
+// getInventoryEndpoint streams the items to clients accepting newline
+// delimited JSON when streamable
+func getInventoryEndpoint(s Service, streamable bool) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(getInventoryRequest)
+		if !ok {
+			return inventoryResponse{}, ErrFoundABug
+		}
+		if req.stream && streamable {
+			return ndjsonResponse{stream: func(emit func(interface{}) error) error {
+				return s.StreamInventory(req.ik, req.states, func(item InventoryItem) error {
+					return emit(item)
+				})
+			}}, nil
+		}
+
+		resp := inventoryResponse{}
+		inventory, err := s.GetInventory(req.ik, req.states...)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.Inventory = inventory
+		return resp, nil
+	}
+}
+
+type keyStatesRequest struct {
+	requestID string
+	ik        string
+	keyPath   string
+	keyName   string
+}
+
+type keyStatesResponse struct {
+	KeyStates []*KeyLifecycle `json:"keyStates"`
+}
+
+type keyStateResponse struct {
+	KeyState *KeyLifecycle `json:"keyState"`
+}
+
+func decodeKeyStatesRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	params := request.URL.Query()
+	return keyStatesRequest{
+		requestID: moovhttp.GetRequestID(request),
+		ik:        mux.Vars(request)["ik"],
+		keyPath:   params.Get("keyPath"),
+		keyName:   params.Get("keyName"),
+	}, nil
+}
+
+func getKeyStatesEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(keyStatesRequest)
+		if !ok {
+			return keyStatesResponse{}, ErrFoundABug
+		}
+
+		resp := keyStatesResponse{}
+		// A key is looked up by its path and name, stored keys which never
+		// changed state are active
+		if req.keyPath != "" && req.keyName != "" {
+			l, err := s.GetKeyState(req.ik, req.keyPath, req.keyName)
+			if err != nil {
+				return resp, err
+			}
+			resp.KeyStates = []*KeyLifecycle{l}
+			return resp, nil
+		}
+
+		lifecycles, err := s.GetKeyStates(req.ik)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.KeyStates = lifecycles
+		return resp, nil
+	}
+}
+
+type changeKeyStateRequest struct {
+	requestID string
+	ik        string
+	keyPath   string
+	keyName   string
+	state     KeyState
+	reason    string
+}
+
+func decodeChangeKeyStateRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	req := changeKeyStateRequest{
+		requestID: moovhttp.GetRequestID(request),
+		ik:        mux.Vars(request)["ik"],
+	}
+
+	type requestParam struct {
+		KeyPath string
+		KeyName string
+		State   string
+		Reason  string
+	}
+
+	reqParams := requestParam{}
+	if err := bindJSON(request, &reqParams); err != nil {
+		return nil, err
+	}
+	state, err := ParseKeyState(reqParams.State)
+	if err != nil {
+		return nil, err
+	}
+	req.keyPath = strings.TrimSpace(reqParams.KeyPath)
+	req.keyName = strings.TrimSpace(reqParams.KeyName)
+	req.state = state
+	req.reason = reqParams.Reason
+	return req, nil
+}
+
+func changeKeyStateEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(changeKeyStateRequest)
+		if !ok {
+			return keyStateResponse{}, ErrFoundABug
+		}
+
+		resp := keyStateResponse{}
+		l, err := s.ChangeKeyState(req.ik, req.keyPath, req.keyName, req.state, req.reason)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.KeyState = l
+		return resp, nil
+	}
+}
+
+type compromiseRequest struct {
+	requestID  string
+	ik         string
+	compromise CompromiseRequest
+}
+
+type compromiseResponse struct {
+	Report *CompromiseReport `json:"report"`
+}
+
+func decodeCompromiseRequest(ctx context.Context, request *http.Request) (interface{}, error) {
+	req := compromiseRequest{
+		requestID: moovhttp.GetRequestID(request),
+		ik:        mux.Vars(request)["ik"],
+	}
+	if err := bindJSON(request, &req.compromise); err != nil {
+		return nil, err
+	}
+	req.compromise.Principal = principalFrom(ctx)
+	return req, nil
+}
+
+func compromiseEndpoint(s Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(compromiseRequest)
+		if !ok {
+			return compromiseResponse{}, ErrFoundABug
+		}
+
+		resp := compromiseResponse{}
+		report, err := s.Compromise(req.ik, req.compromise)
+		if err != nil {
+			return resp, err
+		}
+
+		resp.Report = report
+		return resp, nil
+	}
+}
+
+type getDictionaryRequest struct {
+	requestID string
+}
+
+type dictionaryResponse struct {
+	Dictionary tr31.Dictionary `json:"dictionary"`
+}
+
+func decodeGetDictionaryRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	return getDictionaryRequest{
+		requestID: moovhttp.GetRequestID(request),
+	}, nil
+}
+
+// getDictionaryEndpoint lists the header field values, it doesn't need the service
+func getDictionaryEndpoint() endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		if _, ok := request.(getDictionaryRequest); !ok {
+			return dictionaryResponse{}, ErrFoundABug
+		}
+		return dictionaryResponse{Dictionary: tr31.HeaderDictionary()}, nil
+	}
+}
+
+type inspectRequest struct {
+	requestID string
+	file      io.Reader
+	limits    requestLimits
+}
+
+type inspectResponse struct {
+	Report *InspectReport `json:"report"`
+}
+
+// decodeInspectRequest reads the uploaded file, the part named file of a
+// multipart/form-data body or the whole body otherwise
+func decodeInspectRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	body, err := readBody(request)
+	if err != nil {
+		return nil, err
+	}
+	mediaType, params, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	file, err := inspectedFile(body, mediaType, params)
+	if err != nil {
+		return nil, err
+	}
+	return inspectRequest{
+		requestID: moovhttp.GetRequestID(request),
+		file:      file,
+		limits:    limitsOf(request),
+	}, nil
+}
+
+// inspectEndpoint summarizes a file of key blocks, it doesn't need the service
+func inspectEndpoint() endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(inspectRequest)
+		if !ok {
+			return inspectResponse{}, ErrFoundABug
+		}
+		report, err := inspectKeyBlocks(req.file, req.limits)
+		if err != nil {
+			return inspectResponse{}, err
+		}
+		return inspectResponse{Report: report}, nil
+	}
+}
+
+type selfTestRequest struct {
+	requestID string
+}
+
+type selfTestResponse struct {
+	Report *SelfTestReport `json:"report"`
+}
+
+func decodeSelfTestRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	return selfTestRequest{
+		requestID: moovhttp.GetRequestID(request),
+	}, nil
+}
+
+// selfTestEndpoint runs the known-answer vectors, it doesn't need the service
+func selfTestEndpoint() endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		_, ok := request.(selfTestRequest)
+		if !ok {
+			return selfTestResponse{}, ErrFoundABug
+		}
+		return selfTestResponse{Report: RunSelfTest()}, nil
+	}
+}
+
+// encodeSelfTestResponse encodes the report like encodeResponse, with a 500
+// status when a suite failed so health checks notice
+func encodeSelfTestResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if resp, ok := response.(selfTestResponse); ok && resp.Report != nil && !resp.Report.Passed {
+		w.Header().Set("X-Request-ID", requestIDFrom(ctx))
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		return writeEnvelope(ctx, w, response, nil)
+	}
+	return encodeResponse(ctx, w, response)
+}
+
+type getPolicyRequest struct {
+	requestID string
+}
+
+type policyResponse struct {
+	Policy PolicyStatus `json:"policy"`
+}
+
+func decodeGetPolicyRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	return getPolicyRequest{
+		requestID: moovhttp.GetRequestID(request),
+	}, nil
+}
+
+func getPolicyEndpoint(w *PolicyWatcher) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		if _, ok := request.(getPolicyRequest); !ok {
+			return policyResponse{}, ErrFoundABug
+		}
+		return policyResponse{Policy: w.Status()}, nil
+	}
+}
+
+type getTreeHeadRequest struct {
+	requestID string
+}
+
+type treeHeadResponse struct {
+	TreeHead SignedTreeHead `json:"treeHead"`
+}
+
+func decodeGetTreeHeadRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	return getTreeHeadRequest{
+		requestID: moovhttp.GetRequestID(request),
+	}, nil
+}
+
+func getTreeHeadEndpoint(l *TransparencyLog) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		if _, ok := request.(getTreeHeadRequest); !ok {
+			return treeHeadResponse{}, ErrFoundABug
+		}
+		return treeHeadResponse{TreeHead: l.TreeHead()}, nil
+	}
+}
+
+type getInclusionProofRequest struct {
+	requestID string
+	hash      string
+}
+
+type inclusionProofResponse struct {
+	Proof *InclusionProof `json:"proof"`
+}
+
+// decodeGetInclusionProofRequest reads the hash query parameter, the hex
+// SHA-256 of the key block, so the key block itself isn't sent
+func decodeGetInclusionProofRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	return getInclusionProofRequest{
+		requestID: moovhttp.GetRequestID(request),
+		hash:      request.URL.Query().Get("hash"),
+	}, nil
+}
+
+func getInclusionProofEndpoint(l *TransparencyLog) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(getInclusionProofRequest)
+		if !ok {
+			return inclusionProofResponse{}, ErrFoundABug
+		}
+		proof, err := l.InclusionProof(req.hash)
+		if err != nil {
+			return inclusionProofResponse{}, err
+		}
+		return inclusionProofResponse{Proof: proof}, nil
+	}
+}
+
+type getConsistencyProofRequest struct {
+	requestID string
+	first     int
+	second    int
+}
+
+type consistencyProofResponse struct {
+	Proof *ConsistencyProof `json:"proof"`
+}
+
+func decodeGetConsistencyProofRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	req := getConsistencyProofRequest{
+		requestID: moovhttp.GetRequestID(request),
+	}
+	params := request.URL.Query()
+	var err error
+	if req.first, err = strconv.Atoi(params.Get("first")); err != nil {
+		return nil, fmt.Errorf("%w first must be a number.", errMalformedField)
+	}
+	if req.second, err = strconv.Atoi(params.Get("second")); err != nil {
+		return nil, fmt.Errorf("%w second must be a number.", errMalformedField)
+	}
+	return req, nil
+}
+
+func getConsistencyProofEndpoint(l *TransparencyLog) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(getConsistencyProofRequest)
+		if !ok {
+			return consistencyProofResponse{}, ErrFoundABug
+		}
+		proof, err := l.ConsistencyProof(req.first, req.second)
+		if err != nil {
+			return consistencyProofResponse{}, err
+		}
+		return consistencyProofResponse{Proof: proof}, nil
+	}
+}
+
+type getTransparencyEntriesRequest struct {
+	requestID string
+	start     int
+	end       int
+}
+
+type transparencyEntriesResponse struct {
+	Start   int      `json:"start"`
+	Entries []string `json:"entries"`
+}
+
+// maxTransparencyEntries is the most entries returned by one request
+const maxTransparencyEntries = 1000
+
+func decodeGetTransparencyEntriesRequest(_ context.Context, request *http.Request) (interface{}, error) {
+	req := getTransparencyEntriesRequest{
+		requestID: moovhttp.GetRequestID(request),
+	}
+	params := request.URL.Query()
+	var err error
+	if v := params.Get("start"); v != "" {
+		if req.start, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("%w start must be a number.", errMalformedField)
+		}
+	}
+	req.end = req.start + maxTransparencyEntries
+	if v := params.Get("end"); v != "" {
+		if req.end, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("%w end must be a number.", errMalformedField)
+		}
+		req.end = min(req.end, req.start+maxTransparencyEntries)
+	}
+	return req, nil
+}
+
+func getTransparencyEntriesEndpoint(l *TransparencyLog) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(getTransparencyEntriesRequest)
+		if !ok {
+			return transparencyEntriesResponse{}, ErrFoundABug
+		}
+		entries, err := l.Entries(req.start, req.end)
+		if err != nil {
+			return transparencyEntriesResponse{}, err
+		}
+		return transparencyEntriesResponse{Start: req.start, Entries: entries}, nil
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+var (
+	errInvalidKeyImporter = errors.New("Invalid Key Importer.")
+	errInvalidImportName  = errors.New("Invalid Import Name.")
+)
+
+// KeyImporter imports keys into a downstream key management system, such as
+// Vault Transit, AWS KMS or a PKCS #11 token, so they never leave the service
+// in clear. ImportKey returns the handle the downstream system knows the key
+// by, such as a key name or ARN. header is the header of the unwrapped key
+// block, describing the key.
+type KeyImporter interface {
+	ImportKey(name string, key []byte, header *tr31.Header) (string, error)
+}
+
+// ConfigureKeyImporter registers a key importer decrypt requests can import
+// keys with by name, replacing any importer registered with the name
+func (s *service) ConfigureKeyImporter(name string, importer KeyImporter) {
+	s.importers.Store(name, importer)
+}
+
+// DecryptDataAndImport unwraps a key block like DecryptDataWithFallback and
+// imports the key into the downstream system of the importer registered as
+// importer under importName, returning the handle of the imported key instead
+// of the key. The importer is looked up before the key block is unwrapped.
+func (s *service) DecryptDataAndImport(vaultAddr, vaultToken string, keys []KeyReference, keyBlock, importer, importName string, timeout time.Duration, opts ...UnwrapOption) (_ string, _ KeyReference, err error) {
+	defer func() { s.audit(AUDIT_OPERATION_DECRYPT, auditKeysSubject(keys), err) }()
+	found, ok := s.importers.Load(importer)
+	if !ok {
+		return "", KeyReference{}, fmt.Errorf("%w: %q is not configured", errInvalidKeyImporter, importer)
+	}
+	if importName == "" {
+		return "", KeyReference{}, errInvalidImportName
+	}
+	header := tr31.DefaultHeader()
+	if _, err := header.Load(keyBlock); err != nil {
+		return "", KeyReference{}, err
+	}
+	if err := s.approveUsage(unwrapCallOf(opts).principal, keyBlock); err != nil {
+		return "", KeyReference{}, err
+	}
+
+	data, key, err := s.decryptDataWithFallback(vaultAddr, vaultToken, keys, keyBlock, timeout)
+	if err != nil {
+		return "", KeyReference{}, err
+	}
+	clear, err := hex.DecodeString(data)
+	if err != nil {
+		return "", KeyReference{}, err
+	}
+	defer wipe(clear)
+
+	handle, err := found.(KeyImporter).ImportKey(importName, clear, header)
+	if err != nil {
+		return "", KeyReference{}, fmt.Errorf("importing key with %s: %w", importer, err)
+	}
+	return handle, key, nil
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingImporter keeps the keys imported into it by name
+type recordingImporter struct {
+	keys map[string]string
+	err  error
+}
+
+func (r *recordingImporter) ImportKey(name string, key []byte, header *tr31.Header) (string, error) {
+	if r.err != nil {
+		return "", r.err
+	}
+	r.keys[name] = header.KeyUsage + ":" + hex.EncodeToString(key)
+	return "kms/" + name, nil
+}
+
+func TestService_DecryptDataAndImport(t *testing.T) {
+	s := mockServiceInMock()
+	mockTerminalMachine(t, s)
+	importer := &recordingImporter{keys: make(map[string]string)}
+	s.ConfigureKeyImporter("kms", importer)
+
+	auth := mockVaultAuthOne()
+	keys := []KeyReference{{KeyPath: "secret/tr31", KeyName: "kbkp"}}
+	handle, key, err := s.DecryptDataAndImport(auth.VaultAddress, auth.VaultToken, keys, transportTestKeyBlock, "kms", "mac-key", 0)
+	require.NoError(t, err)
+	require.Equal(t, "kms/mac-key", handle)
+	require.Equal(t, keys[0], key)
+	require.Equal(t, "M3:ccccccccccccccccdddddddddddddddd", importer.keys["mac-key"])
+
+	_, _, err = s.DecryptDataAndImport(auth.VaultAddress, auth.VaultToken, keys, transportTestKeyBlock, "unknown", "mac-key", 0)
+	require.ErrorIs(t, err, errInvalidKeyImporter)
+	_, _, err = s.DecryptDataAndImport(auth.VaultAddress, auth.VaultToken, keys, transportTestKeyBlock, "kms", "", 0)
+	require.ErrorIs(t, err, errInvalidImportName)
+
+	importer.err = errors.New("kms unavailable")
+	_, _, err = s.DecryptDataAndImport(auth.VaultAddress, auth.VaultToken, keys, transportTestKeyBlock, "kms", "mac-key", 0)
+	require.ErrorIs(t, err, importer.err)
+}
+
+func TestService_NeverClear(t *testing.T) {
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	m := NewMachine(mockVaultAuthOne())
+	m.Keys = []KeyReference{{KeyPath: "secret/tr31", KeyName: "kbkp"}}
+	m.NeverClear = true
+	require.NoError(t, s.CreateMachine(m))
+	importer := &recordingImporter{keys: make(map[string]string)}
+	s.ConfigureKeyImporter("kms", importer)
+
+	auth := mockVaultAuthOne()
+	_, err := s.DecryptData(auth.VaultAddress, auth.VaultToken, "secret/tr31", "kbkp", transportTestKeyBlock, 0)
+	require.ErrorIs(t, err, ErrClearKeyNotAllowed)
+	_, _, err = s.DecryptDataWithFallback(auth.VaultAddress, auth.VaultToken, m.Keys, transportTestKeyBlock, 0)
+	require.ErrorIs(t, err, ErrClearKeyNotAllowed)
+
+	// The policy follows the KBPK, whatever credentials read it
+	other := mockVaultAuthTwo()
+	_, err = s.DecryptData(other.VaultAddress, other.VaultToken, "/secret/tr31/", "kbkp", transportTestKeyBlock, 0)
+	require.ErrorIs(t, err, ErrClearKeyNotAllowed)
+	keys := []KeyReference{{KeyPath: "secret/tr31", KeyName: "other"}, m.Keys[0]}
+	_, _, err = s.DecryptDataWithFallback(other.VaultAddress, other.VaultToken, keys, transportTestKeyBlock, 0)
+	require.ErrorIs(t, err, ErrClearKeyNotAllowed)
+
+	_, _, err = s.DecryptDataAndImport(auth.VaultAddress, auth.VaultToken, m.Keys, transportTestKeyBlock, "kms", "mac-key", 0)
+	require.NoError(t, err)
+}
+
+func TestRouting_decrypt_data_import(t *testing.T) {
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	importer := &recordingImporter{keys: make(map[string]string)}
+	s.ConfigureKeyImporter("kms", importer)
+	router := MakeHTTPHandler(s)
+
+	auth := mockVaultAuthOne()
+	body, err := json.Marshal(map[string]interface{}{
+		"VaultAddress": auth.VaultAddress,
+		"VaultToken":   auth.VaultToken,
+		"Keys":         []KeyReference{{KeyPath: "secret/tr31", KeyName: "kbkp"}},
+		"NeverClear":   true,
+	})
+	require.NoError(t, err)
+	req := httptest.NewRequest("POST", "/machine", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	decrypt := func(params map[string]string) *httptest.ResponseRecorder {
+		request := map[string]string{
+			"VaultAddr":  auth.VaultAddress,
+			"VaultToken": auth.VaultToken,
+			"KeyPath":    "secret/tr31",
+			"KeyName":    "kbkp",
+			"KeyBlock":   transportTestKeyBlock,
+		}
+		for k, v := range params {
+			request[k] = v
+		}
+		body, err := json.Marshal(request)
+		require.NoError(t, err)
+		req := httptest.NewRequest("POST", "/decrypt_data", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w = decrypt(nil)
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.Contains(t, w.Body.String(), ERROR_CODE_CLEAR_KEY_NOT_ALLOWED)
+
+	w = decrypt(map[string]string{"ImportTo": "kms", "ImportName": "mac-key"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp decryptDataResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Empty(t, resp.Data)
+	require.Equal(t, "kms/mac-key", resp.Handle)
+
+	w = decrypt(map[string]string{"ImportTo": "unknown", "ImportName": "mac-key"})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = decrypt(map[string]string{"ImportTo": "kms", "ImportName": "mac-key", "TransportKeyID": "abc"})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Body.String(), ERROR_CODE_MALFORMED_FIELD)
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestImports_portable keeps the server buildable and runnable on every
+// platform, such as Alpine containers and Windows: it never runs external
+// programs, leaving process management of development tools to tests and
+// scripts
+func TestImports_portable(t *testing.T) {
+	denied := []string{"os/exec", "syscall", "plugin"}
+	files, err := filepath.Glob("*.go")
+	require.NoError(t, err)
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), file, nil, parser.ImportsOnly)
+		require.NoError(t, err)
+		for _, spec := range f.Imports {
+			path, _ := strconv.Unquote(spec.Path.Value)
+			for _, d := range denied {
+				require.False(t, path == d || strings.HasPrefix(path, d+"/"), "%s imports %s", file, path)
+			}
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"strconv"
+	"strings"
+
+	"github.com/moov-io/tr31/pkg/charset"
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+// maxInspectLineSize bounds a single line of an inspected file, far above the
+// longest key block
+const maxInspectLineSize = 64 * 1024
+
+var errInvalidInspection = errors.New("Invalid Inspection.")
+
+// InspectProblem is a key block of an inspected file which isn't valid
+type InspectProblem struct {
+	// Line is the line of the key block in the file, starting at 1
+	Line int `json:"line"`
+	// Header is the clear header of the key block, when it's long enough to hold one
+	Header string `json:"header,omitempty"`
+	Error  string `json:"error"`
+}
+
+// InspectReport summarizes the key blocks of a file, such as the key inventory
+// sent by a partner being onboarded. Key blocks are inspected without their
+// KBPK, so neither their MAC nor their key is checked.
+type InspectReport struct {
+	Total   int `json:"total"`
+	Valid   int `json:"valid"`
+	Invalid int `json:"invalid"`
+	// Versions, KeyUsages and Algorithms count the valid key blocks by header field
+	Versions   map[string]int `json:"versions"`
+	KeyUsages  map[string]int `json:"keyUsages"`
+	Algorithms map[string]int `json:"algorithms"`
+	// Deprecations counts the valid key blocks by deprecation, such as version A
+	Deprecations map[string]int `json:"deprecations"`
+	// Blocks counts the valid key blocks by optional block ID
+	Blocks map[string]int `json:"blocks"`
+	// BlockDescriptions documents the optional blocks counted, those defined by
+	// X9.143 and the proprietary blocks with a registered handler
+	BlockDescriptions map[string]string `json:"blockDescriptions"`
+	Problems          []InspectProblem  `json:"problems"`
+}
+
+// inspectLine is a line of a JSONL file
+type inspectLine struct {
+	KeyBlock string `json:"keyBlock"`
+}
+
+// InspectKeyBlocks reads a file holding one key block per line, either as is or
+// as a JSON object with a keyBlock field (JSONL), and reports how many key blocks
+// are valid by version, key usage and algorithm along with the reasons the
+// others are not. Blank lines are ignored.
+func InspectKeyBlocks(r io.Reader) (*InspectReport, error) {
+	return inspectKeyBlocks(r, requestLimits{}.withDefaults())
+}
+
+// inspectKeyBlocks inspects a file of at most limits.batchSize key blocks
+func inspectKeyBlocks(r io.Reader, limits requestLimits) (*InspectReport, error) {
+	report := &InspectReport{
+		Versions:          map[string]int{},
+		KeyUsages:         map[string]int{},
+		Algorithms:        map[string]int{},
+		Deprecations:      map[string]int{},
+		Blocks:            map[string]int{},
+		BlockDescriptions: map[string]string{},
+		Problems:          []InspectProblem{},
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), maxInspectLineSize)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		report.Total++
+		if report.Total > limits.batchSize {
+			return nil, fmt.Errorf("%w The file holds more than %d key blocks.", errRequestTooLarge, limits.batchSize)
+		}
+		keyBlock := text
+		if strings.HasPrefix(text, "{") {
+			var l inspectLine
+			if err := json.Unmarshal([]byte(text), &l); err != nil {
+				report.problem(line, "", fmt.Errorf("%w: %s", errInvalidJSON, err))
+				continue
+			}
+			keyBlock = strings.TrimSpace(l.KeyBlock)
+		}
+		header, err := inspectKeyBlock(keyBlock, limits.keyBlockLength)
+		if err != nil {
+			report.problem(line, keyBlock, err)
+			continue
+		}
+		report.Valid++
+		report.Versions[header.VersionID]++
+		report.KeyUsages[header.KeyUsage]++
+		report.Algorithms[header.Algorithm]++
+		for _, deprecation := range header.Deprecations() {
+			report.Deprecations[deprecation]++
+		}
+		for _, block := range header.Blocks.Inspect() {
+			report.Blocks[block.ID]++
+			if block.Description != "" {
+				report.BlockDescriptions[block.ID] = block.Description
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidInspection, err)
+	}
+	if report.Total == 0 {
+		return nil, fmt.Errorf("%w: the file holds no key block", errInvalidInspection)
+	}
+	return report, nil
+}
+
+func (r *InspectReport) problem(line int, keyBlock string, err error) {
+	r.Invalid++
+	problem := InspectProblem{Line: line, Error: err.Error()}
+	// Only the clear header is echoed back, never the encrypted key data
+	if len(keyBlock) >= 16 && charset.IsAlphanumeric(keyBlock[:16]) {
+		problem.Header = keyBlock[:16]
+	}
+	r.Problems = append(r.Problems, problem)
+}
+
+// inspectKeyBlock checks the header of a key block and its length the way
+// Unwrap does before the KBPK is needed, key blocks over maxLen aren't parsed
+func inspectKeyBlock(keyBlock string, maxLen int) (*tr31.Header, error) {
+	if keyBlock == "" {
+		return nil, errInvalidKeyBlock
+	}
+	header := tr31.DefaultHeader()
+	header.SetParseOptions(tr31.ParseOptions{MaxLen: maxLen})
+	if _, err := header.Load(keyBlock); err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(keyBlock[1:5])
+	if err != nil || length != len(keyBlock) {
+		return nil, &tr31.KeyBlockError{Message: fmt.Sprintf(tr31.BlockErrorHeaderLenNoMatched, length, len(keyBlock))}
+	}
+	if spec, _ := tr31.LookupVersion(header.VersionID); spec.BlockSize > 0 && length%spec.BlockSize != 0 {
+		return nil, &tr31.KeyBlockError{Message: fmt.Sprintf(tr31.BlockErrorHeaderLenMismatched, length, spec.BlockSize, header.VersionID)}
+	}
+	if err := header.Lint(); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// inspectedFile returns the file of a multipart/form-data body, the part named
+// file, or the body itself otherwise
+func inspectedFile(body []byte, mediaType string, params map[string]string) (io.Reader, error) {
+	if mediaType != "multipart/form-data" {
+		return bytes.NewReader(body), nil
+	}
+	if params["boundary"] == "" {
+		return nil, fmt.Errorf("%w: the form has no boundary", errInvalidInspection)
+	}
+	form := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: the form has no file part", errInvalidInspection)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidInspection, err)
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+	}
+}
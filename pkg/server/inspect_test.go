@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+	"github.com/stretchr/testify/require"
+)
+
+func inspectedKeyBlocks(t *testing.T) (string, string) {
+	t.Helper()
+	kbpk, _ := hex.DecodeString("AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	versionB, err := wrapKey(kbpk, "ccccccccccccccccdddddddddddddddd", HeaderParams{
+		VersionId: "B", KeyUsage: "D0", Algorithm: "T", ModeOfUse: "D", KeyVersion: "00", Exportability: "E",
+	}, nil, time.Now())
+	require.NoError(t, err)
+	versionA, err := wrapKey(kbpk, "ccccccccccccccccdddddddddddddddd", HeaderParams{
+		VersionId: "A", KeyUsage: "P0", Algorithm: "T", ModeOfUse: "E", KeyVersion: "00", Exportability: "E",
+	}, nil, time.Now())
+	require.NoError(t, err)
+	return versionB.KeyBlock, versionA.KeyBlock
+}
+
+func TestInspectKeyBlocks(t *testing.T) {
+	versionB, versionA := inspectedKeyBlocks(t)
+	file := strings.Join([]string{
+		versionB,
+		"",
+		`{"keyBlock": "` + versionA + `"}`,
+		versionB[:len(versionB)-2],
+		`{"keyBlock": `,
+		"not a key block",
+	}, "\n")
+
+	report, err := InspectKeyBlocks(strings.NewReader(file))
+	require.NoError(t, err)
+	require.Equal(t, 5, report.Total)
+	require.Equal(t, 2, report.Valid)
+	require.Equal(t, 3, report.Invalid)
+	require.Equal(t, map[string]int{"A": 1, "B": 1}, report.Versions)
+	require.Equal(t, map[string]int{"D0": 1, "P0": 1}, report.KeyUsages)
+	require.Equal(t, map[string]int{"T": 2}, report.Algorithms)
+	require.Equal(t, map[string]int{tr31.DeprecationVersionA: 1}, report.Deprecations)
+	require.Empty(t, report.Blocks)
+
+	require.Len(t, report.Problems, 3)
+	require.Equal(t, 4, report.Problems[0].Line)
+	require.Equal(t, versionB[:16], report.Problems[0].Header)
+	require.Contains(t, report.Problems[0].Error, "doesn't match input data length")
+	require.Equal(t, 5, report.Problems[1].Line)
+	require.Contains(t, report.Problems[1].Error, errInvalidJSON.Error())
+	require.Equal(t, 6, report.Problems[2].Line)
+	require.Empty(t, report.Problems[2].Header)
+
+	_, err = InspectKeyBlocks(strings.NewReader("\n\n"))
+	require.ErrorIs(t, err, errInvalidInspection)
+}
+
+// terminalBlock is a proprietary block carrying a terminal ID
+type terminalBlock struct{}
+
+func (terminalBlock) Description() string                        { return "Terminal identifier" }
+func (terminalBlock) Validate(string) error                      { return nil }
+func (terminalBlock) Marshal(value interface{}) (string, error)  { return value.(string), nil }
+func (terminalBlock) Unmarshal(data string) (interface{}, error) { return data, nil }
+
+func TestInspectKeyBlocks_blocks(t *testing.T) {
+	require.NoError(t, tr31.RegisterProprietaryBlock("9T", terminalBlock{}))
+	defer tr31.RegisterProprietaryBlock("9T", nil)
+
+	kbpk, _ := hex.DecodeString("AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	var file []string
+	for _, blocks := range []map[string]string{
+		{"LB": "INST0042", "9T": "TERM0001"},
+		{"LB": "INST0042", "98": "UNKNOWN1"},
+	} {
+		wrapped, err := wrapKey(kbpk, "ccccccccccccccccdddddddddddddddd", HeaderParams{
+			VersionId: "B", KeyUsage: "D0", Algorithm: "T", ModeOfUse: "D", KeyVersion: "00", Exportability: "E", Blocks: blocks,
+		}, nil, time.Now())
+		require.NoError(t, err)
+		file = append(file, wrapped.KeyBlock)
+	}
+
+	report, err := InspectKeyBlocks(strings.NewReader(strings.Join(file, "\n")))
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Valid)
+	require.Equal(t, 2, report.Blocks["LB"])
+	require.Equal(t, 1, report.Blocks["9T"])
+	require.Equal(t, 1, report.Blocks["98"])
+	// Registered proprietary blocks are documented, unknown ones aren't
+	require.Equal(t, "Terminal identifier", report.BlockDescriptions["9T"])
+	require.Equal(t, "Label", report.BlockDescriptions["LB"])
+	require.NotContains(t, report.BlockDescriptions, "98")
+}
+
+func TestRouting_inspect(t *testing.T) {
+	versionB, versionA := inspectedKeyBlocks(t)
+	decode := func(w *httptest.ResponseRecorder) InspectReport {
+		var body struct {
+			Report InspectReport `json:"report"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return body.Report
+	}
+
+	t.Run("jsonl", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/tr31/inspect", strings.NewReader(`{"keyBlock":"`+versionB+`"}`+"\n"+`{"keyBlock":"`+versionA+`"}`))
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		w := httptest.NewRecorder()
+		mockHttpHandler().ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		report := decode(w)
+		require.Equal(t, 2, report.Valid)
+		require.Empty(t, report.Problems)
+	})
+
+	t.Run("multipart", func(t *testing.T) {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		require.NoError(t, form.WriteField("partner", "acquirer"))
+		part, err := form.CreateFormFile("file", "inventory.txt")
+		require.NoError(t, err)
+		part.Write([]byte(versionB + "\n" + versionA[:20] + "\n"))
+		require.NoError(t, form.Close())
+
+		req := httptest.NewRequest("POST", "/tr31/inspect", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		w := httptest.NewRecorder()
+		mockHttpHandler().ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		report := decode(w)
+		require.Equal(t, 2, report.Total)
+		require.Equal(t, 1, report.Invalid)
+		require.Equal(t, 2, report.Problems[0].Line)
+	})
+
+	t.Run("no file", func(t *testing.T) {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		require.NoError(t, form.WriteField("partner", "acquirer"))
+		require.NoError(t, form.Close())
+
+		req := httptest.NewRequest("POST", "/tr31/inspect", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		w := httptest.NewRecorder()
+		mockHttpHandler().ServeHTTP(w, req)
+		require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	})
+}
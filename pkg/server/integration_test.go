@@ -0,0 +1,140 @@
+//go:build integration
+
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// vaultContainer is a Vault server in development mode running in a Docker container
+type vaultContainer struct {
+	id   string
+	auth Vault
+}
+
+// startVault runs a Vault dev server in a container removed when the test ends,
+// skipping the test when Docker isn't available. Set TR31_VAULT_IMAGE to pick
+// the image, hashicorp/vault by default.
+func startVault(t *testing.T) *vaultContainer {
+	t.Helper()
+
+	if err := exec.Command("docker", "info").Run(); err != nil {
+		t.Skipf("docker is not available: %v", err)
+	}
+	image := cmp.Or(os.Getenv("TR31_VAULT_IMAGE"), "hashicorp/vault:1.18")
+	token := "tr31-integration"
+	out, err := exec.Command("docker", "run", "-d", "--rm", "--cap-add", "IPC_LOCK",
+		"-e", "VAULT_DEV_ROOT_TOKEN_ID="+token, "-p", "127.0.0.1::8200", image).Output()
+	require.NoError(t, err, "starting %s", image)
+	v := &vaultContainer{id: strings.TrimSpace(string(out))}
+	t.Cleanup(func() { exec.Command("docker", "rm", "-f", v.id).Run() })
+
+	out, err = exec.Command("docker", "port", v.id, "8200/tcp").Output()
+	require.NoError(t, err)
+	hostPort := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	v.auth = Vault{VaultAddress: "http://" + hostPort, VaultToken: token}
+
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(v.auth.VaultAddress + "/v1/sys/health")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 30*time.Second, 250*time.Millisecond, "vault didn't become healthy")
+	return v
+}
+
+// stop stops the container, failing every request made to Vault afterwards
+func (v *vaultContainer) stop(t *testing.T) {
+	t.Helper()
+	require.NoError(t, exec.Command("docker", "stop", "-t", "1", v.id).Run())
+}
+
+// writeSecret writes a secret straight to Vault, bypassing the service
+func (v *vaultContainer) writeSecret(t *testing.T, path, name, value string) {
+	t.Helper()
+	client, err := NewVaultClient(v.auth)
+	require.NoError(t, err)
+	if vErr := client.WriteSecret(path, name, value); vErr != nil {
+		t.Fatal(vErr)
+	}
+}
+
+// TestIntegration_Vault exercises the service against a real Vault server.
+// Run with: go test -tags integration ./... -run TestIntegration (from pkg/server)
+func TestIntegration_Vault(t *testing.T) {
+	v := startVault(t)
+	s := NewService(NewRepositoryInMemory(nil), MODE_VAULT)
+	router := MakeHTTPHandler(s)
+
+	// Each secret has a path of its own, Vault writes replace every key of a path
+	body, _ := json.Marshal(map[string]interface{}{
+		"VaultAddress": v.auth.VaultAddress,
+		"VaultToken":   v.auth.VaultToken,
+		"Backend":      MODE_VAULT,
+		"KBPK":         KBPKBootstrap{KeyPath: "secret/data/tr31/kbpk", KeyName: "kbpk"},
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/machine", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var created createMachineResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	require.Len(t, created.KCV, 6)
+
+	header := HeaderParams{VersionId: "D", KeyUsage: "D0", Algorithm: "A", ModeOfUse: "D", KeyVersion: "00", Exportability: "E"}
+	key := "ccccccccccccccccdddddddddddddddd"
+	t.Run("encrypt and decrypt", func(t *testing.T) {
+		keyBlock, err := s.EncryptData(v.auth.VaultAddress, v.auth.VaultToken, "secret/data/tr31/kbpk", "kbpk", key, header, 10)
+		require.NoError(t, err)
+		data, err := s.DecryptData(v.auth.VaultAddress, v.auth.VaultToken, "secret/data/tr31/kbpk", "kbpk", keyBlock, 10)
+		require.NoError(t, err)
+		require.Equal(t, key, data)
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		keyBlock, err := s.EncryptData(v.auth.VaultAddress, v.auth.VaultToken, "secret/data/tr31/kbpk", "kbpk", key, header, 10)
+		require.NoError(t, err)
+		v.writeSecret(t, "secret/data/tr31/pek", "pek", keyBlock)
+		v.writeSecret(t, "secret/data/tr31/kbpk-2", "kbpk-2", strings.Repeat("AB", 32))
+
+		report, err := s.ReencryptEstate(created.IK, EstateRequest{
+			Key:       KeyReference{KeyPath: "secret/data/tr31/kbpk", KeyName: "kbpk"},
+			TargetKey: KeyReference{KeyPath: "secret/data/tr31/kbpk-2", KeyName: "kbpk-2"},
+			Paths:     []string{"secret/data/tr31/pek"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, 1, report.Translated, report.Entries)
+
+		client, err := NewVaultClient(v.auth)
+		require.NoError(t, err)
+		rewrapped, vErr := client.ReadSecret("secret/data/tr31/pek", "pek")
+		require.Nil(t, vErr)
+		data, err := s.DecryptData(v.auth.VaultAddress, v.auth.VaultToken, "secret/data/tr31/kbpk-2", "kbpk-2", rewrapped, 10)
+		require.NoError(t, err)
+		require.Equal(t, key, data)
+	})
+
+	t.Run("failures", func(t *testing.T) {
+		_, err := s.EncryptData(v.auth.VaultAddress, "wrong-token", "secret/data/tr31/kbpk", "kbpk", key, header, 10)
+		var vaultErr *VaultError
+		require.ErrorAs(t, err, &vaultErr)
+		_, err = s.EncryptData(v.auth.VaultAddress, v.auth.VaultToken, "secret/data/tr31/missing", "kbpk", key, header, 10)
+		require.ErrorAs(t, err, &vaultErr)
+
+		v.stop(t)
+		_, err = s.EncryptData(v.auth.VaultAddress, v.auth.VaultToken, "secret/data/tr31/kbpk", "kbpk", key, header, 10)
+		require.ErrorAs(t, err, &vaultErr)
+	})
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+// timestampLayout is the layout of the TS optional block, such as 20240101120000Z
+const timestampLayout = "20060102150405Z"
+
+var errNoKBPKUnwraps = errors.New("no KBPK of the machine unwraps the key block")
+
+// InventoryItem describes a key block stored under a machine, either a secret
+// under one of its secret paths or the TMK of a terminal
+type InventoryItem struct {
+	Path       string `json:"path,omitempty"`
+	Name       string `json:"name,omitempty"`
+	TerminalID string `json:"terminalId,omitempty"`
+	// Header summarizes the key block header, Blocks lists its optional block IDs
+	Header HeaderParams `json:"header"`
+	Blocks []string     `json:"blocks,omitempty"`
+	KCV    string       `json:"kcv,omitempty"`
+	// CreatedAt is the TS optional block of the key block, or the time a terminal TMK was provisioned
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
+	// LastRotatedAt is the last time the key block was re-encrypted under a new KBPK
+	LastRotatedAt *time.Time `json:"lastRotatedAt,omitempty"`
+	// State is the lifecycle state of the key, see KeyState
+	State KeyState `json:"state"`
+	Error string   `json:"error,omitempty"`
+}
+
+// Inventory lists the key blocks stored under a machine, the report auditors
+// ask for during PCI PIN assessments
+type Inventory struct {
+	InitialKey  string          `json:"initialKey"`
+	Items       []InventoryItem `json:"items"`
+	GeneratedAt time.Time       `json:"generatedAt"`
+}
+
+// GetInventory lists every key block stored under the machine's secret paths,
+// with its header summary, KCV and lifecycle state, followed by the TMKs of its
+// terminals and the destroyed keys of the machine. The KCV of a stored key block
+// is computed by unwrapping it with the machine's KBPKs in order, key blocks none
+// of them unwraps are listed with an error. Only keys in states are listed, when
+// states are given.
+func (s *service) GetInventory(ik string, states ...KeyState) (*Inventory, error) {
+	inventory := &Inventory{
+		InitialKey:  ik,
+		Items:       []InventoryItem{},
+		GeneratedAt: s.now(),
+	}
+	err := s.StreamInventory(ik, states, func(item InventoryItem) error {
+		inventory.Items = append(inventory.Items, item)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inventory, nil
+}
+
+// StreamInventory passes the items of GetInventory to emit as they are read,
+// instead of collecting them, and stops at the first error of emit. Errors
+// finding the machine or reading its KBPKs are returned before any item.
+func (s *service) StreamInventory(ik string, states []KeyState, emit func(InventoryItem) error) error {
+	m, err := s.GetMachine(ik)
+	if err != nil {
+		return err
+	}
+	if len(m.Keys) == 0 {
+		return errMachineHasNoKBPK
+	}
+	sm, err := s.scopedSecretManagerOf(m)
+	if err != nil {
+		return err
+	}
+	scanner, ok := sm.(SecretScanner)
+	if !ok {
+		return errSecretScanNotSupported
+	}
+
+	kbpks := make([][]byte, 0, len(m.Keys))
+	defer func() {
+		for _, kbpk := range kbpks {
+			wipe(kbpk)
+		}
+	}()
+	for _, key := range m.Keys {
+		kbpk, err := s.readKBPKFor(sm, UnifiedParams{
+			VaultAddr:  m.vaultAuth.VaultAddress,
+			VaultToken: m.vaultAuth.VaultToken,
+			KeyPath:    key.KeyPath,
+			KeyName:    key.KeyName,
+		})
+		if err != nil {
+			return err
+		}
+		kbpks = append(kbpks, kbpk)
+	}
+
+	// listed drops the items outside states
+	listed := func(item InventoryItem) error {
+		if len(states) > 0 && !slices.Contains(states, item.State) {
+			return nil
+		}
+		return emit(item)
+	}
+	for _, path := range estatePaths(m, EstateRequest{}) {
+		secrets, vErr := scanner.ReadSecrets(path)
+		if vErr != nil {
+			if err := listed(InventoryItem{Path: path, State: KEY_STATE_ACTIVE, Error: vErr.Error()}); err != nil {
+				return err
+			}
+			continue
+		}
+		names := make([]string, 0, len(secrets))
+		for name := range secrets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if isMachineKBPK(m, path, name) {
+				continue
+			}
+			header := tr31.DefaultHeader()
+			if _, err := header.Load(secrets[name]); err != nil {
+				// Other secrets aren't key blocks
+				continue
+			}
+			item := inventoryItem(header)
+			item.Path, item.Name = path, name
+			item.LastRotatedAt = s.lastRotation(ik, path, name)
+			item.State = s.keyStateOf(ik, path, name)
+			item.KCV, err = keyBlockKCV(kbpks, secrets[name])
+			if err != nil {
+				item.Error = err.Error()
+			}
+			if err := listed(item); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, t := range s.store.FindTerminals(ik) {
+		header := tr31.DefaultHeader()
+		if _, err := header.Load(t.KeyBlock); err != nil {
+			if err := listed(InventoryItem{TerminalID: t.TerminalID, State: KEY_STATE_ACTIVE, Error: err.Error()}); err != nil {
+				return err
+			}
+			continue
+		}
+		item := inventoryItem(header)
+		item.TerminalID = t.TerminalID
+		item.KCV = t.KCV
+		item.State = KEY_STATE_ACTIVE
+		createdAt := t.CreatedAt
+		item.CreatedAt = &createdAt
+		if err := listed(item); err != nil {
+			return err
+		}
+	}
+
+	lifecycles, _ := s.GetKeyStates(ik)
+	for _, l := range lifecycles {
+		if l.State == KEY_STATE_DESTROYED {
+			if err := listed(InventoryItem{Path: l.KeyPath, Name: l.KeyName, State: l.State}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// inventoryItem summarizes the header of a key block
+func inventoryItem(header *tr31.Header) InventoryItem {
+	item := InventoryItem{
+		Header: HeaderParams{
+			VersionId:     header.VersionID,
+			KeyUsage:      header.KeyUsage,
+			Algorithm:     header.Algorithm,
+			ModeOfUse:     header.ModeOfUse,
+			KeyVersion:    header.VersionNum,
+			Exportability: header.Exportability,
+		},
+	}
+	blocks := header.GetBlocks()
+	for id := range blocks {
+		item.Blocks = append(item.Blocks, id)
+	}
+	sort.Strings(item.Blocks)
+	if ts, ok := blocks["TS"]; ok {
+		if createdAt, err := time.Parse(timestampLayout, ts); err == nil {
+			item.CreatedAt = &createdAt
+		}
+	}
+	return item
+}
+
+// isMachineKBPK reports whether the secret is one of the machine's KBPKs,
+// paths are compared without their leading and trailing slashes
+func isMachineKBPK(m *Machine, path, name string) bool {
+	path = strings.Trim(path, "/")
+	for _, key := range m.Keys {
+		if strings.Trim(key.KeyPath, "/") == path && key.KeyName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// keyBlockKCV returns the KCV of the key wrapped in the key block by the first KBPK unwrapping it
+func keyBlockKCV(kbpks [][]byte, keyBlock string) (string, error) {
+	for _, kbpk := range kbpks {
+		if kcv, err := unwrapKCV(kbpk, keyBlock); err == nil {
+			return kcv, nil
+		}
+	}
+	return "", errNoKBPKUnwraps
+}
+
+// recordRotation remembers the time a stored key block was re-encrypted
+func (s *service) recordRotation(ik, path, name string, at time.Time) {
+	s.rotations.Store(ik+"/"+path+"/"+name, at)
+}
+
+// lastRotation returns the last time a stored key block was re-encrypted, nil if it never was
+func (s *service) lastRotation(ik, path, name string) *time.Time {
+	if v, ok := s.rotations.Load(ik + "/" + path + "/" + name); ok {
+		at := v.(time.Time)
+		return &at
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_GetInventory(t *testing.T) {
+	s := mockServiceInMock()
+	m := mockTerminalMachine(t, s)
+	sm := s.GetSecretManager()
+
+	kbpk, _ := hex.DecodeString("AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	header, err := tr31.NewHeader("D", "D0", "A", "D", "00", "E")
+	require.NoError(t, err)
+	require.NoError(t, header.Blocks.Set("TS", "20240101120000Z"))
+	kblock, err := tr31.NewKeyBlock(kbpk, header)
+	require.NoError(t, err)
+	pek, err := kblock.WrapHex("ccccccccccccccccdddddddddddddddd", nil)
+	require.NoError(t, err)
+	other, _ := hex.DecodeString("11111111111111112222222222222222")
+	foreign, err := wrapKey(other, "ccccccccccccccccdddddddddddddddd", HeaderParams{
+		VersionId: "D", KeyUsage: "K0", Algorithm: "A", ModeOfUse: "B", KeyVersion: "00", Exportability: "N",
+	}, nil, time.Now())
+	require.NoError(t, err)
+	sm.WriteSecret("secret/tr31", "pek", pek)
+	sm.WriteSecret("secret/tr31", "foreign", foreign.KeyBlock)
+	_, err = s.ProvisionTerminal(m.InitialKey, "K0", "00A1B2C3D4E5F601")
+	require.NoError(t, err)
+
+	inventory, err := s.GetInventory(m.InitialKey)
+	require.NoError(t, err)
+	require.Equal(t, m.InitialKey, inventory.InitialKey)
+	// The KBPK itself isn't a key block and isn't listed
+	require.Len(t, inventory.Items, 3)
+
+	require.Equal(t, "foreign", inventory.Items[0].Name)
+	require.Empty(t, inventory.Items[0].KCV)
+	require.Equal(t, errNoKBPKUnwraps.Error(), inventory.Items[0].Error)
+
+	item := inventory.Items[1]
+	require.Equal(t, "secret/tr31", item.Path)
+	require.Equal(t, "pek", item.Name)
+	require.Equal(t, "D0", item.Header.KeyUsage)
+	require.Equal(t, []string{"TS"}, item.Blocks)
+	require.Equal(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC), *item.CreatedAt)
+	require.Nil(t, item.LastRotatedAt)
+	kcv, err := tr31.KeyCheckValue([]byte{0xcc, 0xcc, 0xcc, 0xcc, 0xcc, 0xcc, 0xcc, 0xcc, 0xdd, 0xdd, 0xdd, 0xdd, 0xdd, 0xdd, 0xdd, 0xdd}, "A")
+	require.NoError(t, err)
+	require.Equal(t, kcv, item.KCV)
+
+	terminal := inventory.Items[2]
+	require.Equal(t, "00A1B2C3D4E5F601", terminal.TerminalID)
+	require.Equal(t, "K0", terminal.Header.KeyUsage)
+	require.Len(t, terminal.KCV, 6)
+	require.NotNil(t, terminal.CreatedAt)
+
+	// Re-encrypted key blocks report their last rotation
+	sm.WriteSecret("secret/tr31", "target", "DDDDDDDDDDDDDDDDEEEEEEEEEEEEEEEEFFFFFFFFFFFFFFFF")
+	_, err = s.ReencryptEstate(m.InitialKey, EstateRequest{
+		Key:       KeyReference{KeyPath: "secret/tr31", KeyName: "kbkp"},
+		TargetKey: KeyReference{KeyPath: "secret/tr31", KeyName: "target"},
+	})
+	require.NoError(t, err)
+	inventory, err = s.GetInventory(m.InitialKey)
+	require.NoError(t, err)
+	require.NotNil(t, inventory.Items[1].LastRotatedAt)
+
+	_, err = s.GetInventory("missing")
+	require.Equal(t, ErrNotFound, err)
+}
+
+func TestRouting_inventory_signed(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	signer, err := NewResponseSigner(key)
+	require.NoError(t, err)
+
+	s := mockServiceInMock()
+	m := mockTerminalMachine(t, s)
+	_, err = s.ProvisionTerminal(m.InitialKey, "K0", "00A1B2C3D4E5F601")
+	require.NoError(t, err)
+	router := MakeHTTPHandler(s, WithResponseSigner(signer))
+
+	req := httptest.NewRequest("GET", "/machines/"+m.InitialKey+"/inventory", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	body, signature := w.Body.Bytes(), w.Header().Get(ResponseSignatureHeader)
+	require.NoError(t, VerifyResponse(body, signature, &key.PublicKey))
+
+	var resp inventoryResponse
+	require.NoError(t, json.Unmarshal(body, &resp))
+	require.Len(t, resp.Inventory.Items, 1)
+	require.Equal(t, "00A1B2C3D4E5F601", resp.Inventory.Items[0].TerminalID)
+
+	// Signatures cover the whole body, so signed inventories aren't streamed
+	req.Header.Set("Accept", "application/x-ndjson")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	require.NoError(t, VerifyResponse(w.Body.Bytes(), w.Header().Get(ResponseSignatureHeader), &key.PublicKey))
+}
+
+func TestRouting_inventory_ndjson(t *testing.T) {
+	s := mockServiceInMock()
+	m := mockTerminalMachine(t, s)
+	for _, id := range []string{"00A1B2C3D4E5F601", "00A1B2C3D4E5F602"} {
+		_, err := s.ProvisionTerminal(m.InitialKey, "K0", id)
+		require.NoError(t, err)
+	}
+	router := MakeHTTPHandler(s)
+
+	req := httptest.NewRequest("GET", "/machines/"+m.InitialKey+"/inventory?state=active", nil)
+	req.Header.Set("Accept", "application/json;q=0.5, application/x-ndjson")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+
+	decoder := json.NewDecoder(w.Body)
+	var terminals []string
+	for decoder.More() {
+		var item InventoryItem
+		require.NoError(t, decoder.Decode(&item))
+		terminals = append(terminals, item.TerminalID)
+	}
+	require.Equal(t, []string{"00A1B2C3D4E5F601", "00A1B2C3D4E5F602"}, terminals)
+
+	// Errors before the first item keep their status
+	req = httptest.NewRequest("GET", "/machines/missing/inventory", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,438 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/moov-io/base"
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+type JobType string
+
+var (
+	// JOB_BATCH_WRAP wraps every supplied key under the KBPK
+	JOB_BATCH_WRAP JobType = "batch_wrap"
+	// JOB_REWRAP unwraps every supplied key block and wraps it again under the target KBPK
+	JOB_REWRAP JobType = "rewrap"
+	// JOB_ROTATION generates a fresh key for every supplied header and wraps it under the KBPK
+	JOB_ROTATION JobType = "rotation"
+)
+
+type JobStatus string
+
+var (
+	JOB_PENDING   JobStatus = "pending"
+	JOB_RUNNING   JobStatus = "running"
+	JOB_COMPLETED JobStatus = "completed"
+	JOB_CANCELLED JobStatus = "cancelled"
+	// JOB_FAILED jobs stopped before processing their items, such as when a KBPK can't be read
+	JOB_FAILED JobStatus = "failed"
+)
+
+// DefaultJobRetention is how long finished jobs and their results are kept
+const DefaultJobRetention = time.Hour
+
+var (
+	errInvalidJobType  = errors.New("Invalid Job Type.")
+	errInvalidJobItems = errors.New("Invalid Job Items.")
+	errJobNotFinished  = errors.New("job is not finished")
+)
+
+// JobItem is a single unit of work of a job
+type JobItem struct {
+	// EncryptKey is the hex encoded key to wrap (batch_wrap)
+	EncryptKey string
+	// KeyBlock is the key block to re-wrap (rewrap)
+	KeyBlock string
+	// Header describes the key block to produce (batch_wrap, rotation)
+	Header HeaderParams
+	// KeyLength is the length in bytes of the generated key (rotation)
+	KeyLength int
+}
+
+// JobRequest describes a job to be run asynchronously
+type JobRequest struct {
+	Type          JobType
+	VaultAddr     string
+	VaultToken    string
+	KeyPath       string
+	KeyName       string
+	TargetKeyPath string
+	TargetKeyName string
+	Items         []JobItem
+	// Tenant is set from the tenant of the request, never from its body
+	Tenant string `json:"-"`
+	// Principal is the caller the usage approver decides for on rewrap jobs,
+	// set from the request like Tenant
+	Principal string `json:"-"`
+}
+
+// JobResult is the outcome of a single job item
+type JobResult struct {
+	Index int    `json:"index"`
+	Data  string `json:"data,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Job is a snapshot of an asynchronous job and its progress
+type Job struct {
+	ID        string    `json:"id"`
+	Type      JobType   `json:"type"`
+	Status    JobStatus `json:"status"`
+	Total     int       `json:"total"`
+	Completed int       `json:"completed"`
+	Failed    int       `json:"failed"`
+	Error     string    `json:"error,omitempty"`
+	// Tenant is the ID of the tenant which created the job, see WithTenants
+	Tenant     string     `json:"tenant,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// job is the mutable state of a running job
+type job struct {
+	mu      sync.RWMutex
+	info    Job
+	results []JobResult
+	cancel  context.CancelFunc
+}
+
+func (j *job) snapshot() *Job {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	info := j.info
+	return &info
+}
+
+func (j *job) record(result JobResult) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if result.Error != "" {
+		j.info.Failed++
+	} else {
+		j.info.Completed++
+	}
+	j.results = append(j.results, result)
+}
+
+// expired reports whether the job finished longer than retention before now
+func (j *job) expired(now time.Time, retention time.Duration) bool {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.info.FinishedAt != nil && now.Sub(*j.info.FinishedAt) >= retention
+}
+
+func (j *job) finish(status JobStatus, err error, now time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.info.Status = status
+	j.info.FinishedAt = &now
+	if err != nil {
+		j.info.Error = err.Error()
+	}
+}
+
+// jobRunner processes one item of a job with the resolved key block protection keys
+type jobRunner func(item JobItem, kbpk, targetKbpk []byte) (string, error)
+
+var _jobRunners = map[JobType]jobRunner{
+	JOB_BATCH_WRAP: runBatchWrap,
+	JOB_REWRAP:     runRewrap,
+	JOB_ROTATION:   runRotation,
+}
+
+func validateJobRequest(req JobRequest) error {
+	if _, exists := _jobRunners[req.Type]; !exists {
+		return errInvalidJobType
+	}
+	if len(req.Items) == 0 {
+		return errInvalidJobItems
+	}
+	if req.KeyPath == "" {
+		return errInvalidKeyPath
+	}
+	if req.KeyName == "" {
+		return errInvalidKeyName
+	}
+	if req.Type == JOB_REWRAP {
+		if req.TargetKeyPath == "" {
+			return errInvalidKeyPath
+		}
+		if req.TargetKeyName == "" {
+			return errInvalidKeyName
+		}
+	}
+	if req.Type == JOB_ROTATION {
+		// Keys are generated by the job, their length is bounded before it starts
+		for i, item := range req.Items {
+			if err := validateGeneratedKeyLength(item.Header.Algorithm, item.KeyLength); err != nil {
+				return fmt.Errorf("%w: item %d: %v", errInvalidJobItems, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// CreateJob validates the request and starts running it in the background
+func (s *service) CreateJob(req JobRequest) (*Job, error) {
+	if err := validateJobRequest(req); err != nil {
+		return nil, err
+	}
+
+	s.evictJobs()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		info: Job{
+			ID:        base.ID(),
+			Type:      req.Type,
+			Status:    JOB_PENDING,
+			Total:     len(req.Items),
+			Tenant:    req.Tenant,
+			CreatedAt: s.now(),
+		},
+		cancel: cancel,
+	}
+	s.jobs.Store(j.info.ID, j)
+
+	go s.runJob(ctx, j, req)
+	return j.snapshot(), nil
+}
+
+// GetJob returns the current status of a job
+func (s *service) GetJob(id string) (*Job, error) {
+	j, err := s.findJob(id)
+	if err != nil {
+		return nil, err
+	}
+	return j.snapshot(), nil
+}
+
+// CancelJob stops a job, items already processed keep their results
+func (s *service) CancelJob(id string) error {
+	j, err := s.findJob(id)
+	if err != nil {
+		return err
+	}
+	j.cancel()
+	return nil
+}
+
+// GetJobResults returns the results of a finished job
+func (s *service) GetJobResults(id string) ([]JobResult, error) {
+	j, err := s.findJob(id)
+	if err != nil {
+		return nil, err
+	}
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	if j.info.FinishedAt == nil {
+		return nil, errJobNotFinished
+	}
+	results := make([]JobResult, len(j.results))
+	copy(results, j.results)
+	return results, nil
+}
+
+// StreamJobResults passes the results of a finished job to emit in order,
+// without copying them, and stops at the first error of emit
+func (s *service) StreamJobResults(id string, emit func(JobResult) error) error {
+	j, err := s.findJob(id)
+	if err != nil {
+		return err
+	}
+	j.mu.RLock()
+	finished := j.info.FinishedAt != nil
+	results := j.results
+	j.mu.RUnlock()
+	if !finished {
+		return errJobNotFinished
+	}
+	// Results aren't recorded once the job finished, so emit runs unlocked
+	for _, result := range results {
+		if err := emit(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *service) findJob(id string) (*job, error) {
+	if v, ok := s.jobs.Load(id); ok {
+		if j, valid := v.(*job); valid && !j.expired(s.now(), s.jobRetention()) {
+			return j, nil
+		}
+		s.jobs.Delete(id)
+	}
+	return nil, ErrNotFound
+}
+
+// ConfigureJobRetention changes how long finished jobs and their results are
+// kept, DefaultJobRetention when zero
+func (s *service) ConfigureJobRetention(retention time.Duration) {
+	s.jobsRetention.Store(int64(retention))
+}
+
+// jobRetention returns how long finished jobs are kept
+func (s *service) jobRetention() time.Duration {
+	if retention := time.Duration(s.jobsRetention.Load()); retention > 0 {
+		return retention
+	}
+	return DefaultJobRetention
+}
+
+// evictJobs forgets the jobs finished longer than the retention ago
+func (s *service) evictJobs() {
+	now, retention := s.now(), s.jobRetention()
+	s.jobs.Range(func(id, v any) bool {
+		if j, valid := v.(*job); !valid || j.expired(now, retention) {
+			s.jobs.Delete(id)
+		}
+		return true
+	})
+}
+
+func (s *service) runJob(ctx context.Context, j *job, req JobRequest) {
+	defer j.cancel()
+
+	j.mu.Lock()
+	j.info.Status = JOB_RUNNING
+	j.mu.Unlock()
+
+	vaultParams := UnifiedParams{
+		VaultAddr:  req.VaultAddr,
+		VaultToken: req.VaultToken,
+		KeyPath:    req.KeyPath,
+		KeyName:    req.KeyName,
+	}
+	// The job runs concurrently with other requests, its secret manager
+	// can't share the credentials of the service one
+	sm, err := s.scopedSecretManagerFor(vaultParams)
+	if err != nil {
+		j.finish(JOB_FAILED, err, s.now())
+		return
+	}
+
+	kbpk, err := s.readKBPKFor(sm, vaultParams)
+	if err != nil {
+		j.finish(JOB_FAILED, err, s.now())
+		return
+	}
+	defer wipe(kbpk)
+	var targetKbpk []byte
+	if req.Type == JOB_REWRAP {
+		vaultParams.KeyPath = req.TargetKeyPath
+		vaultParams.KeyName = req.TargetKeyName
+		targetKbpk, err = s.readKBPKFor(sm, vaultParams)
+		if err != nil {
+			j.finish(JOB_FAILED, err, s.now())
+			return
+		}
+		defer wipe(targetKbpk)
+	}
+
+	runner := _jobRunners[req.Type]
+	for i, item := range req.Items {
+		select {
+		case <-ctx.Done():
+			j.finish(JOB_CANCELLED, nil, s.now())
+			return
+		default:
+		}
+
+		result := JobResult{Index: i}
+		data, err := s.runJobItem(runner, req, item, kbpk, targetKbpk)
+		if err == nil {
+			err = s.logWrapped(data)
+		}
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Data = data
+		}
+		j.record(result)
+	}
+	j.finish(JOB_COMPLETED, nil, s.now())
+}
+
+// runJobItem runs a job item once the policies of the KBPKs accept it
+func (s *service) runJobItem(runner jobRunner, req JobRequest, item JobItem, kbpk, targetKbpk []byte) (string, error) {
+	if req.Type == JOB_REWRAP {
+		params := UnifiedParams{
+			VaultAddr:  req.VaultAddr,
+			VaultToken: req.VaultToken,
+			KeyPath:    req.KeyPath,
+			KeyName:    req.KeyName,
+		}
+		if err := s.approveUsage(req.Principal, item.KeyBlock); err != nil {
+			return "", err
+		}
+		if err := s.checkRewrapPolicy(params, req.TargetKeyPath, req.TargetKeyName, item.KeyBlock); err != nil {
+			return "", err
+		}
+	}
+	return runner(item, kbpk, targetKbpk)
+}
+
+func readKBPK(vault SecretManager, params UnifiedParams) ([]byte, error) {
+	keyStr, err := readKey(vault, params)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(keyStr)
+}
+
+func runBatchWrap(item JobItem, kbpk, _ []byte) (string, error) {
+	header, err := item.Header.Header()
+	if err != nil {
+		return "", err
+	}
+	kblock, err := tr31.New(kbpk, tr31.WithHeader(header))
+	if err != nil {
+		return "", err
+	}
+	return kblock.WrapHex(item.EncryptKey, nil)
+}
+
+func runRewrap(item JobItem, kbpk, targetKbpk []byte) (string, error) {
+	source, err := tr31.New(kbpk)
+	if err != nil {
+		return "", err
+	}
+	key, err := source.Unwrap(item.KeyBlock)
+	if err != nil {
+		return "", err
+	}
+	defer wipe(key)
+	target, err := tr31.New(targetKbpk, tr31.WithHeader(source.GetHeader()))
+	if err != nil {
+		return "", err
+	}
+	return target.Wrap(key, nil)
+}
+
+func runRotation(item JobItem, kbpk, _ []byte) (string, error) {
+	if err := validateGeneratedKeyLength(item.Header.Algorithm, item.KeyLength); err != nil {
+		return "", err
+	}
+	key := make([]byte, item.KeyLength)
+	defer wipe(key)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	header, err := item.Header.Header()
+	if err != nil {
+		return "", err
+	}
+	kblock, err := tr31.New(kbpk, tr31.WithHeader(header))
+	if err != nil {
+		return "", err
+	}
+	return kblock.Wrap(key, nil)
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func waitForJob(t *testing.T, s Service, id string) *Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := s.GetJob(id)
+		require.NoError(t, err)
+		if job.FinishedAt != nil {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+	return nil
+}
+
+func TestService_Jobs_Batch_Wrap_And_Rewrap(t *testing.T) {
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	s.GetSecretManager().WriteSecret("secret/tr31", "target", "DDDDDDDDDDDDDDDDEEEEEEEEEEEEEEEEFFFFFFFFFFFFFFFF")
+
+	header := HeaderParams{
+		VersionId:     "D",
+		KeyUsage:      "D0",
+		Algorithm:     "A",
+		ModeOfUse:     "D",
+		KeyVersion:    "00",
+		Exportability: "E",
+	}
+	job, err := s.CreateJob(JobRequest{
+		Type:       JOB_BATCH_WRAP,
+		VaultAddr:  mockVaultAuthOne().VaultAddress,
+		VaultToken: mockVaultAuthOne().VaultToken,
+		KeyPath:    "secret/tr31",
+		KeyName:    "kbkp",
+		Items: []JobItem{
+			{EncryptKey: "ccccccccccccccccdddddddddddddddd", Header: header},
+			{EncryptKey: "not hex", Header: header},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, job.Total)
+
+	job = waitForJob(t, s, job.ID)
+	require.Equal(t, JOB_COMPLETED, job.Status)
+	require.Equal(t, 1, job.Completed)
+	require.Equal(t, 1, job.Failed)
+
+	results, err := s.GetJobResults(job.ID)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.NotEmpty(t, results[0].Data)
+	require.NotEmpty(t, results[1].Error)
+
+	rewrap, err := s.CreateJob(JobRequest{
+		Type:          JOB_REWRAP,
+		VaultAddr:     mockVaultAuthOne().VaultAddress,
+		VaultToken:    mockVaultAuthOne().VaultToken,
+		KeyPath:       "secret/tr31",
+		KeyName:       "kbkp",
+		TargetKeyPath: "secret/tr31",
+		TargetKeyName: "target",
+		Items:         []JobItem{{KeyBlock: results[0].Data}},
+	})
+	require.NoError(t, err)
+	rewrap = waitForJob(t, s, rewrap.ID)
+	require.Equal(t, 1, rewrap.Completed)
+
+	rewrapped, err := s.GetJobResults(rewrap.ID)
+	require.NoError(t, err)
+	data, err := s.DecryptData(mockVaultAuthOne().VaultAddress, mockVaultAuthOne().VaultToken, "secret/tr31", "target", rewrapped[0].Data, 10)
+	require.NoError(t, err)
+	require.Equal(t, "ccccccccccccccccdddddddddddddddd", data)
+}
+
+func TestService_Jobs_Rewrap_Version_Policy(t *testing.T) {
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	s.GetSecretManager().WriteSecret("secret/tr31", "target", "DDDDDDDDDDDDDDDDEEEEEEEEEEEEEEEEFFFFFFFFFFFFFFFF")
+	keyBlock := "A0088M3TC00E000022BD7EC46BBE2A6A73389D1BA6DB63120B386F912839F4679C0523399E4D8D0F1D9A356E" // gitleaks:allow
+
+	m := NewMachine(Vault{VaultAddress: "http://owner:8200", VaultToken: "owner"})
+	m.AllowedVersions = []string{"D"}
+	m.Keys = []KeyReference{{KeyPath: "secret/tr31", KeyName: "target"}}
+	require.NoError(t, s.CreateMachine(m))
+
+	job, err := s.CreateJob(JobRequest{
+		Type:          JOB_REWRAP,
+		VaultAddr:     mockVaultAuthOne().VaultAddress,
+		VaultToken:    mockVaultAuthOne().VaultToken,
+		KeyPath:       "secret/tr31",
+		KeyName:       "kbkp",
+		TargetKeyPath: "secret/tr31",
+		TargetKeyName: "target",
+		Items:         []JobItem{{KeyBlock: keyBlock}},
+	})
+	require.NoError(t, err)
+	job = waitForJob(t, s, job.ID)
+	require.Equal(t, 1, job.Failed)
+
+	results, err := s.GetJobResults(job.ID)
+	require.NoError(t, err)
+	require.Equal(t, ErrVersionNotAllowed.Error(), results[0].Error)
+}
+
+func TestService_Jobs_Failed(t *testing.T) {
+	s := mockServiceInMock()
+
+	job, err := s.CreateJob(JobRequest{
+		Type:       JOB_ROTATION,
+		VaultAddr:  mockVaultAuthOne().VaultAddress,
+		VaultToken: mockVaultAuthOne().VaultToken,
+		KeyPath:    "secret/tr31",
+		KeyName:    "missing",
+		Items:      []JobItem{{KeyLength: 16}},
+	})
+	require.NoError(t, err)
+
+	job = waitForJob(t, s, job.ID)
+	require.Equal(t, JOB_FAILED, job.Status)
+	require.NotEmpty(t, job.Error)
+	require.Zero(t, job.Completed)
+}
+
+func TestService_Jobs_Retention(t *testing.T) {
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	clock := NewManualClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	s.ConfigureClock(clock)
+	s.ConfigureJobRetention(time.Minute)
+
+	header := HeaderParams{VersionId: "D", KeyUsage: "D0", Algorithm: "A", ModeOfUse: "D", KeyVersion: "00", Exportability: "E"}
+	req := JobRequest{
+		Type:       JOB_ROTATION,
+		VaultAddr:  mockVaultAuthOne().VaultAddress,
+		VaultToken: mockVaultAuthOne().VaultToken,
+		KeyPath:    "secret/tr31",
+		KeyName:    "kbkp",
+		Items:      []JobItem{{KeyLength: 16, Header: header}},
+	}
+	first, err := s.CreateJob(req)
+	require.NoError(t, err)
+	waitForJob(t, s, first.ID)
+
+	// Finished jobs are kept for the retention
+	clock.Advance(30 * time.Second)
+	_, err = s.GetJobResults(first.ID)
+	require.NoError(t, err)
+
+	clock.Advance(30 * time.Second)
+	_, err = s.GetJob(first.ID)
+	require.Equal(t, ErrNotFound, err)
+
+	// Creating a job evicts the expired ones
+	second, err := s.CreateJob(req)
+	require.NoError(t, err)
+	waitForJob(t, s, second.ID)
+	clock.Advance(time.Minute)
+	third, err := s.CreateJob(req)
+	require.NoError(t, err)
+	waitForJob(t, s, third.ID)
+
+	impl, ok := s.(*service)
+	require.True(t, ok)
+	_, found := impl.jobs.Load(second.ID)
+	require.False(t, found)
+}
+
+func TestService_Jobs_Errors(t *testing.T) {
+	s := mockServiceInMock()
+
+	_, err := s.CreateJob(JobRequest{Type: "unknown", Items: []JobItem{{}}})
+	require.Equal(t, errInvalidJobType, err)
+
+	_, err = s.CreateJob(JobRequest{Type: JOB_ROTATION, KeyPath: "secret/tr31", KeyName: "kbkp"})
+	require.Equal(t, errInvalidJobItems, err)
+
+	_, err = s.CreateJob(JobRequest{Type: JOB_REWRAP, KeyPath: "secret/tr31", KeyName: "kbkp", Items: []JobItem{{}}})
+	require.Equal(t, errInvalidKeyPath, err)
+
+	// Generated keys are bounded by their algorithm before the job starts
+	aes := HeaderParams{VersionId: "D", KeyUsage: "D0", Algorithm: "A", ModeOfUse: "D", KeyVersion: "00", Exportability: "E"}
+	for _, item := range []JobItem{{KeyLength: 0}, {KeyLength: 1 << 40}, {KeyLength: 20, Header: aes}, {KeyLength: 64, Header: aes}} {
+		_, err = s.CreateJob(JobRequest{Type: JOB_ROTATION, KeyPath: "secret/tr31", KeyName: "kbkp", Items: []JobItem{item}})
+		require.ErrorIs(t, err, errInvalidJobItems)
+	}
+
+	_, err = s.GetJob("missing")
+	require.Equal(t, ErrNotFound, err)
+	require.Equal(t, ErrNotFound, s.CancelJob("missing"))
+	_, err = s.GetJobResults("missing")
+	require.Equal(t, ErrNotFound, err)
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyState is a state of the lifecycle of a key, after NIST SP 800-57 Part 1
+type KeyState string
+
+var (
+	// KEY_STATE_PRE_ACTIVATION keys are generated but not yet authorized for use
+	KEY_STATE_PRE_ACTIVATION KeyState = "pre-activation"
+	// KEY_STATE_ACTIVE keys protect and process data, stored keys are active unless changed
+	KEY_STATE_ACTIVE KeyState = "active"
+	// KEY_STATE_SUSPENDED keys are temporarily not used, such as during an investigation
+	KEY_STATE_SUSPENDED KeyState = "suspended"
+	// KEY_STATE_DEACTIVATED keys only process data they protected before, such as to unwrap it
+	KEY_STATE_DEACTIVATED KeyState = "deactivated"
+	// KEY_STATE_COMPROMISED keys are known or suspected to be disclosed and are no longer used
+	KEY_STATE_COMPROMISED KeyState = "compromised"
+	// KEY_STATE_DESTROYED keys are deleted, only their lifecycle is kept
+	KEY_STATE_DESTROYED KeyState = "destroyed"
+)
+
+// keyStateTransitions lists the states each state may change to
+var keyStateTransitions = map[KeyState][]KeyState{
+	KEY_STATE_PRE_ACTIVATION: {KEY_STATE_ACTIVE, KEY_STATE_COMPROMISED, KEY_STATE_DESTROYED},
+	KEY_STATE_ACTIVE:         {KEY_STATE_SUSPENDED, KEY_STATE_DEACTIVATED, KEY_STATE_COMPROMISED},
+	KEY_STATE_SUSPENDED:      {KEY_STATE_ACTIVE, KEY_STATE_DEACTIVATED, KEY_STATE_COMPROMISED},
+	KEY_STATE_DEACTIVATED:    {KEY_STATE_COMPROMISED, KEY_STATE_DESTROYED},
+	KEY_STATE_COMPROMISED:    {KEY_STATE_DESTROYED},
+	KEY_STATE_DESTROYED:      {},
+}
+
+var (
+	// ErrKeyStateTransition is returned for key state changes the lifecycle doesn't allow
+	ErrKeyStateTransition = errors.New("key state transition is not allowed")
+	// ErrKeyNotUsable is returned when the state of a key doesn't allow its use
+	ErrKeyNotUsable = errors.New("key state doesn't allow its use")
+
+	errInvalidKeyState = errors.New("Invalid Key State.")
+)
+
+// ParseKeyState returns the key state named s
+func ParseKeyState(s string) (KeyState, error) {
+	state := KeyState(strings.ToLower(strings.TrimSpace(s)))
+	if _, ok := keyStateTransitions[state]; !ok {
+		return "", fmt.Errorf("%w: unknown state %q", errInvalidKeyState, s)
+	}
+	return state, nil
+}
+
+// KeyStateChange is a change of the state of a key
+type KeyStateChange struct {
+	From   KeyState  `json:"from"`
+	To     KeyState  `json:"to"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// KeyLifecycle is the state of a key stored under a machine and the changes
+// which led to it
+type KeyLifecycle struct {
+	InitialKey string   `json:"initialKey"`
+	KeyPath    string   `json:"keyPath"`
+	KeyName    string   `json:"keyName"`
+	State      KeyState `json:"state"`
+	// UpdatedAt is the time of the last change, nil for keys which never changed state
+	UpdatedAt *time.Time       `json:"updatedAt,omitempty"`
+	History   []KeyStateChange `json:"history,omitempty"`
+}
+
+// keyLifecycle is the mutable lifecycle of a key
+type keyLifecycle struct {
+	mu   sync.Mutex
+	info KeyLifecycle
+}
+
+func (l *keyLifecycle) snapshot() *KeyLifecycle {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	info := l.info
+	info.History = slices.Clone(l.info.History)
+	return &info
+}
+
+func keyStateKey(ik, path, name string) string {
+	return ik + "/" + path + "/" + name
+}
+
+// keyStateOf returns the state of a stored key, KEY_STATE_ACTIVE for keys which never changed state
+func (s *service) keyStateOf(ik, path, name string) KeyState {
+	if v, ok := s.keyStates.Load(keyStateKey(ik, path, name)); ok {
+		return v.(*keyLifecycle).snapshot().State
+	}
+	return KEY_STATE_ACTIVE
+}
+
+// GetKeyState returns the lifecycle of a key stored under the machine
+func (s *service) GetKeyState(ik, path, name string) (*KeyLifecycle, error) {
+	if _, err := s.GetMachine(ik); err != nil {
+		return nil, err
+	}
+	if v, ok := s.keyStates.Load(keyStateKey(ik, path, name)); ok {
+		return v.(*keyLifecycle).snapshot(), nil
+	}
+	return &KeyLifecycle{InitialKey: ik, KeyPath: path, KeyName: name, State: KEY_STATE_ACTIVE}, nil
+}
+
+// GetKeyStates returns the lifecycles of the keys of the machine which changed
+// state, sorted by path and name
+func (s *service) GetKeyStates(ik string) ([]*KeyLifecycle, error) {
+	if _, err := s.GetMachine(ik); err != nil {
+		return nil, err
+	}
+	lifecycles := []*KeyLifecycle{}
+	s.keyStates.Range(func(_, value interface{}) bool {
+		if l := value.(*keyLifecycle).snapshot(); l.InitialKey == ik {
+			lifecycles = append(lifecycles, l)
+		}
+		return true
+	})
+	sort.Slice(lifecycles, func(i, j int) bool {
+		if lifecycles[i].KeyPath != lifecycles[j].KeyPath {
+			return lifecycles[i].KeyPath < lifecycles[j].KeyPath
+		}
+		return lifecycles[i].KeyName < lifecycles[j].KeyName
+	})
+	return lifecycles, nil
+}
+
+// ChangeKeyState moves a key stored under the machine to state, if its
+// lifecycle allows the transition, and records the reason in the audit log.
+// Destroyed keys are deleted from the secret manager, the machine's KBPKs can't
+// be destroyed.
+func (s *service) ChangeKeyState(ik, path, name string, state KeyState, reason string) (_ *KeyLifecycle, err error) {
+	defer func() {
+		s.auditKeyState(ik, path, name, state, reason, err)
+	}()
+	if _, ok := keyStateTransitions[state]; !ok {
+		return nil, fmt.Errorf("%w: unknown state %q", errInvalidKeyState, state)
+	}
+	if strings.TrimSpace(reason) == "" {
+		return nil, fmt.Errorf("%w: a reason is required", errInvalidKeyState)
+	}
+	m, err := s.GetMachine(ik)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.validateKeyReferences([]KeyReference{{KeyPath: path, KeyName: name}}); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidKeyState, err)
+	}
+	if state == KEY_STATE_DESTROYED && isMachineKBPK(m, path, name) {
+		return nil, fmt.Errorf("%w: %s/%s is a KBPK of the machine", ErrKeyStateTransition, path, name)
+	}
+	sm, err := s.scopedSecretManagerOf(m)
+	if err != nil {
+		return nil, err
+	}
+
+	s.keyStateMu.Lock()
+	defer s.keyStateMu.Unlock()
+	l := &keyLifecycle{info: KeyLifecycle{InitialKey: ik, KeyPath: path, KeyName: name, State: KEY_STATE_ACTIVE}}
+	if v, ok := s.keyStates.Load(keyStateKey(ik, path, name)); ok {
+		l = v.(*keyLifecycle)
+	}
+	from := l.snapshot().State
+	if !slices.Contains(keyStateTransitions[from], state) {
+		return nil, fmt.Errorf("%w: %s to %s", ErrKeyStateTransition, from, state)
+	}
+	if !secretExists(sm, path, name) {
+		return nil, ErrNotFound
+	}
+	if state == KEY_STATE_DESTROYED {
+		if vErr := sm.DeleteSecret(path, name); vErr != nil {
+			return nil, vErr
+		}
+	}
+
+	now := s.now()
+	l.mu.Lock()
+	l.info.State = state
+	l.info.UpdatedAt = &now
+	l.info.History = append(l.info.History, KeyStateChange{From: from, To: state, Reason: reason, Time: now})
+	l.mu.Unlock()
+	s.keyStates.Store(keyStateKey(ik, path, name), l)
+	return l.snapshot(), nil
+}
+
+// checkKeyUsable returns ErrKeyNotUsable unless the stored key is active or
+// deactivated, deactivated keys still process the data they protected before
+func (s *service) checkKeyUsable(ik, path, name string) error {
+	if state := s.keyStateOf(ik, path, name); state != KEY_STATE_ACTIVE && state != KEY_STATE_DEACTIVATED {
+		return fmt.Errorf("%w: %s/%s is %s", ErrKeyNotUsable, path, name, state)
+	}
+	return nil
+}
+
+func (s *service) auditKeyState(ik, path, name string, state KeyState, reason string, err error) {
+	l := s.auditLog.Load()
+	if l == nil {
+		return
+	}
+	r := AuditRecord{
+		Time:      s.now().UTC(),
+		Operation: AUDIT_OPERATION_CHANGE_KEY_STATE,
+		Subject:   ik + "/" + path + "/" + name,
+		State:     string(state),
+		Reason:    reason,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	l.Record(r)
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_ChangeKeyState(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := NewAuditLog(path, NewLocalAuditSigner(key), AuditConfig{}, nil)
+	require.NoError(t, err)
+
+	s := mockServiceInMock()
+	s.ConfigureAuditLog(l)
+	m := mockTerminalMachine(t, s)
+	sm := s.GetSecretManager()
+	sm.WriteSecret("secret/tr31", "pek", "DDDDDDDDDDDDDDDDEEEEEEEEEEEEEEEEFFFFFFFFFFFFFFFF")
+
+	lifecycle, err := s.GetKeyState(m.InitialKey, "secret/tr31", "pek")
+	require.NoError(t, err)
+	require.Equal(t, KEY_STATE_ACTIVE, lifecycle.State)
+	require.Nil(t, lifecycle.UpdatedAt)
+
+	for _, state := range []KeyState{KEY_STATE_SUSPENDED, KEY_STATE_ACTIVE, KEY_STATE_DEACTIVATED} {
+		lifecycle, err = s.ChangeKeyState(m.InitialKey, "secret/tr31", "pek", state, "INC-2041")
+		require.NoError(t, err)
+		require.Equal(t, state, lifecycle.State)
+	}
+	_, err = s.ChangeKeyState(m.InitialKey, "secret/tr31", "pek", KEY_STATE_ACTIVE, "reuse")
+	require.ErrorIs(t, err, ErrKeyStateTransition)
+	_, err = s.ChangeKeyState(m.InitialKey, "secret/tr31", "pek", KEY_STATE_DESTROYED, " ")
+	require.ErrorIs(t, err, errInvalidKeyState)
+
+	lifecycle, err = s.ChangeKeyState(m.InitialKey, "secret/tr31", "pek", KEY_STATE_DESTROYED, "end of cryptoperiod")
+	require.NoError(t, err)
+	require.Len(t, lifecycle.History, 4)
+	require.Equal(t, KEY_STATE_DEACTIVATED, lifecycle.History[3].From)
+	require.Equal(t, "end of cryptoperiod", lifecycle.History[3].Reason)
+	_, vErr := sm.ReadSecret("secret/tr31", "pek")
+	require.Error(t, vErr)
+
+	// The machine KBPK can't be destroyed, missing keys and machines aren't found
+	_, err = s.ChangeKeyState(m.InitialKey, "secret/tr31", "kbkp", KEY_STATE_DEACTIVATED, "rotated")
+	require.NoError(t, err)
+	_, err = s.ChangeKeyState(m.InitialKey, "secret/tr31", "kbkp", KEY_STATE_DESTROYED, "rotated")
+	require.ErrorIs(t, err, ErrKeyStateTransition)
+	_, err = s.ChangeKeyState(m.InitialKey, "secret/tr31", "missing", KEY_STATE_SUSPENDED, "INC-2041")
+	require.Equal(t, ErrNotFound, err)
+	_, err = s.ChangeKeyState("missing", "secret/tr31", "pek", KEY_STATE_SUSPENDED, "INC-2041")
+	require.Equal(t, ErrNotFound, err)
+	_, err = s.ChangeKeyState(m.InitialKey, "secret/tr31", "pek", "retired", "INC-2041")
+	require.ErrorIs(t, err, errInvalidKeyState)
+
+	lifecycles, err := s.GetKeyStates(m.InitialKey)
+	require.NoError(t, err)
+	require.Len(t, lifecycles, 2)
+	require.Equal(t, "kbkp", lifecycles[0].KeyName)
+	require.Equal(t, "pek", lifecycles[1].KeyName)
+
+	require.NoError(t, l.Close())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var records []AuditRecord
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var batch SignedAuditBatch
+		require.NoError(t, json.Unmarshal(line, &batch))
+		records = append(records, batch.Records...)
+	}
+	var changes []AuditRecord
+	for _, r := range records {
+		if r.Operation == AUDIT_OPERATION_CHANGE_KEY_STATE {
+			changes = append(changes, r)
+		}
+	}
+	require.Equal(t, m.InitialKey+"/secret/tr31/pek", changes[0].Subject)
+	require.Equal(t, "suspended", changes[0].State)
+	require.Equal(t, "INC-2041", changes[0].Reason)
+	require.Empty(t, changes[0].Error)
+	require.Equal(t, "active", changes[3].State)
+	require.NotEmpty(t, changes[3].Error)
+}
+
+func TestService_ManagedKeyState(t *testing.T) {
+	s := mockServiceInMock()
+	m := mockTerminalMachine(t, s)
+	key := bytes.Repeat([]byte{0x5a}, 16)
+	k, err := s.RegisterManagedKey(m.InitialKey, ManagedKeyRequest{Key: key, Algorithm: tr31.ENC_ALGORITHM_AES})
+	require.NoError(t, err)
+	path := managedKeyPath(m, k.ID)
+
+	_, err = s.ChangeKeyState(m.InitialKey, path, managedKeyName, KEY_STATE_SUSPENDED, "INC-2041")
+	require.NoError(t, err)
+	_, _, err = s.GetManagedKey(m.InitialKey, k.ID)
+	require.ErrorIs(t, err, ErrKeyNotUsable)
+
+	_, err = s.ChangeKeyState(m.InitialKey, path, managedKeyName, KEY_STATE_ACTIVE, "INC-2041 closed")
+	require.NoError(t, err)
+	got, _, err := s.GetManagedKey(m.InitialKey, k.ID)
+	require.NoError(t, err)
+	require.Equal(t, key, got)
+
+	require.NoError(t, s.DestroyManagedKey(m.InitialKey, k.ID))
+	lifecycle, err := s.GetKeyState(m.InitialKey, path, managedKeyName)
+	require.NoError(t, err)
+	require.Equal(t, KEY_STATE_DESTROYED, lifecycle.State)
+	require.Len(t, lifecycle.History, 4)
+	require.Equal(t, KEY_STATE_DEACTIVATED, lifecycle.History[2].To)
+	require.Equal(t, ErrNotFound, s.DestroyManagedKey(m.InitialKey, k.ID))
+
+	inventory, err := s.GetInventory(m.InitialKey, KEY_STATE_DESTROYED)
+	require.NoError(t, err)
+	require.Len(t, inventory.Items, 1)
+	require.Equal(t, path, inventory.Items[0].Path)
+	require.Equal(t, KEY_STATE_DESTROYED, inventory.Items[0].State)
+}
+
+func TestRouting_keyStates(t *testing.T) {
+	s := mockServiceInMock()
+	m := mockTerminalMachine(t, s)
+	kbpk, _ := hex.DecodeString("AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	pek, err := wrapKey(kbpk, "ccccccccccccccccdddddddddddddddd", HeaderParams{
+		VersionId: "D", KeyUsage: "P0", Algorithm: "A", ModeOfUse: "E", KeyVersion: "00", Exportability: "E",
+	}, nil, time.Now())
+	require.NoError(t, err)
+	s.GetSecretManager().WriteSecret("secret/tr31", "pek", pek.KeyBlock)
+	router := MakeHTTPHandler(s)
+
+	change := func(state string) *httptest.ResponseRecorder {
+		body := `{"KeyPath":"secret/tr31","KeyName":"pek","State":"` + state + `","Reason":"INC-2041"}`
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/machine/"+m.InitialKey+"/key_states", strings.NewReader(body)))
+		return w
+	}
+	w := change("suspended")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp keyStateResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Equal(t, KEY_STATE_SUSPENDED, resp.KeyState.State)
+
+	w = change("pre-activation")
+	require.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+	require.Contains(t, w.Body.String(), ERROR_CODE_KEY_STATE_TRANSITION)
+	w = change("unknown")
+	require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/machine/"+m.InitialKey+"/key_states", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var list keyStatesResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.KeyStates, 1)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/machines/"+m.InitialKey+"/inventory?state=suspended", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var inventory inventoryResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &inventory))
+	require.Len(t, inventory.Inventory.Items, 1)
+	require.Equal(t, "pek", inventory.Inventory.Items[0].Name)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/machines/"+m.InitialKey+"/inventory?state=retired", nil))
+	require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+}
@@ -0,0 +1,350 @@
+package server
+
+import (
+	"cmp"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/moov-io/base/log"
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+// KMIP operations, object types, key formats, algorithms and results
+const (
+	kmipOperationRegister int32 = 0x03
+	kmipOperationGet      int32 = 0x0A
+	kmipOperationDestroy  int32 = 0x14
+
+	kmipObjectSymmetricKey int32 = 0x02
+	kmipKeyFormatRaw       int32 = 0x01
+
+	kmipAlgorithmDES       int32 = 0x01
+	kmipAlgorithmTripleDES int32 = 0x02
+	kmipAlgorithmAES       int32 = 0x03
+
+	kmipResultSuccess         int32 = 0x00
+	kmipResultOperationFailed int32 = 0x01
+
+	kmipReasonItemNotFound              int32 = 0x01
+	kmipReasonInvalidMessage            int32 = 0x04
+	kmipReasonOperationNotSupported     int32 = 0x05
+	kmipReasonInvalidField              int32 = 0x07
+	kmipReasonCryptographicFailure      int32 = 0x0A
+	kmipReasonPermissionDenied          int32 = 0x0C
+	kmipReasonKeyFormatTypeNotSupported int32 = 0x10
+	kmipReasonGeneralFailure            int32 = 0x100
+)
+
+// _kmipAlgorithms maps KMIP cryptographic algorithms to key block algorithms
+var _kmipAlgorithms = map[int32]string{
+	kmipAlgorithmDES:       tr31.ENC_ALGORITHM_DES,
+	kmipAlgorithmTripleDES: tr31.ENC_ALGORITHM_TRIPLE_DES,
+	kmipAlgorithmAES:       tr31.ENC_ALGORITHM_AES,
+}
+
+// kmipError is a failed batch item, with its KMIP result reason
+type kmipError struct {
+	reason  int32
+	message string
+}
+
+func (e *kmipError) Error() string {
+	return e.message
+}
+
+// KMIPConfig configures the KMIP facade
+type KMIPConfig struct {
+	// Machine is the initial key of the machine whose first KBPK wraps the managed keys
+	Machine string
+	// KeyUsage is the key usage of registered keys, "D0" when empty
+	KeyUsage string
+	// IdleTimeout closes connections idle for longer, 5 minutes when zero
+	IdleTimeout time.Duration
+	// Clock stamps the response headers, SystemClock when nil
+	Clock Clock
+}
+
+// KMIPServer is a minimal KMIP facade, so enterprise key managers speaking only
+// KMIP can register, get and destroy symmetric keys. Keys are stored as key
+// blocks wrapped under the KBPK of the configured machine, see
+// Service.RegisterManagedKey. It speaks the TTLV encoding of KMIP 1.x, and
+// callers are expected to authenticate with TLS client certificates, see
+// Listen and AUTH_MTLS.
+type KMIPServer struct {
+	svc    Service
+	config KMIPConfig
+	logger log.Logger
+
+	mu     sync.Mutex
+	ln     net.Listener
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// NewKMIPServer creates a KMIP facade of the service
+func NewKMIPServer(s Service, config KMIPConfig, logger log.Logger) *KMIPServer {
+	config.Clock = clockOrSystem(config.Clock)
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = 5 * time.Minute
+	}
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &KMIPServer{svc: s, config: config, logger: logger, conns: make(map[net.Conn]struct{})}
+}
+
+// Serve answers the KMIP requests of the connections accepted on ln, until Close
+func (k *KMIPServer) Serve(ln net.Listener) error {
+	k.mu.Lock()
+	if k.closed {
+		k.mu.Unlock()
+		return net.ErrClosed
+	}
+	k.ln = ln
+	k.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			k.mu.Lock()
+			closed := k.closed
+			k.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go k.ServeConn(conn)
+	}
+}
+
+// Close stops accepting connections and closes those open
+func (k *KMIPServer) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.closed = true
+	for conn := range k.conns {
+		conn.Close()
+	}
+	if k.ln != nil {
+		return k.ln.Close()
+	}
+	return nil
+}
+
+// ServeConn answers the KMIP requests of a connection until it is closed
+func (k *KMIPServer) ServeConn(conn net.Conn) {
+	k.mu.Lock()
+	k.conns[conn] = struct{}{}
+	k.mu.Unlock()
+	defer func() {
+		k.mu.Lock()
+		delete(k.conns, conn)
+		k.mu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(k.config.IdleTimeout))
+		request, err := readTTLV(conn)
+		if err != nil {
+			if errors.Is(err, errInvalidTTLV) {
+				k.logger.LogErrorf("kmip: %v", err)
+				conn.Write(k.failure(kmipReasonInvalidMessage, err.Error()).encode())
+			}
+			return
+		}
+		response := k.handle(request, kmipPrincipal(conn))
+		encoded := response.encode()
+		_, err = conn.Write(encoded)
+		// Byte strings carry key material
+		request.wipe()
+		response.wipe()
+		wipe(encoded)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// kmipPrincipal identifies the caller of a connection by the common name of its
+// TLS client certificate, like PrincipalFromClientCert
+func kmipPrincipal(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
+
+// handle answers a request message of principal
+func (k *KMIPServer) handle(request ttlv, principal string) ttlv {
+	header, _ := request.child(kmipTagRequestHeader)
+	if request.tag != kmipTagRequestMessage {
+		return k.failure(kmipReasonInvalidMessage, "expecting a request message")
+	}
+	version, hasVersion := header.child(kmipTagProtocolVersion)
+	if !hasVersion {
+		return k.failure(kmipReasonInvalidMessage, "request header has no protocol version")
+	}
+
+	items := request.childrenOf(kmipTagBatchItem)
+	response := ttlvStruct(kmipTagResponseMessage, k.responseHeader(version, len(items)))
+	for _, item := range items {
+		response.children = append(response.children, k.handleItem(item, principal))
+	}
+	return response
+}
+
+func (k *KMIPServer) responseHeader(version ttlv, batchCount int) ttlv {
+	return ttlvStruct(kmipTagResponseHeader,
+		version,
+		ttlvTime(kmipTagTimeStamp, k.config.Clock.Now()),
+		ttlvInt(kmipTagBatchCount, int32(batchCount)),
+	)
+}
+
+// failure answers a message which couldn't be read with a single failed batch
+// item, under protocol version 1.0
+func (k *KMIPServer) failure(reason int32, message string) ttlv {
+	version := ttlvStruct(kmipTagProtocolVersion, ttlvInt(kmipTagProtocolVersionMajor, 1), ttlvInt(kmipTagProtocolVersionMinor, 0))
+	return ttlvStruct(kmipTagResponseMessage,
+		k.responseHeader(version, 1),
+		ttlvStruct(kmipTagBatchItem,
+			ttlvEnum(kmipTagResultStatus, kmipResultOperationFailed),
+			ttlvEnum(kmipTagResultReason, reason),
+			ttlvText(kmipTagResultMessage, message),
+		),
+	)
+}
+
+// handleItem runs the operation of a batch item
+func (k *KMIPServer) handleItem(item ttlv, principal string) ttlv {
+	operation, _ := item.int(kmipTagOperation)
+	payload, _ := item.child(kmipTagRequestPayload)
+
+	var result ttlv
+	var err error
+	switch operation {
+	case kmipOperationRegister:
+		result, err = k.register(payload)
+	case kmipOperationGet:
+		result, err = k.get(payload, principal)
+	case kmipOperationDestroy:
+		result, err = k.destroy(payload)
+	default:
+		err = &kmipError{kmipReasonOperationNotSupported, "only Register, Get and Destroy are supported"}
+	}
+
+	response := ttlvStruct(kmipTagBatchItem, ttlvEnum(kmipTagOperation, operation))
+	if id, ok := item.child(kmipTagUniqueBatchItemID); ok {
+		response.children = append(response.children, id)
+	}
+	if err != nil {
+		reason, message := kmipReasonOf(err)
+		k.logger.Info().Logf("kmip: operation %d failed: %s", operation, message)
+		response.children = append(response.children,
+			ttlvEnum(kmipTagResultStatus, kmipResultOperationFailed),
+			ttlvEnum(kmipTagResultReason, reason),
+			ttlvText(kmipTagResultMessage, message),
+		)
+		return response
+	}
+	response.children = append(response.children, ttlvEnum(kmipTagResultStatus, kmipResultSuccess), result)
+	return response
+}
+
+// register wraps and stores a raw symmetric key
+func (k *KMIPServer) register(payload ttlv) (ttlv, error) {
+	if objectType, _ := payload.int(kmipTagObjectType); objectType != kmipObjectSymmetricKey {
+		return ttlv{}, &kmipError{kmipReasonInvalidField, "only symmetric keys can be registered"}
+	}
+	symmetricKey, _ := payload.child(kmipTagSymmetricKey)
+	keyBlock, _ := symmetricKey.child(kmipTagKeyBlock)
+	if format, _ := keyBlock.int(kmipTagKeyFormatType); format != kmipKeyFormatRaw {
+		return ttlv{}, &kmipError{kmipReasonKeyFormatTypeNotSupported, "only raw keys are supported"}
+	}
+	kmipAlgorithm, _ := keyBlock.int(kmipTagCryptographicAlgorithm)
+	algorithm, exists := _kmipAlgorithms[kmipAlgorithm]
+	if !exists {
+		return ttlv{}, &kmipError{kmipReasonInvalidField, "only DES, TDES and AES keys are supported"}
+	}
+	keyValue, _ := keyBlock.child(kmipTagKeyValue)
+	material, _ := keyValue.child(kmipTagKeyMaterial)
+	key, ok := material.value.([]byte)
+	if !ok || len(key) == 0 {
+		return ttlv{}, &kmipError{kmipReasonInvalidField, "the key block has no key material"}
+	}
+
+	managed, err := k.svc.RegisterManagedKey(k.config.Machine, ManagedKeyRequest{
+		Key:       key,
+		Algorithm: algorithm,
+		KeyUsage:  cmp.Or(k.config.KeyUsage, defaultManagedKeyUsage),
+	})
+	if err != nil {
+		return ttlv{}, err
+	}
+	return ttlvStruct(kmipTagResponsePayload, ttlvText(kmipTagUniqueIdentifier, managed.ID)), nil
+}
+
+// get returns a managed key in raw format, when the usage approver allows principal
+func (k *KMIPServer) get(payload ttlv, principal string) (ttlv, error) {
+	id, _ := payload.text(kmipTagUniqueIdentifier)
+	key, managed, err := k.svc.GetManagedKey(k.config.Machine, id, AsPrincipal(principal))
+	if err != nil {
+		return ttlv{}, err
+	}
+	var kmipAlgorithm int32
+	for a, algorithm := range _kmipAlgorithms {
+		if algorithm == managed.Algorithm {
+			kmipAlgorithm = a
+		}
+	}
+	return ttlvStruct(kmipTagResponsePayload,
+		ttlvEnum(kmipTagObjectType, kmipObjectSymmetricKey),
+		ttlvText(kmipTagUniqueIdentifier, id),
+		ttlvStruct(kmipTagSymmetricKey,
+			ttlvStruct(kmipTagKeyBlock,
+				ttlvEnum(kmipTagKeyFormatType, kmipKeyFormatRaw),
+				ttlvStruct(kmipTagKeyValue, ttlvBytes(kmipTagKeyMaterial, key)),
+				ttlvEnum(kmipTagCryptographicAlgorithm, kmipAlgorithm),
+				ttlvInt(kmipTagCryptographicLength, int32(len(key)*8)),
+			),
+		),
+	), nil
+}
+
+// destroy deletes a managed key
+func (k *KMIPServer) destroy(payload ttlv) (ttlv, error) {
+	id, _ := payload.text(kmipTagUniqueIdentifier)
+	if err := k.svc.DestroyManagedKey(k.config.Machine, id); err != nil {
+		return ttlv{}, err
+	}
+	return ttlvStruct(kmipTagResponsePayload, ttlvText(kmipTagUniqueIdentifier, id)), nil
+}
+
+// kmipReasonOf maps service errors to KMIP result reasons
+func kmipReasonOf(err error) (int32, string) {
+	var kErr *kmipError
+	var headerErr *tr31.HeaderError
+	var keyBlockErr *tr31.KeyBlockError
+	switch {
+	case errors.As(err, &kErr):
+		return kErr.reason, kErr.message
+	case errors.Is(err, ErrNotFound):
+		return kmipReasonItemNotFound, "object not found"
+	case errors.Is(err, ErrQuotaExceeded), errors.Is(err, ErrClearKeyNotAllowed), errors.Is(err, ErrUsageNotApproved):
+		return kmipReasonPermissionDenied, err.Error()
+	case errors.Is(err, errInvalidManagedKey), errors.As(err, &headerErr):
+		return kmipReasonInvalidField, err.Error()
+	case errors.As(err, &keyBlockErr):
+		return kmipReasonCryptographicFailure, err.Error()
+	}
+	return kmipReasonGeneralFailure, "general failure"
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTTLV(t *testing.T) {
+	// Integer 8 of the KMIP 1.4 TTLV encoding examples
+	require.Equal(t, "42002002000000040000000800000000", hex.EncodeToString(ttlvInt(0x420020, 8).encode()))
+	require.Equal(t, "420020070000000b48656c6c6f20576f726c640000000000", hex.EncodeToString(ttlvText(0x420020, "Hello World").encode()))
+
+	item := ttlvStruct(kmipTagRequestMessage,
+		ttlvInt(kmipTagBatchCount, 2),
+		ttlvEnum(kmipTagOperation, kmipOperationGet),
+		ttlvText(kmipTagUniqueIdentifier, "abc"),
+		ttlvBytes(kmipTagKeyMaterial, []byte{1, 2, 3}),
+		ttlvTime(kmipTagTimeStamp, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)),
+		ttlv{tag: kmipTagBatchItem, typ: ttlvBoolean, value: true},
+		ttlv{tag: kmipTagBatchItem, typ: ttlvLongInteger, value: int64(-5)},
+	)
+	decoded, err := readTTLV(bytes.NewReader(item.encode()))
+	require.NoError(t, err)
+	require.Equal(t, item, decoded)
+
+	_, err = readTTLV(bytes.NewReader(ttlvInt(kmipTagBatchCount, 1).encode()))
+	require.ErrorIs(t, err, errInvalidTTLV)
+	truncated := ttlvStruct(kmipTagRequestMessage, ttlvText(kmipTagUniqueIdentifier, "abc")).encode()
+	truncated[7] = 4
+	_, err = readTTLV(bytes.NewReader(truncated[:12]))
+	require.ErrorIs(t, err, errInvalidTTLV)
+}
+
+func TestKMIPServer(t *testing.T) {
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	m := NewMachine(mockVaultAuthOne())
+	m.Keys = []KeyReference{{KeyPath: "secret/tr31", KeyName: "kbkp"}}
+	require.NoError(t, s.CreateMachine(m))
+
+	kmip := NewKMIPServer(s, KMIPConfig{Machine: m.InitialKey}, nil)
+	client, conn := net.Pipe()
+	go kmip.ServeConn(conn)
+	defer client.Close()
+
+	call := func(operation int32, payload ...ttlv) ttlv {
+		request := ttlvStruct(kmipTagRequestMessage,
+			ttlvStruct(kmipTagRequestHeader,
+				ttlvStruct(kmipTagProtocolVersion, ttlvInt(kmipTagProtocolVersionMajor, 1), ttlvInt(kmipTagProtocolVersionMinor, 4)),
+				ttlvInt(kmipTagBatchCount, 1),
+			),
+			ttlvStruct(kmipTagBatchItem,
+				ttlvEnum(kmipTagOperation, operation),
+				ttlvStruct(kmipTagRequestPayload, payload...),
+			),
+		)
+		_, err := client.Write(request.encode())
+		require.NoError(t, err)
+		response, err := readTTLV(client)
+		require.NoError(t, err)
+		require.Equal(t, kmipTagResponseMessage, response.tag)
+		header, _ := response.child(kmipTagResponseHeader)
+		version, _ := header.child(kmipTagProtocolVersion)
+		minor, _ := version.int(kmipTagProtocolVersionMinor)
+		require.Equal(t, int32(4), minor)
+		item, _ := response.child(kmipTagBatchItem)
+		return item
+	}
+	symmetricKey := func(algorithm int32, key []byte) ttlv {
+		return ttlvStruct(kmipTagSymmetricKey,
+			ttlvStruct(kmipTagKeyBlock,
+				ttlvEnum(kmipTagKeyFormatType, kmipKeyFormatRaw),
+				ttlvStruct(kmipTagKeyValue, ttlvBytes(kmipTagKeyMaterial, key)),
+				ttlvEnum(kmipTagCryptographicAlgorithm, algorithm),
+				ttlvInt(kmipTagCryptographicLength, int32(len(key)*8)),
+			),
+		)
+	}
+
+	key := bytes.Repeat([]byte{0x3C}, 16)
+	item := call(kmipOperationRegister, ttlvEnum(kmipTagObjectType, kmipObjectSymmetricKey), symmetricKey(kmipAlgorithmAES, key))
+	status, _ := item.int(kmipTagResultStatus)
+	require.Equal(t, kmipResultSuccess, status, item)
+	payload, _ := item.child(kmipTagResponsePayload)
+	id, _ := payload.text(kmipTagUniqueIdentifier)
+	require.NotEmpty(t, id)
+
+	// The key is stored as a key block under the machine KBPK
+	keyBlock, vErr := s.GetSecretManager().ReadSecret("secret/tr31/managed/"+id, managedKeyName)
+	require.Nil(t, vErr)
+	require.Equal(t, "D", keyBlock[:1])
+
+	item = call(kmipOperationGet, ttlvText(kmipTagUniqueIdentifier, id))
+	status, _ = item.int(kmipTagResultStatus)
+	require.Equal(t, kmipResultSuccess, status, item)
+	payload, _ = item.child(kmipTagResponsePayload)
+	got, _ := payload.child(kmipTagSymmetricKey)
+	block, _ := got.child(kmipTagKeyBlock)
+	algorithm, _ := block.int(kmipTagCryptographicAlgorithm)
+	require.Equal(t, kmipAlgorithmAES, algorithm)
+	value, _ := block.child(kmipTagKeyValue)
+	material, _ := value.child(kmipTagKeyMaterial)
+	require.Equal(t, key, material.value)
+
+	item = call(kmipOperationDestroy, ttlvText(kmipTagUniqueIdentifier, id))
+	status, _ = item.int(kmipTagResultStatus)
+	require.Equal(t, kmipResultSuccess, status, item)
+
+	failed := func(item ttlv, reason int32) {
+		t.Helper()
+		status, _ := item.int(kmipTagResultStatus)
+		require.Equal(t, kmipResultOperationFailed, status, item)
+		got, _ := item.int(kmipTagResultReason)
+		require.Equal(t, reason, got, item)
+	}
+	failed(call(kmipOperationGet, ttlvText(kmipTagUniqueIdentifier, id)), kmipReasonItemNotFound)
+	failed(call(kmipOperationDestroy, ttlvText(kmipTagUniqueIdentifier, "../kbkp")), kmipReasonItemNotFound)
+	failed(call(0x01), kmipReasonOperationNotSupported)
+	failed(call(kmipOperationRegister, ttlvEnum(kmipTagObjectType, 0x07)), kmipReasonInvalidField)
+	failed(call(kmipOperationRegister, ttlvEnum(kmipTagObjectType, kmipObjectSymmetricKey), symmetricKey(0x04, key)), kmipReasonInvalidField)
+	failed(call(kmipOperationRegister, ttlvEnum(kmipTagObjectType, kmipObjectSymmetricKey), symmetricKey(kmipAlgorithmTripleDES, key[:5])), kmipReasonInvalidField)
+
+	// Never-clear machines don't return keys in clear
+	item = call(kmipOperationRegister, ttlvEnum(kmipTagObjectType, kmipObjectSymmetricKey), symmetricKey(kmipAlgorithmAES, key))
+	payload, _ = item.child(kmipTagResponsePayload)
+	id, _ = payload.text(kmipTagUniqueIdentifier)
+	_, err := s.(*service).store.UpdateMachine(m.InitialKey, func(m *Machine) error {
+		m.NeverClear = true
+		return nil
+	})
+	require.NoError(t, err)
+	failed(call(kmipOperationGet, ttlvText(kmipTagUniqueIdentifier, id)), kmipReasonPermissionDenied)
+
+	// Messages which aren't TTLV structures are answered with a failure, and the connection closed
+	go client.Write(ttlvInt(kmipTagBatchCount, 1).encode())
+	response, err := readTTLV(client)
+	require.NoError(t, err)
+	item, _ = response.child(kmipTagBatchItem)
+	failed(item, kmipReasonInvalidMessage)
+}
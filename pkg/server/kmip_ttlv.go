@@ -0,0 +1,251 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// KMIP TTLV item types
+const (
+	ttlvStructure   byte = 0x01
+	ttlvInteger     byte = 0x02
+	ttlvLongInteger byte = 0x03
+	ttlvEnumeration byte = 0x05
+	ttlvBoolean     byte = 0x06
+	ttlvTextString  byte = 0x07
+	ttlvByteString  byte = 0x08
+	ttlvDateTime    byte = 0x09
+)
+
+// KMIP tags of the messages and objects the facade handles
+const (
+	kmipTagBatchCount             uint32 = 0x42000D
+	kmipTagBatchItem              uint32 = 0x42000F
+	kmipTagCryptographicAlgorithm uint32 = 0x420028
+	kmipTagCryptographicLength    uint32 = 0x42002A
+	kmipTagKeyBlock               uint32 = 0x420040
+	kmipTagKeyFormatType          uint32 = 0x420042
+	kmipTagKeyMaterial            uint32 = 0x420043
+	kmipTagKeyValue               uint32 = 0x420045
+	kmipTagObjectType             uint32 = 0x420057
+	kmipTagOperation              uint32 = 0x42005C
+	kmipTagProtocolVersion        uint32 = 0x420069
+	kmipTagProtocolVersionMajor   uint32 = 0x42006A
+	kmipTagProtocolVersionMinor   uint32 = 0x42006B
+	kmipTagRequestHeader          uint32 = 0x420077
+	kmipTagRequestMessage         uint32 = 0x420078
+	kmipTagRequestPayload         uint32 = 0x420079
+	kmipTagResponseHeader         uint32 = 0x42007A
+	kmipTagResponseMessage        uint32 = 0x42007B
+	kmipTagResponsePayload        uint32 = 0x42007C
+	kmipTagResultMessage          uint32 = 0x42007D
+	kmipTagResultReason           uint32 = 0x42007E
+	kmipTagResultStatus           uint32 = 0x42007F
+	kmipTagSymmetricKey           uint32 = 0x42008F
+	kmipTagTimeStamp              uint32 = 0x420092
+	kmipTagUniqueBatchItemID      uint32 = 0x420093
+	kmipTagUniqueIdentifier       uint32 = 0x420094
+)
+
+// maxTTLVLength caps the length of the messages read, working key requests are small
+const maxTTLVLength = 64 * 1024
+
+var errInvalidTTLV = errors.New("invalid KMIP TTLV encoding")
+
+// ttlv is a KMIP Tag-Type-Length-Value item. Structures hold their items in
+// children, other types their value: int32 for integers and enumerations,
+// int64 for long integers, bool, string, []byte or time.Time.
+type ttlv struct {
+	tag      uint32
+	typ      byte
+	value    interface{}
+	children []ttlv
+}
+
+func ttlvStruct(tag uint32, children ...ttlv) ttlv {
+	return ttlv{tag: tag, typ: ttlvStructure, children: children}
+}
+
+func ttlvInt(tag uint32, v int32) ttlv {
+	return ttlv{tag: tag, typ: ttlvInteger, value: v}
+}
+
+func ttlvEnum(tag uint32, v int32) ttlv {
+	return ttlv{tag: tag, typ: ttlvEnumeration, value: v}
+}
+
+func ttlvText(tag uint32, v string) ttlv {
+	return ttlv{tag: tag, typ: ttlvTextString, value: v}
+}
+
+func ttlvBytes(tag uint32, v []byte) ttlv {
+	return ttlv{tag: tag, typ: ttlvByteString, value: v}
+}
+
+func ttlvTime(tag uint32, v time.Time) ttlv {
+	return ttlv{tag: tag, typ: ttlvDateTime, value: v}
+}
+
+// child returns the first item of the structure with the tag
+func (t ttlv) child(tag uint32) (ttlv, bool) {
+	for _, c := range t.children {
+		if c.tag == tag {
+			return c, true
+		}
+	}
+	return ttlv{}, false
+}
+
+// childrenOf returns the items of the structure with the tag
+func (t ttlv) childrenOf(tag uint32) []ttlv {
+	var items []ttlv
+	for _, c := range t.children {
+		if c.tag == tag {
+			items = append(items, c)
+		}
+	}
+	return items
+}
+
+// int returns the value of an integer or enumeration item of the structure
+func (t ttlv) int(tag uint32) (int32, bool) {
+	c, found := t.child(tag)
+	v, ok := c.value.(int32)
+	return v, found && ok
+}
+
+// text returns the value of a text string item of the structure
+func (t ttlv) text(tag uint32) (string, bool) {
+	c, found := t.child(tag)
+	v, ok := c.value.(string)
+	return v, found && ok
+}
+
+// wipe clears the byte strings of the item, which carry key material
+func (t ttlv) wipe() {
+	if b, ok := t.value.([]byte); ok {
+		wipe(b)
+	}
+	for _, c := range t.children {
+		c.wipe()
+	}
+}
+
+// encode returns the TTLV encoding of the item
+func (t ttlv) encode() []byte {
+	var value []byte
+	switch t.typ {
+	case ttlvStructure:
+		for _, c := range t.children {
+			value = append(value, c.encode()...)
+		}
+	case ttlvInteger, ttlvEnumeration:
+		value = binary.BigEndian.AppendUint32(nil, uint32(t.value.(int32)))
+	case ttlvLongInteger:
+		value = binary.BigEndian.AppendUint64(nil, uint64(t.value.(int64)))
+	case ttlvBoolean:
+		var b uint64
+		if t.value.(bool) {
+			b = 1
+		}
+		value = binary.BigEndian.AppendUint64(nil, b)
+	case ttlvTextString:
+		value = []byte(t.value.(string))
+	case ttlvByteString:
+		value = t.value.([]byte)
+	case ttlvDateTime:
+		value = binary.BigEndian.AppendUint64(nil, uint64(t.value.(time.Time).Unix()))
+	}
+	out := make([]byte, 8, 8+len(value)+7)
+	out[0], out[1], out[2] = byte(t.tag>>16), byte(t.tag>>8), byte(t.tag)
+	out[3] = t.typ
+	binary.BigEndian.PutUint32(out[4:], uint32(len(value)))
+	out = append(out, value...)
+	// Values are padded to a multiple of 8 bytes
+	return append(out, make([]byte, (8-len(value)%8)%8)...)
+}
+
+// readTTLV reads one TTLV message
+func readTTLV(r io.Reader) (ttlv, error) {
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return ttlv{}, err
+	}
+	length := binary.BigEndian.Uint32(head[4:])
+	if head[3] != ttlvStructure || length > maxTTLVLength {
+		return ttlv{}, fmt.Errorf("%w: messages are structures of at most %d bytes", errInvalidTTLV, maxTTLVLength)
+	}
+	body := make([]byte, 8+int(length))
+	defer wipe(body)
+	copy(body, head)
+	if _, err := io.ReadFull(r, body[8:]); err != nil {
+		return ttlv{}, err
+	}
+	item, _, err := decodeTTLV(body)
+	return item, err
+}
+
+// decodeTTLV decodes the item at the start of data, and returns its padded length
+func decodeTTLV(data []byte) (ttlv, int, error) {
+	if len(data) < 8 {
+		return ttlv{}, 0, fmt.Errorf("%w: truncated item", errInvalidTTLV)
+	}
+	t := ttlv{tag: uint32(data[0])<<16 | uint32(data[1])<<8 | uint32(data[2]), typ: data[3]}
+	length := int(binary.BigEndian.Uint32(data[4:8]))
+	padded := length + (8-length%8)%8
+	if length > len(data)-8 || (t.typ != ttlvStructure && padded > len(data)-8) {
+		return ttlv{}, 0, fmt.Errorf("%w: item %06X overflows its structure", errInvalidTTLV, t.tag)
+	}
+	value := data[8 : 8+length]
+	fixed := func(n int) error {
+		if length != n {
+			return fmt.Errorf("%w: item %06X of type %02X has length %d", errInvalidTTLV, t.tag, t.typ, length)
+		}
+		return nil
+	}
+
+	switch t.typ {
+	case ttlvStructure:
+		for i := 0; i < len(value); {
+			c, n, err := decodeTTLV(value[i:])
+			if err != nil {
+				return ttlv{}, 0, err
+			}
+			t.children = append(t.children, c)
+			i += n
+		}
+		// Structures hold padded items, so their length is a multiple of 8
+		padded = length
+	case ttlvInteger, ttlvEnumeration:
+		if err := fixed(4); err != nil {
+			return ttlv{}, 0, err
+		}
+		t.value = int32(binary.BigEndian.Uint32(value))
+	case ttlvLongInteger:
+		if err := fixed(8); err != nil {
+			return ttlv{}, 0, err
+		}
+		t.value = int64(binary.BigEndian.Uint64(value))
+	case ttlvBoolean:
+		if err := fixed(8); err != nil {
+			return ttlv{}, 0, err
+		}
+		t.value = binary.BigEndian.Uint64(value) != 0
+	case ttlvTextString:
+		t.value = string(value)
+	case ttlvByteString:
+		t.value = append([]byte(nil), value...)
+	case ttlvDateTime:
+		if err := fixed(8); err != nil {
+			return ttlv{}, 0, err
+		}
+		t.value = time.Unix(int64(binary.BigEndian.Uint64(value)), 0).UTC()
+	default:
+		// Other types, such as big integers and intervals, are kept raw
+		t.value = append([]byte(nil), value...)
+	}
+	return t, 8 + padded, nil
+}
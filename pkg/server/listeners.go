@@ -0,0 +1,151 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+)
+
+// AuthMode is how a listener authenticates its callers
+type AuthMode string
+
+var (
+	// AUTH_NONE accepts every caller, such as sidecars reaching a Unix socket
+	// only they can open, or callers authenticated by an API gateway
+	AUTH_NONE AuthMode = "none"
+	// AUTH_MTLS requires callers to present a TLS client certificate signed by the listener's client CA
+	AUTH_MTLS AuthMode = "mtls"
+)
+
+var (
+	// ErrClientCertRequired is returned to callers of an AUTH_MTLS listener without a verified client certificate
+	ErrClientCertRequired = errors.New("a verified TLS client certificate is required")
+	errInvalidListener    = errors.New("invalid listener")
+)
+
+// defaultSocketMode lets the owner and group of the server reach its Unix socket
+const defaultSocketMode os.FileMode = 0660
+
+// ListenerConfig describes one of the listeners the server exposes its API on
+type ListenerConfig struct {
+	// Network is "tcp" or "unix"
+	Network string
+	// Address is a host:port for tcp, or the socket path for unix
+	Address string
+	// CertFile and KeyFile serve TLS on a tcp listener, when set
+	CertFile string
+	KeyFile  string
+	// ClientCAFile holds the CAs client certificates are verified against.
+	// Client certificates are optional unless Auth is AUTH_MTLS.
+	ClientCAFile string
+	// Auth is AUTH_NONE when empty
+	Auth AuthMode
+	// SocketMode is the permission of the Unix socket, 0660 when zero
+	SocketMode os.FileMode
+}
+
+// Listen opens the listener described by cfg. A stale Unix socket left at the
+// path by a previous run is removed first.
+func Listen(cfg ListenerConfig) (net.Listener, error) {
+	if cfg.Auth == "" {
+		cfg.Auth = AUTH_NONE
+	}
+	if cfg.Auth != AUTH_NONE && cfg.Auth != AUTH_MTLS {
+		return nil, fmt.Errorf("%w: unknown auth mode %s", errInvalidListener, cfg.Auth)
+	}
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Network {
+	case "tcp":
+		ln, err := net.Listen("tcp", cfg.Address)
+		if err != nil {
+			return nil, err
+		}
+		if tlsConfig != nil {
+			ln = tls.NewListener(ln, tlsConfig)
+		}
+		return ln, nil
+
+	case "unix":
+		if tlsConfig != nil || cfg.Auth == AUTH_MTLS {
+			return nil, fmt.Errorf("%w: unix sockets don't serve TLS", errInvalidListener)
+		}
+		if info, err := os.Lstat(cfg.Address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(cfg.Address)
+		}
+		ln, err := net.Listen("unix", cfg.Address)
+		if err != nil {
+			return nil, err
+		}
+		mode := cfg.SocketMode
+		if mode == 0 {
+			mode = defaultSocketMode
+		}
+		if err := os.Chmod(cfg.Address, mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+		return ln, nil
+	}
+	return nil, fmt.Errorf("%w: unknown network %s", errInvalidListener, cfg.Network)
+}
+
+// tlsConfig returns the TLS configuration of the listener, nil for plain listeners
+func (cfg ListenerConfig) tlsConfig() (*tls.Config, error) {
+	if cfg.CertFile == "" && cfg.KeyFile == "" {
+		if cfg.Auth == AUTH_MTLS {
+			return nil, fmt.Errorf("%w: %s auth needs a certificate and a client CA", errInvalidListener, cfg.Auth)
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if cfg.ClientCAFile == "" {
+		if cfg.Auth == AUTH_MTLS {
+			return nil, fmt.Errorf("%w: %s auth needs a client CA", errInvalidListener, cfg.Auth)
+		}
+		return tlsConfig, nil
+	}
+	pem, err := os.ReadFile(cfg.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%w: %s", errInvalidCACert, cfg.ClientCAFile)
+	}
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if cfg.Auth == AUTH_MTLS {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// RequireAuth rejects the requests which don't satisfy the auth mode of the
+// listener they were received on. TLS handshakes already enforce AUTH_MTLS on
+// listeners opened by Listen, this guards handlers served behind other listeners.
+func RequireAuth(mode AuthMode, next http.Handler) http.Handler {
+	if mode != AUTH_MTLS {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			encodeError(saveRequestIDIntoContext()(r.Context(), r), ErrClientCertRequired, w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func serveListener(t *testing.T, cfg ListenerConfig) string {
+	t.Helper()
+	ln, err := Listen(cfg)
+	require.NoError(t, err)
+	srv := &http.Server{Handler: RequireAuth(cfg.Auth, mockHttpHandler())}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+func TestListen_unix(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "tr31.sock")
+	// A socket left by a previous run is replaced
+	stale, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	serveListener(t, ListenerConfig{Network: "unix", Address: socket})
+	info, err := os.Stat(socket)
+	require.NoError(t, err)
+	require.Equal(t, defaultSocketMode, info.Mode().Perm())
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://tr31/ping")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	require.Equal(t, "PONG", string(body))
+}
+
+func TestListen_mtls(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, false)
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), filepath.Join(dir, "ca.pem")
+	newTestCert(t, "server", ca, true).write(t, certFile, keyFile)
+	ca.write(t, caFile, "")
+
+	addr := serveListener(t, ListenerConfig{
+		Network:      "tcp",
+		Address:      "127.0.0.1:0",
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: caFile,
+		Auth:         AUTH_MTLS,
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(certs ...tls.Certificate) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: certs,
+		}}}
+		return client.Get("https://" + addr + "/machines")
+	}
+
+	clientCert := newTestCert(t, "pos-gateway", ca, false)
+	resp, err := get(tls.Certificate{Certificate: [][]byte{clientCert.der}, PrivateKey: clientCert.key})
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Callers without a client certificate, or signed by another CA, are rejected
+	_, err = get()
+	require.Error(t, err)
+	otherCert := newTestCert(t, "pos-gateway", newTestCert(t, "other-ca", nil, false), false)
+	_, err = get(tls.Certificate{Certificate: [][]byte{otherCert.der}, PrivateKey: otherCert.key})
+	require.Error(t, err)
+}
+
+func TestListen_Errors(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "tr31.sock")
+	configs := []ListenerConfig{
+		{Network: "udp", Address: "127.0.0.1:0"},
+		{Network: "tcp", Address: "127.0.0.1:0", Auth: "token"},
+		{Network: "tcp", Address: "127.0.0.1:0", Auth: AUTH_MTLS},
+		{Network: "unix", Address: socket, Auth: AUTH_MTLS},
+	}
+	for _, cfg := range configs {
+		_, err := Listen(cfg)
+		require.ErrorIs(t, err, errInvalidListener, cfg)
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	handler := RequireAuth(AUTH_MTLS, mockHttpHandler())
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/machines", nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Contains(t, w.Body.String(), ERROR_CODE_UNAUTHORIZED)
+
+	w = httptest.NewRecorder()
+	RequireAuth(AUTH_NONE, mockHttpHandler()).ServeHTTP(w, httptest.NewRequest("GET", "/machines", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+}
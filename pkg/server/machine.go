@@ -1,18 +1,58 @@
 package server
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 )
 
+const (
+	maxTagKeyLength   = 64
+	maxTagValueLength = 256
+)
+
+var errInvalidTag = errors.New("invalid machine tag")
+
 type Vault struct {
 	VaultAddress string
 	VaultToken   string
 }
+
+// String hides the token, so logging credentials doesn't leak it
+func (v Vault) String() string {
+	return fmt.Sprintf("{VaultAddress:%s VaultToken:<redacted>}", v.VaultAddress)
+}
+
+// Machine holds the vault credentials and the KBPK references of a client.
+// The credentials never leave the service: API responses, JSON and String
+// only carry the MachineView of the machine, and the repository seals them at
+// rest, see CredentialSealer.
 type Machine struct {
-	vaultAuth      Vault
-	InitialKey     string
+	vaultAuth  Vault
+	InitialKey string
+	// TransactionKey matches requests to the machine by their vault credentials.
+	// It's a DES CBC-MAC of the credentials under a fixed key, so anyone holding
+	// it could check guessed credentials offline: MachineView leaves it out.
 	TransactionKey string
-	CreatedAt      time.Time
+	// AllowedVersions lists the key block versions the machine will unwrap, empty allows all versions
+	AllowedVersions []string
+	// Keys references the KBPKs the machine is expected to use
+	Keys []KeyReference
+	// Backend is the secret manager backend the machine was created on
+	Backend RunningMode
+	// Tags organize machines, for example by environment, institution or zone
+	Tags map[string]string
+	// NeverClear rejects decrypt requests returning keys in clear, keys are only
+	// returned under a transport key or imported into a downstream key manager
+	NeverClear bool
+	// HeaderTemplate fills the header fields and optional blocks omitted by
+	// encrypt requests for the machine, see UpdateMachineHeaderTemplate
+	HeaderTemplate *HeaderParams `json:",omitempty"`
+	// Tenant is the ID of the tenant which created the machine, see WithTenants
+	Tenant    string `json:",omitempty"`
+	CreatedAt time.Time
 }
 
 func NewMachine(vaultAuth Vault) *Machine {
@@ -20,3 +60,107 @@ func NewMachine(vaultAuth Vault) *Machine {
 		vaultAuth: vaultAuth,
 	}
 }
+
+// MachineView is a machine as returned by the API, without its vault credentials
+type MachineView struct {
+	InitialKey      string
+	AllowedVersions []string
+	Keys            []KeyReference
+	Backend         RunningMode
+	Tags            map[string]string
+	NeverClear      bool
+	HeaderTemplate  *HeaderParams `json:",omitempty"`
+	Tenant          string        `json:",omitempty"`
+	CreatedAt       time.Time
+}
+
+// View returns the machine without its vault credentials
+func (m *Machine) View() *MachineView {
+	return &MachineView{
+		InitialKey:      m.InitialKey,
+		AllowedVersions: m.AllowedVersions,
+		Keys:            m.Keys,
+		Backend:         m.Backend,
+		Tags:            m.Tags,
+		NeverClear:      m.NeverClear,
+		HeaderTemplate:  m.HeaderTemplate,
+		Tenant:          m.Tenant,
+		CreatedAt:       m.CreatedAt,
+	}
+}
+
+// MarshalJSON encodes the MachineView of the machine
+func (m *Machine) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.View())
+}
+
+// String formats the MachineView of the machine, fmt would otherwise print
+// the vault credentials
+func (m *Machine) String() string {
+	return fmt.Sprintf("%+v", *m.View())
+}
+
+// validateTags checks tag keys are short identifiers made of letters, digits,
+// '-', '_', '.' and '/', and tag values are not too long
+func validateTags(tags map[string]string) error {
+	for k, v := range tags {
+		if k == "" || len(k) > maxTagKeyLength {
+			return fmt.Errorf("%w: key %q must be 1 to %d characters", errInvalidTag, k, maxTagKeyLength)
+		}
+		for _, c := range k {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '/') {
+				return fmt.Errorf("%w: key %q has invalid characters", errInvalidTag, k)
+			}
+		}
+		if len(v) > maxTagValueLength {
+			return fmt.Errorf("%w: value of %q must be at most %d characters", errInvalidTag, k, maxTagValueLength)
+		}
+	}
+	return nil
+}
+
+// _headerTemplateBaseline completes partial header templates, so the fields
+// they set can be validated
+var _headerTemplateBaseline = HeaderParams{
+	VersionId:     "B",
+	KeyUsage:      "D0",
+	Algorithm:     "T",
+	ModeOfUse:     "E",
+	KeyVersion:    "00",
+	Exportability: "N",
+}
+
+// validateHeaderTemplate checks the fields and optional blocks a header
+// template sets, any of them may be omitted
+func validateHeaderTemplate(template *HeaderParams) error {
+	if template == nil {
+		return nil
+	}
+	if _, err := template.withDefaults(_headerTemplateBaseline).Header(); err != nil {
+		return fmt.Errorf("%w: header template %v", errInvalidMachine, err)
+	}
+	return nil
+}
+
+// HasTags reports whether the machine carries every tag with the same value
+func (m *Machine) HasTags(tags map[string]string) bool {
+	for k, v := range tags {
+		if value, exists := m.Tags[k]; !exists || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowsVersion reports whether the machine's policy permits unwrapping key blocks of versionID
+func (m *Machine) AllowsVersion(versionID string) bool {
+	if len(m.AllowedVersions) == 0 {
+		return true
+	}
+	for _, v := range m.AllowedVersions {
+		if strings.EqualFold(v, versionID) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Sort orders of MachineQuery, the initial key breaks ties so pages are stable
+const (
+	MACHINE_SORT_CREATED_AT      string = "createdAt"
+	MACHINE_SORT_CREATED_AT_DESC string = "-createdAt"
+	MACHINE_SORT_IK              string = "ik"
+	MACHINE_SORT_IK_DESC         string = "-ik"
+)
+
+// MachineQuery filters, sorts and pages machines. Zero values don't filter,
+// a zero Limit returns every machine from Offset.
+type MachineQuery struct {
+	Backend RunningMode
+	// Tenant keeps the machines of the tenant
+	Tenant string
+	// Tags keeps machines carrying every tag with the same value
+	Tags          map[string]string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// Sort is one of the MACHINE_SORT_* orders, MACHINE_SORT_CREATED_AT by default
+	Sort   string
+	Limit  int
+	Offset int
+}
+
+// Validate checks the sort order and the page bounds
+func (q MachineQuery) Validate() error {
+	switch q.Sort {
+	case "", MACHINE_SORT_CREATED_AT, MACHINE_SORT_CREATED_AT_DESC, MACHINE_SORT_IK, MACHINE_SORT_IK_DESC:
+	default:
+		return fmt.Errorf("%w sort must be createdAt, -createdAt, ik or -ik.", errMalformedField)
+	}
+	if q.Limit < 0 {
+		return fmt.Errorf("%w limit must not be negative.", errMalformedField)
+	}
+	if q.Offset < 0 {
+		return fmt.Errorf("%w offset must not be negative.", errMalformedField)
+	}
+	return nil
+}
+
+func (q MachineQuery) matches(m *Machine) bool {
+	if q.Backend != "" && m.Backend != q.Backend {
+		return false
+	}
+	if q.Tenant != "" && m.Tenant != q.Tenant {
+		return false
+	}
+	if !m.HasTags(q.Tags) {
+		return false
+	}
+	if !q.CreatedAfter.IsZero() && !m.CreatedAt.After(q.CreatedAfter) {
+		return false
+	}
+	if !q.CreatedBefore.IsZero() && !m.CreatedAt.Before(q.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+func (q MachineQuery) sort(machines []*Machine) {
+	sort.SliceStable(machines, func(i, j int) bool {
+		a, b := machines[i], machines[j]
+		switch q.Sort {
+		case MACHINE_SORT_IK:
+			return a.InitialKey < b.InitialKey
+		case MACHINE_SORT_IK_DESC:
+			return a.InitialKey > b.InitialKey
+		case MACHINE_SORT_CREATED_AT_DESC:
+			if !a.CreatedAt.Equal(b.CreatedAt) {
+				return a.CreatedAt.After(b.CreatedAt)
+			}
+		default:
+			if !a.CreatedAt.Equal(b.CreatedAt) {
+				return a.CreatedAt.Before(b.CreatedAt)
+			}
+		}
+		return a.InitialKey < b.InitialKey
+	})
+}
+
+func (q MachineQuery) page(machines []*Machine) []*Machine {
+	if q.Offset >= len(machines) {
+		return []*Machine{}
+	}
+	machines = machines[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(machines) {
+		machines = machines[:q.Limit]
+	}
+	return machines
+}
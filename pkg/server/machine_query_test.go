@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func seedMachines(t *testing.T, r Repository) time.Time {
+	t.Helper()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		backend := MODE_VAULT
+		if i%2 == 1 {
+			backend = MODE_MOCK
+		}
+		tags := map[string]string{"zone": "us"}
+		if i%3 == 0 {
+			tags = map[string]string{"zone": "eu", "environment": fmt.Sprintf("env-%d", i)}
+		}
+		if i == 3 {
+			tags["environment"] = "prod"
+		}
+		require.NoError(t, r.StoreMachine(&Machine{
+			InitialKey: fmt.Sprintf("ik-%d", i),
+			Backend:    backend,
+			Tags:       tags,
+			CreatedAt:  start.Add(time.Duration(i) * time.Hour),
+		}))
+	}
+	// same creation time as ik-2, sorted after it by initial key
+	require.NoError(t, r.StoreMachine(&Machine{InitialKey: "ik-2b", Backend: MODE_VAULT, CreatedAt: start.Add(2 * time.Hour)}))
+	return start
+}
+
+func initialKeys(machines []*Machine) []string {
+	iks := make([]string, len(machines))
+	for i := range machines {
+		iks[i] = machines[i].InitialKey
+	}
+	return iks
+}
+
+func viewInitialKeys(views []*MachineView) []string {
+	iks := make([]string, len(views))
+	for i := range views {
+		iks[i] = views[i].InitialKey
+	}
+	return iks
+}
+
+func TestRepository_FindMachines(t *testing.T) {
+	r := NewRepositoryInMemory(nil)
+	start := seedMachines(t, r)
+
+	machines, total, err := r.FindMachines(MachineQuery{})
+	require.NoError(t, err)
+	require.Equal(t, 6, total)
+	require.Equal(t, []string{"ik-0", "ik-1", "ik-2", "ik-2b", "ik-3", "ik-4"}, initialKeys(machines))
+
+	machines, total, err = r.FindMachines(MachineQuery{Sort: MACHINE_SORT_CREATED_AT_DESC, Limit: 3})
+	require.NoError(t, err)
+	require.Equal(t, 6, total)
+	require.Equal(t, []string{"ik-4", "ik-3", "ik-2"}, initialKeys(machines))
+
+	machines, total, err = r.FindMachines(MachineQuery{Sort: MACHINE_SORT_IK_DESC, Limit: 2, Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, 6, total)
+	require.Equal(t, []string{"ik-3", "ik-2b"}, initialKeys(machines))
+
+	machines, total, err = r.FindMachines(MachineQuery{Backend: MODE_MOCK})
+	require.NoError(t, err)
+	require.Equal(t, 2, total)
+	require.Equal(t, []string{"ik-1", "ik-3"}, initialKeys(machines))
+
+	machines, total, err = r.FindMachines(MachineQuery{CreatedAfter: start, CreatedBefore: start.Add(3 * time.Hour)})
+	require.NoError(t, err)
+	require.Equal(t, 3, total)
+	require.Equal(t, []string{"ik-1", "ik-2", "ik-2b"}, initialKeys(machines))
+
+	machines, total, err = r.FindMachines(MachineQuery{Tags: map[string]string{"zone": "eu"}})
+	require.NoError(t, err)
+	require.Equal(t, 2, total)
+	require.Equal(t, []string{"ik-0", "ik-3"}, initialKeys(machines))
+
+	machines, total, err = r.FindMachines(MachineQuery{Tags: map[string]string{"zone": "eu", "environment": "prod"}})
+	require.NoError(t, err)
+	require.Equal(t, 1, total)
+	require.Equal(t, []string{"ik-3"}, initialKeys(machines))
+
+	machines, total, err = r.FindMachines(MachineQuery{Offset: 10})
+	require.NoError(t, err)
+	require.Equal(t, 6, total)
+	require.Empty(t, machines)
+}
+
+func TestMachineQuery_Validate(t *testing.T) {
+	require.NoError(t, MachineQuery{Sort: MACHINE_SORT_IK, Limit: 10}.Validate())
+	require.ErrorIs(t, MachineQuery{Sort: "name"}.Validate(), errMalformedField)
+	require.ErrorIs(t, MachineQuery{Limit: -1}.Validate(), errMalformedField)
+	require.ErrorIs(t, MachineQuery{Offset: -1}.Validate(), errMalformedField)
+}
+
+func TestRouting_get_machines_query(t *testing.T) {
+	repository := NewRepositoryInMemory(nil)
+	seedMachines(t, repository)
+	router := MakeHTTPHandler(NewService(repository, MODE_MOCK))
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+
+	w := get("/machines?limit=2&offset=1&sort=-createdAt&backend=vault")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "4", w.Header().Get("X-Total-Count"))
+	var resp getMachinesResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Equal(t, []string{"ik-2", "ik-2b"}, viewInitialKeys(resp.Machines))
+
+	w = get("/machines?createdAfter=2024-01-01T02:30:00Z")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "2", w.Header().Get("X-Total-Count"))
+
+	w = get("/machines?tag=zone:eu&tag=environment:prod")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "1", w.Header().Get("X-Total-Count"))
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Equal(t, map[string]string{"zone": "eu", "environment": "prod"}, resp.Machines[0].Tags)
+
+	for _, url := range []string{"/machines?limit=ten", "/machines?offset=-1", "/machines?sort=name", "/machines?createdBefore=yesterday", "/machines?tag=zone"} {
+		w = get(url)
+		require.Equal(t, http.StatusBadRequest, w.Code, url)
+		require.Contains(t, w.Body.String(), ERROR_CODE_MALFORMED_FIELD, url)
+	}
+}
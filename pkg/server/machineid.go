@@ -0,0 +1,182 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// maxMachineIDAttempts bounds the IDs generated for a machine when they
+	// collide with the ID of a stored machine
+	maxMachineIDAttempts = 3
+	maxMachineIDPrefix   = 32
+)
+
+var errInvalidMachineID = errors.New("invalid machine ID")
+
+// MachineIDGenerator assigns the ID of created machines, the ik of the routes.
+// Downstream systems keying their records on machine IDs pick the strategy
+// producing the format they expect, see ConfigureMachineIDs.
+type MachineIDGenerator interface {
+	MachineID(m *Machine) (string, error)
+}
+
+// MachineIDFunc adapts a function to a MachineIDGenerator
+type MachineIDFunc func(m *Machine) (string, error)
+
+func (f MachineIDFunc) MachineID(m *Machine) (string, error) {
+	return f(m)
+}
+
+var (
+	// CredentialMachineIDs derives the ID from the machine's vault credentials,
+	// the default: the same credentials always give the same 16 hexchars ID
+	CredentialMachineIDs MachineIDGenerator = MachineIDFunc(credentialMachineID)
+	// UUIDv7MachineIDs generates RFC 9562 version 7 UUIDs, sortable by the
+	// machine creation time
+	UUIDv7MachineIDs MachineIDGenerator = MachineIDFunc(uuidv7MachineID)
+	// ULIDMachineIDs generates ULIDs, 26 Crockford base32 characters sortable
+	// by the machine creation time
+	ULIDMachineIDs MachineIDGenerator = MachineIDFunc(ulidMachineID)
+)
+
+func credentialMachineID(m *Machine) (string, error) {
+	return InitialKey(UnifiedParams{VaultAddr: m.vaultAuth.VaultAddress, VaultToken: m.vaultAuth.VaultToken})
+}
+
+// machineIDTime returns the creation time of the machine, now when it's unset
+func machineIDTime(m *Machine) time.Time {
+	if m.CreatedAt.IsZero() {
+		return time.Now()
+	}
+	return m.CreatedAt
+}
+
+// uuidv7MachineID lays out 48 bits of Unix milliseconds, the version, 12
+// random bits, the variant and 62 random bits
+func uuidv7MachineID(m *Machine) (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[6:]); err != nil {
+		return "", err
+	}
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(machineIDTime(m).UnixMilli()))
+	copy(id[:6], ms[2:])
+	id[6] = id[6]&0x0f | 0x70
+	id[8] = id[8]&0x3f | 0x80
+
+	h := hex.EncodeToString(id[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
+
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidMachineID encodes 48 bits of Unix milliseconds and 80 random bits
+func ulidMachineID(m *Machine) (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[6:]); err != nil {
+		return "", err
+	}
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(machineIDTime(m).UnixMilli()))
+	copy(id[:6], ms[2:])
+
+	// 26 characters of 5 bits hold the 128 bits, the first one only 3 of them
+	hi, lo := binary.BigEndian.Uint64(id[:8]), binary.BigEndian.Uint64(id[8:])
+	out := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		out[i] = crockfordBase32[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out), nil
+}
+
+// PrefixedMachineIDs prefixes the IDs of g with an institution prefix and a
+// dash, such as "acme-01J9...". The prefix is made of letters, digits, '_' and
+// '.', at most 32 of them.
+func PrefixedMachineIDs(prefix string, g MachineIDGenerator) (MachineIDGenerator, error) {
+	if prefix == "" || len(prefix) > maxMachineIDPrefix {
+		return nil, fmt.Errorf("%w: prefix %q must be 1 to %d characters", errInvalidMachineID, prefix, maxMachineIDPrefix)
+	}
+	for _, c := range prefix {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.') {
+			return nil, fmt.Errorf("%w: prefix %q has invalid characters", errInvalidMachineID, prefix)
+		}
+	}
+	if g == nil {
+		g = CredentialMachineIDs
+	}
+	return MachineIDFunc(func(m *Machine) (string, error) {
+		id, err := g.MachineID(m)
+		if err != nil {
+			return "", err
+		}
+		return prefix + "-" + id, nil
+	}), nil
+}
+
+// ParseMachineIDStrategy returns the generator of a strategy: credentials (or
+// empty), uuidv7 or ulid, prefixed when prefix isn't empty
+func ParseMachineIDStrategy(strategy, prefix string) (MachineIDGenerator, error) {
+	var g MachineIDGenerator
+	switch strings.ToLower(strategy) {
+	case "", "credentials":
+		g = CredentialMachineIDs
+	case "uuidv7":
+		g = UUIDv7MachineIDs
+	case "ulid":
+		g = ULIDMachineIDs
+	default:
+		return nil, fmt.Errorf("%w: unknown strategy %q", errInvalidMachineID, strategy)
+	}
+	if prefix == "" {
+		return g, nil
+	}
+	return PrefixedMachineIDs(prefix, g)
+}
+
+// validateMachineID checks generated IDs can be used in the ik of the routes
+func validateMachineID(id string) error {
+	if id == "" || len(id) > 128 {
+		return fmt.Errorf("%w: %q must be 1 to 128 characters", errInvalidMachineID, id)
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return fmt.Errorf("%w: %q has invalid characters", errInvalidMachineID, id)
+		}
+	}
+	return nil
+}
+
+// ConfigureMachineIDs changes how the IDs of created machines are generated,
+// nil restores CredentialMachineIDs. Stored machines keep their ID.
+func (s *service) ConfigureMachineIDs(g MachineIDGenerator) {
+	if g == nil {
+		g = CredentialMachineIDs
+	}
+	s.machineIDs.Store(&g)
+}
+
+// machineIDGenerator returns the generator of the service
+func (s *service) machineIDGenerator() MachineIDGenerator {
+	if g := s.machineIDs.Load(); g != nil {
+		return *g
+	}
+	return CredentialMachineIDs
+}
+
+// machineFor returns the machine registered for the vault credentials of
+// params, whatever the strategy its ID was generated with
+func (s *service) machineFor(params UnifiedParams) (*Machine, error) {
+	tk, err := TransactionKey(params)
+	if err != nil {
+		return nil, err
+	}
+	return s.store.FindMachineByTransactionKey(tk)
+}
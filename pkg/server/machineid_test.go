@@ -0,0 +1,116 @@
+package server
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMachineIDs(t *testing.T) {
+	created := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+	m := NewMachine(Vault{VaultAddress: "http://localhost:8200", VaultToken: "token"})
+	m.CreatedAt = created
+
+	id, err := CredentialMachineIDs.MachineID(m)
+	require.NoError(t, err)
+	ik, err := InitialKey(UnifiedParams{VaultAddr: "http://localhost:8200", VaultToken: "token"})
+	require.NoError(t, err)
+	require.Equal(t, ik, id)
+
+	id, err = UUIDv7MachineIDs.MachineID(m)
+	require.NoError(t, err)
+	require.Regexp(t, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), id)
+	require.Equal(t, "019247f3-9a00", id[:13]) // milliseconds of created
+	other, err := UUIDv7MachineIDs.MachineID(m)
+	require.NoError(t, err)
+	require.NotEqual(t, id, other)
+
+	id, err = ULIDMachineIDs.MachineID(m)
+	require.NoError(t, err)
+	require.Regexp(t, regexp.MustCompile(`^[0-9A-HJKMNP-TV-Z]{26}$`), id)
+	require.Equal(t, "01J93Z76G0", id[:10]) // milliseconds of created
+	m.CreatedAt = created.Add(time.Millisecond)
+	later, err := ULIDMachineIDs.MachineID(m)
+	require.NoError(t, err)
+	require.Less(t, id, later)
+
+	prefixed, err := PrefixedMachineIDs("acme", ULIDMachineIDs)
+	require.NoError(t, err)
+	id, err = prefixed.MachineID(m)
+	require.NoError(t, err)
+	require.Regexp(t, regexp.MustCompile(`^acme-[0-9A-Z]{26}$`), id)
+	_, err = PrefixedMachineIDs("acme/eu", ULIDMachineIDs)
+	require.ErrorIs(t, err, errInvalidMachineID)
+	_, err = PrefixedMachineIDs("", ULIDMachineIDs)
+	require.ErrorIs(t, err, errInvalidMachineID)
+
+	g, err := ParseMachineIDStrategy("ULID", "")
+	require.NoError(t, err)
+	id, err = g.MachineID(m)
+	require.NoError(t, err)
+	require.Len(t, id, 26)
+	g, err = ParseMachineIDStrategy("", "bank_1")
+	require.NoError(t, err)
+	id, err = g.MachineID(m)
+	require.NoError(t, err)
+	require.Equal(t, "bank_1-"+ik, id)
+	_, err = ParseMachineIDStrategy("snowflake", "")
+	require.ErrorIs(t, err, errInvalidMachineID)
+}
+
+func TestService_ConfigureMachineIDs(t *testing.T) {
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	s.ConfigureMachineIDs(UUIDv7MachineIDs)
+
+	m := NewMachine(mockVaultAuthOne())
+	m.NeverClear = true
+	require.NoError(t, s.CreateMachine(m))
+	require.Len(t, m.InitialKey, 36)
+	found, err := s.GetMachine(m.InitialKey)
+	require.NoError(t, err)
+	require.Equal(t, m, found)
+
+	// The machine is still found by its vault credentials
+	auth := mockVaultAuthOne()
+	_, err = s.DecryptData(auth.VaultAddress, auth.VaultToken, "secret/tr31", "kbkp", "D0112D0AE00E0000", time.Second)
+	require.ErrorIs(t, err, ErrClearKeyNotAllowed)
+
+	// Credentials are registered to a single machine whatever its ID
+	require.ErrorIs(t, s.CreateMachine(NewMachine(mockVaultAuthOne())), ErrAlreadyExists)
+
+	// Colliding IDs are drawn again
+	ids := []string{m.InitialKey, m.InitialKey, "fresh"}
+	s.ConfigureMachineIDs(MachineIDFunc(func(*Machine) (string, error) {
+		id := ids[0]
+		ids = ids[1:]
+		return id, nil
+	}))
+	other := NewMachine(Vault{VaultAddress: "http://other:8200", VaultToken: "other"})
+	require.NoError(t, s.CreateMachine(other))
+	require.Equal(t, "fresh", other.InitialKey)
+
+	s.ConfigureMachineIDs(MachineIDFunc(func(*Machine) (string, error) { return "a/b", nil }))
+	require.ErrorIs(t, s.CreateMachine(NewMachine(Vault{VaultAddress: "http://third:8200", VaultToken: "third"})), errInvalidMachineID)
+
+	// Declarations match stored machines by their vault credentials
+	s.ConfigureMachineIDs(ULIDMachineIDs)
+	decl := &Declaration{Machines: []MachineDeclaration{{
+		VaultAddress: auth.VaultAddress,
+		VaultToken:   auth.VaultToken,
+		Keys:         []KeyReference{{KeyPath: "secret/tr31", KeyName: "kbkp"}},
+	}}}
+	result, err := s.Apply(decl)
+	require.NoError(t, err)
+	require.Equal(t, []string{m.InitialKey}, result.Updated)
+	result, err = s.Apply(decl)
+	require.NoError(t, err)
+	require.Equal(t, []string{m.InitialKey}, result.Unchanged)
+
+	s.ConfigureMachineIDs(nil)
+	third := NewMachine(Vault{VaultAddress: "http://third:8200", VaultToken: "third"})
+	require.NoError(t, s.CreateMachine(third))
+	require.Len(t, third.InitialKey, 16)
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/moov-io/base"
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+const (
+	// managedKeyDir is the directory, under the path of the machine KBPK, managed keys are stored in
+	managedKeyDir = "managed"
+	// managedKeyName is the secret name of each managed key block
+	managedKeyName = "keyBlock"
+	// defaultManagedKeyUsage is the key usage of managed keys registered without one
+	defaultManagedKeyUsage = "D0"
+)
+
+var errInvalidManagedKey = errors.New("invalid managed key")
+
+// ManagedKey is a symmetric key registered by a key manager, stored as a key
+// block wrapped under the first KBPK of a machine
+type ManagedKey struct {
+	ID string
+	// InitialKey identifies the machine whose KBPK wraps the key
+	InitialKey string
+	// Algorithm is the key block algorithm, such as "A" or "T"
+	Algorithm string
+	KeyUsage  string
+	KeyBlock  string
+	// KCV is the key check value of the key
+	KCV       string
+	CreatedAt time.Time
+}
+
+// ManagedKeyRequest is a symmetric key to register
+type ManagedKeyRequest struct {
+	Key []byte
+	// Algorithm is tr31.ENC_ALGORITHM_AES, ENC_ALGORITHM_TRIPLE_DES or ENC_ALGORITHM_DES
+	Algorithm string
+	// KeyUsage is the key usage of the key block, "D0" when empty
+	KeyUsage string
+}
+
+// managedKeyPath returns the path of the managed key under the machine KBPK
+func managedKeyPath(m *Machine, id string) string {
+	return m.Keys[0].KeyPath + "/" + managedKeyDir + "/" + id
+}
+
+// RegisterManagedKey wraps the key under the first KBPK referenced by the
+// machine, in a version D key block for AES keys and version B otherwise, and
+// stores the key block next to the KBPK
+func (s *service) RegisterManagedKey(ik string, req ManagedKeyRequest) (registered *ManagedKey, err error) {
+	defer func() {
+		subject := ik
+		if registered != nil {
+			subject += "/" + registered.ID
+		}
+		s.audit(AUDIT_OPERATION_REGISTER_MANAGED, subject, err)
+	}()
+	m, err := s.GetMachine(ik)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Keys) == 0 {
+		return nil, errMachineHasNoKBPK
+	}
+	versionID := tr31.TR31_VERSION_B
+	switch req.Algorithm {
+	case tr31.ENC_ALGORITHM_AES:
+		versionID = tr31.TR31_VERSION_D
+	case tr31.ENC_ALGORITHM_TRIPLE_DES, tr31.ENC_ALGORITHM_DES:
+	default:
+		return nil, fmt.Errorf("%w: unsupported algorithm %s", errInvalidManagedKey, req.Algorithm)
+	}
+	if !m.AllowsVersion(versionID) {
+		return nil, fmt.Errorf("%w: machine policy doesn't allow key block version %s", errInvalidManagedKey, versionID)
+	}
+	if m.Tenant != "" {
+		s.tenantMu.Lock()
+		defer s.tenantMu.Unlock()
+		if err := s.checkTenantLimits(m.Tenant, 0, 1); err != nil {
+			return nil, err
+		}
+	}
+	header, err := tr31.NewHeader(versionID, cmp.Or(req.KeyUsage, defaultManagedKeyUsage), req.Algorithm, "B", "00", "N")
+	if err != nil {
+		return nil, err
+	}
+	if err := s.blockPolicy.Load().Apply(header, s.now()); err != nil {
+		return nil, err
+	}
+	kcv, err := tr31.KeyCheckValue(req.Key, req.Algorithm)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidManagedKey, err)
+	}
+
+	sm, kbpk, err := s.managedKeyKBPK(m)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(kbpk)
+	kblock, err := tr31.New(kbpk, tr31.WithHeader(header))
+	if err != nil {
+		return nil, err
+	}
+	keyBlock, err := kblock.Wrap(req.Key, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.logWrapped(keyBlock); err != nil {
+		return nil, err
+	}
+
+	k := &ManagedKey{
+		ID:         base.ID(),
+		InitialKey: ik,
+		Algorithm:  req.Algorithm,
+		KeyUsage:   header.KeyUsage,
+		KeyBlock:   keyBlock,
+		KCV:        kcv,
+		CreatedAt:  s.now(),
+	}
+	if vErr := sm.WriteSecret(managedKeyPath(m, k.ID), managedKeyName, keyBlock); vErr != nil {
+		return nil, vErr
+	}
+	return k, nil
+}
+
+// GetManagedKey unwraps a managed key of the machine, unless a NeverClear
+// machine forbids returning its KBPK's keys in clear
+func (s *service) GetManagedKey(ik, id string, opts ...UnwrapOption) (_ []byte, _ *ManagedKey, err error) {
+	defer func() { s.audit(AUDIT_OPERATION_GET_MANAGED, ik+"/"+id, err) }()
+	m, err := s.GetMachine(ik)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(m.Keys) == 0 {
+		return nil, nil, errMachineHasNoKBPK
+	}
+	if !validManagedKeyID(id) {
+		return nil, nil, ErrNotFound
+	}
+	// The key is returned in clear, which NeverClear machines forbid like DecryptData
+	if err := s.checkClearOutput(m.vaultAuth.VaultAddress, m.vaultAuth.VaultToken, m.Keys[:1]); err != nil {
+		return nil, nil, err
+	}
+	sm, kbpk, err := s.managedKeyKBPK(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(kbpk)
+	keyBlock, vErr := sm.ReadSecret(managedKeyPath(m, id), managedKeyName)
+	if vErr != nil {
+		return nil, nil, ErrNotFound
+	}
+	if err := s.checkKeyUsable(ik, managedKeyPath(m, id), managedKeyName); err != nil {
+		return nil, nil, err
+	}
+	if err := s.approveUsage(unwrapCallOf(opts).principal, keyBlock); err != nil {
+		return nil, nil, err
+	}
+	kblock, err := tr31.New(kbpk)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := kblock.Unwrap(keyBlock)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := kblock.GetHeader()
+	kcv, _ := tr31.KeyCheckValue(key, header.Algorithm)
+	return key, &ManagedKey{
+		ID:         id,
+		InitialKey: ik,
+		Algorithm:  header.Algorithm,
+		KeyUsage:   header.KeyUsage,
+		KeyBlock:   keyBlock,
+		KCV:        kcv,
+	}, nil
+}
+
+// DestroyManagedKey deletes a managed key of the machine, moving it through
+// the deactivated state to destroyed in its lifecycle
+func (s *service) DestroyManagedKey(ik, id string) (err error) {
+	defer func() { s.audit(AUDIT_OPERATION_DESTROY_MANAGED, ik+"/"+id, err) }()
+	m, err := s.GetMachine(ik)
+	if err != nil {
+		return err
+	}
+	if len(m.Keys) == 0 {
+		return errMachineHasNoKBPK
+	}
+	sm, err := s.scopedSecretManagerOf(m)
+	if err != nil {
+		return err
+	}
+	path := managedKeyPath(m, id)
+	if !validManagedKeyID(id) || !secretExists(sm, path, managedKeyName) {
+		return ErrNotFound
+	}
+	// Keys in use are deactivated before they're destroyed
+	reason := "destroyed by key manager"
+	switch s.keyStateOf(ik, path, managedKeyName) {
+	case KEY_STATE_ACTIVE, KEY_STATE_SUSPENDED:
+		if _, err := s.ChangeKeyState(ik, path, managedKeyName, KEY_STATE_DEACTIVATED, reason); err != nil {
+			return err
+		}
+	}
+	_, err = s.ChangeKeyState(ik, path, managedKeyName, KEY_STATE_DESTROYED, reason)
+	return err
+}
+
+// managedKeyKBPK returns the secret manager of the machine and its first KBPK
+func (s *service) managedKeyKBPK(m *Machine) (SecretManager, []byte, error) {
+	sm, err := s.scopedSecretManagerOf(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	kbpk, err := s.readKBPKFor(sm, UnifiedParams{
+		VaultAddr:  m.vaultAuth.VaultAddress,
+		VaultToken: m.vaultAuth.VaultToken,
+		KeyPath:    m.Keys[0].KeyPath,
+		KeyName:    m.Keys[0].KeyName,
+	})
+	return sm, kbpk, err
+}
+
+// validManagedKeyID keeps IDs from escaping the managed key directory
+func validManagedKeyID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, "/.")
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/bits"
+)
+
+// The Merkle tree of the transparency log hashes as RFC 6962 section 2.1
+// specifies, so proofs are checked with the same code as Certificate
+// Transparency proofs.
+
+// merkleLeafHash returns the hash of a leaf, prefixed by 0x00 so no leaf hash
+// equals a node hash
+func merkleLeafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// merkleNodeHash returns the hash of an inner node, prefixed by 0x01
+func merkleNodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleSplit returns the largest power of 2 smaller than n, for n > 1
+func merkleSplit(n int) int {
+	return 1 << (bits.Len(uint(n-1)) - 1)
+}
+
+// merkleRoot returns the root hash of the tree of the leaf hashes, the hash of
+// the empty string for an empty tree
+func merkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		root := sha256.Sum256(nil)
+		return root[:]
+	case 1:
+		return leaves[0]
+	}
+	k := merkleSplit(len(leaves))
+	return merkleNodeHash(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+// merkleInclusionPath returns the audit path of leaf m in the tree of the leaf hashes
+func merkleInclusionPath(m int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := merkleSplit(len(leaves))
+	if m < k {
+		return append(merkleInclusionPath(m, leaves[:k]), merkleRoot(leaves[k:]))
+	}
+	return append(merkleInclusionPath(m-k, leaves[k:]), merkleRoot(leaves[:k]))
+}
+
+// merkleConsistencyPath returns the proof the tree of the first m leaf hashes
+// is a prefix of the tree of all of them
+func merkleConsistencyPath(m int, leaves [][]byte) [][]byte {
+	if m <= 0 || m >= len(leaves) {
+		return nil
+	}
+	return merkleSubproof(m, leaves, true)
+}
+
+func merkleSubproof(m int, leaves [][]byte, complete bool) [][]byte {
+	if m == len(leaves) {
+		if complete {
+			return nil
+		}
+		return [][]byte{merkleRoot(leaves)}
+	}
+	k := merkleSplit(len(leaves))
+	if m <= k {
+		return append(merkleSubproof(m, leaves[:k], complete), merkleRoot(leaves[k:]))
+	}
+	return append(merkleSubproof(m-k, leaves[k:], false), merkleRoot(leaves[:k]))
+}
+
+// VerifyInclusion checks path is the audit path of the leaf hash at index in
+// the tree of size leaves with the root hash, as RFC 9162 section 2.1.3.2 describes
+func VerifyInclusion(leafHash []byte, index, size int, path [][]byte, root []byte) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+	fn, sn := index, size-1
+	r := leafHash
+	for _, p := range path {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = merkleNodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(r, root)
+}
+
+// VerifyConsistency checks path proves the tree of size first with the root
+// hash firstRoot is a prefix of the tree of size second with the root hash
+// secondRoot, as RFC 9162 section 2.1.4.2 describes
+func VerifyConsistency(first, second int, path [][]byte, firstRoot, secondRoot []byte) bool {
+	switch {
+	case first < 0 || first > second:
+		return false
+	case first == second:
+		return len(path) == 0 && bytes.Equal(firstRoot, secondRoot)
+	case first == 0:
+		return len(path) == 0
+	case len(path) == 0:
+		return false
+	}
+	if first&(first-1) == 0 {
+		path = append([][]byte{firstRoot}, path...)
+	}
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := path[0], path[0]
+	for _, c := range path[1:] {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = merkleNodeHash(c, fr)
+			sr = merkleNodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = merkleNodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(fr, firstRoot) && bytes.Equal(sr, secondRoot)
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+const maxPartnerIDLength = 64
+
+var errInvalidPartner = errors.New("Invalid Partner.")
+
+// Partner webhook event types
+const (
+	PARTNER_EVENT_WRAP      = "wrap"
+	PARTNER_EVENT_TRANSLATE = "translate"
+)
+
+// partnerWebhookClient delivers partner webhook events
+var partnerWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Partner is a remote KRD or KDH exchanging key blocks with a machine under its
+// own KBPK. Keys are wrapped and translated for a partner by its ID, and only
+// under the versions and usages it accepts.
+type Partner struct {
+	ID string
+	// InitialKey identifies the machine the partner is registered under
+	InitialKey string
+	Name       string
+	// Key references the KBPK shared with the partner
+	Key KeyReference
+	// AllowedVersions lists the key block versions of the partner, empty allows all versions
+	AllowedVersions []string
+	// AllowedUsages lists the key usages of the partner, empty allows all usages
+	AllowedUsages []string
+	Contact       PartnerContact
+	// Webhooks are http(s) URLs notified of the keys wrapped and translated for the partner
+	Webhooks  []string
+	CreatedAt time.Time
+}
+
+// PartnerContact is who to reach at the partner about its keys
+type PartnerContact struct {
+	Name  string `json:",omitempty"`
+	Email string `json:",omitempty"`
+	Phone string `json:",omitempty"`
+}
+
+// PartnerEvent is the JSON body POSTed to the webhooks of a partner. It
+// identifies the key block, but doesn't carry it.
+type PartnerEvent struct {
+	Type       string
+	PartnerID  string
+	InitialKey string
+	// KeyBlockHash is the hex SHA-256 of the key block
+	KeyBlockHash string
+	KCV          string `json:",omitempty"`
+	Time         time.Time
+}
+
+// allows reports whether the partner accepts key blocks of the version and usage
+func (p *Partner) allows(versionID, keyUsage string) error {
+	if len(p.AllowedVersions) > 0 && !slices.Contains(p.AllowedVersions, versionID) {
+		return fmt.Errorf("%w: partner %s doesn't accept version %s", ErrVersionNotAllowed, p.ID, versionID)
+	}
+	if len(p.AllowedUsages) > 0 && !slices.Contains(p.AllowedUsages, keyUsage) {
+		return fmt.Errorf("%w: partner %s doesn't accept usage %s", ErrUsageNotApproved, p.ID, keyUsage)
+	}
+	return nil
+}
+
+// validPartnerName reports whether name, a partner ID or zone, is 1 to
+// maxPartnerIDLength letters, digits, '-', '_' or '.', other than . and ..
+func validPartnerName(name string) bool {
+	if name == "" || name == "." || name == ".." || len(name) > maxPartnerIDLength {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// validatePartner checks the fields of a partner before it's stored
+func (s *service) validatePartner(p *Partner) error {
+	if !validPartnerName(p.ID) {
+		return fmt.Errorf("%w: ID must be 1 to %d letters, digits, '-', '_' or '.'", errInvalidPartner, maxPartnerIDLength)
+	}
+	if p.Key.KeyPath == "" || p.Key.KeyName == "" {
+		return fmt.Errorf("%w: Key needs a KeyPath and KeyName", errInvalidPartner)
+	}
+	if err := s.validateKeyReferences([]KeyReference{p.Key}); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidPartner, err)
+	}
+	for _, v := range p.AllowedVersions {
+		if err := tr31.DefaultHeader().SetVersionID(v); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidPartner, err)
+		}
+	}
+	for _, u := range p.AllowedUsages {
+		if err := tr31.DefaultHeader().SetKeyUsage(u); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidPartner, err)
+		}
+	}
+	for _, hook := range p.Webhooks {
+		if err := validateHTTPURL(hook); err != nil {
+			return fmt.Errorf("%w: webhook %v", errInvalidPartner, err)
+		}
+	}
+	return nil
+}
+
+// CreatePartner registers a partner under the machine
+func (s *service) CreatePartner(ik string, p *Partner) (err error) {
+	defer func() {
+		if p != nil {
+			s.audit(AUDIT_OPERATION_CREATE_PARTNER, ik+"/"+p.ID, err)
+		}
+	}()
+	if p == nil {
+		return errInvalidPartner
+	}
+	if _, err := s.GetMachine(ik); err != nil {
+		return err
+	}
+	if err := s.validatePartner(p); err != nil {
+		return err
+	}
+	p.InitialKey = ik
+	if p.CreatedAt.IsZero() {
+		p.CreatedAt = s.now()
+	}
+	return s.store.StorePartner(p)
+}
+
+// GetPartner returns a partner registered under the machine
+func (s *service) GetPartner(ik, partnerID string) (*Partner, error) {
+	return s.store.FindPartner(ik, partnerID)
+}
+
+// GetPartners returns the partners registered under the machine, sorted by ID
+func (s *service) GetPartners(ik string) ([]*Partner, error) {
+	if _, err := s.GetMachine(ik); err != nil {
+		return nil, err
+	}
+	return s.store.FindPartners(ik), nil
+}
+
+// DeletePartner removes a partner registered under the machine
+func (s *service) DeletePartner(ik, partnerID string) error {
+	err := s.store.DeletePartner(ik, partnerID)
+	s.audit(AUDIT_OPERATION_DELETE_PARTNER, ik+"/"+partnerID, err)
+	return err
+}
+
+// WrapForPartner wraps the key under the KBPK of the partner with the vault
+// credentials of the machine, after checking the header against the partner's
+// versions and usages
+func (s *service) WrapForPartner(ik, partnerID, encKey string, header HeaderParams, timeout time.Duration) (*EncryptResult, error) {
+	m, p, err := s.partnerOf(ik, partnerID)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.allows(header.VersionId, header.KeyUsage); err != nil {
+		return nil, err
+	}
+	result, err := s.EncryptDataWithResult(m.vaultAuth.VaultAddress, m.vaultAuth.VaultToken, p.Key.KeyPath, p.Key.KeyName, encKey, header, timeout)
+	if err != nil {
+		return nil, err
+	}
+	s.notifyPartner(p, PARTNER_EVENT_WRAP, result.KeyBlock, result.KCV)
+	return result, nil
+}
+
+// TranslateForPartner unwraps a key block with the KBPK at source, the first KBPK
+// of the machine when empty, and wraps the key again under the KBPK of the
+// partner, after checking the key block header against the partner's versions
+// and usages
+func (s *service) TranslateForPartner(ik, partnerID string, source KeyReference, keyBlock string, timeout time.Duration, opts ...UnwrapOption) (string, error) {
+	m, p, err := s.partnerOf(ik, partnerID)
+	if err != nil {
+		return "", err
+	}
+	if source.KeyPath == "" && source.KeyName == "" {
+		if len(m.Keys) == 0 {
+			return "", errMachineHasNoKBPK
+		}
+		source = m.Keys[0]
+	}
+	header := tr31.DefaultHeader()
+	if _, err := header.Load(keyBlock); err != nil {
+		return "", err
+	}
+	if err := p.allows(header.VersionID, header.KeyUsage); err != nil {
+		return "", err
+	}
+	translated, err := s.TranslateData(m.vaultAuth.VaultAddress, m.vaultAuth.VaultToken, source.KeyPath, source.KeyName, p.Key.KeyPath, p.Key.KeyName, keyBlock, timeout, opts...)
+	if err != nil {
+		return "", err
+	}
+	s.notifyPartner(p, PARTNER_EVENT_TRANSLATE, translated, "")
+	return translated, nil
+}
+
+// partnerOf returns the machine and a partner registered under it
+func (s *service) partnerOf(ik, partnerID string) (*Machine, *Partner, error) {
+	m, err := s.GetMachine(ik)
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := s.store.FindPartner(ik, partnerID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, p, nil
+}
+
+// notifyPartner POSTs an event to the webhooks of the partner in the background,
+// failed deliveries are not retried
+func (s *service) notifyPartner(p *Partner, eventType, keyBlock, kcv string) {
+	if len(p.Webhooks) == 0 {
+		return
+	}
+	hash := sha256.Sum256([]byte(keyBlock))
+	body, err := json.Marshal(PartnerEvent{
+		Type:         eventType,
+		PartnerID:    p.ID,
+		InitialKey:   p.InitialKey,
+		KeyBlockHash: hex.EncodeToString(hash[:]),
+		KCV:          kcv,
+		Time:         s.now(),
+	})
+	if err != nil {
+		return
+	}
+	for _, hook := range p.Webhooks {
+		go func(hook string) {
+			resp, err := partnerWebhookClient.Post(hook, "application/json", bytes.NewReader(body))
+			if err == nil {
+				resp.Body.Close()
+			}
+		}(hook)
+	}
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+	"github.com/stretchr/testify/require"
+)
+
+func mockPartner(t *testing.T, s Service, m *Machine, webhooks ...string) *Partner {
+	t.Helper()
+	s.GetSecretManager().WriteSecret("secret/partners", "acme", "0123456789ABCDEFFEDCBA98765432100123456789ABCDEFFEDCBA9876543210")
+	p := &Partner{
+		ID:              "acme",
+		Name:            "Acme Acquiring",
+		Key:             KeyReference{KeyPath: "secret/partners", KeyName: "acme"},
+		AllowedVersions: []string{"D"},
+		AllowedUsages:   []string{"P0", "K0"},
+		Contact:         PartnerContact{Name: "Key Custodians", Email: "keys@acme.example"},
+		Webhooks:        webhooks,
+	}
+	require.NoError(t, s.CreatePartner(m.InitialKey, p))
+	return p
+}
+
+func TestService_Partners(t *testing.T) {
+	s := mockServiceInMock()
+	m := mockTerminalMachine(t, s)
+	p := mockPartner(t, s, m)
+	require.Equal(t, m.InitialKey, p.InitialKey)
+	require.False(t, p.CreatedAt.IsZero())
+
+	require.ErrorIs(t, s.CreatePartner(m.InitialKey, &Partner{ID: "acme", Key: p.Key}), ErrAlreadyExists)
+	require.ErrorIs(t, s.CreatePartner("ffffffffffffffff", &Partner{ID: "other", Key: p.Key}), ErrNotFound)
+
+	found, err := s.GetPartner(m.InitialKey, "acme")
+	require.NoError(t, err)
+	require.Equal(t, p, found)
+	partners, err := s.GetPartners(m.InitialKey)
+	require.NoError(t, err)
+	require.Equal(t, []*Partner{p}, partners)
+
+	require.NoError(t, s.DeletePartner(m.InitialKey, "acme"))
+	_, err = s.GetPartner(m.InitialKey, "acme")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.ErrorIs(t, s.DeletePartner(m.InitialKey, "acme"), ErrNotFound)
+}
+
+func TestService_CreatePartner_invalid(t *testing.T) {
+	s := mockServiceInMock()
+	m := mockTerminalMachine(t, s)
+	key := KeyReference{KeyPath: "secret/partners", KeyName: "acme"}
+
+	tests := map[string]*Partner{
+		"no ID":   {Key: key},
+		"ID":      {ID: "acme zone", Key: key},
+		"no key":  {ID: "acme"},
+		"version": {ID: "acme", Key: key, AllowedVersions: []string{"Z"}},
+		"usage":   {ID: "acme", Key: key, AllowedUsages: []string{"P"}},
+		"webhook": {ID: "acme", Key: key, Webhooks: []string{"ftp://acme.example/hooks"}},
+		"no host": {ID: "acme", Key: key, Webhooks: []string{"https://"}},
+	}
+	for name, p := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.ErrorIs(t, s.CreatePartner(m.InitialKey, p), errInvalidPartner)
+		})
+	}
+}
+
+func TestService_WrapForPartner(t *testing.T) {
+	events := make(chan PartnerEvent, 2)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event PartnerEvent
+		body, _ := io.ReadAll(r.Body)
+		require.NoError(t, json.Unmarshal(body, &event))
+		events <- event
+	}))
+	defer hook.Close()
+
+	s := mockServiceInMock()
+	m := mockTerminalMachine(t, s)
+	mockPartner(t, s, m, hook.URL)
+
+	header := HeaderParams{VersionId: "D", KeyUsage: "P0", Algorithm: "A", ModeOfUse: "E", KeyVersion: "00", Exportability: "E"}
+	result, err := s.WrapForPartner(m.InitialKey, "acme", "11111111111111112222222222222222", header, 0)
+	require.NoError(t, err)
+
+	kbpk, err := readKBPK(s.GetSecretManager(), UnifiedParams{KeyPath: "secret/partners", KeyName: "acme"})
+	require.NoError(t, err)
+	kb, err := tr31.New(kbpk)
+	require.NoError(t, err)
+	key, err := kb.Unwrap(result.KeyBlock)
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat([]byte{0x11}, 8), key[:8])
+
+	select {
+	case event := <-events:
+		require.Equal(t, PARTNER_EVENT_WRAP, event.Type)
+		require.Equal(t, "acme", event.PartnerID)
+		require.Equal(t, m.InitialKey, event.InitialKey)
+		require.Equal(t, result.KCV, event.KCV)
+		require.Len(t, event.KeyBlockHash, 64)
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not notified")
+	}
+
+	// The partner policy applies before the KBPK is read
+	header.KeyUsage = "D0"
+	_, err = s.WrapForPartner(m.InitialKey, "acme", "11111111111111112222222222222222", header, 0)
+	require.ErrorIs(t, err, ErrUsageNotApproved)
+	header.VersionId, header.KeyUsage = "B", "P0"
+	_, err = s.WrapForPartner(m.InitialKey, "acme", "11111111111111112222222222222222", header, 0)
+	require.ErrorIs(t, err, ErrVersionNotAllowed)
+	_, err = s.WrapForPartner(m.InitialKey, "unknown", "11111111111111112222222222222222", header, 0)
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestService_TranslateForPartner(t *testing.T) {
+	s := mockServiceInMock()
+	m := mockTerminalMachine(t, s)
+	mockPartner(t, s, m)
+
+	auth := mockVaultAuthOne()
+	header := HeaderParams{VersionId: "D", KeyUsage: "K0", Algorithm: "A", ModeOfUse: "B", KeyVersion: "00", Exportability: "E"}
+	keyBlock, err := s.EncryptData(auth.VaultAddress, auth.VaultToken, "secret/tr31", "kbkp", "33333333333333334444444444444444", header, 0)
+	require.NoError(t, err)
+
+	translated, err := s.TranslateForPartner(m.InitialKey, "acme", KeyReference{}, keyBlock, 0)
+	require.NoError(t, err)
+	data, err := s.DecryptData(auth.VaultAddress, auth.VaultToken, "secret/partners", "acme", translated, 0)
+	require.NoError(t, err)
+	require.Equal(t, "33333333333333334444444444444444", data)
+
+	header.KeyUsage = "B0"
+	keyBlock, err = s.EncryptData(auth.VaultAddress, auth.VaultToken, "secret/tr31", "kbkp", "33333333333333334444444444444444", header, 0)
+	require.NoError(t, err)
+	_, err = s.TranslateForPartner(m.InitialKey, "acme", KeyReference{}, keyBlock, 0)
+	require.ErrorIs(t, err, ErrUsageNotApproved)
+}
+
+func TestRouting_partners(t *testing.T) {
+	s := mockServiceInMock()
+	m := mockTerminalMachine(t, s)
+	s.GetSecretManager().WriteSecret("secret/partners", "acme", "0123456789ABCDEFFEDCBA98765432100123456789ABCDEFFEDCBA9876543210")
+	router := MakeHTTPHandler(s)
+
+	serve := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != nil {
+			encoded, err := json.Marshal(body)
+			require.NoError(t, err)
+			reader = bytes.NewReader(encoded)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, reader))
+		return w
+	}
+
+	w := serve("POST", "/machine/"+m.InitialKey+"/partners", map[string]interface{}{
+		"ID":              "acme",
+		"Key":             map[string]string{"KeyPath": "secret/partners", "KeyName": "acme"},
+		"AllowedVersions": []string{"D"},
+		"AllowedUsages":   []string{"P0"},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = serve("POST", "/machine/"+m.InitialKey+"/partners", map[string]interface{}{"ID": "acme"})
+	require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	w = serve("GET", "/machine/"+m.InitialKey+"/partners", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var partners partnersResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &partners))
+	require.Len(t, partners.Partners, 1)
+
+	wrap := map[string]interface{}{
+		"EncryptKey": "11111111111111112222222222222222",
+		"Header":     HeaderParams{VersionId: "D", KeyUsage: "P0", Algorithm: "A", ModeOfUse: "E", KeyVersion: "00", Exportability: "E"},
+	}
+	w = serve("POST", "/machine/"+m.InitialKey+"/partners/acme/encrypt_data", wrap)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var wrapped encryptDataResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &wrapped))
+
+	w = serve("POST", "/machine/"+m.InitialKey+"/partners/acme/translate_data", map[string]string{
+		"KeyPath":  "secret/partners",
+		"KeyName":  "acme",
+		"KeyBlock": wrapped.Data,
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	wrap["Header"] = HeaderParams{VersionId: "D", KeyUsage: "D0", Algorithm: "A", ModeOfUse: "E", KeyVersion: "00", Exportability: "E"}
+	w = serve("POST", "/machine/"+m.InitialKey+"/partners/acme/encrypt_data", wrap)
+	require.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+
+	w = serve("DELETE", "/machine/"+m.InitialKey+"/partners/acme", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = serve("GET", "/machine/"+m.InitialKey+"/partners/acme", nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics/prometheus"
+	"github.com/moov-io/base/log"
+	"github.com/moov-io/tr31/pkg/tr31"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	policyReloadedAt = prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+		Name: "tr31_policy_last_reload_timestamp_seconds",
+		Help: "Unix time the policy files were last loaded",
+	}, nil)
+	policyReloadErrors = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "tr31_policy_reload_errors_total",
+		Help: "Number of policy reloads which failed and kept the previous policy",
+	}, nil)
+	legacyStrengthOperations = stdprometheus.NewCounterFunc(stdprometheus.CounterOpts{
+		Name: "tr31_legacy_strength_operations_total",
+		Help: "Number of single DES keys wrapped and of keys wrapped or unwrapped under single DES KBPKs",
+	}, func() float64 { return float64(tr31.LegacyStrengthOperations()) })
+)
+
+func init() {
+	stdprometheus.MustRegister(legacyStrengthOperations)
+}
+
+var errNoPolicyFiles = errors.New("no policy file to watch")
+
+// PolicyFiles are the files of the policy applied by a PolicyWatcher, empty paths are ignored
+type PolicyFiles struct {
+	// Machines is a machines.yaml declaration, which holds the allowed versions of each machine
+	Machines string
+	// UsageRules are the key usages each caller may unwrap
+	UsageRules string
+	// BlockPolicy lists the optional blocks of wrapped and unwrapped key blocks
+	BlockPolicy string
+}
+
+// PolicyFile is a file of the active policy
+type PolicyFile struct {
+	Path       string    `json:"path"`
+	SHA256     string    `json:"sha256"`
+	ModifiedAt time.Time `json:"modifiedAt"`
+}
+
+// PolicyStatus describes the active policy. Version changes whenever the
+// content of a policy file does.
+type PolicyStatus struct {
+	Version  string       `json:"version"`
+	LoadedAt time.Time    `json:"loadedAt"`
+	Files    []PolicyFile `json:"files"`
+	// LastError is the reason the last reload failed, the previous policy stays active
+	LastError string `json:"lastError,omitempty"`
+}
+
+// PolicyWatcher keeps the policy files applied to a service and applies them
+// again when they change, without restarting the service. The files are all
+// parsed before any is applied, so a file with a mistake leaves the previous
+// policy active. It approves key usages with the latest usage rules.
+type PolicyWatcher struct {
+	svc      Service
+	files    PolicyFiles
+	interval time.Duration
+	logger   log.Logger
+
+	mu         sync.RWMutex
+	usageRules *UsageRules
+	status     PolicyStatus
+	modTimes   map[string]time.Time
+}
+
+// NewPolicyWatcher loads and applies the policy files. The files are checked
+// for changes every interval once Watch is running.
+func NewPolicyWatcher(svc Service, files PolicyFiles, interval time.Duration, logger log.Logger) (*PolicyWatcher, error) {
+	if files.Machines == "" && files.UsageRules == "" && files.BlockPolicy == "" {
+		return nil, errNoPolicyFiles
+	}
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	w := &PolicyWatcher{
+		svc:      svc,
+		files:    files,
+		interval: interval,
+		logger:   logger,
+		modTimes: make(map[string]time.Time),
+	}
+	if err := w.Reload(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Reload reads the policy files and applies them to the service
+func (w *PolicyWatcher) Reload() error {
+	modTimes := w.modTimesOf()
+	err := w.reload()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// A failed reload is retried once the files change again
+	w.modTimes = modTimes
+	if err != nil {
+		policyReloadErrors.Add(1)
+		w.status.LastError = err.Error()
+	}
+	return err
+}
+
+func (w *PolicyWatcher) reload() error {
+	var (
+		decl        *Declaration
+		usageRules  *UsageRules
+		blockPolicy *BlockPolicy
+		files       []PolicyFile
+	)
+	version := sha256.New()
+	read := func(path string) ([]byte, error) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(data)
+		version.Write(sum[:])
+		files = append(files, PolicyFile{Path: path, SHA256: hex.EncodeToString(sum[:]), ModifiedAt: info.ModTime()})
+		return data, nil
+	}
+
+	if path := w.files.Machines; path != "" {
+		data, err := read(path)
+		if err != nil {
+			return err
+		}
+		if decl, err = ParseDeclaration(data); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if path := w.files.UsageRules; path != "" {
+		data, err := read(path)
+		if err != nil {
+			return err
+		}
+		if usageRules, err = ParseUsageRules(data); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if path := w.files.BlockPolicy; path != "" {
+		data, err := read(path)
+		if err != nil {
+			return err
+		}
+		if blockPolicy, err = ParseBlockPolicy(data); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if decl != nil {
+		if _, err := w.svc.Apply(decl); err != nil {
+			return fmt.Errorf("%s: %w", w.files.Machines, err)
+		}
+	}
+	if w.files.BlockPolicy != "" {
+		w.svc.ConfigureBlockPolicy(blockPolicy)
+	}
+
+	now := time.Now()
+	w.mu.Lock()
+	w.usageRules = usageRules
+	w.status = PolicyStatus{
+		Version:  hex.EncodeToString(version.Sum(nil))[:12],
+		LoadedAt: now,
+		Files:    files,
+	}
+	w.mu.Unlock()
+	policyReloadedAt.Set(float64(now.Unix()))
+	return nil
+}
+
+// Watch polls the policy files and reloads them when they change, until ctx is cancelled
+func (w *PolicyWatcher) Watch(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !w.changed() {
+				continue
+			}
+			if err := w.Reload(); err != nil {
+				w.logger.LogErrorf("reloading policy, keeping version %s: %v", w.Status().Version, err)
+				continue
+			}
+			w.logger.Logf("reloaded policy version %s", w.Status().Version)
+		}
+	}
+}
+
+// WithPolicyWatcher serves the active policy of the watcher from GET /policy
+func WithPolicyWatcher(w *PolicyWatcher) HandlerOption {
+	return func(cfg *handlerConfig) {
+		cfg.policyWatcher = w
+	}
+}
+
+// Status returns the active policy
+func (w *PolicyWatcher) Status() PolicyStatus {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.status
+}
+
+// Approve implements UsageApprover with the latest usage rules. Every usage
+// is denied when the policy has no usage rules file.
+func (w *PolicyWatcher) Approve(principal string, header *tr31.Header) (bool, string) {
+	w.mu.RLock()
+	rules := w.usageRules
+	w.mu.RUnlock()
+	if rules == nil {
+		return false, "no usage rules loaded"
+	}
+	return rules.Approve(principal, header)
+}
+
+func (w *PolicyWatcher) paths() []string {
+	var paths []string
+	for _, path := range []string{w.files.Machines, w.files.UsageRules, w.files.BlockPolicy} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+func (w *PolicyWatcher) modTimesOf() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, path := range w.paths() {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[path] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+func (w *PolicyWatcher) changed() bool {
+	modTimes := w.modTimesOf()
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	for _, path := range w.paths() {
+		if !modTimes[path].Equal(w.modTimes[path]) {
+			return true
+		}
+	}
+	return false
+}
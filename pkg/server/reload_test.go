@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base/log"
+	"github.com/moov-io/tr31/pkg/tr31"
+	"github.com/stretchr/testify/require"
+)
+
+func writePolicyFile(t *testing.T, path, data string, modTime time.Time) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(data), 0600))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestPolicyWatcher(t *testing.T) {
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+
+	dir := t.TempDir()
+	files := PolicyFiles{
+		Machines:    filepath.Join(dir, "machines.yaml"),
+		UsageRules:  filepath.Join(dir, "usage_rules.yaml"),
+		BlockPolicy: filepath.Join(dir, "block_policy.yaml"),
+	}
+	start := time.Now().Add(-time.Hour)
+	writePolicyFile(t, files.Machines, `
+machines:
+  - vaultAddress: http://localhost:8200
+    vaultToken: token
+    allowedVersions: [D]
+    keys:
+      - keyPath: secret/tr31
+        keyName: kbkp
+`, start)
+	writePolicyFile(t, files.UsageRules, `
+rules:
+  - principal: pos-gateway
+    allow: [D0]
+`, start)
+	writePolicyFile(t, files.BlockPolicy, `
+blocks:
+  - id: LB
+    value: INST0042
+`, start)
+
+	w, err := NewPolicyWatcher(s, files, time.Millisecond, log.NewNopLogger())
+	require.NoError(t, err)
+	status := w.Status()
+	require.Len(t, status.Version, 12)
+	require.Len(t, status.Files, 3)
+	require.Empty(t, status.LastError)
+	require.False(t, w.changed())
+
+	machines, err := s.GetMachines()
+	require.NoError(t, err)
+	require.Len(t, machines, 1)
+	require.Equal(t, []string{"D"}, machines[0].AllowedVersions)
+
+	header, err := tr31.NewHeader("D", "D0", "A", "D", "00", "E")
+	require.NoError(t, err)
+	approved, _ := w.Approve("pos-gateway", header)
+	require.True(t, approved)
+
+	// Changes are applied by Watch without restarting the service
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Watch(ctx)
+
+	writePolicyFile(t, files.UsageRules, `
+rules:
+  - principal: pos-gateway
+    deny: [D0]
+`, start.Add(time.Minute))
+	require.Eventually(t, func() bool {
+		return w.Status().Version != status.Version
+	}, time.Second, time.Millisecond)
+	approved, _ = w.Approve("pos-gateway", header)
+	require.False(t, approved)
+
+	writePolicyFile(t, files.Machines, `
+machines:
+  - vaultAddress: http://localhost:8200
+    vaultToken: token
+    allowedVersions: [B, D]
+    keys:
+      - keyPath: secret/tr31
+        keyName: kbkp
+`, start.Add(2*time.Minute))
+	require.Eventually(t, func() bool {
+		machines, err := s.GetMachines()
+		return err == nil && len(machines) == 1 && len(machines[0].AllowedVersions) == 2
+	}, time.Second, time.Millisecond)
+	cancel()
+
+	// A file with a mistake keeps the previous policy active
+	status = w.Status()
+	writePolicyFile(t, files.BlockPolicy, `blocks: [{id: LB}]`, start.Add(3*time.Minute))
+	require.ErrorIs(t, w.Reload(), errInvalidBlockPolicy)
+	require.Equal(t, status.Version, w.Status().Version)
+	require.Contains(t, w.Status().LastError, files.BlockPolicy)
+	require.False(t, w.changed())
+	require.NotNil(t, s.(*service).blockPolicy.Load())
+
+	_, err = NewPolicyWatcher(s, PolicyFiles{}, 0, nil)
+	require.ErrorIs(t, err, errNoPolicyFiles)
+	_, err = NewPolicyWatcher(s, PolicyFiles{UsageRules: filepath.Join(dir, "missing.yaml")}, 0, nil)
+	require.Error(t, err)
+}
+
+func TestRouting_policy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage_rules.yaml")
+	writePolicyFile(t, path, `rules: [{principal: "*", allow: [D0]}]`, time.Now())
+	w, err := NewPolicyWatcher(mockServiceInMock(), PolicyFiles{UsageRules: path}, 0, nil)
+	require.NoError(t, err)
+
+	// The endpoint is only served when a watcher is configured
+	rec := httptest.NewRecorder()
+	mockHttpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/policy", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = httptest.NewRecorder()
+	MakeHTTPHandler(mockServiceInMock(), WithPolicyWatcher(w)).ServeHTTP(rec, httptest.NewRequest("GET", "/policy", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var body struct {
+		Policy PolicyStatus `json:"policy"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	require.Equal(t, w.Status().Version, body.Policy.Version)
+	require.Equal(t, path, body.Policy.Files[0].Path)
+}
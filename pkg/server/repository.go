@@ -2,6 +2,8 @@ package server
 
 import (
 	"errors"
+	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/moov-io/base/log"
@@ -11,26 +13,89 @@ import (
 type Repository interface {
 	StoreMachine(m *Machine) error
 	FindMachine(ik string) (*Machine, error)
-	FindAllMachines() []*Machine
+	FindMachineByTransactionKey(tk string) (*Machine, error)
+	FindAllMachines() ([]*Machine, error)
+	FindMachines(query MachineQuery) ([]*Machine, int, error)
+	FindMachinesByKey(path, name string) ([]*Machine, error)
+	UpdateMachine(ik string, update func(m *Machine) error) (*Machine, error)
 	DeleteMachine(ik string) error
+	StoreTerminal(t *Terminal) error
+	FindTerminal(ik, terminalID string) (*Terminal, error)
+	FindTerminals(ik string) []*Terminal
+	StoreTransportKey(tk *TransportKey) error
+	FindTransportKey(ik, keyID string) (*TransportKey, error)
+	StorePartner(p *Partner) error
+	FindPartner(ik, partnerID string) (*Partner, error)
+	FindPartners(ik string) []*Partner
+	DeletePartner(ik, partnerID string) error
 }
 
 type repositoryInMemory struct {
-	mtx      sync.RWMutex
-	machines map[string]*Machine
-	logger   log.Logger
+	mtx       sync.RWMutex
+	machines  map[string]*sealedMachine
+	sealer    CredentialSealer
+	terminals map[string]*Terminal
+	transport map[string]*TransportKey
+	partners  map[string]*Partner
+	logger    log.Logger
 }
 
-// NewRepositoryInMemory is an in memory ach storage repository for machines
-func NewRepositoryInMemory(logger log.Logger) Repository {
+// RepositoryOption configures the repository created by NewRepositoryInMemory
+type RepositoryOption func(*repositoryInMemory)
+
+// WithCredentialSealer seals the vault credentials of machines with sealer
+// instead of a random key generated for the repository
+func WithCredentialSealer(sealer CredentialSealer) RepositoryOption {
+	return func(r *repositoryInMemory) {
+		r.sealer = sealer
+	}
+}
+
+// NewRepositoryInMemory is an in memory ach storage repository for machines.
+// The vault credentials of machines are sealed at rest, machines found are
+// copies with their credentials opened.
+func NewRepositoryInMemory(logger log.Logger, opts ...RepositoryOption) Repository {
 	repo := &repositoryInMemory{
-		machines: make(map[string]*Machine),
-		logger:   logger,
+		machines:  make(map[string]*sealedMachine),
+		terminals: make(map[string]*Terminal),
+		transport: make(map[string]*TransportKey),
+		partners:  make(map[string]*Partner),
+		logger:    logger,
+	}
+	for _, opt := range opts {
+		opt(repo)
+	}
+	if repo.sealer == nil {
+		sealer, err := newEphemeralCredentialSealer()
+		if err != nil {
+			// Machines can't be stored without a sealing key, StoreMachine
+			// returns the error instead
+			if logger != nil {
+				logger.LogErrorf("repository: %v", err)
+			}
+			repo.sealer = unavailableSealer{err: err}
+		} else {
+			repo.sealer = sealer
+		}
 	}
 
 	return repo
 }
 
+// openMachines opens the sealed machines, machines whose credentials can't be
+// opened fail the whole lookup rather than going missing from it
+func (r *repositoryInMemory) openMachines(sealed []*sealedMachine) ([]*Machine, error) {
+	machines := make([]*Machine, 0, len(sealed))
+	for _, s := range sealed {
+		m, err := s.open(r.sealer)
+		if err != nil {
+			return nil, fmt.Errorf("opening machine %s: %w", s.machine.InitialKey, err)
+		}
+		machines = append(machines, m)
+	}
+	return machines, nil
+}
+
 // StoreMachine create new machine based on the supplied initial key
 func (r *repositoryInMemory) StoreMachine(m *Machine) error {
 	if m == nil {
@@ -42,7 +107,20 @@ func (r *repositoryInMemory) StoreMachine(m *Machine) error {
 	if _, ok := r.machines[m.InitialKey]; ok {
 		return ErrAlreadyExists
 	}
-	r.machines[m.InitialKey] = m
+	// The transaction key derives from the vault credentials, which are
+	// registered to a single machine whatever its ID
+	if m.TransactionKey != "" {
+		for _, other := range r.machines {
+			if other.machine.TransactionKey == m.TransactionKey {
+				return fmt.Errorf("%w: the vault credentials are registered to machine %s", ErrAlreadyExists, other.machine.InitialKey)
+			}
+		}
+	}
+	sealed, err := sealMachine(r.sealer, m)
+	if err != nil {
+		return err
+	}
+	r.machines[m.InitialKey] = sealed
 	return nil
 }
 
@@ -51,20 +129,119 @@ func (r *repositoryInMemory) FindMachine(ik string) (*Machine, error) {
 	r.mtx.RLock()
 	defer r.mtx.RUnlock()
 	if val, ok := r.machines[ik]; ok {
-		return val, nil
+		return val.open(r.sealer)
+	}
+	return nil, ErrNotFound
+}
+
+// FindMachineByTransactionKey retrieves the machine registered for the vault
+// credentials the transaction key derives from
+func (r *repositoryInMemory) FindMachineByTransactionKey(tk string) (*Machine, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	for _, m := range r.machines {
+		if tk != "" && m.machine.TransactionKey == tk {
+			return m.open(r.sealer)
+		}
 	}
 	return nil, ErrNotFound
 }
 
 // FindAllMachines returns all machines that have been saved in memory
-func (r *repositoryInMemory) FindAllMachines() []*Machine {
+func (r *repositoryInMemory) FindAllMachines() ([]*Machine, error) {
 	r.mtx.RLock()
 	defer r.mtx.RUnlock()
-	files := make([]*Machine, 0, len(r.machines))
+	files := make([]*sealedMachine, 0, len(r.machines))
 	for i := range r.machines {
 		files = append(files, r.machines[i])
 	}
-	return files
+	return r.openMachines(files)
+}
+
+// FindMachines filters, sorts and pages the machines saved in memory and returns
+// the page along with the number of machines matching the filters
+func (r *repositoryInMemory) FindMachines(query MachineQuery) ([]*Machine, int, error) {
+	// Machines are filtered and sorted without their credentials, only the
+	// page is opened
+	r.mtx.RLock()
+	matches := make([]*Machine, 0, len(r.machines))
+	sealed := make(map[*Machine]*sealedMachine, len(r.machines))
+	for _, s := range r.machines {
+		if query.matches(&s.machine) {
+			matches = append(matches, &s.machine)
+			sealed[&s.machine] = s
+		}
+	}
+	r.mtx.RUnlock()
+
+	query.sort(matches)
+	total := len(matches)
+	page := query.page(matches)
+	pageSealed := make([]*sealedMachine, 0, len(page))
+	for _, m := range page {
+		pageSealed = append(pageSealed, sealed[m])
+	}
+	machines, err := r.openMachines(pageSealed)
+	if err != nil {
+		return nil, 0, err
+	}
+	return machines, total, nil
+}
+
+// FindMachinesByKey retrieves the machines referencing the KBPK at path/name,
+// failing if any of them can't be opened
+func (r *repositoryInMemory) FindMachinesByKey(path, name string) ([]*Machine, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	var machines []*Machine
+	for _, s := range r.machines {
+		if !isMachineKBPK(&s.machine, path, name) {
+			continue
+		}
+		m, err := s.open(r.sealer)
+		if err != nil {
+			return nil, err
+		}
+		machines = append(machines, m)
+	}
+	return machines, nil
+}
+
+// UpdateMachine applies update to a copy of the machine with the initial key and
+// stores the result in its place, holding the lock so that the machine is never
+// missing and concurrent updates aren't lost. The slices and maps of the copy
+// are shared with the stored machine, update replaces them rather than
+// changing them, and must not call the repository.
+func (r *repositoryInMemory) UpdateMachine(ik string, update func(m *Machine) error) (*Machine, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	current, ok := r.machines[ik]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	m, err := current.open(r.sealer)
+	if err != nil {
+		return nil, err
+	}
+	if err := update(m); err != nil {
+		return nil, err
+	}
+	if m.InitialKey != ik {
+		return nil, fmt.Errorf("%w: the initial key of machine %s can't change", errInvalidMachine, ik)
+	}
+	if m.TransactionKey != "" {
+		for otherIK, other := range r.machines {
+			if otherIK != ik && other.machine.TransactionKey == m.TransactionKey {
+				return nil, fmt.Errorf("%w: the vault credentials are registered to machine %s", ErrAlreadyExists, otherIK)
+			}
+		}
+	}
+	sealed, err := sealMachine(r.sealer, m)
+	if err != nil {
+		return nil, err
+	}
+	r.machines[ik] = sealed
+	return m, nil
 }
 
 // DeleteMachine removes a machine that have been saved in memory by the supplied initial key
@@ -74,3 +251,126 @@ func (r *repositoryInMemory) DeleteMachine(ik string) error {
 	delete(r.machines, ik)
 	return nil
 }
+
+// StoreTerminal saves the TMK association of a terminal
+func (r *repositoryInMemory) StoreTerminal(t *Terminal) error {
+	if t == nil {
+		return errors.New("nil terminal provided")
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	key := t.InitialKey + "/" + t.TerminalID
+	if _, ok := r.terminals[key]; ok {
+		return ErrAlreadyExists
+	}
+	r.terminals[key] = t
+	return nil
+}
+
+// FindTerminal retrieves the TMK association of a terminal provisioned under the machine
+func (r *repositoryInMemory) FindTerminal(ik, terminalID string) (*Terminal, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if val, ok := r.terminals[ik+"/"+terminalID]; ok {
+		return val, nil
+	}
+	return nil, ErrNotFound
+}
+
+// FindTerminals retrieves the TMK associations of the terminals provisioned under
+// the machine, sorted by terminal ID
+func (r *repositoryInMemory) FindTerminals(ik string) []*Terminal {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	terminals := make([]*Terminal, 0)
+	for _, t := range r.terminals {
+		if t.InitialKey == ik {
+			terminals = append(terminals, t)
+		}
+	}
+	sort.Slice(terminals, func(i, j int) bool {
+		return terminals[i].TerminalID < terminals[j].TerminalID
+	})
+	return terminals
+}
+
+// StoreTransportKey saves a transport key registered under a machine
+func (r *repositoryInMemory) StoreTransportKey(tk *TransportKey) error {
+	if tk == nil {
+		return errors.New("nil transport key provided")
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	key := tk.InitialKey + "/" + tk.KeyID
+	if _, ok := r.transport[key]; ok {
+		return ErrAlreadyExists
+	}
+	r.transport[key] = tk
+	return nil
+}
+
+// FindTransportKey retrieves a transport key registered under the machine
+func (r *repositoryInMemory) FindTransportKey(ik, keyID string) (*TransportKey, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if val, ok := r.transport[ik+"/"+keyID]; ok {
+		return val, nil
+	}
+	return nil, ErrNotFound
+}
+
+// StorePartner saves a partner registered under a machine
+func (r *repositoryInMemory) StorePartner(p *Partner) error {
+	if p == nil {
+		return errors.New("nil partner provided")
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	key := p.InitialKey + "/" + p.ID
+	if _, ok := r.partners[key]; ok {
+		return ErrAlreadyExists
+	}
+	r.partners[key] = p
+	return nil
+}
+
+// FindPartner retrieves a partner registered under the machine
+func (r *repositoryInMemory) FindPartner(ik, partnerID string) (*Partner, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if val, ok := r.partners[ik+"/"+partnerID]; ok {
+		return val, nil
+	}
+	return nil, ErrNotFound
+}
+
+// FindPartners retrieves the partners registered under the machine, sorted by ID
+func (r *repositoryInMemory) FindPartners(ik string) []*Partner {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	partners := make([]*Partner, 0)
+	for _, p := range r.partners {
+		if p.InitialKey == ik {
+			partners = append(partners, p)
+		}
+	}
+	sort.Slice(partners, func(i, j int) bool {
+		return partners[i].ID < partners[j].ID
+	})
+	return partners
+}
+
+// DeletePartner removes a partner registered under the machine
+func (r *repositoryInMemory) DeletePartner(ik, partnerID string) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	key := ik + "/" + partnerID
+	if _, ok := r.partners[key]; !ok {
+		return ErrNotFound
+	}
+	delete(r.partners, key)
+	return nil
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepository_UpdateMachine(t *testing.T) {
+	repository := NewRepositoryInMemory(nil)
+	vault := Vault{VaultAddress: "http://vault:8200", VaultToken: "token"}
+	for _, ik := range []string{"ik-1", "ik-2"} {
+		m := NewMachine(vault)
+		m.InitialKey = ik
+		m.TransactionKey = "tk-" + ik
+		require.NoError(t, repository.StoreMachine(m))
+	}
+
+	updated, err := repository.UpdateMachine("ik-1", func(m *Machine) error {
+		m.Tags = map[string]string{"env": "prod"}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"env": "prod"}, updated.Tags)
+	require.Equal(t, vault, updated.vaultAuth)
+	found, err := repository.FindMachine("ik-1")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"env": "prod"}, found.Tags)
+
+	// Failed updates leave the machine as it was
+	_, err = repository.UpdateMachine("ik-1", func(m *Machine) error {
+		m.Tags = nil
+		return errors.New("rejected")
+	})
+	require.EqualError(t, err, "rejected")
+	_, err = repository.UpdateMachine("ik-1", func(m *Machine) error {
+		m.InitialKey = "ik-3"
+		return nil
+	})
+	require.ErrorIs(t, err, errInvalidMachine)
+	_, err = repository.UpdateMachine("ik-1", func(m *Machine) error {
+		m.TransactionKey = "tk-ik-2"
+		return nil
+	})
+	require.ErrorIs(t, err, ErrAlreadyExists)
+	found, err = repository.FindMachine("ik-1")
+	require.NoError(t, err)
+	require.Equal(t, "tk-ik-1", found.TransactionKey)
+	require.Equal(t, map[string]string{"env": "prod"}, found.Tags)
+
+	_, err = repository.UpdateMachine("missing", func(*Machine) error { return nil })
+	require.Equal(t, ErrNotFound, err)
+}
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+const (
+	// RequestSignatureHeader holds the detached JWS over the signing input of signed requests
+	RequestSignatureHeader = "X-Request-Signature"
+	// RequestTimestampHeader holds the Unix time in seconds a signed request was sent at
+	RequestTimestampHeader = "X-Request-Timestamp"
+	// RequestNonceHeader holds the nonce of a signed request, never sent twice by a client
+	RequestNonceHeader = "X-Request-Nonce"
+
+	// DefaultRequestSigningWindow is how far the timestamp of a signed request
+	// may be from the server time when no window is configured
+	DefaultRequestSigningWindow = 5 * time.Minute
+
+	minRequestNonceLength = 16
+	maxRequestNonceLength = 128
+)
+
+var (
+	// ErrRequestSignature is returned for requests without a valid signature
+	// by a known client key, or with a timestamp outside the signing window
+	ErrRequestSignature = errors.New("missing or invalid request signature")
+	// ErrRequestReplayed is returned for signed requests whose nonce was already received
+	ErrRequestReplayed = errors.New("request nonce was already used")
+
+	errInvalidRequestSigningKey = errors.New("invalid request signing key")
+)
+
+// _requestSigningPublicPaths are answered without a request signature
+var _requestSigningPublicPaths = []string{"/ping", "/.well-known/jwks.json"}
+
+// NonceStore remembers the nonces of signed requests while their timestamp is
+// within the signing window. Replicas of the server share a NonceStore, such
+// as one backed by Redis, so a request captured from one can't be replayed to
+// another.
+type NonceStore interface {
+	// Use records nonce until expires, it returns false when the nonce is
+	// already recorded
+	Use(nonce string, expires time.Time) (bool, error)
+}
+
+// memoryNonceStore is a NonceStore for a single server
+type memoryNonceStore struct {
+	mu        sync.Mutex
+	nonces    map[string]time.Time
+	lastPrune time.Time
+}
+
+// NewMemoryNonceStore returns a NonceStore keeping nonces in memory, for a
+// single server
+func NewMemoryNonceStore() NonceStore {
+	return &memoryNonceStore{nonces: make(map[string]time.Time)}
+}
+
+func (s *memoryNonceStore) Use(nonce string, expires time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastPrune) > time.Minute {
+		for n, exp := range s.nonces {
+			if now.After(exp) {
+				delete(s.nonces, n)
+			}
+		}
+		s.lastPrune = now
+	}
+	if exp, exists := s.nonces[nonce]; exists && !now.After(exp) {
+		return false, nil
+	}
+	s.nonces[nonce] = expires
+	return true, nil
+}
+
+// requestSigningInput is the payload signed for a request: its method, URI,
+// timestamp and nonce, and the base64url SHA-256 of its body, one per line
+func requestSigningInput(r *http.Request, timestamp, nonce string, body []byte) []byte {
+	digest := sha256.Sum256(body)
+	return []byte(strings.Join([]string{
+		r.Method,
+		r.URL.RequestURI(),
+		timestamp,
+		nonce,
+		base64.RawURLEncoding.EncodeToString(digest[:]),
+	}, "\n"))
+}
+
+// RequestSigner signs the requests of an API client, see WithRequestSigning.
+// Signatures are compact JWS with a detached payload, whose key ID is the RFC
+// 7638 thumbprint of the client public key.
+type RequestSigner struct {
+	signer jose.Signer
+	clock  Clock
+}
+
+// NewRequestSigner returns a RequestSigner for an ECDSA (P-256, P-384 or
+// P-521), RSA or Ed25519 private key
+func NewRequestSigner(key crypto.Signer) (*RequestSigner, error) {
+	algorithm, err := signingAlgorithm(key)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := signingJWK(key.Public(), algorithm)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: algorithm, Key: key},
+		(&jose.SignerOptions{}).WithHeader(jose.HeaderKey("kid"), publicKey.KeyID),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidSigningKey, err)
+	}
+	return &RequestSigner{signer: signer, clock: SystemClock}, nil
+}
+
+// Sign sets the timestamp, a random nonce and the signature headers of a
+// request whose body is body
+func (rs *RequestSigner) Sign(r *http.Request, body []byte) error {
+	random := make([]byte, 18)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(rs.clock.Now().Unix(), 10)
+	nonce := base64.RawURLEncoding.EncodeToString(random)
+
+	jws, err := rs.signer.Sign(requestSigningInput(r, timestamp, nonce, body))
+	if err != nil {
+		return err
+	}
+	signature, err := jws.DetachedCompactSerialize()
+	if err != nil {
+		return err
+	}
+	r.Header.Set(RequestTimestampHeader, timestamp)
+	r.Header.Set(RequestNonceHeader, nonce)
+	r.Header.Set(RequestSignatureHeader, signature)
+	return nil
+}
+
+// RequestVerifier checks requests are signed by a known client key, were sent
+// within the signing window and aren't replayed
+type RequestVerifier struct {
+	keys   map[string]jose.JSONWebKey
+	window time.Duration
+	nonces NonceStore
+	clock  Clock
+}
+
+// NewRequestVerifier returns a RequestVerifier accepting requests signed by the
+// private keys of publicKeys, sent at most window away from the server time,
+// DefaultRequestSigningWindow when zero. Nonces are recorded in nonces, a
+// NewMemoryNonceStore when nil.
+func NewRequestVerifier(publicKeys []crypto.PublicKey, window time.Duration, nonces NonceStore) (*RequestVerifier, error) {
+	if len(publicKeys) == 0 {
+		return nil, fmt.Errorf("%w: no client public key", errInvalidRequestSigningKey)
+	}
+	if window < 0 {
+		return nil, fmt.Errorf("%w: the signing window must not be negative", errInvalidRequestSigningKey)
+	}
+	if window == 0 {
+		window = DefaultRequestSigningWindow
+	}
+	if nonces == nil {
+		nonces = NewMemoryNonceStore()
+	}
+	v := &RequestVerifier{
+		keys:   make(map[string]jose.JSONWebKey, len(publicKeys)),
+		window: window,
+		nonces: nonces,
+		clock:  SystemClock,
+	}
+	for _, key := range publicKeys {
+		switch key.(type) {
+		case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		default:
+			return nil, fmt.Errorf("%w: unsupported key type %T", errInvalidRequestSigningKey, key)
+		}
+		jwk, err := signingJWK(key, "")
+		if err != nil {
+			return nil, err
+		}
+		v.keys[jwk.KeyID] = jwk
+	}
+	return v, nil
+}
+
+// LoadRequestVerifier reads the PEM "PUBLIC KEY" files of the clients and
+// returns a RequestVerifier for them, see NewRequestVerifier
+func LoadRequestVerifier(paths []string, window time.Duration, nonces NonceStore) (*RequestVerifier, error) {
+	publicKeys := make([]crypto.PublicKey, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%w: no PEM data found in %s", errInvalidRequestSigningKey, path)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", errInvalidRequestSigningKey, path, err)
+		}
+		publicKeys = append(publicKeys, key)
+	}
+	return NewRequestVerifier(publicKeys, window, nonces)
+}
+
+// Verify checks the signature, timestamp and nonce of a request whose body is body
+func (v *RequestVerifier) Verify(r *http.Request, body []byte) error {
+	signature := r.Header.Get(RequestSignatureHeader)
+	timestamp := r.Header.Get(RequestTimestampHeader)
+	nonce := r.Header.Get(RequestNonceHeader)
+	if signature == "" || timestamp == "" || nonce == "" {
+		return fmt.Errorf("%w: the %s, %s and %s headers are required", ErrRequestSignature, RequestSignatureHeader, RequestTimestampHeader, RequestNonceHeader)
+	}
+	if len(nonce) < minRequestNonceLength || len(nonce) > maxRequestNonceLength || strings.ContainsFunc(nonce, func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_')
+	}) {
+		return fmt.Errorf("%w: the nonce must be %d to %d base64url characters", ErrRequestSignature, minRequestNonceLength, maxRequestNonceLength)
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: the timestamp must be a Unix time in seconds", ErrRequestSignature)
+	}
+	now := v.clock.Now()
+	sent := time.Unix(seconds, 0)
+	if sent.Before(now.Add(-v.window)) || sent.After(now.Add(v.window)) {
+		return fmt.Errorf("%w: the timestamp is outside the %v signing window", ErrRequestSignature, v.window)
+	}
+
+	input := requestSigningInput(r, timestamp, nonce, body)
+	jws, err := jose.ParseDetached(signature, input, _responseSigningAlgorithms)
+	if err != nil || len(jws.Signatures) != 1 {
+		return fmt.Errorf("%w: malformed signature", ErrRequestSignature)
+	}
+	keyID := jws.Signatures[0].Header.KeyID
+	key, known := v.keys[keyID]
+	if !known {
+		return fmt.Errorf("%w: unknown key %q", ErrRequestSignature, keyID)
+	}
+	if err := jws.DetachedVerify(input, key.Key); err != nil {
+		return fmt.Errorf("%w: the signature doesn't match the request", ErrRequestSignature)
+	}
+
+	// The nonce is recorded once the request is authenticated, so forged
+	// requests can't burn the nonces of a client
+	fresh, err := v.nonces.Use(keyID+" "+nonce, sent.Add(v.window))
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrRequestReplayed
+	}
+	return nil
+}
+
+// WithRequestSigning requires every request, besides CORS pre-flight requests,
+// /ping and /.well-known/jwks.json, to be signed by a client key of verifier
+// with a fresh nonce, so captured requests, such as /encrypt_data and
+// /decrypt_data requests, can't be sent again to obtain keys.
+func WithRequestSigning(verifier *RequestVerifier) HandlerOption {
+	return func(cfg *handlerConfig) {
+		cfg.requestVerifier = verifier
+	}
+}
+
+// signedRequests rejects requests which aren't signed by a client key of
+// verifier, or whose nonce was already used
+func signedRequests(verifier *RequestVerifier, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || slices.Contains(_requestSigningPublicPaths, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := saveRequestIDIntoContext()(r.Context(), r)
+		body, err := readBody(r)
+		if err != nil {
+			encodeError(ctx, err, w)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err := verifier.Verify(r, body); err != nil {
+			encodeError(ctx, err, w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
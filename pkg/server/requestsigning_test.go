@@ -0,0 +1,143 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestSigning(t *testing.T) {
+	_, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := NewRequestSigner(clientKey)
+	require.NoError(t, err)
+	verifier, err := NewRequestVerifier([]crypto.PublicKey{clientKey.Public()}, time.Minute, nil)
+	require.NoError(t, err)
+	clock := NewManualClock(time.Now())
+	verifier.clock = clock
+	handler := MakeHTTPHandler(mockServiceInMock(), WithRequestSigning(verifier))
+
+	send := func(req *http.Request) (int, string) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var body struct {
+			Error *ErrorResponse `json:"error"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if body.Error != nil {
+			return w.Code, body.Error.Code
+		}
+		return w.Code, ""
+	}
+	signed := func(method, target, body string) *http.Request {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		require.NoError(t, signer.Sign(req, []byte(body)))
+		return req
+	}
+
+	// Health checks and pre-flight requests aren't signed
+	code, _ := send(httptest.NewRequest("GET", "/ping", nil))
+	require.Equal(t, http.StatusOK, code)
+
+	code, errCode := send(httptest.NewRequest("GET", "/machines", nil))
+	require.Equal(t, http.StatusUnauthorized, code)
+	require.Equal(t, ERROR_CODE_UNAUTHORIZED, errCode)
+
+	code, _ = send(signed("GET", "/machines?limit=5", ""))
+	require.Equal(t, http.StatusOK, code)
+
+	// A captured request can't be sent again
+	body := `{"vaultAddr":"http://localhost:8200","vaultToken":"token","keyPath":"secret/tr31","keyName":"kbpk","keyBlock":"D0112D0AE00E0000"}`
+	captured := signed("POST", "/decrypt_data", body)
+	code, errCode = send(captured)
+	require.NotEqual(t, http.StatusUnauthorized, code, errCode)
+	replay := httptest.NewRequest("POST", "/decrypt_data", strings.NewReader(body))
+	replay.Header = captured.Header.Clone()
+	code, errCode = send(replay)
+	require.Equal(t, http.StatusUnauthorized, code)
+	require.Equal(t, ERROR_CODE_REQUEST_REPLAYED, errCode)
+
+	// Nor be altered
+	tampered := signed("POST", "/decrypt_data", body)
+	tampered.Body = io.NopCloser(strings.NewReader(strings.Replace(body, "kbpk", "other", 1)))
+	code, errCode = send(tampered)
+	require.Equal(t, http.StatusUnauthorized, code)
+	require.Equal(t, ERROR_CODE_UNAUTHORIZED, errCode)
+	moved := signed("GET", "/machines", "")
+	moved.URL.Path = "/jobs/1"
+	code, _ = send(moved)
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	// Requests outside the window are rejected
+	stale := signed("GET", "/machines", "")
+	clock.Advance(2 * time.Minute)
+	code, _ = send(stale)
+	require.Equal(t, http.StatusUnauthorized, code)
+	clock.Set(time.Now())
+
+	// So are requests signed by unknown keys
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	other, err := NewRequestSigner(otherKey)
+	require.NoError(t, err)
+	req := httptest.NewRequest("GET", "/machines", nil)
+	require.NoError(t, other.Sign(req, nil))
+	code, _ = send(req)
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	req = signed("GET", "/machines", "")
+	req.Header.Set(RequestNonceHeader, "short")
+	code, _ = send(req)
+	require.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestMemoryNonceStore(t *testing.T) {
+	store := NewMemoryNonceStore()
+	fresh, err := store.Use("kid nonce", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.True(t, fresh)
+	fresh, err = store.Use("kid nonce", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.False(t, fresh)
+
+	// Expired nonces are forgotten, their requests are outside the window
+	fresh, err = store.Use("kid expired", time.Now().Add(-time.Second))
+	require.NoError(t, err)
+	require.True(t, fresh)
+	fresh, err = store.Use("kid expired", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.True(t, fresh)
+}
+
+func TestLoadRequestVerifier(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "client.pub")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+
+	verifier, err := LoadRequestVerifier([]string{path}, 0, nil)
+	require.NoError(t, err)
+	require.Equal(t, DefaultRequestSigningWindow, verifier.window)
+
+	_, err = NewRequestVerifier(nil, 0, nil)
+	require.ErrorIs(t, err, errInvalidRequestSigningKey)
+	_, err = LoadRequestVerifier([]string{filepath.Join(t.TempDir(), "missing.pub")}, 0, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,524 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moov-io/base"
+	"github.com/moov-io/base/log"
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+type RotationStatus string
+
+var (
+	// ROTATION_PENDING working keys are generated and being delivered to the partner
+	ROTATION_PENDING RotationStatus = "pending"
+	// ROTATION_DELIVERED working keys wait for the partner's acknowledgment
+	ROTATION_DELIVERED RotationStatus = "delivered"
+	// ROTATION_ACKNOWLEDGED working keys are loaded by the partner and wait for their activation time
+	ROTATION_ACKNOWLEDGED RotationStatus = "acknowledged"
+	// ROTATION_ACTIVE working keys are the current keys of their zone
+	ROTATION_ACTIVE RotationStatus = "active"
+	// ROTATION_RETIRED working keys were replaced by a newer active key
+	ROTATION_RETIRED RotationStatus = "retired"
+	// ROTATION_FAILED working keys couldn't be generated or delivered
+	ROTATION_FAILED RotationStatus = "failed"
+)
+
+const (
+	// zoneKeyDir is the directory, under the path of the machine KBPK, active working keys are stored in
+	zoneKeyDir = "zones"
+	// zoneKeyName is the secret name of each active working key block
+	zoneKeyName = "keyBlock"
+	// defaultWorkingKeyLength is the length in bytes of working keys scheduled without one
+	defaultWorkingKeyLength = 16
+)
+
+var errInvalidRotation = errors.New("Invalid Rotation.")
+
+// RotationSchedule generates a new working key for a zone shared with a
+// partner, such as the ZPK of a PIN zone, on a cron schedule. Each key is
+// wrapped under the partner KBPK, sealed in a key exchange envelope, delivered
+// to the partner's delivery target and activated once the partner acknowledges it.
+type RotationSchedule struct {
+	InitialKey string
+	PartnerID  string
+	// Zone names the working key within the partner, such as "pin"
+	Zone string
+	// Schedule is a cron expression, such as "0 2 1 * *" for 2am on the first of every month
+	Schedule string
+	// Header describes the working key blocks, checked against the partner's versions and usages
+	Header HeaderParams
+	// KeyLength is the length in bytes of the working keys, 16 when zero
+	KeyLength int
+	// ActivationDelay is how long after its acknowledgment a working key is activated
+	ActivationDelay time.Duration
+	// NextRun is the next time a working key is generated
+	NextRun   time.Time
+	CreatedAt time.Time
+}
+
+// Rotation is a snapshot of a working key going from its generation to its activation
+type Rotation struct {
+	ID         string         `json:"id"`
+	InitialKey string         `json:"initialKey"`
+	PartnerID  string         `json:"partnerId"`
+	Zone       string         `json:"zone"`
+	Status     RotationStatus `json:"status"`
+	// KeyBlock is the working key under the partner KBPK, as delivered
+	KeyBlock string `json:"keyBlock,omitempty"`
+	// MachineKeyBlock is the working key under the first KBPK of the machine,
+	// stored next to the KBPK once active
+	MachineKeyBlock string     `json:"machineKeyBlock,omitempty"`
+	KCV             string     `json:"kcv,omitempty"`
+	DeliveryID      string     `json:"deliveryId,omitempty"`
+	Error           string     `json:"error,omitempty"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	DeliveredAt     *time.Time `json:"deliveredAt,omitempty"`
+	AcknowledgedAt  *time.Time `json:"acknowledgedAt,omitempty"`
+	// ActivateAt is when an acknowledged working key becomes active
+	ActivateAt  *time.Time `json:"activateAt,omitempty"`
+	ActivatedAt *time.Time `json:"activatedAt,omitempty"`
+	RetiredAt   *time.Time `json:"retiredAt,omitempty"`
+}
+
+// rotationSchedule is the mutable state of a schedule
+type rotationSchedule struct {
+	mu   sync.Mutex
+	info RotationSchedule
+	cron *CronSchedule
+}
+
+func (rs *rotationSchedule) snapshot() *RotationSchedule {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	info := rs.info
+	return &info
+}
+
+// due reports whether the schedule is due at now, and moves its next run past now
+func (rs *rotationSchedule) due(now time.Time) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if now.Before(rs.info.NextRun) {
+		return false
+	}
+	rs.info.NextRun = rs.cron.Next(now.UTC())
+	return true
+}
+
+// rotation is the mutable state of a rotation
+type rotation struct {
+	mu   sync.RWMutex
+	info Rotation
+}
+
+func (r *rotation) snapshot() *Rotation {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	info := r.info
+	return &info
+}
+
+func (r *rotation) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.info.Status = ROTATION_FAILED
+	r.info.Error = err.Error()
+}
+
+// rotationSigner signs the key exchange envelopes of working keys
+type rotationSigner struct {
+	from   string
+	signer crypto.Signer
+}
+
+func rotationScheduleKey(ik, partnerID, zone string) string {
+	return ik + "/" + partnerID + "/" + zone
+}
+
+// zoneKeyPath returns the path of the active working key of a zone under the machine KBPK
+func zoneKeyPath(m *Machine, partnerID, zone string) string {
+	return m.Keys[0].KeyPath + "/" + zoneKeyDir + "/" + partnerID + "/" + zone
+}
+
+// ConfigureRotationSigner sets the partner ID working keys are sent from and the
+// RSA, ECDSA or Ed25519 key their key exchange envelopes are signed with
+func (s *service) ConfigureRotationSigner(from string, signer crypto.Signer) {
+	s.rotationSigner.Store(&rotationSigner{from: from, signer: signer})
+}
+
+// CreateRotationSchedule schedules the rotation of a zone of the partner,
+// replacing the previous schedule of the zone
+func (s *service) CreateRotationSchedule(ik, partnerID string, schedule *RotationSchedule) error {
+	if schedule == nil {
+		return errInvalidRotation
+	}
+	m, p, err := s.partnerOf(ik, partnerID)
+	if err != nil {
+		return err
+	}
+	if len(m.Keys) == 0 {
+		return errMachineHasNoKBPK
+	}
+	if !validPartnerName(schedule.Zone) {
+		return fmt.Errorf("%w: Zone must be 1 to %d letters, digits, '-', '_' or '.'", errInvalidRotation, maxPartnerIDLength)
+	}
+	cron, err := ParseCron(schedule.Schedule)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidRotation, err)
+	}
+	if _, err := schedule.Header.Header(); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidRotation, err)
+	}
+	if err := p.allows(schedule.Header.VersionId, schedule.Header.KeyUsage); err != nil {
+		return err
+	}
+	if schedule.KeyLength < 0 || schedule.ActivationDelay < 0 {
+		return fmt.Errorf("%w: KeyLength and ActivationDelay can't be negative", errInvalidRotation)
+	}
+	if schedule.KeyLength == 0 {
+		schedule.KeyLength = defaultWorkingKeyLength
+	}
+	// Working keys are generated on every run, their length is bounded by the
+	// algorithm before the schedule is stored
+	if err := validateGeneratedKeyLength(schedule.Header.Algorithm, schedule.KeyLength); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidRotation, err)
+	}
+
+	now := s.now()
+	schedule.InitialKey = ik
+	schedule.PartnerID = partnerID
+	schedule.NextRun = cron.Next(now.UTC())
+	schedule.CreatedAt = now
+	s.rotationSchedules.Store(rotationScheduleKey(ik, partnerID, schedule.Zone), &rotationSchedule{info: *schedule, cron: cron})
+	return nil
+}
+
+// GetRotationSchedules returns the rotation schedules of the partner, sorted by zone
+func (s *service) GetRotationSchedules(ik, partnerID string) ([]*RotationSchedule, error) {
+	if _, _, err := s.partnerOf(ik, partnerID); err != nil {
+		return nil, err
+	}
+	var schedules []*RotationSchedule
+	prefix := rotationScheduleKey(ik, partnerID, "")
+	s.rotationSchedules.Range(func(key, value interface{}) bool {
+		if strings.HasPrefix(key.(string), prefix) {
+			schedules = append(schedules, value.(*rotationSchedule).snapshot())
+		}
+		return true
+	})
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].Zone < schedules[j].Zone })
+	return schedules, nil
+}
+
+// DeleteRotationSchedule stops the scheduled rotations of a zone of the partner.
+// Rotations in progress carry on.
+func (s *service) DeleteRotationSchedule(ik, partnerID, zone string) error {
+	if _, loaded := s.rotationSchedules.LoadAndDelete(rotationScheduleKey(ik, partnerID, zone)); !loaded {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RotateZone generates a new working key for a scheduled zone of the partner
+// now, rather than at the next run of its schedule. The key is wrapped under the
+// partner KBPK and the first KBPK of the machine, and the partner's key block is
+// sealed in a key exchange envelope and delivered to the partner.
+func (s *service) RotateZone(ik, partnerID, zone string) (_ *Rotation, err error) {
+	v, ok := s.rotationSchedules.Load(rotationScheduleKey(ik, partnerID, zone))
+	if !ok {
+		return nil, ErrNotFound
+	}
+	schedule := v.(*rotationSchedule).snapshot()
+	rs := s.rotationSigner.Load()
+	if rs == nil {
+		return nil, fmt.Errorf("%w: no signing key is configured for key exchange envelopes", errInvalidRotation)
+	}
+	m, _, err := s.partnerOf(ik, partnerID)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Keys) == 0 {
+		return nil, errMachineHasNoKBPK
+	}
+
+	id := base.ID()
+	r := &rotation{info: Rotation{
+		ID:         id,
+		InitialKey: ik,
+		PartnerID:  partnerID,
+		Zone:       zone,
+		Status:     ROTATION_PENDING,
+		CreatedAt:  s.now(),
+	}}
+	s.workingKeys.Store(id, r)
+	defer func() {
+		if err != nil {
+			r.fail(err)
+		}
+		s.audit(AUDIT_OPERATION_ROTATE_WORKING_KEY, ik+"/"+partnerID+"/"+zone+"/"+id, err)
+	}()
+
+	key := make([]byte, schedule.KeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+	encKey := hex.EncodeToString(key)
+	wrapped, err := s.WrapForPartner(ik, partnerID, encKey, schedule.Header, 0)
+	if err != nil {
+		return nil, err
+	}
+	local, err := s.EncryptDataWithResult(m.vaultAuth.VaultAddress, m.vaultAuth.VaultToken, m.Keys[0].KeyPath, m.Keys[0].KeyName, encKey, schedule.Header, 0)
+	if err != nil {
+		return nil, err
+	}
+	envelope, err := tr31.SealKeyExchange(&tr31.KeyExchangeMessage{
+		From: rs.from,
+		To:   partnerID,
+		Keys: []tr31.ExchangeKey{{
+			KeyBlock:      wrapped.KeyBlock,
+			KCV:           wrapped.KCV,
+			EffectiveFrom: s.now().Add(schedule.ActivationDelay).UTC(),
+		}},
+	}, rs.signer)
+	if err != nil {
+		return nil, err
+	}
+	d, err := s.DeliverKeyExchange(ik, partnerID, envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.info.KeyBlock = wrapped.KeyBlock
+	r.info.MachineKeyBlock = local.KeyBlock
+	r.info.KCV = wrapped.KCV
+	r.info.DeliveryID = d.ID
+	r.mu.Unlock()
+	return r.snapshot(), nil
+}
+
+// GetRotations returns the rotations of the partner's zones, oldest first
+func (s *service) GetRotations(ik, partnerID string) ([]*Rotation, error) {
+	if _, _, err := s.partnerOf(ik, partnerID); err != nil {
+		return nil, err
+	}
+	var rotations []*Rotation
+	s.workingKeys.Range(func(_, value interface{}) bool {
+		r := value.(*rotation)
+		s.advanceRotation(r)
+		if info := r.snapshot(); info.InitialKey == ik && info.PartnerID == partnerID {
+			rotations = append(rotations, info)
+		}
+		return true
+	})
+	sort.Slice(rotations, func(i, j int) bool { return rotations[i].CreatedAt.Before(rotations[j].CreatedAt) })
+	return rotations, nil
+}
+
+// GetRotation returns a rotation of a zone of the partner
+func (s *service) GetRotation(ik, partnerID, id string) (*Rotation, error) {
+	r, err := s.findRotation(ik, partnerID, id)
+	if err != nil {
+		return nil, err
+	}
+	s.advanceRotation(r)
+	return r.snapshot(), nil
+}
+
+// AcknowledgeRotation records the partner loaded a delivered working key, after
+// checking the KCV the partner computed. The key is activated once its
+// schedule's activation delay has passed.
+func (s *service) AcknowledgeRotation(ik, partnerID, id, kcv string) (_ *Rotation, err error) {
+	r, err := s.findRotation(ik, partnerID, id)
+	if err != nil {
+		return nil, err
+	}
+	zone := r.snapshot().Zone
+	defer func() { s.audit(AUDIT_OPERATION_ACKNOWLEDGE_WORKING_KEY, ik+"/"+partnerID+"/"+zone+"/"+id, err) }()
+	s.advanceRotation(r)
+
+	var delay time.Duration
+	if v, ok := s.rotationSchedules.Load(rotationScheduleKey(ik, partnerID, zone)); ok {
+		delay = v.(*rotationSchedule).snapshot().ActivationDelay
+	}
+	r.mu.Lock()
+	if r.info.Status != ROTATION_DELIVERED {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("%w: rotation is %s, not %s", errInvalidRotation, r.info.Status, ROTATION_DELIVERED)
+	}
+	if r.info.KCV != "" && !strings.EqualFold(r.info.KCV, kcv) {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("%w: KCV %q doesn't match the working key", errInvalidRotation, kcv)
+	}
+	now := s.now()
+	activateAt := now.Add(delay)
+	r.info.Status = ROTATION_ACKNOWLEDGED
+	r.info.AcknowledgedAt = &now
+	r.info.ActivateAt = &activateAt
+	r.mu.Unlock()
+
+	s.advanceRotation(r)
+	return r.snapshot(), nil
+}
+
+// AdvanceRotations generates the working keys of the schedules which are due,
+// and moves rotations on: delivered or failed deliveries, and acknowledged keys
+// whose activation time has come
+func (s *service) AdvanceRotations() error {
+	now := s.now()
+	var errs []error
+	s.rotationSchedules.Range(func(_, value interface{}) bool {
+		rs := value.(*rotationSchedule)
+		if !rs.due(now) {
+			return true
+		}
+		info := rs.snapshot()
+		if _, err := s.RotateZone(info.InitialKey, info.PartnerID, info.Zone); err != nil {
+			errs = append(errs, fmt.Errorf("rotating %s: %w", rotationScheduleKey(info.InitialKey, info.PartnerID, info.Zone), err))
+		}
+		return true
+	})
+	s.workingKeys.Range(func(_, value interface{}) bool {
+		if err := s.advanceRotation(value.(*rotation)); err != nil {
+			errs = append(errs, err)
+		}
+		return true
+	})
+	return errors.Join(errs...)
+}
+
+// WatchRotations advances the rotations of the service every interval, until ctx is cancelled
+func WatchRotations(ctx context.Context, svc Service, interval time.Duration, logger log.Logger) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := svc.AdvanceRotations(); err != nil {
+				logger.LogErrorf("advancing working key rotations: %v", err)
+			}
+		}
+	}
+}
+
+func (s *service) findRotation(ik, partnerID, id string) (*rotation, error) {
+	if v, ok := s.workingKeys.Load(id); ok {
+		r := v.(*rotation)
+		if info := r.snapshot(); info.InitialKey == ik && info.PartnerID == partnerID {
+			return r, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// advanceRotation moves a pending rotation on with the status of its delivery,
+// and activates an acknowledged one once its activation time has come
+func (s *service) advanceRotation(r *rotation) error {
+	info := r.snapshot()
+	switch info.Status {
+	case ROTATION_PENDING:
+		if info.DeliveryID == "" {
+			return nil
+		}
+		d, err := s.GetDelivery(info.InitialKey, info.PartnerID, info.DeliveryID)
+		if err != nil {
+			return nil
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.info.Status != ROTATION_PENDING {
+			return nil
+		}
+		switch d.Status {
+		case DELIVERY_DELIVERED:
+			r.info.Status = ROTATION_DELIVERED
+			r.info.DeliveredAt = d.DeliveredAt
+		case DELIVERY_FAILED:
+			r.info.Status = ROTATION_FAILED
+			r.info.Error = "delivery failed: " + d.Error
+		}
+	case ROTATION_ACKNOWLEDGED:
+		if info.ActivateAt != nil && s.now().Before(*info.ActivateAt) {
+			return nil
+		}
+		return s.activateRotation(r)
+	}
+	return nil
+}
+
+// activateRotation stores the working key next to the machine KBPK and retires
+// the previous active key of the zone
+func (s *service) activateRotation(r *rotation) (err error) {
+	r.mu.Lock()
+	info := r.info
+	if info.Status != ROTATION_ACKNOWLEDGED {
+		r.mu.Unlock()
+		return nil
+	}
+	defer func() {
+		s.audit(AUDIT_OPERATION_ACTIVATE_WORKING_KEY, info.InitialKey+"/"+info.PartnerID+"/"+info.Zone+"/"+info.ID, err)
+	}()
+	err = s.storeZoneKey(info)
+	now := s.now()
+	if err == nil {
+		r.info.Status = ROTATION_ACTIVE
+		r.info.ActivatedAt = &now
+	}
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.workingKeys.Range(func(_, value interface{}) bool {
+		other := value.(*rotation)
+		if other == r {
+			return true
+		}
+		other.mu.Lock()
+		defer other.mu.Unlock()
+		if other.info.Status == ROTATION_ACTIVE && other.info.InitialKey == info.InitialKey &&
+			other.info.PartnerID == info.PartnerID && other.info.Zone == info.Zone &&
+			!other.info.ActivatedAt.After(now) {
+			other.info.Status = ROTATION_RETIRED
+			other.info.RetiredAt = &now
+		}
+		return true
+	})
+	return nil
+}
+
+// storeZoneKey writes the working key under the machine KBPK next to the KBPK
+func (s *service) storeZoneKey(info Rotation) error {
+	m, err := s.GetMachine(info.InitialKey)
+	if err != nil {
+		return err
+	}
+	if len(m.Keys) == 0 {
+		return errMachineHasNoKBPK
+	}
+	sm, err := s.scopedSecretManagerOf(m)
+	if err != nil {
+		return err
+	}
+	if vErr := sm.WriteSecret(zoneKeyPath(m, info.PartnerID, info.Zone), zoneKeyName, info.MachineKeyBlock); vErr != nil {
+		return vErr
+	}
+	return nil
+}
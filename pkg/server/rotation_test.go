@@ -0,0 +1,252 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+	"github.com/stretchr/testify/require"
+)
+
+var mockWorkingKeyHeader = HeaderParams{VersionId: "D", KeyUsage: "P0", Algorithm: "A", ModeOfUse: "E", KeyVersion: "00", Exportability: "E"}
+
+// mockRotations returns a service with a partner delivering to deliverer, and
+// a rotation schedule of its "pin" zone
+func mockRotations(t *testing.T, clock *ManualClock) (Service, *Machine, *flakyDeliverer, ed25519.PublicKey) {
+	t.Helper()
+	s := mockServiceInMock()
+	s.ConfigureClock(clock)
+	m := mockTerminalMachine(t, s)
+	mockPartner(t, s, m)
+
+	deliveries, err := NewDeliveries(DeliveryConfig{Backoff: time.Millisecond})
+	require.NoError(t, err)
+	deliverer := &flakyDeliverer{files: make(map[string][]byte)}
+	deliveries.SetDeliverer("acme", deliverer)
+	s.ConfigureDeliveries(deliveries)
+
+	publicKey, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	s.ConfigureRotationSigner("bank", key)
+
+	require.NoError(t, s.CreateRotationSchedule(m.InitialKey, "acme", &RotationSchedule{
+		Zone:            "pin",
+		Schedule:        "0 2 * * *",
+		Header:          mockWorkingKeyHeader,
+		ActivationDelay: time.Hour,
+	}))
+	return s, m, deliverer, publicKey
+}
+
+func waitForRotation(t *testing.T, s Service, r *Rotation, status RotationStatus) *Rotation {
+	t.Helper()
+	var current *Rotation
+	require.Eventually(t, func() bool {
+		var err error
+		current, err = s.GetRotation(r.InitialKey, r.PartnerID, r.ID)
+		require.NoError(t, err)
+		return current.Status == status
+	}, 5*time.Second, 5*time.Millisecond)
+	return current
+}
+
+func TestService_Rotations(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC))
+	s, m, deliverer, publicKey := mockRotations(t, clock)
+
+	schedules, err := s.GetRotationSchedules(m.InitialKey, "acme")
+	require.NoError(t, err)
+	require.Len(t, schedules, 1)
+	require.Equal(t, time.Date(2024, time.March, 2, 2, 0, 0, 0, time.UTC), schedules[0].NextRun)
+	require.Equal(t, defaultWorkingKeyLength, schedules[0].KeyLength)
+
+	// Nothing is due before the next run
+	require.NoError(t, s.AdvanceRotations())
+	rotations, err := s.GetRotations(m.InitialKey, "acme")
+	require.NoError(t, err)
+	require.Empty(t, rotations)
+
+	clock.Set(schedules[0].NextRun)
+	require.NoError(t, s.AdvanceRotations())
+	rotations, err = s.GetRotations(m.InitialKey, "acme")
+	require.NoError(t, err)
+	require.Len(t, rotations, 1)
+	first := waitForRotation(t, s, rotations[0], ROTATION_DELIVERED)
+	require.Equal(t, "pin", first.Zone)
+	require.NotEmpty(t, first.KCV)
+	require.NotEqual(t, first.KeyBlock, first.MachineKeyBlock)
+
+	schedules, err = s.GetRotationSchedules(m.InitialKey, "acme")
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2024, time.March, 3, 2, 0, 0, 0, time.UTC), schedules[0].NextRun)
+
+	// The partner receives the key block under its KBPK in a signed envelope
+	d, err := s.GetDelivery(m.InitialKey, "acme", first.DeliveryID)
+	require.NoError(t, err)
+	message, err := tr31.OpenKeyExchange(deliverer.files[d.FileName], publicKey)
+	require.NoError(t, err)
+	require.Equal(t, "bank", message.From)
+	require.Equal(t, first.KeyBlock, message.Keys[0].KeyBlock)
+	require.Equal(t, first.KCV, message.Keys[0].KCV)
+	require.Equal(t, clock.Now().Add(time.Hour), message.Keys[0].EffectiveFrom)
+	partnerKBPK, _ := hex.DecodeString("0123456789ABCDEFFEDCBA98765432100123456789ABCDEFFEDCBA9876543210")
+	unwrapped, err := unwrapKey(partnerKBPK, first.KeyBlock)
+	require.NoError(t, err)
+	machineKBPK, _ := hex.DecodeString("AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	local, err := unwrapKey(machineKBPK, first.MachineKeyBlock)
+	require.NoError(t, err)
+	require.Equal(t, unwrapped, local)
+
+	// Keys are acknowledged with their KCV and activated after the delay
+	_, err = s.AcknowledgeRotation(m.InitialKey, "acme", first.ID, "000000")
+	require.ErrorIs(t, err, errInvalidRotation)
+	first, err = s.AcknowledgeRotation(m.InitialKey, "acme", first.ID, strings.ToLower(first.KCV))
+	require.NoError(t, err)
+	require.Equal(t, ROTATION_ACKNOWLEDGED, first.Status)
+	require.Equal(t, clock.Now().Add(time.Hour), *first.ActivateAt)
+	_, err = s.AcknowledgeRotation(m.InitialKey, "acme", first.ID, first.KCV)
+	require.ErrorIs(t, err, errInvalidRotation)
+
+	clock.Advance(59 * time.Minute)
+	require.NoError(t, s.AdvanceRotations())
+	first, err = s.GetRotation(m.InitialKey, "acme", first.ID)
+	require.NoError(t, err)
+	require.Equal(t, ROTATION_ACKNOWLEDGED, first.Status)
+
+	clock.Advance(time.Minute)
+	require.NoError(t, s.AdvanceRotations())
+	first, err = s.GetRotation(m.InitialKey, "acme", first.ID)
+	require.NoError(t, err)
+	require.Equal(t, ROTATION_ACTIVE, first.Status)
+	stored, vErr := s.GetSecretManager().ReadSecret("secret/tr31/zones/acme/pin", zoneKeyName)
+	require.Nil(t, vErr)
+	require.Equal(t, first.MachineKeyBlock, stored)
+
+	// The next active key of the zone retires the previous one
+	second, err := s.RotateZone(m.InitialKey, "acme", "pin")
+	require.NoError(t, err)
+	_, err = s.AcknowledgeRotation(m.InitialKey, "acme", second.ID, second.KCV)
+	require.ErrorIs(t, err, errInvalidRotation, "pending keys can't be acknowledged")
+	second = waitForRotation(t, s, second, ROTATION_DELIVERED)
+	_, err = s.AcknowledgeRotation(m.InitialKey, "acme", second.ID, second.KCV)
+	require.NoError(t, err)
+	clock.Advance(time.Hour)
+	require.NoError(t, s.AdvanceRotations())
+	waitForRotation(t, s, second, ROTATION_ACTIVE)
+	waitForRotation(t, s, first, ROTATION_RETIRED)
+	stored, _ = s.GetSecretManager().ReadSecret("secret/tr31/zones/acme/pin", zoneKeyName)
+	require.Equal(t, second.MachineKeyBlock, stored)
+
+	// Failed deliveries fail the rotation
+	deliverer.failures = 5
+	third, err := s.RotateZone(m.InitialKey, "acme", "pin")
+	require.NoError(t, err)
+	third = waitForRotation(t, s, third, ROTATION_FAILED)
+	require.Contains(t, third.Error, "connection refused")
+
+	require.NoError(t, s.DeleteRotationSchedule(m.InitialKey, "acme", "pin"))
+	require.ErrorIs(t, s.DeleteRotationSchedule(m.InitialKey, "acme", "pin"), ErrNotFound)
+	_, err = s.RotateZone(m.InitialKey, "acme", "pin")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestService_CreateRotationSchedule_invalid(t *testing.T) {
+	s := mockServiceInMock()
+	m := mockTerminalMachine(t, s)
+	mockPartner(t, s, m)
+
+	tests := map[string]struct {
+		schedule RotationSchedule
+		err      error
+	}{
+		"zone":     {RotationSchedule{Zone: "a/b", Schedule: "@daily", Header: mockWorkingKeyHeader}, errInvalidRotation},
+		"schedule": {RotationSchedule{Zone: "pin", Schedule: "daily", Header: mockWorkingKeyHeader}, errInvalidRotation},
+		"header":   {RotationSchedule{Zone: "pin", Schedule: "@daily", Header: HeaderParams{VersionId: "D"}}, errInvalidRotation},
+		"usage":    {RotationSchedule{Zone: "pin", Schedule: "@daily", Header: HeaderParams{VersionId: "D", KeyUsage: "D0", Algorithm: "A", ModeOfUse: "E", KeyVersion: "00", Exportability: "E"}}, ErrUsageNotApproved},
+		"length":   {RotationSchedule{Zone: "pin", Schedule: "@daily", Header: mockWorkingKeyHeader, KeyLength: -1}, errInvalidRotation},
+		"too long": {RotationSchedule{Zone: "pin", Schedule: "@daily", Header: mockWorkingKeyHeader, KeyLength: 1 << 40}, errInvalidRotation},
+		"aes":      {RotationSchedule{Zone: "pin", Schedule: "@daily", Header: mockWorkingKeyHeader, KeyLength: 20}, errInvalidRotation},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := s.CreateRotationSchedule(m.InitialKey, "acme", &tt.schedule)
+			require.ErrorIs(t, err, tt.err)
+		})
+	}
+	err := s.CreateRotationSchedule(m.InitialKey, "unknown", &RotationSchedule{Zone: "pin", Schedule: "@daily", Header: mockWorkingKeyHeader})
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// Rotations need a signing key for their envelopes
+	require.NoError(t, s.CreateRotationSchedule(m.InitialKey, "acme", &RotationSchedule{Zone: "pin", Schedule: "@daily", Header: mockWorkingKeyHeader}))
+	_, err = s.RotateZone(m.InitialKey, "acme", "pin")
+	require.ErrorIs(t, err, errInvalidRotation)
+}
+
+func TestRouting_rotations(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC))
+	s, m, _, _ := mockRotations(t, clock)
+	router := MakeHTTPHandler(s)
+	base := "/machine/" + m.InitialKey + "/partners/acme"
+
+	body := `{"Zone": "mac", "Schedule": "0 3 1 * *", "Header": {"VersionId": "D", "KeyUsage": "K0", "Algorithm": "A", "ModeOfUse": "E", "KeyVersion": "00", "Exportability": "E"}, "KeyLength": 32}`
+	req := httptest.NewRequest("POST", base+"/rotation_schedules", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	req = httptest.NewRequest("GET", base+"/rotation_schedules", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var schedules rotationSchedulesResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &schedules))
+	require.Len(t, schedules.Schedules, 2)
+	require.Equal(t, "mac", schedules.Schedules[0].Zone)
+
+	req = httptest.NewRequest("POST", base+"/rotation_schedules/pin/rotate", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var created rotationResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	delivered := waitForRotation(t, s, created.Rotation, ROTATION_DELIVERED)
+
+	req = httptest.NewRequest("POST", base+"/rotations/"+delivered.ID+"/acknowledge", bytes.NewReader([]byte(`{"KCV": "`+delivered.KCV+`"}`)))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var acknowledged rotationResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &acknowledged))
+	require.Equal(t, ROTATION_ACKNOWLEDGED, acknowledged.Rotation.Status)
+
+	req = httptest.NewRequest("GET", base+"/rotations", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var rotations rotationsResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rotations))
+	require.Len(t, rotations.Rotations, 1)
+
+	req = httptest.NewRequest("POST", base+"/rotations/"+delivered.ID+"/acknowledge", strings.NewReader(`{"KCV": "`+delivered.KCV+`"}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	req = httptest.NewRequest("DELETE", base+"/rotation_schedules/mac", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest("GET", base+"/rotations/unknown", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -1,20 +1,24 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"mime"
 	"net/http"
-	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/go-jose/go-jose/v4"
 	"github.com/go-kit/kit/endpoint"
 	httptransport "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
 	"github.com/moov-io/base"
 	moovhttp "github.com/moov-io/base/http"
+	"github.com/moov-io/tr31/pkg/tr31"
 )
 
 var (
@@ -32,6 +36,9 @@ var (
 	errInvalidKeyPath      = errors.New("Invalid Key Path.")
 	errInvalidKeyName      = errors.New("Invalid Key Name.")
 	errInvalidKeyBlock     = errors.New("Invalid Key Block.")
+	errMalformedField      = errors.New("Malformed Field.")
+	errInvalidJSON         = errors.New("could not parse json request")
+	errRequestTooLarge     = errors.New("Request Body Too Large.")
 )
 
 // contextKey is a unique (and compariable) type we use
@@ -39,6 +46,28 @@ var (
 // go-kit context.
 var contextKey struct{}
 
+// requestIDKey stores the request ID in the go-kit context
+var requestIDKey struct{ name string }
+
+// saveRequestIDIntoContext saves the X-Request-ID header into the go-kit context,
+// generating one when the client didn't send it, so responses can echo it.
+//
+// This is designed to be added as a ServerOption in our main http handler.
+func saveRequestIDIntoContext() httptransport.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		requestID := moovhttp.GetRequestID(r)
+		if requestID == "" {
+			requestID = base.ID()
+		}
+		return context.WithValue(ctx, requestIDKey, requestID)
+	}
+}
+
+func requestIDFrom(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
+
 // saveCORSHeadersIntoContext saves CORS headers into the go-kit context.
 //
 // This is designed to be added as a ServerOption in our main http handler.
@@ -51,14 +80,14 @@ func saveCORSHeadersIntoContext() httptransport.RequestFunc {
 
 // respondWithSavedCORSHeaders looks in the go-kit request context
 // for our own CORS headers. (Stored with our context key in
-// saveCORSHeadersIntoContext.)
+// saveCORSHeadersIntoContext.) Only allowed origins get CORS headers.
 //
 // This is designed to be added as a ServerOption in our main http handler.
-func respondWithSavedCORSHeaders() httptransport.ServerResponseFunc {
+func respondWithSavedCORSHeaders(cfg *handlerConfig) httptransport.ServerResponseFunc {
 	return func(ctx context.Context, w http.ResponseWriter) context.Context {
 		v, ok := ctx.Value(contextKey).(string)
 		if ok && v != "" {
-			moovhttp.SetAccessControlAllowHeaders(w, v) // set CORS headers
+			cfg.setCORSHeaders(w, v) // set CORS headers
 		}
 		return ctx
 	}
@@ -83,21 +112,89 @@ func preflightHandler(options []httptransport.ServerOption) http.Handler {
 	)
 }
 
-func MakeHTTPHandler(s Service) http.Handler {
+// HandlerOption configures the HTTP handler made by MakeHTTPHandler
+type HandlerOption func(*handlerConfig)
+
+type handlerConfig struct {
+	responseSigner *ResponseSigner
+	// principal identifies the callers the usage approver decides for
+	principal     PrincipalFunc
+	policyWatcher *PolicyWatcher
+	// transparencyLog serves the signed tree heads and proofs of wrapped key blocks
+	transparencyLog *TransparencyLog
+	// tenants authenticates the tenant of requests and scopes them to its machines
+	tenants *Tenants
+	// requestVerifier checks the signature and nonce of every request
+	requestVerifier *RequestVerifier
+
+	allowedOrigins     []string
+	maxRequestBodySize int64
+	maxKeyBlockLength  int
+	maxBatchSize       int
+	gzip               bool
+	idempotencyTTL     time.Duration
+	// idempotency keeps the responses of the routes opting in with idempotent
+	idempotency *idempotencyStore
+}
+
+// WithResponseSigner signs the bodies of successful /decrypt_data responses,
+// which carry clear keys, and of inventory and compromise reports, handed to
+// auditors, with a detached JWS in the X-JWS-Signature header.
+// The public key is served as a JWK Set from /.well-known/jwks.json.
+func WithResponseSigner(signer *ResponseSigner) HandlerOption {
+	return func(cfg *handlerConfig) {
+		cfg.responseSigner = signer
+	}
+}
+
+// WithPrincipal identifies the caller of every request with principal, which
+// the usage approver of the service decides for, see
+// Service.ConfigureUsageApprover. Callers are identified by
+// PrincipalFromClientCert by default.
+func WithPrincipal(principal PrincipalFunc) HandlerOption {
+	return func(cfg *handlerConfig) {
+		cfg.principal = principal
+	}
+}
+
+func MakeHTTPHandler(s Service, opts ...HandlerOption) http.Handler {
+	var cfg handlerConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
 	r := mux.NewRouter()
+	if cfg.tenants != nil {
+		r.Use(tenantRequests(s, cfg.tenants))
+	}
+	if cfg.principal == nil {
+		cfg.principal = PrincipalFromClientCert
+	}
+	if cfg.idempotencyTTL > 0 {
+		cfg.idempotency = newIdempotencyStore(cfg.idempotencyTTL)
+	}
 	options := []httptransport.ServerOption{
 		httptransport.ServerErrorEncoder(encodeError),
 		httptransport.ServerBefore(saveCORSHeadersIntoContext()),
-		httptransport.ServerAfter(respondWithSavedCORSHeaders()),
+		httptransport.ServerBefore(saveRequestIDIntoContext()),
+		httptransport.ServerBefore(savePrincipalIntoContext(cfg.principal)),
+		httptransport.ServerAfter(respondWithSavedCORSHeaders(&cfg)),
 	}
 
 	// HTTP Methods
 	r.Methods("OPTIONS").Handler(preflightHandler(options)) // CORS pre-flight handler
 	r.Methods("GET").Path("/ping").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		moovhttp.SetAccessControlAllowHeaders(w, r.Header.Get("Origin"))
+		cfg.setCORSHeaders(w, r.Header.Get("Origin"))
 		w.Header().Set("Content-Type", "text/plain")
 		w.Write([]byte("PONG"))
 	})
+	if cfg.responseSigner != nil {
+		r.Methods("GET").Path("/.well-known/jwks.json").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cfg.setCORSHeaders(w, r.Header.Get("Origin"))
+			w.Header().Set("Content-Type", "application/jwk-set+json")
+			json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{cfg.responseSigner.PublicKey()}})
+		})
+	}
 
 	// REST APIs
 	r.Methods("GET").Path("/machines").Handler(httptransport.NewServer(
@@ -114,36 +211,329 @@ func MakeHTTPHandler(s Service) http.Handler {
 		options...,
 	))
 
-	r.Methods("POST").Path("/machine").Handler(httptransport.NewServer(
+	r.Methods("PATCH").Path("/machine/{ik}").Handler(httptransport.NewServer(
+		updateMachineEndpoint(s),
+		decodeUpdateMachineRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/machine").Handler(cfg.idempotent(httptransport.NewServer(
 		createMachineEndpoint(s),
 		decodeCreateMachineRequest,
 		encodeResponse,
 		options...,
+	)))
+
+	r.Methods("POST").Path("/admin/apply").Handler(cfg.idempotent(httptransport.NewServer(
+		applyDeclarationEndpoint(s),
+		decodeApplyDeclarationRequest,
+		encodeResponse,
+		options...,
+	)))
+
+	r.Methods("POST").Path("/jobs").Handler(cfg.idempotent(httptransport.NewServer(
+		createJobEndpoint(s),
+		decodeCreateJobRequest,
+		encodeResponse,
+		options...,
+	)))
+
+	r.Methods("GET").Path("/jobs/{id}").Handler(httptransport.NewServer(
+		getJobEndpoint(s),
+		decodeJobRequest,
+		encodeResponse,
+		options...,
 	))
 
-	r.Methods("POST").Path("/encrypt_data").Handler(httptransport.NewServer(
+	r.Methods("DELETE").Path("/jobs/{id}").Handler(httptransport.NewServer(
+		cancelJobEndpoint(s),
+		decodeJobRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/jobs/{id}/result").Handler(httptransport.NewServer(
+		getJobResultsEndpoint(s),
+		decodeJobRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/machine/{ik}/terminals").Handler(cfg.idempotent(httptransport.NewServer(
+		provisionTerminalEndpoint(s),
+		decodeProvisionTerminalRequest,
+		encodeResponse,
+		options...,
+	)))
+
+	r.Methods("GET").Path("/machine/{ik}/terminals/{terminalID}").Handler(httptransport.NewServer(
+		getTerminalEndpoint(s),
+		decodeGetTerminalRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/encrypt_data").Handler(cfg.idempotent(httptransport.NewServer(
 		encryptDataEndpoint(s),
 		decodeEncryptDataRequest,
 		encodeResponse,
 		options...,
+	)))
+
+	r.Methods("POST").Path("/machine/{ik}/transport_keys").Handler(cfg.idempotent(httptransport.NewServer(
+		registerTransportKeyEndpoint(s),
+		decodeRegisterTransportKeyRequest,
+		encodeResponse,
+		options...,
+	)))
+
+	r.Methods("GET").Path("/machine/{ik}/transport_keys/{keyID}").Handler(httptransport.NewServer(
+		getTransportKeyEndpoint(s),
+		decodeGetTransportKeyRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/machine/{ik}/partners").Handler(cfg.idempotent(httptransport.NewServer(
+		createPartnerEndpoint(s),
+		decodeCreatePartnerRequest,
+		encodeResponse,
+		options...,
+	)))
+
+	r.Methods("GET").Path("/machine/{ik}/partners").Handler(httptransport.NewServer(
+		getPartnersEndpoint(s),
+		decodePartnerRequest,
+		encodeResponse,
+		options...,
 	))
 
+	r.Methods("GET").Path("/machine/{ik}/partners/{partnerID}").Handler(httptransport.NewServer(
+		getPartnerEndpoint(s),
+		decodePartnerRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("DELETE").Path("/machine/{ik}/partners/{partnerID}").Handler(httptransport.NewServer(
+		deletePartnerEndpoint(s),
+		decodePartnerRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/machine/{ik}/partners/{partnerID}/encrypt_data").Handler(cfg.idempotent(httptransport.NewServer(
+		wrapForPartnerEndpoint(s),
+		decodeWrapForPartnerRequest,
+		encodeResponse,
+		options...,
+	)))
+
+	r.Methods("POST").Path("/machine/{ik}/partners/{partnerID}/translate_data").Handler(cfg.idempotent(httptransport.NewServer(
+		translateForPartnerEndpoint(s),
+		decodeTranslateForPartnerRequest,
+		encodeResponse,
+		options...,
+	)))
+
+	r.Methods("POST").Path("/machine/{ik}/partners/{partnerID}/deliveries").Handler(cfg.idempotent(httptransport.NewServer(
+		deliverKeyExchangeEndpoint(s),
+		decodeDeliverKeyExchangeRequest,
+		encodeResponse,
+		options...,
+	)))
+
+	r.Methods("GET").Path("/machine/{ik}/partners/{partnerID}/deliveries/{deliveryID}").Handler(httptransport.NewServer(
+		getDeliveryEndpoint(s),
+		decodeGetDeliveryRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/machine/{ik}/partners/{partnerID}/rotation_schedules").Handler(cfg.idempotent(httptransport.NewServer(
+		createRotationScheduleEndpoint(s),
+		decodeCreateRotationScheduleRequest,
+		encodeResponse,
+		options...,
+	)))
+
+	r.Methods("GET").Path("/machine/{ik}/partners/{partnerID}/rotation_schedules").Handler(httptransport.NewServer(
+		getRotationSchedulesEndpoint(s),
+		decodeRotationRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("DELETE").Path("/machine/{ik}/partners/{partnerID}/rotation_schedules/{zone}").Handler(httptransport.NewServer(
+		deleteRotationScheduleEndpoint(s),
+		decodeRotationRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/machine/{ik}/partners/{partnerID}/rotation_schedules/{zone}/rotate").Handler(cfg.idempotent(httptransport.NewServer(
+		rotateZoneEndpoint(s),
+		decodeRotationRequest,
+		encodeResponse,
+		options...,
+	)))
+
+	r.Methods("GET").Path("/machine/{ik}/partners/{partnerID}/rotations").Handler(httptransport.NewServer(
+		getRotationsEndpoint(s),
+		decodeRotationRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/machine/{ik}/partners/{partnerID}/rotations/{rotationID}").Handler(httptransport.NewServer(
+		getRotationEndpoint(s),
+		decodeRotationRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/machine/{ik}/partners/{partnerID}/rotations/{rotationID}/acknowledge").Handler(cfg.idempotent(httptransport.NewServer(
+		acknowledgeRotationEndpoint(s),
+		decodeAcknowledgeRotationRequest,
+		encodeResponse,
+		options...,
+	)))
+
+	r.Methods("POST").Path("/machine/{ik}/reencrypt").Handler(cfg.idempotent(httptransport.NewServer(
+		reencryptEstateEndpoint(s),
+		decodeReencryptEstateRequest,
+		encodeResponse,
+		options...,
+	)))
+
+	r.Methods("POST").Path("/machine/{ik}/escrows").Handler(cfg.idempotent(httptransport.NewServer(
+		escrowKBPKEndpoint(s),
+		decodeEscrowKBPKRequest,
+		encodeResponse,
+		options...,
+	)))
+
+	r.Methods("POST").Path("/machine/{ik}/escrows/{escrowID}/recover").Handler(cfg.idempotent(httptransport.NewServer(
+		recoverKBPKEndpoint(s),
+		decodeRecoverKBPKRequest,
+		encodeResponse,
+		options...,
+	)))
+
+	if cfg.policyWatcher != nil {
+		r.Methods("GET").Path("/policy").Handler(httptransport.NewServer(
+			getPolicyEndpoint(cfg.policyWatcher),
+			decodeGetPolicyRequest,
+			encodeResponse,
+			options...,
+		))
+	}
+
+	if cfg.transparencyLog != nil {
+		r.Methods("GET").Path("/transparency/tree_head").Handler(httptransport.NewServer(
+			getTreeHeadEndpoint(cfg.transparencyLog),
+			decodeGetTreeHeadRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("GET").Path("/transparency/inclusion_proof").Handler(httptransport.NewServer(
+			getInclusionProofEndpoint(cfg.transparencyLog),
+			decodeGetInclusionProofRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("GET").Path("/transparency/consistency_proof").Handler(httptransport.NewServer(
+			getConsistencyProofEndpoint(cfg.transparencyLog),
+			decodeGetConsistencyProofRequest,
+			encodeResponse,
+			options...,
+		))
+		r.Methods("GET").Path("/transparency/entries").Handler(httptransport.NewServer(
+			getTransparencyEntriesEndpoint(cfg.transparencyLog),
+			decodeGetTransparencyEntriesRequest,
+			encodeResponse,
+			options...,
+		))
+	}
+
+	r.Methods("GET").Path("/tr31/dictionary").Handler(httptransport.NewServer(
+		getDictionaryEndpoint(),
+		decodeGetDictionaryRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/tr31/inspect").Handler(httptransport.NewServer(
+		inspectEndpoint(),
+		decodeInspectRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/selftest").Handler(httptransport.NewServer(
+		selfTestEndpoint(),
+		decodeSelfTestRequest,
+		encodeSelfTestResponse,
+		options...,
+	))
+
+	signedEncoder := encodeResponse
+	if cfg.responseSigner != nil {
+		signedEncoder = encodeSignedResponse(cfg.responseSigner)
+	}
+	// Signatures cover the whole body, so signed inventories aren't streamed
+	r.Methods("GET").Path("/machines/{ik}/inventory").Handler(httptransport.NewServer(
+		getInventoryEndpoint(s, cfg.responseSigner == nil),
+		decodeGetInventoryRequest,
+		signedEncoder,
+		options...,
+	))
+
+	r.Methods("GET").Path("/machine/{ik}/key_states").Handler(httptransport.NewServer(
+		getKeyStatesEndpoint(s),
+		decodeKeyStatesRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/machine/{ik}/key_states").Handler(cfg.idempotent(httptransport.NewServer(
+		changeKeyStateEndpoint(s),
+		decodeChangeKeyStateRequest,
+		encodeResponse,
+		options...,
+	)))
+
+	r.Methods("POST").Path("/machines/{ik}/compromise").Handler(cfg.idempotent(httptransport.NewServer(
+		compromiseEndpoint(s),
+		decodeCompromiseRequest,
+		signedEncoder,
+		options...,
+	)))
+
 	r.Methods("POST").Path("/decrypt_data").Handler(httptransport.NewServer(
 		decryptDataEndpoint(s),
 		decodeDecryptDataRequest,
-		encodeResponse,
+		signedEncoder,
 		options...,
 	))
 
-	return r
-}
-
-// errorer is implemented by all concrete response types that may contain
-// errors. There are a few well-known values which are used to change the
-// HTTP response code without needing to trigger an endpoint (transport-level)
-// error.
-type errorer interface {
-	error() error
+	// Gateway features wrap the router, replayed responses are compressed too
+	var handler http.Handler = r
+	limits := requestLimits{
+		body:           cfg.maxRequestBodySize,
+		keyBlockLength: cfg.maxKeyBlockLength,
+		batchSize:      cfg.maxBatchSize,
+	}
+	// Unsigned requests are rejected before idempotent responses are replayed
+	if cfg.requestVerifier != nil {
+		handler = signedRequests(cfg.requestVerifier, handler)
+	}
+	handler = limitRequests(limits.withDefaults(), handler)
+	if cfg.gzip {
+		handler = gzipResponses(handler)
+	}
+	return handler
 }
 
 // counter is implemented by any concrete response types that may contain
@@ -152,29 +542,43 @@ type counter interface {
 	count() int
 }
 
-// marshalStructWithError converts a struct into a JSON response with all fields of the struct
-// with our expected error formats.
-//
-// There are a few reasons we need to do this.
-//  1. base.ErrorList marshals to an object which breaks the string format our API declares
-//     and isn't caught when we pass around interface{} values.
-//  2. We want to return additional fields of structs (such as in createFileEndpoint)
-func marshalStructWithError(in interface{}, w http.ResponseWriter) error {
-	v := reflect.ValueOf(in)
-	out := make(map[string]interface{}, v.NumField())
-
-	for i := 0; i < v.NumField(); i++ {
-		name := v.Type().Field(i).Name
-		value := v.Field(i).Interface()
-
-		if err, ok := value.(error); ok {
-			out["error"] = err.Error()
-		} else {
-			out[name] = value
-		}
+// writeEnvelope writes a response envelope: the fields of the response, the
+// request ID and, when the request failed, an error object with a machine-readable
+// code. Go error values are never serialized directly, they marshal to {}.
+func writeEnvelope(ctx context.Context, w http.ResponseWriter, response interface{}, err error) error {
+	body, err := marshalEnvelope(ctx, response, err)
+	if err != nil {
+		return err
 	}
+	_, err = w.Write(body)
+	return err
+}
 
-	return json.NewEncoder(w).Encode(out)
+// marshalEnvelope returns the body writeEnvelope writes
+func marshalEnvelope(ctx context.Context, response interface{}, err error) ([]byte, error) {
+	envelope := make(map[string]interface{})
+	if response != nil {
+		data, err := json.Marshal(response)
+		if err != nil {
+			return nil, err
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return nil, err
+		}
+		for name, value := range fields {
+			envelope[name] = value
+		}
+	}
+	envelope["requestId"] = requestIDFrom(ctx)
+	if err != nil {
+		envelope["error"] = newErrorResponse(err)
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(envelope); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 // encodeResponse is the common method to encode all response types to the
@@ -182,11 +586,13 @@ func marshalStructWithError(in interface{}, w http.ResponseWriter) error {
 // reason to provide anything more specific. It's certainly possible to
 // specialize on a per-response (per-method) basis.
 func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
-	if e, ok := response.(errorer); ok && e.error() != nil {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(codeFrom(e.error()))
-		return marshalStructWithError(response, w)
+	if stream, ok := response.(ndjsonResponse); ok {
+		return encodeNDJSON(ctx, w, stream)
+	}
+	if binary, ok := response.(binaryResponse); ok {
+		return writeBinary(ctx, w, binary, "")
 	}
+	w.Header().Set("X-Request-ID", requestIDFrom(ctx))
 
 	// Used for pagination
 	if e, ok := response.(counter); ok {
@@ -196,21 +602,135 @@ func encodeResponse(ctx context.Context, w http.ResponseWriter, response interfa
 	if v := w.Header().Get("Content-Type"); v == "" {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		// Only write json body if we're setting response as json
-		return json.NewEncoder(w).Encode(response)
+		return writeEnvelope(ctx, w, response, nil)
 	}
 	return nil
 }
 
+const (
+	// ndjsonContentType is the media type of streamed responses, one JSON value per line
+	ndjsonContentType = "application/x-ndjson"
+	// ndjsonWriteTimeout bounds the write of each streamed item, instead of the
+	// whole response, so long streams outlive the server write timeout
+	ndjsonWriteTimeout = 30 * time.Second
+)
+
+// ndjsonResponse is a response streamed as newline delimited JSON, stream
+// passes each item to emit as it is produced
+type ndjsonResponse struct {
+	stream func(emit func(item interface{}) error) error
+}
+
+// encodeNDJSON writes each item of a stream on its own line and flushes it, so
+// clients process large results incrementally and the server doesn't buffer
+// them. The status is sent with the first item: a stream failing before it is
+// answered like any other error, a stream failing after it ends with a line
+// holding the error object.
+func encodeNDJSON(ctx context.Context, w http.ResponseWriter, response ndjsonResponse) error {
+	enc := json.NewEncoder(w)
+	flusher := http.NewResponseController(w)
+	started := false
+	start := func() {
+		started = true
+		w.Header().Set("X-Request-ID", requestIDFrom(ctx))
+		w.Header().Set("Content-Type", ndjsonContentType)
+		w.WriteHeader(http.StatusOK)
+	}
+	err := response.stream(func(item interface{}) error {
+		if !started {
+			start()
+		}
+		if err := flusher.SetWriteDeadline(time.Now().Add(ndjsonWriteTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		if err := enc.Encode(item); err != nil {
+			return err
+		}
+		if err := flusher.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		return nil
+	})
+	if !started {
+		if err != nil {
+			return err
+		}
+		start()
+		return nil
+	}
+	if err != nil {
+		return enc.Encode(map[string]interface{}{
+			"requestId": requestIDFrom(ctx),
+			"error":     newErrorResponse(err),
+		})
+	}
+	return nil
+}
+
+// binaryResponse is a response written as the raw bytes of data, downloaded as
+// filename, with the extra headers of header
+type binaryResponse struct {
+	data     []byte
+	filename string
+	header   http.Header
+}
+
+// writeBinary writes a binary response and wipes its data, the signature of
+// the data is sent when not empty
+func writeBinary(ctx context.Context, w http.ResponseWriter, response binaryResponse, signature string) error {
+	defer wipe(response.data)
+	for name, values := range response.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("X-Request-ID", requestIDFrom(ctx))
+	w.Header().Set("Content-Type", binaryContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": response.filename}))
+	w.Header().Set("Content-Length", strconv.Itoa(len(response.data)))
+	if signature != "" {
+		w.Header().Set(ResponseSignatureHeader, signature)
+	}
+	_, err := w.Write(response.data)
+	return err
+}
+
+// encodeSignedResponse encodes responses like encodeResponse and signs the
+// exact bytes of the body, so consumers verify what was sent. Errors aren't
+// signed, they never carry keys.
+func encodeSignedResponse(signer *ResponseSigner) httptransport.EncodeResponseFunc {
+	return func(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+		if binary, ok := response.(binaryResponse); ok {
+			signature, err := signer.Sign(binary.data)
+			if err != nil {
+				wipe(binary.data)
+				return fmt.Errorf("signing response: %w", err)
+			}
+			return writeBinary(ctx, w, binary, signature)
+		}
+		body, err := marshalEnvelope(ctx, response, nil)
+		if err != nil {
+			return err
+		}
+		signature, err := signer.Sign(body)
+		if err != nil {
+			return fmt.Errorf("signing response: %w", err)
+		}
+		w.Header().Set("X-Request-ID", requestIDFrom(ctx))
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set(ResponseSignatureHeader, signature)
+		_, err = w.Write(body)
+		return err
+	}
+}
+
 // encodeError JSON encodes the supplied error
-func encodeError(_ context.Context, err error, w http.ResponseWriter) {
+func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
 	if err == nil {
 		err = ErrFoundABug
 	}
+	w.Header().Set("X-Request-ID", requestIDFrom(ctx))
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(codeFrom(err))
-	err = json.NewEncoder(w).Encode(map[string]interface{}{
-		"error": err.Error(),
-	})
+	err = writeEnvelope(ctx, w, nil, err)
 	if err != nil {
 		w.Write([]byte(fmt.Sprintf("problem rendering json: %v", err)))
 	}
@@ -220,14 +740,67 @@ func codeFrom(err error) int {
 	if err == nil {
 		return http.StatusOK
 	}
+	if status, ok := statusOf(err); ok {
+		return status
+	}
 
 	errString := fmt.Sprintf("%#v", err)
 	if el, ok := err.(base.ErrorList); ok {
 		errString = el.Error()
 	}
+	var headerErr *tr31.HeaderError
+	var paramsErr *HeaderParamsError
+	var keyBlockErr *tr31.KeyBlockError
 	switch {
+	case errors.Is(err, errRequestTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrClientCertRequired), errors.Is(err, ErrTenantUnauthorized),
+		errors.Is(err, ErrRequestSignature), errors.Is(err, ErrRequestReplayed),
+		errors.Is(err, ErrAdminUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrTenantForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrQuotaExceeded):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrUsageNotApproved), errors.Is(err, ErrVersionNotAllowed), errors.Is(err, ErrBlockPolicy):
+		return http.StatusForbidden
+	case errors.Is(err, ErrKeyNotUsable):
+		return http.StatusForbidden
+	case errors.Is(err, errIdempotencyKeyInUse), errors.Is(err, ErrKeyStateTransition):
+		return http.StatusConflict
+	case errors.Is(err, errIdempotencyKeyReused), errors.As(err, &paramsErr):
+		return http.StatusUnprocessableEntity
+	case
+		errors.Is(err, errInvalidJSON),
+		errors.Is(err, errMalformedField),
+		errors.Is(err, errInvalidKeyPath),
+		errors.Is(err, errInvalidKeyName),
+		errors.Is(err, errInvalidKeyBlock),
+		errors.Is(err, errInvalidTransportKey),
+		errors.Is(err, errInvalidPartner),
+		errors.Is(err, errInvalidDelivery),
+		errors.Is(err, errInvalidRotation),
+		errors.Is(err, errInvalidKeyState),
+		errors.Is(err, errInvalidCompromise),
+		errors.Is(err, errInvalidInspection),
+		errors.Is(err, errInvalidDump),
+		errors.Is(err, errInvalidEscrow),
+		errors.Is(err, errInvalidEscrowShare),
+		errors.Is(err, errInvalidKeyImporter),
+		errors.Is(err, errInvalidImportName),
+		errors.Is(err, errSecretScanNotSupported),
+		errors.Is(err, errInvalidIdempotencyKey),
+		errors.Is(err, errInvalidConsumerAction),
+		errors.Is(err, errInvalidJobType),
+		errors.Is(err, errInvalidJobItems),
+		errors.As(err, &headerErr),
+		errors.As(err, &keyBlockErr):
+		return http.StatusBadRequest
 	case
-		strings.Contains(errString, errInvalidMachine.Error()):
+		strings.Contains(errString, errInvalidMachine.Error()),
+		strings.Contains(errString, errInvalidDeclaration.Error()):
 		return http.StatusBadRequest
 	}
 
@@ -236,6 +809,10 @@ func codeFrom(err error) int {
 		return http.StatusNotFound
 	case ErrAlreadyExists:
 		return http.StatusBadRequest
+	case ErrVersionNotAllowed, ErrClearKeyNotAllowed:
+		return http.StatusForbidden
+	case errJobNotFinished:
+		return http.StatusConflict
 	default:
 		return http.StatusInternalServerError
 	}
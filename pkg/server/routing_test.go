@@ -2,11 +2,21 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/moov-io/tr31/pkg/tr31"
 	"github.com/stretchr/testify/require"
 )
 
@@ -437,7 +447,7 @@ func Test_DecryptData(t *testing.T) {
 				KeyPath: "secret/tr31",
 				KeyName: "kbkp",
 			},
-			expectedStatus: http.StatusInternalServerError,
+			expectedStatus: http.StatusBadRequest,
 			validateResp:   false,
 		},
 		{
@@ -449,7 +459,7 @@ func Test_DecryptData(t *testing.T) {
 				KeyName:  "kbkp",
 				KeyBlock: "INVALID_KEYBLOCK_1234",
 			},
-			expectedStatus: http.StatusInternalServerError,
+			expectedStatus: http.StatusBadRequest,
 			validateResp:   false,
 		},
 		{
@@ -460,7 +470,30 @@ func Test_DecryptData(t *testing.T) {
 				KeyName:  "kbkp",
 				KeyBlock: "A0088M3TC00E000022BD7EC46BBE2A6A73389D1BA6DB63120B386F912839F4679C0523399E4D8D0F1D9A356E", // gitleaks:allow
 			},
-			expectedStatus: http.StatusInternalServerError,
+			expectedStatus: http.StatusBadRequest,
+			validateResp:   false,
+		},
+		{
+			name:   "KeyBlock With Surrounding Whitespace",
+			method: "POST",
+			url:    "/decrypt_data",
+			body: decryptRequest{
+				KeyPath:  " secret/tr31 ",
+				KeyName:  "kbkp\n",
+				KeyBlock: "\n  A0088M3TC00E000022BD7EC46BBE2A6A73389D1BA6DB63120B386F912839F4679C0523399E4D8D0F1D9A356E\r\n"}, // gitleaks:allow
+			expectedStatus: http.StatusOK,
+			validateResp:   true,
+			expectedKey:    "ccccccccccccccccdddddddddddddddd",
+		},
+		{
+			name:   "KeyBlock With Inner Whitespace",
+			method: "POST",
+			url:    "/decrypt_data",
+			body: decryptRequest{
+				KeyPath:  "secret/tr31",
+				KeyName:  "kbkp",
+				KeyBlock: "A0088M3TC00E0000 22BD7EC46BBE2A6A73389D1BA6DB63120B386F912839F4679C0523399E4D8D0F1D9A356E"}, // gitleaks:allow
+			expectedStatus: http.StatusBadRequest,
 			validateResp:   false,
 		},
 		{
@@ -475,7 +508,7 @@ func Test_DecryptData(t *testing.T) {
 			method:         "POST",
 			url:            "/decrypt_data",
 			body:           nil,
-			expectedStatus: http.StatusInternalServerError,
+			expectedStatus: http.StatusBadRequest,
 			validateResp:   false,
 		},
 		{
@@ -485,7 +518,7 @@ func Test_DecryptData(t *testing.T) {
 			body: map[string]interface{}{
 				"wrongField": "unexpected",
 			},
-			expectedStatus: http.StatusInternalServerError,
+			expectedStatus: http.StatusBadRequest,
 			validateResp:   false,
 		},
 	}
@@ -556,3 +589,289 @@ func Test_DecryptData(t *testing.T) {
 		})
 	}
 }
+
+func TestRouting_encrypt_data_validation(t *testing.T) {
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	router := MakeHTTPHandler(s)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/encrypt_data", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// mixed case header and key padded with newlines are accepted
+	w := post(`{"KeyPath":"secret/tr31","KeyName":"kbkp","EncryptKey":" ccccccccccccccccDDDDDDDDDDDDDDDD\n",` +
+		`"Header":{"VersionId":"b","KeyUsage":"d0","Algorithm":"t","ModeOfUse":"d","KeyVersion":"00","Exportability":"e"}}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp encryptDataResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.True(t, strings.HasPrefix(resp.Data, "B0096D0TD00E0000"), w.Body.String())
+	require.Len(t, resp.KCV, 6)
+	require.Equal(t, &HeaderParams{VersionId: "B", KeyUsage: "D0", Algorithm: "T", ModeOfUse: "D", KeyVersion: "00", Exportability: "E"}, resp.Header)
+
+	// optional blocks are carried, every invalid header field is reported with a 422
+	w = post(`{"KeyPath":"secret/tr31","KeyName":"kbkp","EncryptKey":"ccccccccccccccccDDDDDDDDDDDDDDDD",` +
+		`"Header":{"VersionId":"b","KeyUsage":"d0","Algorithm":"t","ModeOfUse":"d","KeyVersion":"00","Exportability":"e","Blocks":{"ks":"00604B120F9292800000"}}}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.True(t, strings.HasPrefix(resp.Data, "B0120D0TD00E0100KS1800604B120F9292800000"), w.Body.String())
+
+	w = post(`{"KeyPath":"secret/tr31","KeyName":"kbkp","EncryptKey":"ccccccccccccccccDDDDDDDDDDDDDDDD",` +
+		`"Header":{"VersionId":"X","KeyUsage":"d0","Algorithm":"t","ModeOfUse":"d","KeyVersion":"0","Exportability":"e"}}`)
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	var failed struct{ Error ErrorResponse }
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &failed))
+	require.Equal(t, ERROR_CODE_INVALID_HEADER, failed.Error.Code)
+	require.Len(t, failed.Error.Fields, 2)
+	require.Equal(t, "Header.VersionId", failed.Error.Fields[0].Field)
+	require.Equal(t, "Header.KeyVersion", failed.Error.Fields[1].Field)
+
+	w = post(`{"KeyPath":"secret/tr31","KeyName":"kbkp","EncryptKey":"cccccccccccccccg"}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Body.String(), "EncryptKey must be hexchars")
+
+	w = post(`{"KeyPath":"secret/tr31","KeyName":"kbkp","EncryptKey":"ccc"}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Body.String(), "EncryptKey must be an even number of hexchars")
+
+	w = post(`{"KeyPath":"secret/tr31",`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Body.String(), "could not parse json request")
+
+	w = post(`{"EncryptKey":"` + strings.Repeat("c", int(maxRequestBodySize)) + `"}`)
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
+
+func TestRouting_decrypt_data_version_policy(t *testing.T) {
+	repository := NewRepositoryInMemory(nil)
+	mockService := NewService(repository, MODE_MOCK)
+	mockService.GetSecretManager().WriteSecret(
+		"secret/tr31",
+		"kbkp",
+		"AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC",
+	)
+	router := MakeHTTPHandler(mockService)
+
+	auth := mockVaultAuthOne()
+	requestBody, err := json.Marshal(map[string]interface{}{
+		"VaultAddress":    auth.VaultAddress,
+		"VaultToken":      auth.VaultToken,
+		"AllowedVersions": []string{"D"},
+	})
+	require.NoError(t, err)
+	req := httptest.NewRequest("POST", "/machine", bytes.NewReader(requestBody))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var created createMachineResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	require.Equal(t, []string{"D"}, created.Machine.AllowedVersions)
+
+	requestBody, err = json.Marshal(map[string]interface{}{
+		"VaultAddr":  auth.VaultAddress,
+		"VaultToken": auth.VaultToken,
+		"KeyPath":    "secret/tr31",
+		"KeyName":    "kbkp",
+		"KeyBlock":   "A0088M3TC00E000022BD7EC46BBE2A6A73389D1BA6DB63120B386F912839F4679C0523399E4D8D0F1D9A356E", // gitleaks:allow
+	})
+	require.NoError(t, err)
+	req = httptest.NewRequest("POST", "/decrypt_data", bytes.NewReader(requestBody))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.Contains(t, w.Body.String(), ErrVersionNotAllowed.Error())
+}
+
+func TestRouting_jobs(t *testing.T) {
+	repository := NewRepositoryInMemory(nil)
+	mockService := NewService(repository, MODE_MOCK)
+	mockService.GetSecretManager().WriteSecret(
+		"secret/tr31",
+		"kbkp",
+		"AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC",
+	)
+	router := MakeHTTPHandler(mockService)
+
+	requestBody, err := json.Marshal(JobRequest{
+		Type:    JOB_ROTATION,
+		KeyPath: "secret/tr31",
+		KeyName: "kbkp",
+		Items: []JobItem{
+			{
+				KeyLength: 16,
+				Header: HeaderParams{
+					VersionId:     "B",
+					KeyUsage:      "D0",
+					Algorithm:     "T",
+					ModeOfUse:     "D",
+					KeyVersion:    "00",
+					Exportability: "E",
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	req := httptest.NewRequest("POST", "/jobs", bytes.NewReader(requestBody))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var created jobResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	require.Equal(t, JOB_ROTATION, created.Job.Type)
+	waitForJob(t, mockService, created.Job.ID)
+
+	req = httptest.NewRequest("GET", "/jobs/"+created.Job.ID, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var status jobResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	require.Equal(t, JOB_COMPLETED, status.Job.Status)
+	require.Equal(t, 1, status.Job.Completed)
+
+	req = httptest.NewRequest("GET", "/jobs/"+created.Job.ID+"/result", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var results jobResultsResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &results))
+	require.Len(t, results.Results, 1)
+	require.Equal(t, "B", results.Results[0].Data[:1])
+
+	// Results stream one per line to clients accepting NDJSON
+	req = httptest.NewRequest("GET", "/jobs/"+created.Job.ID+"/result", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	require.Len(t, lines, 1)
+	var streamed JobResult
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &streamed))
+	require.Equal(t, results.Results[0], streamed)
+
+	req = httptest.NewRequest("GET", "/jobs/missing/result", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	req = httptest.NewRequest("DELETE", "/jobs/missing", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRouting_decrypt_data_format(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	signer, err := NewResponseSigner(key)
+	require.NoError(t, err)
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	router := MakeHTTPHandler(s, WithResponseSigner(signer))
+	clear, _ := hex.DecodeString("ccccccccccccccccdddddddddddddddd")
+
+	decrypt := func(format, accept string) *httptest.ResponseRecorder {
+		body := `{"KeyPath": "secret/tr31", "KeyName": "kbkp", "Format": "` + format + `",` +
+			`"KeyBlock": "A0088M3TC00E000022BD7EC46BBE2A6A73389D1BA6DB63120B386F912839F4679C0523399E4D8D0F1D9A356E"}` // gitleaks:allow
+		req := httptest.NewRequest("POST", "/decrypt_data", strings.NewReader(body))
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := decrypt("base64", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp decryptDataResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Equal(t, base64.StdEncoding.EncodeToString(clear), resp.Data)
+
+	for _, w := range []*httptest.ResponseRecorder{decrypt("binary", ""), decrypt("", "application/octet-stream")} {
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+		require.Equal(t, `attachment; filename=kbkp.bin`, w.Header().Get("Content-Disposition"))
+		require.Equal(t, clear, w.Body.Bytes())
+		// The signature covers the raw key
+		require.NoError(t, VerifyResponse(w.Body.Bytes(), w.Header().Get(ResponseSignatureHeader), &key.PublicKey))
+	}
+
+	w = decrypt("pem", "")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Body.String(), "Format must be hex, base64 or binary.")
+
+	req := httptest.NewRequest("POST", "/decrypt_data", strings.NewReader(`{"KeyPath": "secret/tr31", "KeyName": "kbkp", "KeyBlock": "A0088M3TC00E0000", "TransportKeyID": "acquirer", "Format": "binary"}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Body.String(), "Format only applies to clear keys")
+}
+
+func TestEncodeNDJSON(t *testing.T) {
+	stream := func(n int, err error) ndjsonResponse {
+		return ndjsonResponse{stream: func(emit func(interface{}) error) error {
+			for i := 0; i < n; i++ {
+				if err := emit(JobResult{Index: i}); err != nil {
+					return err
+				}
+			}
+			return err
+		}}
+	}
+
+	// Through gzip, every item is flushed as it is written
+	w := httptest.NewRecorder()
+	gw := &gzipResponseWriter{ResponseWriter: w}
+	require.NoError(t, encodeNDJSON(context.Background(), gw, stream(2, nil)))
+	require.True(t, w.Flushed)
+	require.NoError(t, gw.close())
+	gz, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	require.Equal(t, "{\"index\":0}\n{\"index\":1}\n", string(body))
+
+	// A stream failing after its first item ends with the error
+	w = httptest.NewRecorder()
+	require.NoError(t, encodeNDJSON(context.Background(), w, stream(1, ErrNotFound)))
+	require.Equal(t, http.StatusOK, w.Code)
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[1], `"code":"not_found"`)
+
+	// Before it, the error is returned for the error encoder
+	w = httptest.NewRecorder()
+	require.ErrorIs(t, encodeNDJSON(context.Background(), w, stream(0, ErrNotFound)), ErrNotFound)
+	require.Empty(t, w.Body.String())
+
+	// An empty stream is an empty body
+	w = httptest.NewRecorder()
+	require.NoError(t, encodeNDJSON(context.Background(), w, stream(0, nil)))
+	require.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	require.Empty(t, w.Body.String())
+}
+
+func TestRouting_dictionary(t *testing.T) {
+	req := httptest.NewRequest("GET", "/tr31/dictionary", nil)
+	w := httptest.NewRecorder()
+	mockHttpHandler().ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var body struct {
+		Dictionary tr31.Dictionary `json:"dictionary"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	require.Equal(t, tr31.HeaderDictionary(), body.Dictionary)
+	require.NotEmpty(t, body.Dictionary.KeyUsages)
+}
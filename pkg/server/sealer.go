@@ -0,0 +1,128 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var errSealedCredentials = errors.New("sealed machine credentials")
+
+// CredentialSealer encrypts the vault credentials of machines at rest in the
+// repository. associatedData binds the sealed credentials to their machine, so
+// they can't be swapped between machines.
+type CredentialSealer interface {
+	Seal(plaintext, associatedData []byte) ([]byte, error)
+	Open(ciphertext, associatedData []byte) ([]byte, error)
+}
+
+// LocalCredentialSealer seals credentials with AES-256-GCM under a key held by
+// the service. Repositories outliving the process plug a sealer backed by a
+// key manager instead.
+type LocalCredentialSealer struct {
+	aead cipher.AEAD
+}
+
+// NewLocalCredentialSealer returns a CredentialSealer for a 32 byte AES key
+func NewLocalCredentialSealer(key []byte) (*LocalCredentialSealer, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%w: key must be 32 bytes, received %d", errSealedCredentials, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalCredentialSealer{aead: aead}, nil
+}
+
+// newEphemeralCredentialSealer seals credentials under a random key, for
+// repositories which don't outlive the process
+func newEphemeralCredentialSealer() (*LocalCredentialSealer, error) {
+	key := make([]byte, 32)
+	defer wipe(key)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("%w: generating the sealing key: %v", errSealedCredentials, err)
+	}
+	return NewLocalCredentialSealer(key)
+}
+
+// unavailableSealer fails to seal or open credentials, for repositories whose
+// sealing key couldn't be generated
+type unavailableSealer struct {
+	err error
+}
+
+func (s unavailableSealer) Seal(_, _ []byte) ([]byte, error) {
+	return nil, s.err
+}
+
+func (s unavailableSealer) Open(_, _ []byte) ([]byte, error) {
+	return nil, s.err
+}
+
+// Seal encrypts plaintext, the random nonce prefixes the ciphertext
+func (s *LocalCredentialSealer) Seal(plaintext, associatedData []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(plaintext)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, plaintext, associatedData), nil
+}
+
+// Open decrypts ciphertext sealed by Seal with the same associatedData
+func (s *LocalCredentialSealer) Open(ciphertext, associatedData []byte) ([]byte, error) {
+	if len(ciphertext) < s.aead.NonceSize() {
+		return nil, fmt.Errorf("%w: ciphertext is too short", errSealedCredentials)
+	}
+	nonce, sealed := ciphertext[:s.aead.NonceSize()], ciphertext[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, sealed, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errSealedCredentials, err)
+	}
+	return plaintext, nil
+}
+
+// sealedMachine is a machine as stored by the repository, with its vault
+// credentials sealed
+type sealedMachine struct {
+	// machine has no vault credentials
+	machine     Machine
+	credentials []byte
+}
+
+// sealMachine seals the vault credentials of m, bound to its initial key
+func sealMachine(sealer CredentialSealer, m *Machine) (*sealedMachine, error) {
+	plaintext, err := json.Marshal(m.vaultAuth)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(plaintext)
+	credentials, err := sealer.Seal(plaintext, []byte(m.InitialKey))
+	if err != nil {
+		return nil, err
+	}
+	sealed := &sealedMachine{machine: *m, credentials: credentials}
+	sealed.machine.vaultAuth = Vault{}
+	return sealed, nil
+}
+
+// open returns a copy of the machine with its vault credentials
+func (s *sealedMachine) open(sealer CredentialSealer) (*Machine, error) {
+	plaintext, err := sealer.Open(s.credentials, []byte(s.machine.InitialKey))
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(plaintext)
+	m := s.machine
+	if err := json.Unmarshal(plaintext, &m.vaultAuth); err != nil {
+		return nil, fmt.Errorf("%w: %v", errSealedCredentials, err)
+	}
+	return &m, nil
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepository_sealsCredentials(t *testing.T) {
+	sealer, err := NewLocalCredentialSealer(bytes.Repeat([]byte{0x42}, 32))
+	require.NoError(t, err)
+	repository := NewRepositoryInMemory(nil, WithCredentialSealer(sealer))
+	vault := Vault{VaultAddress: "http://vault:8200", VaultToken: "s.secret-token"}
+	for _, ik := range []string{"ik-1", "ik-2"} {
+		m := NewMachine(vault)
+		m.InitialKey = ik
+		m.TransactionKey = "tk-" + ik
+		require.NoError(t, repository.StoreMachine(m))
+	}
+
+	// At rest the machine has no credentials and the token isn't in the clear
+	stored := repository.(*repositoryInMemory).machines["ik-1"]
+	require.Equal(t, Vault{}, stored.machine.vaultAuth)
+	require.NotContains(t, string(stored.credentials), vault.VaultToken)
+
+	found, err := repository.FindMachine("ik-1")
+	require.NoError(t, err)
+	require.Equal(t, vault, found.vaultAuth)
+	found, err = repository.FindMachineByTransactionKey("tk-ik-2")
+	require.NoError(t, err)
+	require.Equal(t, vault, found.vaultAuth)
+	machines, err := repository.FindAllMachines()
+	require.NoError(t, err)
+	for _, m := range machines {
+		require.Equal(t, vault, m.vaultAuth)
+	}
+	machines, total, err := repository.FindMachines(MachineQuery{Sort: MACHINE_SORT_IK_DESC, Limit: 1})
+	require.NoError(t, err)
+	require.Equal(t, 2, total)
+	require.Equal(t, "ik-2", machines[0].InitialKey)
+	require.Equal(t, vault, machines[0].vaultAuth)
+
+	// Machines found are copies
+	found.vaultAuth.VaultToken = "changed"
+	found, _ = repository.FindMachine("ik-2")
+	require.Equal(t, vault, found.vaultAuth)
+
+	// Sealed credentials are bound to their machine
+	r := repository.(*repositoryInMemory)
+	r.machines["ik-1"].credentials, r.machines["ik-2"].credentials = r.machines["ik-2"].credentials, r.machines["ik-1"].credentials
+	_, err = repository.FindMachine("ik-1")
+	require.ErrorIs(t, err, errSealedCredentials)
+	// nor do machines go missing from lookups when their credentials can't be opened
+	_, err = repository.FindAllMachines()
+	require.ErrorIs(t, err, errSealedCredentials)
+	_, _, err = repository.FindMachines(MachineQuery{})
+	require.ErrorIs(t, err, errSealedCredentials)
+
+	_, err = NewLocalCredentialSealer(make([]byte, 16))
+	require.ErrorIs(t, err, errSealedCredentials)
+}
+
+func TestRepository_unavailableSealer(t *testing.T) {
+	sealer := unavailableSealer{err: errors.New("entropy unavailable")}
+	repository := NewRepositoryInMemory(nil, WithCredentialSealer(sealer))
+	m := NewMachine(Vault{VaultAddress: "http://vault:8200", VaultToken: "s.secret-token"})
+	require.ErrorIs(t, repository.StoreMachine(m), sealer.err)
+	_, err := repository.FindMachine(m.InitialKey)
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMachine_withoutCredentials(t *testing.T) {
+	vault := Vault{VaultAddress: "http://vault:8200", VaultToken: "s.secret-token"}
+	m := NewMachine(vault)
+	m.InitialKey = "ik"
+	m.TransactionKey = "44cbb6e6434ddb22"
+
+	data, err := json.Marshal(m)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), vault.VaultToken)
+	// The transaction key would let guessed credentials be checked offline
+	require.NotContains(t, string(data), m.TransactionKey)
+	var view MachineView
+	require.NoError(t, json.Unmarshal(data, &view))
+	require.Equal(t, m.View(), &view)
+
+	for _, formatted := range []string{fmt.Sprint(m), fmt.Sprintf("%+v", m), fmt.Sprintf("%v", vault)} {
+		require.NotContains(t, formatted, vault.VaultToken)
+	}
+	require.Contains(t, fmt.Sprint(vault), vault.VaultAddress)
+
+	// Nor do API responses carry the credentials
+	router := MakeHTTPHandler(mockServiceInMock())
+	for _, req := range []*http.Request{
+		httptest.NewRequest("POST", "/machine", strings.NewReader(`{"vaultAddress":"http://vault:8200","vaultToken":"s.secret-token"}`)),
+		httptest.NewRequest("GET", "/machines", nil),
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.NotContains(t, w.Body.String(), vault.VaultToken)
+		require.NotContains(t, w.Body.String(), "TransactionKey")
+		require.Contains(t, w.Body.String(), "InitialKey")
+	}
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+// SelfTestReport is the outcome of the known-answer vectors of the tr31
+// package, see RunSelfTest
+type SelfTestReport struct {
+	// Passed is set when every suite passed
+	Passed bool            `json:"passed"`
+	Suites []SelfTestSuite `json:"suites"`
+}
+
+// SelfTestSuite is the outcome of a suite of vectors: wrap, unwrap, cmac or kdf
+type SelfTestSuite struct {
+	Suite    string   `json:"suite"`
+	Passed   bool     `json:"passed"`
+	Vectors  int      `json:"vectors"`
+	Failures []string `json:"failures,omitempty"`
+}
+
+// RunSelfTest runs the known-answer vectors embedded in the tr31 package, so a
+// deployment proves its crypto stack is intact, such as after an upgrade
+func RunSelfTest() *SelfTestReport {
+	report := &SelfTestReport{Passed: true}
+	for _, result := range tr31.SelfTest() {
+		report.Suites = append(report.Suites, SelfTestSuite{
+			Suite:    result.Suite,
+			Passed:   result.Passed,
+			Vectors:  result.Vectors,
+			Failures: result.Failures,
+		})
+		report.Passed = report.Passed && result.Passed
+	}
+	return report
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfTest(t *testing.T) {
+	req := httptest.NewRequest("POST", "/selftest", nil)
+	w := httptest.NewRecorder()
+	mockHttpHandler().ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp struct {
+		Report SelfTestReport `json:"report"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.True(t, resp.Report.Passed)
+	suites := make([]string, 0, len(resp.Report.Suites))
+	for _, suite := range resp.Report.Suites {
+		require.True(t, suite.Passed, suite.Failures)
+		require.NotZero(t, suite.Vectors)
+		suites = append(suites, suite.Suite)
+	}
+	require.Equal(t, []string{"wrap", "unwrap", "cmac", "kdf"}, suites)
+
+	// A failed suite fails the request, the report still names it
+	failed := selfTestResponse{Report: &SelfTestReport{Suites: []SelfTestSuite{{Suite: "cmac", Failures: []string{"vector: computed 00"}}}}}
+	w = httptest.NewRecorder()
+	require.NoError(t, encodeSelfTestResponse(context.Background(), w, failed))
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.Contains(t, w.Body.String(), "vector: computed 00")
+}
@@ -1,9 +1,16 @@
 package server
 
 import (
+	"crypto"
 	"errors"
+	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/moov-io/base/log"
+	"github.com/moov-io/tr31/pkg/tr31"
 )
 
 type RunningMode string
@@ -11,29 +18,129 @@ type RunningMode string
 var (
 	MODE_MOCK  RunningMode = "MOCK"
 	MODE_VAULT RunningMode = "VAULT"
+	// MODE_SIMULATOR is only selectable per machine, see Simulator
+	MODE_SIMULATOR RunningMode = "SIMULATOR"
 )
 
 var (
-	ErrNotFound      = errors.New("not found")
-	ErrAlreadyExists = errors.New("already exists")
+	ErrNotFound          = errors.New("not found")
+	ErrAlreadyExists     = errors.New("already exists")
+	ErrVersionNotAllowed = errors.New("key block version is not allowed by machine policy")
+	// ErrClearKeyNotAllowed is returned when a NeverClear machine is asked for a key in clear
+	ErrClearKeyNotAllowed = errors.New("clear key output is not allowed by machine policy")
 )
 
 // Service is a REST interface for interacting with machine structures
 type Service interface {
 	GetSecretManager() SecretManager
+	ConfigureSimulator(config SimulatorConfig)
 	CreateMachine(m *Machine) error
+	CreateMachineWithKBPK(m *Machine, bootstrap KBPKBootstrap) (string, error)
 	GetMachine(ik string) (*Machine, error)
-	GetMachines() []*Machine
+	GetMachines() ([]*Machine, error)
+	FindMachines(query MachineQuery) ([]*Machine, int, error)
+	UpdateMachineTags(ik string, tags map[string]*string) (*Machine, error)
+	UpdateMachineHeaderTemplate(ik string, template *HeaderParams) (*Machine, error)
 	DeleteMachine(ik string) error
 	EncryptData(vaultAddr, vaultToken, keyPath, keyName, encKey string, header HeaderParams, timeout time.Duration) (string, error)
-	DecryptData(vaultAddr, vaultToken, keyPath, keyName, keyBlock string, timeout time.Duration) (string, error)
+	EncryptDataWithResult(vaultAddr, vaultToken, keyPath, keyName, encKey string, header HeaderParams, timeout time.Duration) (*EncryptResult, error)
+	DecryptData(vaultAddr, vaultToken, keyPath, keyName, keyBlock string, timeout time.Duration, opts ...UnwrapOption) (string, error)
+	DecryptDataWithFallback(vaultAddr, vaultToken string, keys []KeyReference, keyBlock string, timeout time.Duration, opts ...UnwrapOption) (string, KeyReference, error)
+	TranslateData(vaultAddr, vaultToken, keyPath, keyName, targetKeyPath, targetKeyName, keyBlock string, timeout time.Duration, opts ...UnwrapOption) (string, error)
+	CreateJob(req JobRequest) (*Job, error)
+	GetJob(id string) (*Job, error)
+	CancelJob(id string) error
+	GetJobResults(id string) ([]JobResult, error)
+	StreamJobResults(id string, emit func(JobResult) error) error
+	ConfigureJobRetention(retention time.Duration)
+	Apply(decl *Declaration) (*ApplyResult, error)
+	ProvisionTerminal(ik, tmkUsage, terminalID string) (*Terminal, error)
+	GetTerminal(ik, terminalID string) (*Terminal, error)
+	RegisterManagedKey(ik string, req ManagedKeyRequest) (*ManagedKey, error)
+	GetManagedKey(ik, id string, opts ...UnwrapOption) ([]byte, *ManagedKey, error)
+	DestroyManagedKey(ik, id string) error
+	RegisterTransportKey(ik, publicKey string) (*TransportKey, error)
+	GetTransportKey(ik, keyID string) (*TransportKey, error)
+	DecryptDataUnderTransportKey(vaultAddr, vaultToken string, keys []KeyReference, keyBlock, keyID string, timeout time.Duration, opts ...UnwrapOption) (string, KeyReference, error)
+	CreatePartner(ik string, p *Partner) error
+	GetPartner(ik, partnerID string) (*Partner, error)
+	GetPartners(ik string) ([]*Partner, error)
+	DeletePartner(ik, partnerID string) error
+	WrapForPartner(ik, partnerID, encKey string, header HeaderParams, timeout time.Duration) (*EncryptResult, error)
+	TranslateForPartner(ik, partnerID string, source KeyReference, keyBlock string, timeout time.Duration, opts ...UnwrapOption) (string, error)
+	ConfigureDeliveries(d *Deliveries)
+	DeliverKeyExchange(ik, partnerID string, envelope []byte) (*Delivery, error)
+	GetDelivery(ik, partnerID, id string) (*Delivery, error)
+	ConfigureRotationSigner(from string, signer crypto.Signer)
+	CreateRotationSchedule(ik, partnerID string, schedule *RotationSchedule) error
+	GetRotationSchedules(ik, partnerID string) ([]*RotationSchedule, error)
+	DeleteRotationSchedule(ik, partnerID, zone string) error
+	RotateZone(ik, partnerID, zone string) (*Rotation, error)
+	GetRotations(ik, partnerID string) ([]*Rotation, error)
+	GetRotation(ik, partnerID, id string) (*Rotation, error)
+	AcknowledgeRotation(ik, partnerID, id, kcv string) (*Rotation, error)
+	AdvanceRotations() error
+	ConfigureKeyImporter(name string, importer KeyImporter)
+	DecryptDataAndImport(vaultAddr, vaultToken string, keys []KeyReference, keyBlock, importer, importName string, timeout time.Duration, opts ...UnwrapOption) (string, KeyReference, error)
+	ReencryptEstate(ik string, req EstateRequest) (*EstateReport, error)
+	GetInventory(ik string, states ...KeyState) (*Inventory, error)
+	StreamInventory(ik string, states []KeyState, emit func(InventoryItem) error) error
+	GetKeyState(ik, path, name string) (*KeyLifecycle, error)
+	GetKeyStates(ik string) ([]*KeyLifecycle, error)
+	ChangeKeyState(ik, path, name string, state KeyState, reason string) (*KeyLifecycle, error)
+	Compromise(ik string, req CompromiseRequest) (*CompromiseReport, error)
+	EscrowKBPK(ik string, req EscrowRequest) (*Escrow, error)
+	RecoverKBPK(ik, escrowID string, submission EscrowShare) (*EscrowRecovery, error)
+	ConfigureBlockPolicy(policy *BlockPolicy)
+	ConfigureTransparencyLog(l *TransparencyLog)
+	ConfigureTenants(tenants *Tenants)
+	ConfigureClock(c Clock)
+	ConfigureMachineIDs(g MachineIDGenerator)
+	ConfigureAuditLog(l *AuditLog)
+	ConfigureUsageApprover(approver UsageApprover, logger log.Logger)
 }
 
 // service a concrete implementation of the service.
 type service struct {
-	store   Repository
-	clients sync.Map
-	mode    RunningMode
+	store     Repository
+	clients   sync.Map
+	jobs      sync.Map
+	importers sync.Map
+	rotations sync.Map
+	// jobsRetention is how long finished jobs are kept, DefaultJobRetention when unset
+	jobsRetention atomic.Int64
+	// escrows holds the shares submitted to recover escrowed KBPKs
+	escrows sync.Map
+	// deliveries holds the deliveries of key exchange files to the
+	// deliveryTargets of partners
+	deliveries      sync.Map
+	deliveryTargets atomic.Pointer[Deliveries]
+	// rotationSchedules generate the workingKeys of partner zones, whose key
+	// exchange envelopes are signed by rotationSigner
+	rotationSchedules sync.Map
+	workingKeys       sync.Map
+	rotationSigner    atomic.Pointer[rotationSigner]
+	// keyStates holds the lifecycles of stored keys which changed state,
+	// keyStateMu serializes the changes
+	keyStates  sync.Map
+	keyStateMu sync.Mutex
+	// blockPolicy lists the optional blocks of wrapped and unwrapped key blocks
+	blockPolicy atomic.Pointer[BlockPolicy]
+	// transparencyLog records the key blocks the service wraps
+	transparencyLog atomic.Pointer[TransparencyLog]
+	// auditLog records the operations of the service
+	auditLog atomic.Pointer[AuditLog]
+	// tenants limits the machines and keys of tenants, tenantMu serializes
+	// the checks with the changes they allow
+	tenants  atomic.Pointer[Tenants]
+	tenantMu sync.Mutex
+	// clock stamps the times the service records, SystemClock when unset
+	clock atomic.Pointer[Clock]
+	// machineIDs generates the IDs of created machines, CredentialMachineIDs when unset
+	machineIDs atomic.Pointer[MachineIDGenerator]
+	// usageApproval approves the key usages callers unwrap, see ConfigureUsageApprover
+	usageApproval atomic.Pointer[usageApproval]
+	mode          RunningMode
 	// vaultClient SecretManager
 	// mu          sync.Mutex
 }
@@ -47,6 +154,7 @@ func NewService(r Repository, mode RunningMode) Service {
 	mockClient := NewMockVaultClient()
 	s.clients.Store(MODE_VAULT, vaultClient)
 	s.clients.Store(MODE_MOCK, mockClient)
+	s.clients.Store(MODE_SIMULATOR, NewSimulator(SimulatorConfig{}))
 	s.mode = mode
 	return &s
 }
@@ -60,31 +168,112 @@ func (s *service) GetSecretManager() SecretManager {
 	return nil
 }
 
+// ConfigureSimulator changes the faults injected for machines on the simulator backend
+func (s *service) ConfigureSimulator(config SimulatorConfig) {
+	s.clients.Store(MODE_SIMULATOR, NewSimulator(config))
+}
+
+// secretManagerOf returns the secret manager of the machine backend
+func (s *service) secretManagerOf(m *Machine) SecretManager {
+	if m != nil && m.Backend != "" {
+		if client, ok := s.clients.Load(m.Backend); ok {
+			return client.(SecretManager)
+		}
+	}
+	return s.GetSecretManager()
+}
+
+// secretManagerFor returns the secret manager of the machine registered for the
+// vault credentials, or the service one for credentials without a machine
+func (s *service) secretManagerFor(params UnifiedParams) SecretManager {
+	m, _ := s.machineFor(params)
+	return s.secretManagerOf(m)
+}
+
+// scopedSecretManagerOf returns the secret manager of the machine backend bound
+// to the vault credentials of the machine, see scopedSecretManager
+func (s *service) scopedSecretManagerOf(m *Machine) (SecretManager, error) {
+	return scopedSecretManager(s.secretManagerOf(m), m.vaultAuth)
+}
+
+// scopedSecretManagerFor returns the secret manager for the vault credentials
+// like secretManagerFor, bound to them so concurrent requests don't share them
+func (s *service) scopedSecretManagerFor(params UnifiedParams) (SecretManager, error) {
+	return scopedSecretManager(s.secretManagerFor(params), Vault{VaultAddress: params.VaultAddr, VaultToken: params.VaultToken})
+}
+
 // CreateMachine add a machine to storage
-func (s *service) CreateMachine(m *Machine) error {
+func (s *service) CreateMachine(m *Machine) (err error) {
+	defer func() {
+		if m != nil {
+			s.audit(AUDIT_OPERATION_CREATE_MACHINE, m.InitialKey, err)
+		}
+	}()
 	if m == nil {
 		return ErrNotFound
 	}
+	for _, v := range m.AllowedVersions {
+		if err := tr31.DefaultHeader().SetVersionID(v); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidMachine, err)
+		}
+	}
+	if err := validateTags(m.Tags); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidMachine, err)
+	}
+	if err := validateHeaderTemplate(m.HeaderTemplate); err != nil {
+		return err
+	}
+	if _, ok := s.clients.Load(m.Backend); m.Backend != "" && !ok {
+		return fmt.Errorf("%w: unknown backend %s", errInvalidMachine, m.Backend)
+	}
+	if err := s.validateKeyReferences(m.Keys); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidMachine, err)
+	}
+	if m.Tenant != "" {
+		s.tenantMu.Lock()
+		defer s.tenantMu.Unlock()
+		if err := s.checkTenantLimits(m.Tenant, 1, len(m.Keys)); err != nil {
+			return err
+		}
+	}
 
 	params := UnifiedParams{
 		VaultAddr:  m.vaultAuth.VaultAddress,
 		VaultToken: m.vaultAuth.VaultToken,
 	}
 
-	ik, err := InitialKey(params)
-	if err != nil {
-		return err
-	}
-	m.InitialKey = ik
 	tk, err := TransactionKey(params)
 	if err != nil {
 		return err
 	}
 	m.TransactionKey = tk
-	if err = s.store.StoreMachine(m); err != nil {
-		return err
+	if _, err := s.store.FindMachineByTransactionKey(tk); err == nil {
+		return ErrAlreadyExists
+	}
+	if m.Backend == "" {
+		m.Backend = s.mode
+	}
+	if m.CreatedAt.IsZero() {
+		m.CreatedAt = s.now()
+	}
+	// Generated IDs are drawn again when they collide with a stored machine
+	for attempt := 1; ; attempt++ {
+		ik, err := s.machineIDGenerator().MachineID(m)
+		if err != nil {
+			return err
+		}
+		if err := validateMachineID(ik); err != nil {
+			return err
+		}
+		m.InitialKey = ik
+		err = s.store.StoreMachine(m)
+		if !errors.Is(err, ErrAlreadyExists) || attempt == maxMachineIDAttempts {
+			return err
+		}
+		if _, err := s.store.FindMachineByTransactionKey(tk); err == nil {
+			return ErrAlreadyExists
+		}
 	}
-	return nil
 }
 
 // GetMachine returns a machine based on the supplied initial key
@@ -96,12 +285,65 @@ func (s *service) GetMachine(ik string) (*Machine, error) {
 	return f, nil
 }
 
-func (s *service) GetMachines() []*Machine {
+func (s *service) GetMachines() ([]*Machine, error) {
 	return s.store.FindAllMachines()
 }
 
+// UpdateMachineTags merges tags into the tags of a machine, a nil value removes the tag
+func (s *service) UpdateMachineTags(ik string, tags map[string]*string) (*Machine, error) {
+	// The tags are merged under the repository lock, so concurrent updates aren't lost
+	return s.store.UpdateMachine(ik, func(m *Machine) error {
+		merged := make(map[string]string, len(m.Tags)+len(tags))
+		for k, v := range m.Tags {
+			merged[k] = v
+		}
+		for k, v := range tags {
+			if v == nil {
+				delete(merged, k)
+			} else {
+				merged[k] = *v
+			}
+		}
+		if err := validateTags(merged); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidMachine, err)
+		}
+		// A new map, so readers holding the machine don't see the tags change
+		m.Tags = merged
+		return nil
+	})
+}
+
+// UpdateMachineHeaderTemplate replaces the header template of a machine, nil
+// removes it
+func (s *service) UpdateMachineHeaderTemplate(ik string, template *HeaderParams) (*Machine, error) {
+	if err := validateHeaderTemplate(template); err != nil {
+		return nil, err
+	}
+	// The template is replaced under the repository lock, so the machine is never missing
+	return s.store.UpdateMachine(ik, func(m *Machine) error {
+		m.HeaderTemplate = template
+		return nil
+	})
+}
+
+// FindMachines returns a page of the machines matching the query, along with
+// the number of matching machines
+func (s *service) FindMachines(query MachineQuery) ([]*Machine, int, error) {
+	return s.store.FindMachines(query)
+}
+
 func (s *service) EncryptData(vaultAddr, vaultToken, keyPath, keyName, encKey string, header HeaderParams, timeout time.Duration) (string, error) {
+	result, err := s.EncryptDataWithResult(vaultAddr, vaultToken, keyPath, keyName, encKey, header, timeout)
+	if err != nil {
+		return "", err
+	}
+	return result.KeyBlock, nil
+}
 
+// EncryptDataWithResult wraps the key like EncryptData, and also returns the KCV
+// of the key and the header it was wrapped under
+func (s *service) EncryptDataWithResult(vaultAddr, vaultToken, keyPath, keyName, encKey string, header HeaderParams, timeout time.Duration) (_ *EncryptResult, err error) {
+	defer func() { s.audit(AUDIT_OPERATION_ENCRYPT, keyPath+"/"+keyName, err) }()
 	vaultParams := UnifiedParams{
 		VaultAddr:  vaultAddr,
 		VaultToken: vaultToken,
@@ -110,23 +352,41 @@ func (s *service) EncryptData(vaultAddr, vaultToken, keyPath, keyName, encKey st
 		timeout:    timeout,
 	}
 
-	s.GetSecretManager().SetAddress(vaultParams.VaultAddr)
-	s.GetSecretManager().SetToken(vaultParams.VaultToken)
+	sm, err := s.scopedSecretManagerFor(vaultParams)
+	if err != nil {
+		return nil, err
+	}
 
-	keyStr, vErr := readKey(s.GetSecretManager(), vaultParams)
+	if m, err := s.machineFor(vaultParams); err == nil && m.HeaderTemplate != nil {
+		header = header.withDefaults(*m.HeaderTemplate)
+	}
+	kbpk, vErr := s.readKBPKFor(sm, vaultParams)
 	if vErr != nil {
-		return "", vErr
+		return nil, vErr
 	}
-	params := UnifiedParams{
-		Kbkp:    keyStr,
-		EncKey:  encKey,
-		Header:  header,
-		timeout: timeout,
+	defer wipe(kbpk)
+	result, err := wrapKey(kbpk, encKey, header, s.blockPolicy.Load(), s.now())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.logWrapped(result.KeyBlock); err != nil {
+		return nil, err
 	}
-	return EncryptData(params)
+	return result, nil
 }
 
-func (s *service) DecryptData(vaultAddr, vaultToken, keyPath, keyName, keyBlock string, timeout time.Duration) (string, error) {
+func (s *service) DecryptData(vaultAddr, vaultToken, keyPath, keyName, keyBlock string, timeout time.Duration, opts ...UnwrapOption) (_ string, err error) {
+	defer func() { s.audit(AUDIT_OPERATION_DECRYPT, keyPath+"/"+keyName, err) }()
+	if err := s.approveUsage(unwrapCallOf(opts).principal, keyBlock); err != nil {
+		return "", err
+	}
+	if err := s.checkClearOutput(vaultAddr, vaultToken, []KeyReference{{KeyPath: keyPath, KeyName: keyName}}); err != nil {
+		return "", err
+	}
+	return s.decryptData(vaultAddr, vaultToken, keyPath, keyName, keyBlock, timeout)
+}
+
+func (s *service) decryptData(vaultAddr, vaultToken, keyPath, keyName, keyBlock string, timeout time.Duration) (string, error) {
 	vaultParams := UnifiedParams{
 		VaultAddr:  vaultAddr,
 		VaultToken: vaultToken,
@@ -134,25 +394,204 @@ func (s *service) DecryptData(vaultAddr, vaultToken, keyPath, keyName, keyBlock
 		KeyName:    keyName,
 		timeout:    timeout,
 	}
-	s.GetSecretManager().SetAddress(vaultParams.VaultAddr)
-	s.GetSecretManager().SetToken(vaultParams.VaultToken)
+	if err := s.checkVersionPolicy(vaultParams, keyBlock); err != nil {
+		return "", err
+	}
+	if err := s.checkBlockPolicy(keyBlock); err != nil {
+		return "", err
+	}
+	sm, err := s.scopedSecretManagerFor(vaultParams)
+	if err != nil {
+		return "", err
+	}
 
-	keyStr, err := readKey(s.GetSecretManager(), vaultParams)
+	kbpk, err := s.readKBPKFor(sm, vaultParams)
 	if err != nil {
 		return "", err
 	}
-	params := UnifiedParams{
-		Kbkp:     keyStr,
-		KeyName:  keyName,
-		KeyBlock: keyBlock,
-		timeout:  timeout,
+	defer wipe(kbpk)
+	if sim, ok := sm.(*Simulator); ok {
+		if err := sim.unwrapFault(); err != nil {
+			return "", err
+		}
 	}
+	return unwrapKey(kbpk, keyBlock)
+}
+
+// DecryptDataWithFallback unwraps a key block trying the KBPKs in order, such as the
+// old and new KBPK during a rotation, and returns the key that unwrapped it
+func (s *service) DecryptDataWithFallback(vaultAddr, vaultToken string, keys []KeyReference, keyBlock string, timeout time.Duration, opts ...UnwrapOption) (_ string, _ KeyReference, err error) {
+	defer func() { s.audit(AUDIT_OPERATION_DECRYPT, auditKeysSubject(keys), err) }()
+	if err := s.approveUsage(unwrapCallOf(opts).principal, keyBlock); err != nil {
+		return "", KeyReference{}, err
+	}
+	if err := s.checkClearOutput(vaultAddr, vaultToken, keys); err != nil {
+		return "", KeyReference{}, err
+	}
+	return s.decryptDataWithFallback(vaultAddr, vaultToken, keys, keyBlock, timeout)
+}
 
-	return DecryptData(params)
+func (s *service) decryptDataWithFallback(vaultAddr, vaultToken string, keys []KeyReference, keyBlock string, timeout time.Duration) (string, KeyReference, error) {
+	if len(keys) == 0 {
+		return "", KeyReference{}, errInvalidKeyPath
+	}
+	var err error
+	for _, key := range keys {
+		var data string
+		data, err = s.decryptData(vaultAddr, vaultToken, key.KeyPath, key.KeyName, keyBlock, timeout)
+		if err == nil {
+			return data, key, nil
+		}
+		// A policy rejection is final, falling back to another KBPK must not bypass it
+		if errors.Is(err, ErrVersionNotAllowed) || errors.Is(err, ErrBlockPolicy) {
+			break
+		}
+	}
+	return "", KeyReference{}, err
+}
+
+// TranslateData unwraps a key block with the KBPK at keyPath/keyName and wraps
+// the key again under the KBPK at targetKeyPath/targetKeyName keeping its header
+func (s *service) TranslateData(vaultAddr, vaultToken, keyPath, keyName, targetKeyPath, targetKeyName, keyBlock string, timeout time.Duration, opts ...UnwrapOption) (_ string, err error) {
+	defer func() {
+		s.audit(AUDIT_OPERATION_TRANSLATE, keyPath+"/"+keyName+","+targetKeyPath+"/"+targetKeyName, err)
+	}()
+	vaultParams := UnifiedParams{
+		VaultAddr:  vaultAddr,
+		VaultToken: vaultToken,
+		KeyPath:    keyPath,
+		KeyName:    keyName,
+		timeout:    timeout,
+	}
+	if targetKeyPath == "" {
+		return "", errInvalidKeyPath
+	}
+	if targetKeyName == "" {
+		return "", errInvalidKeyName
+	}
+	if err := s.approveUsage(unwrapCallOf(opts).principal, keyBlock); err != nil {
+		return "", err
+	}
+	if err := s.checkRewrapPolicy(vaultParams, targetKeyPath, targetKeyName, keyBlock); err != nil {
+		return "", err
+	}
+	sm, err := s.scopedSecretManagerFor(vaultParams)
+	if err != nil {
+		return "", err
+	}
+
+	kbpk, err := s.readKBPKFor(sm, vaultParams)
+	if err != nil {
+		return "", err
+	}
+	defer wipe(kbpk)
+	if sim, ok := sm.(*Simulator); ok {
+		if err := sim.unwrapFault(); err != nil {
+			return "", err
+		}
+	}
+	vaultParams.KeyPath = targetKeyPath
+	vaultParams.KeyName = targetKeyName
+	targetKbpk, err := s.readKBPKFor(sm, vaultParams)
+	if err != nil {
+		return "", err
+	}
+	defer wipe(targetKbpk)
+	translated, err := runRewrap(JobItem{KeyBlock: keyBlock}, kbpk, targetKbpk)
+	if err != nil {
+		return "", err
+	}
+	if err := s.logWrapped(translated); err != nil {
+		return "", err
+	}
+	return translated, nil
 }
 
 func (s *service) DeleteMachine(ik string) error {
-	return s.store.DeleteMachine(ik)
+	err := s.store.DeleteMachine(ik)
+	s.audit(AUDIT_OPERATION_DELETE_MACHINE, ik, err)
+	return err
+}
+
+// policyMachines returns the machines whose policies apply to the KBPK of params:
+// the machines referencing it and the machine registered for the vault credentials.
+// Lookup failures are returned so that policies fail closed.
+func (s *service) policyMachines(params UnifiedParams) ([]*Machine, error) {
+	machines, err := s.store.FindMachinesByKey(params.KeyPath, params.KeyName)
+	if err != nil {
+		return nil, err
+	}
+	// Credentials without a transaction key, such as empty ones, can't be
+	// registered to a machine
+	tk, err := TransactionKey(params)
+	if err != nil {
+		return machines, nil
+	}
+	m, err := s.store.FindMachineByTransactionKey(tk)
+	switch {
+	case err == nil:
+		machines = append(machines, m)
+	case !errors.Is(err, ErrNotFound):
+		return nil, err
+	}
+	return machines, nil
+}
+
+// checkVersionPolicy rejects key blocks whose version is not allowed by a machine
+// referencing the KBPK or registered for the vault credentials. KBPKs and
+// credentials without a machine are not restricted.
+func (s *service) checkVersionPolicy(params UnifiedParams, keyBlock string) error {
+	if len(keyBlock) == 0 {
+		return nil
+	}
+	machines, err := s.policyMachines(params)
+	if err != nil {
+		return err
+	}
+	versionID := strings.ToUpper(keyBlock[:1])
+	for _, m := range machines {
+		if !m.AllowsVersion(versionID) {
+			return ErrVersionNotAllowed
+		}
+	}
+	return nil
+}
+
+// checkRewrapPolicy applies the policies of both the source and the target KBPK
+// to a key block re-wrapped from one to the other
+func (s *service) checkRewrapPolicy(params UnifiedParams, targetKeyPath, targetKeyName, keyBlock string) error {
+	if err := s.checkVersionPolicy(params, keyBlock); err != nil {
+		return err
+	}
+	target := params
+	target.KeyPath, target.KeyName = targetKeyPath, targetKeyName
+	if err := s.checkVersionPolicy(target, keyBlock); err != nil {
+		return err
+	}
+	return s.checkBlockPolicy(keyBlock)
+}
+
+// checkClearOutput rejects returning keys in clear when a NeverClear machine
+// references one of the KBPKs or is registered for the vault credentials.
+// Lookup failures are returned so that the check fails closed.
+func (s *service) checkClearOutput(vaultAddr, vaultToken string, keys []KeyReference) error {
+	params := UnifiedParams{VaultAddr: vaultAddr, VaultToken: vaultToken}
+	if len(keys) == 0 {
+		keys = []KeyReference{{}}
+	}
+	for _, key := range keys {
+		params.KeyPath, params.KeyName = key.KeyPath, key.KeyName
+		machines, err := s.policyMachines(params)
+		if err != nil {
+			return err
+		}
+		for _, m := range machines {
+			if m.NeverClear {
+				return ErrClearKeyNotAllowed
+			}
+		}
+	}
+	return nil
 }
 
 func Encrypt(params UnifiedParams) (string, error) {
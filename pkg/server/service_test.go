@@ -3,8 +3,12 @@ package server
 import (
 	"cmp"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/moov-io/tr31/pkg/tr31"
 	"github.com/stretchr/testify/require"
 )
 
@@ -39,11 +43,126 @@ func TestService__CreateMachine(t *testing.T) {
 	mDes := NewMachine(mockVaultAuthOne())
 	err := s.CreateMachine(mDes)
 	require.NoError(t, err)
+	require.Equal(t, MODE_MOCK, mDes.Backend)
+	require.False(t, mDes.CreatedAt.IsZero())
 
 	err = s.CreateMachine(mDes)
 	require.Equal(t, "already exists", err.Error())
 }
 
+func TestService_UpdateMachineTags(t *testing.T) {
+	s := mockServiceInMock()
+	m := NewMachine(mockVaultAuthOne())
+	m.Tags = map[string]string{"environment": "test", "zone": "us-east"}
+	require.NoError(t, s.CreateMachine(m))
+
+	prod := "prod"
+	updated, err := s.UpdateMachineTags(m.InitialKey, map[string]*string{
+		"environment": &prod,
+		"institution": &prod,
+		"zone":        nil,
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"environment": "prod", "institution": "prod"}, updated.Tags)
+	require.Equal(t, m.CreatedAt, updated.CreatedAt)
+
+	// the machine passed to CreateMachine is left untouched
+	require.Equal(t, "test", m.Tags["environment"])
+
+	found, err := s.GetMachine(m.InitialKey)
+	require.NoError(t, err)
+	require.Equal(t, updated.Tags, found.Tags)
+
+	_, err = s.UpdateMachineTags(m.InitialKey, map[string]*string{"bad key": &prod})
+	require.ErrorIs(t, err, errInvalidMachine)
+	_, err = s.UpdateMachineTags("missing", nil)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// Concurrent updates are merged, and the machine is never missing meanwhile
+	var wg sync.WaitGroup
+	for i := range 20 {
+		value := strconv.Itoa(i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := s.UpdateMachineTags(m.InitialKey, map[string]*string{"tag-" + value: &value})
+			require.NoError(t, err)
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := s.GetMachine(m.InitialKey)
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	found, err = s.GetMachine(m.InitialKey)
+	require.NoError(t, err)
+	require.Len(t, found.Tags, 22)
+
+	invalid := NewMachine(mockVaultAuthTwo())
+	invalid.Tags = map[string]string{"": "empty"}
+	require.ErrorIs(t, s.CreateMachine(invalid), errInvalidMachine)
+}
+
+func TestService_UpdateMachineHeaderTemplate(t *testing.T) {
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	auth := mockVaultAuthOne()
+	m := NewMachine(auth)
+	m.HeaderTemplate = &HeaderParams{VersionId: "X"}
+	require.ErrorIs(t, s.CreateMachine(m), errInvalidMachine)
+	m.HeaderTemplate = nil
+	require.NoError(t, s.CreateMachine(m))
+
+	template := &HeaderParams{
+		VersionId:     "D",
+		Algorithm:     "A",
+		KeyVersion:    "00",
+		Exportability: "E",
+		Blocks:        map[string]string{"LB": "INST0042"},
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, err := s.UpdateMachineHeaderTemplate(m.InitialKey, template)
+		require.NoError(t, err)
+	}()
+	go func() {
+		defer wg.Done()
+		prod := "prod"
+		_, err := s.UpdateMachineTags(m.InitialKey, map[string]*string{"env": &prod})
+		require.NoError(t, err)
+	}()
+	wg.Wait()
+	updated, err := s.GetMachine(m.InitialKey)
+	require.NoError(t, err)
+	require.Equal(t, template, updated.HeaderTemplate)
+	require.Equal(t, map[string]string{"env": "prod"}, updated.Tags)
+	require.Nil(t, m.HeaderTemplate)
+
+	// Fields and blocks of the request win over the template
+	header := HeaderParams{KeyUsage: "D0", ModeOfUse: "D", Exportability: "N", Blocks: map[string]string{"KS": "FFFF9876543210E00000"}}
+	result, err := s.EncryptDataWithResult(auth.VaultAddress, auth.VaultToken, "secret/tr31", "kbkp", "ccccccccccccccccdddddddddddddddd", header, 10)
+	require.NoError(t, err)
+	require.Equal(t, "D", result.Header.VersionId)
+	require.Equal(t, "A", result.Header.Algorithm)
+	require.Equal(t, "N", result.Header.Exportability)
+	require.Equal(t, map[string]string{"KS": "FFFF9876543210E00000", "LB": "INST0042"}, result.Header.Blocks)
+
+	_, err = s.UpdateMachineHeaderTemplate(m.InitialKey, &HeaderParams{Exportability: "?"})
+	require.ErrorIs(t, err, errInvalidMachine)
+	_, err = s.UpdateMachineHeaderTemplate("missing", template)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// Without the template the request must carry every field
+	updated, err = s.UpdateMachineHeaderTemplate(m.InitialKey, nil)
+	require.NoError(t, err)
+	require.Nil(t, updated.HeaderTemplate)
+	_, err = s.EncryptDataWithResult(auth.VaultAddress, auth.VaultToken, "secret/tr31", "kbkp", "ccccccccccccccccdddddddddddddddd", header, 10)
+	require.Error(t, err)
+}
+
 func TestService__GetMachine(t *testing.T) {
 	s := mockServiceInMock()
 
@@ -53,7 +172,8 @@ func TestService__GetMachine(t *testing.T) {
 		return
 	}
 
-	machines := s.GetMachines()
+	machines, err := s.GetMachines()
+	require.NoError(t, err)
 	require.Equal(t, 1, len(machines))
 
 	machine, err := s.GetMachine(machines[0].InitialKey)
@@ -77,7 +197,8 @@ func TestService__DeleteMachine(t *testing.T) {
 	require.NotEqual(t, m1.TransactionKey, m2.TransactionKey)
 	require.NotEqual(t, m1.InitialKey, m2.InitialKey)
 
-	machines := s.GetMachines()
+	machines, err := s.GetMachines()
+	require.NoError(t, err)
 	require.Equal(t, 2, len(machines))
 
 	err = s.DeleteMachine(m1.InitialKey)
@@ -89,7 +210,8 @@ func TestService__DeleteMachine(t *testing.T) {
 		return
 	}
 
-	machines = s.GetMachines()
+	machines, err = s.GetMachines()
+	require.NoError(t, err)
 	require.Equal(t, 0, len(machines))
 }
 
@@ -125,3 +247,68 @@ func TestService_Encrypt_Decrypt_Data_With_Mock(t *testing.T) {
 
 	s.GetSecretManager().DeleteSecret("/auth/keys", "kbkp")
 }
+
+func TestService_Decrypt_Data_Version_Policy(t *testing.T) {
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret(
+		"secret/tr31",
+		"kbkp",
+		"AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC",
+	)
+	keyBlock := "A0088M3TC00E000022BD7EC46BBE2A6A73389D1BA6DB63120B386F912839F4679C0523399E4D8D0F1D9A356E" // gitleaks:allow
+
+	invalid := NewMachine(mockVaultAuthOne())
+	invalid.AllowedVersions = []string{"E"}
+	err := s.CreateMachine(invalid)
+	require.ErrorIs(t, err, errInvalidMachine)
+
+	m := NewMachine(mockVaultAuthOne())
+	m.AllowedVersions = []string{"D"}
+	require.NoError(t, s.CreateMachine(m))
+	require.True(t, m.AllowsVersion("D"))
+	require.False(t, m.AllowsVersion("A"))
+
+	_, err = s.DecryptData(mockVaultAuthOne().VaultAddress, mockVaultAuthOne().VaultToken, "secret/tr31", "kbkp", keyBlock, 10)
+	require.ErrorIs(t, err, ErrVersionNotAllowed)
+
+	// Credentials without a registered machine are not restricted
+	data, err := s.DecryptData("mock", "mock", "secret/tr31", "kbkp", keyBlock, 10)
+	require.NoError(t, err)
+	require.Equal(t, "ccccccccccccccccdddddddddddddddd", data)
+
+	// The policy of the machine referencing the KBPK applies to any credentials
+	owner := NewMachine(Vault{VaultAddress: "http://owner:8200", VaultToken: "owner"})
+	owner.AllowedVersions = []string{"D"}
+	owner.Keys = []KeyReference{{KeyPath: "/secret/tr31/", KeyName: "kbkp"}}
+	require.NoError(t, s.CreateMachine(owner))
+	_, err = s.DecryptData("mock", "mock", "secret/tr31", "kbkp", keyBlock, 10)
+	require.ErrorIs(t, err, ErrVersionNotAllowed)
+	_, err = s.TranslateData("mock", "mock", "secret/tr31", "other", "secret/tr31", "kbkp", keyBlock, 10)
+	require.ErrorIs(t, err, ErrVersionNotAllowed)
+
+	// Versions are compared whatever their case
+	_, err = s.DecryptData("mock", "mock", "secret/tr31", "kbkp", strings.ToLower(keyBlock[:1])+keyBlock[1:], 10)
+	require.ErrorIs(t, err, ErrVersionNotAllowed)
+	require.True(t, owner.AllowsVersion("d"))
+}
+
+func TestService_DecryptDataWithFallback(t *testing.T) {
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "old", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	s.GetSecretManager().WriteSecret("secret/tr31", "new", "DDDDDDDDDDDDDDDDEEEEEEEEEEEEEEEEFFFFFFFFFFFFFFFF")
+	header := HeaderParams{VersionId: "B", KeyUsage: "D0", Algorithm: "T", ModeOfUse: "D", KeyVersion: "00", Exportability: "E"}
+	keyBlock, err := s.EncryptData("mock", "mock", "secret/tr31", "old", "ccccccccccccccccdddddddddddddddd", header, 10)
+	require.NoError(t, err)
+
+	keys := []KeyReference{{KeyPath: "secret/tr31", KeyName: "new"}, {KeyPath: "secret/tr31", KeyName: "old"}}
+	data, key, err := s.DecryptDataWithFallback("mock", "mock", keys, keyBlock, 10)
+	require.NoError(t, err)
+	require.Equal(t, "ccccccccccccccccdddddddddddddddd", data)
+	require.Equal(t, keys[1], key)
+
+	_, _, err = s.DecryptDataWithFallback("mock", "mock", keys[:1], keyBlock, 10)
+	require.IsType(t, &tr31.KeyBlockError{}, err)
+
+	_, _, err = s.DecryptDataWithFallback("mock", "mock", nil, keyBlock, 10)
+	require.Equal(t, errInvalidKeyPath, err)
+}
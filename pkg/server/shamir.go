@@ -0,0 +1,103 @@
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+var errInvalidShares = errors.New("invalid Shamir shares")
+
+// splitSecret splits secret into n Shamir shares, any threshold of which
+// recombine into the secret. Each byte of the secret is the constant term of
+// a random polynomial of degree threshold-1 over GF(2^8), and share i holds its
+// x coordinate i+1 followed by the polynomials evaluated at x.
+func splitSecret(secret []byte, n, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("%w: secret is empty", errInvalidShares)
+	}
+	if threshold < 2 || threshold > n || n > 255 {
+		return nil, fmt.Errorf("%w: can't split in %d shares with a threshold of %d", errInvalidShares, n, threshold)
+	}
+
+	coefficients := make([]byte, len(secret)*(threshold-1))
+	defer wipe(coefficients)
+	if _, err := rand.Read(coefficients); err != nil {
+		return nil, err
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		x := byte(i + 1)
+		share := make([]byte, len(secret)+1)
+		share[0] = x
+		for j := range secret {
+			// Horner's method, from the highest degree coefficient down to the secret
+			var y byte
+			for k := threshold - 2; k >= 0; k-- {
+				y = gfMul(y, x) ^ coefficients[j*(threshold-1)+k]
+			}
+			share[j+1] = gfMul(y, x) ^ secret[j]
+		}
+		shares[i] = share
+	}
+	return shares, nil
+}
+
+// combineShares interpolates the Shamir shares at zero, which gives the secret
+// when at least the threshold of shares is combined
+func combineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, fmt.Errorf("%w: at least 2 shares are needed", errInvalidShares)
+	}
+	length := len(shares[0])
+	seen := make(map[byte]bool, len(shares))
+	for i, share := range shares {
+		if len(share) < 2 || len(share) != length {
+			return nil, fmt.Errorf("%w: share %d length (%d) doesn't match share 1 length (%d)", errInvalidShares, i+1, len(share), length)
+		}
+		if share[0] == 0 || seen[share[0]] {
+			return nil, fmt.Errorf("%w: share %d has a zero or repeated x coordinate", errInvalidShares, i+1)
+		}
+		seen[share[0]] = true
+	}
+
+	secret := make([]byte, length-1)
+	for i, share := range shares {
+		// Lagrange basis polynomial of the share evaluated at zero
+		basis := byte(1)
+		for j, other := range shares {
+			if i != j {
+				basis = gfMul(basis, gfMul(other[0], gfInv(other[0]^share[0])))
+			}
+		}
+		for k := range secret {
+			secret[k] ^= gfMul(share[k+1], basis)
+		}
+	}
+	return secret, nil
+}
+
+// gfMul multiplies in GF(2^8) with the AES polynomial, without branching on
+// the operands
+func gfMul(a, b byte) byte {
+	var p byte
+	for range 8 {
+		p ^= a & -(b & 1)
+		a = a<<1 ^ 0x1b&-(a>>7)
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv returns the multiplicative inverse of a non-zero a in GF(2^8), a^254
+func gfInv(a byte) byte {
+	result := byte(1)
+	for exponent := 254; exponent > 0; exponent >>= 1 {
+		if exponent&1 == 1 {
+			result = gfMul(result, a)
+		}
+		a = gfMul(a, a)
+	}
+	return result
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// ResponseSignatureHeader holds the detached JWS over the body of signed responses
+const ResponseSignatureHeader = "X-JWS-Signature"
+
+var errInvalidSigningKey = errors.New("invalid response signing key")
+
+// _responseSigningAlgorithms are the algorithms a ResponseSigner may sign with
+var _responseSigningAlgorithms = []jose.SignatureAlgorithm{
+	jose.ES256, jose.ES384, jose.ES512, jose.RS256, jose.EdDSA,
+}
+
+// ResponseSigner signs response bodies with a server key, so consumers of
+// clear keys can check they came from this service unaltered. Signatures are
+// compact JWS with a detached payload (RFC 7515 appendix F): the payload is
+// the exact response body and the key ID is the RFC 7638 thumbprint of the
+// public key.
+type ResponseSigner struct {
+	signer    jose.Signer
+	publicKey jose.JSONWebKey
+}
+
+// NewResponseSigner returns a ResponseSigner for an ECDSA (P-256, P-384 or
+// P-521), RSA or Ed25519 private key.
+func NewResponseSigner(key crypto.Signer) (*ResponseSigner, error) {
+	algorithm, err := signingAlgorithm(key)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := signingJWK(key.Public(), algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: algorithm, Key: key},
+		(&jose.SignerOptions{}).WithHeader(jose.HeaderKey("kid"), publicKey.KeyID),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidSigningKey, err)
+	}
+	return &ResponseSigner{signer: signer, publicKey: publicKey}, nil
+}
+
+// signingAlgorithm returns the JWS algorithm of an ECDSA (P-256, P-384 or
+// P-521), RSA or Ed25519 private key
+func signingAlgorithm(key crypto.Signer) (jose.SignatureAlgorithm, error) {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		case elliptic.P521():
+			return jose.ES512, nil
+		}
+		return "", fmt.Errorf("%w: unsupported curve %s", errInvalidSigningKey, k.Curve.Params().Name)
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return "", fmt.Errorf("%w: RSA keys must be at least 2048 bits", errInvalidSigningKey)
+		}
+		return jose.RS256, nil
+	case ed25519.PrivateKey:
+		return jose.EdDSA, nil
+	}
+	return "", fmt.Errorf("%w: unsupported key type %T", errInvalidSigningKey, key)
+}
+
+// signingJWK returns the JSON Web Key of a public key, identified by its RFC
+// 7638 thumbprint
+func signingJWK(key crypto.PublicKey, algorithm jose.SignatureAlgorithm) (jose.JSONWebKey, error) {
+	publicKey := jose.JSONWebKey{Key: key, Algorithm: string(algorithm), Use: "sig"}
+	thumbprint, err := publicKey.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return jose.JSONWebKey{}, fmt.Errorf("%w: %v", errInvalidSigningKey, err)
+	}
+	publicKey.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+	return publicKey, nil
+}
+
+// LoadResponseSigner reads a PEM encoded PKCS #8, SEC 1 (EC) or PKCS #1 (RSA)
+// private key from path and returns a ResponseSigner for it.
+func LoadResponseSigner(path string) (*ResponseSigner, error) {
+	signer, err := LoadSigningKey(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewResponseSigner(signer)
+}
+
+// LoadSigningKey reads a PEM encoded PKCS #8, SEC 1 (EC) or PKCS #1 (RSA)
+// private key from path
+func LoadSigningKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM data found in %s", errInvalidSigningKey, path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidSigningKey, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported key type %T", errInvalidSigningKey, key)
+	}
+	return signer, nil
+}
+
+// Sign returns the detached compact JWS over body
+func (rs *ResponseSigner) Sign(body []byte) (string, error) {
+	jws, err := rs.signer.Sign(body)
+	if err != nil {
+		return "", err
+	}
+	return jws.DetachedCompactSerialize()
+}
+
+// PublicKey returns the JSON Web Key consumers verify signatures with
+func (rs *ResponseSigner) PublicKey() jose.JSONWebKey {
+	return rs.publicKey
+}
+
+// VerifyResponse checks signature, the value of the X-JWS-Signature header, is
+// a valid signature over the response body by key, the public key of the
+// service's ResponseSigner.
+func VerifyResponse(body []byte, signature string, key crypto.PublicKey) error {
+	if signature == "" {
+		return errors.New("response is not signed")
+	}
+	jws, err := jose.ParseDetached(signature, body, _responseSigningAlgorithms)
+	if err != nil {
+		return fmt.Errorf("parsing response signature: %w", err)
+	}
+	return jws.DetachedVerify(body, key)
+}
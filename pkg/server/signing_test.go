@@ -0,0 +1,132 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseSigner(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	signer, err := NewResponseSigner(key)
+	require.NoError(t, err)
+
+	body := []byte(`{"data":"ccccccccccccccccdddddddddddddddd"}`)
+	signature, err := signer.Sign(body)
+	require.NoError(t, err)
+	require.Len(t, strings.Split(signature, "."), 3)
+	require.Empty(t, strings.Split(signature, ".")[1], "payload is detached")
+
+	require.NoError(t, VerifyResponse(body, signature, &key.PublicKey))
+	require.Error(t, VerifyResponse([]byte(`{"data":"eeeeeeeeeeeeeeeedddddddddddddddd"}`), signature, &key.PublicKey))
+	require.Error(t, VerifyResponse(body, "", &key.PublicKey))
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	require.Error(t, VerifyResponse(body, signature, &other.PublicKey))
+
+	jws, err := jose.ParseDetached(signature, body, []jose.SignatureAlgorithm{jose.ES256})
+	require.NoError(t, err)
+	require.Equal(t, signer.PublicKey().KeyID, jws.Signatures[0].Header.KeyID)
+
+	_, err = NewResponseSigner(unsupportedSigner{key})
+	require.ErrorIs(t, err, errInvalidSigningKey)
+}
+
+// unsupportedSigner is a crypto.Signer of a type NewResponseSigner doesn't know
+type unsupportedSigner struct {
+	*ecdsa.PrivateKey
+}
+
+func TestLoadResponseSigner(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "signing.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+
+	signer, err := LoadResponseSigner(path)
+	require.NoError(t, err)
+	require.Equal(t, string(jose.EdDSA), signer.PublicKey().Algorithm)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	der, err = x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+
+	signer, err = LoadResponseSigner(path)
+	require.NoError(t, err)
+	require.Equal(t, string(jose.ES384), signer.PublicKey().Algorithm)
+
+	require.NoError(t, os.WriteFile(path, []byte("not a key"), 0600))
+	_, err = LoadResponseSigner(path)
+	require.ErrorIs(t, err, errInvalidSigningKey)
+}
+
+func TestRouting_decrypt_data_signed(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	signer, err := NewResponseSigner(key)
+	require.NoError(t, err)
+
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	router := MakeHTTPHandler(s, WithResponseSigner(signer))
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/decrypt_data", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post(`{"KeyPath":"secret/tr31","KeyName":"kbkp",` +
+		`"KeyBlock":"A0088M3TC00E000022BD7EC46BBE2A6A73389D1BA6DB63120B386F912839F4679C0523399E4D8D0F1D9A356E"}`) // gitleaks:allow
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	body, signature := w.Body.Bytes(), w.Header().Get(ResponseSignatureHeader)
+	require.NotEmpty(t, signature)
+	require.NoError(t, VerifyResponse(body, signature, &key.PublicKey))
+
+	var resp decryptDataResponse
+	require.NoError(t, json.Unmarshal(body, &resp))
+	require.Equal(t, "ccccccccccccccccdddddddddddddddd", resp.Data)
+
+	// errors never carry keys and aren't signed
+	w = post(`{"KeyPath":"secret/tr31","KeyName":"kbkp","KeyBlock":"A0088"}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Empty(t, w.Header().Get(ResponseSignatureHeader))
+
+	// consumers find the public key in the JWK Set
+	req := httptest.NewRequest("GET", "/.well-known/jwks.json", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var jwks jose.JSONWebKeySet
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &jwks))
+	keys := jwks.Key(signer.PublicKey().KeyID)
+	require.Len(t, keys, 1)
+	require.NoError(t, VerifyResponse(body, signature, keys[0].Key))
+
+	// without a signer nothing is signed or served
+	router = MakeHTTPHandler(s)
+	req = httptest.NewRequest("GET", "/.well-known/jwks.json", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.NotEqual(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+// SimulatorConfig configures the faults injected by the simulator backend
+type SimulatorConfig struct {
+	// Latency is added to every key read, plus a random delay up to Jitter
+	Latency time.Duration
+	Jitter  time.Duration
+	// KeyNotFoundRate is the share of key reads failing as if the key didn't exist, from 0 to 1
+	KeyNotFoundRate float64
+	// MACFailureRate is the share of unwraps failing MAC verification, from 0 to 1
+	MACFailureRate float64
+	// Seed makes the injected faults reproducible, zero seeds from the clock
+	Seed int64
+}
+
+// Simulator is a secret manager behaving like an HSM under stress, for resilience
+// testing of calling systems. KBPKs are derived from their path and name, so any
+// key reference works without touching real keys, unless written explicitly.
+// Machines created with the MODE_SIMULATOR backend use it.
+type Simulator struct {
+	config SimulatorConfig
+	keys   *MockVaultClient
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// NewSimulator creates a simulator injecting the configured faults
+func NewSimulator(config SimulatorConfig) *Simulator {
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Simulator{
+		config: config,
+		keys:   NewMockVaultClient(),
+		rand:   rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (sim *Simulator) SetAddress(address string) *VaultError {
+	return nil
+}
+
+func (sim *Simulator) SetToken(token string) *VaultError {
+	return nil
+}
+
+// WriteSecret stores a KBPK overriding the derived one
+func (sim *Simulator) WriteSecret(path, key, value string) *VaultError {
+	return sim.keys.WriteSecret(path, key, value)
+}
+
+// ReadSecret waits for the simulated latency and returns the written or derived
+// KBPK, or fails as if the key didn't exist
+func (sim *Simulator) ReadSecret(path, key string) (string, *VaultError) {
+	if path == "" || key == "" {
+		return "", &VaultError{Message: "Invalid input: path and key are required"}
+	}
+
+	sim.mu.Lock()
+	delay := sim.config.Latency
+	if sim.config.Jitter > 0 {
+		delay += time.Duration(sim.rand.Int63n(int64(sim.config.Jitter)))
+	}
+	notFound := sim.rand.Float64() < sim.config.KeyNotFoundRate
+	sim.mu.Unlock()
+
+	time.Sleep(delay)
+	if notFound {
+		return "", &VaultError{Message: fmt.Sprintf("Key %s not found in path %s", key, path)}
+	}
+	if value, err := sim.keys.ReadSecret(path, key); err == nil {
+		return value, nil
+	}
+	// 24 bytes KBPKs suit TDES and AES key blocks
+	sum := sha256.Sum256([]byte(path + "/" + key))
+	return hex.EncodeToString(sum[:24]), nil
+}
+
+func (sim *Simulator) ListSecrets(path string) ([]string, *VaultError) {
+	return sim.keys.ListSecrets(path)
+}
+
+// ReadSecrets returns the secrets written under the path, derived KBPKs aren't stored
+func (sim *Simulator) ReadSecrets(path string) (map[string]string, *VaultError) {
+	return sim.keys.ReadSecrets(path)
+}
+
+func (sim *Simulator) DeleteSecret(path, key string) *VaultError {
+	return sim.keys.DeleteSecret(path, key)
+}
+
+// unwrapFault fails an unwrap like a MAC mismatch at the configured rate
+func (sim *Simulator) unwrapFault() error {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	if sim.rand.Float64() < sim.config.MACFailureRate {
+		return &tr31.KeyBlockError{Message: tr31.BlockErrorMacNotMatched}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+	"github.com/stretchr/testify/require"
+)
+
+func simulatorMachine(t *testing.T, s Service) Vault {
+	t.Helper()
+	auth := Vault{VaultAddress: "http://simulator:8200", VaultToken: "simulator"}
+	m := NewMachine(auth)
+	m.Backend = MODE_SIMULATOR
+	require.NoError(t, s.CreateMachine(m))
+	return auth
+}
+
+func TestSimulator_ReadSecret(t *testing.T) {
+	sim := NewSimulator(SimulatorConfig{})
+
+	kbpk, err := sim.ReadSecret("secret/tr31", "kbkp")
+	require.Nil(t, err)
+	require.Len(t, kbpk, 48)
+	again, _ := sim.ReadSecret("secret/tr31", "kbkp")
+	require.Equal(t, kbpk, again)
+	other, _ := sim.ReadSecret("secret/tr31", "other")
+	require.NotEqual(t, kbpk, other)
+
+	require.Nil(t, sim.WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBB"))
+	written, _ := sim.ReadSecret("secret/tr31", "kbkp")
+	require.Equal(t, "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBB", written)
+
+	_, err = sim.ReadSecret("", "kbkp")
+	require.NotNil(t, err)
+}
+
+func TestSimulator_Faults(t *testing.T) {
+	sim := NewSimulator(SimulatorConfig{KeyNotFoundRate: 1, MACFailureRate: 1})
+	_, err := sim.ReadSecret("secret/tr31", "kbkp")
+	require.NotNil(t, err)
+	require.Contains(t, err.Message, "not found")
+	require.Equal(t, &tr31.KeyBlockError{Message: tr31.BlockErrorMacNotMatched}, sim.unwrapFault())
+
+	sim = NewSimulator(SimulatorConfig{Latency: 20 * time.Millisecond, Seed: 1})
+	start := time.Now()
+	_, err = sim.ReadSecret("secret/tr31", "kbkp")
+	require.Nil(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	require.NoError(t, sim.unwrapFault())
+
+	// the same seed injects the same faults
+	a := NewSimulator(SimulatorConfig{KeyNotFoundRate: 0.5, Seed: 42})
+	b := NewSimulator(SimulatorConfig{KeyNotFoundRate: 0.5, Seed: 42})
+	for i := 0; i < 20; i++ {
+		_, errA := a.ReadSecret("secret/tr31", "kbkp")
+		_, errB := b.ReadSecret("secret/tr31", "kbkp")
+		require.Equal(t, errA == nil, errB == nil)
+	}
+}
+
+func TestService_Simulator_Backend(t *testing.T) {
+	s := mockServiceInMock()
+	auth := simulatorMachine(t, s)
+	header := HeaderParams{VersionId: "D", KeyUsage: "D0", Algorithm: "A", ModeOfUse: "D", KeyVersion: "00", Exportability: "E"}
+
+	// no real key is needed, the KBPK is derived from the key reference
+	block, err := s.EncryptData(auth.VaultAddress, auth.VaultToken, "any/path", "any-key", "ccccccccccccccccdddddddddddddddd", header, time.Second)
+	require.NoError(t, err)
+	data, err := s.DecryptData(auth.VaultAddress, auth.VaultToken, "any/path", "any-key", block, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "ccccccccccccccccdddddddddddddddd", data)
+
+	// the service backend doesn't know the key
+	_, err = s.DecryptData("http://localhost:8200", "token", "any/path", "any-key", block, time.Second)
+	require.Error(t, err)
+
+	s.ConfigureSimulator(SimulatorConfig{MACFailureRate: 1})
+	_, err = s.DecryptData(auth.VaultAddress, auth.VaultToken, "any/path", "any-key", block, time.Second)
+	require.Equal(t, ERROR_CODE_INVALID_KEY_BLOCK, codeOf(err))
+	_, err = s.EncryptData(auth.VaultAddress, auth.VaultToken, "any/path", "any-key", "ccccccccccccccccdddddddddddddddd", header, time.Second)
+	require.NoError(t, err)
+
+	s.ConfigureSimulator(SimulatorConfig{KeyNotFoundRate: 1})
+	_, err = s.EncryptData(auth.VaultAddress, auth.VaultToken, "any/path", "any-key", "ccccccccccccccccdddddddddddddddd", header, time.Second)
+	require.Equal(t, ERROR_CODE_VAULT, codeOf(err))
+
+	unknown := NewMachine(mockVaultAuthTwo())
+	unknown.Backend = "HSM"
+	require.ErrorIs(t, s.CreateMachine(unknown), errInvalidMachine)
+}
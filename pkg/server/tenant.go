@@ -0,0 +1,280 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// ErrTenantUnauthorized is returned for requests without the API token of a tenant
+	ErrTenantUnauthorized = errors.New("missing or unknown tenant API token")
+	// ErrTenantForbidden is returned when a tenant calls a route reserved to admin tenants
+	ErrTenantForbidden = errors.New("route is reserved to admin tenants")
+	// ErrQuotaExceeded is returned when a tenant exceeds its request quota or key limits
+	ErrQuotaExceeded = errors.New("tenant quota exceeded")
+
+	errInvalidTenants = errors.New("invalid tenants")
+)
+
+// _tenantPublicPaths are answered without a tenant API token
+var _tenantPublicPaths = []string{"/ping", "/.well-known/jwks.json"}
+
+// Tenant is a business unit served by the deployment. Its API tokens are sent
+// as "Authorization: Bearer <token>", and it only sees the machines it created.
+type Tenant struct {
+	ID string `yaml:"id"`
+	// TokenHashes are the hex SHA-256 hashes of the tenant API tokens, see
+	// TenantTokenHash, so the tenants file holds no token
+	TokenHashes []string `yaml:"tokenHashes"`
+	// Admin tenants see every machine and may call /admin routes
+	Admin bool `yaml:"admin"`
+	// RequestsPerMinute caps the requests of the tenant, zero is unlimited
+	RequestsPerMinute int `yaml:"requestsPerMinute"`
+	// MaxMachines caps the machines of the tenant, zero is unlimited
+	MaxMachines int `yaml:"maxMachines"`
+	// MaxKeys caps the KBPKs referenced by the tenant machines and the TMKs
+	// provisioned under them, zero is unlimited
+	MaxKeys int `yaml:"maxKeys"`
+}
+
+// Tenants is the content of a tenants.yaml file, along with the request
+// counts of the tenants
+type Tenants struct {
+	Tenants []Tenant `yaml:"tenants"`
+
+	byID map[string]*Tenant
+
+	mu      sync.Mutex
+	windows map[string]*requestWindow
+}
+
+// requestWindow counts the requests of a tenant in the current minute
+type requestWindow struct {
+	start    time.Time
+	requests int
+}
+
+// ParseTenants parses and validates tenants in YAML, such as
+//
+//	tenants:
+//	  - id: acquiring
+//	    tokenHashes: ["9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"]
+//	    requestsPerMinute: 600
+//	    maxMachines: 20
+//	    maxKeys: 500
+func ParseTenants(data []byte) (*Tenants, error) {
+	tenants := &Tenants{}
+	if err := yaml.Unmarshal(data, tenants); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidTenants, err)
+	}
+	tenants.byID = make(map[string]*Tenant, len(tenants.Tenants))
+	tenants.windows = make(map[string]*requestWindow)
+	hashes := make(map[string]string)
+	for i := range tenants.Tenants {
+		tenant := &tenants.Tenants[i]
+		if tenant.ID == "" {
+			return nil, fmt.Errorf("%w: tenant %d needs an id", errInvalidTenants, i)
+		}
+		if _, exists := tenants.byID[tenant.ID]; exists {
+			return nil, fmt.Errorf("%w: tenant %s is declared twice", errInvalidTenants, tenant.ID)
+		}
+		if tenant.RequestsPerMinute < 0 || tenant.MaxMachines < 0 || tenant.MaxKeys < 0 {
+			return nil, fmt.Errorf("%w: tenant %s limits must not be negative", errInvalidTenants, tenant.ID)
+		}
+		for j, hash := range tenant.TokenHashes {
+			hash = strings.ToLower(hash)
+			if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+				return nil, fmt.Errorf("%w: tenant %s token hash %d must be 64 hexchars", errInvalidTenants, tenant.ID, j)
+			}
+			if owner, exists := hashes[hash]; exists {
+				return nil, fmt.Errorf("%w: tenants %s and %s share a token", errInvalidTenants, owner, tenant.ID)
+			}
+			hashes[hash] = tenant.ID
+			tenant.TokenHashes[j] = hash
+		}
+		tenants.byID[tenant.ID] = tenant
+	}
+	return tenants, nil
+}
+
+// LoadTenants reads a tenants file
+func LoadTenants(path string) (*Tenants, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTenants(data)
+}
+
+// TenantTokenHash returns the hex SHA-256 hash of an API token, as listed in
+// the tokenHashes of a tenant
+func TenantTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Tenant returns the tenant with the ID
+func (t *Tenants) Tenant(id string) (*Tenant, bool) {
+	if t == nil {
+		return nil, false
+	}
+	tenant, exists := t.byID[id]
+	return tenant, exists
+}
+
+// authenticate returns the tenant of the API token
+func (t *Tenants) authenticate(token string) (*Tenant, bool) {
+	if token == "" {
+		return nil, false
+	}
+	hash := []byte(TenantTokenHash(token))
+	for i := range t.Tenants {
+		for _, candidate := range t.Tenants[i].TokenHashes {
+			if subtle.ConstantTimeCompare(hash, []byte(candidate)) == 1 {
+				return &t.Tenants[i], true
+			}
+		}
+	}
+	return nil, false
+}
+
+// allow counts a request of the tenant and reports whether it is within the
+// tenant quota, along with the time the quota resets
+func (t *Tenants) allow(tenant *Tenant, now time.Time) (bool, time.Time) {
+	if tenant.RequestsPerMinute == 0 {
+		return true, now
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	window, exists := t.windows[tenant.ID]
+	if !exists || now.Sub(window.start) >= time.Minute {
+		window = &requestWindow{start: now}
+		t.windows[tenant.ID] = window
+	}
+	reset := window.start.Add(time.Minute)
+	if window.requests >= tenant.RequestsPerMinute {
+		return false, reset
+	}
+	window.requests++
+	return true, reset
+}
+
+// tenantKey stores the tenant of the request in its context, its type differs
+// from requestIDKey so the keys don't collide
+var tenantKey struct{ tenant string }
+
+// tenantFrom returns the tenant of the request, nil without tenants
+func tenantFrom(ctx context.Context) *Tenant {
+	tenant, _ := ctx.Value(tenantKey).(*Tenant)
+	return tenant
+}
+
+// scopedTenant returns the ID of the tenant the request is scoped to, empty
+// without tenants and for admin tenants, which see every machine
+func scopedTenant(ctx context.Context) string {
+	if tenant := tenantFrom(ctx); tenant != nil && !tenant.Admin {
+		return tenant.ID
+	}
+	return ""
+}
+
+// WithTenants requires the API token of a tenant on every route but /ping
+// and the JWK Set, enforces the tenant request quota and hides the machines and
+// jobs of other tenants. Pair it with Service.ConfigureTenants, which enforces the
+// machine and key limits.
+func WithTenants(tenants *Tenants) HandlerOption {
+	return func(cfg *handlerConfig) {
+		cfg.tenants = tenants
+	}
+}
+
+// tenantRequests authenticates the tenant of requests, counts them against
+// its quota and answers requests for machines and jobs of other tenants with a 404
+func tenantRequests(s Service, tenants *Tenants) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodOptions || slices.Contains(_tenantPublicPaths, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx := saveRequestIDIntoContext()(r.Context(), r)
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			tenant, ok := tenants.authenticate(strings.TrimSpace(token))
+			if !ok {
+				encodeError(ctx, ErrTenantUnauthorized, w)
+				return
+			}
+			if allowed, reset := tenants.allow(tenant, time.Now()); !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+				encodeError(ctx, fmt.Errorf("%w: tenant %s is limited to %d requests per minute", ErrQuotaExceeded, tenant.ID, tenant.RequestsPerMinute), w)
+				return
+			}
+			if !tenant.Admin {
+				if strings.HasPrefix(r.URL.Path, "/admin/") {
+					encodeError(ctx, ErrTenantForbidden, w)
+					return
+				}
+				// Machines and jobs of other tenants, and those which can't
+				// be found, are answered alike
+				if ik := mux.Vars(r)["ik"]; ik != "" {
+					if m, err := s.GetMachine(ik); err != nil || m.Tenant != tenant.ID {
+						encodeError(ctx, ErrNotFound, w)
+						return
+					}
+				}
+				if id := mux.Vars(r)["id"]; id != "" && strings.HasPrefix(r.URL.Path, "/jobs/") {
+					if j, err := s.GetJob(id); err != nil || j.Tenant != tenant.ID {
+						encodeError(ctx, ErrNotFound, w)
+						return
+					}
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey, tenant)))
+		})
+	}
+}
+
+// ConfigureTenants enforces the machine and key limits of the tenants when
+// their machines are created and terminals provisioned, nil lifts them
+func (s *service) ConfigureTenants(tenants *Tenants) {
+	s.tenants.Store(tenants)
+}
+
+// checkTenantLimits checks the tenant stays within its limits with machines
+// more machines and keys more keys
+func (s *service) checkTenantLimits(tenantID string, machines, keys int) error {
+	tenant, exists := s.tenants.Load().Tenant(tenantID)
+	if !exists || (tenant.MaxMachines == 0 && tenant.MaxKeys == 0) {
+		return nil
+	}
+	owned, count, err := s.store.FindMachines(MachineQuery{Tenant: tenantID})
+	if err != nil {
+		return err
+	}
+	if tenant.MaxMachines > 0 && count+machines > tenant.MaxMachines {
+		return fmt.Errorf("%w: tenant %s is limited to %d machines", ErrQuotaExceeded, tenantID, tenant.MaxMachines)
+	}
+	if tenant.MaxKeys > 0 {
+		for _, m := range owned {
+			keys += len(m.Keys) + len(s.store.FindTerminals(m.InitialKey))
+		}
+		if keys > tenant.MaxKeys {
+			return fmt.Errorf("%w: tenant %s is limited to %d keys", ErrQuotaExceeded, tenantID, tenant.MaxKeys)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTenants(t *testing.T) {
+	tenants, err := ParseTenants([]byte(`
+tenants:
+  - id: acquiring
+    tokenHashes: ["` + TenantTokenHash("acquiring-token") + `"]
+    requestsPerMinute: 2
+  - id: ops
+    tokenHashes: ["` + TenantTokenHash("ops-token") + `"]
+    admin: true
+`))
+	require.NoError(t, err)
+	tenant, ok := tenants.authenticate("acquiring-token")
+	require.True(t, ok)
+	require.Equal(t, "acquiring", tenant.ID)
+	_, ok = tenants.authenticate("other-token")
+	require.False(t, ok)
+	_, ok = tenants.Tenant("ops")
+	require.True(t, ok)
+
+	for _, data := range []string{
+		"tenants: [{tokenHashes: []}]",
+		"tenants: [{id: a}, {id: a}]",
+		"tenants: [{id: a, tokenHashes: [abc]}]",
+		"tenants: [{id: a, maxKeys: -1}]",
+		"tenants: [{id: a, tokenHashes: [" + TenantTokenHash("t") + "]}, {id: b, tokenHashes: [" + TenantTokenHash("t") + "]}]",
+	} {
+		_, err := ParseTenants([]byte(data))
+		require.ErrorIs(t, err, errInvalidTenants, data)
+	}
+}
+
+func TestTenants_http(t *testing.T) {
+	tenants, err := ParseTenants([]byte(`
+tenants:
+  - id: acquiring
+    tokenHashes: ["` + TenantTokenHash("acquiring-token") + `"]
+    maxMachines: 1
+  - id: issuing
+    tokenHashes: ["` + TenantTokenHash("issuing-token") + `"]
+    requestsPerMinute: 3
+  - id: ops
+    tokenHashes: ["` + TenantTokenHash("ops-token") + `"]
+    admin: true
+`))
+	require.NoError(t, err)
+	s := mockServiceInMock()
+	s.ConfigureTenants(tenants)
+	router := MakeHTTPHandler(s, WithTenants(tenants))
+
+	call := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		var data []byte
+		if body != nil {
+			data, err = json.Marshal(body)
+			require.NoError(t, err)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(data))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, call("GET", "/ping", "", nil).Code)
+	w := call("GET", "/machines", "", nil)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Contains(t, w.Body.String(), ERROR_CODE_UNAUTHORIZED)
+	require.Equal(t, http.StatusUnauthorized, call("GET", "/machines", "wrong-token", nil).Code)
+
+	w = call("POST", "/machine", "acquiring-token", mockVaultAuthOne())
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var created createMachineResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	require.Equal(t, "acquiring", created.Machine.Tenant)
+
+	// The machine limit of the tenant is enforced
+	w = call("POST", "/machine", "acquiring-token", Vault{VaultAddress: "http://localhost:8300", VaultToken: "other"})
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Contains(t, w.Body.String(), ERROR_CODE_QUOTA_EXCEEDED)
+
+	// Machines of other tenants are hidden
+	var listed getMachinesResponse
+	w = call("GET", "/machines", "issuing-token", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	require.Empty(t, listed.Machines)
+	require.Equal(t, http.StatusNotFound, call("GET", "/machine/"+created.IK, "issuing-token", nil).Code)
+	require.Equal(t, http.StatusForbidden, call("POST", "/admin/apply", "issuing-token", nil).Code)
+
+	// The request quota of the tenant is enforced
+	w = call("GET", "/machines", "issuing-token", nil)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	require.Equal(t, http.StatusOK, call("GET", "/machine/"+created.IK, "acquiring-token", nil).Code)
+	w = call("GET", "/machines", "ops-token", nil)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	require.Len(t, listed.Machines, 1)
+}
+
+func TestTenants_keyLimit(t *testing.T) {
+	tenants, err := ParseTenants([]byte(`
+tenants:
+  - id: acquiring
+    maxKeys: 2
+`))
+	require.NoError(t, err)
+	s := mockServiceInMock()
+	s.ConfigureTenants(tenants)
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+
+	m := NewMachine(mockVaultAuthOne())
+	m.Tenant = "acquiring"
+	m.Keys = []KeyReference{{KeyPath: "secret/tr31", KeyName: "kbkp"}}
+	require.NoError(t, s.CreateMachine(m))
+
+	_, err = s.ProvisionTerminal(m.InitialKey, "K0", "00A1B2C3D4E5F601")
+	require.NoError(t, err)
+	_, err = s.ProvisionTerminal(m.InitialKey, "K0", "00A1B2C3D4E5F602")
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+
+	other := NewMachine(Vault{VaultAddress: "http://localhost:8300", VaultToken: "other"})
+	other.Tenant = "acquiring"
+	other.Keys = []KeyReference{{KeyPath: "secret/tr31", KeyName: "kbkp"}}
+	require.ErrorIs(t, s.CreateMachine(other), ErrQuotaExceeded)
+}
+
+func TestTenants_jobs(t *testing.T) {
+	tenants, err := ParseTenants([]byte(`
+tenants:
+  - id: acquiring
+    tokenHashes: ["` + TenantTokenHash("acquiring-token") + `"]
+  - id: issuing
+    tokenHashes: ["` + TenantTokenHash("issuing-token") + `"]
+`))
+	require.NoError(t, err)
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	router := MakeHTTPHandler(s, WithTenants(tenants))
+
+	call := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+		req := httptest.NewRequest(method, path, bytes.NewReader(data))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// The tenant of the request owns the job, whatever its body says
+	w := call("POST", "/jobs", "acquiring-token", map[string]interface{}{
+		"Type":       JOB_BATCH_WRAP,
+		"VaultAddr":  mockVaultAuthOne().VaultAddress,
+		"VaultToken": mockVaultAuthOne().VaultToken,
+		"KeyPath":    "secret/tr31",
+		"KeyName":    "kbkp",
+		"Tenant":     "issuing",
+		"Items": []JobItem{{
+			EncryptKey: "ccccccccccccccccdddddddddddddddd",
+			Header:     HeaderParams{VersionId: "D", KeyUsage: "D0", Algorithm: "A", ModeOfUse: "D", KeyVersion: "00", Exportability: "E"},
+		}},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var created jobResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	require.Equal(t, "acquiring", created.Job.Tenant)
+	waitForJob(t, s, created.Job.ID)
+
+	// Jobs of other tenants are hidden, like unknown jobs
+	for _, path := range []string{"/jobs/" + created.Job.ID, "/jobs/" + created.Job.ID + "/result"} {
+		require.Equal(t, http.StatusOK, call("GET", path, "acquiring-token", nil).Code)
+		require.Equal(t, http.StatusNotFound, call("GET", path, "issuing-token", nil).Code)
+	}
+	require.Equal(t, http.StatusNotFound, call("DELETE", "/jobs/"+created.Job.ID, "issuing-token", nil).Code)
+	require.Equal(t, http.StatusNotFound, call("GET", "/jobs/missing", "acquiring-token", nil).Code)
+	require.Equal(t, http.StatusNotFound, call("GET", "/machine/missing", "acquiring-token", nil).Code)
+}
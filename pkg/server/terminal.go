@@ -0,0 +1,131 @@
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"time"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+var (
+	errInvalidTerminalID    = errors.New("Invalid Terminal ID.")
+	errInvalidTMKUsage      = errors.New("Invalid TMK Usage.")
+	errMachineHasNoKBPK     = errors.New("machine has no KBPK reference")
+	errNoTerminalKeyVersion = errors.New("machine policy allows no TMK key block version")
+)
+
+// Terminal is a terminal master key (TMK) provisioned for a terminal under a machine's KBPK
+type Terminal struct {
+	TerminalID string
+	// InitialKey identifies the machine whose KBPK wraps the TMK
+	InitialKey string
+	KeyUsage   string
+	KeyBlock   string
+	// KCV is the key check value of the TMK
+	KCV       string
+	CreatedAt time.Time
+}
+
+// ProvisionTerminal generates a TMK for the terminal, wraps it under the first KBPK
+// referenced by the machine and stores the association. The terminal ID, which
+// must be hex, is carried in the IK block of AES key blocks and in the KS block
+// of TDES key blocks.
+func (s *service) ProvisionTerminal(ik, tmkUsage, terminalID string) (_ *Terminal, err error) {
+	defer func() { s.audit(AUDIT_OPERATION_PROVISION_TERMINAL, ik+"/"+terminalID, err) }()
+	if terminalID == "" {
+		return nil, errInvalidTerminalID
+	}
+	if tmkUsage == "" {
+		return nil, errInvalidTMKUsage
+	}
+	m, err := s.GetMachine(ik)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Keys) == 0 {
+		return nil, errMachineHasNoKBPK
+	}
+	if m.Tenant != "" {
+		s.tenantMu.Lock()
+		defer s.tenantMu.Unlock()
+		if err := s.checkTenantLimits(m.Tenant, 0, 1); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := s.store.FindTerminal(ik, terminalID); err == nil {
+		return nil, ErrAlreadyExists
+	}
+
+	versionID, algorithm, idBlock := tr31.TR31_VERSION_D, tr31.ENC_ALGORITHM_AES, "IK"
+	if !m.AllowsVersion(versionID) {
+		versionID, algorithm, idBlock = tr31.TR31_VERSION_B, tr31.ENC_ALGORITHM_TRIPLE_DES, "KS"
+	}
+	if !m.AllowsVersion(versionID) {
+		return nil, errNoTerminalKeyVersion
+	}
+
+	header, err := tr31.NewHeader(versionID, tmkUsage, algorithm, "B", "00", "N")
+	if err != nil {
+		return nil, err
+	}
+	if err := header.Blocks.Set(idBlock, terminalID); err != nil {
+		return nil, err
+	}
+	if err := s.blockPolicy.Load().Apply(header, s.now()); err != nil {
+		return nil, err
+	}
+
+	sm, err := s.scopedSecretManagerOf(m)
+	if err != nil {
+		return nil, err
+	}
+	kbpk, err := s.readKBPKFor(sm, UnifiedParams{
+		VaultAddr:  m.vaultAuth.VaultAddress,
+		VaultToken: m.vaultAuth.VaultToken,
+		KeyPath:    m.Keys[0].KeyPath,
+		KeyName:    m.Keys[0].KeyName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(kbpk)
+
+	tmk := make([]byte, 16)
+	if _, err := rand.Read(tmk); err != nil {
+		return nil, err
+	}
+	kcv, err := tr31.KeyCheckValue(tmk, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	kblock, err := tr31.New(kbpk, tr31.WithHeader(header))
+	if err != nil {
+		return nil, err
+	}
+	keyBlock, err := kblock.Wrap(tmk, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.logWrapped(keyBlock); err != nil {
+		return nil, err
+	}
+
+	t := &Terminal{
+		TerminalID: terminalID,
+		InitialKey: ik,
+		KeyUsage:   tmkUsage,
+		KeyBlock:   keyBlock,
+		KCV:        kcv,
+		CreatedAt:  s.now(),
+	}
+	if err := s.store.StoreTerminal(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// GetTerminal returns the TMK provisioned for the terminal under the machine
+func (s *service) GetTerminal(ik, terminalID string) (*Terminal, error) {
+	return s.store.FindTerminal(ik, terminalID)
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+	"github.com/stretchr/testify/require"
+)
+
+func mockTerminalMachine(t *testing.T, s Service, allowedVersions ...string) *Machine {
+	t.Helper()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	m := NewMachine(mockVaultAuthOne())
+	m.AllowedVersions = allowedVersions
+	m.Keys = []KeyReference{{KeyPath: "secret/tr31", KeyName: "kbkp"}}
+	require.NoError(t, s.CreateMachine(m))
+	return m
+}
+
+func TestService_ProvisionTerminal(t *testing.T) {
+	tests := []struct {
+		name            string
+		allowedVersions []string
+		versionID       string
+		idBlock         string
+	}{
+		{"AES key block", nil, "D", "IK"},
+		{"TDES key block", []string{"B"}, "B", "KS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := mockServiceInMock()
+			m := mockTerminalMachine(t, s, tt.allowedVersions...)
+
+			terminal, err := s.ProvisionTerminal(m.InitialKey, "K0", "00A1B2C3D4E5F601")
+			require.NoError(t, err)
+			require.Equal(t, tt.versionID, terminal.KeyBlock[:1])
+			require.Len(t, terminal.KCV, 6)
+
+			// The key block carries the terminal ID and unwraps to a key matching the KCV
+			kbpk, _ := hex.DecodeString("AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+			kblock, err := tr31.NewKeyBlock(kbpk, nil)
+			require.NoError(t, err)
+			tmk, err := kblock.Unwrap(terminal.KeyBlock)
+			require.NoError(t, err)
+			id, err := kblock.GetHeader().Blocks.Get(tt.idBlock)
+			require.NoError(t, err)
+			require.Equal(t, "00A1B2C3D4E5F601", id)
+			kcv, err := tr31.KeyCheckValue(tmk, kblock.GetHeader().Algorithm)
+			require.NoError(t, err)
+			require.Equal(t, terminal.KCV, kcv)
+
+			found, err := s.GetTerminal(m.InitialKey, "00A1B2C3D4E5F601")
+			require.NoError(t, err)
+			require.Equal(t, terminal, found)
+
+			_, err = s.ProvisionTerminal(m.InitialKey, "K0", "00A1B2C3D4E5F601")
+			require.Equal(t, ErrAlreadyExists, err)
+		})
+	}
+}
+
+func TestService_ProvisionTerminal_Errors(t *testing.T) {
+	s := mockServiceInMock()
+	m := mockTerminalMachine(t, s)
+
+	_, err := s.ProvisionTerminal(m.InitialKey, "K0", "")
+	require.Equal(t, errInvalidTerminalID, err)
+	_, err = s.ProvisionTerminal(m.InitialKey, "", "00A1")
+	require.Equal(t, errInvalidTMKUsage, err)
+	_, err = s.ProvisionTerminal("missing", "K0", "00A1")
+	require.Equal(t, ErrNotFound, err)
+	_, err = s.ProvisionTerminal(m.InitialKey, "K0", "TERMINAL-1")
+	require.IsType(t, &tr31.HeaderError{}, err)
+	_, err = s.ProvisionTerminal(m.InitialKey, "K", "00A1")
+	require.IsType(t, &tr31.HeaderError{}, err)
+
+	noKeys := NewMachine(Vault{VaultAddress: "http://other:8200", VaultToken: "other"})
+	require.NoError(t, s.CreateMachine(noKeys))
+	_, err = s.ProvisionTerminal(noKeys.InitialKey, "K0", "00A1")
+	require.Equal(t, errMachineHasNoKBPK, err)
+
+	_, err = s.GetTerminal(m.InitialKey, "00A1")
+	require.Equal(t, ErrNotFound, err)
+}
+
+func TestRouting_terminals(t *testing.T) {
+	s := mockServiceInMock()
+	m := mockTerminalMachine(t, s)
+	router := MakeHTTPHandler(s)
+
+	body, err := json.Marshal(map[string]string{"KeyUsage": "K0", "TerminalID": "00A1B2C3"})
+	require.NoError(t, err)
+	req := httptest.NewRequest("POST", "/machine/"+m.InitialKey+"/terminals", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var created terminalResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	require.Equal(t, "00A1B2C3", created.Terminal.TerminalID)
+
+	req = httptest.NewRequest("GET", "/machine/"+m.InitialKey+"/terminals/00A1B2C3", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var found terminalResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &found))
+	require.Equal(t, created.Terminal.KCV, found.Terminal.KCV)
+
+	req = httptest.NewRequest("GET", "/machine/"+m.InitialKey+"/terminals/FFFF", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+// VaultTransitImporter imports keys into a Vault Transit secrets engine as
+// non-exportable keys, using the BYOK flow: the key is wrapped with AES-KWP
+// (RFC 5649) under an ephemeral AES-256 key, itself encrypted with RSA-OAEP
+// under the engine's wrapping key. AES-128 and AES-256 keys are imported as
+// aes128-gcm96 and aes256-gcm96 keys and HMAC keys as hmac keys.
+type VaultTransitImporter struct {
+	client *api.Client
+	mount  string
+}
+
+// NewVaultTransitImporter returns an importer into the Transit engine mounted
+// at mount ("transit" when empty) of the Vault at address
+func NewVaultTransitImporter(address, token, mount string) (*VaultTransitImporter, error) {
+	client, vErr := createVaultClient(address, token, 10)
+	if vErr != nil {
+		return nil, vErr
+	}
+	if mount == "" {
+		mount = "transit"
+	}
+	return &VaultTransitImporter{client: client, mount: strings.Trim(mount, "/")}, nil
+}
+
+// ImportKey imports key as the Transit key name and returns its path
+func (v *VaultTransitImporter) ImportKey(name string, key []byte, header *tr31.Header) (string, error) {
+	keyType, err := transitKeyType(key, header)
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := v.client.Logical().Read(v.mount + "/wrapping_key")
+	if err != nil {
+		return "", err
+	}
+	if secret == nil {
+		return "", errors.New("transit wrapping key not found")
+	}
+	publicKey, _ := secret.Data["public_key"].(string)
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil {
+		return "", errors.New("transit wrapping key is not PEM encoded")
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	wrappingKey, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return "", fmt.Errorf("transit wrapping key is a %T, not an RSA key", parsed)
+	}
+
+	ephemeral := make([]byte, 32)
+	if _, err := rand.Read(ephemeral); err != nil {
+		return "", err
+	}
+	defer wipe(ephemeral)
+	wrappedKey, err := wrapKeyWithPadding(ephemeral, key)
+	if err != nil {
+		return "", err
+	}
+	wrappedEphemeral, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, wrappingKey, ephemeral, nil)
+	if err != nil {
+		return "", err
+	}
+
+	path := v.mount + "/keys/" + name
+	_, err = v.client.Logical().Write(path+"/import", map[string]interface{}{
+		"ciphertext":    base64.StdEncoding.EncodeToString(append(wrappedEphemeral, wrappedKey...)),
+		"hash_function": "SHA256",
+		"type":          keyType,
+		"exportable":    false,
+	})
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// transitKeyType returns the Transit key type a key is imported as
+func transitKeyType(key []byte, header *tr31.Header) (string, error) {
+	switch {
+	case header.Algorithm == tr31.ENC_ALGORITHM_AES && len(key) == 16:
+		return "aes128-gcm96", nil
+	case header.Algorithm == tr31.ENC_ALGORITHM_AES && len(key) == 32:
+		return "aes256-gcm96", nil
+	case header.Algorithm == "H": // HMAC
+		return "hmac", nil
+	}
+	return "", fmt.Errorf("transit doesn't support %d byte keys of algorithm %s", len(key), header.Algorithm)
+}
+
+// wrapKeyWithPadding wraps key under kek with the AES key wrap with padding
+// algorithm of RFC 5649
+func wrapKeyWithPadding(kek, key []byte) ([]byte, error) {
+	cipher, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, errors.New("no key to wrap")
+	}
+
+	n := (len(key) + 7) / 8
+	var a [8]byte
+	binary.BigEndian.PutUint32(a[:4], 0xA65959A6)
+	binary.BigEndian.PutUint32(a[4:], uint32(len(key)))
+	r := make([]byte, n*8)
+	copy(r, key)
+	defer wipe(r)
+
+	buf := make([]byte, 16)
+	if n == 1 {
+		copy(buf, a[:])
+		copy(buf[8:], r)
+		cipher.Encrypt(buf, buf)
+		return buf, nil
+	}
+	for j := 0; j < 6; j++ {
+		for i := 0; i < n; i++ {
+			copy(buf, a[:])
+			copy(buf[8:], r[i*8:])
+			cipher.Encrypt(buf, buf)
+			binary.BigEndian.PutUint64(a[:], binary.BigEndian.Uint64(buf[:8])^uint64(n*j+i+1))
+			copy(r[i*8:], buf[8:])
+		}
+	}
+	return append(a[:], r...), nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrapKeyWithPadding(t *testing.T) {
+	// RFC 5649 section 6
+	kek, _ := hex.DecodeString("5840df6e29b02af1ab493b705bf16ea1ae8338f4dcc176a8")
+	tests := []struct {
+		key, wrapped string
+	}{
+		{"c37b7e6492584340bed12207808941155068f738", "138bdeaa9b8fa7fc61f97742e72248ee5ae6ae5360d1ae6a5f54f373fa543b6a"},
+		{"466f7250617369", "afbeb0f07dfbf5419200f2ccb50bb24f"},
+	}
+	for _, tt := range tests {
+		key, _ := hex.DecodeString(tt.key)
+		wrapped, err := wrapKeyWithPadding(kek, key)
+		require.NoError(t, err)
+		require.Equal(t, tt.wrapped, hex.EncodeToString(wrapped))
+	}
+}
+
+func TestVaultTransitImporter(t *testing.T) {
+	wrappingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&wrappingKey.PublicKey)
+	require.NoError(t, err)
+
+	key, _ := hex.DecodeString("00112233445566778899aabbccddeeff")
+	var imported map[string]interface{}
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/v1/transit/wrapping_key":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]string{"public_key": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))},
+			})
+		case r.Method == "PUT" && r.URL.Path == "/v1/transit/keys/pin-key/import":
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&imported))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer vault.Close()
+
+	importer, err := NewVaultTransitImporter(vault.URL, "token", "")
+	require.NoError(t, err)
+	header, err := tr31.NewHeader(tr31.TR31_VERSION_D, "D0", tr31.ENC_ALGORITHM_AES, "B", "00", "N")
+	require.NoError(t, err)
+	handle, err := importer.ImportKey("pin-key", key, header)
+	require.NoError(t, err)
+	require.Equal(t, "transit/keys/pin-key", handle)
+	require.Equal(t, "aes128-gcm96", imported["type"])
+	require.Equal(t, false, imported["exportable"])
+
+	// Vault unwraps the ephemeral key with its wrapping key and the key with the ephemeral key
+	ciphertext, err := base64.StdEncoding.DecodeString(imported["ciphertext"].(string))
+	require.NoError(t, err)
+	ephemeral, err := rsa.DecryptOAEP(sha256.New(), nil, wrappingKey, ciphertext[:256], nil)
+	require.NoError(t, err)
+	wrapped, err := wrapKeyWithPadding(ephemeral, key)
+	require.NoError(t, err)
+	require.Equal(t, wrapped, ciphertext[256:])
+
+	header.Algorithm = tr31.ENC_ALGORITHM_TRIPLE_DES
+	_, err = importer.ImportKey("pin-key", key, header)
+	require.ErrorContains(t, err, "transit doesn't support")
+}
@@ -0,0 +1,370 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moov-io/base/log"
+)
+
+var (
+	errNoTransparencySigner = errors.New("transparency log needs a signing key")
+	errInvalidTransparency  = errors.New("invalid transparency log")
+)
+
+// TreeHead is the size and root hash of the transparency log at a time
+type TreeHead struct {
+	TreeSize  int       `json:"treeSize"`
+	RootHash  string    `json:"rootHash"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// SignedTreeHead is a tree head signed by the service. Signature is a detached
+// JWS over the JSON encoding of the TreeHead, checked with VerifyTreeHead.
+type SignedTreeHead struct {
+	TreeHead
+	Signature string `json:"signature"`
+}
+
+// InclusionProof proves the key block with the hash is the leaf at LeafIndex
+// of the tree of the signed tree head
+type InclusionProof struct {
+	Hash      string         `json:"hash"`
+	LeafIndex int            `json:"leafIndex"`
+	AuditPath []string       `json:"auditPath"`
+	TreeHead  SignedTreeHead `json:"treeHead"`
+}
+
+// ConsistencyProof proves the tree of First leaves is a prefix of the tree of Second leaves
+type ConsistencyProof struct {
+	First  int      `json:"first"`
+	Second int      `json:"second"`
+	Path   []string `json:"path"`
+}
+
+// TransparencyLog is an append-only log of the SHA-256 hashes of the key
+// blocks wrapped by the service, kept in a Merkle tree as Certificate
+// Transparency logs are (RFC 6962). A tree head is signed every interval, and
+// inclusion proofs are given against the latest one, so an institution holding
+// a key block can prove it was produced by this service, and an auditor reading
+// every entry can prove a key block wasn't.
+type TransparencyLog struct {
+	signer   *ResponseSigner
+	path     string
+	interval time.Duration
+	logger   log.Logger
+	clock    Clock
+
+	mu     sync.RWMutex
+	file   *os.File
+	leaves [][]byte
+	hashes []string
+	index  map[string]int
+	head   SignedTreeHead
+}
+
+// NewTransparencyLog opens the log kept at path, creating it if needed, and
+// signs a first tree head with signer. Entries are appended to the file as hex
+// SHA-256 hashes, one per line. An empty path keeps the log in memory only.
+func NewTransparencyLog(path string, signer *ResponseSigner, interval time.Duration, logger log.Logger) (*TransparencyLog, error) {
+	if signer == nil {
+		return nil, errNoTransparencySigner
+	}
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	l := &TransparencyLog{
+		signer:   signer,
+		path:     path,
+		interval: interval,
+		logger:   logger,
+		clock:    SystemClock,
+		index:    make(map[string]int),
+	}
+	if path != "" {
+		if err := l.load(); err != nil {
+			return nil, err
+		}
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		l.file = file
+	}
+	if _, err := l.SignTreeHead(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// load reads the entries of the log file
+func (l *TransparencyLog) load() error {
+	file, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		hash, err := decodeBlockHash(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%w: %s line %d: %v", errInvalidTransparency, l.path, line, err)
+		}
+		l.add(hash)
+	}
+	return scanner.Err()
+}
+
+// Close closes the log file
+func (l *TransparencyLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// BlockHash returns the hex SHA-256 of a key block, its entry in the log
+func BlockHash(keyBlock string) string {
+	sum := sha256.Sum256([]byte(keyBlock))
+	return hex.EncodeToString(sum[:])
+}
+
+// decodeBlockHash parses a hex SHA-256 hash
+func decodeBlockHash(hash string) ([]byte, error) {
+	data, err := hex.DecodeString(strings.TrimSpace(hash))
+	if err != nil || len(data) != sha256.Size {
+		return nil, fmt.Errorf("%w hash must be 64 hexchars.", errMalformedField)
+	}
+	return data, nil
+}
+
+// Append adds the hash of the key block to the log. The hash is written to
+// the log file before Append returns.
+func (l *TransparencyLog) Append(keyBlock string) error {
+	sum := sha256.Sum256([]byte(keyBlock))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		if _, err := fmt.Fprintln(l.file, hex.EncodeToString(sum[:])); err != nil {
+			return fmt.Errorf("appending to transparency log: %w", err)
+		}
+		if err := l.file.Sync(); err != nil {
+			return fmt.Errorf("appending to transparency log: %w", err)
+		}
+	}
+	l.add(sum[:])
+	return nil
+}
+
+func (l *TransparencyLog) add(hash []byte) {
+	encoded := hex.EncodeToString(hash)
+	// The same key block wrapped twice is proven by its first entry
+	if _, exists := l.index[encoded]; !exists {
+		l.index[encoded] = len(l.leaves)
+	}
+	l.leaves = append(l.leaves, merkleLeafHash(hash))
+	l.hashes = append(l.hashes, encoded)
+}
+
+// SignTreeHead signs the current size and root hash of the log, which
+// becomes the tree head proofs are given against
+func (l *TransparencyLog) SignTreeHead() (SignedTreeHead, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	head := TreeHead{
+		TreeSize:  len(l.leaves),
+		RootHash:  hex.EncodeToString(merkleRoot(l.leaves)),
+		Timestamp: l.clock.Now().UTC(),
+	}
+	body, err := json.Marshal(head)
+	if err != nil {
+		return SignedTreeHead{}, err
+	}
+	signature, err := l.signer.Sign(body)
+	if err != nil {
+		return SignedTreeHead{}, err
+	}
+	l.head = SignedTreeHead{TreeHead: head, Signature: signature}
+	return l.head, nil
+}
+
+// SetClock changes the clock timestamping the tree heads signed from now on,
+// nil restores SystemClock
+func (l *TransparencyLog) SetClock(c Clock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clock = clockOrSystem(c)
+}
+
+// Run signs a tree head every interval, until ctx is cancelled
+func (l *TransparencyLog) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := l.SignTreeHead(); err != nil {
+				l.logger.LogErrorf("signing transparency log tree head: %v", err)
+			}
+		}
+	}
+}
+
+// TreeHead returns the latest signed tree head
+func (l *TransparencyLog) TreeHead() SignedTreeHead {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.head
+}
+
+// InclusionProof returns the proof the key block with the hex SHA-256 hash is
+// in the tree of the latest signed tree head. ErrNotFound is returned for
+// key blocks the log doesn't hold, or appended after the tree head was signed.
+func (l *TransparencyLog) InclusionProof(hash string) (*InclusionProof, error) {
+	decoded, err := decodeBlockHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	encoded := hex.EncodeToString(decoded)
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	size := l.head.TreeSize
+	index, exists := l.index[encoded]
+	if !exists || index >= size {
+		return nil, fmt.Errorf("%w: no key block with hash %s in the tree of size %d", ErrNotFound, encoded, size)
+	}
+	return &InclusionProof{
+		Hash:      encoded,
+		LeafIndex: index,
+		AuditPath: encodeHashes(merkleInclusionPath(index, l.leaves[:size])),
+		TreeHead:  l.head,
+	}, nil
+}
+
+// ConsistencyProof returns the proof the tree of first leaves is a prefix of
+// the tree of second leaves, which can't exceed the latest signed tree head
+func (l *TransparencyLog) ConsistencyProof(first, second int) (*ConsistencyProof, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if first < 0 || first > second || second > l.head.TreeSize {
+		return nil, fmt.Errorf("%w first and second must be tree sizes, with first <= second <= %d.", errMalformedField, l.head.TreeSize)
+	}
+	return &ConsistencyProof{
+		First:  first,
+		Second: second,
+		Path:   encodeHashes(merkleConsistencyPath(first, l.leaves[:second])),
+	}, nil
+}
+
+// Entries returns the hex SHA-256 hashes of the entries from start up to end,
+// capped to the latest signed tree head, so auditors can rebuild the tree
+func (l *TransparencyLog) Entries(start, end int) ([]string, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	end = min(end, l.head.TreeSize)
+	if start < 0 || start > end {
+		return nil, fmt.Errorf("%w start must be from 0 to end, within the tree size %d.", errMalformedField, l.head.TreeSize)
+	}
+	return append([]string{}, l.hashes[start:end]...), nil
+}
+
+func encodeHashes(hashes [][]byte) []string {
+	encoded := make([]string, len(hashes))
+	for i, hash := range hashes {
+		encoded[i] = hex.EncodeToString(hash)
+	}
+	return encoded
+}
+
+// VerifyTreeHead checks the signature of the tree head was made by key, the
+// public key of the service's signer
+func VerifyTreeHead(head SignedTreeHead, key crypto.PublicKey) error {
+	body, err := json.Marshal(head.TreeHead)
+	if err != nil {
+		return err
+	}
+	return VerifyResponse(body, head.Signature, key)
+}
+
+// VerifyInclusionProof checks the tree head of the proof was signed by key,
+// the public key of the service's signer, and the proof places the key block
+// in its tree
+func VerifyInclusionProof(keyBlock string, proof InclusionProof, key crypto.PublicKey) error {
+	if err := VerifyTreeHead(proof.TreeHead, key); err != nil {
+		return err
+	}
+	head := proof.TreeHead
+	root, err := hex.DecodeString(head.RootHash)
+	if err != nil {
+		return fmt.Errorf("%w: root hash: %v", errInvalidTransparency, err)
+	}
+	path, err := decodeHashes(proof.AuditPath)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(keyBlock))
+	if !VerifyInclusion(merkleLeafHash(sum[:]), proof.LeafIndex, head.TreeSize, path, root) {
+		return fmt.Errorf("%w: key block is not in the tree of size %d", errInvalidTransparency, head.TreeSize)
+	}
+	return nil
+}
+
+func decodeHashes(hashes []string) ([][]byte, error) {
+	decoded := make([][]byte, len(hashes))
+	for i, hash := range hashes {
+		data, err := hex.DecodeString(hash)
+		if err != nil {
+			return nil, fmt.Errorf("%w: proof hash %d: %v", errInvalidTransparency, i, err)
+		}
+		decoded[i] = data
+	}
+	return decoded, nil
+}
+
+// WithTransparencyLog serves the signed tree heads, proofs and entries of
+// the log from /transparency
+func WithTransparencyLog(l *TransparencyLog) HandlerOption {
+	return func(cfg *handlerConfig) {
+		cfg.transparencyLog = l
+	}
+}
+
+// ConfigureTransparencyLog appends every key block the service wraps to the
+// log, nil stops logging them
+func (s *service) ConfigureTransparencyLog(l *TransparencyLog) {
+	s.transparencyLog.Store(l)
+}
+
+// logWrapped appends a key block the service wrapped to the transparency log.
+// The key block isn't returned when it can't be logged.
+func (s *service) logWrapped(keyBlock string) error {
+	if l := s.transparencyLog.Load(); l != nil {
+		return l.Append(keyBlock)
+	}
+	return nil
+}
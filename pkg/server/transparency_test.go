@@ -0,0 +1,176 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMerkleProofs(t *testing.T) {
+	var leaves [][]byte
+	for n := 1; n <= 33; n++ {
+		leaves = append(leaves, merkleLeafHash([]byte(fmt.Sprint(n))))
+		root := merkleRoot(leaves)
+		for m := 0; m < n; m++ {
+			path := merkleInclusionPath(m, leaves)
+			require.True(t, VerifyInclusion(leaves[m], m, n, path, root), "leaf %d of %d", m, n)
+			if n > 1 {
+				require.False(t, VerifyInclusion(leaves[(m+1)%n], m, n, path, root), "leaf %d of %d", m, n)
+			}
+		}
+		for m := 1; m <= n; m++ {
+			path := merkleConsistencyPath(m, leaves)
+			require.True(t, VerifyConsistency(m, n, path, merkleRoot(leaves[:m]), root), "tree %d of %d", m, n)
+			if m < n {
+				require.False(t, VerifyConsistency(m, n, path, merkleRoot(leaves[1:m+1]), root), "tree %d of %d", m, n)
+			}
+		}
+	}
+
+	// RFC 6962 hashes the empty tree as the hash of the empty string
+	require.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", hex.EncodeToString(merkleRoot(nil)))
+}
+
+func newTransparencySigner(t *testing.T) (*ResponseSigner, ed25519.PublicKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := NewResponseSigner(priv)
+	require.NoError(t, err)
+	return signer, pub
+}
+
+func TestTransparencyLog(t *testing.T) {
+	signer, pub := newTransparencySigner(t)
+	path := filepath.Join(t.TempDir(), "transparency.log")
+	l, err := NewTransparencyLog(path, signer, 0, nil)
+	require.NoError(t, err)
+
+	head := l.TreeHead()
+	require.Equal(t, 0, head.TreeSize)
+	require.NoError(t, VerifyTreeHead(head, pub))
+
+	blocks := []string{"D0112P0AE00E0000block1", "D0112P0AE00E0000block2", "D0112P0AE00E0000block3"}
+	for _, block := range blocks {
+		require.NoError(t, l.Append(block))
+	}
+
+	// Entries are proven once a tree head covers them
+	_, err = l.InclusionProof(BlockHash(blocks[0]))
+	require.ErrorIs(t, err, ErrNotFound)
+	head, err = l.SignTreeHead()
+	require.NoError(t, err)
+	require.Equal(t, 3, head.TreeSize)
+
+	for i, block := range blocks {
+		proof, err := l.InclusionProof(BlockHash(block))
+		require.NoError(t, err)
+		require.Equal(t, i, proof.LeafIndex)
+		require.NoError(t, VerifyInclusionProof(block, *proof, pub))
+		require.Error(t, VerifyInclusionProof("D0112P0AE00E0000forged", *proof, pub))
+	}
+	_, err = l.InclusionProof(BlockHash("D0112P0AE00E0000other"))
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = l.InclusionProof("abc")
+	require.ErrorIs(t, err, errMalformedField)
+
+	// A tampered tree head fails its signature
+	proof, _ := l.InclusionProof(BlockHash(blocks[1]))
+	proof.TreeHead.TreeSize = 2
+	require.Error(t, VerifyInclusionProof(blocks[1], *proof, pub))
+
+	entries, err := l.Entries(1, 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{BlockHash(blocks[1]), BlockHash(blocks[2])}, entries)
+	_, err = l.Entries(4, 10)
+	require.ErrorIs(t, err, errMalformedField)
+
+	// The log file is reloaded, with the same root
+	require.NoError(t, l.Close())
+	reopened, err := NewTransparencyLog(path, signer, 0, nil)
+	require.NoError(t, err)
+	defer reopened.Close()
+	require.Equal(t, head.RootHash, reopened.TreeHead().RootHash)
+	require.NoError(t, reopened.Append("D0112P0AE00E0000block4"))
+	grown, err := reopened.SignTreeHead()
+	require.NoError(t, err)
+
+	consistency, err := reopened.ConsistencyProof(3, 4)
+	require.NoError(t, err)
+	path3, _ := decodeHashes(consistency.Path)
+	root3, _ := hex.DecodeString(head.RootHash)
+	root4, _ := hex.DecodeString(grown.RootHash)
+	require.True(t, VerifyConsistency(3, 4, path3, root3, root4))
+	_, err = reopened.ConsistencyProof(3, 5)
+	require.ErrorIs(t, err, errMalformedField)
+
+	require.NoError(t, os.WriteFile(path, []byte("not a hash\n"), 0600))
+	_, err = NewTransparencyLog(path, signer, 0, nil)
+	require.ErrorIs(t, err, errInvalidTransparency)
+
+	_, err = NewTransparencyLog("", nil, 0, nil)
+	require.ErrorIs(t, err, errNoTransparencySigner)
+}
+
+func TestTransparencyLog_service(t *testing.T) {
+	signer, pub := newTransparencySigner(t)
+	l, err := NewTransparencyLog("", signer, 0, nil)
+	require.NoError(t, err)
+
+	s := mockServiceInMock()
+	s.GetSecretManager().WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC")
+	s.ConfigureTransparencyLog(l)
+	auth := mockVaultAuthOne()
+	header := HeaderParams{VersionId: "D", KeyUsage: "D0", Algorithm: "A", ModeOfUse: "D", KeyVersion: "00", Exportability: "E"}
+	keyBlock, err := s.EncryptData(auth.VaultAddress, auth.VaultToken, "secret/tr31", "kbkp", "ccccccccccccccccdddddddddddddddd", header, 10)
+	require.NoError(t, err)
+	_, err = l.SignTreeHead()
+	require.NoError(t, err)
+
+	router := MakeHTTPHandler(s, WithTransparencyLog(l))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/transparency/inclusion_proof?hash="+BlockHash(keyBlock), nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Proof InclusionProof `json:"proof"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.NoError(t, VerifyInclusionProof(keyBlock, resp.Proof, pub))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/transparency/inclusion_proof?hash="+BlockHash("other"), nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/transparency/tree_head", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var headResp struct {
+		TreeHead SignedTreeHead `json:"treeHead"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&headResp))
+	require.Equal(t, 1, headResp.TreeHead.TreeSize)
+	require.NoError(t, VerifyTreeHead(headResp.TreeHead, pub))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/transparency/entries", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), BlockHash(keyBlock))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/transparency/consistency_proof?first=0&second=1", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// Nothing is served without the option
+	w = httptest.NewRecorder()
+	MakeHTTPHandler(s).ServeHTTP(w, httptest.NewRequest("GET", "/transparency/tree_head", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
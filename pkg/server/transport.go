@@ -0,0 +1,157 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+var errInvalidTransportKey = errors.New("Invalid Transport Key.")
+
+// TransportKey is a public key registered under a machine that decrypted keys
+// are encrypted under instead of being returned in clear. RSA keys encrypt with
+// RSA-OAEP-256 and EC keys with ECDH-ES+A256KW (ECIES), the key itself is
+// encrypted with A256GCM in a compact JWE.
+type TransportKey struct {
+	// KeyID is the RFC 7638 thumbprint of the public key
+	KeyID string
+	// InitialKey identifies the machine the transport key is registered under
+	InitialKey string
+	Algorithm  string
+	// PublicKey is the PEM encoded PKIX public key
+	PublicKey string
+	CreatedAt time.Time
+
+	publicKey crypto.PublicKey
+}
+
+// RegisterTransportKey registers a PEM encoded RSA (at least 2048 bits) or EC
+// (P-256, P-384 or P-521) public key under the machine
+func (s *service) RegisterTransportKey(ik, publicKey string) (_ *TransportKey, err error) {
+	defer func() { s.audit(AUDIT_OPERATION_REGISTER_TRANSPORT, ik, err) }()
+	if _, err := s.GetMachine(ik); err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM data found", errInvalidTransportKey)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidTransportKey, err)
+	}
+
+	var algorithm jose.KeyAlgorithm
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("%w: RSA keys must be at least 2048 bits", errInvalidTransportKey)
+		}
+		algorithm = jose.RSA_OAEP_256
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() && k.Curve != elliptic.P384() && k.Curve != elliptic.P521() {
+			return nil, fmt.Errorf("%w: unsupported curve %s", errInvalidTransportKey, k.Curve.Params().Name)
+		}
+		algorithm = jose.ECDH_ES_A256KW
+	default:
+		return nil, fmt.Errorf("%w: unsupported key type %T", errInvalidTransportKey, key)
+	}
+
+	thumbprint, err := (&jose.JSONWebKey{Key: key}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidTransportKey, err)
+	}
+	tk := &TransportKey{
+		KeyID:      base64.RawURLEncoding.EncodeToString(thumbprint),
+		InitialKey: ik,
+		Algorithm:  string(algorithm),
+		PublicKey:  string(pem.EncodeToMemory(block)),
+		CreatedAt:  s.now(),
+		publicKey:  key,
+	}
+	if err := s.store.StoreTransportKey(tk); err != nil {
+		return nil, err
+	}
+	return tk, nil
+}
+
+// GetTransportKey returns the transport key registered under the machine
+func (s *service) GetTransportKey(ik, keyID string) (*TransportKey, error) {
+	return s.store.FindTransportKey(ik, keyID)
+}
+
+// DecryptDataUnderTransportKey unwraps a key block like DecryptDataWithFallback
+// and returns the key encrypted under the transport key registered with keyID
+// under the machine of the vault credentials, so it's never returned in clear.
+// The transport key is looked up before the key block is unwrapped.
+func (s *service) DecryptDataUnderTransportKey(vaultAddr, vaultToken string, keys []KeyReference, keyBlock, keyID string, timeout time.Duration, opts ...UnwrapOption) (_ string, _ KeyReference, err error) {
+	defer func() { s.audit(AUDIT_OPERATION_DECRYPT_TO_TRANSPORT, auditKeysSubject(keys), err) }()
+	if err := s.approveUsage(unwrapCallOf(opts).principal, keyBlock); err != nil {
+		return "", KeyReference{}, err
+	}
+	m, err := s.machineFor(UnifiedParams{VaultAddr: vaultAddr, VaultToken: vaultToken})
+	if err != nil {
+		return "", KeyReference{}, err
+	}
+	tk, err := s.store.FindTransportKey(m.InitialKey, keyID)
+	if err != nil {
+		return "", KeyReference{}, err
+	}
+
+	data, key, err := s.decryptDataWithFallback(vaultAddr, vaultToken, keys, keyBlock, timeout)
+	if err != nil {
+		return "", KeyReference{}, err
+	}
+	clear, err := hex.DecodeString(data)
+	if err != nil {
+		return "", KeyReference{}, err
+	}
+	defer wipe(clear)
+
+	encrypted, err := tk.encrypt(clear)
+	if err != nil {
+		return "", KeyReference{}, err
+	}
+	return encrypted, key, nil
+}
+
+// encrypt returns the compact JWE of key under the transport key
+func (tk *TransportKey) encrypt(key []byte) (string, error) {
+	encrypter, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{
+		Algorithm: jose.KeyAlgorithm(tk.Algorithm),
+		Key:       tk.publicKey,
+		KeyID:     tk.KeyID,
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	jwe, err := encrypter.Encrypt(key)
+	if err != nil {
+		return "", err
+	}
+	return jwe.CompactSerialize()
+}
+
+// DecryptTransportKey returns the key of a compact JWE returned by /decrypt_data
+// for a TransportKeyID, decrypted with the private key of the transport key
+func DecryptTransportKey(encrypted string, privateKey crypto.PrivateKey) ([]byte, error) {
+	jwe, err := jose.ParseEncrypted(encrypted,
+		[]jose.KeyAlgorithm{jose.RSA_OAEP_256, jose.ECDH_ES_A256KW},
+		[]jose.ContentEncryption{jose.A256GCM},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return jwe.Decrypt(privateKey)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const transportTestKeyBlock = "A0088M3TC00E000022BD7EC46BBE2A6A73389D1BA6DB63120B386F912839F4679C0523399E4D8D0F1D9A356E" // gitleaks:allow
+
+func mustPublicKeyPEM(t *testing.T, key interface{}) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestService_DecryptDataUnderTransportKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		privateKey interface{}
+		publicKey  interface{}
+		algorithm  string
+	}{
+		{"RSA", rsaKey, &rsaKey.PublicKey, "RSA-OAEP-256"},
+		{"ECIES", ecKey, &ecKey.PublicKey, "ECDH-ES+A256KW"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := mockServiceInMock()
+			m := mockTerminalMachine(t, s)
+
+			tk, err := s.RegisterTransportKey(m.InitialKey, mustPublicKeyPEM(t, tt.publicKey))
+			require.NoError(t, err)
+			require.Equal(t, tt.algorithm, tk.Algorithm)
+			require.NotEmpty(t, tk.KeyID)
+
+			_, err = s.RegisterTransportKey(m.InitialKey, tk.PublicKey)
+			require.ErrorIs(t, err, ErrAlreadyExists)
+
+			auth := mockVaultAuthOne()
+			keys := []KeyReference{{KeyPath: "secret/tr31", KeyName: "kbkp"}}
+			encrypted, key, err := s.DecryptDataUnderTransportKey(auth.VaultAddress, auth.VaultToken, keys, transportTestKeyBlock, tk.KeyID, 0)
+			require.NoError(t, err)
+			require.Equal(t, keys[0], key)
+
+			clear, err := DecryptTransportKey(encrypted, tt.privateKey)
+			require.NoError(t, err)
+			require.Equal(t, "ccccccccccccccccdddddddddddddddd", hex.EncodeToString(clear))
+
+			_, _, err = s.DecryptDataUnderTransportKey(auth.VaultAddress, auth.VaultToken, keys, transportTestKeyBlock, "unknown", 0)
+			require.ErrorIs(t, err, ErrNotFound)
+		})
+	}
+}
+
+func TestService_RegisterTransportKey_invalid(t *testing.T) {
+	s := mockServiceInMock()
+	m := mockTerminalMachine(t, s)
+
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	_, err = s.RegisterTransportKey(m.InitialKey, mustPublicKeyPEM(t, &weak.PublicKey))
+	require.ErrorIs(t, err, errInvalidTransportKey)
+
+	_, err = s.RegisterTransportKey(m.InitialKey, "not a key")
+	require.ErrorIs(t, err, errInvalidTransportKey)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, err = s.RegisterTransportKey("ffffffffffffffff", mustPublicKeyPEM(t, &ecKey.PublicKey))
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestRouting_decrypt_data_transport_key(t *testing.T) {
+	s := mockServiceInMock()
+	m := mockTerminalMachine(t, s)
+	router := MakeHTTPHandler(s)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	body, err := json.Marshal(map[string]string{"PublicKey": mustPublicKeyPEM(t, &ecKey.PublicKey)})
+	require.NoError(t, err)
+	req := httptest.NewRequest("POST", "/machine/"+m.InitialKey+"/transport_keys", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var registered transportKeyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &registered))
+
+	req = httptest.NewRequest("GET", "/machine/"+m.InitialKey+"/transport_keys/"+registered.TransportKey.KeyID, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	auth := mockVaultAuthOne()
+	decrypt := func(transportKeyID string) *httptest.ResponseRecorder {
+		body, err := json.Marshal(map[string]string{
+			"VaultAddr":      auth.VaultAddress,
+			"VaultToken":     auth.VaultToken,
+			"KeyPath":        "secret/tr31",
+			"KeyName":        "kbkp",
+			"KeyBlock":       transportTestKeyBlock,
+			"TransportKeyID": transportKeyID,
+		})
+		require.NoError(t, err)
+		req := httptest.NewRequest("POST", "/decrypt_data", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w = decrypt(registered.TransportKey.KeyID)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp decryptDataResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Empty(t, resp.Data)
+	clear, err := DecryptTransportKey(resp.EncryptedData, ecKey)
+	require.NoError(t, err)
+	require.Equal(t, "ccccccccccccccccdddddddddddddddd", hex.EncodeToString(clear))
+
+	w = decrypt("unknown")
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	body, err = json.Marshal(map[string]string{"PublicKey": "not a key"})
+	require.NoError(t, err)
+	req = httptest.NewRequest("POST", "/machine/"+m.InitialKey+"/transport_keys", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
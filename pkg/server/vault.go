@@ -1,8 +1,11 @@
 package server
 
 import (
+	"errors"
 	"fmt"
-	"os/exec"
+	"net/http"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/vault/api"
@@ -31,8 +34,40 @@ const (
 	VaultErrorResultNotString string = "Value is not a string: %v"
 	VaultErrorResultNotExist  string = "Key not found:%v"
 	VaultErrorUpdate          string = "Error updating Vault: %v"
+	VaultErrorTransport       string = "Vault client transport doesn't support TLS configuration."
+	VaultErrorKVv2Data        string = "Secret at %s has no KV v2 'data' field, set the KV version to 1 for KV v1 mounts."
+	VaultErrorKVData          string = "Secret at %s has no data."
 )
 
+// KVVersion is the version of the Vault KV secrets engine mounts keys are stored on
+type KVVersion string
+
+const (
+	// KV_VERSION_AUTO detects the version: secrets read with a 'data' and a
+	// 'metadata' field are KV v2, and secrets are written to KV v2 when their
+	// path has a 'data' segment after the mount, such as secret/data/tr31
+	KV_VERSION_AUTO KVVersion = "auto"
+	// KV_VERSION_1 reads and writes secrets as is, without 'data' nesting
+	KV_VERSION_1 KVVersion = "1"
+	// KV_VERSION_2 nests secrets under 'data', paths include the data segment
+	KV_VERSION_2 KVVersion = "2"
+)
+
+var errInvalidKVVersion = errors.New("invalid Vault KV version")
+
+// ParseKVVersion returns the KV version of auto (or empty), 1 or 2
+func ParseKVVersion(version string) (KVVersion, error) {
+	switch strings.TrimPrefix(strings.ToLower(version), "v") {
+	case "", "auto":
+		return KV_VERSION_AUTO, nil
+	case "1":
+		return KV_VERSION_1, nil
+	case "2":
+		return KV_VERSION_2, nil
+	}
+	return "", fmt.Errorf("%w: %q, expecting auto, 1 or 2", errInvalidKVVersion, version)
+}
+
 type SecretManager interface {
 	// SetAddress set a vault server url
 	SetAddress(address string) *VaultError
@@ -49,7 +84,8 @@ type SecretManager interface {
 }
 
 type VaultClient struct {
-	client *api.Client
+	client    *api.Client
+	kvVersion KVVersion
 }
 
 func NewVaultClient(v Vault) (*VaultClient, error) {
@@ -57,11 +93,71 @@ func NewVaultClient(v Vault) (*VaultClient, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &VaultClient{vClient}, nil
+	return &VaultClient{client: vClient, kvVersion: KV_VERSION_AUTO}, nil
+}
+
+// scopedSecretManager returns a secret manager bound to the vault credentials,
+// so that concurrent callers don't change the credentials of sm. Vault clients
+// are copied, other secret managers don't use the credentials.
+func scopedSecretManager(sm SecretManager, v Vault) (SecretManager, error) {
+	vc, ok := sm.(*VaultClient)
+	if !ok {
+		return sm, nil
+	}
+	scoped, err := NewVaultClient(v)
+	if err != nil {
+		return nil, err
+	}
+	scoped.kvVersion = vc.kvVersion
+	return scoped, nil
+}
+
+// SetKVVersion sets the KV version of the mounts keys are stored on, instead
+// of detecting it
+func (v *VaultClient) SetKVVersion(version KVVersion) {
+	if version == "" {
+		version = KV_VERSION_AUTO
+	}
+	v.kvVersion = version
 }
 
-// Vault Process Reference
-var vaultCmd *exec.Cmd
+// kvData returns the key-value pairs of a secret read from path
+func (v *VaultClient) kvData(path string, secret *api.Secret) (map[string]interface{}, *VaultError) {
+	if v.kvVersion == KV_VERSION_1 {
+		if secret.Data == nil {
+			return nil, &VaultError{Message: fmt.Sprintf(VaultErrorKVData, path)}
+		}
+		return secret.Data, nil
+	}
+	data, nested := secret.Data["data"].(map[string]interface{})
+	if v.kvVersion == KV_VERSION_2 {
+		if !nested {
+			return nil, &VaultError{Message: fmt.Sprintf(VaultErrorKVv2Data, path)}
+		}
+		return data, nil
+	}
+	// KV v2 responses always carry the metadata of the version read
+	if _, versioned := secret.Data["metadata"]; nested && versioned {
+		return data, nil
+	}
+	if secret.Data == nil {
+		return nil, &VaultError{Message: fmt.Sprintf(VaultErrorKVData, path)}
+	}
+	return secret.Data, nil
+}
+
+// kvPayload returns the body writing data to the secret at path
+func (v *VaultClient) kvPayload(path string, data map[string]interface{}) map[string]interface{} {
+	nested := v.kvVersion == KV_VERSION_2
+	if v.kvVersion == KV_VERSION_AUTO {
+		segments := strings.Split(strings.Trim(path, "/"), "/")
+		nested = len(segments) > 2 && slices.Contains(segments[1:len(segments)-1], "data")
+	}
+	if !nested {
+		return data
+	}
+	return map[string]interface{}{"data": data}
+}
 
 // createVaultClient initializes and returns a new Vault API client.
 //
@@ -132,11 +228,9 @@ func (v *VaultClient) WriteSecret(path, key, value string) *VaultError {
 
 	client := v.client
 	// Store key-value
-	secretData := map[string]interface{}{
-		"data": map[string]interface{}{
-			key: value,
-		},
-	}
+	secretData := v.kvPayload(path, map[string]interface{}{
+		key: value,
+	})
 	_, vErr := client.Logical().Write(path, secretData)
 	if vErr != nil {
 		return &VaultError{Message: fmt.Sprintf(VaultErrorWriting, vErr)}
@@ -175,14 +269,9 @@ func (v *VaultClient) ReadSecret(path, key string) (string, *VaultError) {
 	}
 
 	// Extract the value
-	dataRaw, ok := secret.Data["data"]
-	if !ok {
-		return "", &VaultError{Message: fmt.Sprintf("missing 'data' key in secret response")}
-	}
-
-	data, ok := dataRaw.(map[string]interface{})
-	if !ok {
-		return "", &VaultError{Message: fmt.Sprintf("'data' key is not a valid map[string]interface{}")}
+	data, dErr := v.kvData(path, secret)
+	if dErr != nil {
+		return "", dErr
 	}
 
 	valueKey, ok := data[key]
@@ -223,9 +312,9 @@ func (v *VaultClient) ListSecrets(path string) ([]string, *VaultError) {
 		return nil, &VaultError{Message: fmt.Sprintf(VaultErrorReadResult, vErr)}
 	}
 
-	data, ok := secret.Data["data"].(map[string]interface{})
-	if !ok {
-		return nil, &VaultError{Message: fmt.Sprintf(VaultErrorReadResult, vErr)}
+	data, dErr := v.kvData(path, secret)
+	if dErr != nil {
+		return nil, dErr
 	}
 	values := make([]interface{}, 0, len(data))
 	for _, value := range data {
@@ -240,6 +329,40 @@ func (v *VaultClient) ListSecrets(path string) ([]string, *VaultError) {
 	return stringValues, nil
 }
 
+// ReadSecrets retrieves every key-value pair of a stored secret in the Vault secrets engine.
+//
+// Parameters:
+// - path: The Vault path where the secret is stored (e.g., "secret/myapp").
+//
+// Returns:
+// - map[string]string: The string values of the secret by key, other values are left out.
+// - *VaultError: An error object if the operation fails.
+func (v *VaultClient) ReadSecrets(path string) (map[string]string, *VaultError) {
+	if v.client == nil {
+		return nil, &VaultError{Message: fmt.Sprintf(VaultErrorClient)}
+	}
+	if len(path) == 0 {
+		return nil, &VaultError{Message: fmt.Sprintf(VaultErrorNoKeyPath)}
+	}
+
+	secret, vErr := v.client.Logical().Read(path)
+	if vErr != nil || secret == nil {
+		return nil, &VaultError{Message: fmt.Sprintf(VaultErrorReadResult, vErr)}
+	}
+
+	data, dErr := v.kvData(path, secret)
+	if dErr != nil {
+		return nil, dErr
+	}
+	secrets := make(map[string]string, len(data))
+	for key, value := range data {
+		if str, ok := value.(string); ok {
+			secrets[key] = str
+		}
+	}
+	return secrets, nil
+}
+
 // DeleteSecret removes a specific key from a stored secret in the Vault secrets engine.
 //
 // This function reads the existing secret data from Vault, removes the specified key,
@@ -271,7 +394,10 @@ func (v *VaultClient) DeleteSecret(path, key string) *VaultError {
 	}
 
 	// Remove key from data
-	data := secret.Data["data"].(map[string]interface{})
+	data, dErr := v.kvData(path, secret)
+	if dErr != nil {
+		return dErr
+	}
 	if _, exists := data[key]; exists {
 		delete(data, key)
 	} else {
@@ -279,13 +405,27 @@ func (v *VaultClient) DeleteSecret(path, key string) *VaultError {
 	}
 
 	// Write updated data back to Vault
-	updatedSecret := map[string]interface{}{
-		"data": data,
-	}
+	updatedSecret := v.kvPayload(path, data)
 
-	_, vErr = client.Logical().Write("secret/data/"+path, updatedSecret)
+	_, vErr = client.Logical().Write(path, updatedSecret)
 	if vErr != nil {
 		return &VaultError{Message: fmt.Sprintf(VaultErrorUpdate, key)}
 	}
 	return nil
 }
+
+// UseCertWatcher configures the Vault client for mutual TLS with certificates
+// from the watcher. Idle connections are closed on every reload so new
+// connections present the rotated certificate.
+func (v *VaultClient) UseCertWatcher(w *CertWatcher) *VaultError {
+	if v.client == nil {
+		return &VaultError{Message: fmt.Sprintf(VaultErrorClient)}
+	}
+	transport, ok := v.client.CloneConfig().HttpClient.Transport.(*http.Transport)
+	if !ok {
+		return &VaultError{Message: fmt.Sprintf(VaultErrorTransport)}
+	}
+	transport.TLSClientConfig = w.TLSConfig()
+	w.OnReload(transport.CloseIdleConnections)
+	return nil
+}
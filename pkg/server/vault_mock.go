@@ -80,6 +80,26 @@ func (m *MockVaultClient) ListSecrets(path string) ([]string, *VaultError) {
 	return nil, &VaultError{Message: fmt.Sprintf("Values not found in path %s", path)}
 }
 
+// ReadSecrets simulates reading every key-value pair under a path from Vault.
+func (m *MockVaultClient) ReadSecrets(path string) (map[string]string, *VaultError) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if path == "" {
+		return nil, &VaultError{Message: "Invalid input: path is required"}
+	}
+
+	values, exists := m.storage[path]
+	if !exists {
+		return nil, &VaultError{Message: fmt.Sprintf("Values not found in path %s", path)}
+	}
+	secrets := make(map[string]string, len(values))
+	for key, value := range values {
+		secrets[key] = value
+	}
+	return secrets, nil
+}
+
 // DeleteSecret simulates removing a key-value pair from Vault.
 func (m *MockVaultClient) DeleteSecret(path, key string) *VaultError {
 	m.mu.Lock()
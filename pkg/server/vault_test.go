@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeKV serves the reads and writes of a Vault KV mount of version from memory
+func fakeKV(t *testing.T, version KVVersion) *httptest.Server {
+	var mu sync.Mutex
+	secrets := map[string]map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		path := strings.TrimPrefix(r.URL.Path, "/v1/")
+		switch r.Method {
+		case "GET":
+			secret, exists := secrets[path]
+			if !exists {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"errors":[]}`))
+				return
+			}
+			var data interface{} = secret
+			if version == KV_VERSION_2 {
+				data = map[string]interface{}{"data": secret, "metadata": map[string]interface{}{"version": 1}}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+		case "PUT", "POST":
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			if version == KV_VERSION_2 {
+				data, nested := body["data"].(map[string]interface{})
+				if !nested {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte(`{"errors":["no data provided"]}`))
+					return
+				}
+				body = data
+			}
+			secrets[path] = body
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestVaultClient_KVVersions(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		mount    KVVersion
+		client   KVVersion
+		path     string
+		readErr  string
+		writeErr bool
+	}{
+		{name: "auto on v1", mount: KV_VERSION_1, client: KV_VERSION_AUTO, path: "secret/tr31/kbpk"},
+		{name: "auto on v2", mount: KV_VERSION_2, client: KV_VERSION_AUTO, path: "secret/data/tr31/kbpk"},
+		{name: "v1 with a data directory", mount: KV_VERSION_1, client: KV_VERSION_1, path: "kv/data/kbpk"},
+		{name: "v2", mount: KV_VERSION_2, client: KV_VERSION_2, path: "secret/data/kbpk"},
+		{name: "v2 on v1", mount: KV_VERSION_1, client: KV_VERSION_2, path: "secret/data/kbpk", readErr: "set the KV version to 1"},
+		{name: "v1 on v2", mount: KV_VERSION_2, client: KV_VERSION_1, path: "secret/data/kbpk", writeErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := fakeKV(t, tc.mount)
+			client, err := NewVaultClient(Vault{VaultAddress: server.URL, VaultToken: "token"})
+			require.NoError(t, err)
+			client.SetKVVersion(tc.client)
+
+			writer := client
+			if tc.readErr != "" {
+				// The secret was stored by the tools of the mount
+				writer, err = NewVaultClient(Vault{VaultAddress: server.URL, VaultToken: "token"})
+				require.NoError(t, err)
+				writer.SetKVVersion(tc.mount)
+			}
+			vErr := writer.WriteSecret(tc.path, "kbpk", "AABB")
+			if tc.writeErr {
+				require.NotNil(t, vErr)
+				return
+			}
+			require.Nil(t, vErr)
+			value, vErr := client.ReadSecret(tc.path, "kbpk")
+			if tc.readErr != "" {
+				require.NotNil(t, vErr)
+				require.Contains(t, vErr.Error(), tc.readErr)
+				return
+			}
+			require.Nil(t, vErr)
+			require.Equal(t, "AABB", value)
+
+			secrets, vErr := client.ReadSecrets(tc.path)
+			require.Nil(t, vErr)
+			require.Equal(t, map[string]string{"kbpk": "AABB"}, secrets)
+			values, vErr := client.ListSecrets(tc.path)
+			require.Nil(t, vErr)
+			require.Equal(t, []string{"AABB"}, values)
+
+			require.Nil(t, client.DeleteSecret(tc.path, "kbpk"))
+			_, vErr = client.ReadSecret(tc.path, "kbpk")
+			require.NotNil(t, vErr)
+			require.Contains(t, vErr.Error(), "key 'kbpk' not found")
+		})
+	}
+}
+
+func TestParseKVVersion(t *testing.T) {
+	for input, expected := range map[string]KVVersion{"": KV_VERSION_AUTO, "auto": KV_VERSION_AUTO, "1": KV_VERSION_1, "v2": KV_VERSION_2} {
+		version, err := ParseKVVersion(input)
+		require.NoError(t, err)
+		require.Equal(t, expected, version)
+	}
+	_, err := ParseKVVersion("3")
+	require.ErrorIs(t, err, errInvalidKVVersion)
+}
+
+func TestScopedSecretManager(t *testing.T) {
+	server := fakeKV(t, KV_VERSION_1)
+	shared, err := NewVaultClient(Vault{VaultAddress: "http://localhost:1", VaultToken: "shared"})
+	require.NoError(t, err)
+	shared.SetKVVersion(KV_VERSION_1)
+
+	sm, err := scopedSecretManager(shared, Vault{VaultAddress: server.URL, VaultToken: "scoped"})
+	require.NoError(t, err)
+	scoped, ok := sm.(*VaultClient)
+	require.True(t, ok)
+	require.Equal(t, KV_VERSION_1, scoped.kvVersion)
+	require.Equal(t, server.URL, scoped.client.Address())
+	require.Equal(t, "scoped", scoped.client.Token())
+	require.Equal(t, "shared", shared.client.Token())
+	require.Nil(t, scoped.WriteSecret("secret/tr31", "kbkp", "AAAA"))
+
+	// Other secret managers don't use the credentials
+	mock := NewMockVaultClient()
+	sm, err = scopedSecretManager(mock, Vault{VaultAddress: server.URL, VaultToken: "scoped"})
+	require.NoError(t, err)
+	require.Same(t, mock, sm)
+}
+
+func TestService_scoped_secret_manager(t *testing.T) {
+	server := fakeKV(t, KV_VERSION_1)
+	s := NewService(NewRepositoryInMemory(nil), MODE_VAULT)
+	shared, ok := s.GetSecretManager().(*VaultClient)
+	require.True(t, ok)
+	shared.SetKVVersion(KV_VERSION_1)
+	address := shared.client.Address()
+
+	creds := Vault{VaultAddress: server.URL, VaultToken: "caller"}
+	sm, err := scopedSecretManager(shared, creds)
+	require.NoError(t, err)
+	require.Nil(t, sm.WriteSecret("secret/tr31", "kbkp", "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBBCCCCCCCCCCCCCCCC"))
+	require.Nil(t, sm.WriteSecret("secret/target", "target", "DDDDDDDDDDDDDDDDEEEEEEEEEEEEEEEEFFFFFFFFFFFFFFFF"))
+
+	keyBlock, err := s.EncryptData(creds.VaultAddress, creds.VaultToken, "secret/tr31", "kbkp", "ccccccccccccccccdddddddddddddddd", HeaderParams{
+		VersionId: "D", KeyUsage: "D0", Algorithm: "A", ModeOfUse: "D", KeyVersion: "00", Exportability: "E",
+	}, 10)
+	require.NoError(t, err)
+	_, err = s.DecryptData(creds.VaultAddress, creds.VaultToken, "secret/tr31", "kbkp", keyBlock, 10)
+	require.NoError(t, err)
+	_, err = s.TranslateData(creds.VaultAddress, creds.VaultToken, "secret/tr31", "kbkp", "secret/target", "target", keyBlock, 10)
+	require.NoError(t, err)
+
+	// The credentials of the callers never reach the shared client
+	require.Equal(t, address, shared.client.Address())
+	require.Empty(t, shared.client.Token())
+}
@@ -4,6 +4,10 @@ import (
 	"bytes"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/moov-io/tr31/pkg/tr31"
@@ -16,7 +20,95 @@ type HeaderParams struct {
 	ModeOfUse     string
 	KeyVersion    string
 	Exportability string
+	// Blocks are the optional blocks of the header by ID, such as {"KS": "00604B120F9292800000"}
+	Blocks map[string]string `json:",omitempty"`
 }
+
+// withDefaults fills the fields p omits from defaults, and adds the optional
+// blocks of defaults p doesn't set
+func (p HeaderParams) withDefaults(defaults HeaderParams) HeaderParams {
+	fill := func(value, fallback string) string {
+		if value == "" {
+			return fallback
+		}
+		return value
+	}
+	merged := HeaderParams{
+		VersionId:     fill(p.VersionId, defaults.VersionId),
+		KeyUsage:      fill(p.KeyUsage, defaults.KeyUsage),
+		Algorithm:     fill(p.Algorithm, defaults.Algorithm),
+		ModeOfUse:     fill(p.ModeOfUse, defaults.ModeOfUse),
+		KeyVersion:    fill(p.KeyVersion, defaults.KeyVersion),
+		Exportability: fill(p.Exportability, defaults.Exportability),
+	}
+	if len(p.Blocks) > 0 || len(defaults.Blocks) > 0 {
+		merged.Blocks = make(map[string]string, len(p.Blocks)+len(defaults.Blocks))
+		for id, value := range defaults.Blocks {
+			merged.Blocks[id] = value
+		}
+		for id, value := range p.Blocks {
+			merged.Blocks[id] = value
+		}
+	}
+	return merged
+}
+
+// FieldError is an invalid request field, named by its path such as "Header.Blocks.KS"
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// HeaderParamsError lists every invalid field of header params
+type HeaderParamsError struct {
+	Fields []FieldError
+}
+
+func (e *HeaderParamsError) Error() string {
+	fields := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		fields[i] = f.Field + ": " + f.Message
+	}
+	return "invalid header: " + strings.Join(fields, "; ")
+}
+
+// Header builds the key block header the params describe. Every invalid field
+// is reported in a *HeaderParamsError, rather than only the first one.
+func (p HeaderParams) Header() (*tr31.Header, error) {
+	header := tr31.DefaultHeader()
+	var fields []FieldError
+	check := func(field string, err error) {
+		if err == nil {
+			return
+		}
+		message := err.Error()
+		var headerErr *tr31.HeaderError
+		if errors.As(err, &headerErr) {
+			message = headerErr.Message
+		}
+		fields = append(fields, FieldError{Field: "Header." + field, Message: message})
+	}
+	check("VersionId", header.SetVersionID(p.VersionId))
+	check("KeyUsage", header.SetKeyUsage(p.KeyUsage))
+	check("Algorithm", header.SetAlgorithm(p.Algorithm))
+	check("ModeOfUse", header.SetModeOfUse(p.ModeOfUse))
+	check("KeyVersion", header.SetVersionNum(p.KeyVersion))
+	check("Exportability", header.SetExportability(p.Exportability))
+
+	ids := make([]string, 0, len(p.Blocks))
+	for id := range p.Blocks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		check("Blocks."+id, header.Blocks.Set(id, p.Blocks[id]))
+	}
+	if len(fields) > 0 {
+		return nil, &HeaderParamsError{Fields: fields}
+	}
+	return header, nil
+}
+
 type UnifiedParams struct {
 	VaultAddr  string
 	VaultToken string
@@ -34,7 +126,7 @@ type WrapperCall func(params UnifiedParams) (string, error)
 func InitialKey(params UnifiedParams) (string, error) {
 	planData := []byte(params.VaultAddr + params.VaultToken)
 	kbpk := bytes.Repeat([]byte("E"), 24)
-	encData, err := tr31.GenerateCBCMAC(kbpk, planData, 1, 8, tr31.DES)
+	encData, err := tr31.GenerateCBCMAC(kbpk, planData, tr31.PAD_METHOD_1, 8, tr31.DES)
 	if err != nil {
 		return "", err
 	}
@@ -44,7 +136,7 @@ func InitialKey(params UnifiedParams) (string, error) {
 func TransactionKey(params UnifiedParams) (string, error) {
 	planData := []byte(params.VaultAddr + params.VaultToken)
 	kbpk := bytes.Repeat([]byte("F"), 24)
-	encData, err := tr31.GenerateCBCMAC(kbpk, planData, 1, 8, tr31.DES)
+	encData, err := tr31.GenerateCBCMAC(kbpk, planData, tr31.PAD_METHOD_1, 8, tr31.DES)
 	if err != nil {
 		return "", err
 	}
@@ -55,53 +147,120 @@ func TransactionKey(params UnifiedParams) (string, error) {
 func readKey(vault SecretManager, params UnifiedParams) (string, error) {
 	kbpkStr, err := vault.ReadSecret(params.KeyPath, params.KeyName)
 	if err != nil {
-		return "", errors.New(err.Message)
+		return "", err
 	}
 	return kbpkStr, nil
 }
 
 func EncryptData(params UnifiedParams) (string, error) {
-	kbpkStr := params.Kbkp
-	kbpk, decErr := hex.DecodeString(kbpkStr)
+	kbpk, decErr := hex.DecodeString(params.Kbkp)
 	if decErr != nil {
 		return "", decErr
 	}
-	enckey, decErr := hex.DecodeString(params.EncKey)
+	result, err := wrapKey(kbpk, params.EncKey, params.Header, nil, time.Now())
+	if err != nil {
+		return "", err
+	}
+	return result.KeyBlock, nil
+}
+
+func DecryptData(params UnifiedParams) (string, error) {
+	kbpk, decErr := hex.DecodeString(params.Kbkp)
 	if decErr != nil {
 		return "", decErr
 	}
-	header, hErr := tr31.NewHeader(
-		params.Header.VersionId,
-		params.Header.KeyUsage,
-		params.Header.Algorithm,
-		params.Header.ModeOfUse,
-		params.Header.KeyVersion,
-		params.Header.Exportability)
+	return unwrapKey(kbpk, params.KeyBlock)
+}
+
+// EncryptResult is a key block wrapped by the service, with the KCV of the key
+// and the header it was wrapped under, policy blocks included
+type EncryptResult struct {
+	KeyBlock string
+	// KCV is the key check value of the key, empty for algorithms without one
+	KCV    string
+	Header HeaderParams
+}
+
+// headerParamsOf describes a key block header as header params
+// maxGeneratedKeyLength bounds the keys generated for algorithms without a fixed
+// set of key lengths, such as HMAC
+const maxGeneratedKeyLength = 64
+
+// _generatedKeyLengths lists the lengths in bytes of the keys of each algorithm
+var _generatedKeyLengths = map[string][]int{
+	tr31.ENC_ALGORITHM_TRIPLE_DES: {16, 24},
+	tr31.ENC_ALGORITHM_DES:        {8},
+	tr31.ENC_ALGORITHM_AES:        {16, 24, 32},
+}
+
+// validateGeneratedKeyLength checks the length of a key to generate for the algorithm
+func validateGeneratedKeyLength(algorithm string, length int) error {
+	if lengths, exists := _generatedKeyLengths[algorithm]; exists {
+		if !slices.Contains(lengths, length) {
+			return fmt.Errorf("key length %d is invalid for algorithm %s, expected one of %v", length, algorithm, lengths)
+		}
+		return nil
+	}
+	if length <= 0 || length > maxGeneratedKeyLength {
+		return fmt.Errorf("key length %d must be 1 to %d bytes", length, maxGeneratedKeyLength)
+	}
+	return nil
+}
+
+func headerParamsOf(header *tr31.Header) HeaderParams {
+	params := HeaderParams{
+		VersionId:     header.VersionID,
+		KeyUsage:      header.KeyUsage,
+		Algorithm:     header.Algorithm,
+		ModeOfUse:     header.ModeOfUse,
+		KeyVersion:    header.VersionNum,
+		Exportability: header.Exportability,
+	}
+	if blocks := header.GetBlocks(); len(blocks) > 0 {
+		params.Blocks = make(map[string]string, len(blocks))
+		for id, value := range blocks {
+			params.Blocks[id] = value
+		}
+	}
+	return params
+}
+
+// wrapKey wraps the hex key under kbpk with a header built from the header
+// params, carrying their optional blocks and the blocks of the policy stamped at now
+func wrapKey(kbpk []byte, encKey string, params HeaderParams, policy *BlockPolicy, now time.Time) (*EncryptResult, error) {
+	header, hErr := params.Header()
 	if hErr != nil {
-		return "", decErr
+		return nil, hErr
+	}
+	if err := policy.Apply(header, now); err != nil {
+		return nil, err
 	}
-	kblock, bErr := tr31.NewKeyBlock(kbpk, header)
+	kblock, bErr := tr31.New(kbpk, tr31.WithHeader(header))
 	if bErr != nil {
-		return "", bErr
+		return nil, bErr
 	}
-	kb, wErr := kblock.Wrap(enckey, nil)
+	kb, wErr := kblock.WrapHex(encKey, nil)
 	if wErr != nil {
-		return "", wErr
+		return nil, wErr
 	}
-	return kb, nil
+	key, _ := hex.DecodeString(encKey)
+	defer wipe(key)
+	// Only TDES, DES and AES keys have a KCV
+	kcv, _ := tr31.KeyCheckValue(key, header.Algorithm)
+	return &EncryptResult{
+		KeyBlock: kb,
+		KCV:      kcv,
+		Header:   headerParamsOf(header),
+	}, nil
 }
 
-func DecryptData(params UnifiedParams) (string, error) {
-	kbpkStr := params.Kbkp
-	kbpk, decErr := hex.DecodeString(kbpkStr)
-	if decErr != nil {
-		return "", decErr
-	}
-	block, bErr := tr31.NewKeyBlock(kbpk, nil)
+// unwrapKey unwraps the key block with kbpk and returns the key as hex
+func unwrapKey(kbpk []byte, keyBlock string) (string, error) {
+	block, bErr := tr31.New(kbpk)
 	if bErr != nil {
 		return "", bErr
 	}
-	resultKB, wErr := block.Unwrap(params.KeyBlock)
+	resultKB, wErr := block.Unwrap(keyBlock)
 	if wErr != nil {
 		return "", wErr
 	}
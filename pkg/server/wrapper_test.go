@@ -1,6 +1,7 @@
 package server
 
 import (
+	"net/http"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -26,3 +27,36 @@ func TestDecryptData(t *testing.T) {
 
 	require.Equal(t, "ccccccccccccccccdddddddddddddddd", keyStr)
 }
+
+func TestHeaderParams_Header(t *testing.T) {
+	params := HeaderParams{
+		VersionId:     "D",
+		KeyUsage:      "P0",
+		Algorithm:     "A",
+		ModeOfUse:     "E",
+		KeyVersion:    "00",
+		Exportability: "E",
+		Blocks:        map[string]string{"KS": "00604B120F9292800000"},
+	}
+	header, err := params.Header()
+	require.NoError(t, err)
+	require.Equal(t, "P0", header.KeyUsage)
+	ks, err := header.Blocks.Get("KS")
+	require.NoError(t, err)
+	require.Equal(t, "00604B120F9292800000", ks)
+
+	// every invalid field is reported by its path
+	params.KeyUsage = "P"
+	params.Exportability = ""
+	params.Blocks["K$"] = "00"
+	_, err = params.Header()
+	var paramsErr *HeaderParamsError
+	require.ErrorAs(t, err, &paramsErr)
+	fields := make([]string, len(paramsErr.Fields))
+	for i, f := range paramsErr.Fields {
+		fields[i] = f.Field
+	}
+	require.Equal(t, []string{"Header.KeyUsage", "Header.Exportability", "Header.Blocks.K$"}, fields)
+	require.Equal(t, ERROR_CODE_INVALID_HEADER, codeOf(err))
+	require.Equal(t, http.StatusUnprocessableEntity, codeFrom(err))
+}
@@ -6,7 +6,7 @@ import (
 	"fmt"
 )
 
-// EncryptAESCBC encrypts data using AES CBC algorithm
+// EncryptAESCBC encrypts data using AES CBC algorithm with a 16 byte IV, see EncryptCBC
 func EncryptAESCBC(key []byte, iv []byte, data []byte) ([]byte, error) {
 	if len(data) == 0 {
 		return nil, fmt.Errorf("Data is empty")
@@ -15,7 +15,7 @@ func EncryptAESCBC(key []byte, iv []byte, data []byte) ([]byte, error) {
 		return nil, fmt.Errorf("data length (%d) must be a multiple of AES block size %d", len(data), aes.BlockSize)
 	}
 	if len(iv) != aes.BlockSize {
-		return nil, fmt.Errorf("IV length (%d) must be a equal of AES block size %d", len(data), aes.BlockSize)
+		return nil, fmt.Errorf("IV length (%d) must be equal to AES block size %d", len(iv), aes.BlockSize)
 	}
 
 	block, err := aes.NewCipher(key)
@@ -51,7 +51,7 @@ func EncryptAESECB(key []byte, data []byte) ([]byte, error) {
 	return encrypted, nil
 }
 
-// DecryptAESCBC decrypts data using AES CBC algorithm
+// DecryptAESCBC decrypts data using AES CBC algorithm with a 16 byte IV, see DecryptCBC
 func DecryptAESCBC(key []byte, iv []byte, data []byte) ([]byte, error) {
 	if len(data) == 0 {
 		return nil, fmt.Errorf("Data is empty")
@@ -60,7 +60,7 @@ func DecryptAESCBC(key []byte, iv []byte, data []byte) ([]byte, error) {
 		return nil, fmt.Errorf("data length (%d) must be a multiple of AES block size %d", len(data), aes.BlockSize)
 	}
 	if len(iv) != aes.BlockSize {
-		return nil, fmt.Errorf("IV length (%d) must be a equal of AES block size %d", len(data), aes.BlockSize)
+		return nil, fmt.Errorf("IV length (%d) must be equal to AES block size %d", len(iv), aes.BlockSize)
 	}
 
 	block, err := aes.NewCipher(key)
@@ -0,0 +1,65 @@
+package tr31
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MACLengthPolicy controls unwrapping key blocks whose MAC is truncated to less
+// than the cipher block size, the 4 byte MACs of versions A and C
+type MACLengthPolicy int
+
+const (
+	// MAC_LENGTH_ANY unwraps key blocks with truncated MACs, the default
+	MAC_LENGTH_ANY MACLengthPolicy = iota
+	// MAC_LENGTH_FULL refuses to unwrap key blocks with truncated MACs
+	MAC_LENGTH_FULL
+)
+
+// AESKeyPolicy controls the key block versions AES keys (algorithm A) are
+// wrapped in and unwrapped from
+type AESKeyPolicy int
+
+const (
+	// AES_KEY_ANY_VERSION accepts AES keys in any key block version, the default
+	AES_KEY_ANY_VERSION AESKeyPolicy = iota
+	// AES_KEY_VERSION_D refuses AES keys in key block versions other than D,
+	// whose TDES KBPK is weaker than the key it protects
+	AES_KEY_VERSION_D
+)
+
+var (
+	_macLengthPolicy MACLengthPolicy
+	_aesKeyPolicy    AESKeyPolicy
+	_agilityMtx      sync.RWMutex
+)
+
+// SetMACLengthPolicy changes how Unwrap handles key blocks with truncated MACs
+func SetMACLengthPolicy(policy MACLengthPolicy) {
+	_agilityMtx.Lock()
+	defer _agilityMtx.Unlock()
+	_macLengthPolicy = policy
+}
+
+// SetAESKeyPolicy changes the key block versions Wrap and Unwrap accept AES keys in
+func SetAESKeyPolicy(policy AESKeyPolicy) {
+	_agilityMtx.Lock()
+	defer _agilityMtx.Unlock()
+	_aesKeyPolicy = policy
+}
+
+// checkAESKeyVersion applies the AES key policy to the header
+func checkAESKeyVersion(h *Header, policy AESKeyPolicy) error {
+	if policy == AES_KEY_VERSION_D && h.Algorithm == ENC_ALGORITHM_AES && h.VersionID != TR31_VERSION_D {
+		return &KeyBlockError{Message: fmt.Sprintf(BlockErrorAESVersionRejected, h.VersionID)}
+	}
+	return nil
+}
+
+// checkMACLength applies the MAC length policy to a key block of the version
+func checkMACLength(spec VersionSpec, policy MACLengthPolicy) error {
+	if policy == MAC_LENGTH_FULL && spec.MACLen < spec.BlockSize {
+		return &KeyBlockError{Message: fmt.Sprintf(BlockErrorMACTruncatedRejected, spec.ID, spec.MACLen)}
+	}
+	return nil
+}
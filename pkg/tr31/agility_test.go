@@ -0,0 +1,81 @@
+package tr31
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMACLengthPolicy(t *testing.T) {
+	kbpk := bytes.Repeat([]byte{0x5A}, 16)
+	key := bytes.Repeat([]byte{0x3C}, 16)
+	blocks := map[string]string{}
+	for _, version := range []string{TR31_VERSION_A, TR31_VERSION_B, TR31_VERSION_C, TR31_VERSION_D} {
+		kb, err := NewKeyBlockFromString(kbpk, version+"0000P0TE00E0000")
+		require.NoError(t, err)
+		blocks[version], err = kb.Wrap(key, nil)
+		require.NoError(t, err)
+	}
+
+	strict, _ := New(kbpk, WithPolicy(Policy{MACLength: MAC_LENGTH_FULL}))
+	for version, block := range blocks {
+		_, err := strict.Unwrap(block)
+		if version == TR31_VERSION_A || version == TR31_VERSION_C {
+			assert.Equal(t, &KeyBlockError{Message: "Key block version " + version + " MACs are truncated to 4 bytes, rejected by policy requiring full-length MACs."}, err)
+		} else {
+			assert.Nil(t, err, version)
+		}
+	}
+
+	SetMACLengthPolicy(MAC_LENGTH_FULL)
+	defer SetMACLengthPolicy(MAC_LENGTH_ANY)
+	assert.Equal(t, Policy{MACLength: MAC_LENGTH_FULL}, PackagePolicy())
+	kb, _ := New(kbpk)
+	_, err := kb.Unwrap(blocks[TR31_VERSION_C])
+	assert.NotNil(t, err)
+	// Key blocks with their own policy aren't affected
+	kb, _ = New(kbpk, WithPolicy(Policy{}))
+	_, err = kb.Unwrap(blocks[TR31_VERSION_C])
+	assert.Nil(t, err)
+}
+
+func TestAESKeyPolicy(t *testing.T) {
+	tdesKBPK := bytes.Repeat([]byte{0x5A}, 24)
+	aesKBPK := bytes.Repeat([]byte{0x5A}, 32)
+	key := bytes.Repeat([]byte{0x3C}, 16)
+
+	// AES keys wrapped in version B before the policy
+	kb, err := NewKeyBlockFromString(tdesKBPK, "B0000D0AE00E0000")
+	require.NoError(t, err)
+	legacy, err := kb.Wrap(key, nil)
+	require.NoError(t, err)
+
+	policy := WithPolicy(Policy{AESKeys: AES_KEY_VERSION_D})
+	rejected := &KeyBlockError{Message: "AES keys in key block version B are rejected by policy requiring version D."}
+	kb, _ = NewKeyBlockFromString(tdesKBPK, "B0000D0AE00E0000", policy)
+	_, err = kb.Wrap(key, nil)
+	assert.Equal(t, rejected, err)
+	_, err = kb.Unwrap(legacy)
+	assert.Equal(t, rejected, err)
+
+	// TDES keys in version B and AES keys in version D are accepted
+	kb, _ = NewKeyBlockFromString(tdesKBPK, "B0000D0TE00E0000", policy)
+	block, err := kb.Wrap(key, nil)
+	require.NoError(t, err)
+	_, err = kb.Unwrap(block)
+	assert.Nil(t, err)
+	kb, _ = NewKeyBlockFromString(aesKBPK, "D0000D0AE00E0000", policy)
+	block, err = kb.Wrap(key, nil)
+	require.NoError(t, err)
+	_, err = kb.Unwrap(block)
+	assert.Nil(t, err)
+
+	SetAESKeyPolicy(AES_KEY_VERSION_D)
+	defer SetAESKeyPolicy(AES_KEY_ANY_VERSION)
+	assert.Equal(t, Policy{AESKeys: AES_KEY_VERSION_D}, PackagePolicy())
+	kb, _ = New(tdesKBPK)
+	_, err = kb.Unwrap(legacy)
+	assert.Equal(t, rejected, err)
+}
@@ -0,0 +1,283 @@
+package tr31
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+)
+
+const pkcs8PEMType = "PRIVATE KEY"
+
+// jwk is a private JSON Web Key (RFC 7517) of an RSA, EC or Ed25519 key
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	D   string `json:"d"`
+	P   string `json:"p,omitempty"`
+	Q   string `json:"q,omitempty"`
+	DP  string `json:"dp,omitempty"`
+	DQ  string `json:"dq,omitempty"`
+	QI  string `json:"qi,omitempty"`
+}
+
+// _jwkCurves maps JWK curve names to their ECDH curves
+var _jwkCurves = map[string]ecdh.Curve{
+	"P-256": ecdh.P256(),
+	"P-384": ecdh.P384(),
+	"P-521": ecdh.P521(),
+}
+
+// WrapPKCS8 wraps an RSA, EC or Ed25519 private key given as a PKCS#8 PEM
+// "PRIVATE KEY" block. The key type must match the header algorithm: RSA keys
+// need algorithm R, EC and Ed25519 keys algorithm E.
+func (kb *KeyBlock) WrapPKCS8(pemKey string, maskedKeyLen *int) (string, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil || block.Type != pkcs8PEMType {
+		return "", &KeyBlockError{Message: AsymmetricErrPEM}
+	}
+	defer clear(block.Bytes)
+	if _, err := kb.parsePKCS8(block.Bytes); err != nil {
+		return "", err
+	}
+	return kb.Wrap(block.Bytes, maskedKeyLen)
+}
+
+// UnwrapPKCS8 unwraps a key block of an asymmetric key and returns the private
+// key as a PKCS#8 PEM "PRIVATE KEY" block
+func (kb *KeyBlock) UnwrapPKCS8(keyBlock string) (string, error) {
+	der, err := kb.Unwrap(keyBlock)
+	if err != nil {
+		return "", err
+	}
+	defer clear(der)
+	if _, err := kb.parsePKCS8(der); err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: pkcs8PEMType, Bytes: der})), nil
+}
+
+// WrapJWK wraps an RSA, EC (P-256, P-384 or P-521) or Ed25519 private key given
+// as a JSON Web Key, with the same algorithm checks as WrapPKCS8. RSA keys need
+// their primes.
+func (kb *KeyBlock) WrapJWK(jwkKey string, maskedKeyLen *int) (string, error) {
+	key, err := parseJWK(jwkKey)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", &KeyBlockError{Message: fmt.Sprintf(AsymmetricErrJWK, err)}
+	}
+	defer clear(der)
+	if _, err := kb.parsePKCS8(der); err != nil {
+		return "", err
+	}
+	return kb.Wrap(der, maskedKeyLen)
+}
+
+// UnwrapJWK unwraps a key block of an asymmetric key and returns the private
+// key as a JSON Web Key
+func (kb *KeyBlock) UnwrapJWK(keyBlock string) (string, error) {
+	der, err := kb.Unwrap(keyBlock)
+	if err != nil {
+		return "", err
+	}
+	defer clear(der)
+	key, err := kb.parsePKCS8(der)
+	if err != nil {
+		return "", err
+	}
+	encoded, err := jwkOf(key)
+	if err != nil {
+		return "", err
+	}
+	out, err := json.Marshal(encoded)
+	if err != nil {
+		return "", &KeyBlockError{Message: fmt.Sprintf(AsymmetricErrJWK, err)}
+	}
+	return string(out), nil
+}
+
+// parsePKCS8 parses a PKCS#8 DER private key and checks its type against the
+// header algorithm
+func (kb *KeyBlock) parsePKCS8(der []byte) (crypto.PrivateKey, error) {
+	if kb == nil {
+		return nil, fmt.Errorf(ErrNoKBPK)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, &KeyBlockError{Message: fmt.Sprintf(AsymmetricErrPKCS8, err)}
+	}
+	var keyType, algorithm string
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		keyType, algorithm = "RSA", ENC_ALGORITHM_RSA
+	case *ecdsa.PrivateKey:
+		keyType, algorithm = "EC", ENC_ALGORITHM_EC
+	case ed25519.PrivateKey:
+		keyType, algorithm = "Ed25519", ENC_ALGORITHM_EC
+	default:
+		return nil, &KeyBlockError{Message: fmt.Sprintf(AsymmetricErrKeyType, fmt.Sprintf("%T", key))}
+	}
+	if kb.header.Algorithm != algorithm {
+		return nil, &KeyBlockError{Message: fmt.Sprintf(AsymmetricErrAlgorithm, keyType, kb.header.Algorithm, algorithm)}
+	}
+	return key, nil
+}
+
+// parseJWK builds the private key of a JSON Web Key
+func parseJWK(data string) (crypto.PrivateKey, error) {
+	invalid := func(format string, args ...interface{}) error {
+		return &KeyBlockError{Message: fmt.Sprintf(AsymmetricErrJWK, fmt.Sprintf(format, args...))}
+	}
+	var k jwk
+	if err := json.Unmarshal([]byte(data), &k); err != nil {
+		return nil, invalid("%v", err)
+	}
+	field := func(name, value string) ([]byte, error) {
+		if value == "" {
+			return nil, invalid("%s is missing", name)
+		}
+		decoded, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return nil, invalid("%s is not base64url", name)
+		}
+		return decoded, nil
+	}
+	integer := func(name, value string) (*big.Int, error) {
+		decoded, err := field(name, value)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(decoded), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		var values [5]*big.Int
+		for i, f := range []struct{ name, value string }{{"n", k.N}, {"e", k.E}, {"d", k.D}, {"p", k.P}, {"q", k.Q}} {
+			v, err := integer(f.name, f.value)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		if !values[1].IsInt64() || values[1].Int64() > 1<<31-1 {
+			return nil, invalid("e is too large")
+		}
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: values[0], E: int(values[1].Int64())},
+			D:         values[2],
+			Primes:    []*big.Int{values[3], values[4]},
+		}
+		if err := key.Validate(); err != nil {
+			return nil, invalid("%v", err)
+		}
+		key.Precompute()
+		return key, nil
+
+	case "EC":
+		curve, exists := _jwkCurves[k.Crv]
+		if !exists {
+			return nil, invalid("curve %s is not supported", k.Crv)
+		}
+		d, err := field("d", k.D)
+		if err != nil {
+			return nil, err
+		}
+		defer clear(d)
+		x, err := field("x", k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := field("y", k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key, err := curve.NewPrivateKey(d)
+		if err != nil {
+			return nil, invalid("%v", err)
+		}
+		if string(key.PublicKey().Bytes()) != string(append(append([]byte{4}, x...), y...)) {
+			return nil, invalid("x and y don't match d")
+		}
+		return key, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, invalid("curve %s is not supported", k.Crv)
+		}
+		seed, err := field("d", k.D)
+		if err != nil {
+			return nil, err
+		}
+		defer clear(seed)
+		if len(seed) != ed25519.SeedSize {
+			return nil, invalid("d must be %d bytes", ed25519.SeedSize)
+		}
+		key := ed25519.NewKeyFromSeed(seed)
+		if x, err := field("x", k.X); err != nil {
+			return nil, err
+		} else if string(key.Public().(ed25519.PublicKey)) != string(x) {
+			return nil, invalid("x doesn't match d")
+		}
+		return key, nil
+	}
+	return nil, invalid("key type %s is not supported", k.Kty)
+}
+
+// jwkOf encodes a private key parsed by parsePKCS8 as a JSON Web Key
+func jwkOf(key crypto.PrivateKey) (jwk, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if len(key.Primes) != 2 {
+			return jwk{}, &KeyBlockError{Message: fmt.Sprintf(AsymmetricErrJWK, "multi-prime RSA keys are not supported")}
+		}
+		return jwk{
+			Kty: "RSA",
+			N:   encode(key.N.Bytes()),
+			E:   encode(big.NewInt(int64(key.E)).Bytes()),
+			D:   encode(key.D.Bytes()),
+			P:   encode(key.Primes[0].Bytes()),
+			Q:   encode(key.Primes[1].Bytes()),
+			DP:  encode(key.Precomputed.Dp.Bytes()),
+			DQ:  encode(key.Precomputed.Dq.Bytes()),
+			QI:  encode(key.Precomputed.Qinv.Bytes()),
+		}, nil
+	case *ecdsa.PrivateKey:
+		ecdhKey, err := key.ECDH()
+		if err != nil {
+			return jwk{}, &KeyBlockError{Message: fmt.Sprintf(AsymmetricErrJWK, err)}
+		}
+		public := ecdhKey.PublicKey().Bytes()
+		size := (len(public) - 1) / 2
+		return jwk{
+			Kty: "EC",
+			Crv: key.Curve.Params().Name,
+			X:   encode(public[1 : 1+size]),
+			Y:   encode(public[1+size:]),
+			D:   encode(ecdhKey.Bytes()),
+		}, nil
+	case ed25519.PrivateKey:
+		return jwk{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   encode(key.Public().(ed25519.PublicKey)),
+			D:   encode(key.Seed()),
+		}, nil
+	}
+	return jwk{}, &KeyBlockError{Message: fmt.Sprintf(AsymmetricErrKeyType, fmt.Sprintf("%T", key))}
+}
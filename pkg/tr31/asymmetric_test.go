@@ -0,0 +1,116 @@
+package tr31
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAsymmetricPKCS8JWK(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	kbpk := bytes.Repeat([]byte{0x89}, 32)
+	for _, tt := range []struct {
+		name      string
+		key       interface{}
+		algorithm string
+		kty       string
+	}{
+		{"RSA", rsaKey, ENC_ALGORITHM_RSA, "RSA"},
+		{"EC", ecKey, ENC_ALGORITHM_EC, "EC"},
+		{"Ed25519", edKey, ENC_ALGORITHM_EC, "OKP"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			der, err := x509.MarshalPKCS8PrivateKey(tt.key)
+			require.NoError(t, err)
+			pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+
+			header, _ := NewHeader(TR31_VERSION_D, "S0", tt.algorithm, "S", "00", "N")
+			kb, err := NewKeyBlock(kbpk, header)
+			require.NoError(t, err)
+			keyBlock, err := kb.WrapPKCS8(pemKey, nil)
+			require.NoError(t, err)
+
+			// The payload is the PKCS#8 DER encoding
+			kb, _ = New(kbpk)
+			key, err := kb.Unwrap(keyBlock)
+			require.NoError(t, err)
+			require.Equal(t, der, key)
+			unwrapped, err := kb.UnwrapPKCS8(keyBlock)
+			require.NoError(t, err)
+			require.Equal(t, pemKey, unwrapped)
+
+			jwkKey, err := kb.UnwrapJWK(keyBlock)
+			require.NoError(t, err)
+			var fields map[string]string
+			require.NoError(t, json.Unmarshal([]byte(jwkKey), &fields))
+			require.Equal(t, tt.kty, fields["kty"])
+
+			kb, _ = NewKeyBlock(kbpk, header)
+			keyBlock, err = kb.WrapJWK(jwkKey, nil)
+			require.NoError(t, err)
+			unwrapped, err = kb.UnwrapPKCS8(keyBlock)
+			require.NoError(t, err)
+			require.Equal(t, pemKey, unwrapped)
+		})
+	}
+
+	der, _ := x509.MarshalPKCS8PrivateKey(ecKey)
+	ecPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	rsaHeader, _ := NewHeader(TR31_VERSION_D, "S0", ENC_ALGORITHM_RSA, "S", "00", "N")
+	kb, _ := NewKeyBlock(kbpk, rsaHeader)
+
+	_, err = kb.WrapPKCS8(ecPEM, nil)
+	require.EqualError(t, err, "KeyBlockError: Private key type (EC) doesn't match algorithm R. Expecting algorithm E.")
+	_, err = kb.WrapPKCS8(string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})), nil)
+	require.EqualError(t, err, "KeyBlockError: Private key PEM is malformed. Expecting a PRIVATE KEY block.")
+	_, err = kb.WrapPKCS8(string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte{0x30, 0x00}})), nil)
+	require.ErrorContains(t, err, "Private key is not valid PKCS#8")
+
+	for jwkKey, expected := range map[string]string{
+		`{"kty":"oct","k":"AAAA"}`:                     "KeyBlockError: JWK is invalid: key type oct is not supported",
+		`{"kty":"RSA","n":"AQAB","e":"AQAB","d":"AQ"}`: "KeyBlockError: JWK is invalid: p is missing",
+		`{"kty":"EC","crv":"P-192","d":"AQ"}`:          "KeyBlockError: JWK is invalid: curve P-192 is not supported",
+		`{"kty":"OKP","crv":"Ed25519","d":"AQ"}`:       "KeyBlockError: JWK is invalid: d must be 32 bytes",
+		`{"kty":"EC","crv":"P-256","d":"!!"}`:          "KeyBlockError: JWK is invalid: d is not base64url",
+	} {
+		_, err := kb.WrapJWK(jwkKey, nil)
+		require.EqualError(t, err, expected)
+	}
+
+	// The public point has to match the private key
+	ecHeader, _ := NewHeader(TR31_VERSION_D, "S0", ENC_ALGORITHM_EC, "S", "00", "N")
+	kb, _ = NewKeyBlock(kbpk, ecHeader)
+	keyBlock, err := kb.WrapPKCS8(ecPEM, nil)
+	require.NoError(t, err)
+	jwkKey, err := kb.UnwrapJWK(keyBlock)
+	require.NoError(t, err)
+	var fields map[string]string
+	require.NoError(t, json.Unmarshal([]byte(jwkKey), &fields))
+	fields["x"], fields["y"] = fields["y"], fields["x"]
+	swapped, _ := json.Marshal(fields)
+	_, err = kb.WrapJWK(string(swapped), nil)
+	require.EqualError(t, err, "KeyBlockError: JWK is invalid: x and y don't match d")
+
+	// Symmetric key blocks aren't PKCS#8
+	header, _ := NewHeader(TR31_VERSION_D, "D0", ENC_ALGORITHM_AES, "D", "00", "E")
+	kb, _ = NewKeyBlock(kbpk, header)
+	keyBlock, err = kb.Wrap(bytes.Repeat([]byte{0x3c}, 16), nil)
+	require.NoError(t, err)
+	_, err = kb.UnwrapPKCS8(keyBlock)
+	require.ErrorContains(t, err, "Private key is not valid PKCS#8")
+}
@@ -0,0 +1,63 @@
+package tr31
+
+import "fmt"
+
+// Severity ranks audit findings
+type Severity string
+
+const (
+	// SEVERITY_INFO flags a configuration with a better alternative
+	SEVERITY_INFO Severity = "info"
+	// SEVERITY_WARNING flags a deprecated or loosely restricted configuration
+	SEVERITY_WARNING Severity = "warning"
+	// SEVERITY_CRITICAL flags a configuration that weakens the protected key
+	SEVERITY_CRITICAL Severity = "critical"
+)
+
+// Finding is a weak configuration reported by AuditConfig
+type Finding struct {
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+}
+
+// AuditConfig lints a header and the length of the KBPK protecting it for weak
+// configurations, such as a TDES KBPK protecting an AES key or the deprecated
+// key block version A. It returns no findings for a sound configuration.
+func AuditConfig(h *Header, kbpkLen int) []Finding {
+	var findings []Finding
+	add := func(severity Severity, message string) {
+		findings = append(findings, Finding{Severity: severity, Message: message})
+	}
+
+	if spec, _ := LookupVersion(h.VersionID); !containsInt(spec.KBPKLengths, kbpkLen) {
+		add(SEVERITY_CRITICAL, fmt.Sprintf(AuditKBPKLength, kbpkLen, h.VersionID))
+	}
+	if h.VersionID != TR31_VERSION_D && kbpkLen == 8 {
+		add(SEVERITY_CRITICAL, fmt.Sprintf(AuditSingleDESKBPK, kbpkLen))
+	}
+	if h.VersionID != TR31_VERSION_D && h.Algorithm == ENC_ALGORITHM_AES {
+		add(SEVERITY_CRITICAL, AuditTDESProtectingAES)
+	}
+	if h.Algorithm == ENC_ALGORITHM_DES {
+		add(SEVERITY_CRITICAL, DeprecationSingleDES)
+	}
+	switch h.VersionID {
+	case TR31_VERSION_A:
+		add(SEVERITY_WARNING, DeprecationVersionA)
+	case TR31_VERSION_C:
+		add(SEVERITY_INFO, AuditVariantBinding)
+	}
+	if h.Exportability == "E" && h.ModeOfUse == "N" {
+		add(SEVERITY_WARNING, AuditExportableAnyUse)
+	}
+	return findings
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
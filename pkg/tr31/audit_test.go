@@ -0,0 +1,44 @@
+package tr31
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   []string
+		kbpkLen  int
+		findings []Finding
+	}{
+		{"AES key block", []string{"D", "K0", "A", "B", "00", "N"}, 32, nil},
+		{"TDES key block", []string{"B", "P0", "T", "E", "00", "S"}, 24, nil},
+		{"TDES KBPK protecting AES key", []string{"B", "K0", "A", "B", "00", "N"}, 24, []Finding{
+			{SEVERITY_CRITICAL, AuditTDESProtectingAES},
+		}},
+		{"Version A with single DES", []string{"A", "D0", "D", "D", "00", "N"}, 8, []Finding{
+			{SEVERITY_CRITICAL, "Single DES KBPK (8 bytes) is too weak to protect keys."},
+			{SEVERITY_CRITICAL, DeprecationSingleDES},
+			{SEVERITY_WARNING, DeprecationVersionA},
+		}},
+		{"Version C", []string{"C", "P0", "T", "E", "00", "N"}, 16, []Finding{
+			{SEVERITY_INFO, AuditVariantBinding},
+		}},
+		{"Exportable for any use", []string{"D", "D0", "A", "N", "00", "E"}, 16, []Finding{
+			{SEVERITY_WARNING, AuditExportableAnyUse},
+		}},
+		{"KBPK length not valid", []string{"D", "D0", "A", "D", "00", "N"}, 8, []Finding{
+			{SEVERITY_CRITICAL, "KBPK length (8) is not valid for key block version D."},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewHeader(tt.header[0], tt.header[1], tt.header[2], tt.header[3], tt.header[4], tt.header[5])
+			assert.Nil(t, err)
+			assert.Equal(t, tt.findings, AuditConfig(h, tt.kbpkLen))
+		})
+	}
+}
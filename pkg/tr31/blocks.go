@@ -0,0 +1,254 @@
+package tr31
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/moov-io/tr31/pkg/charset"
+)
+
+// Character sets accepted by the optional blocks defined in X9.143
+const (
+	// BLOCK_CHARSET_HEX is used by blocks carrying identifiers and check values
+	BLOCK_CHARSET_HEX string = "0123456789ABCDEFabcdef"
+	// BLOCK_CHARSET_NUMERIC is used by blocks carrying version and pedigree digits
+	BLOCK_CHARSET_NUMERIC string = "0123456789"
+	// BLOCK_CHARSET_ALPHANUMERIC is used by blocks carrying time stamps
+	BLOCK_CHARSET_ALPHANUMERIC string = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	// BLOCK_CHARSET_BASE64 is used by blocks carrying encoded certificates
+	BLOCK_CHARSET_BASE64 string = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789+/="
+)
+
+// BlockValidator validates the data of an optional block before it is stored in a header.
+// It should return a *HeaderError describing the problem when the data is rejected.
+type BlockValidator func(blockID string, data string) error
+
+// CharsetBlockValidator returns a BlockValidator accepting only characters from charset.
+// The name is used in the error message to describe the expected character set.
+func CharsetBlockValidator(name string, charset string) BlockValidator {
+	return func(blockID string, data string) error {
+		if !isSubset(data, charset) {
+			return &HeaderError{
+				Message: fmt.Sprintf(BlockErrorDataCharset, blockID, name, data),
+			}
+		}
+		return nil
+	}
+}
+
+// _blockValidators maps the optional block IDs defined by X9.143 to the
+// character set their data must use. Blocks not listed here, including
+// proprietary blocks without a registered validator, must be ASCII printable.
+var _blockValidators = map[string]BlockValidator{
+	"BI": CharsetBlockValidator("hex", BLOCK_CHARSET_HEX),
+	"CT": CharsetBlockValidator("base64", BLOCK_CHARSET_BASE64),
+	"HM": CharsetBlockValidator("hex", BLOCK_CHARSET_HEX),
+	"IK": CharsetBlockValidator("hex", BLOCK_CHARSET_HEX),
+	"KC": CharsetBlockValidator("hex", BLOCK_CHARSET_HEX),
+	"KP": CharsetBlockValidator("hex", BLOCK_CHARSET_HEX),
+	"KS": CharsetBlockValidator("hex", BLOCK_CHARSET_HEX),
+	"TC": CharsetBlockValidator("alphanumeric", BLOCK_CHARSET_ALPHANUMERIC),
+	"TS": CharsetBlockValidator("alphanumeric", BLOCK_CHARSET_ALPHANUMERIC),
+	"WP": CharsetBlockValidator("numeric", BLOCK_CHARSET_NUMERIC),
+}
+
+var _blockValidatorsMtx sync.RWMutex
+
+// IsProprietaryBlockID reports whether blockID falls in the proprietary range
+// reserved by X9.143 for private use, which is any ID starting with a digit.
+func IsProprietaryBlockID(blockID string) bool {
+	return len(blockID) == 2 && charset.IsAlphanumeric(blockID) && blockID[0] >= '0' && blockID[0] <= '9'
+}
+
+// RegisterBlockValidator installs a custom validator for a proprietary block ID.
+// The validator replaces the default ASCII printable check, so it may accept a
+// wider or narrower character set than the default.
+// Passing a nil validator removes a previous registration.
+func RegisterBlockValidator(blockID string, validator BlockValidator) error {
+	if !IsProprietaryBlockID(blockID) {
+		return &HeaderError{
+			Message: fmt.Sprintf(BlockErrorIdNotProprietary, blockID),
+		}
+	}
+
+	_blockValidatorsMtx.Lock()
+	defer _blockValidatorsMtx.Unlock()
+	if validator == nil {
+		delete(_blockValidators, blockID)
+		return nil
+	}
+	_blockValidators[blockID] = validator
+	return nil
+}
+
+// validateBlockData checks block data against the validator registered for the
+// block ID, falling back to the ASCII printable check.
+func validateBlockData(blockID string, data string) error {
+	_blockValidatorsMtx.RLock()
+	validator, exists := _blockValidators[blockID]
+	_blockValidatorsMtx.RUnlock()
+
+	if exists {
+		return validator(blockID, data)
+	}
+	if !charset.IsPrintable(data) {
+		return &HeaderError{
+			Message: fmt.Sprintf(BlockErrorDataInvalid, blockID, data),
+		}
+	}
+	return nil
+}
+
+// ProprietaryBlockHandler is implemented by integrators to describe a proprietary
+// optional block. A registered handler validates block data when it is set on a
+// header, converts between block data and a typed value, and documents the block
+// for header inspection.
+type ProprietaryBlockHandler interface {
+	// Description returns a short human readable description of the block
+	Description() string
+	// Validate checks block data before it is stored in a header
+	Validate(data string) error
+	// Marshal converts a typed value into block data
+	Marshal(value interface{}) (string, error)
+	// Unmarshal converts block data into a typed value
+	Unmarshal(data string) (interface{}, error)
+}
+
+// _blockDescriptions documents the optional blocks defined by X9.143
+var _blockDescriptions = map[string]string{
+	"AL": "Asymmetric key life",
+	"BI": "Base derivation key identifier",
+	"CT": "Public key certificate",
+	"DA": "Derivations allowed",
+	"HM": "HMAC hash algorithm",
+	"IK": "Initial key identifier",
+	"KC": "Key check value of wrapped key",
+	"KP": "Key check value of KBPK",
+	"KS": "Initial key serial number",
+	"KV": "Key block values",
+	"LB": "Label",
+	"PB": "Padding block",
+	"TC": "Time of creation",
+	"TS": "Time stamp",
+	"WP": "Wrapping pedigree",
+}
+
+var (
+	_proprietaryBlocks    = map[string]ProprietaryBlockHandler{}
+	_proprietaryBlocksMtx sync.RWMutex
+)
+
+// BlockInfo describes an optional block found in a header
+type BlockInfo struct {
+	// ID is the two character block ID
+	ID string
+	// Data is the raw block data
+	Data string
+	// Description documents the block, empty when the block is unknown
+	Description string
+	// Proprietary is true when the ID is in the proprietary range
+	Proprietary bool
+	// Value is the typed value decoded by a registered proprietary handler, if any
+	Value interface{}
+}
+
+// RegisterProprietaryBlock installs a handler for a proprietary block ID.
+// The handler's Validate method is also registered as the block validator.
+// Passing a nil handler removes a previous registration.
+func RegisterProprietaryBlock(blockID string, handler ProprietaryBlockHandler) error {
+	if !IsProprietaryBlockID(blockID) {
+		return &HeaderError{
+			Message: fmt.Sprintf(BlockErrorIdNotProprietary, blockID),
+		}
+	}
+
+	if handler == nil {
+		_proprietaryBlocksMtx.Lock()
+		delete(_proprietaryBlocks, blockID)
+		_proprietaryBlocksMtx.Unlock()
+		return RegisterBlockValidator(blockID, nil)
+	}
+
+	_proprietaryBlocksMtx.Lock()
+	_proprietaryBlocks[blockID] = handler
+	_proprietaryBlocksMtx.Unlock()
+	return RegisterBlockValidator(blockID, func(_ string, data string) error {
+		return handler.Validate(data)
+	})
+}
+
+// LookupProprietaryBlock returns the handler registered for a proprietary block ID
+func LookupProprietaryBlock(blockID string) (ProprietaryBlockHandler, bool) {
+	_proprietaryBlocksMtx.RLock()
+	defer _proprietaryBlocksMtx.RUnlock()
+	handler, exists := _proprietaryBlocks[blockID]
+	return handler, exists
+}
+
+// DescribeBlock returns the documentation string of a defined or registered proprietary block ID
+func DescribeBlock(blockID string) string {
+	if handler, exists := LookupProprietaryBlock(blockID); exists {
+		return handler.Description()
+	}
+	return _blockDescriptions[blockID]
+}
+
+// SetValue marshals a typed value with the handler registered for the
+// proprietary block ID and stores the result in the container
+func (b *Blocks) SetValue(key string, value interface{}) error {
+	handler, exists := LookupProprietaryBlock(key)
+	if !exists {
+		return &HeaderError{
+			Message: fmt.Sprintf(BlockErrorNoHandler, key),
+		}
+	}
+	data, err := handler.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return b.Set(key, data)
+}
+
+// GetValue retrieves a proprietary block and unmarshals it with the registered handler
+func (b *Blocks) GetValue(key string) (interface{}, error) {
+	handler, exists := LookupProprietaryBlock(key)
+	if !exists {
+		return nil, &HeaderError{
+			Message: fmt.Sprintf(BlockErrorNoHandler, key),
+		}
+	}
+	data, err := b.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return handler.Unmarshal(data)
+}
+
+// Inspect describes every block in the container ordered by block ID.
+// Proprietary blocks with a registered handler include their decoded value,
+// blocks whose data cannot be decoded are reported without a value.
+func (b *Blocks) Inspect() []BlockInfo {
+	ids := make([]string, 0, len(b._blocks))
+	for id := range b._blocks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	infos := make([]BlockInfo, 0, len(ids))
+	for _, id := range ids {
+		info := BlockInfo{
+			ID:          id,
+			Data:        b._blocks[id],
+			Description: DescribeBlock(id),
+			Proprietary: IsProprietaryBlockID(id),
+		}
+		if handler, exists := LookupProprietaryBlock(id); exists {
+			if value, err := handler.Unmarshal(info.Data); err == nil {
+				info.Value = value
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
@@ -0,0 +1,172 @@
+package tr31
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/moov-io/tr31/pkg/charset"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlocksSetCharset(t *testing.T) {
+	tests := []struct {
+		name          string
+		blockID       string
+		data          string
+		expectedError string
+	}{
+		{"Hex key set identifier", "KS", "00604B120F9292800000", ""},
+		{"Lowercase hex key set identifier", "KS", "00604b120f9292800000", ""},
+		{"Non hex key set identifier", "KS", "00604B120F929280000Z", "Block KS data is invalid. Expecting hex characters. Data: '00604B120F929280000Z'"},
+		{"Base64 certificate", "CT", "MIIBCgKCAQEA+/=", ""},
+		{"Certificate with space", "CT", "MIIB CgKCAQEA", "Block CT data is invalid. Expecting base64 characters. Data: 'MIIB CgKCAQEA'"},
+		{"Numeric wrapping pedigree", "WP", "0002", ""},
+		{"Non numeric wrapping pedigree", "WP", "00A2", "Block WP data is invalid. Expecting numeric characters. Data: '00A2'"},
+		{"Time stamp", "TS", "20240101120000Z", ""},
+		{"Time stamp with separators", "TS", "2024-01-01", "Block TS data is invalid. Expecting alphanumeric characters. Data: '2024-01-01'"},
+		{"Lowercase label", "LB", "my key label", ""},
+		{"Label with control character", "LB", "label\n", "Block LB data is invalid. Expecting ASCII printable characters. Data: 'label\n'"},
+		{"Proprietary block defaults to printable", "1A", "any printable ~ data", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocks := NewBlocks()
+			err := blocks.Set(tt.blockID, tt.data)
+			if tt.expectedError == "" {
+				assert.Nil(t, err)
+				assert.Equal(t, true, blocks.Contains(tt.blockID))
+				return
+			}
+			assert.IsType(t, &HeaderError{}, err)
+			if headerErr, ok := err.(*HeaderError); ok {
+				assert.Equal(t, tt.expectedError, headerErr.Message)
+			}
+			assert.Equal(t, false, blocks.Contains(tt.blockID))
+		})
+	}
+}
+
+func TestIsProprietaryBlockID(t *testing.T) {
+	tests := []struct {
+		blockID string
+		want    bool
+	}{
+		{"1A", true},
+		{"9Z", true},
+		{"00", true},
+		{"KS", false},
+		{"A1", false},
+		{"1", false},
+		{"1A2", false},
+		{"1*", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.blockID, func(t *testing.T) {
+			assert.Equal(t, tt.want, IsProprietaryBlockID(tt.blockID))
+		})
+	}
+}
+
+func TestRegisterBlockValidator(t *testing.T) {
+	err := RegisterBlockValidator("KS", CharsetBlockValidator("numeric", BLOCK_CHARSET_NUMERIC))
+	assert.IsType(t, &HeaderError{}, err)
+	assert.Equal(t, "HeaderError: Block ID (KS) is not in the proprietary range. Expecting a numeric first character.", err.Error())
+
+	// Extended character set beyond ASCII printable
+	extended := func(blockID string, data string) error {
+		if strings.ContainsRune(data, '\x00') {
+			return &HeaderError{Message: fmt.Sprintf("Block %s data contains NUL.", blockID)}
+		}
+		return nil
+	}
+	assert.Nil(t, RegisterBlockValidator("1E", extended))
+	defer RegisterBlockValidator("1E", nil)
+
+	blocks := NewBlocks()
+	assert.Nil(t, blocks.Set("1E", "tab\tseparated"))
+	err = blocks.Set("1E", "nul\x00")
+	assert.Equal(t, "HeaderError: Block 1E data contains NUL.", err.Error())
+
+	// Removing the validator restores the printable check
+	assert.Nil(t, RegisterBlockValidator("1E", nil))
+	err = blocks.Set("1E", "tab\tseparated")
+	assert.IsType(t, &HeaderError{}, err)
+}
+
+// terminalIDBlock is a sample proprietary block carrying a numeric terminal ID
+type terminalIDBlock struct{}
+
+func (terminalIDBlock) Description() string {
+	return "Terminal identifier"
+}
+
+func (terminalIDBlock) Validate(data string) error {
+	if len(data) != 8 || !charset.IsNumeric(data) {
+		return &HeaderError{Message: fmt.Sprintf("Terminal identifier (%s) is invalid.", data)}
+	}
+	return nil
+}
+
+func (terminalIDBlock) Marshal(value interface{}) (string, error) {
+	id, ok := value.(int)
+	if !ok {
+		return "", &HeaderError{Message: fmt.Sprintf("Terminal identifier type (%T) is invalid.", value)}
+	}
+	return fmt.Sprintf("%08d", id), nil
+}
+
+func (terminalIDBlock) Unmarshal(data string) (interface{}, error) {
+	return stringToInt(data), nil
+}
+
+func TestRegisterProprietaryBlock(t *testing.T) {
+	err := RegisterProprietaryBlock("TI", terminalIDBlock{})
+	assert.IsType(t, &HeaderError{}, err)
+
+	assert.Nil(t, RegisterProprietaryBlock("1T", terminalIDBlock{}))
+	defer RegisterProprietaryBlock("1T", nil)
+
+	handler, exists := LookupProprietaryBlock("1T")
+	assert.Equal(t, true, exists)
+	assert.Equal(t, "Terminal identifier", handler.Description())
+	assert.Equal(t, "Terminal identifier", DescribeBlock("1T"))
+	assert.Equal(t, "Label", DescribeBlock("LB"))
+	assert.Equal(t, "", DescribeBlock("2T"))
+
+	blocks := NewBlocks()
+	assert.Nil(t, blocks.SetValue("1T", 1234))
+	data, _ := blocks.Get("1T")
+	assert.Equal(t, "00001234", data)
+	value, err := blocks.GetValue("1T")
+	assert.Nil(t, err)
+	assert.Equal(t, 1234, value)
+
+	// Validation comes from the handler
+	err = blocks.Set("1T", "1234")
+	assert.Equal(t, "HeaderError: Terminal identifier (1234) is invalid.", err.Error())
+	err = blocks.SetValue("1T", "1234")
+	assert.Equal(t, "HeaderError: Terminal identifier type (string) is invalid.", err.Error())
+
+	// Blocks without a handler cannot be set or read as typed values
+	err = blocks.SetValue("2T", 1)
+	assert.Equal(t, "HeaderError: Block ID (2T) has no registered proprietary handler.", err.Error())
+	_, err = blocks.GetValue("2T")
+	assert.Equal(t, "HeaderError: Block ID (2T) has no registered proprietary handler.", err.Error())
+
+	assert.Nil(t, blocks.Set("LB", "label"))
+	assert.Nil(t, blocks.Set("2T", "opaque"))
+	assert.Equal(t, []BlockInfo{
+		{ID: "1T", Data: "00001234", Description: "Terminal identifier", Proprietary: true, Value: 1234},
+		{ID: "2T", Data: "opaque", Description: "", Proprietary: true},
+		{ID: "LB", Data: "label", Description: "Label"},
+	}, blocks.Inspect())
+
+	// Unregistering the handler also removes its validator
+	assert.Nil(t, RegisterProprietaryBlock("1T", nil))
+	_, exists = LookupProprietaryBlock("1T")
+	assert.Equal(t, false, exists)
+	assert.Nil(t, blocks.Set("1T", "1234"))
+}
@@ -0,0 +1,107 @@
+package tr31
+
+import (
+	"crypto/aes"
+	"crypto/des"
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+// CBCError is returned for CBC inputs which can't be encrypted or decrypted,
+// such as an IV which isn't one cipher block long
+type CBCError struct {
+	Message string
+}
+
+// Error method to implement the error interface for CBCError.
+func (e *CBCError) Error() string {
+	return fmt.Sprintf("CBCError: %s", e.Message)
+}
+
+const (
+	CBCErrCipher     string = "cipher (%d) is not supported"
+	CBCErrIVLength   string = "IV length (%d) must be the block size of %s (%d)"
+	CBCErrDataLength string = "data length (%d) must be a non-zero multiple of the block size of %s (%d)"
+	CBCErrIVSource   string = "reading a random IV: %v"
+)
+
+// cbcCipher returns the name and block size of the algorithm
+func cbcCipher(algorithm Algorithm) (string, int, error) {
+	switch algorithm {
+	case DES:
+		return "DES", des.BlockSize, nil
+	case AES:
+		return "AES", aes.BlockSize, nil
+	}
+	return "", 0, &CBCError{Message: fmt.Sprintf(CBCErrCipher, algorithm)}
+}
+
+// IVLength returns the length in bytes of the CBC IVs of the algorithm, its
+// block size: 8 for DES and TDES, 16 for AES
+func IVLength(algorithm Algorithm) (int, error) {
+	_, blockSize, err := cbcCipher(algorithm)
+	return blockSize, err
+}
+
+// checkCBCInput checks the IV is one block long and data a whole number of blocks
+func checkCBCInput(algorithm Algorithm, iv, data []byte) error {
+	name, blockSize, err := cbcCipher(algorithm)
+	if err != nil {
+		return err
+	}
+	if len(iv) != blockSize {
+		return &CBCError{Message: fmt.Sprintf(CBCErrIVLength, len(iv), name, blockSize)}
+	}
+	if len(data) == 0 || len(data)%blockSize != 0 {
+		return &CBCError{Message: fmt.Sprintf(CBCErrDataLength, len(data), name, blockSize)}
+	}
+	return nil
+}
+
+// EncryptCBC encrypts data, a whole number of blocks, in CBC mode under a DES,
+// TDES or AES key with an explicit IV of IVLength bytes. Unless a protocol
+// fixes the IV, such as the MAC of version B and D key blocks, the IV must be
+// unpredictable and never reused with the key: use EncryptCBCRandomIV.
+func EncryptCBC(algorithm Algorithm, key, iv, data []byte) ([]byte, error) {
+	if err := checkCBCInput(algorithm, iv, data); err != nil {
+		return nil, err
+	}
+	if algorithm == AES {
+		return EncryptAESCBC(key, iv, data)
+	}
+	return EncryptTDESCBC(key, iv, data)
+}
+
+// DecryptCBC decrypts data encrypted with EncryptCBC with the same IV
+func DecryptCBC(algorithm Algorithm, key, iv, data []byte) ([]byte, error) {
+	if err := checkCBCInput(algorithm, iv, data); err != nil {
+		return nil, err
+	}
+	if algorithm == AES {
+		return DecryptAESCBC(key, iv, data)
+	}
+	return DecryptTDESCBC(key, iv, data)
+}
+
+// EncryptCBCRandomIV encrypts data like EncryptCBC with a fresh IV read from
+// random, crypto/rand when nil. The IV is returned to be sent along with the
+// ciphertext, it isn't secret.
+func EncryptCBCRandomIV(algorithm Algorithm, key, data []byte, random io.Reader) (iv, ciphertext []byte, err error) {
+	length, err := IVLength(algorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+	if random == nil {
+		random = rand.Reader
+	}
+	iv = make([]byte, length)
+	if _, err := io.ReadFull(random, iv); err != nil {
+		return nil, nil, &CBCError{Message: fmt.Sprintf(CBCErrIVSource, err)}
+	}
+	ciphertext, err = EncryptCBC(algorithm, key, iv, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return iv, ciphertext, nil
+}
@@ -0,0 +1,98 @@
+package tr31
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIVLength(t *testing.T) {
+	length, err := IVLength(DES)
+	require.NoError(t, err)
+	assert.Equal(t, 8, length)
+	length, err = IVLength(AES)
+	require.NoError(t, err)
+	assert.Equal(t, 16, length)
+
+	_, err = IVLength(Algorithm(7))
+	var cbcErr *CBCError
+	assert.ErrorAs(t, err, &cbcErr)
+}
+
+func TestEncryptCBC(t *testing.T) {
+	// NIST SP 800-38A F.2.1, CBC-AES128.Encrypt
+	key, _ := hex.DecodeString("2b7e151628aed2a6abf7158809cf4f3c")
+	iv, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	plaintext, _ := hex.DecodeString("6bc1bee22e409f96e93d7e117393172a")
+	ciphertext, err := EncryptCBC(AES, key, iv, plaintext)
+	require.NoError(t, err)
+	assert.Equal(t, "7649abac8119b246cee98e9b12e9197d", hex.EncodeToString(ciphertext))
+	decrypted, err := DecryptCBC(AES, key, iv, ciphertext)
+	require.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	tdesKey, _ := hex.DecodeString("0123456789ABCDEFFEDCBA9876543210")
+	tdesIV := bytes.Repeat([]byte{0x11}, 8)
+	ciphertext, err = EncryptCBC(DES, tdesKey, tdesIV, plaintext)
+	require.NoError(t, err)
+	decrypted, err = DecryptCBC(DES, tdesKey, tdesIV, ciphertext)
+	require.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	tests := []struct {
+		name      string
+		algorithm Algorithm
+		iv        []byte
+		data      []byte
+	}{
+		{"AES with a TDES IV", AES, tdesIV, plaintext},
+		{"TDES with an AES IV", DES, iv, plaintext},
+		{"missing IV", AES, nil, plaintext},
+		{"empty data", AES, iv, nil},
+		{"partial block", DES, tdesIV, plaintext[:12]},
+		{"unknown cipher", Algorithm(7), iv, plaintext},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cbcErr *CBCError
+			_, err := EncryptCBC(tt.algorithm, key, tt.iv, tt.data)
+			assert.ErrorAs(t, err, &cbcErr)
+			_, err = DecryptCBC(tt.algorithm, key, tt.iv, tt.data)
+			assert.ErrorAs(t, err, &cbcErr)
+		})
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("source unavailable")
+}
+
+func TestEncryptCBCRandomIV(t *testing.T) {
+	key, _ := hex.DecodeString("2b7e151628aed2a6abf7158809cf4f3c")
+	plaintext := bytes.Repeat([]byte{0x42}, 32)
+
+	iv, ciphertext, err := EncryptCBCRandomIV(AES, key, plaintext, nil)
+	require.NoError(t, err)
+	assert.Len(t, iv, 16)
+	otherIV, otherCiphertext, err := EncryptCBCRandomIV(AES, key, plaintext, nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, iv, otherIV)
+	assert.NotEqual(t, ciphertext, otherCiphertext)
+	decrypted, err := DecryptCBC(AES, key, iv, ciphertext)
+	require.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	iv, _, err = EncryptCBCRandomIV(DES, key, plaintext, bytes.NewReader(bytes.Repeat([]byte{0x07}, 8)))
+	require.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{0x07}, 8), iv)
+
+	var cbcErr *CBCError
+	_, _, err = EncryptCBCRandomIV(AES, key, plaintext, failingReader{})
+	assert.ErrorAs(t, err, &cbcErr)
+}
@@ -0,0 +1,134 @@
+//go:build conformance
+
+package tr31
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/hex"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type conformanceCase struct {
+	KBPK         string `json:"kbpk"`
+	Header       string `json:"header"`
+	Key          string `json:"key"`
+	MaskedKeyLen int    `json:"maskedKeyLen"`
+}
+
+// conformanceCases draws key blocks of every built-in version from r, with
+// and without optional blocks and key length masking
+func conformanceCases(t *testing.T, r *rand.Rand, n int) []conformanceCase {
+	t.Helper()
+
+	configs := []struct {
+		versionID, algorithm string
+		keyLengths           []int
+	}{
+		{TR31_VERSION_A, ENC_ALGORITHM_TRIPLE_DES, []int{16, 24}},
+		{TR31_VERSION_B, ENC_ALGORITHM_TRIPLE_DES, []int{16, 24}},
+		{TR31_VERSION_C, ENC_ALGORITHM_TRIPLE_DES, []int{16, 24}},
+		{TR31_VERSION_D, ENC_ALGORITHM_TRIPLE_DES, []int{16, 24}},
+		{TR31_VERSION_D, ENC_ALGORITHM_AES, []int{16, 24, 32}},
+	}
+	usages := []string{"D0", "K0", "P0"}
+
+	var cases []conformanceCase
+	for i := 0; i < n; i++ {
+		config := configs[i%len(configs)]
+		spec, _ := LookupVersion(config.versionID)
+		kbpk := make([]byte, spec.KBPKLengths[r.Intn(len(spec.KBPKLengths))])
+		r.Read(kbpk)
+		key := make([]byte, config.keyLengths[r.Intn(len(config.keyLengths))])
+		r.Read(key)
+		maskedKeyLen := len(key)
+		if r.Intn(2) == 0 {
+			algorithm, _ := LookupAlgorithm(config.algorithm)
+			maskedKeyLen = algorithm.MaxKeyLen
+		}
+
+		h, err := NewHeader(config.versionID, usages[r.Intn(len(usages))], config.algorithm, "E", "00", "N")
+		assert.NoError(t, err)
+		if r.Intn(2) == 0 {
+			ks := make([]byte, 10)
+			r.Read(ks)
+			assert.NoError(t, h.Blocks.Set("KS", hex.EncodeToString(ks)))
+		}
+		header, err := h.Dump(maskedKeyLen)
+		assert.NoError(t, err)
+
+		cases = append(cases, conformanceCase{
+			KBPK:         hex.EncodeToString(kbpk),
+			Header:       header,
+			Key:          hex.EncodeToString(key),
+			MaskedKeyLen: maskedKeyLen,
+		})
+	}
+	return cases
+}
+
+// psecWrap wraps the cases with the psec reference implementation, skipping the
+// test when the Python interpreter in TR31_PSEC_PYTHON (python3 by default)
+// doesn't have psec installed
+func psecWrap(t *testing.T, cases []conformanceCase) []string {
+	t.Helper()
+
+	python := cmp.Or(os.Getenv("TR31_PSEC_PYTHON"), "python3")
+	if err := exec.Command(python, "-c", "import psec.tr31").Run(); err != nil {
+		t.Skipf("psec is not available to %s: %v", python, err)
+	}
+
+	input, err := json.Marshal(cases)
+	assert.NoError(t, err)
+	cmd := exec.Command(python, filepath.Join("testdata", "conformance", "psec_wrap.py"))
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("running psec: %v", err)
+	}
+
+	var blocks []string
+	assert.NoError(t, json.Unmarshal(output, &blocks))
+	assert.Len(t, blocks, len(cases))
+	return blocks
+}
+
+// TestConformancePsec compares the key blocks wrapped by this package with the
+// ones wrapped by psec (https://github.com/knovichikhin/psec) given the same
+// padding, and checks this package unwraps the psec key blocks.
+// Run with: go test -tags conformance ./pkg/tr31 -run TestConformancePsec
+func TestConformancePsec(t *testing.T) {
+	cases := conformanceCases(t, rand.New(rand.NewSource(31)), 100)
+	expected := psecWrap(t, cases)
+
+	for i, c := range cases {
+		kbpk, _ := hex.DecodeString(c.KBPK)
+		key, _ := hex.DecodeString(c.Key)
+
+		kb, err := NewKeyBlockFromString(kbpk, c.Header)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		kb.SetEntropySource(patternSource{})
+		maskedKeyLen := c.MaskedKeyLen
+		block, err := kb.Wrap(key, &maskedKeyLen)
+		if assert.NoError(t, err, "case %d", i) {
+			assert.Equal(t, expected[i], block, "case %d: header %s, KBPK %s, key %s", i, c.Header, c.KBPK, c.Key)
+		}
+
+		received, err := NewKeyBlock(kbpk, nil)
+		assert.NoError(t, err)
+		unwrapped, err := received.Unwrap(expected[i])
+		if assert.NoError(t, err, "case %d: unwrapping %s", i, expected[i]) {
+			assert.Equal(t, key, unwrapped, "case %d", i)
+		}
+	}
+}
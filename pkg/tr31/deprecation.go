@@ -0,0 +1,121 @@
+package tr31
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// SingleDESPolicy controls wrapping keys with algorithm D (single DES)
+type SingleDESPolicy int
+
+const (
+	// SINGLE_DES_WARN wraps single DES keys and reports a warning, the default
+	SINGLE_DES_WARN SingleDESPolicy = iota
+	// SINGLE_DES_REJECT refuses to wrap single DES keys
+	SINGLE_DES_REJECT
+)
+
+// SingleDESKBPKPolicy controls wrapping and unwrapping under single DES (8 byte)
+// KBPKs, which key block versions A and C accept
+type SingleDESKBPKPolicy int
+
+const (
+	// SINGLE_DES_KBPK_REJECT refuses single DES KBPKs, the default
+	SINGLE_DES_KBPK_REJECT SingleDESKBPKPolicy = iota
+	// SINGLE_DES_KBPK_ALLOW accepts single DES KBPKs, reporting a warning for every operation
+	SINGLE_DES_KBPK_ALLOW
+)
+
+var (
+	_singleDESPolicy     SingleDESPolicy
+	_singleDESKBPKPolicy SingleDESKBPKPolicy
+	_warningHandler      func(message string)
+	_deprecationMtx      sync.RWMutex
+
+	// _legacyStrengthOperations counts the operations protected by single DES
+	_legacyStrengthOperations atomic.Uint64
+)
+
+// SetSingleDESPolicy changes how Wrap handles keys with algorithm D
+func SetSingleDESPolicy(policy SingleDESPolicy) {
+	_deprecationMtx.Lock()
+	defer _deprecationMtx.Unlock()
+	_singleDESPolicy = policy
+}
+
+// SetSingleDESKBPKPolicy changes how key blocks handle single DES KBPKs
+func SetSingleDESKBPKPolicy(policy SingleDESKBPKPolicy) {
+	_deprecationMtx.Lock()
+	defer _deprecationMtx.Unlock()
+	_singleDESKBPKPolicy = policy
+}
+
+// LegacyStrengthOperations returns the number of single DES keys wrapped and of
+// keys wrapped or unwrapped under single DES KBPKs since the program started,
+// for security teams to measure the single DES protection left to drive out
+func LegacyStrengthOperations() uint64 {
+	return _legacyStrengthOperations.Load()
+}
+
+// warn reports a deprecation warning to the installed handler
+func warn(message string) {
+	_deprecationMtx.RLock()
+	handler := _warningHandler
+	_deprecationMtx.RUnlock()
+	if handler != nil {
+		handler(message)
+	}
+}
+
+// SetWarningHandler installs a function receiving deprecation warnings raised
+// while wrapping keys. Warnings are dropped when no handler is installed.
+func SetWarningHandler(handler func(message string)) {
+	_deprecationMtx.Lock()
+	defer _deprecationMtx.Unlock()
+	_warningHandler = handler
+}
+
+// checkSingleDES applies the single DES policy before wrapping a key with algorithm D
+func checkSingleDES(key []byte, policy SingleDESPolicy) error {
+	des, _ := LookupAlgorithm(ENC_ALGORITHM_DES)
+	if len(key) > des.MaxKeyLen {
+		return &KeyBlockError{
+			Message: fmt.Sprintf(BlockErrorDESKeyLen, len(key), des.MaxKeyLen),
+		}
+	}
+
+	if policy == SINGLE_DES_REJECT {
+		return &KeyBlockError{Message: BlockErrorDESRejected}
+	}
+	_legacyStrengthOperations.Add(1)
+	warn(DeprecationSingleDES)
+	return nil
+}
+
+// checkSingleDESKBPK applies the single DES KBPK policy before wrapping or
+// unwrapping under the KBPK of the key block
+func (kb *KeyBlock) checkSingleDESKBPK() error {
+	if len(kb.kbpk) != 8 {
+		return nil
+	}
+	if kb.effectivePolicy().SingleDESKBPK == SINGLE_DES_KBPK_REJECT {
+		return &KeyBlockError{Message: BlockErrorDESKBPKRejected}
+	}
+	_legacyStrengthOperations.Add(1)
+	warn(DeprecationSingleDESKBPK)
+	return nil
+}
+
+// Deprecations lists the deprecated features used by the header, such as
+// single DES keys or key block version A, for display when inspecting key blocks
+func (h *Header) Deprecations() []string {
+	var deprecations []string
+	if h.VersionID == TR31_VERSION_A {
+		deprecations = append(deprecations, DeprecationVersionA)
+	}
+	if h.Algorithm == ENC_ALGORITHM_DES {
+		deprecations = append(deprecations, DeprecationSingleDES)
+	}
+	return deprecations
+}
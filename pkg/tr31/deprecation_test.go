@@ -0,0 +1,88 @@
+package tr31
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSingleDESPolicy(t *testing.T) {
+	var warnings []string
+	SetWarningHandler(func(message string) {
+		warnings = append(warnings, message)
+	})
+	defer SetWarningHandler(nil)
+
+	header, _ := NewHeader("B", "D0", "D", "D", "00", "N")
+	kb, _ := NewKeyBlock(bytes.Repeat([]byte("E"), 24), header)
+
+	_, err := kb.Wrap(bytes.Repeat([]byte{0x11}, 8), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Algorithm D (single DES) is deprecated."}, warnings)
+
+	_, err = kb.Wrap(bytes.Repeat([]byte{0x11}, 16), nil)
+	assert.Equal(t, "KeyBlockError: Key length (16) exceeds 8 bytes allowed for single DES (algorithm D).", err.Error())
+
+	SetSingleDESPolicy(SINGLE_DES_REJECT)
+	defer SetSingleDESPolicy(SINGLE_DES_WARN)
+	_, err = kb.Wrap(bytes.Repeat([]byte{0x11}, 8), nil)
+	assert.Equal(t, "KeyBlockError: Wrapping single DES (algorithm D) keys is rejected by policy.", err.Error())
+
+	// Triple DES keys are not affected
+	assert.Nil(t, header.SetAlgorithm("T"))
+	_, err = kb.Wrap(bytes.Repeat([]byte{0x11}, 16), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(warnings))
+}
+
+func TestHeaderDeprecations(t *testing.T) {
+	header, _ := NewHeader("A", "D0", "D", "D", "00", "N")
+	assert.Equal(t, []string{DeprecationVersionA, DeprecationSingleDES}, header.Deprecations())
+
+	header, _ = NewHeader("D", "D0", "A", "D", "00", "N")
+	assert.Nil(t, header.Deprecations())
+}
+
+func TestSingleDESKBPKPolicy(t *testing.T) {
+	var warnings []string
+	SetWarningHandler(func(message string) {
+		warnings = append(warnings, message)
+	})
+	defer SetWarningHandler(nil)
+
+	kbpk := bytes.Repeat([]byte{0x2a}, 8)
+	header, _ := NewHeader("C", "D0", "T", "D", "00", "N")
+	kb, _ := NewKeyBlock(kbpk, header)
+	key := bytes.Repeat([]byte{0x11}, 16)
+
+	// Single DES KBPKs are rejected by default
+	_, err := kb.Wrap(key, nil)
+	assert.Equal(t, "KeyBlockError: Single DES KBPKs (8 bytes) are rejected by policy.", err.Error())
+
+	before := LegacyStrengthOperations()
+	SetSingleDESKBPKPolicy(SINGLE_DES_KBPK_ALLOW)
+	keyBlock, err := kb.Wrap(key, nil)
+	assert.Nil(t, err)
+	unwrapped, err := kb.Unwrap(keyBlock)
+	assert.Nil(t, err)
+	assert.Equal(t, key, unwrapped)
+	assert.Equal(t, before+2, LegacyStrengthOperations())
+	assert.Equal(t, []string{DeprecationSingleDESKBPK, DeprecationSingleDESKBPK}, warnings)
+
+	SetSingleDESKBPKPolicy(SINGLE_DES_KBPK_REJECT)
+	_, err = kb.Unwrap(keyBlock)
+	assert.Equal(t, "KeyBlockError: Single DES KBPKs (8 bytes) are rejected by policy.", err.Error())
+
+	// A key block policy overrides the package one
+	allowed, _ := New(kbpk, WithPolicy(Policy{SingleDESKBPK: SINGLE_DES_KBPK_ALLOW}))
+	_, err = allowed.Unwrap(keyBlock)
+	assert.Nil(t, err)
+	assert.Equal(t, before+3, LegacyStrengthOperations())
+
+	// Double and triple length KBPKs are not affected
+	kb, _ = NewKeyBlock(bytes.Repeat([]byte{0x2a}, 16), header)
+	_, err = kb.Wrap(key, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, before+3, LegacyStrengthOperations())
+}
@@ -0,0 +1,64 @@
+package tr31
+
+import "fmt"
+
+// DerivationPreview holds the key check values of a KBPK and of the KBEK and
+// KBAK a key block version derives from it, see PreviewDerivation
+type DerivationPreview struct {
+	Version string
+	KBPKKCV string
+	KBEKKCV string
+	KBAKKCV string
+}
+
+// PreviewDerivation derives the KBEK and KBAK of key block version B or D from
+// kbpk and returns their key check values, never the keys. When a partner's key
+// blocks fail to unwrap with a MAC mismatch, both parties compare the previews
+// of the KBPK they hold: a different KBPK KCV means the KBPKs differ, the same
+// KBPK KCV with different KBEK or KBAK KCVs means the derivations differ. KCVs
+// are computed with TDES for version B and with AES for version D.
+func PreviewDerivation(kbpk []byte, version string) (*DerivationPreview, error) {
+	var algorithm string
+	switch version {
+	case TR31_VERSION_B:
+		if len(kbpk) != 16 && len(kbpk) != 24 {
+			return nil, &KeyBlockError{Message: fmt.Sprintf(BlockErrorKBKPLenNotMatched, len(kbpk), version)}
+		}
+		algorithm = ENC_ALGORITHM_TRIPLE_DES
+	case TR31_VERSION_D:
+		if len(kbpk) != 16 && len(kbpk) != 24 && len(kbpk) != 32 {
+			return nil, &KeyBlockError{Message: fmt.Sprintf(BlockErrorKBKPLenNotMatchedAES, len(kbpk))}
+		}
+		algorithm = ENC_ALGORITHM_AES
+	default:
+		return nil, &KeyBlockError{Message: fmt.Sprintf(DeriveErrVersion, version)}
+	}
+
+	kb, err := NewKeyBlock(kbpk, nil)
+	if err != nil {
+		return nil, err
+	}
+	var kbek, kbak []byte
+	if version == TR31_VERSION_B {
+		kbek, kbak, err = kb.BDerive()
+	} else {
+		kbek, kbak, err = kb.dDerive()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer clear(kbek)
+	defer clear(kbak)
+
+	preview := &DerivationPreview{Version: version}
+	if preview.KBPKKCV, err = KeyCheckValue(kbpk, algorithm); err != nil {
+		return nil, err
+	}
+	if preview.KBEKKCV, err = KeyCheckValue(kbek, algorithm); err != nil {
+		return nil, err
+	}
+	if preview.KBAKKCV, err = KeyCheckValue(kbak, algorithm); err != nil {
+		return nil, err
+	}
+	return preview, nil
+}
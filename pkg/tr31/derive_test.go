@@ -0,0 +1,46 @@
+package tr31
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreviewDerivation(t *testing.T) {
+	// The keys derived by the self-test vectors
+	cases := []struct {
+		version, algorithm, kbpk, kbek, kbak string
+	}{
+		{TR31_VERSION_B, ENC_ALGORITHM_TRIPLE_DES, "89E88CF7931444F334BD7547FC3F380C", "12802065300D49CAF1B22A561CBADD78", "EEB74C38D8E36CFD4DF269B857937CF6"},
+		{TR31_VERSION_D, ENC_ALGORITHM_AES, "88E1AB2A2E3DD38C1FA039A536500CC8", "DB605ED0B3B456610097B230A1A7A5EC", "71F8C080EFD46E8D72415E7EBE389445"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.version, func(t *testing.T) {
+			kcv := func(key string) string {
+				decoded, _ := hex.DecodeString(key)
+				kcv, err := KeyCheckValue(decoded, tc.algorithm)
+				require.NoError(t, err)
+				return kcv
+			}
+			kbpk, _ := hex.DecodeString(tc.kbpk)
+			preview, err := PreviewDerivation(kbpk, tc.version)
+			require.NoError(t, err)
+			require.Equal(t, &DerivationPreview{
+				Version: tc.version,
+				KBPKKCV: kcv(tc.kbpk),
+				KBEKKCV: kcv(tc.kbek),
+				KBAKKCV: kcv(tc.kbak),
+			}, preview)
+			require.Equal(t, tc.kbpk, fmt.Sprintf("%X", kbpk), "the KBPK is left as is")
+		})
+	}
+
+	_, err := PreviewDerivation(make([]byte, 16), TR31_VERSION_A)
+	require.EqualError(t, err, "KeyBlockError: Key derivation preview is for key block versions B and D. Received A.")
+	_, err = PreviewDerivation(make([]byte, 32), TR31_VERSION_B)
+	require.ErrorContains(t, err, "KBPK length (32) must be Double or Triple DES")
+	_, err = PreviewDerivation(make([]byte, 8), TR31_VERSION_D)
+	require.ErrorContains(t, err, "KBPK length (8) must be AES-128, AES-192 or AES-256")
+}
@@ -58,7 +58,8 @@ func bitsOn(b byte) int {
 	return count
 }
 
-// Encrypt3DESCBC encrypts plaintext using 3DES in CBC mode with the provided 16-byte key.
+// EncryptTDESCBC encrypts plaintext using 3DES in CBC mode with the provided 8, 16 or 24 byte
+// key and an 8 byte IV, see EncryptCBC
 func EncryptTDESCBC(key, iv, data []byte) ([]byte, error) {
 	if len(key) != 8 && len(key) != 16 && len(key) != 24 {
 		return nil, fmt.Errorf("key length must be 8, 16, 24 bytes")
@@ -70,7 +71,8 @@ func EncryptTDESCBC(key, iv, data []byte) ([]byte, error) {
 		return nil, fmt.Errorf("data length must be a multiple of 8")
 	}
 	// Create a 24-byte key for 3DES by appending the first 8 bytes of the key to itself.
-	desKey := append(key, key[:8]...)
+	// The key is capped so appending never writes into the caller's array.
+	desKey := append(key[:len(key):len(key)], key[:8]...)
 	if len(key) == 24 {
 		desKey = key
 	} else if len(key) == 8 {
@@ -89,7 +91,8 @@ func EncryptTDESCBC(key, iv, data []byte) ([]byte, error) {
 	return ciphertext, nil
 }
 
-// Decrypt3DESCBC decrypts ciphertext using 3DES in CBC mode with the provided 16-byte key and IV.
+// DecryptTDESCBC decrypts ciphertext using 3DES in CBC mode with the provided 8, 16 or 24 byte
+// key and an 8 byte IV, see DecryptCBC
 func DecryptTDESCBC(key, iv, data []byte) ([]byte, error) {
 	if len(key) != 8 && len(key) != 16 && len(key) != 24 {
 		return nil, fmt.Errorf("key length must be 8, 16, 24 bytes")
@@ -102,7 +105,8 @@ func DecryptTDESCBC(key, iv, data []byte) ([]byte, error) {
 	}
 
 	// Create a 24-byte key for 3DES by appending the first 8 bytes of the key to itself.
-	desKey := append(key, key[:8]...)
+	// The key is capped so appending never writes into the caller's array.
+	desKey := append(key[:len(key):len(key)], key[:8]...)
 	if len(key) == 24 {
 		desKey = key
 	} else if len(key) == 8 {
@@ -139,7 +143,8 @@ func EncryptTDSECB(key, data []byte) ([]byte, error) {
 		return nil, fmt.Errorf("Data length must be multiple of DES block size 8")
 	}
 	// Create a 24-byte key for 3DES by appending the first 8 bytes of the key to itself.
-	desKey := append(key, key[:8]...)
+	// The key is capped so appending never writes into the caller's array.
+	desKey := append(key[:len(key):len(key)], key[:8]...)
 	if len(key) == 24 {
 		desKey = key
 	} else if len(key) == 8 {
@@ -167,7 +172,7 @@ func DecryptTDSECB(key, data []byte) ([]byte, error) {
 	if len(data)%8 != 0 {
 		return nil, fmt.Errorf("Data length must be multiple of DES block size 8")
 	}
-	desKey := append(key, key[:8]...)
+	desKey := append(key[:len(key):len(key)], key[:8]...)
 	if len(key) == 24 {
 		desKey = key
 	} else if len(key) == 8 {
@@ -0,0 +1,112 @@
+package tr31
+
+import (
+	"sort"
+	"strings"
+)
+
+// _versionDescriptions describe the built-in key block versions
+var _versionDescriptions = map[string]string{
+	TR31_VERSION_A: "TDES variant binding, deprecated",
+	TR31_VERSION_B: "TDES key derivation binding",
+	TR31_VERSION_C: "TDES variant binding",
+	TR31_VERSION_D: "AES key derivation binding",
+}
+
+// _algorithmDescriptions describe the algorithms defined by X9.143
+var _algorithmDescriptions = map[string]string{
+	"A": "AES",
+	"D": "DEA (single DES), deprecated",
+	"E": "Elliptic curve",
+	"H": "HMAC",
+	"R": "RSA",
+	"S": "DSA",
+	"T": "Triple DEA (TDES)",
+}
+
+// _modeOfUseDescriptions describe the modes of use defined by X9.143
+var _modeOfUseDescriptions = map[string]string{
+	"B": "Both encrypt and decrypt, or wrap and unwrap",
+	"C": "Both generate and verify",
+	"D": "Decrypt or unwrap only",
+	"E": "Encrypt or wrap only",
+	"G": "Generate only",
+	"N": "No special restrictions",
+	"S": "Signature only",
+	"T": "Both sign and decrypt",
+	"V": "Verify only",
+	"X": "Key used to derive other keys",
+	"Y": "Key used to create key variants",
+}
+
+// _exportabilityDescriptions describe the exportability values defined by X9.143
+var _exportabilityDescriptions = map[string]string{
+	"E": "Exportable under a KEK in a form meeting X9.24",
+	"N": "Non-exportable",
+	"S": "Sensitive, exportable under a KEK in a form not meeting X9.24",
+}
+
+// DictionaryEntry is a header field value along with its meaning
+type DictionaryEntry struct {
+	Value       string `json:"value"`
+	Description string `json:"description"`
+}
+
+// KeyUsageEntry is a key usage along with the algorithms and modes of use a
+// key of that usage may have
+type KeyUsageEntry struct {
+	Value       string   `json:"value"`
+	Description string   `json:"description"`
+	Algorithms  []string `json:"algorithms"`
+	ModesOfUse  []string `json:"modesOfUse"`
+}
+
+// Dictionary lists the values of each header field defined by X9.143, the
+// tables a header builder offers to choose from. Values starting with a digit
+// are reserved for proprietary use and aren't listed.
+type Dictionary struct {
+	Versions      []DictionaryEntry `json:"versions"`
+	KeyUsages     []KeyUsageEntry   `json:"keyUsages"`
+	Algorithms    []DictionaryEntry `json:"algorithms"`
+	ModesOfUse    []DictionaryEntry `json:"modesOfUse"`
+	Exportability []DictionaryEntry `json:"exportability"`
+}
+
+// HeaderDictionary returns the header field values Lint accepts, sorted by
+// value. Versions lists every registered version, the ones registered with
+// RegisterVersion have no description.
+func HeaderDictionary() Dictionary {
+	dict := Dictionary{
+		Algorithms:    dictionaryEntries(_lintAlgorithms, _algorithmDescriptions),
+		ModesOfUse:    dictionaryEntries(_lintModesOfUse, _modeOfUseDescriptions),
+		Exportability: dictionaryEntries(_lintExportability, _exportabilityDescriptions),
+	}
+	for _, id := range RegisteredVersions() {
+		dict.Versions = append(dict.Versions, DictionaryEntry{Value: id, Description: _versionDescriptions[id]})
+	}
+
+	usages := make([]string, 0, len(_keyUsages))
+	for usage := range _keyUsages {
+		usages = append(usages, usage)
+	}
+	sort.Strings(usages)
+	for _, usage := range usages {
+		spec := _keyUsages[usage]
+		dict.KeyUsages = append(dict.KeyUsages, KeyUsageEntry{
+			Value:       usage,
+			Description: spec.description,
+			Algorithms:  strings.Split(spec.algorithms, ""),
+			ModesOfUse:  strings.Split(spec.modesOfUse, ""),
+		})
+	}
+	return dict
+}
+
+// dictionaryEntries describes each single character value of a field
+func dictionaryEntries(values string, descriptions map[string]string) []DictionaryEntry {
+	entries := make([]DictionaryEntry, 0, len(values))
+	for _, value := range strings.Split(values, "") {
+		entries = append(entries, DictionaryEntry{Value: value, Description: descriptions[value]})
+	}
+	return entries
+}
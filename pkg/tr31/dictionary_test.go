@@ -0,0 +1,43 @@
+package tr31
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderDictionary(t *testing.T) {
+	dict := HeaderDictionary()
+
+	assert.Equal(t, []DictionaryEntry{
+		{Value: "A", Description: "TDES variant binding, deprecated"},
+		{Value: "B", Description: "TDES key derivation binding"},
+		{Value: "C", Description: "TDES variant binding"},
+		{Value: "D", Description: "AES key derivation binding"},
+	}, dict.Versions)
+	assert.Len(t, dict.KeyUsages, len(_keyUsages))
+	assert.Equal(t, "B0", dict.KeyUsages[0].Value)
+	assert.Equal(t, KeyUsageEntry{
+		Value:       "P0",
+		Description: "PIN encryption key",
+		Algorithms:  []string{"A", "D", "T"},
+		ModesOfUse:  []string{"B", "D", "E"},
+	}, dict.KeyUsages[32])
+
+	// Every value has a description and every combination passes Lint
+	for _, entries := range [][]DictionaryEntry{dict.Algorithms, dict.ModesOfUse, dict.Exportability} {
+		for _, entry := range entries {
+			assert.NotEmpty(t, entry.Description, entry.Value)
+		}
+	}
+	for _, usage := range dict.KeyUsages {
+		assert.NotEmpty(t, usage.Description, usage.Value)
+		for _, algorithm := range usage.Algorithms {
+			for _, mode := range usage.ModesOfUse {
+				h, err := NewHeader("B", usage.Value, algorithm, mode, "00", "N")
+				assert.Nil(t, err)
+				assert.Nil(t, h.Lint(), "%s %s %s", usage.Value, algorithm, mode)
+			}
+		}
+	}
+}
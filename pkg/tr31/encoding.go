@@ -0,0 +1,145 @@
+package tr31
+
+import (
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+
+	"github.com/moov-io/tr31/pkg/charset"
+)
+
+// QR_CHUNK_PREFIX starts every QR chunk produced by EncodeQRChunks
+const QR_CHUNK_PREFIX string = "TR31"
+
+// EncodeBase64 encodes a key block with standard padded base64
+func EncodeBase64(keyBlock string) string {
+	return base64.StdEncoding.EncodeToString([]byte(keyBlock))
+}
+
+// DecodeBase64 decodes a key block encoded by EncodeBase64
+func DecodeBase64(data string) (string, error) {
+	return decodeBase64(base64.StdEncoding, data)
+}
+
+// EncodeBase64URL encodes a key block with unpadded URL-safe base64,
+// suitable for query strings and file names
+func EncodeBase64URL(keyBlock string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(keyBlock))
+}
+
+// DecodeBase64URL decodes a key block encoded by EncodeBase64URL
+func DecodeBase64URL(data string) (string, error) {
+	return decodeBase64(base64.RawURLEncoding, data)
+}
+
+func decodeBase64(encoding *base64.Encoding, data string) (string, error) {
+	decoded, err := encoding.DecodeString(data)
+	if err != nil {
+		return "", &KeyBlockError{Message: fmt.Sprintf(EncodingErrMalformed, err)}
+	}
+	if !charset.IsPrintable(string(decoded)) {
+		return "", &KeyBlockError{Message: fmt.Sprintf(EncodingErrMalformed, "decoded data is not ASCII printable")}
+	}
+	return string(decoded), nil
+}
+
+// EncodeQRChunks splits a key block into payloads of at most chunkSize key block
+// characters, each small enough to be scanned from its own QR code. Every chunk
+// carries a sequence header and a checksum of the whole key block:
+//
+//	TR31:<sequence>/<total>:<crc32>:<data>
+//
+// so chunks can be scanned in any order and chunks from different key blocks are rejected.
+func EncodeQRChunks(keyBlock string, chunkSize int) ([]string, error) {
+	if chunkSize <= 0 {
+		return nil, &KeyBlockError{Message: fmt.Sprintf(EncodingErrChunkSize, chunkSize)}
+	}
+
+	checksum := fmt.Sprintf("%08X", crc32.ChecksumIEEE([]byte(keyBlock)))
+	total := (len(keyBlock) + chunkSize - 1) / chunkSize
+	if total == 0 {
+		total = 1
+	}
+
+	chunks := make([]string, 0, total)
+	for i := 0; i < total; i++ {
+		end := min((i+1)*chunkSize, len(keyBlock))
+		chunks = append(chunks, fmt.Sprintf("%s:%d/%d:%s:%s", QR_CHUNK_PREFIX, i+1, total, checksum, keyBlock[i*chunkSize:end]))
+	}
+	return chunks, nil
+}
+
+// DecodeQRChunks reassembles a key block from the chunks produced by EncodeQRChunks.
+// Chunks may be supplied in any order and repeated scans of the same chunk are ignored.
+func DecodeQRChunks(chunks []string) (string, error) {
+	var (
+		checksum string
+		total    int
+		parts    map[int]string
+	)
+
+	for _, chunk := range chunks {
+		fields := strings.SplitN(chunk, ":", 4)
+		if len(fields) != 4 || fields[0] != QR_CHUNK_PREFIX {
+			return "", &KeyBlockError{Message: fmt.Sprintf(EncodingErrChunkMalformed, chunk)}
+		}
+		seq, count, ok := parseChunkSequence(fields[1])
+		if !ok {
+			return "", &KeyBlockError{Message: fmt.Sprintf(EncodingErrChunkMalformed, chunk)}
+		}
+
+		if parts == nil {
+			checksum = fields[2]
+			total = count
+			parts = make(map[int]string, total)
+		}
+		if fields[2] != checksum || count != total {
+			return "", &KeyBlockError{Message: fmt.Sprintf(EncodingErrChunkMismatched, chunk)}
+		}
+		if prev, exists := parts[seq]; exists && prev != fields[3] {
+			return "", &KeyBlockError{Message: fmt.Sprintf(EncodingErrChunkMismatched, chunk)}
+		}
+		parts[seq] = fields[3]
+	}
+
+	if parts == nil {
+		return "", &KeyBlockError{Message: fmt.Sprintf(EncodingErrChunkMissing, 1, 1)}
+	}
+
+	var sb strings.Builder
+	for i := 1; i <= total; i++ {
+		part, exists := parts[i]
+		if !exists {
+			return "", &KeyBlockError{Message: fmt.Sprintf(EncodingErrChunkMissing, i, total)}
+		}
+		sb.WriteString(part)
+	}
+
+	keyBlock := sb.String()
+	if fmt.Sprintf("%08X", crc32.ChecksumIEEE([]byte(keyBlock))) != checksum {
+		return "", &KeyBlockError{Message: fmt.Sprintf(EncodingErrChecksum, checksum)}
+	}
+	return keyBlock, nil
+}
+
+// parseChunkSequence parses "<sequence>/<total>" with 1 <= sequence <= total
+func parseChunkSequence(s string) (int, int, bool) {
+	seqStr, totalStr, found := strings.Cut(s, "/")
+	if !found {
+		return 0, 0, false
+	}
+	seq, err := strconv.Atoi(seqStr)
+	if err != nil {
+		return 0, 0, false
+	}
+	total, err := strconv.Atoi(totalStr)
+	if err != nil {
+		return 0, 0, false
+	}
+	if seq < 1 || total < 1 || seq > total {
+		return 0, 0, false
+	}
+	return seq, total, true
+}
@@ -0,0 +1,72 @@
+package tr31
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const encodingTestKeyBlock = "A0088M3TC00E000022BD7EC46BBE2A6A73389D1BA6DB63120B386F912839F4679C0523399E4D8D0F1D9A356E" // gitleaks:allow
+
+func TestEncodeBase64(t *testing.T) {
+	encoded := EncodeBase64(encodingTestKeyBlock)
+	decoded, err := DecodeBase64(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, encodingTestKeyBlock, decoded)
+
+	encoded = EncodeBase64URL("B0016P0TE00N0000?>")
+	assert.Equal(t, "QjAwMTZQMFRFMDBOMDAwMD8-", encoded)
+	decoded, err = DecodeBase64URL(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, "B0016P0TE00N0000?>", decoded)
+
+	_, err = DecodeBase64("not base64!")
+	assert.IsType(t, &KeyBlockError{}, err)
+	_, err = DecodeBase64URL(EncodeBase64URL("\x00\x01"))
+	assert.IsType(t, &KeyBlockError{}, err)
+}
+
+func TestEncodeQRChunks(t *testing.T) {
+	chunks, err := EncodeQRChunks(encodingTestKeyBlock, 40)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(chunks))
+	assert.Equal(t, "TR31:1/3:", chunks[0][:9])
+
+	// Scanning order and repeated scans don't matter
+	decoded, err := DecodeQRChunks([]string{chunks[2], chunks[0], chunks[2], chunks[1]})
+	assert.Nil(t, err)
+	assert.Equal(t, encodingTestKeyBlock, decoded)
+
+	single, err := EncodeQRChunks(encodingTestKeyBlock, 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(single))
+
+	_, err = EncodeQRChunks(encodingTestKeyBlock, 0)
+	assert.Equal(t, "KeyBlockError: QR chunk size (0) must be positive.", err.Error())
+}
+
+func TestDecodeQRChunksErrors(t *testing.T) {
+	chunks, _ := EncodeQRChunks(encodingTestKeyBlock, 40)
+	other, _ := EncodeQRChunks("B0016P0TE00N0000", 8)
+
+	tests := []struct {
+		name          string
+		chunks        []string
+		expectedError string
+	}{
+		{"No chunks", nil, "KeyBlockError: QR chunk 1 of 1 is missing."},
+		{"Missing chunk", chunks[:2], "KeyBlockError: QR chunk 3 of 3 is missing."},
+		{"Malformed chunk", []string{"TR31:1:ABC"}, "KeyBlockError: QR chunk (TR31:1:ABC) is malformed. Expecting TR31:<sequence>/<total>:<checksum>:<data>."},
+		{"Sequence out of range", []string{"TR31:4/3:00000000:AB"}, "KeyBlockError: QR chunk (TR31:4/3:00000000:AB) is malformed. Expecting TR31:<sequence>/<total>:<checksum>:<data>."},
+		{"Mixed key blocks", []string{chunks[0], other[1]}, "KeyBlockError: QR chunk (" + other[1] + ") doesn't belong to the same key block."},
+		{"Corrupted data", []string{chunks[0], chunks[1], chunks[2][:len(chunks[2])-1] + "0"}, "KeyBlockError: Key block checksum (" + chunks[0][9:17] + ") is not matched."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeQRChunks(tt.chunks)
+			assert.IsType(t, &KeyBlockError{}, err)
+			assert.Equal(t, tt.expectedError, err.Error())
+		})
+	}
+}
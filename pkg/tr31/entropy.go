@@ -0,0 +1,76 @@
+package tr31
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// EntropySource supplies the random bytes padding wrapped keys, for deployments
+// drawing randomness from an HSM DRBG or a hardware RNG instead of the OS
+type EntropySource interface {
+	io.Reader
+	// Health reports why the source can't supply random bytes, nil when it can.
+	// It is checked before every read so wraps fail while the source is unavailable.
+	Health() error
+}
+
+// readerSource is an EntropySource over a reader that is always available
+type readerSource struct {
+	io.Reader
+}
+
+func (readerSource) Health() error {
+	return nil
+}
+
+// ReaderEntropySource returns an EntropySource reading from r, with no health check
+func ReaderEntropySource(r io.Reader) EntropySource {
+	return readerSource{Reader: r}
+}
+
+var (
+	_entropySource    EntropySource = ReaderEntropySource(rand.Reader)
+	_entropySourceMtx sync.RWMutex
+)
+
+// SetEntropySource changes the source of random padding for every key block
+// without its own source. A nil source restores crypto/rand.
+func SetEntropySource(source EntropySource) {
+	if source == nil {
+		source = ReaderEntropySource(rand.Reader)
+	}
+	_entropySourceMtx.Lock()
+	defer _entropySourceMtx.Unlock()
+	_entropySource = source
+}
+
+// SetEntropySource makes Wrap read random padding from source instead of the
+// package entropy source. A nil source restores the package one.
+func (kb *KeyBlock) SetEntropySource(source EntropySource) {
+	kb.entropy = source
+}
+
+// entropySource returns the entropy source in effect for the key block
+func (kb *KeyBlock) entropySource() EntropySource {
+	if kb.entropy != nil {
+		return kb.entropy
+	}
+	_entropySourceMtx.RLock()
+	defer _entropySourceMtx.RUnlock()
+	return _entropySource
+}
+
+// randomBytes reads n bytes from the entropy source after checking its health
+func (kb *KeyBlock) randomBytes(n int) ([]byte, error) {
+	source := kb.entropySource()
+	if err := source.Health(); err != nil {
+		return nil, &KeyBlockError{Message: fmt.Sprintf(BlockErrorEntropyUnavailable, err)}
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(source, data); err != nil {
+		return nil, &KeyBlockError{Message: fmt.Sprintf(BlockErrorEntropyUnavailable, err)}
+	}
+	return data, nil
+}
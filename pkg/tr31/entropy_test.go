@@ -0,0 +1,77 @@
+package tr31
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// hsmSource is a sample entropy source standing in for an HSM DRBG
+type hsmSource struct {
+	fill byte
+	err  error
+	read int
+}
+
+func (s *hsmSource) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = s.fill
+	}
+	s.read += len(p)
+	return len(p), nil
+}
+
+func (s *hsmSource) Health() error {
+	return s.err
+}
+
+func TestKeyBlockEntropySource(t *testing.T) {
+	kbpk := bytes.Repeat([]byte("E"), 16)
+	key := bytes.Repeat([]byte("F"), 16)
+	header, _ := NewHeader(TR31_VERSION_D, "D0", ENC_ALGORITHM_AES, "D", "00", "N")
+
+	kb, err := NewKeyBlock(kbpk, header)
+	assert.Nil(t, err)
+	source := &hsmSource{fill: 0xA5}
+	kb.SetEntropySource(source)
+
+	block, err := kb.Wrap(key, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 30, source.read)
+
+	// the same padding gives the same key block
+	again, _ := kb.Wrap(key, nil)
+	assert.Equal(t, block, again)
+
+	// wraps fail while the source is unhealthy
+	source.err = errors.New("HSM DRBG offline")
+	_, err = kb.Wrap(key, nil)
+	assert.Equal(t, &KeyBlockError{Message: "Entropy source is unavailable: HSM DRBG offline"}, err)
+
+	// zero padding doesn't need the source
+	kb.SetWrapOptions(WrapOptions{MaskKeyLength: true})
+	_, err = kb.Wrap(key, nil)
+	assert.Nil(t, err)
+}
+
+func TestSetEntropySource(t *testing.T) {
+	source := &hsmSource{err: errors.New("RNG not seeded")}
+	SetEntropySource(source)
+	defer SetEntropySource(nil)
+
+	kb, _ := NewKeyBlockFromString(bytes.Repeat([]byte("E"), 16), "D0000D0AD00N0000")
+	_, err := kb.Wrap(bytes.Repeat([]byte("F"), 16), nil)
+	assert.Equal(t, &KeyBlockError{Message: "Entropy source is unavailable: RNG not seeded"}, err)
+
+	// a short read fails the wrap
+	kb.SetEntropySource(ReaderEntropySource(bytes.NewReader([]byte{0x01})))
+	_, err = kb.Wrap(bytes.Repeat([]byte("F"), 16), nil)
+	assert.Equal(t, &KeyBlockError{Message: "Entropy source is unavailable: unexpected EOF"}, err)
+
+	SetEntropySource(nil)
+	kb.SetEntropySource(nil)
+	_, err = kb.Wrap(bytes.Repeat([]byte("F"), 16), nil)
+	assert.Nil(t, err)
+}
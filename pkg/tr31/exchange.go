@@ -0,0 +1,185 @@
+package tr31
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// KeyExchangeFormat identifies the envelope format of key exchange messages
+const KeyExchangeFormat = "tr31-kem/1"
+
+// KeyExchangeMessage bundles key blocks sent to a partner in a key exchange
+// file, such as a file emailed or uploaded over SFTP
+type KeyExchangeMessage struct {
+	// From and To are the partner IDs of the sender and the recipient
+	From      string        `json:"from"`
+	To        string        `json:"to"`
+	CreatedAt time.Time     `json:"createdAt"`
+	Keys      []ExchangeKey `json:"keys"`
+}
+
+// ExchangeKey is a key block of a key exchange message with the KCV the recipient
+// checks after unwrapping it, and the period the key is used in
+type ExchangeKey struct {
+	KeyBlock      string    `json:"keyBlock"`
+	KCV           string    `json:"kcv,omitempty"`
+	EffectiveFrom time.Time `json:"effectiveFrom"`
+	// EffectiveUntil is zero for keys used until they're replaced
+	EffectiveUntil time.Time `json:"effectiveUntil,omitzero"`
+}
+
+// KeyExchangeEnvelope is the JSON file a key exchange message travels in. The
+// signature is detached from the message: it's computed over the compact JSON of
+// the message, so reformatting the file doesn't break it.
+type KeyExchangeEnvelope struct {
+	Format    string               `json:"format"`
+	Message   json.RawMessage      `json:"message"`
+	Signature KeyExchangeSignature `json:"signature"`
+}
+
+// KeyExchangeSignature is the detached signature of a key exchange message
+type KeyExchangeSignature struct {
+	// Algorithm is RSA-SHA256 (PKCS #1 v1.5), ECDSA-SHA256 (ASN.1) or Ed25519
+	Algorithm string `json:"algorithm"`
+	// KeyID is the hex SHA-256 of the PKIX public key of the signer
+	KeyID string `json:"keyId"`
+	// Value is the base64 signature
+	Value string `json:"value"`
+}
+
+// EffectiveAt reports whether the key is used at t
+func (k ExchangeKey) EffectiveAt(t time.Time) bool {
+	return !t.Before(k.EffectiveFrom) && (k.EffectiveUntil.IsZero() || t.Before(k.EffectiveUntil))
+}
+
+// Validate checks the message has a sender, a recipient and keys whose headers
+// load, with hex KCVs and effective periods that don't end before they start
+func (m *KeyExchangeMessage) Validate() error {
+	invalid := func(format string, args ...interface{}) error {
+		return &KeyBlockError{Message: fmt.Sprintf(KeyExchangeErrMessage, fmt.Sprintf(format, args...))}
+	}
+	if m.From == "" || m.To == "" {
+		return invalid("from and to partner IDs are required")
+	}
+	if len(m.Keys) == 0 {
+		return invalid("no keys")
+	}
+	for i, k := range m.Keys {
+		if _, err := DefaultHeader().Load(k.KeyBlock); err != nil {
+			return invalid("key %d: %v", i, err)
+		}
+		if _, err := hex.DecodeString(k.KCV); err != nil {
+			return invalid("key %d: KCV must be hex", i)
+		}
+		if k.EffectiveFrom.IsZero() {
+			return invalid("key %d: effectiveFrom is required", i)
+		}
+		if !k.EffectiveUntil.IsZero() && !k.EffectiveUntil.After(k.EffectiveFrom) {
+			return invalid("key %d: effectiveUntil must be after effectiveFrom", i)
+		}
+	}
+	return nil
+}
+
+// SealKeyExchange validates the message and returns the JSON envelope of the
+// message signed with an RSA, ECDSA or Ed25519 key. CreatedAt is set to the
+// current time when zero.
+func SealKeyExchange(m *KeyExchangeMessage, signer crypto.Signer) ([]byte, error) {
+	if m.CreatedAt.IsZero() {
+		m.CreatedAt = time.Now().UTC()
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	message, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, keyID, err := keyExchangeSigner(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	signature, _, err := signMessage(signer, message)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(KeyExchangeEnvelope{
+		Format:  KeyExchangeFormat,
+		Message: message,
+		Signature: KeyExchangeSignature{
+			Algorithm: algorithm,
+			KeyID:     keyID,
+			Value:     base64.StdEncoding.EncodeToString(signature),
+		},
+	}, "", "  ")
+}
+
+// OpenKeyExchange verifies the signature of a JSON envelope with the public key
+// of the sender and returns its validated message
+func OpenKeyExchange(envelope []byte, publicKey crypto.PublicKey) (*KeyExchangeMessage, error) {
+	var env KeyExchangeEnvelope
+	if err := json.Unmarshal(envelope, &env); err != nil {
+		return nil, &KeyBlockError{Message: fmt.Sprintf(KeyExchangeErrEnvelope, err)}
+	}
+	if env.Format != KeyExchangeFormat {
+		return nil, &KeyBlockError{Message: fmt.Sprintf(KeyExchangeErrEnvelope, fmt.Sprintf("format %q is not %s", env.Format, KeyExchangeFormat))}
+	}
+	algorithm, keyID, err := keyExchangeSigner(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if env.Signature.Algorithm != algorithm || !strings.EqualFold(env.Signature.KeyID, keyID) {
+		return nil, &KeyBlockError{Message: fmt.Sprintf(KeyExchangeErrSigner, env.Signature.Algorithm, env.Signature.KeyID)}
+	}
+	signature, err := base64.StdEncoding.DecodeString(env.Signature.Value)
+	if err != nil {
+		return nil, &KeyBlockError{Message: KeyExchangeErrSignature}
+	}
+	var message bytes.Buffer
+	if err := json.Compact(&message, env.Message); err != nil {
+		return nil, &KeyBlockError{Message: fmt.Sprintf(KeyExchangeErrEnvelope, err)}
+	}
+	if valid, _ := verifyMessage(publicKey, message.Bytes(), signature); !valid {
+		return nil, &KeyBlockError{Message: KeyExchangeErrSignature}
+	}
+
+	var m KeyExchangeMessage
+	if err := json.Unmarshal(message.Bytes(), &m); err != nil {
+		return nil, &KeyBlockError{Message: fmt.Sprintf(KeyExchangeErrMessage, err)}
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// keyExchangeSigner returns the signature algorithm and key ID of a public key
+func keyExchangeSigner(publicKey crypto.PublicKey) (algorithm, keyID string, err error) {
+	switch publicKey.(type) {
+	case *rsa.PublicKey:
+		algorithm = "RSA-SHA256"
+	case *ecdsa.PublicKey:
+		algorithm = "ECDSA-SHA256"
+	case ed25519.PublicKey:
+		algorithm = "Ed25519"
+	default:
+		return "", "", &KeyBlockError{Message: fmt.Sprintf(HeaderErrSignatureKey, publicKey)}
+	}
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", "", &KeyBlockError{Message: fmt.Sprintf(HeaderErrSignatureKey, publicKey)}
+	}
+	digest := sha256.Sum256(der)
+	return algorithm, hex.EncodeToString(digest[:]), nil
+}
@@ -0,0 +1,103 @@
+package tr31
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func exchangeTestMessage(t *testing.T) *KeyExchangeMessage {
+	t.Helper()
+	header, _ := NewHeader("D", "P0", "A", "E", "00", "E")
+	kb, err := NewKeyBlock(bytes.Repeat([]byte{0x89}, 32), header)
+	require.NoError(t, err)
+	result, err := kb.WrapWithResult(bytes.Repeat([]byte{0x3c}, 16), nil)
+	require.NoError(t, err)
+	return &KeyExchangeMessage{
+		From: "bank",
+		To:   "acme",
+		Keys: []ExchangeKey{{
+			KeyBlock:       result.Block,
+			KCV:            result.KCV,
+			EffectiveFrom:  time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+			EffectiveUntil: time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC),
+		}},
+	}
+}
+
+func TestKeyExchange(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	for _, signer := range []crypto.Signer{edKey, ecKey, rsaKey} {
+		m := exchangeTestMessage(t)
+		envelope, err := SealKeyExchange(m, signer)
+		require.NoError(t, err)
+		assert.False(t, m.CreatedAt.IsZero())
+
+		opened, err := OpenKeyExchange(envelope, signer.Public())
+		require.NoError(t, err)
+		assert.Equal(t, m.Keys[0].KeyBlock, opened.Keys[0].KeyBlock)
+		assert.Equal(t, m.Keys[0].KCV, opened.Keys[0].KCV)
+		assert.True(t, opened.CreatedAt.Equal(m.CreatedAt))
+		assert.Equal(t, "acme", opened.To)
+
+		// Reformatting the envelope keeps the signature valid
+		var compact bytes.Buffer
+		require.NoError(t, json.Compact(&compact, envelope))
+		_, err = OpenKeyExchange(compact.Bytes(), signer.Public())
+		require.NoError(t, err)
+	}
+}
+
+func TestKeyExchangeErrors(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	envelope, err := SealKeyExchange(exchangeTestMessage(t), key)
+	require.NoError(t, err)
+
+	var keyBlockErr *KeyBlockError
+	_, err = OpenKeyExchange(envelope, other.Public())
+	require.True(t, errors.As(err, &keyBlockErr))
+	assert.Contains(t, err.Error(), "not the key given")
+
+	tampered := bytes.Replace(envelope, []byte(`"to": "acme"`), []byte(`"to": "evil"`), 1)
+	require.NotEqual(t, envelope, tampered)
+	_, err = OpenKeyExchange(tampered, key.Public())
+	assert.Equal(t, "KeyBlockError: Key exchange envelope signature is invalid.", err.Error())
+
+	_, err = OpenKeyExchange([]byte(`{"format":"other"}`), key.Public())
+	assert.Contains(t, err.Error(), "Key exchange envelope is malformed")
+
+	m := exchangeTestMessage(t)
+	m.Keys[0].EffectiveUntil = m.Keys[0].EffectiveFrom
+	_, err = SealKeyExchange(m, key)
+	assert.Contains(t, err.Error(), "effectiveUntil must be after effectiveFrom")
+	m = exchangeTestMessage(t)
+	m.Keys[0].KeyBlock = "not a key block"
+	_, err = SealKeyExchange(m, key)
+	assert.True(t, errors.As(err, &keyBlockErr))
+	_, err = SealKeyExchange(&KeyExchangeMessage{From: "bank"}, key)
+	assert.Contains(t, err.Error(), "from and to partner IDs are required")
+}
+
+func TestExchangeKeyEffectiveAt(t *testing.T) {
+	k := exchangeTestMessage(t).Keys[0]
+	assert.False(t, k.EffectiveAt(k.EffectiveFrom.Add(-time.Second)))
+	assert.True(t, k.EffectiveAt(k.EffectiveFrom))
+	assert.False(t, k.EffectiveAt(k.EffectiveUntil))
+	k.EffectiveUntil = time.Time{}
+	assert.True(t, k.EffectiveAt(k.EffectiveFrom.AddDate(10, 0, 0)))
+}
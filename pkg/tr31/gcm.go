@@ -0,0 +1,133 @@
+package tr31
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+const (
+	// _gcmNonceLen is the length of the random nonce of AES-GCM key blocks
+	_gcmNonceLen = 12
+	// _gcmTagLen is the length of the AES-GCM authentication tag
+	_gcmTagLen = 16
+)
+
+// RegisterAESGCMVersion registers an opt-in vendor extension version under id,
+// such as "G", wrapping keys with AES-GCM instead of AES-CBC and AES-CMAC. The
+// key block header is authenticated as additional data, so it keeps its meaning.
+// The MAC field of these key blocks carries the 12 byte GCM nonce followed by the
+// 16 byte tag. Other parties must register the same version to unwrap them.
+func RegisterAESGCMVersion(id string) error {
+	return RegisterVersion(VersionSpec{
+		ID:           id,
+		BlockSize:    8,
+		MACLen:       _gcmNonceLen + _gcmTagLen,
+		KBPKLengths:  []int{16, 24, 32},
+		Wrap:         (*KeyBlock).GCMWrap,
+		Unwrap:       (*KeyBlock).GCMUnwrap,
+		WrapDefaults: WrapOptions{MaskKeyLength: true, RandomPad: true},
+	})
+}
+
+// GCMWrap wraps a key with AES-GCM under a key derived from the KBPK, for
+// versions registered with RegisterAESGCMVersion
+func (kb *KeyBlock) GCMWrap(header string, key []byte, extraPad int) (string, error) {
+	aead, err := kb.gcm()
+	if err != nil {
+		return "", err
+	}
+
+	// Format key data: 2-byte key length measured in bits + key + pad
+	padLen := 8 - ((2 + len(key) + extraPad) % 8)
+	pad, err := kb.pad(padLen + extraPad)
+	if err != nil {
+		return "", err
+	}
+	clearKeyData := make([]byte, 2+len(key)+len(pad))
+	binary.BigEndian.PutUint16(clearKeyData[:2], uint16(len(key)*8))
+	copy(clearKeyData[2:], key)
+	copy(clearKeyData[2+len(key):], pad)
+
+	nonce, err := kb.randomBytes(_gcmNonceLen)
+	if err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nil, nonce, clearKeyData, []byte(header))
+	encKey, tag := sealed[:len(clearKeyData)], sealed[len(clearKeyData):]
+
+	return header + hex.EncodeToString(encKey) + hex.EncodeToString(nonce) + hex.EncodeToString(tag), nil
+}
+
+// GCMUnwrap unwraps a key wrapped by GCMWrap. receivedMAC is the nonce followed by the tag.
+func (kb *KeyBlock) GCMUnwrap(header string, keyData, receivedMAC []byte) ([]byte, error) {
+	aead, err := kb.gcm()
+	if err != nil {
+		return nil, err
+	}
+	if len(receivedMAC) != _gcmNonceLen+_gcmTagLen || len(keyData) < 2 {
+		return nil, &KeyBlockError{Message: BlockErrorEncKeyMalformed}
+	}
+
+	nonce, tag := receivedMAC[:_gcmNonceLen], receivedMAC[_gcmNonceLen:]
+	sealed := append(append([]byte{}, keyData...), tag...)
+	clearKeyData, err := aead.Open(nil, nonce, sealed, []byte(header))
+	if err != nil {
+		return nil, &KeyBlockError{Message: BlockErrorMacNotMatched}
+	}
+
+	// Extract key length from clear key data (2 byte key length in bits)
+	keyLength := binary.BigEndian.Uint16(clearKeyData[:2])
+	if keyLength%8 != 0 {
+		return nil, &KeyBlockError{Message: BlockErrorDecKeyInvalid}
+	}
+	keyLength = keyLength / 8
+	if len(clearKeyData) < int(keyLength)+2 {
+		return nil, &KeyBlockError{Message: BlockErrorDecKeyMalformed}
+	}
+	return clearKeyData[2 : 2+keyLength], nil
+}
+
+// gcm returns the AES-GCM cipher keyed with the key derived from the KBPK
+func (kb *KeyBlock) gcm() (cipher.AEAD, error) {
+	if len(kb.kbpk) != 16 && len(kb.kbpk) != 24 && len(kb.kbpk) != 32 {
+		return nil, &KeyBlockError{Message: fmt.Sprintf(BlockErrorKBKPLenNotMatchedAES, len(kb.kbpk))}
+	}
+	block, err := aes.NewCipher(kb.gcmDerive())
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// gcmDerive derives the AES-GCM key with the version D key derivation, under a
+// key usage indicator of its own (8000) so it never equals the version D KBEK or KBAK
+func (kb *KeyBlock) gcmDerive() []byte {
+	// Counter, key usage indicator, separator, algorithm indicator and key length
+	kdInput := []byte{
+		0x01, 0x80, 0x00, 0x00,
+		0x00, 0x02, 0x00, 0x80,
+		0x80, 0x00, 0x00, 0x00, // Padding
+		0x00, 0x00, 0x00, 0x00,
+	}
+	calls := 1
+	switch len(kb.kbpk) {
+	case 24:
+		kdInput[5], kdInput[6], kdInput[7] = 0x03, 0x00, 0xC0
+		calls = 2
+	case 32:
+		kdInput[5], kdInput[6], kdInput[7] = 0x04, 0x01, 0x00
+		calls = 2
+	}
+
+	_, k2, _ := kb.deriveAESCMACSubkeys(kb.kbpk)
+	var key []byte
+	for i := 1; i <= calls; i++ {
+		kdInput[0] = byte(i)
+		data, _ := GenerateCBCMAC(kb.kbpk, xor(kdInput, k2), PAD_METHOD_1, 16, AES)
+		key = append(key, data...)
+	}
+	return key[:len(kb.kbpk)]
+}
@@ -0,0 +1,62 @@
+package tr31
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAESGCMVersion(t *testing.T) {
+	assert.Nil(t, RegisterAESGCMVersion("G"))
+	defer func() {
+		_versions.mtx.Lock()
+		delete(_versions.versions, "G")
+		_versions.mtx.Unlock()
+	}()
+
+	key := bytes.Repeat([]byte{0x11, 0x22}, 8)
+	for _, kbpkLen := range []int{16, 24, 32} {
+		kbpk := bytes.Repeat([]byte("E"), kbpkLen)
+		header, err := NewHeader("G", "D0", "A", "D", "00", "E")
+		assert.Nil(t, err)
+		assert.Nil(t, header.Blocks.Set("KS", "00604B120F9292800000"))
+		kb, _ := NewKeyBlock(kbpk, header)
+
+		keyBlock, err := kb.Wrap(key, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, "G", keyBlock[:1])
+		again, _ := kb.Wrap(key, nil)
+		assert.NotEqual(t, keyBlock, again, "every wrap uses a fresh nonce")
+
+		received, _ := NewKeyBlock(kbpk, nil)
+		keyOut, err := received.Unwrap(keyBlock)
+		assert.Nil(t, err)
+		assert.Equal(t, key, keyOut)
+		assert.Equal(t, "00604B120F9292800000", received.GetHeader().GetBlocks()["KS"])
+
+		// The header is authenticated, as are the key data and tag
+		tampered := keyBlock[:8] + "N" + keyBlock[9:]
+		_, err = received.Unwrap(tampered)
+		assert.EqualError(t, err, "KeyBlockError: Key block MAC is not matched.")
+		last := "0"
+		if keyBlock[len(keyBlock)-1] == '0' {
+			last = "1"
+		}
+		tampered = keyBlock[:len(keyBlock)-1] + last
+		_, err = received.Unwrap(tampered)
+		assert.NotNil(t, err)
+
+		// The GCM key is never a version D key
+		kbek, kbak, _ := kb.dDerive()
+		assert.NotEqual(t, kbek, kb.gcmDerive())
+		assert.NotEqual(t, kbak, kb.gcmDerive())
+	}
+
+	kb, _ := NewKeyBlockFromString(bytes.Repeat([]byte("E"), 16), "G0000D0AD00E0000")
+	kb.kbpk = kb.kbpk[:8]
+	_, err := kb.Wrap(key, nil)
+	assert.NotNil(t, err)
+
+	assert.NotNil(t, RegisterAESGCMVersion("D"))
+}
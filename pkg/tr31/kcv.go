@@ -0,0 +1,33 @@
+package tr31
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// KCV_LENGTH is the number of bytes of the encrypted zero block kept as key check value
+const KCV_LENGTH int = 3
+
+// KeyCheckValue computes the legacy key check value of a key: the first 3 bytes
+// of a block of zeros encrypted with the key, as uppercase hex. algorithm is
+// ENC_ALGORITHM_TRIPLE_DES, ENC_ALGORITHM_DES or ENC_ALGORITHM_AES.
+func KeyCheckValue(key []byte, algorithm string) (string, error) {
+	var (
+		encrypted []byte
+		err       error
+	)
+	switch algorithm {
+	case ENC_ALGORITHM_TRIPLE_DES, ENC_ALGORITHM_DES:
+		keyCopy := append([]byte{}, key...)
+		encrypted, err = EncryptTDSECB(keyCopy, make([]byte, 8))
+	case ENC_ALGORITHM_AES:
+		encrypted, err = EncryptAESECB(key, make([]byte, 16))
+	default:
+		return "", &KeyBlockError{Message: fmt.Sprintf(HeaderErrAlgorithm, algorithm)}
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.ToUpper(hex.EncodeToString(encrypted[:KCV_LENGTH])), nil
+}
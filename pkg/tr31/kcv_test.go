@@ -0,0 +1,36 @@
+package tr31
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyCheckValue(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       string
+		algorithm string
+		expected  string
+		expectErr bool
+	}{
+		{"Double length TDES", "0123456789ABCDEFFEDCBA9876543210", ENC_ALGORITHM_TRIPLE_DES, "08D7B4", false},
+		{"AES-128", "2B7E151628AED2A6ABF7158809CF4F3C", ENC_ALGORITHM_AES, "7DF76B", false},
+		{"Invalid AES key length", "0123456789", ENC_ALGORITHM_AES, "", true},
+		{"Unknown algorithm", "0123456789ABCDEFFEDCBA9876543210", "X", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, _ := hex.DecodeString(tt.key)
+			kcv, err := KeyCheckValue(key, tt.algorithm)
+			if tt.expectErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.expected, kcv)
+		})
+	}
+}
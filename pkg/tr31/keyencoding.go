@@ -0,0 +1,69 @@
+package tr31
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/moov-io/tr31/pkg/charset"
+)
+
+// _algoIDKeyLens lists the key lengths accepted by the encoded key variants of Wrap
+var _algoIDKeyLens = map[string][]int{
+	ENC_ALGORITHM_TRIPLE_DES: {16, 24},
+	ENC_ALGORITHM_DES:        {8},
+	ENC_ALGORITHM_AES:        {16, 24, 32},
+}
+
+// WrapHex wraps a key given as hex. Unlike hex.DecodeString, odd length input is
+// rejected instead of silently dropping the last character, and the key length is
+// checked against the header algorithm for TDES, DES and AES keys.
+func (kb *KeyBlock) WrapHex(keyHex string, maskedKeyLen *int) (string, error) {
+	if len(keyHex)%2 != 0 || (keyHex != "" && !charset.IsHex(keyHex)) {
+		return "", &KeyBlockError{Message: fmt.Sprintf(EncodingErrKeyHex, len(keyHex))}
+	}
+	key, _ := hex.DecodeString(keyHex)
+	return kb.wrapEncoded(key, maskedKeyLen)
+}
+
+// WrapBase64 wraps a key given as standard padded base64, with the same length
+// checks as WrapHex
+func (kb *KeyBlock) WrapBase64(keyBase64 string, maskedKeyLen *int) (string, error) {
+	key, err := base64.StdEncoding.Strict().DecodeString(keyBase64)
+	if err != nil {
+		return "", &KeyBlockError{Message: fmt.Sprintf(EncodingErrKeyBase64, err)}
+	}
+	return kb.wrapEncoded(key, maskedKeyLen)
+}
+
+// UnwrapHex unwraps a key block and returns the key as uppercase hex
+func (kb *KeyBlock) UnwrapHex(keyBlock string) (string, error) {
+	key, err := kb.Unwrap(keyBlock)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToUpper(hex.EncodeToString(key)), nil
+}
+
+// UnwrapBase64 unwraps a key block and returns the key as standard padded base64
+func (kb *KeyBlock) UnwrapBase64(keyBlock string) (string, error) {
+	key, err := kb.Unwrap(keyBlock)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+func (kb *KeyBlock) wrapEncoded(key []byte, maskedKeyLen *int) (string, error) {
+	if kb == nil {
+		return "", fmt.Errorf(ErrNoKBPK)
+	}
+	if len(key) == 0 {
+		return "", &KeyBlockError{Message: EncodingErrKeyEmpty}
+	}
+	if lens, exists := _algoIDKeyLens[kb.header.Algorithm]; exists && !containsInt(lens, len(key)) {
+		return "", &KeyBlockError{Message: fmt.Sprintf(EncodingErrKeyLength, len(key), kb.header.Algorithm, lens)}
+	}
+	return kb.Wrap(key, maskedKeyLen)
+}
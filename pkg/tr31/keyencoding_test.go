@@ -0,0 +1,57 @@
+package tr31
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrapHexBase64(t *testing.T) {
+	header, _ := NewHeader("D", "D0", "A", "D", "00", "E")
+	kb, _ := NewKeyBlock(bytes.Repeat([]byte("E"), 32), header)
+
+	keyBlock, err := kb.WrapHex("ccccccccccccccccdddddddddddddddd", nil)
+	assert.Nil(t, err)
+	keyHex, err := kb.UnwrapHex(keyBlock)
+	assert.Nil(t, err)
+	assert.Equal(t, "CCCCCCCCCCCCCCCCDDDDDDDDDDDDDDDD", keyHex)
+
+	keyBlock, err = kb.WrapBase64("zMzMzMzMzMzd3d3d3d3d3Q==", nil)
+	assert.Nil(t, err)
+	keyBase64, err := kb.UnwrapBase64(keyBlock)
+	assert.Nil(t, err)
+	assert.Equal(t, "zMzMzMzMzMzd3d3d3d3d3Q==", keyBase64)
+
+	_, err = kb.UnwrapHex("D0016")
+	assert.NotNil(t, err)
+	_, err = kb.UnwrapBase64("D0016")
+	assert.NotNil(t, err)
+}
+
+func TestWrapHexBase64Errors(t *testing.T) {
+	header, _ := NewHeader("D", "D0", "A", "D", "00", "E")
+	kb, _ := NewKeyBlock(bytes.Repeat([]byte("E"), 32), header)
+
+	tests := []struct {
+		name          string
+		wrap          func(string, *int) (string, error)
+		key           string
+		expectedError string
+	}{
+		{"Odd length hex", kb.WrapHex, "ccccccccccccccccddddddddddddddd", "KeyBlockError: Key must be an even number of hexchars. Received 31 characters."},
+		{"Non hex characters", kb.WrapHex, "ccccccccccccccccddddddddddddddzz", "KeyBlockError: Key must be an even number of hexchars. Received 32 characters."},
+		{"Empty hex", kb.WrapHex, "", "KeyBlockError: Key must not be empty."},
+		{"Hex key length", kb.WrapHex, "cccccccccccccccc", "KeyBlockError: Key length (8) is not valid for algorithm A. Expecting one of [16 24 32] bytes."},
+		{"Malformed base64", kb.WrapBase64, "zMzMzMzMzMzd3d3d3d3d3Q", "KeyBlockError: Key base64 is malformed: illegal base64 data at input byte 20"},
+		{"Base64 key length", kb.WrapBase64, "zMzMzMzMzMw=", "KeyBlockError: Key length (8) is not valid for algorithm A. Expecting one of [16 24 32] bytes."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.wrap(tt.key, nil)
+			assert.IsType(t, &KeyBlockError{}, err)
+			assert.Equal(t, tt.expectedError, err.Error())
+		})
+	}
+}
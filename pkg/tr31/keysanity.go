@@ -0,0 +1,101 @@
+package tr31
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// KeySanityPolicy controls checking keys for test key patterns before wrapping them
+type KeySanityPolicy int
+
+const (
+	// KEY_SANITY_SKIP wraps keys without checking them, the default
+	KEY_SANITY_SKIP KeySanityPolicy = iota
+	// KEY_SANITY_REJECT refuses to wrap all-zero, repeated pattern or low entropy keys
+	KEY_SANITY_REJECT
+)
+
+// _minEntropyRatio is the share of the highest entropy a key of its length can
+// have below which the key is considered low entropy. Random keys of 8 bytes or
+// more are above it with overwhelming probability.
+const _minEntropyRatio = 0.6
+
+var (
+	_keySanityPolicy KeySanityPolicy
+	_keySanityMtx    sync.RWMutex
+)
+
+// SetKeySanityPolicy changes whether Wrap checks keys with CheckKeySanity, so a
+// test key accidentally promoted to production is refused
+func SetKeySanityPolicy(policy KeySanityPolicy) {
+	_keySanityMtx.Lock()
+	defer _keySanityMtx.Unlock()
+	_keySanityPolicy = policy
+}
+
+// KeyEntropy estimates the entropy of a key in bits per byte from its byte
+// histogram. A key of n distinct bytes has at most log2(n) bits per byte.
+func KeyEntropy(key []byte) float64 {
+	if len(key) == 0 {
+		return 0
+	}
+	var histogram [256]int
+	for _, b := range key {
+		histogram[b]++
+	}
+	entropy := 0.0
+	for _, count := range histogram {
+		if count > 0 {
+			p := float64(count) / float64(len(key))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
+
+// CheckKeySanity returns a KeyBlockError when the key looks like a test key:
+// all zeros, a repeated pattern such as 0x11 or 0x0102, or few distinct bytes
+func CheckKeySanity(key []byte) error {
+	zero := true
+	for _, b := range key {
+		zero = zero && b == 0
+	}
+	if zero {
+		return &KeyBlockError{Message: KeyErrAllZero}
+	}
+	if period := repeatedPeriod(key); period > 0 {
+		return &KeyBlockError{Message: fmt.Sprintf(KeyErrRepeatedPattern, period)}
+	}
+	maxEntropy := math.Log2(float64(min(len(key), 256)))
+	if entropy := KeyEntropy(key); entropy < maxEntropy*_minEntropyRatio {
+		return &KeyBlockError{Message: fmt.Sprintf(KeyErrLowEntropy, entropy, maxEntropy*_minEntropyRatio)}
+	}
+	return nil
+}
+
+// repeatedPeriod returns the length of the shortest pattern the key repeats,
+// 0 when the key doesn't repeat a pattern at least twice
+func repeatedPeriod(key []byte) int {
+	for period := 1; period <= len(key)/2; period++ {
+		if len(key)%period != 0 {
+			continue
+		}
+		repeated := true
+		for i := period; i < len(key) && repeated; i++ {
+			repeated = key[i] == key[i-period]
+		}
+		if repeated {
+			return period
+		}
+	}
+	return 0
+}
+
+// checkKeySanity applies the key sanity policy before wrapping a key
+func checkKeySanity(key []byte, policy KeySanityPolicy) error {
+	if policy == KEY_SANITY_REJECT {
+		return CheckKeySanity(key)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package tr31
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckKeySanity(t *testing.T) {
+	for _, tc := range []struct {
+		key     string
+		message string
+	}{
+		{"00000000000000000000000000000000", "KeyBlockError: Key is all zeros, likely a test key."},
+		{"11111111111111111111111111111111", "KeyBlockError: Key repeats a 1 byte pattern, likely a test key."},
+		{"0123456789ABCDEF0123456789ABCDEF", "KeyBlockError: Key repeats a 8 byte pattern, likely a test key."},
+		{"01010101020202020101020201020102", "KeyBlockError: Key entropy (1.00 bits per byte) is below 2.40, likely a test key."},
+		{"9B71D224BD62F3785D96D46AD3EA3D73", ""},
+	} {
+		key, _ := hex.DecodeString(tc.key)
+		err := CheckKeySanity(key)
+		if tc.message == "" {
+			assert.Nil(t, err, tc.key)
+			continue
+		}
+		assert.EqualError(t, err, tc.message, tc.key)
+	}
+
+	// Random keys pass
+	for i := 0; i < 1000; i++ {
+		key := make([]byte, 16)
+		rand.Read(key)
+		assert.Nil(t, CheckKeySanity(key), hex.EncodeToString(key))
+	}
+}
+
+func TestKeyEntropy(t *testing.T) {
+	assert.Equal(t, 0.0, KeyEntropy(nil))
+	assert.Equal(t, 0.0, KeyEntropy(bytes.Repeat([]byte{0x11}, 16)))
+	assert.Equal(t, 4.0, KeyEntropy([]byte("0123456789ABCDEF")))
+}
+
+func TestKeySanityPolicy(t *testing.T) {
+	header, _ := NewHeader("D", "D0", "A", "D", "00", "E")
+	kb, _ := NewKeyBlock(bytes.Repeat([]byte("E"), 32), header)
+	testKey := bytes.Repeat([]byte{0x00}, 32)
+
+	_, err := kb.Wrap(testKey, nil)
+	assert.Nil(t, err)
+
+	SetKeySanityPolicy(KEY_SANITY_REJECT)
+	defer SetKeySanityPolicy(KEY_SANITY_SKIP)
+	_, err = kb.Wrap(testKey, nil)
+	assert.EqualError(t, err, "KeyBlockError: Key is all zeros, likely a test key.")
+
+	key, _ := hex.DecodeString("9B71D224BD62F3785D96D46AD3EA3D73")
+	_, err = kb.Wrap(key, nil)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,163 @@
+package tr31
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// KSNFormat identifies the DUKPT variant a key serial number belongs to
+type KSNFormat int
+
+const (
+	// KSN_TDES is the 80 bit ANS X9.24-1 TDES DUKPT KSN: 40 bit key set ID,
+	// 19 bit device ID and 21 bit transaction counter, carried in the KS block
+	KSN_TDES KSNFormat = iota
+	// KSN_AES is the 96 bit ANS X9.24-3 AES DUKPT KSN: 32 bit BDK ID, 32 bit
+	// derivation ID and 32 bit transaction counter. The first 64 bits are the
+	// initial key ID carried in the IK block.
+	KSN_AES
+)
+
+// _ksnLayouts holds the bit sizes of the KSN fields and the most counter bits set
+// X9.24 allows, which bounds the number of future keys a device has to keep
+var _ksnLayouts = map[KSNFormat]struct {
+	bdkIDLen      int
+	deviceIDBits  int
+	counterBits   int
+	maxOnes       int
+	initialBlock  string
+	initialKeyLen int
+}{
+	KSN_TDES: {bdkIDLen: 5, deviceIDBits: 19, counterBits: 21, maxOnes: 10, initialBlock: "KS", initialKeyLen: 10},
+	KSN_AES:  {bdkIDLen: 4, deviceIDBits: 32, counterBits: 32, maxOnes: 16, initialBlock: "IK", initialKeyLen: 8},
+}
+
+// KSN is a DUKPT key serial number
+type KSN struct {
+	Format KSNFormat
+	// BDKID identifies the base derivation key: the 5 byte key set ID for TDES, 4 bytes for AES
+	BDKID []byte
+	// DeviceID is the 19 bit TDES device ID or the 32 bit AES derivation ID
+	DeviceID uint32
+	// Counter is the transaction counter
+	Counter uint32
+}
+
+// ParseKSN parses a KSN from 20 (TDES) or 24 (AES) hexchars
+func ParseKSN(ksn string) (*KSN, error) {
+	raw, err := hex.DecodeString(ksn)
+	if err != nil {
+		return nil, &HeaderError{Message: fmt.Sprintf(KSNErrMalformed, ksn)}
+	}
+	switch len(raw) {
+	case 10:
+		tail := uint64(raw[5])<<32 | uint64(binary.BigEndian.Uint32(raw[6:]))
+		k := &KSN{
+			Format:   KSN_TDES,
+			BDKID:    raw[:5],
+			DeviceID: uint32(tail >> 21),
+			Counter:  uint32(tail & (1<<21 - 1)),
+		}
+		return k, k.Validate()
+	case 12:
+		k := &KSN{
+			Format:   KSN_AES,
+			BDKID:    raw[:4],
+			DeviceID: binary.BigEndian.Uint32(raw[4:8]),
+			Counter:  binary.BigEndian.Uint32(raw[8:]),
+		}
+		return k, k.Validate()
+	}
+	return nil, &HeaderError{Message: fmt.Sprintf(KSNErrMalformed, ksn)}
+}
+
+// Validate checks the fields fit the format and the counter has no more bits set than X9.24 allows
+func (k *KSN) Validate() error {
+	layout, exists := _ksnLayouts[k.Format]
+	if !exists || len(k.BDKID) != layout.bdkIDLen {
+		return &HeaderError{Message: fmt.Sprintf(KSNErrMalformed, hex.EncodeToString(k.BDKID))}
+	}
+	if uint64(k.DeviceID) >= 1<<layout.deviceIDBits {
+		return &HeaderError{Message: fmt.Sprintf(KSNErrField, "device ID", k.DeviceID, layout.deviceIDBits)}
+	}
+	if uint64(k.Counter) >= 1<<layout.counterBits {
+		return &HeaderError{Message: fmt.Sprintf(KSNErrField, "transaction counter", k.Counter, layout.counterBits)}
+	}
+	if bits.OnesCount32(k.Counter) > layout.maxOnes {
+		return &HeaderError{Message: fmt.Sprintf(KSNErrCounterBits, k.Counter, layout.maxOnes)}
+	}
+	return nil
+}
+
+// String formats the KSN as uppercase hex
+func (k *KSN) String() string {
+	var raw []byte
+	switch k.Format {
+	case KSN_TDES:
+		tail := uint64(k.DeviceID)<<21 | uint64(k.Counter)
+		raw = append(append([]byte{}, k.BDKID...), byte(tail>>32), 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(raw[6:], uint32(tail))
+	case KSN_AES:
+		raw = append(append([]byte{}, k.BDKID...), make([]byte, 8)...)
+		binary.BigEndian.PutUint32(raw[4:8], k.DeviceID)
+		binary.BigEndian.PutUint32(raw[8:], k.Counter)
+	}
+	return strings.ToUpper(hex.EncodeToString(raw))
+}
+
+// Next returns the KSN of the next transaction. Counters with more bits set than
+// X9.24 allows are skipped, and an error is returned once the counter is exhausted.
+func (k *KSN) Next() (*KSN, error) {
+	layout := _ksnLayouts[k.Format]
+	counter := uint64(k.Counter) + 1
+	for bits.OnesCount64(counter) > layout.maxOnes {
+		// Adding the lowest set bit clears the run of low bits
+		counter += counter & -counter
+	}
+	if counter >= 1<<layout.counterBits {
+		return nil, &HeaderError{Message: KSNErrExhausted}
+	}
+	next := *k
+	next.BDKID = append([]byte{}, k.BDKID...)
+	next.Counter = uint32(counter)
+	return &next, nil
+}
+
+// Initial returns the KSN with a zero transaction counter, identifying the initial key
+func (k *KSN) Initial() *KSN {
+	initial := *k
+	initial.BDKID = append([]byte{}, k.BDKID...)
+	initial.Counter = 0
+	return &initial
+}
+
+// InitialKeyID returns the optional block data identifying the initial key: the
+// initial KSN for TDES, or the BDK ID and derivation ID for AES
+func (k *KSN) InitialKeyID() string {
+	layout := _ksnLayouts[k.Format]
+	return k.Initial().String()[:layout.initialKeyLen*2]
+}
+
+// SetBlock stores the initial key ID in the header, in the KS block for TDES
+// DUKPT or the IK block for AES DUKPT
+func (k *KSN) SetBlock(h *Header) error {
+	if err := k.Validate(); err != nil {
+		return err
+	}
+	return h.Blocks.Set(_ksnLayouts[k.Format].initialBlock, k.InitialKeyID())
+}
+
+// KSNFromHeader reads the initial KSN from the KS or IK block of a header.
+// The transaction counter of the returned KSN is zero.
+func KSNFromHeader(h *Header) (*KSN, error) {
+	if data, err := h.Blocks.Get("KS"); err == nil {
+		return ParseKSN(data)
+	}
+	if data, err := h.Blocks.Get("IK"); err == nil {
+		return ParseKSN(data + "00000000")
+	}
+	return nil, &HeaderError{Message: KSNErrNoBlock}
+}
@@ -0,0 +1,102 @@
+package tr31
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKSN(t *testing.T) {
+	ksn, err := ParseKSN("FFFF9876543210E00008")
+	assert.Nil(t, err)
+	assert.Equal(t, KSN_TDES, ksn.Format)
+	assert.Equal(t, []byte{0xFF, 0xFF, 0x98, 0x76, 0x54}, ksn.BDKID)
+	assert.Equal(t, uint32(0x19087), ksn.DeviceID)
+	assert.Equal(t, uint32(8), ksn.Counter)
+	assert.Equal(t, "FFFF9876543210E00008", ksn.String())
+	assert.Equal(t, "FFFF9876543210E00000", ksn.InitialKeyID())
+
+	ksn, err = ParseKSN("123456789012345600000001")
+	assert.Nil(t, err)
+	assert.Equal(t, KSN_AES, ksn.Format)
+	assert.Equal(t, []byte{0x12, 0x34, 0x56, 0x78}, ksn.BDKID)
+	assert.Equal(t, uint32(0x90123456), ksn.DeviceID)
+	assert.Equal(t, uint32(1), ksn.Counter)
+	assert.Equal(t, "123456789012345600000001", ksn.String())
+	assert.Equal(t, "1234567890123456", ksn.InitialKeyID())
+}
+
+func TestParseKSNErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		ksn           string
+		expectedError string
+	}{
+		{"Not hex", "FFFF9876543210E0000Z", "HeaderError: KSN (FFFF9876543210E0000Z) is malformed. Expecting 20 hexchars for TDES DUKPT or 24 hexchars for AES DUKPT."},
+		{"Wrong length", "FFFF9876543210E000", "HeaderError: KSN (FFFF9876543210E000) is malformed. Expecting 20 hexchars for TDES DUKPT or 24 hexchars for AES DUKPT."},
+		{"TDES counter bits", "FFFF98765432100FFE00", "HeaderError: KSN transaction counter (1048064) has more than 10 bits set."},
+		{"AES counter bits", "12345678901234560001FFFF", "HeaderError: KSN transaction counter (131071) has more than 16 bits set."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseKSN(tt.ksn)
+			assert.Equal(t, tt.expectedError, err.Error())
+		})
+	}
+
+	ksn := &KSN{Format: KSN_TDES, BDKID: make([]byte, 5), DeviceID: 1 << 19}
+	assert.Equal(t, "HeaderError: KSN device ID (524288) is out of range. Expecting at most 19 bits.", ksn.Validate().Error())
+}
+
+func TestKSNNext(t *testing.T) {
+	ksn, _ := ParseKSN("FFFF9876543210E00000")
+	next, err := ksn.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, "FFFF9876543210E00001", next.String())
+	assert.Equal(t, "FFFF9876543210E00000", ksn.String())
+
+	// 0x3FF has 10 bits set, 0x400 is next. 0x7FE has 10 bits set, 0x7FF would have 11.
+	ksn.Counter = 0x3FF
+	next, _ = ksn.Next()
+	assert.Equal(t, uint32(0x400), next.Counter)
+	ksn.Counter = 0x7FE
+	next, _ = ksn.Next()
+	assert.Equal(t, uint32(0x800), next.Counter)
+
+	// The last TDES counter has its 10 highest bits set
+	ksn.Counter = 0x1FF800
+	_, err = ksn.Next()
+	assert.Equal(t, "HeaderError: KSN transaction counter is exhausted.", err.Error())
+
+	aes, _ := ParseKSN("12345678901234560000FFFF")
+	next, err = aes.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0x10000), next.Counter)
+}
+
+func TestKSNHeaderBlocks(t *testing.T) {
+	for _, tc := range []struct {
+		ksn     string
+		blockID string
+		data    string
+	}{
+		{"FFFF9876543210E00008", "KS", "FFFF9876543210E00000"},
+		{"123456789012345600000001", "IK", "1234567890123456"},
+	} {
+		ksn, _ := ParseKSN(tc.ksn)
+		header, _ := NewHeader("D", "B1", "A", "X", "00", "N")
+		assert.Nil(t, ksn.SetBlock(header))
+		data, err := header.Blocks.Get(tc.blockID)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.data, data)
+
+		initial, err := KSNFromHeader(header)
+		assert.Nil(t, err)
+		assert.Equal(t, ksn.Initial(), initial)
+	}
+
+	header, _ := NewHeader("D", "B1", "A", "X", "00", "N")
+	_, err := KSNFromHeader(header)
+	assert.Equal(t, "HeaderError: Header has no KS or IK block.", err.Error())
+}
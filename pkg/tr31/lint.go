@@ -0,0 +1,146 @@
+package tr31
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/moov-io/tr31/pkg/charset"
+)
+
+// Header field values defined by X9.143. Numeric values are reserved for
+// proprietary use and accepted in every field.
+const (
+	_lintAlgorithms     = "ADEHRST"
+	_lintModesOfUse     = "BCDEGNSTVXY"
+	_lintExportability  = "ENS"
+	_lintProprietaryIDs = "0123456789"
+)
+
+// keyUsageSpec describes a key usage defined by X9.143: the algorithms and
+// modes of use a key of that usage may have
+type keyUsageSpec struct {
+	algorithms  string
+	modesOfUse  string
+	description string
+}
+
+// _keyUsages maps the key usages defined by X9.143 to their algorithms and modes of use
+var _keyUsages = map[string]keyUsageSpec{
+	"B0": {"AT", "X", "Base derivation key (BDK)"},
+	"B1": {"AT", "X", "Initial DUKPT key"},
+	"B2": {"T", "X", "Base key variant key"},
+	"B3": {"AT", "X", "Key derivation key"},
+	"C0": {"ADT", "CGV", "Card verification key"},
+	"D0": {"ADT", "BDE", "Symmetric data encryption key"},
+	"D1": {"ER", "BDE", "Asymmetric data encryption key"},
+	"D2": {"ADT", "BDE", "Data encryption key for decimalization tables"},
+	"D3": {"AT", "BDE", "Data encryption key for sensitive data"},
+	"E0": {"AT", "X", "EMV master key for application cryptograms"},
+	"E1": {"AT", "X", "EMV master key for secure messaging confidentiality"},
+	"E2": {"AT", "X", "EMV master key for secure messaging integrity"},
+	"E3": {"AT", "X", "EMV master key for data authentication codes"},
+	"E4": {"AT", "X", "EMV master key for dynamic numbers"},
+	"E5": {"AT", "X", "EMV master key for card personalization"},
+	"E6": {"AT", "X", "EMV master key, other"},
+	"E7": {"AT", "X", "EMV asymmetric master key"},
+	"I0": {"ADT", "N", "Initialization vector"},
+	"K0": {"ADT", "BDE", "Key encryption or wrapping key"},
+	"K1": {"AT", "BDE", "TR-31 key block protection key"},
+	"K2": {"R", "BDE", "TR-34 asymmetric key"},
+	"K3": {"ER", "X", "Asymmetric key for key agreement"},
+	"K4": {"AT", "BDE", "ISO 20038 key block protection key"},
+	"M0": {"T", "CGV", "ISO 16609 MAC algorithm 1"},
+	"M1": {"DT", "CGV", "ISO 9797-1 MAC algorithm 1"},
+	"M2": {"DT", "CGV", "ISO 9797-1 MAC algorithm 2"},
+	"M3": {"DT", "CGV", "ISO 9797-1 MAC algorithm 3"},
+	"M4": {"DT", "CGV", "ISO 9797-1 MAC algorithm 4"},
+	"M5": {"DT", "CGV", "ISO 9797-1:1999 MAC algorithm 5"},
+	"M6": {"AT", "CGV", "ISO 9797-1:2011 MAC algorithm 5 (CMAC)"},
+	"M7": {"H", "CGV", "HMAC"},
+	"M8": {"DT", "CGV", "ISO 9797-1:2011 MAC algorithm 6"},
+	"P0": {"ADT", "BDE", "PIN encryption key"},
+	"P1": {"ADT", "CGV", "PIN generation key"},
+	"S0": {"ERS", "SV", "Asymmetric key pair for digital signatures"},
+	"S1": {"ERS", "SV", "Asymmetric key pair for a CA"},
+	"S2": {"ERS", "SV", "Asymmetric key pair, non X9.24"},
+	"V0": {"ADT", "CGV", "PIN verification key, other algorithms"},
+	"V1": {"DT", "CGV", "PIN verification key, IBM 3624"},
+	"V2": {"DT", "CGV", "PIN verification key, Visa PVV"},
+	"V3": {"A", "CGV", "PIN verification key, X9.132 algorithm 1"},
+	"V4": {"A", "CGV", "PIN verification key, X9.132 algorithm 2"},
+}
+
+// Lint checks a header before a key block is emitted with it. The fields are
+// checked the way Load checks them, since callers may set them directly, along
+// with the key usage being defined by X9.143 and allowing the algorithm, the
+// mode of use and exportability being defined and the optional block data
+// using the block's character set. All problems found are returned joined, so
+// errors.As still finds a *HeaderError. Wrap lints the header before wrapping.
+func (h *Header) Lint() error {
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, &HeaderError{Message: fmt.Sprintf(format, args...)})
+	}
+
+	if _, exists := LookupVersion(h.VersionID); !exists {
+		add(ErrVersionID, h.VersionID)
+	}
+
+	usageValid := len(h.KeyUsage) == 2 && charset.IsAlphanumeric(h.KeyUsage)
+	usage, usageDefined := _keyUsages[h.KeyUsage]
+	algorithms := usage.algorithms
+	switch {
+	case !usageValid:
+		add(HeaderErrKeyUsage, h.KeyUsage)
+	case !usageDefined && !isProprietaryValue(h.KeyUsage):
+		add(LintErrKeyUsage, h.KeyUsage)
+	}
+
+	// Vendor algorithms registered with RegisterAlgorithm are valid for any key usage
+	algorithm, registered := LookupAlgorithm(h.Algorithm)
+	vendorAlgorithm := registered && !algorithm.builtin
+	algorithmValid := len(h.Algorithm) == 1 && (contains(_lintAlgorithms, rune(h.Algorithm[0])) || isProprietaryValue(h.Algorithm) || vendorAlgorithm)
+	if !algorithmValid {
+		add(HeaderErrAlgorithm, h.Algorithm)
+	} else if usageDefined && !vendorAlgorithm && !contains(algorithms, rune(h.Algorithm[0])) {
+		add(LintErrAlgorithmUsage, h.Algorithm, h.KeyUsage, algorithms)
+	}
+
+	if len(h.ModeOfUse) != 1 || !(contains(_lintModesOfUse, rune(h.ModeOfUse[0])) || isProprietaryValue(h.ModeOfUse)) {
+		add(HeaderErrModeOfUse, h.ModeOfUse)
+	}
+	if len(h.VersionNum) != 2 || !charset.IsAlphanumeric(h.VersionNum) {
+		add(HeaderErrVersionNumber, h.VersionNum)
+	}
+	if len(h.Exportability) != 1 || !(contains(_lintExportability, rune(h.Exportability[0])) || isProprietaryValue(h.Exportability)) {
+		add(HeaderErrExportability, h.Exportability)
+	}
+	if len(h.Reserved) != 2 || !charset.IsAlphanumeric(h.Reserved) {
+		add(LintErrReserved, h.Reserved)
+	}
+
+	// Blocks are validated when set, but validators may have been registered since
+	ids := make([]string, 0, len(h.Blocks._blocks))
+	for id := range h.Blocks._blocks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if len(id) != 2 || !charset.IsAlphanumeric(id) {
+			add(BlockErrorIdInvalid, id)
+			continue
+		}
+		if err := validateBlockData(id, h.Blocks._blocks[id]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// isProprietaryValue reports whether a header field value starts with a digit,
+// the range X9.143 reserves for proprietary values
+func isProprietaryValue(value string) bool {
+	return len(value) > 0 && contains(_lintProprietaryIDs, rune(value[0]))
+}
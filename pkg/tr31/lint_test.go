@@ -0,0 +1,91 @@
+package tr31
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderLint(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []string
+		errs   []string
+	}{
+		{"AES KBPK", []string{"D", "K1", "A", "B", "00", "N"}, nil},
+		{"TDES MAC key", []string{"B", "M3", "T", "C", "00", "S"}, nil},
+		{"Proprietary key usage", []string{"B", "00", "R", "0", "00", "1"}, nil},
+		{"Undefined key usage", []string{"B", "Q9", "T", "B", "00", "N"}, []string{
+			"HeaderError: Key usage (Q9) is not defined by X9.143.",
+		}},
+		{"AES PVV key", []string{"D", "V2", "A", "V", "00", "N"}, []string{
+			"HeaderError: Algorithm (A) is not allowed for key usage V2. Expecting one of DT.",
+		}},
+		{"Undefined attributes", []string{"B", "P0", "Z", "Z", "00", "Z"}, []string{
+			"HeaderError: Algorithm (Z) is invalid.",
+			"HeaderError: Mode of use (Z) is invalid.",
+			"HeaderError: Exportability (Z) is invalid.",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewHeader(tt.header[0], tt.header[1], tt.header[2], tt.header[3], tt.header[4], tt.header[5])
+			assert.Nil(t, err)
+
+			err = h.Lint()
+			if tt.errs == nil {
+				assert.Nil(t, err)
+				return
+			}
+			var headerErr *HeaderError
+			assert.True(t, errors.As(err, &headerErr))
+			for _, msg := range tt.errs {
+				assert.Contains(t, err.Error(), msg)
+			}
+		})
+	}
+}
+
+func TestHeaderLintFieldsSetDirectly(t *testing.T) {
+	h := DefaultHeader()
+	h.VersionID = "X"
+	h.KeyUsage = "k"
+	h.Reserved = "?"
+
+	err := h.Lint()
+	assert.Equal(t, "HeaderError: Version ID (X) is not supported.\n"+
+		"HeaderError: Key usage (k) is invalid.\n"+
+		"HeaderError: Reserved field (?) is invalid.", err.Error())
+}
+
+func TestHeaderLintBlockCharset(t *testing.T) {
+	h := DefaultHeader()
+	assert.Nil(t, h.Blocks.Set("1L", "T-1000"))
+
+	// The block was valid when set, but a validator registered since rejects it
+	assert.Nil(t, RegisterBlockValidator("1L", CharsetBlockValidator("numeric", BLOCK_CHARSET_NUMERIC)))
+	defer RegisterBlockValidator("1L", nil)
+
+	err := h.Lint()
+	assert.Equal(t, "HeaderError: Block 1L data is invalid. Expecting numeric characters. Data: 'T-1000'", err.Error())
+}
+
+func TestWrapLintsHeader(t *testing.T) {
+	h, err := NewHeader(TR31_VERSION_D, "M0", ENC_ALGORITHM_AES, "C", "00", "N")
+	assert.Nil(t, err)
+	h.ModeOfUse = "Q"
+
+	kb, err := NewKeyBlock(bytes.Repeat([]byte("E"), 16), h)
+	assert.Nil(t, err)
+	block, err := kb.Wrap(bytes.Repeat([]byte("F"), 16), nil)
+	assert.Empty(t, block)
+	assert.Equal(t, "HeaderError: Algorithm (A) is not allowed for key usage M0. Expecting one of T.\n"+
+		"HeaderError: Mode of use (Q) is invalid.", err.Error())
+
+	h.KeyUsage, h.ModeOfUse = "M6", "C"
+	_, err = kb.Wrap(bytes.Repeat([]byte("F"), 16), nil)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,78 @@
+package tr31
+
+import "fmt"
+
+// LogEvent identifies the events reported to a Logger
+type LogEvent string
+
+const (
+	// LOG_EVENT_PARSE_WARNING reports a fix lenient parsing applied to a malformed key block
+	LOG_EVENT_PARSE_WARNING LogEvent = "parse_warning"
+	// LOG_EVENT_COMPATIBILITY_MODE reports wrap options differing from the defaults of the key block version
+	LOG_EVENT_COMPATIBILITY_MODE LogEvent = "compatibility_mode"
+	// LOG_EVENT_DEPRECATED reports a deprecated key block version or algorithm
+	LOG_EVENT_DEPRECATED LogEvent = "deprecated"
+	// LOG_EVENT_TRACE reports a step of wrapping or unwrapping, in builds with the tr31trace tag
+	LOG_EVENT_TRACE LogEvent = "trace"
+)
+
+// Logger receives the significant events of parsing, wrapping and unwrapping
+// key blocks, so embedding applications can surface them in their own logs.
+// The library never writes them anywhere else.
+type Logger interface {
+	Log(event LogEvent, message string)
+}
+
+// LoggerFunc adapts a function to the Logger interface
+type LoggerFunc func(event LogEvent, message string)
+
+// Log calls f(event, message)
+func (f LoggerFunc) Log(event LogEvent, message string) {
+	f(event, message)
+}
+
+// WithLogger reports the events of the key block to l, including those of
+// loading the header given to NewKeyBlock
+func WithLogger(l Logger) KeyBlockOption {
+	return func(c *keyBlockConfig) {
+		c.logger = l
+	}
+}
+
+// SetLogger reports the events of loading headers to l, nil stops reporting them
+func (h *Header) SetLogger(l Logger) {
+	h.logger = l
+}
+
+// SetLogger reports the events of wrapping and unwrapping to l, nil stops reporting them
+func (kb *KeyBlock) SetLogger(l Logger) {
+	kb.header.SetLogger(l)
+}
+
+func (h *Header) log(event LogEvent, message string) {
+	if h.logger != nil {
+		h.logger.Log(event, message)
+	}
+}
+
+// logDeprecations reports the deprecated features used by the header
+func (h *Header) logDeprecations() {
+	if h.logger == nil {
+		return
+	}
+	for _, deprecation := range h.Deprecations() {
+		h.log(LOG_EVENT_DEPRECATED, deprecation)
+	}
+}
+
+// logCompatibility reports wrap options set to match a host disagreeing with
+// the defaults of the key block version
+func (kb *KeyBlock) logCompatibility() {
+	if kb.options == nil || kb.header.logger == nil {
+		return
+	}
+	defaults := DefaultWrapOptions(kb.header.VersionID)
+	if *kb.options != defaults {
+		kb.header.log(LOG_EVENT_COMPATIBILITY_MODE, fmt.Sprintf(LogCompatibilityMode, kb.header.VersionID, *kb.options, defaults))
+	}
+}
@@ -0,0 +1,79 @@
+package tr31
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type logEntry struct {
+	event   LogEvent
+	message string
+}
+
+func recordLogs(entries *[]logEntry) Logger {
+	return LoggerFunc(func(event LogEvent, message string) {
+		*entries = append(*entries, logEntry{event, message})
+	})
+}
+
+func TestLogger_lenientParsing(t *testing.T) {
+	kbpk := bytes.Repeat([]byte("E"), 16)
+	key := bytes.Repeat([]byte{0x11}, 16)
+	header, _ := NewHeader("B", "P0", "T", "E", "00", "N")
+	kb, _ := NewKeyBlock(kbpk, header)
+	headerDump, _ := header.Dump(24)
+	legacyKb, err := kb.BWrap("b"+headerDump[1:5]+"p0TE 0n"+headerDump[12:], key, 8)
+	assert.Nil(t, err)
+
+	var entries []logEntry
+	received, _ := NewKeyBlock(kbpk, nil, WithLogger(recordLogs(&entries)))
+	received.SetParseOptions(ParseOptions{LenientASCII: true})
+	_, err = received.Unwrap(legacyKb + "\n")
+	assert.Nil(t, err)
+	assert.Equal(t, []logEntry{
+		{LOG_EVENT_PARSE_WARNING, "Version ID (b) normalized to (B)."},
+		{LOG_EVENT_PARSE_WARNING, "Key usage (p0) normalized to (P0)."},
+		{LOG_EVENT_PARSE_WARNING, "Version number ( 0) normalized to (00)."},
+		{LOG_EVENT_PARSE_WARNING, "Exportability (n) normalized to (N)."},
+		{LOG_EVENT_PARSE_WARNING, "Whitespace around key block trimmed."},
+	}, entries)
+
+	// Nothing is reported once the logger is removed
+	entries = nil
+	received.SetLogger(nil)
+	_, err = received.Unwrap(legacyKb + "\n")
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestLogger_deprecatedAndCompatibility(t *testing.T) {
+	kbpk := bytes.Repeat([]byte("E"), 16)
+	key := bytes.Repeat([]byte{0x11}, 16)
+	var entries []logEntry
+
+	kb, _ := NewKeyBlockFromString(kbpk, "A0000D0TE00N0000", WithLogger(recordLogs(&entries)))
+	assert.Equal(t, []logEntry{{LOG_EVENT_DEPRECATED, DeprecationVersionA}}, entries)
+
+	entries = nil
+	kb.SetWrapOptions(WrapOptions{MaskKeyLength: true, RandomPad: true})
+	block, err := kb.Wrap(key, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, LOG_EVENT_DEPRECATED, entries[0].event)
+	assert.Equal(t, LOG_EVENT_COMPATIBILITY_MODE, entries[1].event)
+	assert.Contains(t, entries[1].message, "Key block version A uses wrap options")
+
+	entries = nil
+	_, err = kb.Unwrap(block)
+	assert.Nil(t, err)
+	assert.Equal(t, []LogEvent{LOG_EVENT_DEPRECATED, LOG_EVENT_COMPATIBILITY_MODE}, []LogEvent{entries[0].event, entries[1].event})
+
+	// The version defaults report nothing
+	entries = nil
+	header, _ := NewHeader("D", "D0", "A", "D", "00", "E")
+	kb, _ = NewKeyBlock(bytes.Repeat([]byte("E"), 32), header, WithLogger(recordLogs(&entries)))
+	_, err = kb.Wrap(key, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
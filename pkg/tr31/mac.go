@@ -1,6 +1,9 @@
 package tr31
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
 	"encoding/binary"
 	"fmt"
 )
@@ -12,89 +15,244 @@ const (
 	AES
 )
 
-var _padDispatch = map[int]func(data []byte, blockSize int) ([]byte, error){
-	1: padISO1,
-	2: padISO2,
-	3: padISO3,
+// PadMethod is an ISO/IEC 9797-1 padding method
+type PadMethod int
+
+const (
+	// PAD_METHOD_1 appends zeros up to the block size, data already a whole number of blocks isn't padded
+	PAD_METHOD_1 PadMethod = 1
+	// PAD_METHOD_2 appends 0x80 then zeros up to the block size
+	PAD_METHOD_2 PadMethod = 2
+	// PAD_METHOD_3 prepends a block holding the data length in bits, then pads with zeros like PAD_METHOD_1
+	PAD_METHOD_3 PadMethod = 3
+)
+
+// MACAlgorithm is an ISO/IEC 9797-1 MAC algorithm
+type MACAlgorithm int
+
+const (
+	// MAC_ALGORITHM_1 is CBC-MAC with DES, TDES or AES
+	MAC_ALGORITHM_1 MACAlgorithm = 1
+	// MAC_ALGORITHM_3 is the retail MAC (ANSI X9.19): single DES CBC-MAC under the
+	// first half of a 16 byte key, the last block encrypted with TDES under the whole key
+	MAC_ALGORITHM_3 MACAlgorithm = 3
+	// MAC_ALGORITHM_5 is CMAC (NIST SP 800-38B) with TDES or AES, which pads as CMAC specifies
+	MAC_ALGORITHM_5 MACAlgorithm = 5
+)
+
+// MIN_MAC_LENGTH is the shortest MAC truncation accepted, 32 bits as ISO/IEC 9797-1 recommends
+const MIN_MAC_LENGTH int = 4
+
+// MACError is returned for MAC inputs which can't produce a MAC, such as an
+// unknown padding method or a length the cipher block can't be truncated to
+type MACError struct {
+	Message string
+}
+
+// Error method to implement the error interface for MACError.
+func (e *MACError) Error() string {
+	return fmt.Sprintf("MACError: %s", e.Message)
+}
+
+var _padDispatch = map[PadMethod]func(data []byte, blockSize int) ([]byte, error){
+	PAD_METHOD_1: padISO1,
+	PAD_METHOD_2: padISO2,
+	PAD_METHOD_3: padISO3,
+}
+
+// ComputeMAC computes a MAC of data with an ISO/IEC 9797-1 MAC algorithm and
+// padding method, such as ComputeMAC(MAC_ALGORITHM_3, PAD_METHOD_2, DES, key, data, 8).
+// blockCipher picks DES (single DES or TDES, following the key length) or AES
+// for algorithms 1 and 5. The MAC is truncated to length bytes, from MIN_MAC_LENGTH
+// to the cipher block size, or is the whole block when length is 0, so 4, 8 and 16
+// byte MACs are supported. Padding is ignored by MAC_ALGORITHM_5. Invalid inputs
+// return a *MACError.
+func ComputeMAC(algorithm MACAlgorithm, padding PadMethod, blockCipher Algorithm, key, data []byte, length int) ([]byte, error) {
+	switch algorithm {
+	case MAC_ALGORITHM_1:
+		return GenerateCBCMAC(key, data, padding, length, blockCipher)
+	case MAC_ALGORITHM_3:
+		if blockCipher != DES || len(key) != 16 {
+			return nil, &MACError{Message: fmt.Sprintf(MACErrRetailKey, len(key))}
+		}
+		return generateRetailMAC(key[:8], key[8:], data, padding, length)
+	case MAC_ALGORITHM_5:
+		return generateCMAC(key, data, length, blockCipher)
+	}
+	return nil, &MACError{Message: fmt.Sprintf(MACErrAlgorithm, algorithm)}
 }
 
-func GenerateCBCMAC(key []byte, data []byte, padding int, length int, algorithm Algorithm) ([]byte, error) {
-	if padding == 0 {
-		return nil, fmt.Errorf("Specify valid padding method: 1, 2 or 3.")
+// macLength validates the MAC length for the cipher block size, 0 keeps the whole block
+func macLength(length, blockSize int) (int, error) {
+	if length == 0 {
+		return blockSize, nil
 	}
-	if key == nil {
-		return nil, fmt.Errorf("Invalid key.")
+	if length < MIN_MAC_LENGTH || length > blockSize {
+		return 0, &MACError{Message: fmt.Sprintf(MACErrLength, length, MIN_MAC_LENGTH, blockSize)}
 	}
-	if data == nil || len(data) == 0 {
-		return nil, fmt.Errorf("Invalid data.")
+	return length, nil
+}
+
+// checkMACInput validates the padding method, key and data common to the MAC algorithms
+func checkMACInput(padding PadMethod, key, data []byte) error {
+	if _, exists := _padDispatch[padding]; !exists {
+		return &MACError{Message: fmt.Sprintf(MACErrPadding, padding)}
 	}
-	if length == 0 {
-		if algorithm == AES {
-			length = 16
-		} else {
-			length = 8
-		}
+	if len(key) == 0 {
+		return &MACError{Message: MACErrKeyMissing}
 	}
+	if len(data) == 0 {
+		return &MACError{Message: MACErrDataEmpty}
+	}
+	return nil
+}
 
-	implementation := EncryptTDESCBC
-	blockSize := 8
+// GenerateCBCMAC computes a CBC-MAC, ISO/IEC 9797-1 MAC algorithm 1, with the
+// padding method. length follows the truncation rules of ComputeMAC.
+func GenerateCBCMAC(key []byte, data []byte, padding PadMethod, length int, algorithm Algorithm) ([]byte, error) {
+	if err := checkMACInput(padding, key, data); err != nil {
+		return nil, err
+	}
 
-	if algorithm == DES {
+	var implementation func(key, iv, data []byte) ([]byte, error)
+	var blockSize int
+	switch algorithm {
+	case DES:
 		blockSize = 8
 		implementation = EncryptTDESCBC
-	}
-	if algorithm == AES {
+	case AES:
 		blockSize = 16
 		implementation = EncryptAESCBC
+	default:
+		return nil, &MACError{Message: fmt.Sprintf(MACErrCipher, algorithm)}
 	}
-	if padding > 3 {
-		return nil, fmt.Errorf("Specify valid padding method: 1, 2 or 3.")
+	length, err := macLength(length, blockSize)
+	if err != nil {
+		return nil, err
 	}
 	paddedData, err := _padDispatch[padding](data, blockSize)
 	if err != nil {
-		return nil, fmt.Errorf("invalid padding method: %v", err)
+		return nil, &MACError{Message: fmt.Sprintf(MACErrPaddingFailed, err)}
 	}
 
 	// Encrypt the data
 	mac, err := implementation(key, make([]byte, blockSize), paddedData)
 	if err != nil {
-		return nil, err
+		return nil, &MACError{Message: fmt.Sprintf(MACErrKeyInvalid, err)}
 	}
 	mac = mac[len(mac)-blockSize:]
 	return mac[:length], nil
 }
 
-func generateRetailMAC(key1 []byte, key2 []byte, data []byte, padding int, length int) ([]byte, error) {
-	if padding == 0 || padding > 3 {
-		return nil, fmt.Errorf("Specify valid padding method: 1, 2 or 3.")
-	}
-	if key1 == nil || key2 == nil {
-		return nil, fmt.Errorf("Invalid key.")
+// generateRetailMAC computes the retail MAC, ISO/IEC 9797-1 MAC algorithm 3:
+// every block is chained under key1, then the last one is decrypted under key2
+// and encrypted again under key1
+func generateRetailMAC(key1 []byte, key2 []byte, data []byte, padding PadMethod, length int) ([]byte, error) {
+	if err := checkMACInput(padding, key1, data); err != nil {
+		return nil, err
 	}
-	if data == nil || len(data) == 0 {
-		return nil, fmt.Errorf("Invalid data.")
+	if len(key1) < 8 || len(key2) < 8 {
+		return nil, &MACError{Message: fmt.Sprintf(MACErrRetailKey, len(key1)+len(key2))}
 	}
-	if length == 0 {
-		length = 8
+	length, err := macLength(length, 8)
+	if err != nil {
+		return nil, err
 	}
 
 	paddedData, err := _padDispatch[padding](data, 8)
 	if err != nil {
-		return nil, fmt.Errorf("invalid padding method: %v", err)
+		return nil, &MACError{Message: fmt.Sprintf(MACErrPaddingFailed, err)}
 	}
 
-	// First, encrypt using key1
-	encData, err := EncryptTDESCBC(key1, make([]byte, 8), paddedData)
+	// First, chain every block but the last using key1
+	chained := make([]byte, 8)
+	if len(paddedData) > 8 {
+		encData, err := EncryptTDESCBC(key1, make([]byte, 8), paddedData[:len(paddedData)-8])
+		if err != nil {
+			return nil, &MACError{Message: fmt.Sprintf(MACErrKeyInvalid, err)}
+		}
+		chained = encData[len(encData)-8:]
+	}
+	// Then, encrypt the last block using TDES with key1 and key2
+	tdesKey := append(append([]byte{}, key1[:8]...), key2[:8]...)
+	mac, err := EncryptTDESCBC(tdesKey, chained, paddedData[len(paddedData)-8:])
+	if err != nil {
+		return nil, &MACError{Message: fmt.Sprintf(MACErrKeyInvalid, err)}
+	}
+	return mac[:length], nil
+}
+
+// generateCMAC computes a CMAC, ISO/IEC 9797-1 MAC algorithm 5, with TDES or AES
+func generateCMAC(key []byte, data []byte, length int, algorithm Algorithm) ([]byte, error) {
+	var block cipher.Block
+	var err error
+	switch algorithm {
+	case AES:
+		block, err = aes.NewCipher(key)
+	case DES:
+		if len(key) != 16 && len(key) != 24 {
+			return nil, &MACError{Message: fmt.Sprintf(MACErrCMACKey, len(key))}
+		}
+		block, err = des.NewTripleDESCipher(append(append([]byte{}, key...), key[:24-len(key)]...))
+	default:
+		return nil, &MACError{Message: fmt.Sprintf(MACErrCipher, algorithm)}
+	}
 	if err != nil {
-		return nil, fmt.Errorf("invalid encrypt using key1: %v", err)
+		return nil, &MACError{Message: fmt.Sprintf(MACErrKeyInvalid, err)}
 	}
-	encData = encData[len(encData)-8:]
-	// Then, encrypt the last block using TDES with key2 and key1
-	data, err = EncryptTDESCBC(key2, encData, encData)
+	blockSize := block.BlockSize()
+	length, err = macLength(length, blockSize)
 	if err != nil {
-		return nil, fmt.Errorf("encrypt the last block using TDES with key2 and key1: %v", err)
+		return nil, err
+	}
+
+	// Subkeys from the encrypted zero block, Rb is 0x87 for 128 bit blocks and 0x1B for 64 bit ones
+	rb := byte(0x87)
+	if blockSize == 8 {
+		rb = 0x1B
+	}
+	l := make([]byte, blockSize)
+	block.Encrypt(l, l)
+	k1 := shiftSubkey(l, rb)
+	k2 := shiftSubkey(k1, rb)
+
+	// The last block is xored with k1 when complete, otherwise padded with 0x80 and zeros and xored with k2
+	n := (len(data) + blockSize - 1) / blockSize
+	last := make([]byte, blockSize)
+	if n > 0 && len(data)%blockSize == 0 {
+		last = xor(data[(n-1)*blockSize:], k1)
+	} else {
+		if n == 0 {
+			n = 1
+		}
+		copy(last, data[(n-1)*blockSize:])
+		last[len(data)-(n-1)*blockSize] = 0x80
+		last = xor(last, k2)
+	}
+
+	mac := make([]byte, blockSize)
+	for i := 0; i < n-1; i++ {
+		mac = xor(mac, data[i*blockSize:(i+1)*blockSize])
+		block.Encrypt(mac, mac)
+	}
+	mac = xor(mac, last)
+	block.Encrypt(mac, mac)
+	return mac[:length], nil
+}
+
+// shiftSubkey shifts a CMAC subkey left by one bit, xoring rb when the dropped bit is set
+func shiftSubkey(key []byte, rb byte) []byte {
+	shifted := make([]byte, len(key))
+	for i := range key {
+		shifted[i] = key[i] << 1
+		if i+1 < len(key) {
+			shifted[i] |= key[i+1] >> 7
+		}
+	}
+	if key[0]&0x80 != 0 {
+		shifted[len(shifted)-1] ^= rb
 	}
-	return data[:length], nil
+	return shifted
 }
 
 func padISO1(data []byte, blockSize int) ([]byte, error) {
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"strings"
 	"testing"
@@ -11,7 +12,7 @@ import (
 
 func Test_generate_cbc_mac_with_well_known(t *testing.T) {
 	tests := []struct {
-		padding int
+		padding PadMethod
 		length  int
 		result  string
 	}{
@@ -41,7 +42,7 @@ func TestGenerateCBCMAC(t *testing.T) {
 		name      string
 		key       []byte
 		data      []byte
-		padding   int
+		padding   PadMethod
 		length    int
 		algorithm Algorithm
 		wantErr   bool
@@ -93,7 +94,7 @@ func TestGenerateRetailMAC(t *testing.T) {
 		key1    []byte
 		key2    []byte
 		data    []byte
-		padding int
+		padding PadMethod
 		length  int
 		wantErr bool
 	}{
@@ -263,3 +264,107 @@ func TestPadISO3(t *testing.T) {
 		})
 	}
 }
+
+func TestComputeMAC(t *testing.T) {
+	hexBytes := func(s string) []byte {
+		b, _ := hex.DecodeString(s)
+		return b
+	}
+	tests := []struct {
+		name      string
+		algorithm MACAlgorithm
+		padding   PadMethod
+		cipher    Algorithm
+		key       string
+		data      []byte
+		mac       string
+	}{
+		{"CBC-MAC TDES padding 1", MAC_ALGORITHM_1, PAD_METHOD_1, DES, "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBB", []byte("hello world"), "68D9038F23360DF3"},
+		{"CBC-MAC TDES padding 2", MAC_ALGORITHM_1, PAD_METHOD_2, DES, "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBB", []byte("hello world"), "32DC341271ACCD00"},
+		{"CBC-MAC TDES padding 3", MAC_ALGORITHM_1, PAD_METHOD_3, DES, "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBB", []byte("hello world"), "CDACA53E2DAA5412"},
+		{"CBC-MAC DES FIPS 81", MAC_ALGORITHM_1, PAD_METHOD_1, DES, "0123456789ABCDEF", []byte("Now is the time for all "), "70A30640CC76DD8B"},
+		{"Retail MAC padding 1", MAC_ALGORITHM_3, PAD_METHOD_1, DES, "0123456789ABCDEFFEDCBA9876543210", []byte("Now is the time for all "), "A1C72E74EA3FA9B6"},
+		{"Retail MAC padding 2", MAC_ALGORITHM_3, PAD_METHOD_2, DES, "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBB", []byte("hello world"), "2BC2D9EDE0CF31F6"},
+		{"CMAC AES RFC 4493 empty", MAC_ALGORITHM_5, PAD_METHOD_1, AES, "2B7E151628AED2A6ABF7158809CF4F3C", []byte{}, "BB1D6929E95937287FA37D129B756746"},
+		{"CMAC AES RFC 4493 one block", MAC_ALGORITHM_5, PAD_METHOD_1, AES, "2B7E151628AED2A6ABF7158809CF4F3C", hexBytes("6BC1BEE22E409F96E93D7E117393172A"), "070A16B46B4D4144F79BDD9DD04A287C"},
+		{"CMAC AES RFC 4493 40 bytes", MAC_ALGORITHM_5, PAD_METHOD_1, AES, "2B7E151628AED2A6ABF7158809CF4F3C", hexBytes("6BC1BEE22E409F96E93D7E117393172AAE2D8A571E03AC9C9EB76FAC45AF8E5130C81C46A35CE411"), "DFA66747DE9AE63030CA32611497C827"},
+		{"CMAC TDES", MAC_ALGORITHM_5, PAD_METHOD_1, DES, "8AA83BF8CBDA10620BC1BF19FBB6CD58BC313D4A371CA8B5", hexBytes("6BC1BEE22E409F96E93D7E117393172A"), "286D394673448197"},
+		{"CMAC TDES double length", MAC_ALGORITHM_5, PAD_METHOD_1, DES, "AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBB", []byte("hello world"), "28F57A1BA70C4042"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mac, err := ComputeMAC(tt.algorithm, tt.padding, tt.cipher, hexBytes(tt.key), tt.data, 0)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.mac, strings.ToUpper(hex.EncodeToString(mac)))
+		})
+	}
+
+	key := hexBytes("0123456789ABCDEFFEDCBA9876543210")
+	mac, err := ComputeMAC(MAC_ALGORITHM_3, PAD_METHOD_1, DES, key, []byte("Now is the time for all "), 4)
+	assert.Nil(t, err)
+	assert.Equal(t, "a1c72e74", hex.EncodeToString(mac))
+
+	_, err = ComputeMAC(MAC_ALGORITHM_3, PAD_METHOD_1, AES, key, []byte("data"), 0)
+	assert.EqualError(t, err, "MACError: MAC algorithm 3 needs a 16 byte DES key. Received 16 bytes.")
+	_, err = ComputeMAC(MACAlgorithm(2), PAD_METHOD_1, DES, key, []byte("data"), 0)
+	assert.EqualError(t, err, "MACError: MAC algorithm (2) is invalid. Expecting 1, 3 or 5.")
+	_, err = ComputeMAC(MAC_ALGORITHM_1, PadMethod(4), DES, key, []byte("data"), 0)
+	assert.EqualError(t, err, "MACError: Padding method (4) is invalid. Expecting 1, 2 or 3.")
+	_, err = ComputeMAC(MAC_ALGORITHM_5, PAD_METHOD_1, DES, key[:8], []byte("data"), 0)
+	assert.EqualError(t, err, "MACError: TDES CMAC key length (8) is invalid. Expecting 16 or 24 bytes.")
+}
+
+func TestComputeMAC_length(t *testing.T) {
+	desKey, _ := hex.DecodeString("0123456789ABCDEFFEDCBA9876543210")
+	aesKey, _ := hex.DecodeString("2B7E151628AED2A6ABF7158809CF4F3C")
+	data := []byte("Now is the time for all ")
+
+	tests := []struct {
+		name      string
+		algorithm MACAlgorithm
+		cipher    Algorithm
+		key       []byte
+		length    int
+		want      int
+	}{
+		{"CBC-MAC DES whole block", MAC_ALGORITHM_1, DES, desKey, 0, 8},
+		{"CBC-MAC DES 4 bytes", MAC_ALGORITHM_1, DES, desKey, 4, 4},
+		{"CBC-MAC DES 16 bytes", MAC_ALGORITHM_1, DES, desKey, 16, 0},
+		{"CBC-MAC DES 20 bytes", MAC_ALGORITHM_1, DES, desKey, 20, 0},
+		{"CBC-MAC AES 16 bytes", MAC_ALGORITHM_1, AES, aesKey, 16, 16},
+		{"CBC-MAC AES 3 bytes", MAC_ALGORITHM_1, AES, aesKey, 3, 0},
+		{"Retail MAC 8 bytes", MAC_ALGORITHM_3, DES, desKey, 8, 8},
+		{"Retail MAC 16 bytes", MAC_ALGORITHM_3, DES, desKey, 16, 0},
+		{"CMAC AES 8 bytes", MAC_ALGORITHM_5, AES, aesKey, 8, 8},
+		{"CMAC AES 17 bytes", MAC_ALGORITHM_5, AES, aesKey, 17, 0},
+		{"CMAC TDES negative", MAC_ALGORITHM_5, DES, desKey, -1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mac, err := ComputeMAC(tt.algorithm, PAD_METHOD_2, tt.cipher, tt.key, data, tt.length)
+			if tt.want == 0 {
+				var macErr *MACError
+				assert.ErrorAs(t, err, &macErr)
+				assert.Contains(t, err.Error(), fmt.Sprintf("MAC length (%d) is invalid.", tt.length))
+				return
+			}
+			assert.Nil(t, err)
+			assert.Len(t, mac, tt.want)
+		})
+	}
+
+	// Truncations are prefixes of the whole MAC
+	whole, _ := ComputeMAC(MAC_ALGORITHM_5, PAD_METHOD_1, AES, aesKey, data, 0)
+	for _, length := range []int{4, 8, 16} {
+		mac, err := ComputeMAC(MAC_ALGORITHM_5, PAD_METHOD_1, AES, aesKey, data, length)
+		assert.Nil(t, err)
+		assert.Equal(t, whole[:length], mac)
+	}
+
+	_, err := GenerateCBCMAC(desKey, data, PAD_METHOD_1, 8, Algorithm(9))
+	assert.EqualError(t, err, "MACError: Block cipher (9) is invalid. Expecting DES or AES.")
+	_, err = GenerateCBCMAC(nil, data, PAD_METHOD_1, 8, DES)
+	assert.EqualError(t, err, "MACError: MAC key is missing.")
+	_, err = GenerateCBCMAC(desKey, nil, PAD_METHOD_1, 8, DES)
+	assert.EqualError(t, err, "MACError: Data to MAC is empty.")
+}
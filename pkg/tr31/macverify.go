@@ -0,0 +1,58 @@
+package tr31
+
+// MACInput is the exact data a key block MAC is computed over, for deployments
+// verifying MACs outside the library, such as inside an HSM holding the KBPK
+type MACInput struct {
+	// VersionID is the key block version, selecting the MAC algorithm
+	VersionID string
+	// Header is the key block header as received
+	Header string
+	// KeyData is the key data covered by the MAC: encrypted for versions A and C,
+	// decrypted (length, key and padding) for versions B and D
+	KeyData []byte
+	// MAC is the received MAC
+	MAC []byte
+}
+
+// Data returns the MAC input bytes, the header followed by the key data
+func (in MACInput) Data() []byte {
+	return append([]byte(in.Header), in.KeyData...)
+}
+
+// MACVerifier verifies a key block MAC and returns the verdict. An error aborts unwrapping.
+type MACVerifier func(input MACInput) (bool, error)
+
+// SetMACVerifier makes Unwrap delegate MAC verification to verifier instead of
+// computing the MAC with the KBPK. A nil verifier restores the default.
+func (kb *KeyBlock) SetMACVerifier(verifier MACVerifier) {
+	kb.macVerifier = verifier
+}
+
+// verifyMAC checks the received MAC with the MAC verifier when set, or against the
+// MAC computed by generate otherwise
+func (kb *KeyBlock) verifyMAC(header string, keyData, receivedMAC []byte, generate func() ([]byte, error)) error {
+	if kb.macVerifier != nil {
+		valid, err := kb.macVerifier(MACInput{
+			VersionID: kb.header.VersionID,
+			Header:    header,
+			KeyData:   append([]byte{}, keyData...),
+			MAC:       append([]byte{}, receivedMAC...),
+		})
+		if err != nil {
+			return err
+		}
+		if !valid {
+			return &KeyBlockError{Message: BlockErrorMacNotMatched}
+		}
+		return nil
+	}
+
+	mac, err := generate()
+	if err != nil {
+		return err
+	}
+	if !CompareByte(mac, receivedMAC) {
+		return &KeyBlockError{Message: BlockErrorMacNotMatched}
+	}
+	return nil
+}
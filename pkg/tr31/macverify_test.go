@@ -0,0 +1,75 @@
+package tr31
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMACVerifier(t *testing.T) {
+	key := bytes.Repeat([]byte{0x11}, 16)
+
+	for _, versionID := range []string{"A", "B", "C", "D"} {
+		t.Run(versionID, func(t *testing.T) {
+			kbpk := bytes.Repeat([]byte("E"), 16)
+			header, _ := NewHeader(versionID, "P0", "T", "E", "00", "N")
+			kb, _ := NewKeyBlock(kbpk, header)
+			keyBlock, err := kb.Wrap(key, nil)
+			assert.Nil(t, err)
+
+			// An external verifier gets the exact MAC input and recomputes the MAC
+			var received MACInput
+			verifier := func(input MACInput) (bool, error) {
+				received = input
+				var mac []byte
+				switch input.VersionID {
+				case "A", "C":
+					_, kbak, _ := kb.cDerive()
+					mac, _ = GenerateCBCMAC(kbak, input.Data(), PAD_METHOD_1, 4, DES)
+				case "B":
+					_, kbak, _ := kb.BDerive()
+					mac, _ = kb.bGenerateMac(kbak, input.Header, input.KeyData)
+				case "D":
+					_, kbak, _ := kb.dDerive()
+					mac, _ = kb.dGenerateMAC(kbak, []byte(input.Header), input.KeyData)
+				}
+				return bytes.Equal(mac, input.MAC), nil
+			}
+
+			block, _ := NewKeyBlock(kbpk, nil)
+			block.SetMACVerifier(verifier)
+			keyOut, err := block.Unwrap(keyBlock)
+			assert.Nil(t, err)
+			assert.Equal(t, key, keyOut)
+			assert.Equal(t, versionID, received.VersionID)
+			assert.True(t, strings.HasPrefix(keyBlock, received.Header))
+			assert.True(t, strings.HasSuffix(strings.ToUpper(keyBlock), strings.ToUpper(hex.EncodeToString(received.MAC))))
+			assert.Equal(t, append([]byte(received.Header), received.KeyData...), received.Data())
+		})
+	}
+}
+
+func TestMACVerifierVerdict(t *testing.T) {
+	kbpk := bytes.Repeat([]byte("E"), 32)
+	header, _ := NewHeader("D", "K0", "A", "B", "00", "N")
+	kb, _ := NewKeyBlock(kbpk, header)
+	keyBlock, _ := kb.Wrap(bytes.Repeat([]byte{0x11}, 16), nil)
+
+	block, _ := NewKeyBlock(kbpk, nil)
+	block.SetMACVerifier(func(MACInput) (bool, error) { return false, nil })
+	_, err := block.Unwrap(keyBlock)
+	assert.Equal(t, "KeyBlockError: Key block MAC is not matched.", err.Error())
+
+	hsmErr := errors.New("HSM unavailable")
+	block.SetMACVerifier(func(MACInput) (bool, error) { return false, hsmErr })
+	_, err = block.Unwrap(keyBlock)
+	assert.Equal(t, hsmErr, err)
+
+	block.SetMACVerifier(nil)
+	_, err = block.Unwrap(keyBlock)
+	assert.Nil(t, err)
+}
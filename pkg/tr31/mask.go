@@ -0,0 +1,58 @@
+package tr31
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maskVisible is the number of characters MaskHex leaves in clear at each end
+const maskVisible = 4
+
+// MaskHex redacts a hex string, such as a key or KBPK, for logs and audit trails.
+// Only the first and last 4 characters are kept, strings too short to keep them
+// without disclosing most of the value are redacted entirely.
+func MaskHex(s string) string {
+	if len(s) <= maskVisible*3 {
+		return strings.Repeat("*", len(s))
+	}
+	return s[:maskVisible] + strings.Repeat("*", len(s)-maskVisible*2) + s[len(s)-maskVisible:]
+}
+
+// MaskKeyBlock redacts a key block for logs and audit trails. The header, which
+// carries no key material, stays in clear while the encrypted key and MAC are
+// masked like MaskHex. Blocks whose header can't be parsed are masked entirely.
+func MaskKeyBlock(block string) string {
+	headerLen, err := DefaultHeader().Load(block)
+	if err != nil || headerLen > len(block) {
+		return MaskHex(block)
+	}
+	return block[:headerLen] + MaskHex(block[headerLen:])
+}
+
+// RedactForSharing redacts a key block so it can be attached to a support
+// ticket. The header and MAC stay in clear, the encrypted key data is replaced
+// with '*' of equal length and the SHA-256 fingerprint of the key block is
+// appended, as in "<header><****><MAC> sha256:<hex>", so the recipient can
+// match it against their copy without receiving recoverable ciphertext.
+func RedactForSharing(block string) (string, error) {
+	header := DefaultHeader()
+	headerLen, err := header.Load(block)
+	if err != nil {
+		return "", err
+	}
+	if length, err := strconv.Atoi(block[1:5]); err != nil || length != len(block) {
+		return "", &KeyBlockError{Message: fmt.Sprintf(BlockErrorHeaderLenNoMatched, length, len(block))}
+	}
+	spec, _ := LookupVersion(header.VersionID)
+	macLen := spec.MACLen * 2
+	if len(block)-headerLen <= macLen {
+		return "", &KeyBlockError{Message: BlockErrorEncKeyMalformed}
+	}
+	keyData := len(block) - headerLen - macLen
+	fingerprint := sha256.Sum256([]byte(block))
+	return block[:headerLen] + strings.Repeat("*", keyData) + block[headerLen+keyData:] +
+		" sha256:" + hex.EncodeToString(fingerprint[:]), nil
+}
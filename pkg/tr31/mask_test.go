@@ -0,0 +1,65 @@
+package tr31
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaskHex(t *testing.T) {
+	assert.Equal(t, "CCCC************************DDDD", MaskHex("CCCCCCCCCCCCCCCCDDDDDDDDDDDDDDDD"))
+	assert.Equal(t, "************", MaskHex("0123456789AB"))
+	assert.Equal(t, "0123*****CDEF", MaskHex("012345678CDEF"))
+	assert.Equal(t, "", MaskHex(""))
+}
+
+func TestMaskKeyBlock(t *testing.T) {
+	kbpk := []byte("AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBB")
+	header, _ := NewHeader(TR31_VERSION_D, "D0", "A", "D", "00", "N")
+	kb, _ := NewKeyBlock(kbpk, header)
+	block, err := kb.Wrap([]byte("CCCCCCCCCCCCCCCC"), nil)
+	assert.NoError(t, err)
+
+	masked := MaskKeyBlock(block)
+	assert.Len(t, masked, len(block))
+	assert.Equal(t, block[:16], masked[:16])
+	assert.Equal(t, block[16:20], masked[16:20])
+	assert.Equal(t, block[len(block)-4:], masked[len(masked)-4:])
+	assert.True(t, strings.Contains(masked, strings.Repeat("*", len(block)-24)))
+
+	// a block with an unparsable header is masked entirely
+	assert.Equal(t, MaskHex("Z0096D0TN00N0000ABCDEF0123456789"), MaskKeyBlock("Z0096D0TN00N0000ABCDEF0123456789"))
+}
+
+func TestRedactForSharing(t *testing.T) {
+	kbpk := []byte("AAAAAAAAAAAAAAAABBBBBBBBBBBBBBBB")
+	header, _ := NewHeader(TR31_VERSION_D, "D0", "A", "D", "00", "N")
+	kb, _ := NewKeyBlock(kbpk, header)
+	block, err := kb.Wrap([]byte("CCCCCCCCCCCCCCCC"), nil)
+	assert.NoError(t, err)
+
+	redacted, err := RedactForSharing(block)
+	assert.NoError(t, err)
+	shared, fingerprint, found := strings.Cut(redacted, " sha256:")
+	assert.True(t, found)
+	sum := sha256.Sum256([]byte(block))
+	assert.Equal(t, hex.EncodeToString(sum[:]), fingerprint)
+
+	// The header and the 16 byte MAC of version D stay in clear
+	assert.Len(t, shared, len(block))
+	assert.Equal(t, block[:16], shared[:16])
+	assert.Equal(t, block[len(block)-32:], shared[len(shared)-32:])
+	assert.Equal(t, strings.Repeat("*", len(block)-48), shared[16:len(shared)-32])
+
+	for _, invalid := range []string{
+		"Z0096D0TN00N0000ABCDEF0123456789",
+		block[:len(block)-2],
+		"D0048D0AD00N0000" + strings.Repeat("A", 32),
+	} {
+		_, err := RedactForSharing(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
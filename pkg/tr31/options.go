@@ -0,0 +1,229 @@
+package tr31
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// KeyBlockOption configures a KeyBlock created by New
+type KeyBlockOption func(*keyBlockConfig)
+
+type keyBlockConfig struct {
+	header        *Header
+	headerString  *string
+	defaultHeader *Header
+	logger        Logger
+	parse         *ParseOptions
+	entropy       EntropySource
+	provider      *Provider
+	policy        *Policy
+	revision      *SpecRevision
+}
+
+// Provider supplies the cryptography a key block delegates outside the library,
+// such as to an HSM holding the KBPK. Nil fields keep the library's own.
+type Provider struct {
+	// MACVerifier verifies key block MACs instead of the KBPK, see SetMACVerifier
+	MACVerifier MACVerifier
+	// Entropy supplies random padding, see SetEntropySource
+	Entropy EntropySource
+}
+
+// Policy holds the policies applied when wrapping and unwrapping keys. The zero
+// value matches the package defaults: single DES keys warn, single DES KBPKs are
+// rejected, weak keys and test keys are wrapped, headers of any revision are
+// accepted, and so are truncated MACs and AES keys in any key block version.
+type Policy struct {
+	SingleDES     SingleDESPolicy
+	SingleDESKBPK SingleDESKBPKPolicy
+	WeakKeys      WeakKeyPolicy
+	KeySanity     KeySanityPolicy
+	// Revision is the revision headers are checked against when wrapping and
+	// unwrapping, see Header.Conforms
+	Revision SpecRevision
+	// MACLength controls unwrapping key blocks with truncated MACs
+	MACLength MACLengthPolicy
+	// AESKeys controls the key block versions AES keys are wrapped in and unwrapped from
+	AESKeys AESKeyPolicy
+}
+
+// PackagePolicy returns the policies set with SetSingleDESPolicy,
+// SetSingleDESKBPKPolicy, SetWeakKeyPolicy, SetKeySanityPolicy, SetSpecRevision,
+// SetMACLengthPolicy and SetAESKeyPolicy, used by key blocks without WithPolicy
+func PackagePolicy() Policy {
+	var policy Policy
+	_deprecationMtx.RLock()
+	policy.SingleDES = _singleDESPolicy
+	policy.SingleDESKBPK = _singleDESKBPKPolicy
+	_deprecationMtx.RUnlock()
+	_weakKeyMtx.RLock()
+	policy.WeakKeys = _weakKeyPolicy
+	_weakKeyMtx.RUnlock()
+	_keySanityMtx.RLock()
+	policy.KeySanity = _keySanityPolicy
+	_keySanityMtx.RUnlock()
+	_specRevisionMtx.RLock()
+	policy.Revision = _specRevision
+	_specRevisionMtx.RUnlock()
+	_agilityMtx.RLock()
+	policy.MACLength = _macLengthPolicy
+	policy.AESKeys = _aesKeyPolicy
+	_agilityMtx.RUnlock()
+	return policy
+}
+
+// WithHeader wraps keys under h. Without a header the key block can only
+// unwrap, which loads the header from the key block.
+func WithHeader(h *Header) KeyBlockOption {
+	return func(c *keyBlockConfig) {
+		c.header, c.headerString = h, nil
+	}
+}
+
+// WithHeaderString wraps keys under the header loaded from header, such as
+// "D0000P0AE00E0000". New fails when the header can't be loaded.
+func WithHeaderString(header string) KeyBlockOption {
+	return func(c *keyBlockConfig) {
+		c.header, c.headerString = nil, &header
+	}
+}
+
+// WithDefaultHeader opts in to wrapping under a copy of h when New gets no
+// header, or a header string too short to hold one. A nil h uses DefaultHeader,
+// a version B header with key usage "00".
+func WithDefaultHeader(h *Header) KeyBlockOption {
+	return func(c *keyBlockConfig) {
+		if h == nil {
+			h = DefaultHeader()
+		}
+		c.defaultHeader = h
+	}
+}
+
+// WithStrictParsing makes Unwrap reject malformed legacy key blocks, the default
+func WithStrictParsing() KeyBlockOption {
+	return func(c *keyBlockConfig) {
+		c.parseOptions().LenientASCII = false
+	}
+}
+
+// WithLenientParsing makes Unwrap fix the malformed legacy key blocks
+// ParseOptions.LenientASCII describes instead of rejecting them
+func WithLenientParsing() KeyBlockOption {
+	return func(c *keyBlockConfig) {
+		c.parseOptions().LenientASCII = true
+	}
+}
+
+// WithMaxLen makes Wrap and Unwrap reject key blocks longer than n characters,
+// see ParseOptions.MaxLen
+func WithMaxLen(n int) KeyBlockOption {
+	return func(c *keyBlockConfig) {
+		c.parseOptions().MaxLen = n
+	}
+}
+
+// parseOptions returns the parse options being configured
+func (c *keyBlockConfig) parseOptions() *ParseOptions {
+	if c.parse == nil {
+		c.parse = &ParseOptions{}
+	}
+	return c.parse
+}
+
+// WithRand reads random padding from r instead of the package entropy source,
+// with no health check. See WithProvider for an EntropySource.
+func WithRand(r io.Reader) KeyBlockOption {
+	return func(c *keyBlockConfig) {
+		c.entropy = ReaderEntropySource(r)
+	}
+}
+
+// WithProvider delegates MAC verification and random padding to p
+func WithProvider(p Provider) KeyBlockOption {
+	return func(c *keyBlockConfig) {
+		c.provider = &p
+	}
+}
+
+// WithPolicy applies p when wrapping and unwrapping keys instead of the package policies
+func WithPolicy(p Policy) KeyBlockOption {
+	return func(c *keyBlockConfig) {
+		c.policy = &p
+	}
+}
+
+// WithSpecRevision checks headers against revision when wrapping and unwrapping,
+// instead of the revision of the policy, such as for a partner still on TR-31:2018
+func WithSpecRevision(revision SpecRevision) KeyBlockOption {
+	return func(c *keyBlockConfig) {
+		c.revision = &revision
+	}
+}
+
+// New creates a KeyBlock with the Key Block Protection Key (KBPK), configured by opts
+func New(kbpk []byte, opts ...KeyBlockOption) (*KeyBlock, error) {
+	if len(kbpk) == 0 {
+		return nil, errors.New(ErrKBPKEmpty)
+	}
+	config := &keyBlockConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+
+	kb := &KeyBlock{
+		kbpk:     kbpk,
+		policy:   config.policy,
+		revision: config.revision,
+	}
+	switch {
+	case config.header != nil:
+		kb.header, kb.headerSet = config.header, true
+	case config.headerString != nil && len(*config.headerString) >= 5:
+		kb.header = DefaultHeader()
+		kb.header.SetLogger(config.logger)
+		if _, err := kb.header.Load(*config.headerString); err != nil {
+			return nil, fmt.Errorf(HeaderErrLoad, err)
+		}
+		kb.headerSet = true
+	case config.headerString != nil && config.defaultHeader == nil:
+		// A string too short to hold a header is a misconfiguration, not a request for the default
+		return nil, &HeaderError{Message: HeaderErrMissing}
+	case config.defaultHeader != nil:
+		kb.header, kb.headerSet = config.defaultHeader.clone(), true
+	default:
+		// Without a header the key block can only unwrap, which loads the header
+		// from the key block
+		kb.header = DefaultHeader()
+	}
+	if config.logger != nil {
+		kb.header.SetLogger(config.logger)
+	}
+	if config.parse != nil {
+		kb.header.SetParseOptions(*config.parse)
+	}
+	if config.provider != nil {
+		kb.macVerifier = config.provider.MACVerifier
+		kb.entropy = config.provider.Entropy
+	}
+	if config.entropy != nil {
+		kb.entropy = config.entropy
+	}
+	return kb, nil
+}
+
+// effectivePolicy returns the policy of the key block, or the package policies,
+// with the revision of the key block
+func (kb *KeyBlock) effectivePolicy() Policy {
+	var policy Policy
+	if kb.policy != nil {
+		policy = *kb.policy
+	} else {
+		policy = PackagePolicy()
+	}
+	if kb.revision != nil {
+		policy.Revision = *kb.revision
+	}
+	return policy
+}
@@ -0,0 +1,126 @@
+package tr31
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	kbpk := bytes.Repeat([]byte("E"), 16)
+	key := bytes.Repeat([]byte("F"), 16)
+
+	kb, err := New(kbpk, WithHeaderString("D0000D0AD00N0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, "D0", kb.GetHeader().KeyUsage)
+	block, err := kb.Wrap(key, nil)
+	assert.Nil(t, err)
+
+	// Without a header the key block only unwraps
+	received, err := New(kbpk)
+	assert.Nil(t, err)
+	_, err = received.Wrap(key, nil)
+	assert.Equal(t, &HeaderError{Message: HeaderErrMissing}, err)
+	unwrapped, err := received.Unwrap(block)
+	assert.Nil(t, err)
+	assert.Equal(t, key, unwrapped)
+
+	header, _ := NewHeader(TR31_VERSION_D, "P0", ENC_ALGORITHM_AES, "E", "00", "N")
+	kb, err = New(kbpk, WithHeader(header))
+	assert.Nil(t, err)
+	assert.Same(t, header, kb.GetHeader())
+
+	// The last header option wins
+	kb, err = New(kbpk, WithHeaderString("xx"), WithHeader(header))
+	assert.Nil(t, err)
+	assert.Same(t, header, kb.GetHeader())
+	_, err = New(kbpk, WithHeaderString("D0"))
+	assert.Equal(t, &HeaderError{Message: HeaderErrMissing}, err)
+	kb, err = New(kbpk, WithHeaderString("D0"), WithDefaultHeader(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, TR31_VERSION_B, kb.GetHeader().VersionID)
+	_, err = New(nil, WithHeader(header))
+	assert.EqualError(t, err, ErrKBPKEmpty)
+
+	// The typed constructors report header strings which can't be loaded
+	kb, err = NewKeyBlock(kbpk, header)
+	assert.Nil(t, err)
+	assert.Same(t, header, kb.GetHeader())
+	kb, err = NewKeyBlockFromString(kbpk, "D0000D0AD00N0000")
+	assert.Nil(t, err)
+	assert.Equal(t, "D0", kb.GetHeader().KeyUsage)
+	_, err = NewKeyBlockFromString(kbpk, "")
+	assert.Equal(t, &HeaderError{Message: HeaderErrMissing}, err)
+	_, err = NewKeyBlockFromString(kbpk, "Z0000D0AD00N0000")
+	assert.ErrorContains(t, err, "Failed to load header")
+}
+
+func TestNew_parsing(t *testing.T) {
+	kbpk := bytes.Repeat([]byte("E"), 16)
+	kb, _ := New(kbpk, WithHeaderString("B0000P0TE00N0000"))
+	block, err := kb.Wrap(bytes.Repeat([]byte{0x11}, 16), nil)
+	assert.Nil(t, err)
+	legacy := block + "\n"
+
+	strict, _ := New(kbpk, WithStrictParsing())
+	_, err = strict.Unwrap(legacy)
+	assert.NotNil(t, err)
+
+	lenient, _ := New(kbpk, WithLenientParsing())
+	_, err = lenient.Unwrap(legacy)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Whitespace around key block trimmed."}, lenient.Normalizations())
+}
+
+func TestNew_randAndProvider(t *testing.T) {
+	kbpk := bytes.Repeat([]byte("E"), 16)
+	key := bytes.Repeat([]byte("F"), 16)
+	header, _ := NewHeader(TR31_VERSION_D, "D0", ENC_ALGORITHM_AES, "D", "00", "N")
+
+	// The same random padding gives the same key block
+	first, _ := New(kbpk, WithHeader(header), WithRand(bytes.NewReader(bytes.Repeat([]byte{0xA5}, 64))))
+	second, _ := New(kbpk, WithHeader(header), WithRand(bytes.NewReader(bytes.Repeat([]byte{0xA5}, 64))))
+	block, err := first.Wrap(key, nil)
+	assert.Nil(t, err)
+	again, err := second.Wrap(key, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, block, again)
+
+	source := &hsmSource{fill: 0x5A}
+	var verified []MACInput
+	kb, _ := New(kbpk, WithHeader(header), WithProvider(Provider{
+		Entropy: source,
+		MACVerifier: func(input MACInput) (bool, error) {
+			verified = append(verified, input)
+			return true, nil
+		},
+	}))
+	block, err = kb.Wrap(key, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 30, source.read)
+	_, err = kb.Unwrap(block)
+	assert.Nil(t, err)
+	assert.Len(t, verified, 1)
+}
+
+func TestNew_policy(t *testing.T) {
+	header, _ := NewHeader("B", "D0", "T", "D", "00", "N")
+	weak := append(bytes.Repeat([]byte{0x11}, 8), bytes.Repeat([]byte{0xFE}, 8)...)
+	assert.Equal(t, Policy{}, PackagePolicy())
+
+	kb, _ := New(bytes.Repeat([]byte("E"), 24), WithHeader(header), WithPolicy(Policy{WeakKeys: WEAK_KEY_REJECT}))
+	_, err := kb.Wrap(weak, nil)
+	assert.Equal(t, &KeyBlockError{Message: BlockErrorWeakKeyRejected}, err)
+
+	// The key block policy replaces the package policies
+	SetKeySanityPolicy(KEY_SANITY_REJECT)
+	defer SetKeySanityPolicy(KEY_SANITY_SKIP)
+	assert.Equal(t, Policy{KeySanity: KEY_SANITY_REJECT}, PackagePolicy())
+	kb, _ = New(bytes.Repeat([]byte("E"), 24), WithHeader(header), WithPolicy(Policy{}))
+	_, err = kb.Wrap(weak, nil)
+	assert.Nil(t, err)
+	kb, _ = New(bytes.Repeat([]byte("E"), 24), WithHeader(header))
+	_, err = kb.Wrap(weak, nil)
+	assert.NotNil(t, err)
+}
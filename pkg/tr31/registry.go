@@ -0,0 +1,252 @@
+package tr31
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/moov-io/tr31/pkg/charset"
+)
+
+// VersionSpec describes a key block version: its cipher block size, MAC length,
+// accepted KBPK lengths, wrap and unwrap functions and default wrap options
+type VersionSpec struct {
+	// ID is the single character key block version ID
+	ID string
+	// BlockSize is the cipher block size in bytes the key data and optional blocks are padded to
+	BlockSize int
+	// MACLen is the key block MAC length in bytes
+	MACLen int
+	// KBPKLengths lists the accepted KBPK lengths in bytes
+	KBPKLengths []int
+	// Wrap wraps a key for this version
+	Wrap WrapFunc
+	// Unwrap unwraps a key for this version
+	Unwrap UnwrapFunc
+	// WrapDefaults are the wrap options used when none are set on the key block
+	WrapDefaults WrapOptions
+
+	// builtin versions check the KBPK length in their own wrap functions
+	builtin bool
+}
+
+// VersionRegistry holds the key block versions Wrap, Unwrap and header parsing accept
+type VersionRegistry struct {
+	mtx      sync.RWMutex
+	versions map[string]VersionSpec
+}
+
+// _versions is the registry used by the package, preloaded with versions A to D by init
+var _versions = &VersionRegistry{versions: map[string]VersionSpec{}}
+
+// init registers the built-in versions. It can't be a variable initializer because
+// the wrap functions look up their default options in the registry.
+// Version A predates key length masking, so its keys are only padded to the block size.
+func init() {
+	_versions.versions = map[string]VersionSpec{
+		TR31_VERSION_A: {
+			ID:           TR31_VERSION_A,
+			BlockSize:    8,
+			MACLen:       4,
+			KBPKLengths:  []int{8, 16, 24},
+			Wrap:         (*KeyBlock).CWrap,
+			Unwrap:       (*KeyBlock).CUnwrap,
+			WrapDefaults: WrapOptions{MaskKeyLength: false, HeaderIV: true, RandomPad: true},
+			builtin:      true,
+		},
+		TR31_VERSION_B: {
+			ID:           TR31_VERSION_B,
+			BlockSize:    8,
+			MACLen:       8,
+			KBPKLengths:  []int{16, 24},
+			Wrap:         (*KeyBlock).BWrap,
+			Unwrap:       (*KeyBlock).BUnwrap,
+			WrapDefaults: WrapOptions{MaskKeyLength: true, HeaderIV: true, RandomPad: true},
+			builtin:      true,
+		},
+		TR31_VERSION_C: {
+			ID:           TR31_VERSION_C,
+			BlockSize:    8,
+			MACLen:       4,
+			KBPKLengths:  []int{8, 16, 24},
+			Wrap:         (*KeyBlock).CWrap,
+			Unwrap:       (*KeyBlock).CUnwrap,
+			WrapDefaults: WrapOptions{MaskKeyLength: true, HeaderIV: true, RandomPad: true},
+			builtin:      true,
+		},
+		TR31_VERSION_D: {
+			ID:           TR31_VERSION_D,
+			BlockSize:    16,
+			MACLen:       16,
+			KBPKLengths:  []int{16, 24, 32},
+			Wrap:         (*KeyBlock).DWrap,
+			Unwrap:       (*KeyBlock).DUnwrap,
+			WrapDefaults: WrapOptions{MaskKeyLength: true, HeaderIV: true, RandomPad: true},
+			builtin:      true,
+		},
+	}
+}
+
+// Register adds a key block version. Versions can't be registered twice.
+func (r *VersionRegistry) Register(spec VersionSpec) error {
+	if len(spec.ID) != 1 || !charset.IsAlphanumeric(spec.ID) {
+		return &HeaderError{Message: fmt.Sprintf(RegistryErrVersionID, spec.ID)}
+	}
+	if spec.BlockSize <= 0 || spec.MACLen <= 0 || spec.Wrap == nil || spec.Unwrap == nil {
+		return &HeaderError{Message: fmt.Sprintf(RegistryErrSpec, spec.ID)}
+	}
+	spec.builtin = false
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, exists := r.versions[spec.ID]; exists {
+		return &HeaderError{Message: fmt.Sprintf(RegistryErrDuplicate, spec.ID)}
+	}
+	r.versions[spec.ID] = spec
+	return nil
+}
+
+// Lookup returns the registered version
+func (r *VersionRegistry) Lookup(versionID string) (VersionSpec, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	spec, exists := r.versions[versionID]
+	return spec, exists
+}
+
+// IDs returns the registered version IDs in order
+func (r *VersionRegistry) IDs() []string {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	ids := make([]string, 0, len(r.versions))
+	for id := range r.versions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// RegisterVersion plugs a vendor specific key block version, such as a proprietary
+// "R" version, into Wrap, Unwrap and header parsing
+func RegisterVersion(spec VersionSpec) error {
+	return _versions.Register(spec)
+}
+
+// LookupVersion returns a registered key block version
+func LookupVersion(versionID string) (VersionSpec, bool) {
+	return _versions.Lookup(versionID)
+}
+
+// RegisteredVersions returns the registered key block version IDs in order
+func RegisteredVersions() []string {
+	return _versions.IDs()
+}
+
+// AlgorithmSpec describes a key algorithm: the length keys are padded to when
+// their length is masked, and the key block versions allowed to wrap it
+type AlgorithmSpec struct {
+	// ID is the single character algorithm ID of the header
+	ID string
+	// MaxKeyLen is the longest key of the algorithm in bytes, which shorter keys
+	// are padded to when the key block version masks key lengths
+	MaxKeyLen int
+	// BlockVersions lists the key block versions the algorithm can be wrapped
+	// in, any version when empty
+	BlockVersions []string
+
+	// builtin algorithms are defined by X9.143 and checked against key usages by Lint
+	builtin bool
+}
+
+// AlgorithmRegistry holds the algorithms Wrap knows the maximum key length of
+type AlgorithmRegistry struct {
+	mtx        sync.RWMutex
+	algorithms map[string]AlgorithmSpec
+}
+
+// _algorithms is the registry used by the package, preloaded with TDES, DES and AES
+var _algorithms = &AlgorithmRegistry{algorithms: map[string]AlgorithmSpec{
+	ENC_ALGORITHM_TRIPLE_DES: {ID: ENC_ALGORITHM_TRIPLE_DES, MaxKeyLen: 24, builtin: true},
+	ENC_ALGORITHM_DES:        {ID: ENC_ALGORITHM_DES, MaxKeyLen: 8, builtin: true},
+	ENC_ALGORITHM_AES:        {ID: ENC_ALGORITHM_AES, MaxKeyLen: 32, builtin: true},
+}}
+
+// Register adds an algorithm. Algorithms can't be registered twice.
+func (r *AlgorithmRegistry) Register(spec AlgorithmSpec) error {
+	if len(spec.ID) != 1 || !charset.IsAlphanumeric(spec.ID) {
+		return &HeaderError{Message: fmt.Sprintf(RegistryErrAlgorithmID, spec.ID)}
+	}
+	if spec.MaxKeyLen <= 0 {
+		return &HeaderError{Message: fmt.Sprintf(RegistryErrAlgorithmMaxLen, spec.ID, spec.MaxKeyLen)}
+	}
+	for _, version := range spec.BlockVersions {
+		if len(version) != 1 || !charset.IsAlphanumeric(version) {
+			return &HeaderError{Message: fmt.Sprintf(RegistryErrVersionID, version)}
+		}
+	}
+	spec.BlockVersions = append([]string(nil), spec.BlockVersions...)
+	spec.builtin = false
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, exists := r.algorithms[spec.ID]; exists {
+		return &HeaderError{Message: fmt.Sprintf(RegistryErrAlgorithmDuplicate, spec.ID)}
+	}
+	r.algorithms[spec.ID] = spec
+	return nil
+}
+
+// Lookup returns the registered algorithm
+func (r *AlgorithmRegistry) Lookup(id string) (AlgorithmSpec, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	spec, exists := r.algorithms[id]
+	return spec, exists
+}
+
+// IDs returns the registered algorithm IDs in order
+func (r *AlgorithmRegistry) IDs() []string {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	ids := make([]string, 0, len(r.algorithms))
+	for id := range r.algorithms {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// RegisterAlgorithm adds a vendor specific algorithm code, such as "S" for SM4
+// keys of at most 16 bytes wrapped in version D key blocks only. Wrap pads its
+// keys to maxLen when the key block version masks key lengths, and Lint accepts
+// it for any key usage. Empty blockVersions allows every version.
+func RegisterAlgorithm(id string, maxLen int, blockVersions []string) error {
+	return _algorithms.Register(AlgorithmSpec{ID: id, MaxKeyLen: maxLen, BlockVersions: blockVersions})
+}
+
+// LookupAlgorithm returns a registered algorithm
+func LookupAlgorithm(id string) (AlgorithmSpec, bool) {
+	return _algorithms.Lookup(id)
+}
+
+// RegisteredAlgorithms returns the registered algorithm IDs in order
+func RegisteredAlgorithms() []string {
+	return _algorithms.IDs()
+}
+
+// checkVersion rejects key block versions the algorithm can't be wrapped in
+func (spec AlgorithmSpec) checkVersion(versionID string) error {
+	if len(spec.BlockVersions) == 0 || slices.Contains(spec.BlockVersions, versionID) {
+		return nil
+	}
+	return &HeaderError{Message: fmt.Sprintf(BlockErrorAlgorithmVersion, spec.ID, versionID, spec.BlockVersions)}
+}
+
+// checkKBPK rejects KBPKs of lengths the version doesn't accept
+func (spec VersionSpec) checkKBPK(kbpk []byte) error {
+	if spec.builtin || len(spec.KBPKLengths) == 0 || containsInt(spec.KBPKLengths, len(kbpk)) {
+		return nil
+	}
+	return &KeyBlockError{Message: fmt.Sprintf(BlockErrorKBPKLenVersion, len(kbpk), spec.ID, spec.KBPKLengths)}
+}
@@ -0,0 +1,104 @@
+package tr31
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterVersion(t *testing.T) {
+	// A proprietary version reusing the AES key derivation binding with 32 byte KBPKs only
+	err := RegisterVersion(VersionSpec{
+		ID:           "R",
+		BlockSize:    16,
+		MACLen:       16,
+		KBPKLengths:  []int{32},
+		Wrap:         (*KeyBlock).DWrap,
+		Unwrap:       (*KeyBlock).DUnwrap,
+		WrapDefaults: DefaultWrapOptions(TR31_VERSION_D),
+	})
+	assert.Nil(t, err)
+	defer func() {
+		_versions.mtx.Lock()
+		delete(_versions.versions, "R")
+		_versions.mtx.Unlock()
+	}()
+	assert.Equal(t, []string{"A", "B", "C", "D", "R"}, RegisteredVersions())
+
+	header, err := NewHeader("R", "K0", "A", "B", "00", "N")
+	assert.Nil(t, err)
+	kbpk := bytes.Repeat([]byte("E"), 32)
+	key := bytes.Repeat([]byte{0x11}, 16)
+	kb, _ := NewKeyBlock(kbpk, header)
+	keyBlock, err := kb.Wrap(key, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "R", keyBlock[:1])
+
+	received, _ := NewKeyBlock(kbpk, nil)
+	keyOut, err := received.Unwrap(keyBlock)
+	assert.Nil(t, err)
+	assert.Equal(t, key, keyOut)
+
+	short, _ := NewKeyBlock(kbpk[:16], header)
+	_, err = short.Wrap(key, nil)
+	assert.Equal(t, "KeyBlockError: KBPK length (16) is not valid for key block version R. Expecting one of [32] bytes.", err.Error())
+	short, _ = NewKeyBlock(kbpk[:16], nil)
+	_, err = short.Unwrap(keyBlock)
+	assert.Equal(t, "KeyBlockError: KBPK length (16) is not valid for key block version R. Expecting one of [32] bytes.", err.Error())
+}
+
+func TestRegisterVersionErrors(t *testing.T) {
+	spec := VersionSpec{ID: "D", BlockSize: 16, MACLen: 16, Wrap: (*KeyBlock).DWrap, Unwrap: (*KeyBlock).DUnwrap}
+	assert.Equal(t, "HeaderError: Key block version D is already registered.", RegisterVersion(spec).Error())
+
+	spec.ID = "RR"
+	assert.Equal(t, "HeaderError: Version ID (RR) must be a single alphanumeric character.", RegisterVersion(spec).Error())
+
+	spec.ID = "R"
+	spec.Unwrap = nil
+	assert.Equal(t, "HeaderError: Key block version R needs a block size, MAC length, wrap and unwrap functions.", RegisterVersion(spec).Error())
+
+	_, exists := LookupVersion("R")
+	assert.False(t, exists)
+	_, err := NewHeader("R", "K0", "A", "B", "00", "N")
+	assert.Equal(t, "HeaderError: Version ID (R) is not supported.", err.Error())
+}
+
+func TestRegisterAlgorithm(t *testing.T) {
+	// SM4 keys are 16 bytes, wrapped in version D key blocks only
+	assert.Nil(t, RegisterAlgorithm("X", 16, []string{TR31_VERSION_D}))
+	defer func() {
+		_algorithms.mtx.Lock()
+		delete(_algorithms.algorithms, "X")
+		_algorithms.mtx.Unlock()
+	}()
+	assert.Equal(t, []string{"A", "D", "T", "X"}, RegisteredAlgorithms())
+	spec, exists := LookupAlgorithm("X")
+	assert.True(t, exists)
+	assert.Equal(t, 16, spec.MaxKeyLen)
+
+	kbpk := bytes.Repeat([]byte("E"), 32)
+	header, err := NewHeader(TR31_VERSION_D, "D0", "X", "B", "00", "N")
+	assert.Nil(t, err)
+	kb, _ := NewKeyBlock(kbpk, header)
+	result, err := kb.WrapWithResult(bytes.Repeat([]byte{0x11}, 8), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 16, result.MaskedLen)
+
+	received, _ := NewKeyBlock(kbpk, nil)
+	keyOut, err := received.Unwrap(result.Block)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{0x11}, 8), keyOut)
+
+	header, _ = NewHeader(TR31_VERSION_B, "D0", "X", "B", "00", "N")
+	kb, _ = NewKeyBlock(kbpk[:24], header)
+	_, err = kb.Wrap(bytes.Repeat([]byte{0x11}, 8), nil)
+	assert.Equal(t, "HeaderError: Algorithm (X) can't be wrapped in key block version B. Expecting one of [D].", err.Error())
+
+	assert.Equal(t, "HeaderError: Algorithm X is already registered.", RegisterAlgorithm("X", 16, nil).Error())
+	assert.Equal(t, "HeaderError: Algorithm T is already registered.", RegisterAlgorithm("T", 16, nil).Error())
+	assert.Equal(t, "HeaderError: Algorithm (SM) must be a single alphanumeric character.", RegisterAlgorithm("SM", 16, nil).Error())
+	assert.Equal(t, "HeaderError: Algorithm Y needs a positive maximum key length, got 0.", RegisterAlgorithm("Y", 0, nil).Error())
+	assert.Equal(t, "HeaderError: Version ID (DD) must be a single alphanumeric character.", RegisterAlgorithm("Y", 16, []string{"DD"}).Error())
+}
@@ -0,0 +1,135 @@
+package tr31
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// SpecRevision selects the revision of the key block standard headers must
+// conform to, for partners which haven't moved to the latest revision
+type SpecRevision string
+
+const (
+	// SPEC_REVISION_ANY accepts every key usage and optional block of any
+	// revision, the default
+	SPEC_REVISION_ANY SpecRevision = ""
+	// SPEC_REVISION_TR31_2018 follows ASC X9 TR-31:2018
+	SPEC_REVISION_TR31_2018 SpecRevision = "TR-31:2018"
+	// SPEC_REVISION_X9_143_2021 follows ANSI X9.143-2021, which adds key usages
+	// and optional blocks and withdraws key block version A
+	SPEC_REVISION_X9_143_2021 SpecRevision = "X9.143:2021"
+)
+
+// revisionRules lists what a revision adds to the one before it and withdraws
+// from it
+type revisionRules struct {
+	previous        SpecRevision
+	keyUsages       []string
+	blocks          []string
+	removedVersions []string
+}
+
+var _revisions = map[SpecRevision]revisionRules{
+	SPEC_REVISION_TR31_2018: {
+		keyUsages: []string{
+			"B0", "B1", "B2", "C0", "D0", "D1", "D2", "E0", "E1", "E2", "E3", "E4", "E5", "E6",
+			"I0", "K0", "K1", "K2", "K3", "M0", "M1", "M2", "M3", "M4", "M5", "M6", "M7", "M8",
+			"P0", "P1", "S0", "S1", "S2", "V0", "V1", "V2", "V3", "V4",
+		},
+		blocks: []string{"CT", "HM", "IK", "KS", "KV", "PB", "TS"},
+	},
+	SPEC_REVISION_X9_143_2021: {
+		previous:        SPEC_REVISION_TR31_2018,
+		keyUsages:       []string{"B3", "D3", "E7", "K4"},
+		blocks:          []string{"AL", "BI", "DA", "KC", "KP", "LB", "TC", "WP"},
+		removedVersions: []string{TR31_VERSION_A},
+	},
+}
+
+var (
+	_specRevision    SpecRevision
+	_specRevisionMtx sync.RWMutex
+)
+
+// SetSpecRevision changes the revision Wrap and Unwrap check headers against
+// for key blocks without WithSpecRevision
+func SetSpecRevision(revision SpecRevision) {
+	_specRevisionMtx.Lock()
+	defer _specRevisionMtx.Unlock()
+	_specRevision = revision
+}
+
+// SpecRevisions lists the revisions headers can be checked against
+func SpecRevisions() []SpecRevision {
+	revisions := make([]SpecRevision, 0, len(_revisions))
+	for revision := range _revisions {
+		revisions = append(revisions, revision)
+	}
+	sort.Slice(revisions, func(i, j int) bool { return revisions[i] < revisions[j] })
+	return revisions
+}
+
+// accepts reports whether the revision, or one it builds on, defines the value
+// in the list picked from its rules, and no later revision withdrew it
+func (r SpecRevision) accepts(value string, list func(revisionRules) []string) bool {
+	for revision := r; revision != SPEC_REVISION_ANY; revision = _revisions[revision].previous {
+		for _, v := range list(_revisions[revision]) {
+			if v == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removesVersion reports whether the revision, or one it builds on, withdrew the version
+func (r SpecRevision) removesVersion(versionID string) bool {
+	for revision := r; revision != SPEC_REVISION_ANY; revision = _revisions[revision].previous {
+		for _, v := range _revisions[revision].removedVersions {
+			if v == versionID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Conforms checks the header against a revision of the standard: its key usage
+// and optional blocks must be defined by the revision, and its version must not
+// have been withdrawn. Proprietary key usages and blocks, starting with a
+// digit, conform to every revision. All problems found are returned joined, so
+// errors.As still finds a *HeaderError. SPEC_REVISION_ANY accepts any header.
+func (h *Header) Conforms(revision SpecRevision) error {
+	if revision == SPEC_REVISION_ANY {
+		return nil
+	}
+	if _, exists := _revisions[revision]; !exists {
+		return &HeaderError{Message: fmt.Sprintf(RevisionErrUnknown, revision)}
+	}
+
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, &HeaderError{Message: fmt.Sprintf(format, args...)})
+	}
+	if revision.removesVersion(h.VersionID) {
+		add(RevisionErrVersion, h.VersionID, revision)
+	}
+	usages := func(rules revisionRules) []string { return rules.keyUsages }
+	if !isProprietaryValue(h.KeyUsage) && !revision.accepts(h.KeyUsage, usages) {
+		add(RevisionErrKeyUsage, h.KeyUsage, revision)
+	}
+	ids := make([]string, 0, len(h.Blocks._blocks))
+	for id := range h.Blocks._blocks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	blocks := func(rules revisionRules) []string { return rules.blocks }
+	for _, id := range ids {
+		if !IsProprietaryBlockID(id) && !revision.accepts(id, blocks) {
+			add(RevisionErrBlock, id, revision)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,68 @@
+package tr31
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderConforms(t *testing.T) {
+	header, _ := NewHeader("D", "K4", "A", "B", "00", "E")
+	require.NoError(t, header.Blocks.Set("KP", "01ABCDEF"))
+	require.NoError(t, header.Blocks.Set("IK", "00A1B2C3D4E5F601"))
+
+	assert.Nil(t, header.Conforms(SPEC_REVISION_ANY))
+	assert.Nil(t, header.Conforms(SPEC_REVISION_X9_143_2021))
+	err := header.Conforms(SPEC_REVISION_TR31_2018)
+	assert.Equal(t, "HeaderError: Key usage (K4) is not defined by TR-31:2018.\nHeaderError: Optional block (KP) is not defined by TR-31:2018.", err.Error())
+	var headerErr *HeaderError
+	assert.True(t, errors.As(err, &headerErr))
+
+	// Proprietary usages and blocks conform to every revision
+	header, _ = NewHeader("B", "10", "T", "B", "00", "E")
+	require.NoError(t, header.Blocks.Set("01", "proprietary"))
+	assert.Nil(t, header.Conforms(SPEC_REVISION_TR31_2018))
+
+	header, _ = NewHeader("A", "D0", "T", "D", "00", "N")
+	assert.Nil(t, header.Conforms(SPEC_REVISION_TR31_2018))
+	assert.Equal(t, "HeaderError: Key block version (A) is withdrawn by X9.143:2021.", header.Conforms(SPEC_REVISION_X9_143_2021).Error())
+
+	assert.Equal(t, "HeaderError: Spec revision (X9.143:2030) is unknown.", header.Conforms("X9.143:2030").Error())
+	assert.Equal(t, []SpecRevision{SPEC_REVISION_TR31_2018, SPEC_REVISION_X9_143_2021}, SpecRevisions())
+}
+
+func TestSpecRevision_wrapUnwrap(t *testing.T) {
+	kbpk := bytes.Repeat([]byte{0x89}, 32)
+	header, _ := NewHeader("D", "D0", "A", "D", "00", "E")
+	require.NoError(t, header.Blocks.Set("TC", "20210101000000Z"))
+	kb, err := NewKeyBlock(kbpk, header)
+	require.NoError(t, err)
+	keyBlock, err := kb.Wrap(bytes.Repeat([]byte{0x3c}, 16), nil)
+	require.NoError(t, err)
+
+	// A partner on TR-31:2018 neither wraps nor unwraps blocks it doesn't define
+	kb, err = NewKeyBlock(kbpk, header, WithSpecRevision(SPEC_REVISION_TR31_2018))
+	require.NoError(t, err)
+	_, err = kb.Wrap(bytes.Repeat([]byte{0x3c}, 16), nil)
+	assert.Equal(t, "HeaderError: Optional block (TC) is not defined by TR-31:2018.", err.Error())
+	kb, _ = New(kbpk, WithSpecRevision(SPEC_REVISION_TR31_2018))
+	_, err = kb.Unwrap(keyBlock)
+	assert.Equal(t, "HeaderError: Optional block (TC) is not defined by TR-31:2018.", err.Error())
+
+	// The package revision applies to key blocks without their own
+	SetSpecRevision(SPEC_REVISION_TR31_2018)
+	defer SetSpecRevision(SPEC_REVISION_ANY)
+	assert.Equal(t, SPEC_REVISION_TR31_2018, PackagePolicy().Revision)
+	kb, _ = New(kbpk)
+	_, err = kb.Unwrap(keyBlock)
+	assert.Error(t, err)
+	kb, _ = New(kbpk, WithSpecRevision(SPEC_REVISION_X9_143_2021))
+	_, err = kb.Unwrap(keyBlock)
+	assert.NoError(t, err)
+	kb, _ = New(kbpk, WithPolicy(Policy{Revision: SPEC_REVISION_X9_143_2021}))
+	_, err = kb.Unwrap(keyBlock)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,26 @@
+package tr31
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfTest(t *testing.T) {
+	results := SelfTest()
+	require.Len(t, results, 4)
+	for _, result := range results {
+		require.True(t, result.Passed, "suite %s: %v", result.Suite, result.Failures)
+		require.NotZero(t, result.Vectors, result.Suite)
+	}
+
+	// A failing vector is reported without stopping the suite
+	result := runSelfTestSuite(SELFTEST_SUITE_KDF, 2, func(i int) error {
+		if i == 0 {
+			panic("broken primitive")
+		}
+		return nil
+	}, func(i int) string { return "vector" })
+	require.False(t, result.Passed)
+	require.Equal(t, []string{"vector: panic: broken primitive"}, result.Failures)
+}
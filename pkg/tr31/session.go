@@ -0,0 +1,148 @@
+package tr31
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+)
+
+// KeyAgreementCurve names the curves a KBPKSession agrees a KBPK over
+type KeyAgreementCurve string
+
+const (
+	// KEY_AGREEMENT_P256 is ECDH over NIST P-256
+	KEY_AGREEMENT_P256 KeyAgreementCurve = "P-256"
+	// KEY_AGREEMENT_X25519 is ECDH over Curve25519 (RFC 7748)
+	KEY_AGREEMENT_X25519 KeyAgreementCurve = "X25519"
+)
+
+// SESSION_KBPK_LENGTH is the length of the AES-256 KBPK a KBPKSession derives
+const SESSION_KBPK_LENGTH int = 32
+
+// _sessionKDFLabel prefixes the HKDF info, so the shared secret derives nothing else
+const _sessionKDFLabel = "TR-31 session KBPK"
+
+var _keyAgreementCurves = map[KeyAgreementCurve]ecdh.Curve{
+	KEY_AGREEMENT_P256:   ecdh.P256(),
+	KEY_AGREEMENT_X25519: ecdh.X25519(),
+}
+
+// KBPKSession negotiates an ephemeral KBPK with a peer, for remote key loading
+// when no static KBPK is shared yet. Each side creates a session, sends its
+// PublicKey to the other and calls Establish with the public key received.
+// Both derive the same AES-256 KBPK from the ECDH shared secret with HKDF-SHA256,
+// salted with both public keys, so the KBPK is bound to this exchange.
+type KBPKSession struct {
+	curve   KeyAgreementCurve
+	private *ecdh.PrivateKey
+	public  []byte
+	context []byte
+	kbpk    []byte
+}
+
+// NewKBPKSession generates an ephemeral key pair on the curve. context, such
+// as a session or terminal ID both sides know, is mixed into the KBPK and may
+// be empty.
+func NewKBPKSession(curve KeyAgreementCurve, context []byte) (*KBPKSession, error) {
+	c, exists := _keyAgreementCurves[curve]
+	if !exists {
+		return nil, &KeyBlockError{Message: fmt.Sprintf(SessionErrCurve, curve)}
+	}
+	private, err := c.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KBPKSession{
+		curve:   curve,
+		private: private,
+		public:  private.PublicKey().Bytes(),
+		context: append([]byte{}, context...),
+	}, nil
+}
+
+// Curve returns the curve of the session
+func (s *KBPKSession) Curve() KeyAgreementCurve {
+	return s.curve
+}
+
+// PublicKey returns the ephemeral public key sent to the peer: the uncompressed
+// point for P-256, the 32 byte u-coordinate for X25519
+func (s *KBPKSession) PublicKey() []byte {
+	return append([]byte{}, s.public...)
+}
+
+// Establish agrees the KBPK with the public key of the peer and returns a
+// version D key block context using it. The header, nil for a version D
+// default header, must be version D. The ephemeral private key is dropped, so
+// a session establishes a single KBPK.
+func (s *KBPKSession) Establish(peerPublicKey []byte, header *Header, opts ...KeyBlockOption) (*KeyBlock, error) {
+	if s.private == nil {
+		return nil, &KeyBlockError{Message: SessionErrEstablished}
+	}
+	if header == nil {
+		header = DefaultHeader()
+		header.VersionID = TR31_VERSION_D
+	}
+	if header.VersionID != TR31_VERSION_D {
+		return nil, &KeyBlockError{Message: fmt.Sprintf(SessionErrVersion, header.VersionID)}
+	}
+
+	peer, err := s.private.Curve().NewPublicKey(peerPublicKey)
+	if err != nil {
+		return nil, &KeyBlockError{Message: fmt.Sprintf(SessionErrPeerKey, err)}
+	}
+	own := s.public
+	if bytes.Equal(own, peerPublicKey) {
+		return nil, &KeyBlockError{Message: fmt.Sprintf(SessionErrPeerKey, "own public key")}
+	}
+	secret, err := s.private.ECDH(peer)
+	if err != nil {
+		return nil, &KeyBlockError{Message: fmt.Sprintf(SessionErrPeerKey, err)}
+	}
+	defer clear(secret)
+
+	// Both sides order the public keys the same way, whichever initiated
+	salt := append(append([]byte{}, own...), peerPublicKey...)
+	if bytes.Compare(own, peerPublicKey) > 0 {
+		salt = append(append([]byte{}, peerPublicKey...), own...)
+	}
+	kbpk, err := hkdf.Key(sha256.New, secret, salt, _sessionKDFLabel+"\x00"+string(s.context), SESSION_KBPK_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+	s.private = nil
+	s.kbpk = kbpk
+	return New(kbpk, append(opts[:len(opts):len(opts)], WithHeader(header))...)
+}
+
+// KCV returns the key check value of the established KBPK, which both sides
+// compare to confirm they agreed the same KBPK
+func (s *KBPKSession) KCV() (string, error) {
+	if s.kbpk == nil {
+		return "", &KeyBlockError{Message: SessionErrNotEstablished}
+	}
+	return KeyCheckValue(s.kbpk, ENC_ALGORITHM_AES)
+}
+
+// DeriveKBPKFromTLS derives an AES-256 KBPK from the keying material exported
+// (RFC 5705, RFC 8446 section 7.5) from the TLS connection carrying the key
+// blocks, so they can only be unwrapped by the peer of that connection. Both
+// sides call it with the same label, which should start with "EXPORTER-". TLS
+// 1.2 connections must have negotiated the extended master secret.
+func DeriveKBPKFromTLS(cs tls.ConnectionState, label string) ([]byte, error) {
+	if label == "" {
+		return nil, &KeyBlockError{Message: SessionErrTLSLabel}
+	}
+	if !cs.HandshakeComplete {
+		return nil, &KeyBlockError{Message: fmt.Sprintf(SessionErrTLSExport, "handshake isn't complete")}
+	}
+	kbpk, err := cs.ExportKeyingMaterial(label, nil, SESSION_KBPK_LENGTH)
+	if err != nil {
+		return nil, &KeyBlockError{Message: fmt.Sprintf(SessionErrTLSExport, err)}
+	}
+	return kbpk, nil
+}
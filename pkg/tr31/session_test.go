@@ -0,0 +1,141 @@
+package tr31
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKBPKSession(t *testing.T) {
+	for _, curve := range []KeyAgreementCurve{KEY_AGREEMENT_P256, KEY_AGREEMENT_X25519} {
+		t.Run(string(curve), func(t *testing.T) {
+			host, err := NewKBPKSession(curve, []byte("TID00042"))
+			assert.Nil(t, err)
+			device, err := NewKBPKSession(curve, []byte("TID00042"))
+			assert.Nil(t, err)
+			assert.Equal(t, curve, host.Curve())
+
+			hostKb, err := host.Establish(device.PublicKey(), nil)
+			assert.Nil(t, err)
+			header, _ := NewHeader(TR31_VERSION_D, "K0", "A", "B", "00", "N")
+			deviceKb, err := device.Establish(host.PublicKey(), header)
+			assert.Nil(t, err)
+			assert.Len(t, hostKb.kbpk, SESSION_KBPK_LENGTH)
+			assert.Equal(t, hostKb.kbpk, deviceKb.kbpk)
+
+			hostKCV, err := host.KCV()
+			assert.Nil(t, err)
+			deviceKCV, _ := device.KCV()
+			assert.Equal(t, hostKCV, deviceKCV)
+
+			// A key wrapped by one side is unwrapped by the other
+			key := bytes.Repeat([]byte{0x5A, 0xC3}, 16)
+			block, err := deviceKb.Wrap(key, nil)
+			assert.Nil(t, err)
+			assert.Equal(t, "D", block[:1])
+			unwrapped, err := hostKb.Unwrap(block)
+			assert.Nil(t, err)
+			assert.Equal(t, key, unwrapped)
+
+			// The session is single use
+			_, err = host.Establish(device.PublicKey(), nil)
+			assert.EqualError(t, err, "KeyBlockError: "+SessionErrEstablished)
+		})
+	}
+}
+
+func TestKBPKSession_boundToExchange(t *testing.T) {
+	host, _ := NewKBPKSession(KEY_AGREEMENT_X25519, []byte("session 1"))
+	device, _ := NewKBPKSession(KEY_AGREEMENT_X25519, []byte("session 2"))
+	hostKb, err := host.Establish(device.PublicKey(), nil)
+	assert.Nil(t, err)
+	deviceKb, err := device.Establish(host.PublicKey(), nil)
+	assert.Nil(t, err)
+	assert.NotEqual(t, hostKb.kbpk, deviceKb.kbpk)
+
+	_, err = NewKBPKSession("P-384", nil)
+	assert.EqualError(t, err, "KeyBlockError: Key agreement curve (P-384) is invalid. Expecting P-256 or X25519.")
+
+	session, _ := NewKBPKSession(KEY_AGREEMENT_P256, nil)
+	_, err = session.KCV()
+	assert.EqualError(t, err, "KeyBlockError: "+SessionErrNotEstablished)
+	_, err = session.Establish(session.PublicKey(), nil)
+	assert.EqualError(t, err, "KeyBlockError: Peer public key is invalid: own public key")
+	_, err = session.Establish(bytes.Repeat([]byte{0x04}, 65), nil)
+	assert.ErrorContains(t, err, "Peer public key is invalid")
+	x25519, _ := NewKBPKSession(KEY_AGREEMENT_X25519, nil)
+	_, err = session.Establish(x25519.PublicKey(), nil)
+	assert.ErrorContains(t, err, "Peer public key is invalid")
+
+	header, _ := NewHeader(TR31_VERSION_B, "K0", "T", "B", "00", "N")
+	other, _ := NewKBPKSession(KEY_AGREEMENT_P256, nil)
+	_, err = session.Establish(other.PublicKey(), header)
+	assert.EqualError(t, err, "KeyBlockError: Session key blocks must be version D. Received B.")
+}
+
+func tlsPipe(t *testing.T) (*tls.Conn, *tls.Conn) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"kdh.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	clientConn, serverConn := net.Pipe()
+	server := tls.Server(serverConn, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	client := tls.Client(clientConn, &tls.Config{RootCAs: roots, ServerName: "kdh.example"})
+	done := make(chan error)
+	go func() { done <- server.Handshake() }()
+	assert.Nil(t, client.Handshake())
+	assert.Nil(t, <-done)
+	// Closing the TLS connections would block sending close_notify on the pipe
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+	return client, server
+}
+
+func TestDeriveKBPKFromTLS(t *testing.T) {
+	client, server := tlsPipe(t)
+	const label = "EXPORTER-moov-tr31-kbpk"
+
+	clientKBPK, err := DeriveKBPKFromTLS(client.ConnectionState(), label)
+	assert.Nil(t, err)
+	serverKBPK, err := DeriveKBPKFromTLS(server.ConnectionState(), label)
+	assert.Nil(t, err)
+	assert.Len(t, clientKBPK, SESSION_KBPK_LENGTH)
+	assert.Equal(t, clientKBPK, serverKBPK)
+
+	other, _ := DeriveKBPKFromTLS(client.ConnectionState(), "EXPORTER-other")
+	assert.NotEqual(t, clientKBPK, other)
+
+	// Another connection derives another KBPK
+	client2, _ := tlsPipe(t)
+	kbpk2, _ := DeriveKBPKFromTLS(client2.ConnectionState(), label)
+	assert.NotEqual(t, clientKBPK, kbpk2)
+
+	_, err = DeriveKBPKFromTLS(client.ConnectionState(), "")
+	assert.EqualError(t, err, "KeyBlockError: "+SessionErrTLSLabel)
+	_, err = DeriveKBPKFromTLS(tls.ConnectionState{}, label)
+	assert.EqualError(t, err, "KeyBlockError: TLS keying material can't be exported: handshake isn't complete")
+}
@@ -0,0 +1,121 @@
+package tr31
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Canonical returns a deterministic serialization of the header for signing.
+// Unlike String, optional blocks are sorted by ID, the padding block is left out,
+// header fields and hex block data are upper cased, and every block is written as
+// ID, 4 hex digits of data length and data, so the output doesn't depend on the
+// order blocks were set or parsed in or on the case of hex data.
+func (h *Header) Canonical() string {
+	return h.canonical("")
+}
+
+// canonical serializes the header leaving out the block excluded, used to skip the signature block
+func (h *Header) canonical(excluded string) string {
+	var sb strings.Builder
+	sb.WriteString(strings.ToUpper(h.VersionID + h.KeyUsage + h.Algorithm + h.ModeOfUse + h.VersionNum + h.Exportability))
+
+	ids := make([]string, 0, len(h.Blocks._blocks))
+	for id := range h.Blocks._blocks {
+		if id != "PB" && id != excluded {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		data := h.Blocks._blocks[id]
+		if _hexBlocks[id] {
+			data = strings.ToUpper(data)
+		}
+		sb.WriteString(fmt.Sprintf("%s%04X%s", id, len(data), data))
+	}
+	return sb.String()
+}
+
+// _hexBlocks lists the blocks carrying hex data, which is case insensitive
+var _hexBlocks = map[string]bool{"BI": true, "HM": true, "IK": true, "KC": true, "KP": true, "KS": true}
+
+// SignHeader signs the canonical header with an external signing key and stores
+// the base64 encoded signature in the proprietary block blockID. RSA keys sign
+// with PKCS #1 v1.5 and ECDSA keys with ASN.1 signatures over SHA-256, Ed25519
+// keys sign the canonical header directly.
+func SignHeader(h *Header, signer crypto.Signer, blockID string) error {
+	if !IsProprietaryBlockID(blockID) {
+		return &HeaderError{Message: fmt.Sprintf(BlockErrorIdNotProprietary, blockID)}
+	}
+
+	signature, supported, err := signMessage(signer, []byte(h.canonical(blockID)))
+	if !supported {
+		return &HeaderError{Message: fmt.Sprintf(HeaderErrSignatureKey, signer.Public())}
+	}
+	if err != nil {
+		return err
+	}
+	return h.Blocks.Set(blockID, base64.StdEncoding.EncodeToString(signature))
+}
+
+// VerifyHeader checks the signature stored in block blockID against the canonical
+// header, ignoring the signature block itself
+func VerifyHeader(h *Header, publicKey crypto.PublicKey, blockID string) error {
+	data, err := h.Blocks.Get(blockID)
+	if err != nil {
+		return &HeaderError{Message: fmt.Sprintf(HeaderErrSignatureMissing, blockID)}
+	}
+	signature, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return &HeaderError{Message: fmt.Sprintf(HeaderErrSignatureInvalid, blockID)}
+	}
+
+	valid, supported := verifyMessage(publicKey, []byte(h.canonical(blockID)), signature)
+	if !supported {
+		return &HeaderError{Message: fmt.Sprintf(HeaderErrSignatureKey, publicKey)}
+	}
+	if !valid {
+		return &HeaderError{Message: fmt.Sprintf(HeaderErrSignatureInvalid, blockID)}
+	}
+	return nil
+}
+
+// signMessage signs message with RSA PKCS #1 v1.5 or ECDSA ASN.1 signatures over
+// its SHA-256, or with Ed25519 over the message itself. supported is false for
+// other key types.
+func signMessage(signer crypto.Signer, message []byte) (signature []byte, supported bool, err error) {
+	switch signer.Public().(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		digest := sha256.Sum256(message)
+		signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case ed25519.PublicKey:
+		signature, err = signer.Sign(rand.Reader, message, crypto.Hash(0))
+	default:
+		return nil, false, nil
+	}
+	return signature, true, err
+}
+
+// verifyMessage checks a signature made by signMessage. supported is false for
+// other key types.
+func verifyMessage(publicKey crypto.PublicKey, message, signature []byte) (valid, supported bool) {
+	digest := sha256.Sum256(message)
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil, true
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, digest[:], signature), true
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, message, signature), true
+	}
+	return false, false
+}
@@ -0,0 +1,89 @@
+package tr31
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderCanonical(t *testing.T) {
+	first, _ := NewHeader("D", "K0", "A", "B", "00", "N")
+	assert.Nil(t, first.Blocks.Set("KS", "00604b120f9292800000"))
+	assert.Nil(t, first.Blocks.Set("LB", "label"))
+
+	second, _ := NewHeader("D", "K0", "A", "B", "00", "N")
+	assert.Nil(t, second.Blocks.Set("LB", "label"))
+	assert.Nil(t, second.Blocks.Set("KS", "00604B120F9292800000"))
+
+	assert.Equal(t, "DK0AB00NKS001400604B120F9292800000LB0005label", first.Canonical())
+	assert.Equal(t, first.Canonical(), second.Canonical())
+
+	// Label data is case sensitive
+	assert.Nil(t, second.Blocks.Set("LB", "LABEL"))
+	assert.NotEqual(t, first.Canonical(), second.Canonical())
+}
+
+func TestSignVerifyHeader(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	tests := []struct {
+		name   string
+		signer crypto.Signer
+	}{
+		{"Ed25519", edKey},
+		{"ECDSA", ecKey},
+		{"RSA", rsaKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, _ := NewHeader("D", "K0", "A", "B", "00", "N")
+			assert.Nil(t, header.Blocks.Set("KS", "00604B120F9292800000"))
+			assert.Nil(t, SignHeader(header, tt.signer, "9S"))
+			assert.Nil(t, VerifyHeader(header, tt.signer.Public(), "9S"))
+
+			// The signature survives wrapping and unwrapping the key block
+			kbpk := bytes.Repeat([]byte("E"), 32)
+			kb, _ := NewKeyBlock(kbpk, header)
+			keyBlock, err := kb.Wrap(bytes.Repeat([]byte{0x11}, 16), nil)
+			assert.Nil(t, err)
+			received, _ := NewKeyBlock(kbpk, nil)
+			_, err = received.Unwrap(keyBlock)
+			assert.Nil(t, err)
+			assert.Nil(t, VerifyHeader(received.GetHeader(), tt.signer.Public(), "9S"))
+
+			// Any change to the header invalidates the signature
+			received.GetHeader().KeyUsage = "P0"
+			err = VerifyHeader(received.GetHeader(), tt.signer.Public(), "9S")
+			assert.Equal(t, "HeaderError: Header signature in block (9S) is invalid.", err.Error())
+		})
+	}
+}
+
+func TestSignVerifyHeaderErrors(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	header, _ := NewHeader("D", "K0", "A", "B", "00", "N")
+
+	err := SignHeader(header, key, "SG")
+	assert.Equal(t, "HeaderError: Block ID (SG) is not in the proprietary range. Expecting a numeric first character.", err.Error())
+
+	err = VerifyHeader(header, key.Public(), "9S")
+	assert.Equal(t, "HeaderError: Header signature block (9S) not found.", err.Error())
+
+	assert.Nil(t, header.Blocks.Set("9S", "not base64!"))
+	err = VerifyHeader(header, key.Public(), "9S")
+	assert.Equal(t, "HeaderError: Header signature in block (9S) is invalid.", err.Error())
+
+	assert.Nil(t, header.Blocks.Set("9S", "c2lnbmF0dXJl"))
+	err = VerifyHeader(header, "not a key", "9S")
+	assert.Equal(t, "HeaderError: Signing key type (string) is not supported.", err.Error())
+}
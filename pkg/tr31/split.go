@@ -0,0 +1,95 @@
+package tr31
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/moov-io/tr31/pkg/charset"
+)
+
+// SplitError reports the first malformed key block of a concatenation, which
+// starts Offset bytes into the stream, see SplitBlocks
+type SplitError struct {
+	Offset  int64
+	Message string
+}
+
+// Error method to implement the error interface for SplitError.
+func (e *SplitError) Error() string {
+	return fmt.Sprintf("SplitError: byte offset %d: %s", e.Offset, e.Message)
+}
+
+// SplitBlocks splits a file or stream of concatenated key blocks, as some hosts
+// deliver them, using the length field of each header. Whitespace and line
+// breaks between key blocks are skipped. Each key block must be ASCII printable
+// characters with a header that loads, MACs and keys aren't checked. At the
+// first malformed key block SplitBlocks returns the key blocks before it with
+// a *SplitError holding its byte offset, so the rest of the file can be
+// examined or resent.
+func SplitBlocks(r io.Reader) ([]string, error) {
+	reader := bufio.NewReader(r)
+	var blocks []string
+	var offset int64
+	for {
+		c, err := reader.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return blocks, nil
+		}
+		if err != nil {
+			return blocks, err
+		}
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			offset++
+			continue
+		}
+		reader.UnreadByte()
+
+		block, err := splitBlock(reader, offset)
+		if err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, block)
+		offset += int64(len(block))
+	}
+}
+
+// splitBlock reads the key block starting offset bytes into the stream
+func splitBlock(reader *bufio.Reader, offset int64) (string, error) {
+	fail := func(format string, args ...interface{}) error {
+		return &SplitError{Offset: offset, Message: fmt.Sprintf(format, args...)}
+	}
+
+	// The version ID and the 4 digits of the key block length
+	prefix := make([]byte, 5)
+	n, err := io.ReadFull(reader, prefix)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+	if n < len(prefix) || !charset.IsNumeric(string(prefix[1:])) {
+		return "", fail(SplitErrLength, prefix[1:max(n, 1)])
+	}
+	length, _ := strconv.Atoi(string(prefix[1:]))
+	if length < 16 {
+		return "", fail(SplitErrLengthShort, length)
+	}
+
+	block := make([]byte, length)
+	copy(block, prefix)
+	n, err = io.ReadFull(reader, block[len(prefix):])
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+	if n < length-len(prefix) {
+		return "", fail(SplitErrTruncated, length, len(prefix)+n)
+	}
+	if !charset.IsPrintable(string(block)) {
+		return "", fail(SplitErrEncoding)
+	}
+	if _, err := DefaultHeader().Load(string(block)); err != nil {
+		return "", fail(SplitErrHeader, err)
+	}
+	return string(block), nil
+}
@@ -0,0 +1,56 @@
+package tr31
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitBlocks(t *testing.T) {
+	kbpk, _ := hex.DecodeString("88E1AB2A2E3DD38C1FA039A536500CC8")
+	var wrapped []string
+	for _, header := range []string{"D0000P0AE00E0000", "D0000D0AB00N0100LB0CINST0042"} {
+		kb, err := NewKeyBlockFromString(kbpk, header)
+		require.NoError(t, err)
+		block, err := kb.Wrap([]byte("0123456789ABCDEF"), nil)
+		require.NoError(t, err)
+		wrapped = append(wrapped, block)
+	}
+
+	// Concatenated as is, or on lines of their own
+	for _, file := range []string{
+		wrapped[0] + wrapped[1],
+		wrapped[0] + "\r\n" + wrapped[1] + "\n",
+	} {
+		blocks, err := SplitBlocks(strings.NewReader(file))
+		require.NoError(t, err)
+		require.Equal(t, wrapped, blocks)
+	}
+	blocks, err := SplitBlocks(strings.NewReader(""))
+	require.NoError(t, err)
+	require.Empty(t, blocks)
+
+	malformed := []struct {
+		name, tail, message string
+	}{
+		{"length", "D00X2P0AE00E0000", "Key block length (00X2) is malformed."},
+		{"short length", "D0008P0AE00E0000", "Key block length (8) is shorter than the 16 character header."},
+		{"truncated", wrapped[1][:40], "Key block is truncated. Expecting 176 characters, received 40."},
+		{"truncated length", "D01", "Key block length (01) is malformed."},
+		{"encoding", "D0016P0AE00E\x00000", "Key block must be ASCII printable characters."},
+		{"header", "D0016P0AE00E0300", "Key block header is malformed"},
+	}
+	for _, tc := range malformed {
+		t.Run(tc.name, func(t *testing.T) {
+			prefix := wrapped[0] + "\n"
+			blocks, err := SplitBlocks(strings.NewReader(prefix + tc.tail))
+			require.Equal(t, wrapped[:1], blocks)
+			var splitErr *SplitError
+			require.ErrorAs(t, err, &splitErr)
+			require.Equal(t, int64(len(prefix)), splitErr.Offset)
+			require.Contains(t, splitErr.Message, strings.TrimSuffix(tc.message, "."))
+		})
+	}
+}
@@ -0,0 +1,34 @@
+"""Wraps keys with the psec reference implementation for the conformance tests.
+
+Reads a JSON list of cases from stdin, each with a hex "kbpk", a "header", a
+hex "key" and a "maskedKeyLen", and writes the list of wrapped key blocks to
+stdout. Random padding is replaced with the deterministic pattern used by the
+Go tests, bytes counting up from 0 on every request, so outputs compare equal.
+"""
+
+import json
+import secrets
+import sys
+
+import psec.tr31
+
+
+def pattern(n):
+    return bytes(i % 256 for i in range(n))
+
+
+secrets.token_bytes = pattern
+if hasattr(psec.tr31, "_secrets"):
+    psec.tr31._secrets.token_bytes = pattern
+
+blocks = []
+for case in json.load(sys.stdin):
+    blocks.append(
+        psec.tr31.wrap(
+            bytes.fromhex(case["kbpk"]),
+            case["header"],
+            bytes.fromhex(case["key"]),
+            case["maskedKeyLen"],
+        )
+    )
+json.dump(blocks, sys.stdout)
@@ -4,8 +4,6 @@ import (
 	"crypto/subtle"
 	"encoding/binary"
 	"fmt"
-	"regexp"
-	"unicode"
 )
 
 /*
@@ -53,26 +51,6 @@ func oddParity(v int) int {
 	return int((0x6996 >> v) & 1)
 }
 
-/*
-Check if a string is ASCII alphanumeric (A-Z, a-z, 0-9).
-
-Parameters:
-s - string to check
-
-Returns:
-True if the string is ASCII alphanumeric. False otherwise.
-*/
-// asciiAlphanumeric checks if the string contains only ASCII alphanumeric characters.
-func asciiAlphanumeric(s string) bool {
-	asciiAN := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	for _, char := range s {
-		if !contains(asciiAN, char) {
-			return false
-		}
-	}
-	return true
-}
-
 // contains checks if a character is in the provided string.
 func contains(str string, char rune) bool {
 	for _, c := range str {
@@ -83,40 +61,6 @@ func contains(str string, char rune) bool {
 	return false
 }
 
-// asciiNumeric checks if the string contains only ASCII numeric characters.
-func asciiNumeric(s string) bool {
-	for _, char := range s {
-		if !unicode.IsDigit(char) {
-			return false
-		}
-	}
-	return true
-}
-
-/*
-Check if a string is ASCII printable.
-
-Printable ASCII characters are those with hex values
-in the range 20-7E, inclusive.
-
-Parameters:
-s - string to check
-
-Returns:
-True if the string is ASCII printable. False otherwise.
-*/
-func asciiPrintable(s string) bool {
-	asciiPA := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789 " +
-		"\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~!"
-	return isSubset(s, asciiPA)
-}
-
-// Check if the string contains only valid hex characters.
-func isAsciiHex(s string) bool {
-	re := regexp.MustCompile("^[0-9A-Fa-f]+$")
-	return re.MatchString(s)
-}
-
 func bytesToInt(b []byte) int64 {
 	// Ensure the slice has at least 8 bytes for Uint64 conversion
 	if len(b) < 8 {
@@ -72,34 +72,6 @@ func TestOddParity(t *testing.T) {
 	}
 }
 
-func TestAsciiAlphanumeric(t *testing.T) {
-	tests := []struct {
-		name  string
-		input string
-		want  bool
-	}{
-		{"Empty string", "", true},                                 // No invalid characters
-		{"Lowercase letters", "hello", true},                       // All lowercase letters
-		{"Uppercase letters", "HELLO", true},                       // All uppercase letters
-		{"Numbers only", "123456", true},                           // Only numbers
-		{"Mixed alphanumeric", "Test123", true},                    // Combination of letters and numbers
-		{"Contains space", "Hello World", false},                   // Space is not allowed
-		{"Contains special characters", "abc@123", false},          // Special characters not allowed
-		{"Contains underscore", "abc_def", false},                  // Underscore is not allowed
-		{"Contains hyphen", "abc-def", false},                      // Hyphen is not allowed
-		{"Long alphanumeric string", "A1b2C3D4E5F6G7H8I9J0", true}, // Valid long alphanumeric string
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got := asciiAlphanumeric(tt.input)
-			if got != tt.want {
-				t.Errorf("asciiAlphanumeric(%q) = %v, want %v", tt.input, got, tt.want)
-			}
-		})
-	}
-}
-
 func TestContains(t *testing.T) {
 	tests := []struct {
 		name string
@@ -124,93 +96,6 @@ func TestContains(t *testing.T) {
 	}
 }
 
-func TestAsciiNumeric(t *testing.T) {
-	tests := []struct {
-		name  string
-		input string
-		want  bool
-	}{
-		{"Empty string", "", true},                          // Empty string is valid (no non-numeric chars)
-		{"Only digits", "123456", true},                     // Only digits
-		{"Digits with space", "123 456", false},             // Space is not allowed
-		{"Digits with letters", "123abc", false},            // Letters mixed with digits
-		{"Single digit", "7", true},                         // Single digit
-		{"Digits with special character", "123@456", false}, // Special character is not allowed
-		{"Alphanumeric string", "abc123", false},            // Alphanumeric string is invalid
-		{"Digits with leading zero", "01234", true},         // Leading zero should be allowed
-		{"Digits with punctuation", "12,34", false},         // Punctuation is not allowed
-		{"Valid number with digits", "999999", true},        // Valid all digits string
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got := asciiNumeric(tt.input)
-			if got != tt.want {
-				t.Errorf("asciiNumeric(%q) = %v, want %v", tt.input, got, tt.want)
-			}
-		})
-	}
-}
-
-func TestAsciiPrintable(t *testing.T) {
-	tests := []struct {
-		name  string
-		input string
-		want  bool
-	}{
-		{"Empty string", "", true},                                       // Empty string is valid
-		{"Only printable characters", "Hello World!", true},              // All characters are printable
-		{"Contains newline", "Hello\nWorld", false},                      // Contains newline, invalid
-		{"Contains tab", "Hello\tWorld", false},                          // Contains tab, invalid
-		{"Contains non-printable char", "Hello\x01World", false},         // Contains non-printable char (ASCII 1), invalid
-		{"Only digits", "1234567890", true},                              // Only digits, valid
-		{"Only lowercase letters", "abcdefghijklmnopqrstuvwxyz", true},   // Only lowercase letters, valid
-		{"Only uppercase letters", "ABCDEFGHIJKLMNOPQRSTUVWXYZ", true},   // Only uppercase letters, valid
-		{"Only punctuation", "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", true}, // Only punctuation, valid
-		{"Valid string with spaces", "Hello World", true},                // Valid string with spaces
-		{"Contains special character", "Hello@World", true},              // Valid string with special char
-		{"Invalid string with control char", "Hello\x02World", false},    // Contains control char (ASCII 2), invalid
-		{"String with numbers and letters", "abc123", true},              // Numbers and letters, valid
-		{"String with escape sequence", "Hello\\World", true},            // Escape sequence (backslash) is valid
-		{"String with some special characters", "Hello$World", true},     // Valid string with special chars
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got := asciiPrintable(tt.input)
-			if got != tt.want {
-				t.Errorf("asciiPrintable(%q) = %v, want %v", tt.input, got, tt.want)
-			}
-		})
-	}
-}
-
-func TestIsAsciiHex(t *testing.T) {
-	tests := []struct {
-		name  string
-		input string
-		want  bool
-	}{
-		{"Empty string", "", false},                      // Empty string is invalid (hex should have at least one character)
-		{"Only hex digits", "123ABC", true},              // Only valid hex digits
-		{"Only lowercase hex digits", "abcdef", true},    // Only lowercase hex digits
-		{"Only uppercase hex digits", "ABCDEF", true},    // Only uppercase hex digits
-		{"Mixed case hex digits", "aBcDeF", true},        // Mixed case, still valid
-		{"Contains non-hex character", "123GHI", false},  // Contains non-hex characters (G, H, I)
-		{"Contains spaces", "1 2 3 4", false},            // Contains spaces, invalid
-		{"Contains special characters", "123$#@", false}, // Contains special characters, invalid
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got := isAsciiHex(tt.input)
-			if got != tt.want {
-				t.Errorf("isAsciiHex(%q) = %v, want %v", tt.input, got, tt.want)
-			}
-		})
-	}
-}
-
 func TestBytesToInt(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -4,7 +4,6 @@
 package tr31
 
 import (
-	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -12,6 +11,8 @@ import (
 	"math/big"
 	"strconv"
 	"strings"
+
+	"github.com/moov-io/tr31/pkg/charset"
 )
 
 // TR-31 version identifiers
@@ -34,6 +35,10 @@ const (
 	ENC_ALGORITHM_DES string = "D"
 	// ENC_ALGORITHM_AES is AES encryption
 	ENC_ALGORITHM_AES string = "A"
+	// ENC_ALGORITHM_RSA is RSA, whose key block payload is a PKCS#8 private key
+	ENC_ALGORITHM_RSA string = "R"
+	// ENC_ALGORITHM_EC is elliptic curve, whose key block payload is a PKCS#8 private key
+	ENC_ALGORITHM_EC string = "E"
 )
 
 // Error message constants for various validation and processing errors
@@ -46,6 +51,9 @@ const (
 	BlockErrorIdMalformed          string = "Block ID (%v) is malformed."
 	BlockErrorIdInvalid            string = "Block ID (%s) is invalid. Expecting 2 alphanumeric characters."
 	BlockErrorDataInvalid          string = "Block %s data is invalid. Expecting ASCII printable characters. Data: '%s'"
+	BlockErrorDataCharset          string = "Block %s data is invalid. Expecting %s characters. Data: '%s'"
+	BlockErrorIdNotProprietary     string = "Block ID (%s) is not in the proprietary range. Expecting a numeric first character."
+	BlockErrorNoHandler            string = "Block ID (%s) has no registered proprietary handler."
 	BlockErrorDataInvalidLen       string = "Block %s data is malformed. Received %d/%d. Block data: '%s'"
 	BlockErrorLengthLong           string = "Block %s length is too long."
 	BlockErrorLenMalformed         string = "Block %s length (%s) is malformed. Expecting 2 hexchars."
@@ -56,7 +64,11 @@ const (
 	BlockErrorLengthZero           string = "Block %s length of length must not be 0."
 	BlockErrorHeaderLen            string = "Key block header length is malformed. Expecting 4 digits."
 	BlockErrorHeaderLenMalformed   string = "Key block header length (%s) is malformed. Expecting 4 digits."
+	BlockErrorMaxLen               string = "Key block length (%d) exceeds limit of %d."
 	BlockErrorHeaderLenNoMatched   string = "Key block header length (%d) doesn't match input data length (%d)."
+	BlockErrorHeaderLenDetails     string = " Input is %d characters %s. Header: '%s', key data starts at offset %d."
+	BlockErrorHeaderLenUnparsed    string = " Header can't be parsed: %v"
+	BlockErrorHeaderLenLineBreak   string = "Key block header length (%d) matches input data length (%d) without the trailing %s, likely appended by a file transfer. Strip line breaks or set LenientASCII."
 	BlockErrorHeaderLenMismatched  string = "Key block length (%d) must be multiple of %d for key block version %s."
 	BlockErrorVersion              string = "Key block version ID (%s) is not supported"
 	BlockErrorMacEncode            string = "Key block MAC must be valid hexchars. MAC: '%s'"
@@ -64,6 +76,8 @@ const (
 	BlockErrorMacNotMatched        string = "Key block MAC is not matched."
 	BlockErrorMacNotMalformed      string = "Key block MAC is malformed. Received %d bytes MAC. Expecting %d bytes for key block version %s. MAC: '%s'"
 	BlockErrorMacLenShort          string = "MacData is too short."
+	BlockErrorHeaderBoundary       string = "Key block header length (%d) must be a multiple of %d for key block version %s."
+	BlockErrorKeyDataBoundary      string = "Encrypted key length (%d hexchars) must be a multiple of the %d byte cipher block for key block version %s."
 	BlockErrorKBKPLenNotMatched    string = "KBPK length (%d) must be Double or Triple DES for key block version %s."
 	BlockErrorKBKPLenNotMatchedDES string = "KBPK length (%d) must be Single, Double or Triple DES for key block version %s."
 	BlockErrorKBKPLenNotMatchedAES string = "KBPK length (%d) must be AES-128, AES-192 or AES-256 for key block version D."
@@ -71,7 +85,36 @@ const (
 	BlockErrorDecKeyInvalid        string = "Decrypted key is invalid."
 	BlockErrorDecKeyMalformed      string = "Decrypted key is malformed."
 	BlockErrorExtraPadNegative     string = "ExtraPad cannot be negative."
+	BlockErrorDESKeyLen            string = "Key length (%d) exceeds %d bytes allowed for single DES (algorithm D)."
+	BlockErrorDESRejected          string = "Wrapping single DES (algorithm D) keys is rejected by policy."
+	BlockErrorDESKBPKRejected      string = "Single DES KBPKs (8 bytes) are rejected by policy."
+	BlockErrorWeakKeyRejected      string = "Wrapping weak, semi-weak or possibly weak DES keys is rejected by policy."
+	BlockErrorMACTruncatedRejected string = "Key block version %s MACs are truncated to %d bytes, rejected by policy requiring full-length MACs."
+	BlockErrorAESVersionRejected   string = "AES keys in key block version %s are rejected by policy requiring version D."
+	KeyErrAllZero                  string = "Key is all zeros, likely a test key."
+	KeyErrRepeatedPattern          string = "Key repeats a %d byte pattern, likely a test key."
+	KeyErrLowEntropy               string = "Key entropy (%.2f bits per byte) is below %.2f, likely a test key."
+	DeriveErrVersion               string = "Key derivation preview is for key block versions B and D. Received %s."
+	SessionErrCurve                string = "Key agreement curve (%s) is invalid. Expecting P-256 or X25519."
+	SessionErrPeerKey              string = "Peer public key is invalid: %v"
+	SessionErrVersion              string = "Session key blocks must be version D. Received %s."
+	SessionErrEstablished          string = "Session KBPK is already established, negotiate a new session."
+	SessionErrNotEstablished       string = "Session KBPK isn't established yet."
+	SessionErrTLSLabel             string = "TLS exporter label is missing."
+	SessionErrTLSExport            string = "TLS keying material can't be exported: %v"
+	MACErrPadding                  string = "Padding method (%d) is invalid. Expecting 1, 2 or 3."
+	MACErrPaddingFailed            string = "Padding failed: %v"
+	MACErrAlgorithm                string = "MAC algorithm (%d) is invalid. Expecting 1, 3 or 5."
+	MACErrCipher                   string = "Block cipher (%d) is invalid. Expecting DES or AES."
+	MACErrKeyMissing               string = "MAC key is missing."
+	MACErrKeyInvalid               string = "MAC key is invalid: %v"
+	MACErrRetailKey                string = "MAC algorithm 3 needs a 16 byte DES key. Received %d bytes."
+	MACErrCMACKey                  string = "TDES CMAC key length (%d) is invalid. Expecting 16 or 24 bytes."
+	MACErrDataEmpty                string = "Data to MAC is empty."
+	MACErrLength                   string = "MAC length (%d) is invalid. Expecting %d bytes up to the %d byte block size, or 0 for the whole block."
 	HeaderErrLoad                  string = "Failed to load header: %v"
+	HeaderErrMissing               string = "Header is missing. Pass a header or opt in to a default one with WithDefaultHeader."
+	HeaderErrType                  string = "Header must be a *Header or a header string. Received %T."
 	HeaderErrEncoding              string = "Header must be ASCII alphanumeric. Header: '%s'"
 	HeaderErrLenLimit              string = "Header length (%d) must be >=16. Header: '%s'"
 	HeaderErrKeyUsage              string = "Key usage (%s) is invalid."
@@ -79,9 +122,69 @@ const (
 	HeaderErrModeOfUse             string = "Mode of use (%s) is invalid."
 	HeaderErrVersionNumber         string = "Version number (%s) is invalid."
 	HeaderErrExportability         string = "Exportability (%s) is invalid."
-	HeaderErrBlockLenMaxOver       string = "Total key block length (%d) exceeds limit of 9999."
+	HeaderErrBlockLenMaxOver       string = "Total key block length (%d) exceeds limit of %d."
+	HeaderErrMaxLen                string = "Header data length (%d) exceeds limit of %d."
 	HeaderErrNumberOfBlock         string = "Number of blocks (%s) is invalid. Expecting 2 digits."
 	HeaderErrOutOfBounds           string = "HeaderLen is out of bounds."
+	HeaderErrSignatureMissing      string = "Header signature block (%s) not found."
+	HeaderNormalized               string = "%s (%s) normalized to (%s)."
+	KSNErrMalformed                string = "KSN (%s) is malformed. Expecting 20 hexchars for TDES DUKPT or 24 hexchars for AES DUKPT."
+	KSNErrField                    string = "KSN %s (%d) is out of range. Expecting at most %d bits."
+	KSNErrCounterBits              string = "KSN transaction counter (%d) has more than %d bits set."
+	KSNErrExhausted                string = "KSN transaction counter is exhausted."
+	KSNErrNoBlock                  string = "Header has no KS or IK block."
+	RegistryErrVersionID           string = "Version ID (%s) must be a single alphanumeric character."
+	RegistryErrSpec                string = "Key block version %s needs a block size, MAC length, wrap and unwrap functions."
+	RegistryErrDuplicate           string = "Key block version %s is already registered."
+	RegistryErrAlgorithmID         string = "Algorithm (%s) must be a single alphanumeric character."
+	RegistryErrAlgorithmMaxLen     string = "Algorithm %s needs a positive maximum key length, got %d."
+	RegistryErrAlgorithmDuplicate  string = "Algorithm %s is already registered."
+	BlockErrorAlgorithmVersion     string = "Algorithm (%s) can't be wrapped in key block version %s. Expecting one of %v."
+	BlockErrorKBPKLenVersion       string = "KBPK length (%d) is not valid for key block version %s. Expecting one of %v bytes."
+	HeaderNormalizedTrim           string = "Whitespace around key block trimmed."
+	HeaderErrSignatureInvalid      string = "Header signature in block (%s) is invalid."
+	HeaderErrSignatureKey          string = "Signing key type (%T) is not supported."
+	DeprecationSingleDES           string = "Algorithm D (single DES) is deprecated."
+	DeprecationVersionA            string = "Key block version A is deprecated."
+	DeprecationSingleDESKBPK       string = "Single DES KBPKs (8 bytes) are deprecated."
+	LogCompatibilityMode           string = "Key block version %s uses wrap options %+v instead of the version defaults %+v."
+	AuditSingleDESKBPK             string = "Single DES KBPK (%d bytes) is too weak to protect keys."
+	AuditKBPKLength                string = "KBPK length (%d) is not valid for key block version %s."
+	AuditTDESProtectingAES         string = "TDES KBPK protecting AES key."
+	AuditVariantBinding            string = "Key block version C uses variant key binding. Version B is preferred for TDES."
+	AuditExportableAnyUse          string = "Exportability E with mode of use N (no special restrictions) lets the key be exported for any use."
+	EncodingErrMalformed           string = "Key block encoding is malformed: %v"
+	EncodingErrChunkSize           string = "QR chunk size (%d) must be positive."
+	EncodingErrChunkMalformed      string = "QR chunk (%s) is malformed. Expecting TR31:<sequence>/<total>:<checksum>:<data>."
+	EncodingErrChunkMismatched     string = "QR chunk (%s) doesn't belong to the same key block."
+	EncodingErrChunkMissing        string = "QR chunk %d of %d is missing."
+	EncodingErrChecksum            string = "Key block checksum (%s) is not matched."
+	EncodingErrKeyHex              string = "Key must be an even number of hexchars. Received %d characters."
+	EncodingErrKeyBase64           string = "Key base64 is malformed: %v"
+	EncodingErrKeyEmpty            string = "Key must not be empty."
+	EncodingErrKeyLength           string = "Key length (%d) is not valid for algorithm %s. Expecting one of %v bytes."
+	AsymmetricErrPEM               string = "Private key PEM is malformed. Expecting a PRIVATE KEY block."
+	AsymmetricErrPKCS8             string = "Private key is not valid PKCS#8: %v"
+	AsymmetricErrKeyType           string = "Private key type (%s) is not supported. Expecting RSA, EC or Ed25519."
+	AsymmetricErrAlgorithm         string = "Private key type (%s) doesn't match algorithm %s. Expecting algorithm %s."
+	AsymmetricErrJWK               string = "JWK is invalid: %v"
+	KeyExchangeErrEnvelope         string = "Key exchange envelope is malformed: %v"
+	KeyExchangeErrMessage          string = "Key exchange message is invalid: %v"
+	KeyExchangeErrSigner           string = "Key exchange envelope is signed by %s key %s, not the key given."
+	KeyExchangeErrSignature        string = "Key exchange envelope signature is invalid."
+	BlockErrorEntropyUnavailable   string = "Entropy source is unavailable: %v"
+	LintErrKeyUsage                string = "Key usage (%s) is not defined by X9.143."
+	LintErrAlgorithmUsage          string = "Algorithm (%s) is not allowed for key usage %s. Expecting one of %s."
+	LintErrReserved                string = "Reserved field (%s) is invalid."
+	RevisionErrUnknown             string = "Spec revision (%s) is unknown."
+	RevisionErrKeyUsage            string = "Key usage (%s) is not defined by %s."
+	RevisionErrBlock               string = "Optional block (%s) is not defined by %s."
+	RevisionErrVersion             string = "Key block version (%s) is withdrawn by %s."
+	SplitErrLength                 string = "Key block length (%s) is malformed. Expecting 4 digits."
+	SplitErrLengthShort            string = "Key block length (%d) is shorter than the 16 character header."
+	SplitErrTruncated              string = "Key block is truncated. Expecting %d characters, received %d."
+	SplitErrEncoding               string = "Key block must be ASCII printable characters."
+	SplitErrHeader                 string = "Key block header is malformed: %v"
 )
 
 // HeaderError is a custom error type that indicates an error in processing TR-31 header data.
@@ -116,15 +219,44 @@ type Header struct {
 	// Reserved is two characters reserved for future use
 	Reserved string
 	// Blocks is a collection of optional blocks containing additional metadata
-	Blocks                   Blocks
-	_versionIDAlgoBlockSize  map[string]int // Maps version ID to algorithm block size
-	_versionIDKeyBlockMacLen map[string]int // Maps version ID to MAC length
+	Blocks         Blocks
+	parseOptions   ParseOptions // Tolerance applied when loading headers
+	normalizations []string     // Normalizations applied by the last lenient load
+	logger         Logger       // Receives parse warnings and deprecations when set
+}
+
+// DefaultMaxKeyBlockLen is the longest key block the 4 digit length field can declare
+const DefaultMaxKeyBlockLen = 9999
+
+// ParseOptions controls how tolerant loading is of malformed legacy headers
+type ParseOptions struct {
+	// LenientASCII upper cases header fields, replaces spaces padding numeric
+	// fields with zeros and trims whitespace around key blocks instead of failing
+	LenientASCII bool
+	// MaxLen bounds the length of key blocks wrapped, unwrapped and loaded,
+	// DefaultMaxKeyBlockLen when zero or larger. Longer input is rejected
+	// before it is parsed or copied.
+	MaxLen int
+}
+
+// maxLen returns the key block length limit of the options
+func (o ParseOptions) maxLen() int {
+	if o.MaxLen <= 0 || o.MaxLen > DefaultMaxKeyBlockLen {
+		return DefaultMaxKeyBlockLen
+	}
+	return o.MaxLen
 }
 
 // KeyBlock represents a complete TR-31 key block containing a wrapped key and its metadata
 type KeyBlock struct {
-	kbpk   []byte  // Key Block Protection Key used for wrapping/unwrapping
-	header *Header // Key block header containing metadata
+	kbpk        []byte        // Key Block Protection Key used for wrapping/unwrapping
+	header      *Header       // Key block header containing metadata
+	headerSet   bool          // Whether the header was supplied, defaulted or unwrapped, as Wrap requires
+	options     *WrapOptions  // Wrap options overriding the version defaults
+	macVerifier MACVerifier   // Verifies MACs instead of the KBPK when set
+	entropy     EntropySource // Supplies random padding instead of the package entropy source when set
+	policy      *Policy       // Overrides the package policies applied when wrapping when set
+	revision    *SpecRevision // Overrides the revision of the policy when set
 }
 
 // NewHeaderError creates a new HeaderError with the specified message
@@ -169,17 +301,16 @@ func (b *Blocks) Get(key string) (string, error) {
 
 // Set adds or updates a block with the given ID and data
 // Validates that the block ID is two alphanumeric characters
-// and the data contains only printable ASCII characters
+// and the data matches the character set of the block ID,
+// which defaults to printable ASCII characters
 func (b *Blocks) Set(key string, item string) error {
-	if len(key) != 2 || !asciiAlphanumeric(key) {
+	if len(key) != 2 || !charset.IsAlphanumeric(key) {
 		return &HeaderError{
 			Message: fmt.Sprintf(BlockErrorIdInvalid, key),
 		}
 	}
-	if !asciiPrintable(item) {
-		return &HeaderError{
-			Message: fmt.Sprintf(BlockErrorDataInvalid, key, item),
-		}
+	if err := validateBlockData(key, item); err != nil {
+		return err
 	}
 	b._blocks[key] = item
 	return nil
@@ -255,7 +386,7 @@ func (b *Blocks) parseExtendedLen(blockID string, blocks string, i int) (int, in
 		}
 	}
 	blockLenLenS := blocks[i : i+2]
-	if len(blockLenLenS) != 2 || !isAsciiHex(blockLenLenS) {
+	if len(blockLenLenS) != 2 || !charset.IsHex(blockLenLenS) {
 		return 0, i, &HeaderError{
 			Message: fmt.Sprintf(BlockErrorLenLenMalformed, blockID, blockLenLenS),
 		}
@@ -288,7 +419,7 @@ func (b *Blocks) parseExtendedLen(blockID string, blocks string, i int) (int, in
 	}
 	// Extract actual block length.
 	blockLenS := blocks[i : i+int(blockLenLen)]
-	if len(blockLenS) != int(blockLenLen) || !isAsciiHex(blockLenS) {
+	if len(blockLenS) != int(blockLenLen) || !charset.IsHex(blockLenS) {
 		return 0, i, &HeaderError{
 			Message: fmt.Sprintf(BlockErrorLenInvalid, blockID, blockLenS, blockLenLen),
 		}
@@ -314,7 +445,7 @@ func (b *Blocks) Load(blocksNum int, blocks string) (int, error) {
 
 	i := 0
 	for j := 0; j < blocksNum; j++ {
-		if len(blocks) < 1 {
+		if len(blocks) < i+1 {
 			return 0, &HeaderError{Message: fmt.Sprintf(BlockErrorIdMalformed, "")}
 		}
 		if len(blocks) < 2 || len(blocks[:2]) != 2 {
@@ -325,7 +456,7 @@ func (b *Blocks) Load(blocksNum int, blocks string) (int, error) {
 		}
 		blockID := blocks[i : i+2]
 		i += 2
-		if !asciiAlphanumeric(blockID) {
+		if !charset.IsAlphanumeric(blockID) {
 			return 0, &HeaderError{Message: fmt.Sprintf(BlockErrorIdInvalid, blockID)}
 		}
 		if len(blocks) < i+4 {
@@ -371,16 +502,14 @@ func (b *Blocks) Load(blocksNum int, blocks string) (int, error) {
 // DefaultHeader creates a new Header with default values
 func DefaultHeader() *Header {
 	header := &Header{
-		VersionID:                TR31_VERSION_B,
-		KeyUsage:                 "00",
-		Algorithm:                "0",
-		ModeOfUse:                "0",
-		VersionNum:               "00",
-		Exportability:            "N",
-		Reserved:                 "00",
-		Blocks:                   *NewBlocks(),
-		_versionIDAlgoBlockSize:  map[string]int{TR31_VERSION_A: 8, TR31_VERSION_B: 8, TR31_VERSION_C: 8, TR31_VERSION_D: 16},
-		_versionIDKeyBlockMacLen: map[string]int{TR31_VERSION_A: 4, TR31_VERSION_B: 8, TR31_VERSION_C: 4, TR31_VERSION_D: 16},
+		VersionID:     TR31_VERSION_B,
+		KeyUsage:      "00",
+		Algorithm:     "0",
+		ModeOfUse:     "0",
+		VersionNum:    "00",
+		Exportability: "N",
+		Reserved:      "00",
+		Blocks:        *NewBlocks(),
 	}
 	return header
 }
@@ -388,16 +517,14 @@ func DefaultHeader() *Header {
 // NewHeader creates a new Header with the specified version ID, key usage, algorithm, mode of use, version number, and exportability
 func NewHeader(versionID, keyUsage, algorithm, modeOfUse, versionNum, exportability string) (*Header, error) {
 	header := &Header{
-		VersionID:                "",
-		KeyUsage:                 "",
-		Algorithm:                "",
-		ModeOfUse:                "",
-		VersionNum:               "",
-		Exportability:            "",
-		Reserved:                 "00",
-		Blocks:                   *NewBlocks(),
-		_versionIDAlgoBlockSize:  map[string]int{TR31_VERSION_A: 8, TR31_VERSION_B: 8, TR31_VERSION_C: 8, TR31_VERSION_D: 16},
-		_versionIDKeyBlockMacLen: map[string]int{TR31_VERSION_A: 4, TR31_VERSION_B: 8, TR31_VERSION_C: 4, TR31_VERSION_D: 16},
+		VersionID:     "",
+		KeyUsage:      "",
+		Algorithm:     "",
+		ModeOfUse:     "",
+		VersionNum:    "",
+		Exportability: "",
+		Reserved:      "00",
+		Blocks:        *NewBlocks(),
 	}
 	err := header.SetVersionID(versionID)
 	if err != nil {
@@ -428,13 +555,14 @@ func NewHeader(versionID, keyUsage, algorithm, modeOfUse, versionNum, exportabil
 
 // String returns a string representation of the Header
 func (h *Header) String() string {
-	blocksNum, blocks, _ := h.Blocks.Dump(h._versionIDAlgoBlockSize[h.VersionID])
+	spec, _ := LookupVersion(h.VersionID)
+	blocksNum, blocks, _ := h.Blocks.Dump(spec.BlockSize)
 	return fmt.Sprintf("%s%04d%s%s%s%s%s%02d%s%s", h.VersionID, 16+len(blocks), h.KeyUsage, h.Algorithm, h.ModeOfUse, h.VersionNum, h.Exportability, blocksNum, h.Reserved, blocks)
 }
 
 // SetVersionID sets the version ID of the header
 func (h *Header) SetVersionID(versionID string) error {
-	if versionID != TR31_VERSION_A && versionID != TR31_VERSION_B && versionID != TR31_VERSION_C && versionID != TR31_VERSION_D {
+	if _, exists := LookupVersion(versionID); !exists {
 		return &HeaderError{Message: fmt.Sprintf(ErrVersionID, versionID)}
 	}
 	h.VersionID = versionID
@@ -443,7 +571,7 @@ func (h *Header) SetVersionID(versionID string) error {
 
 // SetKeyUsage sets the key usage of the header
 func (h *Header) SetKeyUsage(keyUsage string) error {
-	if len(keyUsage) != 2 || !asciiAlphanumeric(keyUsage) {
+	if len(keyUsage) != 2 || !charset.IsAlphanumeric(keyUsage) {
 		return &HeaderError{Message: fmt.Sprintf(HeaderErrKeyUsage, keyUsage)}
 	}
 	h.KeyUsage = keyUsage
@@ -452,7 +580,7 @@ func (h *Header) SetKeyUsage(keyUsage string) error {
 
 // SetAlgorithm sets the algorithm of the header
 func (h *Header) SetAlgorithm(algorithm string) error {
-	if len(algorithm) != 1 || !asciiAlphanumeric(algorithm) {
+	if len(algorithm) != 1 || !charset.IsAlphanumeric(algorithm) {
 		return &HeaderError{Message: fmt.Sprintf(HeaderErrAlgorithm, algorithm)}
 	}
 	h.Algorithm = algorithm
@@ -461,7 +589,7 @@ func (h *Header) SetAlgorithm(algorithm string) error {
 
 // SetModeOfUse sets the mode of use of the header
 func (h *Header) SetModeOfUse(modeOfUse string) error {
-	if len(modeOfUse) != 1 || !asciiAlphanumeric(modeOfUse) {
+	if len(modeOfUse) != 1 || !charset.IsAlphanumeric(modeOfUse) {
 		return &HeaderError{Message: fmt.Sprintf(HeaderErrModeOfUse, modeOfUse)}
 	}
 	h.ModeOfUse = modeOfUse
@@ -470,7 +598,7 @@ func (h *Header) SetModeOfUse(modeOfUse string) error {
 
 // SetVersionNum sets the version number of the header
 func (h *Header) SetVersionNum(versionNum string) error {
-	if len(versionNum) != 2 || !asciiAlphanumeric(versionNum) {
+	if len(versionNum) != 2 || !charset.IsAlphanumeric(versionNum) {
 		return &HeaderError{Message: fmt.Sprintf(HeaderErrVersionNumber, versionNum)}
 	}
 	h.VersionNum = versionNum
@@ -479,7 +607,7 @@ func (h *Header) SetVersionNum(versionNum string) error {
 
 // SetExportability sets the exportability of the header
 func (h *Header) SetExportability(exportability string) error {
-	if len(exportability) != 1 || !asciiAlphanumeric(exportability) {
+	if len(exportability) != 1 || !charset.IsAlphanumeric(exportability) {
 		return &HeaderError{Message: fmt.Sprintf(HeaderErrExportability, exportability)}
 	}
 	h.Exportability = exportability
@@ -493,14 +621,15 @@ func (h *Header) GetBlocks() map[string]string {
 
 // Dump returns a string representation of the Header
 func (h *Header) Dump(keyLen int) (string, error) {
-	algoBlockSize := h._versionIDAlgoBlockSize[h.VersionID]
+	spec, _ := LookupVersion(h.VersionID)
+	algoBlockSize := spec.BlockSize
 	padLen := algoBlockSize - ((2 + keyLen) % algoBlockSize)
 	blocksNum, blocks, _ := h.Blocks.Dump(algoBlockSize)
 
-	kbLen := 16 + 4 + (keyLen * 2) + (padLen * 2) + (h._versionIDKeyBlockMacLen[h.VersionID] * 2) + len(blocks)
+	kbLen := 16 + 4 + (keyLen * 2) + (padLen * 2) + (spec.MACLen * 2) + len(blocks)
 
-	if kbLen > 9999 {
-		return "", &HeaderError{Message: fmt.Sprintf(HeaderErrBlockLenMaxOver, kbLen)}
+	if limit := h.parseOptions.maxLen(); kbLen > limit {
+		return "", &HeaderError{Message: fmt.Sprintf(HeaderErrBlockLenMaxOver, kbLen, limit)}
 	}
 
 	return fmt.Sprintf("%s%04d%s%s%s%s%s%02d%s%s", h.VersionID, kbLen, h.KeyUsage, h.Algorithm, h.ModeOfUse, h.VersionNum, h.Exportability, blocksNum, h.Reserved, blocks), nil
@@ -508,10 +637,17 @@ func (h *Header) Dump(keyLen int) (string, error) {
 
 // Load parses a string of header data and loads it into the Header
 func (h *Header) Load(header string) (int, error) {
+	h.normalizations = nil
+	if limit := h.parseOptions.maxLen(); len(header) > limit {
+		return 0, &HeaderError{Message: fmt.Sprintf(HeaderErrMaxLen, len(header), limit)}
+	}
+	if h.parseOptions.LenientASCII && len(header) >= 16 {
+		header = h.normalize(header)
+	}
 	if len(header) < 16 {
-		return 0, &HeaderError{Message: fmt.Sprintf(HeaderErrLenLimit, len(header), header[:16])}
+		return 0, &HeaderError{Message: fmt.Sprintf(HeaderErrLenLimit, len(header), header)}
 	}
-	if !asciiAlphanumeric(header[:16]) {
+	if !charset.IsAlphanumeric(header[:16]) {
 		return 0, &HeaderError{Message: fmt.Sprintf(HeaderErrEncoding, header[:16])}
 	}
 	err := h.SetVersionID(string(header[0]))
@@ -539,8 +675,12 @@ func (h *Header) Load(header string) (int, error) {
 		return 0, err
 	}
 	h.Reserved = header[14:16]
+	for _, normalization := range h.normalizations {
+		h.log(LOG_EVENT_PARSE_WARNING, normalization)
+	}
+	h.logDeprecations()
 
-	if !asciiNumeric(header[12:14]) {
+	if !charset.IsNumeric(header[12:14]) {
 		return 0, &HeaderError{Message: fmt.Sprintf(HeaderErrNumberOfBlock, header[12:14])}
 	}
 
@@ -549,49 +689,95 @@ func (h *Header) Load(header string) (int, error) {
 	return 16 + blocksLen, err
 }
 
-var _versionIDKeyBlockMacLen = map[string]int{
-	TR31_VERSION_A: 4,
-	TR31_VERSION_B: 8,
-	TR31_VERSION_C: 4,
-	TR31_VERSION_D: 16,
+// clone copies the header, so key blocks sharing a default header don't load into each other's
+func (h *Header) clone() *Header {
+	c := *h
+	c.Blocks = *NewBlocks()
+	for id, data := range h.Blocks._blocks {
+		c.Blocks._blocks[id] = data
+	}
+	c.normalizations = nil
+	return &c
 }
 
-var _versionIDAlgoBlockSize = map[string]int{
-	TR31_VERSION_A: 8,
-	TR31_VERSION_B: 8,
-	TR31_VERSION_C: 8,
-	TR31_VERSION_D: 16,
+// SetParseOptions changes how tolerant Load is of malformed legacy headers
+func (h *Header) SetParseOptions(opts ParseOptions) {
+	h.parseOptions = opts
 }
 
-var _algoIDMaxKeyLen = map[string]int{
-	ENC_ALGORITHM_TRIPLE_DES: 24,
-	ENC_ALGORITHM_DES:        24,
-	ENC_ALGORITHM_AES:        32,
+// Normalizations lists the fixes applied to the last header loaded with LenientASCII
+func (h *Header) Normalizations() []string {
+	return h.normalizations
 }
 
-// NewKeyBlock creates a new KeyBlock with the specified Key Block Protection Key (KBPK) and header
-func NewKeyBlock(kbpk []byte, header interface{}) (*KeyBlock, error) {
-	// Validate the input for kbpk and header
-	if len(kbpk) == 0 {
-		return nil, errors.New(ErrKBPKEmpty)
+// _headerFields locates the fixed header fields normalized by lenient loading.
+// Spaces padding numeric fields are replaced with zeros.
+var _headerFields = []struct {
+	name       string
+	start, end int
+	numeric    bool
+}{
+	{"Version ID", 0, 1, false},
+	{"Key usage", 5, 7, true},
+	{"Algorithm", 7, 8, false},
+	{"Mode of use", 8, 9, false},
+	{"Version number", 9, 11, true},
+	{"Exportability", 11, 12, false},
+	{"Number of optional blocks", 12, 14, true},
+	{"Reserved field", 14, 16, true},
+}
+
+// normalize upper cases the fixed header fields and zero fills their space padding,
+// recording every change made
+func (h *Header) normalize(header string) string {
+	fixed := []byte(header[:16])
+	for _, field := range _headerFields {
+		value := string(fixed[field.start:field.end])
+		normalized := strings.ToUpper(value)
+		if field.numeric {
+			normalized = strings.ReplaceAll(normalized, " ", "0")
+		}
+		if normalized != value {
+			copy(fixed[field.start:], normalized)
+			h.normalizations = append(h.normalizations, fmt.Sprintf(HeaderNormalized, field.name, value, normalized))
+		}
 	}
+	return string(fixed) + header[16:]
+}
+
+// WrapOptions controls the wrapping details that legacy hosts disagree on
+type WrapOptions struct {
+	// MaskKeyLength pads the key to the algorithm's max key length when no masked length is given
+	MaskKeyLength bool
+	// HeaderIV uses the first 8 header bytes as CBC IV for versions A and C, otherwise a zero IV is used
+	HeaderIV bool
+	// RandomPad fills the key padding with random bytes, otherwise with zeros
+	RandomPad bool
+}
 
-	kb := &KeyBlock{
-		kbpk: kbpk,
+// DefaultWrapOptions returns the wrap options used for a version ID
+func DefaultWrapOptions(versionID string) WrapOptions {
+	if spec, exists := LookupVersion(versionID); exists {
+		return spec.WrapDefaults
 	}
+	return WrapOptions{MaskKeyLength: true, HeaderIV: true, RandomPad: true}
+}
 
-	if iheader, ok := header.(*Header); ok {
-		kb.header = iheader
-	} else if iheader, ok := header.(string); ok {
-		kb.header = DefaultHeader()
-		if len(iheader) < 5 {
-		} else if _, err := kb.header.Load(iheader); err != nil {
-			return nil, fmt.Errorf(HeaderErrLoad, err)
-		}
-	} else {
-		kb.header = DefaultHeader()
+// NewKeyBlock creates a new KeyBlock with the specified Key Block Protection Key
+// (KBPK) and header. A nil header creates a key block which can only unwrap,
+// unless WithDefaultHeader is given.
+func NewKeyBlock(kbpk []byte, h *Header, opts ...KeyBlockOption) (*KeyBlock, error) {
+	if h != nil {
+		opts = append(opts[:len(opts):len(opts)], WithHeader(h))
 	}
-	return kb, nil
+	return New(kbpk, opts...)
+}
+
+// NewKeyBlockFromString creates a new KeyBlock with the specified KBPK and the
+// header loaded from headerStr, such as "D0000P0AE00E0000". A header string
+// too short to hold a header, or which fails to load, is returned as an error.
+func NewKeyBlockFromString(kbpk []byte, headerStr string, opts ...KeyBlockOption) (*KeyBlock, error) {
+	return New(kbpk, append(opts[:len(opts):len(opts)], WithHeaderString(headerStr))...)
 }
 
 // String returns a string representation of the KeyBlock
@@ -604,51 +790,218 @@ func (kb *KeyBlock) GetHeader() *Header {
 	return kb.header
 }
 
+// SetWrapOptions overrides the version default wrap options, used for both wrapping
+// and unwrapping so key blocks of hosts with a different IV policy can be read back
+func (kb *KeyBlock) SetWrapOptions(opts WrapOptions) {
+	kb.options = &opts
+}
+
+// GetKBPK returns the Key Block Protection Key, for wrap and unwrap functions of
+// versions plugged in with RegisterVersion
+func (kb *KeyBlock) GetKBPK() []byte {
+	return kb.kbpk
+}
+
+// SetParseOptions changes how tolerant Unwrap is of malformed legacy key blocks
+func (kb *KeyBlock) SetParseOptions(opts ParseOptions) {
+	kb.header.SetParseOptions(opts)
+}
+
+// Normalizations lists the fixes applied to the last key block unwrapped with LenientASCII
+func (kb *KeyBlock) Normalizations() []string {
+	return kb.header.Normalizations()
+}
+
+// GetWrapOptions returns the wrap options in effect for the key block
+func (kb *KeyBlock) GetWrapOptions() WrapOptions {
+	if kb.options != nil {
+		return *kb.options
+	}
+	return DefaultWrapOptions(kb.header.VersionID)
+}
+
+// pad returns n bytes of key padding following the wrap options
+func (kb *KeyBlock) pad(n int) ([]byte, error) {
+	if !kb.GetWrapOptions().RandomPad {
+		return make([]byte, n), nil
+	}
+	return kb.randomBytes(n)
+}
+
+// cIV returns the CBC IV for versions A and C following the wrap options
+func (kb *KeyBlock) cIV(header string) []byte {
+	if !kb.GetWrapOptions().HeaderIV {
+		return make([]byte, 8)
+	}
+	return []byte(header[:8])
+}
+
 // Wrap encrypts a key using the KeyBlock Protection Key (KBPK) and returns the wrapped key block
 func (kb *KeyBlock) Wrap(key []byte, maskedKeyLen *int) (string, error) {
 	// Check if header version is supported
 	if kb == nil {
 		return "", fmt.Errorf(ErrNoKBPK)
 	}
-	wrapFunc, exists := _wrapDispatch[kb.header.VersionID]
+	if !kb.headerSet {
+		return "", &HeaderError{Message: HeaderErrMissing}
+	}
+	// Never emit a key block the receiving side would reject when parsing it
+	if err := kb.header.Lint(); err != nil {
+		return "", err
+	}
+	policy := kb.effectivePolicy()
+	if err := kb.header.Conforms(policy.Revision); err != nil {
+		return "", err
+	}
+	if err := checkAESKeyVersion(kb.header, policy.AESKeys); err != nil {
+		return "", err
+	}
+	spec, exists := LookupVersion(kb.header.VersionID)
 	if !exists {
 		return "", fmt.Errorf(BlockErrorVersion, kb.header.VersionID)
 	}
+	if err := spec.checkKBPK(kb.kbpk); err != nil {
+		return "", err
+	}
+	if algorithm, exists := LookupAlgorithm(kb.header.Algorithm); exists {
+		if err := algorithm.checkVersion(kb.header.VersionID); err != nil {
+			return "", err
+		}
+	}
 
-	// If maskedKeyLen is nil, use max key size for the algorithm
-	wrappedMaskedLen := 0
-	if maskedKeyLen == nil {
-		if maxLen, exists := _algoIDMaxKeyLen[kb.header.Algorithm]; exists {
-			// Use the max key length for the algorithm
-			wrappedMaskedLen = max(maxLen, len(key))
-		} else {
-			wrappedMaskedLen = len(key)
+	if kb.header.Algorithm == ENC_ALGORITHM_DES {
+		if err := checkSingleDES(key, policy.SingleDES); err != nil {
+			return "", err
 		}
-	} else {
-		wrappedMaskedLen = max(*maskedKeyLen, len(key))
 	}
-	maskedKeyLen = &wrappedMaskedLen
+	if kb.header.Algorithm == ENC_ALGORITHM_DES || kb.header.Algorithm == ENC_ALGORITHM_TRIPLE_DES {
+		if err := checkWeakKey(key, policy.WeakKeys); err != nil {
+			return "", err
+		}
+	}
+	if err := checkKeySanity(key, policy.KeySanity); err != nil {
+		return "", err
+	}
+
+	kb.header.logDeprecations()
+	kb.logCompatibility()
+
 	// Call the wrap function based on the header's versionID
-	headerDump, _ := kb.header.Dump(*maskedKeyLen)
-	wrapData, err := wrapFunc(kb, headerDump, key, *maskedKeyLen-len(key))
+	wrappedMaskedLen := kb.maskedLength(key, maskedKeyLen)
+	headerDump, err := kb.header.Dump(wrappedMaskedLen)
+	if err != nil {
+		return "", err
+	}
+	if traceEnabled {
+		kb.trace("wrap", traceText("header", headerDump))
+	}
+	wrapData, err := spec.Wrap(kb, headerDump, key, wrappedMaskedLen-len(key))
 	return wrapData, err
 }
 
+// maskedLength returns the length the key is padded to when wrapped
+func (kb *KeyBlock) maskedLength(key []byte, maskedKeyLen *int) int {
+	// If maskedKeyLen is nil, use max key size for the algorithm when the version masks key length
+	if maskedKeyLen == nil {
+		if algorithm, exists := LookupAlgorithm(kb.header.Algorithm); exists && kb.GetWrapOptions().MaskKeyLength {
+			// Use the max key length for the algorithm
+			return max(algorithm.MaxKeyLen, len(key))
+		}
+		return len(key)
+	}
+	return max(*maskedKeyLen, len(key))
+}
+
+// WrapResult is a wrapped key block with the metadata known when wrapping it
+type WrapResult struct {
+	// Block is the wrapped key block
+	Block string
+	// KCV is the key check value of the wrapped key, empty for algorithms without one
+	KCV string
+	// MAC is the key block MAC
+	MAC []byte
+	// Length is the key block length
+	Length int
+	// MaskedLen is the length the key was padded to before encryption
+	MaskedLen int
+}
+
+// WrapWithResult wraps a key like Wrap and returns the key block along with its
+// KCV, MAC and lengths, so callers can log and store them without parsing the block
+func (kb *KeyBlock) WrapWithResult(key []byte, maskedKeyLen *int) (*WrapResult, error) {
+	block, err := kb.Wrap(key, maskedKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	spec, _ := LookupVersion(kb.header.VersionID)
+	mac, err := hex.DecodeString(block[len(block)-spec.MACLen*2:])
+	if err != nil {
+		return nil, &KeyBlockError{Message: fmt.Sprintf(BlockErrorMacEncode, MaskKeyBlock(block))}
+	}
+	// Only TDES, DES and AES keys have a KCV
+	kcv, _ := KeyCheckValue(key, kb.header.Algorithm)
+	return &WrapResult{
+		Block:     block,
+		KCV:       kcv,
+		MAC:       mac,
+		Length:    len(block),
+		MaskedLen: kb.maskedLength(key, maskedKeyLen),
+	}, nil
+}
+
+// lengthMismatch describes a key block whose declared length doesn't match its
+// length: where parsing believes the key data starts, or the line break a file
+// transfer appended when the key block is otherwise intact
+func lengthMismatch(keyBlock string, keyBlockLen, headerLen int, headerErr error) string {
+	if trimmed := strings.TrimRight(keyBlock, "\r\n"); trimmed != keyBlock && len(trimmed) == keyBlockLen {
+		lineBreak := strings.NewReplacer("\r", "CR", "\n", "LF").Replace(keyBlock[len(trimmed):])
+		return fmt.Sprintf(BlockErrorHeaderLenLineBreak, keyBlockLen, len(keyBlock), lineBreak)
+	}
+
+	message := fmt.Sprintf(BlockErrorHeaderLenNoMatched, keyBlockLen, len(keyBlock))
+	if headerErr != nil {
+		return message + fmt.Sprintf(BlockErrorHeaderLenUnparsed, headerErr)
+	}
+	diff, direction := keyBlockLen-len(keyBlock), "short"
+	if diff < 0 {
+		diff, direction = -diff, "too long"
+	}
+	return message + fmt.Sprintf(BlockErrorHeaderLenDetails, diff, direction, keyBlock[:headerLen], headerLen)
+}
+
 // Unwrap decrypts a key from a wrapped key block using the KeyBlock Protection Key (KBPK)
 func (kb *KeyBlock) Unwrap(keyBlock string) ([]byte, error) {
 	if kb == nil {
 		return nil, fmt.Errorf(ErrNoKBPK)
 	}
+	trimmed := false
+	if kb.header.parseOptions.LenientASCII {
+		trimmed = strings.TrimSpace(keyBlock) != keyBlock
+		keyBlock = strings.TrimSpace(keyBlock)
+	}
+	// Reject hostile input before the header and optional blocks are parsed
+	if limit := kb.header.parseOptions.maxLen(); len(keyBlock) > limit {
+		return nil, &KeyBlockError{
+			Message: fmt.Sprintf(BlockErrorMaxLen, len(keyBlock), limit),
+		}
+	}
 	// Extract header from the key block
 	if len(keyBlock) < 5 {
 		return nil, &KeyBlockError{
 			Message: fmt.Sprintf(BlockErrorHeaderLen),
 		}
 	}
-	headerLen, _ := kb.header.Load(keyBlock)
+	headerLen, headerErr := kb.header.Load(keyBlock)
+	if headerErr == nil {
+		kb.headerSet = true
+	}
+	if trimmed {
+		kb.header.normalizations = append(kb.header.normalizations, HeaderNormalizedTrim)
+		kb.header.log(LOG_EVENT_PARSE_WARNING, HeaderNormalizedTrim)
+	}
 
 	// Verify block length
-	if !asciiNumeric(keyBlock[1:5]) {
+	if !charset.IsNumeric(keyBlock[1:5]) {
 		return nil, &KeyBlockError{
 			Message: fmt.Sprintf(BlockErrorHeaderLenMalformed, keyBlock[1:5]),
 		}
@@ -657,20 +1010,38 @@ func (kb *KeyBlock) Unwrap(keyBlock string) ([]byte, error) {
 	keyBlockLen := stringToInt(keyBlock[1:5])
 	if keyBlockLen != len(keyBlock) {
 		return nil, &KeyBlockError{
-			Message: fmt.Sprintf(BlockErrorHeaderLenNoMatched, keyBlockLen, len(keyBlock)),
+			Message: lengthMismatch(keyBlock, keyBlockLen, headerLen, headerErr),
 		}
 	}
 
 	// Check if the length is multiple of the required block size
-	blockSize := _versionIDAlgoBlockSize[kb.header.VersionID]
+	spec, _ := LookupVersion(kb.header.VersionID)
+	blockSize := spec.BlockSize
 	if len(keyBlock)%blockSize != 0 {
 		return nil, &KeyBlockError{
 			Message: fmt.Sprintf(BlockErrorHeaderLenMismatched, len(keyBlock), blockSize, kb.header.VersionID),
 		}
 	}
 
+	// Optional blocks must be parsed exactly as declared by the header,
+	// otherwise the split between header, key data and MAC can't be trusted
+	if headerErr != nil {
+		return nil, headerErr
+	}
+	policy := kb.effectivePolicy()
+	if err := kb.header.Conforms(policy.Revision); err != nil {
+		return nil, err
+	}
+	if err := checkMACLength(spec, policy.MACLength); err != nil {
+		return nil, err
+	}
+	if err := checkAESKeyVersion(kb.header, policy.AESKeys); err != nil {
+		return nil, err
+	}
+	kb.logCompatibility()
+
 	// Extract MAC from the key block
-	algoMacLen := _versionIDKeyBlockMacLen[kb.header.VersionID]
+	algoMacLen := spec.MACLen
 
 	keyBlockBytes := []byte(keyBlock)
 	if headerLen < len(keyBlockBytes) {
@@ -691,6 +1062,19 @@ func (kb *KeyBlock) Unwrap(keyBlock string) ([]byte, error) {
 				}
 			}
 
+			// The header is padded to whole cipher blocks, and so is the encrypted
+			// key between the header and the MAC
+			if headerLen%blockSize != 0 {
+				return nil, &KeyBlockError{
+					Message: fmt.Sprintf(BlockErrorHeaderBoundary, headerLen, blockSize, kb.header.VersionID),
+				}
+			}
+			if keyDataLen := len(keyBlockBytes) - headerLen - algoMacLen*2; keyDataLen%(blockSize*2) != 0 {
+				return nil, &KeyBlockError{
+					Message: fmt.Sprintf(BlockErrorKeyDataBoundary, keyDataLen, blockSize, kb.header.VersionID),
+				}
+			}
+
 			// Extract encrypted key data from the key block
 			keyDataS := keyBlockBytes[headerLen:]
 			keyDataS = keyDataS[:len(keyDataS)-algoMacLen*2]
@@ -706,14 +1090,19 @@ func (kb *KeyBlock) Unwrap(keyBlock string) ([]byte, error) {
 			}
 
 			// Call unwrap function based on version ID
-			unwrapFunc, exists := _unwrapDispatch[kb.header.VersionID]
-			if !exists {
+			if spec.Unwrap == nil {
 				return nil, &KeyBlockError{
 					Message: fmt.Sprintf(BlockErrorVersion, kb.header.VersionID),
 				}
 			}
+			if err := spec.checkKBPK(kb.kbpk); err != nil {
+				return nil, err
+			}
 
-			unwrapData, err := unwrapFunc(kb, keyBlock[:headerLen], keyData, receivedMac)
+			if traceEnabled {
+				kb.trace("unwrap", traceText("header", keyBlock[:headerLen]), traceHex("received mac", receivedMac))
+			}
+			unwrapData, err := spec.Unwrap(kb, keyBlock[:headerLen], keyData, receivedMac)
 			return unwrapData, err
 		} else {
 			// Handle case where the slice is too short
@@ -734,21 +1123,6 @@ type WrapFunc func(keyBlock *KeyBlock, header string, key []byte, extraPad int)
 // UnwrapFunc is a function type that unwraps a key from a wrapped key block using the KeyBlock Protection Key (KBPK)
 type UnwrapFunc func(keyBlock *KeyBlock, str string, data []byte, mac []byte) ([]byte, error)
 
-// Define the dispatch maps for wrap and unwrap functions
-var _wrapDispatch = map[string]WrapFunc{
-	TR31_VERSION_A: (*KeyBlock).CWrap,
-	TR31_VERSION_B: (*KeyBlock).BWrap,
-	TR31_VERSION_C: (*KeyBlock).CWrap,
-	TR31_VERSION_D: (*KeyBlock).DWrap,
-}
-
-var _unwrapDispatch = map[string]UnwrapFunc{
-	TR31_VERSION_A: (*KeyBlock).CUnwrap,
-	TR31_VERSION_B: (*KeyBlock).BUnwrap,
-	TR31_VERSION_C: (*KeyBlock).CUnwrap,
-	TR31_VERSION_D: (*KeyBlock).DUnwrap,
-}
-
 // BWrap wraps a key using the KeyBlock Protection Key (KBPK) and returns the wrapped key block
 func (kb *KeyBlock) BWrap(header string, key []byte, extraPad int) (string, error) {
 	// Ensure KBPK length is valid
@@ -768,12 +1142,9 @@ func (kb *KeyBlock) BWrap(header string, key []byte, extraPad int) (string, erro
 
 	// Format key data: 2-byte key length measured in bits + key + pad
 	padLen := 8 - ((2 + len(key) + extraPad) % 8)
-	pad := make([]byte, padLen+extraPad)
-	_, err := rand.Read(pad)
+	pad, err := kb.pad(padLen + extraPad)
 	if err != nil {
-		return "", &KeyBlockError{
-			Message: err.Error(),
-		}
+		return "", err
 	}
 
 	// Clear key data
@@ -831,6 +1202,9 @@ func (kb *KeyBlock) BDerive() ([]byte, []byte, error) {
 	if err != nil {
 		return nil, nil, err
 	}
+	if traceEnabled {
+		kb.trace("derive", traceHex("cmac subkey k1", k1))
+	}
 
 	// Produce the same number of keying material as the key's length
 	// Each call to CMAC produces 64 bits of keying material
@@ -840,7 +1214,10 @@ func (kb *KeyBlock) BDerive() ([]byte, []byte, error) {
 
 		// Encryption key
 		kdInput[1], kdInput[2] = 0x00, 0x00
-		encKey, err := GenerateCBCMAC(kb.kbpk, xor(kdInput, k1), 1, 8, DES)
+		if traceEnabled {
+			kb.trace("derive kbek", traceHex("derivation data", kdInput), traceHex("cmac input", xor(kdInput, k1)))
+		}
+		encKey, err := GenerateCBCMAC(kb.kbpk, xor(kdInput, k1), PAD_METHOD_1, 8, DES)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -848,12 +1225,18 @@ func (kb *KeyBlock) BDerive() ([]byte, []byte, error) {
 
 		// Authentication key
 		kdInput[1], kdInput[2] = 0x00, 0x01
-		authKey, err := GenerateCBCMAC(kb.kbpk, xor(kdInput, k1), 1, 8, DES)
+		if traceEnabled {
+			kb.trace("derive kbak", traceHex("derivation data", kdInput), traceHex("cmac input", xor(kdInput, k1)))
+		}
+		authKey, err := GenerateCBCMAC(kb.kbpk, xor(kdInput, k1), PAD_METHOD_1, 8, DES)
 		if err != nil {
 			return nil, nil, err
 		}
 		kbak = append(kbak, authKey...)
 	}
+	if traceEnabled {
+		kb.trace("derived", traceKCV("kbek", kbek, ENC_ALGORITHM_TRIPLE_DES), traceKCV("kbak", kbak, ENC_ALGORITHM_TRIPLE_DES))
+	}
 
 	return kbek, kbak, nil
 }
@@ -876,10 +1259,14 @@ func (kb *KeyBlock) bGenerateMac(kbak []byte, header string, keyData []byte) ([]
 	}
 
 	// Generate the CBC-MAC
-	mac, err := GenerateCBCMAC(kbak, macData, 1, 8, DES)
+	mac, err := GenerateCBCMAC(kbak, macData, PAD_METHOD_1, 8, DES)
 	if err != nil {
 		return nil, err
 	}
+	if traceEnabled {
+		// The MAC input ends with the clear key data, only its header is traced
+		kb.trace("mac", traceHex("cmac subkey k1", km1), traceText("mac input header", header), traceHex("mac", mac))
+	}
 
 	return mac, nil
 }
@@ -951,15 +1338,12 @@ func (kb *KeyBlock) BUnwrap(header string, keyData []byte, receivedMac []byte) (
 	}
 
 	// Validate MAC
-	mac, err := kb.bGenerateMac(kbak, header, clearKeyData)
+	err = kb.verifyMAC(header, clearKeyData, receivedMac, func() ([]byte, error) {
+		return kb.bGenerateMac(kbak, header, clearKeyData)
+	})
 	if err != nil {
 		return nil, err
 	}
-	if !CompareByte(mac, receivedMac) {
-		return nil, &KeyBlockError{
-			Message: BlockErrorMacNotMatched,
-		}
-	}
 
 	// Extract key from key data: 2-byte key length + key + pad
 	keyLength := binary.BigEndian.Uint16(clearKeyData[:2])
@@ -994,6 +1378,9 @@ func (kb *KeyBlock) CWrap(header string, key []byte, extraPad int) (string, erro
 			Message: fmt.Sprintf(BlockErrorKBKPLenNotMatchedDES, len(kb.kbpk), kb.header.VersionID),
 		}
 	}
+	if err := kb.checkSingleDESKBPK(); err != nil {
+		return "", err
+	}
 
 	// Derive Key Block Encryption and Authentication Keys
 	kbek, kbak, err := kb.cDerive()
@@ -1003,12 +1390,9 @@ func (kb *KeyBlock) CWrap(header string, key []byte, extraPad int) (string, erro
 
 	// Format key data: 2-byte key length measured in bits + key + pad
 	padLen := 8 - ((2 + len(key) + extraPad) % 8)
-	pad := make([]byte, padLen+extraPad)
-	_, err = rand.Read(pad)
+	pad, err := kb.pad(padLen + extraPad)
 	if err != nil {
-		return "", &KeyBlockError{
-			Message: err.Error(),
-		}
+		return "", err
 	}
 
 	// Clear key data
@@ -1018,7 +1402,7 @@ func (kb *KeyBlock) CWrap(header string, key []byte, extraPad int) (string, erro
 	copy(clearKeyData[2+len(key):], pad)
 
 	// Encrypt key data using TDES CBC
-	encKey, err := EncryptTDESCBC(kbek, []byte(header)[:8], clearKeyData)
+	encKey, err := EncryptTDESCBC(kbek, kb.cIV(header), clearKeyData)
 	if err != nil {
 		return "", err
 	}
@@ -1044,6 +1428,9 @@ func (kb *KeyBlock) cDerive() ([]byte, []byte, error) {
 	// Perform XOR operation
 	encryptionKey := xor(kb.kbpk, encryptionKeyMask)
 	authenticationKey := xor(kb.kbpk, authenticationKeyMask)
+	if traceEnabled {
+		kb.trace("derived", traceKCV("kbek", encryptionKey, ENC_ALGORITHM_TRIPLE_DES), traceKCV("kbak", authenticationKey, ENC_ALGORITHM_TRIPLE_DES))
+	}
 	return encryptionKey, authenticationKey, nil
 }
 
@@ -1051,7 +1438,11 @@ func (kb *KeyBlock) cDerive() ([]byte, []byte, error) {
 func (kb *KeyBlock) cGenerateMAC(kbak []byte, header string, keyData []byte) ([]byte, error) {
 	// Concatenate header and key data
 	data := append([]byte(header), keyData...)
-	encData, _ := GenerateCBCMAC(kbak, data, 1, 4, DES)
+	encData, _ := GenerateCBCMAC(kbak, data, PAD_METHOD_1, 4, DES)
+	if traceEnabled {
+		// The key data is encrypted, so the whole MAC input is traced
+		kb.trace("mac", traceHex("mac input", data), traceHex("mac", encData))
+	}
 	// Return the last block of the encrypted data as the MAC
 	return encData, nil
 }
@@ -1062,6 +1453,9 @@ func (kb *KeyBlock) CUnwrap(header string, keyData []byte, receivedMAC []byte) (
 	if len(kb.kbpk) != 8 && len(kb.kbpk) != 16 && len(kb.kbpk) != 24 {
 		return nil, &KeyBlockError{fmt.Sprintf(BlockErrorKBKPLenNotMatchedDES, len(kb.kbpk), kb.header.VersionID)}
 	}
+	if err := kb.checkSingleDESKBPK(); err != nil {
+		return nil, err
+	}
 
 	// Validate key data length
 	if len(keyData) < 8 || len(keyData)%8 != 0 {
@@ -1072,13 +1466,15 @@ func (kb *KeyBlock) CUnwrap(header string, keyData []byte, receivedMAC []byte) (
 	kbek, kbak, _ := kb.cDerive()
 
 	// Validate MAC
-	mac, _ := kb.cGenerateMAC(kbak, header, keyData)
-	if !compareMAC(mac, receivedMAC) {
-		return nil, &KeyBlockError{fmt.Sprintf(BlockErrorMacNotMatched)}
+	err := kb.verifyMAC(header, keyData, receivedMAC, func() ([]byte, error) {
+		return kb.cGenerateMAC(kbak, header, keyData)
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	// Decrypt key data
-	clearKeyData, err := DecryptTDESCBC(kbek, []byte(header[:8]), keyData)
+	clearKeyData, err := DecryptTDESCBC(kbek, kb.cIV(header), keyData)
 	if err != nil {
 		return nil, err
 	}
@@ -1119,12 +1515,9 @@ func (kb *KeyBlock) DWrap(header string, key []byte, extraPad int) (string, erro
 	}
 	// Format key data: 2-byte key length measured in bits + key + pad
 	padLen := 16 - ((2 + len(key) + extraPad) % 16)
-	pad := make([]byte, padLen+extraPad)
-	_, err = rand.Read(pad)
+	pad, err := kb.pad(padLen + extraPad)
 	if err != nil {
-		return "", &KeyBlockError{
-			Message: err.Error(),
-		}
+		return "", err
 	}
 
 	clearKeyData := make([]byte, 2+len(key)+len(pad))
@@ -1199,6 +1592,9 @@ func (kb *KeyBlock) dDerive() ([]byte, []byte, error) {
 	}
 
 	_, k2, _ := kb.deriveAESCMACSubkeys(kb.kbpk)
+	if traceEnabled {
+		kb.trace("derive", traceHex("cmac subkey k2", k2))
+	}
 	// Produce the same number of keying material as the key's length.
 	// Each call to CMAC produces 128 bits of keying material.
 	// AES-128 -> 1 call to CMAC  -> AES-128 KBEK/KBAK
@@ -1211,16 +1607,25 @@ func (kb *KeyBlock) dDerive() ([]byte, []byte, error) {
 		// Encryption key
 		kdInput[1] = 0x00
 		kdInput[2] = 0x00
-		encData, _ := GenerateCBCMAC(kb.kbpk, xor(kdInput, k2), 1, 16, AES)
+		if traceEnabled {
+			kb.trace("derive kbek", traceHex("derivation data", kdInput), traceHex("cmac input", xor(kdInput, k2)))
+		}
+		encData, _ := GenerateCBCMAC(kb.kbpk, xor(kdInput, k2), PAD_METHOD_1, 16, AES)
 		kbek = append(kbek, encData...)
 
 		// Authentication key
 		kdInput[1] = 0x00
 		kdInput[2] = 0x01
-		encData2, _ := GenerateCBCMAC(kb.kbpk, xor(kdInput, k2), 1, 16, AES)
+		if traceEnabled {
+			kb.trace("derive kbak", traceHex("derivation data", kdInput), traceHex("cmac input", xor(kdInput, k2)))
+		}
+		encData2, _ := GenerateCBCMAC(kb.kbpk, xor(kdInput, k2), PAD_METHOD_1, 16, AES)
 		kbak = append(kbek, encData2...)
 	}
 	cropedKbak := kbak[len(kbak)-len(kb.kbpk):]
+	if traceEnabled {
+		kb.trace("derived", traceKCV("kbek", kbek[:len(kb.kbpk)], ENC_ALGORITHM_AES), traceKCV("kbak", cropedKbak, ENC_ALGORITHM_AES))
+	}
 	return kbek[:len(kb.kbpk)], cropedKbak, nil
 }
 func (kb *KeyBlock) dGenerateMAC(kbak []byte, header, keyData []byte) ([]byte, error) {
@@ -1242,7 +1647,12 @@ func (kb *KeyBlock) dGenerateMAC(kbak []byte, header, keyData []byte) ([]byte, e
 
 	// Combine the sliced macData (without last 16 bytes) with the XORed result
 	macData = append(macData[:len(macData)-16], xored...)
-	return GenerateCBCMAC(kbak, macData, 1, 16, AES)
+	mac, err := GenerateCBCMAC(kbak, macData, PAD_METHOD_1, 16, AES)
+	if traceEnabled && err == nil {
+		// The MAC input ends with the clear key data, only its header is traced
+		kb.trace("mac", traceHex("cmac subkey k1", k1), traceText("mac input header", string(header)), traceHex("mac", mac))
+	}
+	return mac, err
 }
 func dShiftLeft1(inBytes []byte) []byte {
 	// Shift the byte array left by 1 bit
@@ -1317,9 +1727,11 @@ func (kb *KeyBlock) DUnwrap(header string, keyData, receivedMAC []byte) ([]byte,
 	}
 
 	// Validate MAC
-	mac, _ := kb.dGenerateMAC(kbak, []byte(header), clearKeyData)
-	if !CompareByte(mac, receivedMAC) {
-		return nil, &KeyBlockError{fmt.Sprintf(BlockErrorMacNotMatched)}
+	err = kb.verifyMAC(header, clearKeyData, receivedMAC, func() ([]byte, error) {
+		return kb.dGenerateMAC(kbak, []byte(header), clearKeyData)
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	// Extract key length from clear key data (2 byte key length in bits)
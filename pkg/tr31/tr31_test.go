@@ -386,6 +386,10 @@ func Test_kb_sanity(t *testing.T) {
 		{"D", bytes.Repeat([]byte("A"), 16)},
 	}
 
+	// Versions A and C accept single DES KBPKs once the policy allows them
+	SetSingleDESKBPKPolicy(SINGLE_DES_KBPK_ALLOW)
+	defer SetSingleDESKBPKPolicy(SINGLE_DES_KBPK_REJECT)
+
 	// Loop through each test case
 	for _, tt := range tests {
 		t.Run(tt.versionID, func(t *testing.T) {
@@ -457,7 +461,7 @@ func Test_kb_known_values(t *testing.T) {
 func Test_kb_init_with_raw_header(t *testing.T) {
 	data := []byte("E")
 	repeatedData := bytes.Repeat(data, 16)
-	block, _ := NewKeyBlock(repeatedData, "B0000P0TE00N0000xxxxxxxx")
+	block, _ := NewKeyBlockFromString(repeatedData, "B0000P0TE00N0000xxxxxxxx")
 	assert.Equal(t, "B", block.header.VersionID)
 	assert.Equal(t, "P0", block.header.KeyUsage)
 	assert.Equal(t, "T", block.header.Algorithm)
@@ -470,7 +474,7 @@ func Test_kb_init_with_raw_header(t *testing.T) {
 func Test_kb_init_with_raw_header_blocks(t *testing.T) {
 	data := []byte("E")
 	repeatedData := bytes.Repeat(data, 16)
-	block, _ := NewKeyBlock(repeatedData, "B0000P0TE00N0100KS1800604B120F9292800000xxxxxxxx")
+	block, _ := NewKeyBlockFromString(repeatedData, "B0000P0TE00N0100KS1800604B120F9292800000xxxxxxxx")
 	assert.Equal(t, "B", block.header.VersionID)
 	assert.Equal(t, "P0", block.header.KeyUsage)
 	assert.Equal(t, "T", block.header.Algorithm)
@@ -492,16 +496,17 @@ func Test_kb_masking_key_length(t *testing.T) {
 		masked_key_len *int
 		kb_len         int
 	}{
-		{"A", "D", 24, intPtr(24), 88},
-		{"A", "D", 16, intPtr(24), 88},
+		// Single DES keys are at most 8 bytes
+		{"A", "D", 24, intPtr(24), 0},
+		{"A", "D", 16, intPtr(24), 0},
 		{"A", "D", 8, intPtr(24), 88},
-		{"A", "D", 24, nil, 88},
-		{"A", "D", 16, nil, 88},
-		{"A", "D", 8, nil, 88},
-		{"A", "D", 16, intPtr(16), 72},
-		{"A", "D", 16, intPtr(8), 72},
-		{"A", "D", 16, intPtr(0), 72},
-		{"A", "D", 16, intPtr(-8), 72},
+		{"A", "D", 24, nil, 0},
+		{"A", "D", 16, nil, 0},
+		{"A", "D", 8, nil, 56},
+		{"A", "D", 16, intPtr(16), 0},
+		{"A", "D", 16, intPtr(8), 0},
+		{"A", "D", 16, intPtr(0), 0},
+		{"A", "D", 16, intPtr(-8), 0},
 		{"A", "D", 8, intPtr(8), 56},
 		{"A", "D", 8, intPtr(0), 56},
 
@@ -564,7 +569,7 @@ func Test_kb_masking_key_length(t *testing.T) {
 		t.Run(tt.version_id, func(t *testing.T) {
 			kbpkBytes := bytes.Repeat([]byte("E"), 24)
 			keyBytes := bytes.Repeat([]byte("F"), tt.key_len)
-			block, _ := NewKeyBlock(kbpkBytes, nil)
+			block, _ := NewKeyBlock(kbpkBytes, nil, WithDefaultHeader(nil))
 			block.header.SetVersionID(tt.version_id)
 			block.header.SetAlgorithm(tt.algorithm)
 			kb_s, _ := block.Wrap(keyBytes, tt.masked_key_len)
@@ -590,7 +595,7 @@ func Test_invalid_enctript_key_wrap(t *testing.T) {
 		t.Run(tt.versionID, func(t *testing.T) {
 			kbpkBytes := bytes.Repeat([]byte("E"), tt.kbpkLen)
 			keyBytes := bytes.Repeat([]byte("F"), tt.kbpkLen)
-			block, _ := NewKeyBlock(kbpkBytes, nil)
+			block, _ := NewKeyBlock(kbpkBytes, nil, WithDefaultHeader(nil))
 			block.header.SetVersionID(tt.versionID)
 			_, actualError := block.Wrap(keyBytes, nil)
 			assert.IsType(t, &KeyBlockError{}, actualError)
@@ -606,14 +611,14 @@ func Test_invalid_enctript_key_uwrap(t *testing.T) {
 		kb       string
 		error    string
 	}{
-		{16, "B0040P0TE00N0000", "Key block header length (40) doesn't match input data length (16)."},
+		{16, "B0040P0TE00N0000", "Key block header length (40) doesn't match input data length (16). Input is 24 characters short. Header: 'B0040P0TE00N0000', key data starts at offset 16."},
 		{16, "BX040P0TE00N0000", "Key block header length (X040) is malformed. Expecting 4 digits."},
 		{16, "A0087M3TC00E000062C2C14D8785A01A9E8283525CA96F490D0CC6346FC7C2AC1E6FF354468910379AA5BBA", "Key block length (87) must be multiple of 8 for key block version A."},
 		{16, "B0087M3TC00E000062C2C14D8785A01A9E8283525CA96F490D0CC6346FC7C2AC1E6FF354468910379AA5BBA", "Key block length (87) must be multiple of 8 for key block version B."},
 		{16, "C0087M3TC00E000062C2C14D8785A01A9E8283525CA96F490D0CC6346FC7C2AC1E6FF354468910379AA5BBA", "Key block length (87) must be multiple of 8 for key block version C."},
 		{16, "D0087M3TC00E000062C2C14D8785A01A9E8283525CA96F490D0CC6346FC7C2AC1E6FF354468910379AA5BBA", "Key block length (87) must be multiple of 16 for key block version D."},
 		{16, "A0088M3TC00E000062C2C14D8785A01A9E8283525CA96F490D0CC6346FC7C2AC1E6FF3544689103X9AA5BBA6", "Encrypted key must be valid hexchars."},
-		{16, "B0088M3TC00E000062C2C14D8785A01A9E8283525CA96F490D0CC6346FC7C2AC1E6FF35X468910379AA5BBA6", "Encrypted key must be valid hexchars."},
+		{16, "B0080M3TC00E000062C2C14D8785A01A9E8283525CA96F490D0CC6346FC7C2AX1E6FF3544689FFFF", "Encrypted key must be valid hexchars."},
 		{16, "C0088M3TC00E000062C2C14D8785A01A9E8283525CA96F490D0CC6346FC7C2AC1E6FF3544689103X9AA5BBA6", "Encrypted key must be valid hexchars."},
 		{16, "D0112P0AE00E0000DDF7B73888F22B757600010215895621B94A4E8DA57DD3E01BB66FF046A4E6BX9B8F5C30BDD3A946205FDF791C3548EC", "Encrypted key must be valid hexchars."},
 		{16, "A0024M3TC00E00009AA5BBA6", "Key block MAC must be valid hexchars. MAC: '9AA5BBA6'"},
@@ -627,7 +632,7 @@ func Test_invalid_enctript_key_uwrap(t *testing.T) {
 		{16, "D0112P0AE00E0000DDF7B73888F22B757600010215895621B94A4E8DA57DD3E01BB66FF046A4E6B89B8F5C30BDD3A946205FDF791C3548E4", "Key block MAC is not matched."},
 
 		{7, "A0088M3TC00E000062C2C14D8785A01A9E8283525CA96F490D0CC6346FC7C2AC1E6FF354468910379AA5BBA6", "KBPK length (7) must be Single, Double or Triple DES for key block version A."},
-		{8, "B0088M3TC00E000062C2C14D8785A01A9E8283525CA96F490D0CC6346FC7C2AC1E6FF354468910379AA5BBA6", "KBPK length (8) must be Double or Triple DES for key block version B."},
+		{8, "B0080M3TC00E000062C2C14D8785A01A9E8283525CA96F490D0CC6346FC7C2AC1E6FF3544689FFFF", "KBPK length (8) must be Double or Triple DES for key block version B."},
 		{7, "C0088M3TC00E000062C2C14D8785A01A9E8283525CA96F490D0CC6346FC7C2AC1E6FF354468910379AA5BBA6", "KBPK length (7) must be Single, Double or Triple DES for key block version C."},
 		{19, "D0112P0AE00E0000DDF7B73888F22B757600010215895621B94A4E8DA57DD3E01BB66FF046A4E6B89B8F5C30BDD3A946205FDF791C3548E4", "KBPK length (19) must be AES-128, AES-192 or AES-256 for key block version D."},
 
@@ -656,7 +661,7 @@ func Test_invalid_enctript_key_uwrap(t *testing.T) {
 func Test_wrap_unwrap_functions(t *testing.T) {
 	kbpk := []byte{0xAB, 0xAB, 0xAB, 0xAB, 0xAB, 0xAB, 0xAB, 0xAB, 0xAB, 0xAB, 0xAB, 0xAB, 0xAB, 0xAB, 0xAB, 0xAB}
 	key := []byte{0xCD, 0xCD, 0xCD, 0xCD, 0xCD, 0xCD, 0xCD, 0xCD, 0xCD, 0xCD, 0xCD, 0xCD, 0xCD, 0xCD, 0xCD, 0xCD}
-	kblock, _ := NewKeyBlock(kbpk, nil)
+	kblock, _ := NewKeyBlock(kbpk, nil, WithDefaultHeader(nil))
 	wrapData, _ := kblock.Wrap(key, nil)
 	keyOut, _ := kblock.Unwrap(wrapData)
 	assert.Equal(t, key, keyOut)
@@ -664,7 +669,7 @@ func Test_wrap_unwrap_functions(t *testing.T) {
 func Test_wrap_unwrap_header_functions(t *testing.T) {
 	kbpk := []byte{0xEF, 0xEF, 0xEF, 0xEF, 0xAB, 0xAB, 0xAB, 0xAB, 0xAB, 0xEF, 0xEF, 0xEF, 0xEF, 0xEF, 0xEF, 0xEF}
 	key := []byte{0x55, 0x55, 0x55, 0x55, 0xCD, 0xCD, 0xCD, 0xCD, 0xCD, 0xCD, 0xCD, 0x55, 0x55, 0x55, 0x55, 0x55}
-	kblock, _ := NewKeyBlock(kbpk, nil)
+	kblock, _ := NewKeyBlock(kbpk, nil, WithDefaultHeader(nil))
 	wrapData, _ := kblock.Wrap(key, nil)
 	keyOut, _ := kblock.Unwrap(wrapData)
 
@@ -698,3 +703,304 @@ func Test_Unexpected_Input_UnWrap(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Equal(t, "KB is not supported", err.Error())
 }
+
+func Test_unwrap_header_boundary(t *testing.T) {
+	kbpk := bytes.Repeat([]byte("E"), 16)
+	rawKb := "B0120P0TE00N0100KS1800604B120F929280000061ae81b41d3cff6db07690c27316fdf4de475e0735780eae5859c72ed20ceec865b57b578c18940d"
+
+	testCases := []struct {
+		name  string
+		kb    string
+		error string
+	}{
+		{
+			"Declared one block less",
+			rawKb[:12] + "00" + rawKb[14:],
+			"KeyBlockError: Encrypted key length (88 hexchars) must be a multiple of the 8 byte cipher block for key block version B.",
+		},
+		{
+			"Optional blocks not padded to cipher block",
+			"B0048P0TE00N0100KS0A123456AAAAAA0123456789ABCDEF",
+			"KeyBlockError: Key block header length (26) must be a multiple of 8 for key block version B.",
+		},
+		{
+			"Encrypted key not padded to cipher block",
+			"B0040P0TE00E0000AAAAAAAA0123456789ABCDEF",
+			"KeyBlockError: Encrypted key length (8 hexchars) must be a multiple of the 8 byte cipher block for key block version B.",
+		},
+		{
+			"Declared one block more",
+			rawKb[:12] + "02" + rawKb[14:],
+			"HeaderError: Block 61 data is malformed. Received 76/170. Block data: '" + rawKb[44:] + "'",
+		},
+		{
+			"Header shorter than 16 characters",
+			"B0015P0TE00N000",
+			"KeyBlockError: Key block length (15) must be multiple of 8 for key block version B.",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			block, _ := NewKeyBlock(kbpk, nil)
+			_, err := block.Unwrap(tc.kb)
+			assert.NotNil(t, err)
+			if err != nil {
+				assert.Equal(t, tc.error, err.Error())
+			}
+		})
+	}
+
+	block, _ := NewKeyBlock(kbpk, nil)
+	keyOut, err := block.Unwrap(rawKb)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("F"), 16), keyOut)
+}
+
+func FuzzUnwrap(f *testing.F) {
+	kbpk := bytes.Repeat([]byte("E"), 16)
+	f.Add("A0088M3TC00E000022BD7EC46BBE2A6A73389D1BA6DB63120B386F912839F4679C0523399E4D8D0F1D9A356E")
+	f.Add("B0120P0TE00N0100KS1800604B120F929280000061ae81b41d3cff6db07690c27316fdf4de475e0735780eae5859c72ed20ceec865b57b578c18940d")
+	f.Add("D0112D0AD00E00009ef4ff063d9757987d1768a1e317a6530de7d8ac81972c19a3659afb28e8d35f48aaa5b0f124e73893163e9a020ae5f3")
+	f.Add("B0040P0TE00N000")
+	f.Add("D0048P0AE00E0100KS0800")
+
+	f.Fuzz(func(t *testing.T, keyBlock string) {
+		block, _ := NewKeyBlock(kbpk, nil)
+		if _, err := block.Unwrap(keyBlock); err != nil {
+			return
+		}
+		// A successful unwrap means every part of the input was accounted for
+		if stringToInt(keyBlock[1:5]) != len(keyBlock) {
+			t.Errorf("unwrapped %q with mismatched declared length", keyBlock)
+		}
+	})
+}
+
+func TestWrapOptions(t *testing.T) {
+	kbpk := bytes.Repeat([]byte("E"), 16)
+	key := bytes.Repeat([]byte{0x11}, 16)
+
+	// Version A doesn't mask key length by default, version C does
+	for _, tc := range []struct {
+		versionID string
+		length    int
+	}{
+		{"A", 72},
+		{"C", 88},
+	} {
+		header, _ := NewHeader(tc.versionID, "P0", "T", "E", "00", "N")
+		kb, _ := NewKeyBlock(kbpk, header)
+		assert.Equal(t, DefaultWrapOptions(tc.versionID), kb.GetWrapOptions())
+		rawKb, err := kb.Wrap(key, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.length, len(rawKb))
+	}
+
+	// Zero pad and zero IV make the key block deterministic and readable back
+	// only with the same options
+	opts := WrapOptions{MaskKeyLength: true, HeaderIV: false, RandomPad: false}
+	header, _ := NewHeader("A", "P0", "T", "E", "00", "N")
+	kb, _ := NewKeyBlock(kbpk, header)
+	kb.SetWrapOptions(opts)
+	first, err := kb.Wrap(key, nil)
+	assert.Nil(t, err)
+	second, err := kb.Wrap(key, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, first, second)
+	assert.Equal(t, 88, len(first))
+
+	received, _ := NewKeyBlock(kbpk, nil)
+	received.SetWrapOptions(opts)
+	keyOut, err := received.Unwrap(first)
+	assert.Nil(t, err)
+	assert.Equal(t, key, keyOut)
+
+	received, _ = NewKeyBlock(kbpk, nil)
+	keyOut, err = received.Unwrap(first)
+	if err == nil {
+		assert.NotEqual(t, key, keyOut)
+	}
+}
+
+func TestUnwrapLenientASCII(t *testing.T) {
+	kbpk := bytes.Repeat([]byte("E"), 16)
+	key := bytes.Repeat([]byte{0x11}, 16)
+	header, _ := NewHeader("B", "P0", "T", "E", "00", "N")
+	kb, _ := NewKeyBlock(kbpk, header)
+
+	// A legacy emitter sending a lowercase version ID and space padded version number
+	headerDump, _ := header.Dump(24)
+	legacyHeader := "b" + headerDump[1:5] + "p0TE 0n" + headerDump[12:]
+	legacyKb, err := kb.BWrap(legacyHeader, key, 8)
+	assert.Nil(t, err)
+
+	received, _ := NewKeyBlock(kbpk, nil)
+	_, err = received.Unwrap(legacyKb + "\n")
+	assert.NotNil(t, err)
+
+	received.SetParseOptions(ParseOptions{LenientASCII: true})
+	keyOut, err := received.Unwrap(legacyKb + "\n")
+	assert.Nil(t, err)
+	assert.Equal(t, key, keyOut)
+	assert.Equal(t, "B", received.GetHeader().VersionID)
+	assert.Equal(t, "P0", received.GetHeader().KeyUsage)
+	assert.Equal(t, "00", received.GetHeader().VersionNum)
+	assert.Equal(t, []string{
+		"Version ID (b) normalized to (B).",
+		"Key usage (p0) normalized to (P0).",
+		"Version number ( 0) normalized to (00).",
+		"Exportability (n) normalized to (N).",
+		"Whitespace around key block trimmed.",
+	}, received.Normalizations())
+
+	// A well formed key block needs no normalization
+	wellFormed, _ := kb.Wrap(key, nil)
+	_, err = received.Unwrap(wellFormed)
+	assert.Nil(t, err)
+	assert.Empty(t, received.Normalizations())
+}
+
+func TestUnwrapMaxLen(t *testing.T) {
+	kbpk := bytes.Repeat([]byte("E"), 16)
+	key := bytes.Repeat([]byte{0x11}, 16)
+	header, _ := NewHeader("D", "P0", "A", "E", "00", "N")
+	kb, _ := NewKeyBlock(kbpk, header)
+	wrapped, err := kb.Wrap(key, nil)
+	assert.Nil(t, err)
+
+	// A multi-megabyte "key block" is rejected before its header is parsed
+	received, _ := New(kbpk)
+	_, err = received.Unwrap(wrapped[:16] + strings.Repeat("0", 4<<20))
+	var kbErr *KeyBlockError
+	assert.ErrorAs(t, err, &kbErr)
+	assert.Equal(t, fmt.Sprintf(BlockErrorMaxLen, 16+4<<20, DefaultMaxKeyBlockLen), kbErr.Message)
+
+	limited, _ := New(kbpk, WithMaxLen(len(wrapped)-1), WithLenientParsing())
+	_, err = limited.Unwrap(wrapped)
+	assert.ErrorAs(t, err, &kbErr)
+	assert.Equal(t, fmt.Sprintf(BlockErrorMaxLen, len(wrapped), len(wrapped)-1), kbErr.Message)
+	limited.SetParseOptions(ParseOptions{MaxLen: len(wrapped)})
+	keyOut, err := limited.Unwrap(wrapped)
+	assert.Nil(t, err)
+	assert.Equal(t, key, keyOut)
+
+	// Wrapping can't produce a key block over the limit either
+	small, _ := New(kbpk, WithHeader(header), WithMaxLen(64))
+	_, err = small.Wrap(key, nil)
+	var headerErr *HeaderError
+	assert.ErrorAs(t, err, &headerErr)
+	assert.Equal(t, fmt.Sprintf(HeaderErrBlockLenMaxOver, len(wrapped), 64), headerErr.Message)
+
+	loaded := DefaultHeader()
+	loaded.SetParseOptions(ParseOptions{MaxLen: 32})
+	_, err = loaded.Load(wrapped)
+	assert.ErrorAs(t, err, &headerErr)
+	assert.Equal(t, fmt.Sprintf(HeaderErrMaxLen, len(wrapped), 32), headerErr.Message)
+}
+
+func TestWrapWithResult(t *testing.T) {
+	kbpk := bytes.Repeat([]byte("E"), 16)
+	key := bytes.Repeat([]byte{0x11}, 16)
+
+	for _, tc := range []struct {
+		versionID string
+		algorithm string
+		macLen    int
+		maskedLen int
+	}{
+		{"B", "T", 8, 24},
+		{"D", "A", 16, 32},
+		{"A", "T", 4, 16},
+	} {
+		header, _ := NewHeader(tc.versionID, "P0", tc.algorithm, "E", "00", "N")
+		kb, _ := NewKeyBlock(kbpk, header)
+		result, err := kb.WrapWithResult(key, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, len(result.Block), result.Length)
+		assert.Equal(t, tc.maskedLen, result.MaskedLen)
+		assert.Equal(t, tc.macLen, len(result.MAC))
+		assert.Equal(t, strings.ToUpper(hex.EncodeToString(result.MAC)), strings.ToUpper(result.Block[result.Length-tc.macLen*2:]))
+
+		kcv, _ := KeyCheckValue(key, tc.algorithm)
+		assert.Equal(t, kcv, result.KCV)
+	}
+
+	// Keys without a KCV algorithm still wrap
+	header, _ := NewHeader("D", "S0", "R", "S", "00", "N")
+	kb, _ := NewKeyBlock(bytes.Repeat([]byte("E"), 32), header)
+	result, err := kb.WrapWithResult(key, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, result.KCV)
+
+	kb, _ = NewKeyBlock(bytes.Repeat([]byte("E"), 8), header)
+	_, err = kb.WrapWithResult(key, nil)
+	assert.NotNil(t, err)
+}
+
+func TestNewKeyBlockHeaderDefaults(t *testing.T) {
+	kbpk := bytes.Repeat([]byte("E"), 16)
+	key := bytes.Repeat([]byte("F"), 16)
+
+	// short header strings are rejected instead of silently using a default header
+	for _, header := range []string{"", "B00"} {
+		_, err := NewKeyBlockFromString(kbpk, header)
+		assert.Equal(t, &HeaderError{Message: HeaderErrMissing}, err)
+	}
+
+	// without a header the key block unwraps, but doesn't wrap
+	kb, err := NewKeyBlock(kbpk, nil)
+	assert.NoError(t, err)
+	_, err = kb.Wrap(key, nil)
+	assert.Equal(t, &HeaderError{Message: HeaderErrMissing}, err)
+
+	defaultHeader, _ := NewHeader(TR31_VERSION_D, "K0", "A", "B", "00", "N")
+	opted, err := NewKeyBlockFromString(kbpk, "", WithDefaultHeader(defaultHeader))
+	assert.NoError(t, err)
+	wrapped, err := opted.Wrap(key, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "D0144K0AB00N0000", wrapped[:16])
+
+	// the unwrapped header becomes the header of the key block, wrapping again works
+	unwrapped, err := kb.Unwrap(wrapped)
+	assert.NoError(t, err)
+	assert.Equal(t, key, unwrapped)
+	_, err = kb.Wrap(key, nil)
+	assert.NoError(t, err)
+
+	// each key block gets its own copy of the default header
+	assert.NotSame(t, defaultHeader, opted.GetHeader())
+	opted.GetHeader().SetKeyUsage("D0")
+	assert.Equal(t, "K0", defaultHeader.KeyUsage)
+
+	fallback, err := NewKeyBlock(kbpk, nil, WithDefaultHeader(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultHeader().String(), fallback.GetHeader().String())
+}
+
+func TestUnwrapLengthMismatchDiagnostics(t *testing.T) {
+	kbpk := bytes.Repeat([]byte("E"), 16)
+	header, _ := NewHeader(TR31_VERSION_B, "P0", ENC_ALGORITHM_TRIPLE_DES, "E", "00", "N")
+	header.Blocks.Set("KS", "00604B120F9292800000")
+	kb, _ := NewKeyBlock(kbpk, header)
+	block, err := kb.Wrap(bytes.Repeat([]byte("F"), 16), nil)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name     string
+		keyBlock string
+		message  string
+	}{
+		{"CRLF appended", block + "\r\n", "Key block header length (120) matches input data length (122) without the trailing CRLF, likely appended by a file transfer. Strip line breaks or set LenientASCII."},
+		{"LF appended", block + "\n", "Key block header length (120) matches input data length (121) without the trailing LF, likely appended by a file transfer. Strip line breaks or set LenientASCII."},
+		{"Truncated", block[:96], "Key block header length (120) doesn't match input data length (96). Input is 24 characters short. Header: '" + block[:40] + "', key data starts at offset 40."},
+		{"Extra data", block + "00", "Key block header length (120) doesn't match input data length (122). Input is 2 characters too long. Header: '" + block[:40] + "', key data starts at offset 40."},
+		{"Header unparsed", "B0104P0TE00N01", "Key block header length (104) doesn't match input data length (14). Header can't be parsed: HeaderError: Header length (14) must be >=16. Header: 'B0104P0TE00N01'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received, _ := NewKeyBlock(kbpk, nil)
+			_, err := received.Unwrap(tt.keyBlock)
+			assert.Equal(t, &KeyBlockError{Message: tt.message}, err)
+		})
+	}
+}
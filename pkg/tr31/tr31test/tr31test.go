@@ -0,0 +1,127 @@
+// Package tr31test provides generators of valid random key block inputs and
+// assertions for property testing configurations built on the tr31 package.
+package tr31test
+
+import (
+	"bytes"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+)
+
+var (
+	_versionIDs     = []string{tr31.TR31_VERSION_A, tr31.TR31_VERSION_B, tr31.TR31_VERSION_C, tr31.TR31_VERSION_D}
+	_keyUsages      = []string{"B0", "B1", "D0", "K0", "K1", "M3", "P0", "V1"}
+	_tdesOnlyUsages = []string{"M3", "V1"}
+	_modesOfUse     = []string{"B", "C", "D", "E", "G", "N", "S", "T", "V", "X", "Y"}
+	_exportability  = []string{"E", "N", "S"}
+	_labelCharset   = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789 -_."
+	_keyLengths     = map[string][]int{tr31.ENC_ALGORITHM_TRIPLE_DES: {16, 24}, tr31.ENC_ALGORITHM_DES: {8}, tr31.ENC_ALGORITHM_AES: {16, 24, 32}}
+	_algorithms     = []string{tr31.ENC_ALGORITHM_TRIPLE_DES, tr31.ENC_ALGORITHM_AES}
+	_maxLabelLength = 32
+)
+
+// RandomHeader returns a valid header with random version, attributes and an optional label block.
+// Single DES keys are left out since wrapping them depends on the single DES policy.
+func RandomHeader(r *rand.Rand) *tr31.Header {
+	keyUsage, algorithm := pick(r, _keyUsages), pick(r, _algorithms)
+	// MAC and PIN verification keys of these usages can't be AES keys
+	if slices.Contains(_tdesOnlyUsages, keyUsage) {
+		algorithm = tr31.ENC_ALGORITHM_TRIPLE_DES
+	}
+	header, err := tr31.NewHeader(
+		pick(r, _versionIDs),
+		keyUsage,
+		algorithm,
+		pick(r, _modesOfUse),
+		"00",
+		pick(r, _exportability),
+	)
+	if err != nil {
+		panic(err)
+	}
+	if r.Intn(2) == 0 {
+		label := make([]byte, 1+r.Intn(_maxLabelLength))
+		for i := range label {
+			label[i] = _labelCharset[r.Intn(len(_labelCharset))]
+		}
+		if err := header.Blocks.Set("LB", string(label)); err != nil {
+			panic(err)
+		}
+	}
+	return header
+}
+
+// RandomKBPK returns a random KBPK of a length valid for the key block version.
+// Single DES KBPKs are only returned when the package policy allows them.
+func RandomKBPK(r *rand.Rand, versionID string) []byte {
+	spec, _ := tr31.LookupVersion(versionID)
+	lengths := spec.KBPKLengths
+	if tr31.PackagePolicy().SingleDESKBPK == tr31.SINGLE_DES_KBPK_REJECT {
+		lengths = slices.DeleteFunc(slices.Clone(lengths), func(length int) bool { return length == 8 })
+	}
+	return randomBytes(r, pickInt(r, lengths))
+}
+
+// RandomKey returns a random key of a length valid for the algorithm
+func RandomKey(r *rand.Rand, algorithm string) []byte {
+	return randomBytes(r, pickInt(r, _keyLengths[algorithm]))
+}
+
+// RoundTrip wraps the key with the header and KBPK, unwraps the key block with a
+// KeyBlock knowing only the KBPK and fails the test unless the key and the header
+// come back unchanged. It returns the key block for further checks.
+func RoundTrip(t testing.TB, kbpk []byte, header *tr31.Header, key []byte) string {
+	t.Helper()
+
+	kb, err := tr31.New(kbpk, tr31.WithHeader(header))
+	if err != nil {
+		t.Fatalf("creating key block: %v", err)
+	}
+	keyBlock, err := kb.Wrap(key, nil)
+	if err != nil {
+		t.Fatalf("wrapping key with header %s: %v", header.Canonical(), err)
+	}
+
+	received, err := tr31.New(kbpk)
+	if err != nil {
+		t.Fatalf("creating key block: %v", err)
+	}
+	unwrapped, err := received.Unwrap(keyBlock)
+	if err != nil {
+		t.Fatalf("unwrapping key block %s: %v", keyBlock, err)
+	}
+	if !bytes.Equal(key, unwrapped) {
+		t.Fatalf("key block %s unwrapped to a different key", keyBlock)
+	}
+	if got, want := received.GetHeader().Canonical(), header.Canonical(); got != want {
+		t.Fatalf("key block %s unwrapped to header %s, expecting %s", keyBlock, got, want)
+	}
+	return keyBlock
+}
+
+// CheckRoundTrip runs RoundTrip for n random headers, KBPKs and keys drawn from r
+func CheckRoundTrip(t testing.TB, r *rand.Rand, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		header := RandomHeader(r)
+		RoundTrip(t, RandomKBPK(r, header.VersionID), header, RandomKey(r, header.Algorithm))
+	}
+}
+
+func pick(r *rand.Rand, values []string) string {
+	return values[r.Intn(len(values))]
+}
+
+func pickInt(r *rand.Rand, values []int) int {
+	return values[r.Intn(len(values))]
+}
+
+func randomBytes(r *rand.Rand, length int) []byte {
+	data := make([]byte, length)
+	r.Read(data)
+	return data
+}
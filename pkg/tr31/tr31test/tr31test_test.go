@@ -0,0 +1,33 @@
+package tr31test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/moov-io/tr31/pkg/tr31"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRandomInputs(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		header := RandomHeader(r)
+		assert.Contains(t, _versionIDs, header.VersionID)
+		spec, _ := tr31.LookupVersion(header.VersionID)
+		assert.Contains(t, spec.KBPKLengths, len(RandomKBPK(r, header.VersionID)))
+		assert.Contains(t, _keyLengths[header.Algorithm], len(RandomKey(r, header.Algorithm)))
+	}
+	assert.Len(t, RandomKey(r, tr31.ENC_ALGORITHM_DES), 8)
+}
+
+func TestCheckRoundTrip(t *testing.T) {
+	CheckRoundTrip(t, rand.New(rand.NewSource(1)), 500)
+}
+
+func TestRoundTrip(t *testing.T) {
+	header, _ := tr31.NewHeader("D", "K0", "A", "B", "00", "N")
+	assert.Nil(t, header.Blocks.Set("KS", "00604B120F9292800000"))
+	r := rand.New(rand.NewSource(1))
+	keyBlock := RoundTrip(t, RandomKBPK(r, "D"), header, RandomKey(r, "A"))
+	assert.Equal(t, "D", keyBlock[:1])
+}
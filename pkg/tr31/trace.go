@@ -0,0 +1,124 @@
+package tr31
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing reports the derivation data, CMAC subkeys, MAC inputs and headers of
+// wrapping and unwrapping to the key block Logger as LOG_EVENT_TRACE events, to
+// compare them with the traces of HSM vendors when debugging interoperability.
+// It only exists in builds with the tr31trace tag:
+//
+//	go build -tags tr31trace
+//
+// Traces never carry the clear key, the KBPK or the derived KBEK and KBAK: the
+// derived keys are reported by their KCV, MAC inputs covering the clear key
+// data by their header, and any KBPK bytes left in a trace are redacted.
+
+// DEFAULT_TRACE_RATE is the number of trace events reported per second by default
+const DEFAULT_TRACE_RATE = 100
+
+// traceRedacted replaces the KBPK in trace events
+const traceRedacted = "<redacted>"
+
+var (
+	_traceMtx     sync.Mutex
+	_traceRate    = DEFAULT_TRACE_RATE
+	_traceWindow  time.Time
+	_traceCount   int
+	_traceDropped int
+)
+
+// SetTraceRate changes the number of trace events reported per second, events
+// past it are dropped and counted in the next one reported. Zero or less
+// restores DEFAULT_TRACE_RATE.
+func SetTraceRate(perSecond int) {
+	_traceMtx.Lock()
+	defer _traceMtx.Unlock()
+	if perSecond <= 0 {
+		perSecond = DEFAULT_TRACE_RATE
+	}
+	_traceRate = perSecond
+}
+
+// TraceEnabled reports whether the package was built with the tr31trace tag
+func TraceEnabled() bool {
+	return traceEnabled
+}
+
+// traceValue is a named value of a trace event
+type traceValue struct {
+	name  string
+	value string
+}
+
+func traceHex(name string, data []byte) traceValue {
+	return traceValue{name: name, value: strings.ToUpper(hex.EncodeToString(data))}
+}
+
+func traceText(name, text string) traceValue {
+	return traceValue{name: name, value: text}
+}
+
+// traceKCV reports a derived key by its key check value
+func traceKCV(name string, key []byte, algorithm string) traceValue {
+	kcv, err := KeyCheckValue(key, algorithm)
+	if err != nil {
+		kcv = "n/a"
+	}
+	return traceValue{name: name + " kcv", value: kcv}
+}
+
+// traceAllowed counts an event against the rate, it returns false for events
+// to drop and the number of events dropped since the last one reported
+func traceAllowed(now time.Time) (bool, int) {
+	_traceMtx.Lock()
+	defer _traceMtx.Unlock()
+	if now.Sub(_traceWindow) >= time.Second {
+		_traceWindow, _traceCount = now, 0
+	}
+	if _traceCount >= _traceRate {
+		_traceDropped++
+		return false, 0
+	}
+	_traceCount++
+	dropped := _traceDropped
+	_traceDropped = 0
+	return true, dropped
+}
+
+// trace reports a step of wrapping or unwrapping to the key block logger.
+// Callers check traceEnabled first, so the values aren't computed otherwise.
+func (kb *KeyBlock) trace(step string, values ...traceValue) {
+	if !traceEnabled || kb.header.logger == nil {
+		return
+	}
+	allowed, dropped := traceAllowed(time.Now())
+	if !allowed {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s:", kb.header.VersionID, step)
+	for _, v := range values {
+		fmt.Fprintf(&b, " %s=%s", v.name, v.value)
+	}
+	if dropped > 0 {
+		fmt.Fprintf(&b, " (%d trace events dropped)", dropped)
+	}
+	kb.header.log(LOG_EVENT_TRACE, redactTrace(b.String(), kb.kbpk))
+}
+
+// redactTrace removes the hex, upper or lower case, of the secret from the message
+func redactTrace(message string, secret []byte) string {
+	if len(bytes.TrimLeft(secret, "\x00")) == 0 {
+		return message
+	}
+	encoded := hex.EncodeToString(secret)
+	message = strings.ReplaceAll(message, encoded, traceRedacted)
+	return strings.ReplaceAll(message, strings.ToUpper(encoded), traceRedacted)
+}
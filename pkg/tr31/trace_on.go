@@ -0,0 +1,6 @@
+//go:build tr31trace
+
+package tr31
+
+// traceEnabled reports the steps of wrapping and unwrapping, see trace.go
+const traceEnabled = true
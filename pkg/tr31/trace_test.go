@@ -0,0 +1,97 @@
+package tr31
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTrace_redaction runs in both builds, go test -tags tr31trace checks the
+// traces never carry the clear key, the KBPK or the derived keys
+func TestTrace_redaction(t *testing.T) {
+	SetTraceRate(10000)
+	defer SetTraceRate(0)
+
+	cases := []struct {
+		version, algorithm string
+		kbpk               []byte
+		derive             func(kb *KeyBlock) ([]byte, []byte, error)
+	}{
+		{TR31_VERSION_A, "T", bytes.Repeat([]byte{0x13, 0x57}, 8), (*KeyBlock).cDerive},
+		{TR31_VERSION_B, "T", bytes.Repeat([]byte{0x24, 0x68, 0xAC}, 8), (*KeyBlock).BDerive},
+		{TR31_VERSION_C, "T", bytes.Repeat([]byte{0x35, 0x79}, 8), (*KeyBlock).cDerive},
+		{TR31_VERSION_D, "A", bytes.Repeat([]byte{0x46, 0x8A, 0xCE, 0x02}, 8), (*KeyBlock).dDerive},
+	}
+	key := bytes.Repeat([]byte{0xE1, 0xD2, 0xC3, 0xB4}, 4)
+	for _, c := range cases {
+		header, err := NewHeader(c.version, "D0", c.algorithm, "D", "00", "E")
+		require.NoError(t, err)
+		var entries []logEntry
+		kb, err := NewKeyBlock(c.kbpk, header, WithLogger(recordLogs(&entries)))
+		require.NoError(t, err)
+		keyBlock, err := kb.Wrap(key, nil)
+		require.NoError(t, err, c.version)
+		unwrapped, err := kb.Unwrap(keyBlock)
+		require.NoError(t, err, c.version)
+		require.Equal(t, key, unwrapped)
+
+		derived, _ := NewKeyBlock(c.kbpk, header)
+		kbek, kbak, err := c.derive(derived)
+		require.NoError(t, err)
+		secrets := [][]byte{c.kbpk, key, kbek, kbak}
+
+		var traces int
+		for _, entry := range entries {
+			if entry.event != LOG_EVENT_TRACE {
+				continue
+			}
+			traces++
+			for _, secret := range secrets {
+				encoded := hex.EncodeToString(secret)
+				message := strings.ToLower(entry.message)
+				require.NotContains(t, message, encoded, "%s trace leaks a secret: %s", c.version, entry.message)
+				// nor 8 byte halves of them, which DES traces would show
+				require.NotContains(t, message, encoded[:16], "%s trace leaks a secret: %s", c.version, entry.message)
+			}
+		}
+		if TraceEnabled() {
+			assert.NotZero(t, traces, c.version)
+		} else {
+			assert.Zero(t, traces, c.version)
+		}
+	}
+}
+
+func TestRedactTrace(t *testing.T) {
+	kbpk := []byte{0xAB, 0xCD, 0xEF, 0x01}
+	assert.Equal(t, "x=<redacted> y=<redacted>", redactTrace("x=ABCDEF01 y=abcdef01", kbpk))
+	assert.Equal(t, "x=0000", redactTrace("x=0000", []byte{0, 0}))
+}
+
+func TestTraceAllowed(t *testing.T) {
+	SetTraceRate(2)
+	defer func() {
+		SetTraceRate(0)
+		_traceWindow, _traceCount, _traceDropped = time.Time{}, 0, 0
+	}()
+
+	now := time.Now().Add(time.Hour)
+	allowed, _ := traceAllowed(now)
+	assert.True(t, allowed)
+	allowed, _ = traceAllowed(now)
+	assert.True(t, allowed)
+	allowed, _ = traceAllowed(now)
+	assert.False(t, allowed)
+	allowed, _ = traceAllowed(now)
+	assert.False(t, allowed)
+
+	// The next window reports the events dropped
+	allowed, dropped := traceAllowed(now.Add(time.Second))
+	assert.True(t, allowed)
+	assert.Equal(t, 2, dropped)
+}
@@ -0,0 +1,40 @@
+package tr31
+
+import (
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestImports_wasm keeps the core packages buildable for WebAssembly: they import
+// only the standard library and each other, and nothing reaching the process or
+// the network, so the browser inspector in cmd/tr31wasm keeps building
+func TestImports_wasm(t *testing.T) {
+	denied := []string{"os", "os/exec", "net", "syscall", "unsafe", "plugin"}
+	for _, dir := range []string{".", "../charset", "../card", "../emv"} {
+		files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+		require.NoError(t, err)
+		for _, file := range files {
+			if strings.HasSuffix(file, "_test.go") {
+				continue
+			}
+			f, err := parser.ParseFile(token.NewFileSet(), file, nil, parser.ImportsOnly)
+			require.NoError(t, err)
+			for _, spec := range f.Imports {
+				path, _ := strconv.Unquote(spec.Path.Value)
+				first, _, _ := strings.Cut(path, "/")
+				if strings.Contains(first, ".") {
+					require.True(t, strings.HasPrefix(path, "github.com/moov-io/tr31/pkg/"), "%s imports %s", file, path)
+				}
+				for _, d := range denied {
+					require.False(t, path == d || strings.HasPrefix(path, d+"/"), "%s imports %s", file, path)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package tr31
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// WeakKeyPolicy controls wrapping DES and TDES keys listed as weak
+type WeakKeyPolicy int
+
+const (
+	// WEAK_KEY_ALLOW wraps weak keys, the default
+	WEAK_KEY_ALLOW WeakKeyPolicy = iota
+	// WEAK_KEY_REJECT refuses to wrap weak keys, which HSMs reject on import anyway
+	WEAK_KEY_REJECT
+)
+
+var (
+	_weakKeyPolicy WeakKeyPolicy
+	_weakKeyMtx    sync.RWMutex
+)
+
+// SetWeakKeyPolicy changes how Wrap handles DES and TDES keys with a weak, semi-weak
+// or possibly weak DES key part
+func SetWeakKeyPolicy(policy WeakKeyPolicy) {
+	_weakKeyMtx.Lock()
+	defer _weakKeyMtx.Unlock()
+	_weakKeyPolicy = policy
+}
+
+// _weakDESKeys lists the 4 weak, 12 semi-weak and 48 possibly weak DES keys
+// (FIPS 74, NIST SP 800-67) with their parity bits cleared
+var _weakDESKeys = func() map[uint64]bool {
+	keys := []uint64{
+		// Weak keys
+		0x0101010101010101, 0xFEFEFEFEFEFEFEFE, 0xE0E0E0E0F1F1F1F1, 0x1F1F1F1F0E0E0E0E,
+		// Semi-weak key pairs
+		0x011F011F010E010E, 0x1F011F010E010E01,
+		0x01E001E001F101F1, 0xE001E001F101F101,
+		0x01FE01FE01FE01FE, 0xFE01FE01FE01FE01,
+		0x1FE01FE00EF10EF1, 0xE01FE01FF10EF10E,
+		0x1FFE1FFE0EFE0EFE, 0xFE1FFE1FFE0EFE0E,
+		0xE0FEE0FEF1FEF1FE, 0xFEE0FEE0FEF1FEF1,
+		// Possibly weak keys
+		0x1F1F01010E0E0101, 0x011F1F01010E0E01, 0x1F01011F0E01010E, 0x01011F1F01010E0E,
+		0xE0E00101F1F10101, 0xFEFE0101FEFE0101, 0xFEE01F01FEF10E01, 0xE0FE1F01F1FE0E01,
+		0xFEE0011FFEF1010E, 0xE0FE011FF1FE010E, 0xE0E01F1FF1F10E0E, 0xFEFE1F1FFEFE0E0E,
+		0xFE1FE001FE0EF101, 0xE01FFE01F10EFE01, 0xFE01E01FFE01F10E, 0xE001FE1FF101FE0E,
+		0x01E0E00101F1F101, 0x1FFEE0010EFEF001, 0x1FE0FE010EF1FE01, 0x01FEFE0101FEFE01,
+		0x1FE0E01F0EF1F10E, 0x01FEE01F01FEF10E, 0x01E0FE1F01F1FE0E, 0x1FFEFE1F0EFEFE0E,
+		0xE00101E0F10101F1, 0xFE1F01E0FE0E01F1, 0xFE011FE0FE010EF1, 0xE01F1FE0F10E0EF1,
+		0xFE0101FEFE0101FE, 0xE01F01FEF10E01FE, 0xE0011FFEF1010EFE, 0xFE1F1FFEFE0E0EFE,
+		0x1FFE01E00EFE01F0, 0x01FE1FE001FE0EF1, 0x1FE001FE0EF101FE, 0x01E01FFE01F10EFE,
+		0x0101E0E00101F1F1, 0x1F1FE0E00E0EF1F1, 0x1F01FEE00E01FEF1, 0x011FFEE0010EFEF1,
+		0x1F01E0FE0E01F1FE, 0x011FE0FE010EF1FE, 0x0101FEFE0101FEFE, 0x1F1FFEFE0E0EFEFE,
+		0xFEFEE0E0FEFEF1F1, 0xE0FEFEE0F1FEFEF1, 0xFEE0E0FEFEF1F1FE, 0xE0E0FEFEF1F1FEFE,
+	}
+	weak := make(map[uint64]bool, len(keys))
+	for _, key := range keys {
+		weak[key&_desParityMask] = true
+	}
+	return weak
+}()
+
+// _desParityMask clears the parity bit of every byte of a DES key
+const _desParityMask uint64 = 0xFEFEFEFEFEFEFEFE
+
+// IsWeakDESKey reports whether the key is, or a part of a TDES key is, a weak,
+// semi-weak or possibly weak DES key. Parity bits are ignored. Keys which aren't
+// a multiple of 8 bytes are never weak.
+func IsWeakDESKey(key []byte) bool {
+	if len(key) == 0 || len(key)%8 != 0 {
+		return false
+	}
+	for i := 0; i < len(key); i += 8 {
+		if _weakDESKeys[binary.BigEndian.Uint64(key[i:i+8])&_desParityMask] {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWeakKey applies the weak key policy before wrapping a DES or TDES key
+func checkWeakKey(key []byte, policy WeakKeyPolicy) error {
+	if policy == WEAK_KEY_REJECT && IsWeakDESKey(key) {
+		return &KeyBlockError{Message: BlockErrorWeakKeyRejected}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package tr31
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsWeakDESKey(t *testing.T) {
+	for _, tc := range []struct {
+		key  string
+		weak bool
+	}{
+		{"0101010101010101", true},
+		{"0000000000000000", true}, // parity bits are ignored
+		{"E0E0E0E0F1F1F1F1", true},
+		{"01FE01FE01FE01FE", true},
+		{"1F1F01010E0E0101", true},
+		{"0123456789ABCDEF", false},
+		{"0123456789ABCDEF0101010101010101", true},
+		{"0123456789ABCDEFFEDCBA9876543210", false},
+		{"0101", false},
+	} {
+		key, _ := hex.DecodeString(tc.key)
+		assert.Equal(t, tc.weak, IsWeakDESKey(key), tc.key)
+	}
+	assert.Len(t, _weakDESKeys, 64)
+}
+
+func TestWeakKeyPolicy(t *testing.T) {
+	header, _ := NewHeader("B", "D0", "T", "D", "00", "N")
+	kb, _ := NewKeyBlock(bytes.Repeat([]byte("E"), 24), header)
+	weak := append(bytes.Repeat([]byte{0x11}, 8), bytes.Repeat([]byte{0xFE}, 8)...)
+
+	_, err := kb.Wrap(weak, nil)
+	assert.Nil(t, err)
+
+	SetWeakKeyPolicy(WEAK_KEY_REJECT)
+	defer SetWeakKeyPolicy(WEAK_KEY_ALLOW)
+	_, err = kb.Wrap(weak, nil)
+	assert.Equal(t, "KeyBlockError: Wrapping weak, semi-weak or possibly weak DES keys is rejected by policy.", err.Error())
+
+	_, err = kb.Wrap(bytes.Repeat([]byte{0x11, 0x22}, 8), nil)
+	assert.Nil(t, err)
+
+	// AES keys aren't DES keys
+	header, _ = NewHeader("D", "D0", "A", "D", "00", "E")
+	kb, _ = NewKeyBlock(bytes.Repeat([]byte("E"), 32), header)
+	_, err = kb.Wrap(bytes.Repeat([]byte{0x01}, 16), nil)
+	assert.Nil(t, err)
+}